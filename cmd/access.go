@@ -66,6 +66,16 @@ var deleteAccess = &cobra.Command{
 	RunE:  accessDelete,
 }
 
+// renameAccess do rename of an access rule
+var renameAccess = &cobra.Command{
+	Use:   "access old new",
+	Short: "Rename a recipient access rule in the database.",
+	Long: `Rename the rule. The addresses and domains that use it keep using it.
+The new name must also replace the old one in smtpd_restriction_classes in main.cf.`,
+	Args: cobra.ExactArgs(2),
+	RunE: accessRename,
+}
+
 // editAccess edit an access rule
 var editAccess = &cobra.Command{
 	Use:   "access name",
@@ -90,6 +100,7 @@ func init() {
 	exportCmd.AddCommand(exportAccess)
 	addCmd.AddCommand(addAccess)
 	deleteCmd.AddCommand(deleteAccess)
+	renameCmd.AddCommand(renameAccess)
 	editCmd.AddCommand(editAccess)
 	editAccess.Flags().StringVarP(&accessAction, "action", "r", "",
 		"Access rule action value used by Postfix to process client access restrictions")
@@ -97,22 +108,23 @@ func init() {
 }
 
 // accessImport
-func accessImport(cmd *cobra.Command, args []string) error {
-	var err error
-
-	mdb.Begin()
-	defer mdb.End(&err)
+func accessImport(cmd *cobra.Command, args []string) (err error) {
+	tx, err := mdb.BeginContext(cmd.Context())
+	if err != nil {
+		return err
+	}
+	defer tx.End(&err)
 
-	err = procImport(cmd, SIMPLE, procAccess)
+	err = procImport(cmd, tx, SIMPLE, procAccess)
 	return err
 }
 
 // procAccess
-func procAccess(tokens []string) error {
+func procAccess(tx *maildb.Tx, tokens []string) error {
 	if len(tokens) <= 1 {
 		return fmt.Errorf("Access rule has no recipient restriction key")
 	}
-	_, err := mdb.InsertAccess(tokens[0], tokens[1])
+	_, err := tx.InsertAccess(tokens[0], tokens[1])
 	return err
 }
 
@@ -128,7 +140,7 @@ func accessExport(cmd *cobra.Command, args []string) error {
 	default:
 		return fmt.Errorf("Only one access rule name can be specified")
 	}
-	al, err := mdb.FindAccess(name)
+	al, err := mdb.FindAccessContext(cmd.Context(), name)
 	if err == nil {
 		for _, ac := range al {
 			cmd.Printf("%s\n", ac.Export())
@@ -138,31 +150,42 @@ func accessExport(cmd *cobra.Command, args []string) error {
 }
 
 // accessAdd
-func accessAdd(cmd *cobra.Command, args []string) error {
-	var err error
-
-	mdb.Begin()
-	defer mdb.End(&err)
+func accessAdd(cmd *cobra.Command, args []string) (err error) {
+	tx, err := mdb.BeginContext(cmd.Context())
+	if err != nil {
+		return err
+	}
+	defer tx.End(&err)
 
-	return procAccess(args)
+	return procAccess(tx, args)
 }
 
 // accessDelete
 func accessDelete(cmd *cobra.Command, args []string) error {
-	return mdb.DeleteAccess(args[0])
+	return mdb.WithTxContext(cmd.Context(), func(tx *maildb.Tx) error {
+		return tx.DeleteAccess(args[0])
+	})
+}
+
+// accessRename
+func accessRename(cmd *cobra.Command, args []string) error {
+	return mdb.WithTxContext(cmd.Context(), func(tx *maildb.Tx) error {
+		_, err := tx.RenameAccess(args[0], args[1])
+		return err
+	})
 }
 
 // accessEdit
-func accessEdit(cmd *cobra.Command, args []string) error {
-	var (
-		err error
-		ac  *maildb.Access
-	)
+func accessEdit(cmd *cobra.Command, args []string) (err error) {
+	var ac *maildb.Access
 
-	mdb.Begin()
-	defer mdb.End(&err)
+	tx, err := mdb.BeginContext(cmd.Context())
+	if err != nil {
+		return err
+	}
+	defer tx.End(&err)
 
-	ac, err = mdb.GetAccess(args[0])
+	ac, err = tx.GetAccess(args[0])
 	if err == nil {
 		if cmd.Flags().Changed("action") {
 			err = ac.SetAction(accessAction)
@@ -179,7 +202,7 @@ func accessShow(cmd *cobra.Command, args []string) error {
 		err error
 		ac  *maildb.Access
 	)
-	if ac, err = mdb.LookupAccess(args[0]); err != nil {
+	if ac, err = mdb.LookupAccessContext(cmd.Context(), args[0]); err != nil {
 		return err
 	}
 	cmd.Printf("Name:\t%s\nAction:\t%s\n", ac.Name(), ac.Action())
@@ -135,12 +135,25 @@ func TestAccess(t *testing.T) {
 	}
 
 	// edit spam but forget the action option
-	// doctor accessAction to reset state. Use empty string to force an empty string error
-	accessAction = ""
 	args = []string{"-d", dbfile, "edit", "access", "spam"}
 	out, errout, err = doTest(rootCmd, "", args)
 	if err == nil {
 		t.Errorf("Edit spam without action option should have failed")
+	} else if !strings.Contains(err.Error(), "action option for access edit not set") {
+		t.Errorf("Edit spam without action option got unexpected error, %s", err)
+	}
+	if out == "" {
+		t.Errorf("Edit spam without action option should have generated output")
+	}
+	if errout == "" {
+		t.Errorf("Edit spam without action option should have generated error output")
+	}
+
+	// edit spam with an empty action
+	args = []string{"-d", dbfile, "edit", "access", "spam", "-r", ""}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err == nil {
+		t.Errorf("Edit spam without action should have failed")
 	} else if err != maildb.ErrMdbAccessBadAction {
 		t.Errorf("Edit spam without action got unexpected error, %s", err)
 	}
@@ -112,25 +112,26 @@ func init() {
 }
 
 // addressImport the addresss from inFile
-func addressImport(cmd *cobra.Command, args []string) error {
-	var err error
-
-	mdb.Begin()
-	defer mdb.End(&err)
+func addressImport(cmd *cobra.Command, args []string) (err error) {
+	tx, err := mdb.BeginContext(cmd.Context())
+	if err != nil {
+		return err
+	}
+	defer tx.End(&err)
 
-	err = procImport(cmd, POSTFIX, procAddress)
+	err = procImport(cmd, tx, POSTFIX, procAddress)
 	return err
 }
 
 // procAddress
 // options are "option=XXX"
-func procAddress(tokens []string) error {
+func procAddress(tx *maildb.Tx, tokens []string) error {
 	var (
 		a   *maildb.Address
 		err error
 	)
 
-	if a, err = mdb.InsertAddress(tokens[0]); err != nil {
+	if a, err = tx.InsertAddress(tokens[0]); err != nil {
 		return err
 	}
 	if len(tokens) > 1 {
@@ -167,7 +168,7 @@ func addressExport(cmd *cobra.Command, args []string) error {
 	default:
 		return fmt.Errorf("Only one address can be specified")
 	}
-	al, err := mdb.FindAddress(address)
+	al, err := mdb.FindAddressContext(cmd.Context(), address)
 	if err == nil {
 		for _, a := range al {
 			cmd.Printf("%s\n", a.Export())
@@ -177,16 +178,16 @@ func addressExport(cmd *cobra.Command, args []string) error {
 }
 
 // addressAdd the address and its class
-func addressAdd(cmd *cobra.Command, args []string) error {
-	var (
-		a   *maildb.Address
-		err error
-	)
+func addressAdd(cmd *cobra.Command, args []string) (err error) {
+	var a *maildb.Address
 
-	mdb.Begin()
-	defer mdb.End(&err)
+	tx, err := mdb.BeginContext(cmd.Context())
+	if err != nil {
+		return err
+	}
+	defer tx.End(&err)
 
-	a, err = mdb.InsertAddress(args[0])
+	a, err = tx.InsertAddress(args[0])
 	if err == nil && cmd.Flags().Changed("rclass") {
 		err = a.SetRclass(arClass)
 	}
@@ -198,20 +199,22 @@ func addressAdd(cmd *cobra.Command, args []string) error {
 
 // addressDelete the address in the first arg
 func addressDelete(cmd *cobra.Command, args []string) error {
-	return mdb.DeleteAddress(args[0])
+	return mdb.WithTxContext(cmd.Context(), func(tx *maildb.Tx) error {
+		return tx.DeleteAddress(args[0])
+	})
 }
 
 // addressEdit the address in the first arg
-func addressEdit(cmd *cobra.Command, args []string) error {
-	var (
-		err error
-		a   *maildb.Address
-	)
+func addressEdit(cmd *cobra.Command, args []string) (err error) {
+	var a *maildb.Address
 
-	mdb.Begin()
-	defer mdb.End(&err)
+	tx, err := mdb.BeginContext(cmd.Context())
+	if err != nil {
+		return err
+	}
+	defer tx.End(&err)
 
-	a, err = mdb.GetAddress(args[0])
+	a, err = tx.GetAddress(args[0])
 	if err == nil {
 		if cmd.Flags().Changed("no-rclass") {
 			err = a.ClearRclass()
@@ -236,7 +239,7 @@ func addressShow(cmd *cobra.Command, args []string) error {
 		a   *maildb.Address
 	)
 
-	if a, err = mdb.LookupAddress(args[0]); err != nil {
+	if a, err = mdb.LookupAddressContext(cmd.Context(), args[0]); err != nil {
 		return err
 	}
 	cmd.Printf("Address:\t%s\nTransport:\t%s\nRestrictions:\t%s\n",
@@ -111,18 +111,19 @@ func init() {
 }
 
 // aliasImport the aliases in /etc/aliases format from inFile
-func aliasImport(cmd *cobra.Command, args []string) error {
-	var err error
-
-	mdb.Begin()
-	defer mdb.End(&err)
+func aliasImport(cmd *cobra.Command, args []string) (err error) {
+	tx, err := mdb.BeginContext(cmd.Context())
+	if err != nil {
+		return err
+	}
+	defer tx.End(&err)
 
-	err = procImport(cmd, ALIASES, procAlias)
+	err = procImport(cmd, tx, ALIASES, procAlias)
 	return err
 }
 
 // procAlias for both add and import
-func procAlias(tokens []string) error {
+func procAlias(tx *maildb.Tx, tokens []string) error {
 	var (
 		err error
 		a   *maildb.Address
@@ -133,7 +134,7 @@ func procAlias(tokens []string) error {
 	} else if !ap.IsLocal() {
 		return fmt.Errorf("An alias cannot have a domain component")
 	}
-	if a, err = mdb.GetOrInsAddress(tokens[0]); err == nil {
+	if a, err = tx.GetOrInsAddress(tokens[0]); err == nil {
 		for _, r := range tokens[1:] {
 			if err = a.AttachAlias(r); err != nil {
 				break
@@ -161,7 +162,7 @@ func aliasExport(cmd *cobra.Command, args []string) error {
 		}
 		alias = args[0]
 	}
-	if alist, err = mdb.LookupAlias(alias); err == nil {
+	if alist, err = mdb.LookupAliasContext(cmd.Context(), alias); err == nil {
 		for _, al := range alist {
 			cmd.Printf("%s\n", al.Export())
 		}
@@ -170,13 +171,14 @@ func aliasExport(cmd *cobra.Command, args []string) error {
 }
 
 // aliasAdd the alias and its recipients
-func aliasAdd(cmd *cobra.Command, args []string) error {
-	var err error
-
-	mdb.Begin()
-	defer mdb.End(&err)
+func aliasAdd(cmd *cobra.Command, args []string) (err error) {
+	tx, err := mdb.BeginContext(cmd.Context())
+	if err != nil {
+		return err
+	}
+	defer tx.End(&err)
 
-	return procAlias(args)
+	return procAlias(tx, args)
 }
 
 // aliasDelete the address in the first arg
@@ -186,37 +188,39 @@ func aliasDelete(cmd *cobra.Command, args []string) error {
 	} else if !ap.IsLocal() {
 		return fmt.Errorf("An alias cannot have a domain component")
 	}
-	return mdb.RemoveAlias(args[0])
+	return mdb.WithTxContext(cmd.Context(), func(tx *maildb.Tx) error {
+		return tx.RemoveAlias(args[0])
+	})
 }
 
 // aliasEdit the address in the first arg
-func aliasEdit(cmd *cobra.Command, args []string) error {
-	var (
-		err error
-		a   *maildb.Address
-	)
+func aliasEdit(cmd *cobra.Command, args []string) (err error) {
+	var a *maildb.Address
 
 	if ap, err := maildb.DecodeRFC822(args[0]); err != nil {
 		return err
 	} else if !ap.IsLocal() {
 		return fmt.Errorf("An alias cannot have a domain component")
 	}
-	// add new ones first so remove doesn't remove an unattached alias...
-	if err == nil && cmd.Flags().Changed("add") {
-		mdb.Begin()
+	tx, err := mdb.BeginContext(cmd.Context())
+	if err != nil {
+		return err
+	}
+	defer tx.End(&err)
 
-		if a, err = mdb.GetAddress(args[0]); err == nil {
+	// add new ones first so remove doesn't remove an unattached alias...
+	if cmd.Flags().Changed("add") {
+		if a, err = tx.GetAddress(args[0]); err == nil {
 			for _, r := range aAddRecipient {
 				if err = a.AttachAlias(r); err != nil {
 					break
 				}
 			}
 		}
-		mdb.End(&err)
 	}
 	if err == nil && cmd.Flags().Changed("remove") {
 		for _, r := range aDelRecipient {
-			if err = mdb.RemoveRecipient(args[0], r); err != nil {
+			if err = tx.RemoveRecipient(args[0], r); err != nil {
 				break
 			}
 		}
@@ -237,8 +241,8 @@ func aliasShow(cmd *cobra.Command, args []string) error {
 	} else if !ap.IsLocal() {
 		return fmt.Errorf("An alias cannot have a domain component")
 	}
-	if a, err = mdb.LookupAddress(args[0]); err == nil {
-		if al, err = a.Alias(); err == nil {
+	if a, err = mdb.LookupAddressContext(cmd.Context(), args[0]); err == nil {
+		if al, err = a.AliasContext(cmd.Context()); err == nil {
 			cmd.Printf("Alias:\t\t%s\nTargets:", args[0])
 			for _, t := range al.Targets() {
 				cmd.Printf("\t%s\n", t.Recipient())
@@ -302,7 +302,8 @@ spam: tech, jones@site
 	}
 
 	// export virtuals
-	exportList = "abuse@disney walt+abuse@disney\n" +
+	exportList = "@disney walt@disney\n" +
+		"abuse@disney walt+abuse@disney\n" +
 		"walt@disney spamalot\n" +
 		"bruce@e-street paul@beatles, dorothy@oz\n" +
 		"mark@fuse.org john@wayne, jimmy@stewart\n" +
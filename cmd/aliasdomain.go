@@ -0,0 +1,92 @@
+/*
+Copyright © 2021 Jim Lieb <lieb@sea-troll.net>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"github.com/lieb/postdove/maildb"
+	"github.com/spf13/cobra"
+)
+
+// addAliasDomain map a domain onto another
+var addAliasDomain = &cobra.Command{
+	Use:   "aliasdomain name target",
+	Short: "Make a domain an alias of another domain",
+	Long: `Make the named domain an alias of the target domain so that every mailbox and
+alias address of the target also works in it, e.g. user@example.net is delivered to
+user@example.com. The domain is added as a virtual domain if it is new. If it is
+already an alias domain, its target is changed.`,
+	Args: cobra.ExactArgs(2),
+	RunE: aliasDomainAdd,
+}
+
+// deleteAliasDomain remove the mapping
+var deleteAliasDomain = &cobra.Command{
+	Use:   "aliasdomain name",
+	Short: "Stop a domain being an alias of another domain",
+	Long: `Remove the mapping of the named alias domain to its target. The domain is
+deleted as well unless it has addresses of its own.`,
+	Args: cobra.ExactArgs(1),
+	RunE: aliasDomainDelete,
+}
+
+// showAliasDomain display alias domains
+var showAliasDomain = &cobra.Command{
+	Use:   "aliasdomain [name]",
+	Short: "Display alias domains and their targets to the standard output",
+	Long: `Show the named alias domain and its target. The name can have '*' wildcards
+like export domain. With no name, all of them are shown.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: aliasDomainShow,
+}
+
+// linkage to top level commands
+func init() {
+	addCmd.AddCommand(addAliasDomain)
+	deleteCmd.AddCommand(deleteAliasDomain)
+	showCmd.AddCommand(showAliasDomain)
+}
+
+// aliasDomainAdd
+func aliasDomainAdd(cmd *cobra.Command, args []string) error {
+	return mdb.WithTxContext(cmd.Context(), func(tx *maildb.Tx) error {
+		_, err := tx.SetAliasDomain(args[0], args[1])
+		return err
+	})
+}
+
+// aliasDomainDelete
+func aliasDomainDelete(cmd *cobra.Command, args []string) error {
+	return mdb.WithTxContext(cmd.Context(), func(tx *maildb.Tx) error {
+		return tx.DeleteAliasDomain(args[0])
+	})
+}
+
+// aliasDomainShow
+func aliasDomainShow(cmd *cobra.Command, args []string) error {
+	name := "*"
+	if len(args) > 0 {
+		name = args[0]
+	}
+	adl, err := mdb.FindAliasDomainContext(cmd.Context(), name)
+	if err != nil {
+		return err
+	}
+	for _, ad := range adl {
+		cmd.Printf("Name:\t\t%s\nTarget:\t\t%s\n", ad.Name(), ad.Target())
+	}
+	return nil
+}
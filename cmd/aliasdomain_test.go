@@ -0,0 +1,176 @@
+/*
+Copyright © 2021 Jim Lieb <lieb@sea-troll.net>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lieb/postdove/maildb"
+)
+
+// TestAliasDomainCmds
+func TestAliasDomainCmds(t *testing.T) {
+	var (
+		err    error
+		dir    string
+		dbfile string
+		args   []string
+		out    string
+	)
+
+	fmt.Println("TestAliasDomainCmds")
+
+	dir, err = ioutil.TempDir("", "TestAliasDomainCmds-*")
+	defer os.RemoveAll(dir)
+	dbfile = filepath.Join(dir, "test.db")
+
+	args = []string{"create", "-d", dbfile, "--no-locals", "--no-aliases"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Fatalf("Create DB: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "add", "domain", "example.com", "-c", "vmailbox"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Fatalf("Add example.com: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "add", "mailbox", "user@example.com"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Fatalf("Add user@example.com: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "add", "virtual", "sales@example.com", "user@example.com"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Fatalf("Add sales@example.com: Unexpected error, %s", err)
+	}
+
+	args = []string{"-d", dbfile, "add", "aliasdomain", "example.net", "example.com"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Errorf("Add example.net: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "show", "aliasdomain", "example.net"}
+	out, _, err = doTest(rootCmd, "", args)
+	if err != nil || out != "Name:\t\texample.net\nTarget:\t\texample.com\n" {
+		t.Errorf("Show example.net: got %q, %v", out, err)
+	}
+	args = []string{"-d", dbfile, "show", "domain", "example.net"}
+	out, _, err = doTest(rootCmd, "", args)
+	if err != nil || out != "Name:\t\texample.net\nClass:\t\tvirtual\nTransport:\t--\nUserID:\t\t--\n"+
+		"Group ID:\t--\nRestrictions:\t--\nQuota:\t\t--\nPw Policy:\t--\nAlias of:\texample.com\n" {
+		t.Errorf("Show domain example.net: got %q, %v", out, err)
+	}
+
+	// what postfix sees
+	db, err := sql.Open("sqlite3", "file:"+dbfile+"?mode=ro")
+	if err != nil {
+		t.Fatalf("Open for virt_alias: %s", err)
+	}
+	defer db.Close()
+	for _, c := range [][]string{
+		{"user", "user@example.com"},
+		{"sales", "sales@example.com"},
+		{"nobody", ""},
+	} {
+		var r string
+		row := db.QueryRow("SELECT recipient FROM virt_alias WHERE mailbox = ? AND domain_name = ?",
+			c[0], "example.net")
+		if err = row.Scan(&r); err == sql.ErrNoRows && c[1] == "" {
+			continue
+		}
+		if err != nil || r != c[1] {
+			t.Errorf("virt_alias %s@example.net: expected %q, got %q, %v", c[0], c[1], r, err)
+		}
+	}
+
+	// a catch-all for the target covers the alias domain too
+	// but the mailboxes still get their own mail
+	args = []string{"-d", dbfile, "add", "mailbox", "ann@example.com"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Errorf("Add ann@example.com: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "add", "virtual", "@example.com", "user@example.com"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Errorf("Add @example.com: Unexpected error, %s", err)
+	}
+	for _, c := range [][]string{
+		{"@example.com", "user@example.com"},
+		{"ann@example.com", "ann@example.com"},
+		{"user@example.com", "user@example.com"},
+		{"ann@example.net", "ann@example.com"},
+		{"@example.net", "user@example.com"},
+		{"sales@example.net", "sales@example.com"},
+	} {
+		var r string
+		row := db.QueryRow(virtualAliasQuery(t, c[0]))
+		if err = row.Scan(&r); err != nil || r != c[1] {
+			t.Errorf("virt_alias %s: expected %q, got %q, %v", c[0], c[1], r, err)
+		}
+	}
+	args = []string{"-d", dbfile, "add", "mailbox", "@example.com"}
+	if _, _, err = doTest(rootCmd, "", args); err != maildb.ErrMdbCatchAll {
+		t.Errorf("Add mailbox @example.com: expected ErrMdbCatchAll, got %v", err)
+	}
+
+	// mistakes
+	args = []string{"-d", dbfile, "add", "aliasdomain", "example.org", "example.net"}
+	if _, _, err = doTest(rootCmd, "", args); err != maildb.ErrMdbAliasDomTarget {
+		t.Errorf("Add example.org -> example.net: expected ErrMdbAliasDomTarget, got %v", err)
+	}
+	args = []string{"-d", dbfile, "show", "aliasdomain", "example.com"}
+	if _, _, err = doTest(rootCmd, "", args); err != maildb.ErrMdbNotAliasDomain {
+		t.Errorf("Show example.com: expected ErrMdbNotAliasDomain, got %v", err)
+	}
+
+	args = []string{"-d", dbfile, "delete", "aliasdomain", "example.net"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Errorf("Delete example.net: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "show", "aliasdomain"}
+	if _, _, err = doTest(rootCmd, "", args); err != maildb.ErrMdbNotAliasDomain {
+		t.Errorf("Show after delete: expected ErrMdbNotAliasDomain, got %v", err)
+	}
+	args = []string{"-d", dbfile, "show", "domain", "example.net"}
+	if _, _, err = doTest(rootCmd, "", args); err != maildb.ErrMdbDomainNotFound {
+		t.Errorf("Show domain example.net after delete: expected ErrMdbDomainNotFound, got %v", err)
+	}
+}
+
+// virtualAliasQuery
+// The query in config/postfix/virtual_alias.query with the key
+// filled in the way postfix does it
+func virtualAliasQuery(t *testing.T, key string) string {
+	b, err := ioutil.ReadFile(filepath.Join("..", "config", "postfix", "virtual_alias.query"))
+	if err != nil {
+		t.Fatalf("Read virtual_alias.query: %s", err)
+	}
+	// a line that starts with white space continues the one before
+	q := ""
+	for _, l := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(l, "query =") {
+			q = strings.TrimPrefix(l, "query =")
+		} else if q != "" && strings.TrimLeft(l, " \t") != l {
+			q += " " + strings.TrimSpace(l)
+		} else if q != "" {
+			break
+		}
+	}
+	d := key[strings.LastIndex(key, "@")+1:]
+	return strings.NewReplacer("%s", key, "%d", d).Replace(q)
+}
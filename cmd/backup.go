@@ -0,0 +1,77 @@
+/*
+Copyright © 2021 Jim Lieb <lieb@sea-troll.net>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"strings"
+
+	"github.com/lieb/postdove/maildb"
+	"github.com/spf13/cobra"
+)
+
+var (
+	backupGzip bool
+)
+
+// backupCmd represents the backup command
+var backupCmd = &cobra.Command{
+	Use:   "backup file",
+	Short: "Make a consistent copy of the database while it is in use",
+	Long: `Make a consistent copy of the database to a file while postfix and dovecot
+are using it. The copy records the schema version of the database. If the file name
+ends in .gz or --gzip is set, the copy is compressed.`,
+	Args:        cobra.ExactArgs(1),
+	RunE:        cmdBackup,
+	Annotations: map[string]string{noSchemaCheck: "true"},
+}
+
+// restoreCmd represents the restore command
+var restoreCmd = &cobra.Command{
+	Use:   "restore file",
+	Short: "Replace the database with a backup",
+	Long: `Replace the database with the contents of a backup file made by the
+backup command. The backup is checked for integrity and schema compatibility and then
+copied into the live database while postfix and dovecot are using it. A backup with an older
+schema is upgraded as part of the restore.`,
+	Args:        cobra.ExactArgs(1),
+	RunE:        cmdRestore,
+	Annotations: map[string]string{noSchemaCheck: "true"},
+}
+
+// cmdBackup
+func cmdBackup(cmd *cobra.Command, args []string) error {
+	compress := backupGzip || strings.HasSuffix(args[0], ".gz")
+	_, err := mdb.BackupContext(cmd.Context(), args[0], compress)
+	return err
+}
+
+// cmdRestore
+func cmdRestore(cmd *cobra.Command, args []string) error {
+	version, err := mdb.Restore(args[0])
+	if err == nil && version != maildb.DbSchemaVersion {
+		cmd.Printf("Restored schema version %d backup, upgraded to version %d\n",
+			version, maildb.DbSchemaVersion)
+	}
+	return err
+}
+
+func init() {
+	rootCmd.AddCommand(backupCmd)
+	backupCmd.Flags().BoolVarP(&backupGzip, "gzip", "z", false,
+		"Compress the backup with gzip")
+	rootCmd.AddCommand(restoreCmd)
+}
@@ -0,0 +1,90 @@
+/*
+Copyright © 2021 Jim Lieb <lieb@sea-troll.net>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestBackupCmd
+func TestBackupCmd(t *testing.T) {
+	var (
+		err         error
+		dir         string
+		dbfile      string
+		args        []string
+		out, errout string
+	)
+
+	fmt.Println("TestBackupCmd")
+
+	dir, err = ioutil.TempDir("", "TestBackup-*")
+	defer os.RemoveAll(dir)
+	dbfile = filepath.Join(dir, "test.db")
+	backup := filepath.Join(dir, "test.backup.gz")
+
+	args = []string{"create", "-d", dbfile, "--no-aliases"}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err != nil {
+		t.Errorf("Create DB: Unexpected error, %s", err)
+	}
+
+	args = []string{"-d", dbfile, "backup", backup}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err != nil {
+		t.Errorf("Backup: Unexpected error, %s", err)
+	}
+	if out != "" || errout != "" {
+		t.Errorf("Backup: did not expect output, got %s, %s", out, errout)
+	}
+
+	args = []string{"-d", dbfile, "delete", "domain", "localhost.localdomain"}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err != nil {
+		t.Errorf("Delete localhost.localdomain: Unexpected error, %s", err)
+	}
+
+	args = []string{"-d", dbfile, "restore", backup}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err != nil {
+		t.Errorf("Restore: Unexpected error, %s", err)
+	}
+	if out != "" || errout != "" {
+		t.Errorf("Restore: did not expect output, got %s, %s", out, errout)
+	}
+
+	args = []string{"-d", dbfile, "show", "domain", "localhost.localdomain"}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err != nil {
+		t.Errorf("Show localhost.localdomain after restore: Unexpected error, %s", err)
+	}
+
+	args = []string{"-d", dbfile, "restore", filepath.Join(dir, "nonexistent")}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err == nil {
+		t.Errorf("Restore of nonexistent file should have failed")
+	}
+	args = []string{"-d", dbfile, "show", "domain", "localhost.localdomain"}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err != nil {
+		t.Errorf("Show localhost.localdomain after failed restore: Unexpected error, %s", err)
+	}
+}
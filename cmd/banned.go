@@ -0,0 +1,119 @@
+/*
+Copyright © 2021 Jim Lieb <lieb@sea-troll.net>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+
+	"github.com/lieb/postdove/maildb"
+	"github.com/spf13/cobra"
+)
+
+// importBanned do import of a banned passwords list
+var importBanned = &cobra.Command{
+	Use:   "banned",
+	Short: "Import a list of banned passwords, one per line",
+	Long: `Import passwords that mailboxes may not use from the file named by the -i flag
+(default stdin '-'). Each line is one password, taken as is. There are no comments
+because '#' can be in a password. Case is ignored and ones already in the list
+are skipped so a list can be loaded more than once.`,
+	Args: cobra.NoArgs,
+	RunE: bannedImport,
+}
+
+// exportBanned do export of the banned passwords list
+var exportBanned = &cobra.Command{
+	Use:   "banned",
+	Short: "Export the banned passwords, one per line",
+	Long:  `Export the banned passwords to the file named by the -o flag (default stdout '-').`,
+	Args:  cobra.NoArgs,
+	RunE:  bannedExport,
+}
+
+// deleteBanned do delete of a banned password
+var deleteBanned = &cobra.Command{
+	Use:   "banned password",
+	Short: "Delete a password from the banned passwords",
+	Long:  `Delete the password from the banned passwords so mailboxes can use it again.`,
+	Args:  cobra.ExactArgs(1),
+	RunE:  bannedDelete,
+}
+
+// linkage to top level commands
+func init() {
+	importCmd.AddCommand(importBanned)
+	exportCmd.AddCommand(exportBanned)
+	deleteCmd.AddCommand(deleteBanned)
+}
+
+// bannedImport
+// Not procImport because a password can have '#' and leading blanks
+func bannedImport(cmd *cobra.Command, args []string) (err error) {
+	var (
+		lines   = bufio.NewScanner(cmd.InOrStdin())
+		lineno  int
+		imports int
+	)
+
+	tx, err := mdb.BeginContext(cmd.Context())
+	if err != nil {
+		return err
+	}
+	defer tx.End(&err)
+
+	for lines.Scan() {
+		lineno++
+		if err = tx.Context().Err(); err != nil { // interrupted, give up
+			return fmt.Errorf("At line %d: %s", lineno, err)
+		}
+		pw := strings.TrimRight(lines.Text(), "\r")
+		if pw == "" {
+			continue
+		}
+		if err = tx.InsertBannedPassword(pw); err != nil {
+			return fmt.Errorf("At line %d: %s", lineno, err)
+		}
+		imports++
+	}
+	if err = lines.Err(); err != nil {
+		return err
+	}
+	if imports == 0 {
+		err = fmt.Errorf("At line %d: nothing found to import", lineno)
+	}
+	return err
+}
+
+// bannedExport
+func bannedExport(cmd *cobra.Command, args []string) error {
+	bl, err := mdb.BannedPasswordsContext(cmd.Context())
+	if err == nil {
+		for _, pw := range bl {
+			cmd.Printf("%s\n", pw)
+		}
+	}
+	return err
+}
+
+// bannedDelete
+func bannedDelete(cmd *cobra.Command, args []string) error {
+	return mdb.WithTxContext(cmd.Context(), func(tx *maildb.Tx) error {
+		return tx.DeleteBannedPassword(args[0])
+	})
+}
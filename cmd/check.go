@@ -0,0 +1,81 @@
+/*
+Copyright © 2021 Jim Lieb <lieb@sea-troll.net>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/lieb/postdove/maildb"
+	"github.com/spf13/cobra"
+)
+
+var (
+	checkRepair bool
+)
+
+// checkCmd represents the check command
+var checkCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Check the database for consistency",
+	Long: `Check the database file for damage and its contents for things that
+break postdove's rules, such as orphan addresses, unresolved alias recipients,
+misplaced mailboxes, and alias loops. Each finding is reported with its severity,
+the check that found it, what it is about, and what is wrong. The command fails if
+there are any errors. With --repair, the findings that are safe to fix are fixed
+in a single transaction.`,
+	Args: cobra.NoArgs,
+	RunE: cmdCheck,
+}
+
+// cmdCheck
+func cmdCheck(cmd *cobra.Command, args []string) error {
+	var (
+		fl     []*maildb.Finding
+		fixed  []*maildb.Finding
+		errors int
+		err    error
+	)
+
+	if checkRepair {
+		if fixed, err = mdb.RepairContext(cmd.Context()); err != nil {
+			return err
+		}
+		for _, f := range fixed {
+			cmd.Printf("repaired\t%s\n", f)
+		}
+	}
+	if fl, err = mdb.CheckContext(cmd.Context()); err != nil {
+		return err
+	}
+	for _, f := range fl {
+		cmd.Printf("%s\n", f)
+		if f.Severity() == maildb.SevError {
+			errors++
+		}
+	}
+	if errors > 0 {
+		cmd.SilenceUsage = true // not a usage problem
+		return fmt.Errorf("Check found %d errors", errors)
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(checkCmd)
+	checkCmd.Flags().BoolVarP(&checkRepair, "repair", "r", false,
+		"Fix the findings that are safe to fix")
+}
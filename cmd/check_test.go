@@ -0,0 +1,108 @@
+/*
+Copyright © 2021 Jim Lieb <lieb@sea-troll.net>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestCheckCmd
+func TestCheckCmd(t *testing.T) {
+	var (
+		err         error
+		dir         string
+		dbfile      string
+		args        []string
+		out, errout string
+	)
+
+	fmt.Println("TestCheckCmd")
+
+	dir, err = ioutil.TempDir("", "TestCheck-*")
+	defer os.RemoveAll(dir)
+	dbfile = filepath.Join(dir, "test.db")
+
+	args = []string{"create", "-d", dbfile}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err != nil {
+		t.Errorf("Create DB: Unexpected error, %s", err)
+	}
+
+	// A new database is clean
+	args = []string{"-d", dbfile, "check"}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err != nil {
+		t.Errorf("Check new DB: Unexpected error, %s", err)
+	}
+	if out != "" || errout != "" {
+		t.Errorf("Check new DB: did not expect output, got %s, %s", out, errout)
+	}
+
+	// Mess it up by hand
+	db, err := sql.Open("sqlite3", dbfile)
+	if err != nil {
+		t.Errorf("Open DB: %s", err)
+		return
+	}
+	_, err = db.Exec("INSERT INTO address (localpart) VALUES ('lonely')")
+	if err == nil {
+		_, err = db.Exec("INSERT INTO address (localpart) VALUES ('gone')")
+	}
+	if err == nil {
+		_, err = db.Exec("INSERT INTO alias (address, target) VALUES ((SELECT id FROM address WHERE localpart = 'gone'), 9999)")
+	}
+	db.Close()
+	if err != nil {
+		t.Errorf("Hand edit: %s", err)
+		return
+	}
+
+	args = []string{"-d", dbfile, "check"}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err == nil {
+		t.Errorf("Check edited DB: should have failed")
+	} else if err.Error() != "Check found 2 errors" {
+		t.Errorf("Check edited DB: Unexpected error, %s", err)
+	}
+	if !strings.Contains(out, "warning\torphan-address\tlonely\t") ||
+		!strings.Contains(out, "error\tdangling-alias\tgone -> #9999\t") ||
+		!strings.Contains(out, "error\tforeign-key\t") {
+		t.Errorf("Check edited DB: did not get expected output, got %s", out)
+	}
+	if strings.Contains(out, "Usage:") {
+		t.Errorf("Check edited DB: did not expect usage, got %s", out)
+	}
+
+	args = []string{"-d", dbfile, "check", "--repair"}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err != nil {
+		t.Errorf("Check repair: Unexpected error, %s", err)
+	}
+	if !strings.HasPrefix(out, "repaired\t") || strings.Count(out, "repaired\t") != 2 ||
+		strings.Count(out, "\n") != 2 {
+		t.Errorf("Check repair: did not get expected output, got %s", out)
+	}
+	if errout != "" {
+		t.Errorf("Check repair: did not expect error output, got %s", errout)
+	}
+}
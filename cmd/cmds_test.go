@@ -27,6 +27,7 @@ import (
 
 	//"github.com/lieb/postdove/maildb"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 // doTest
@@ -35,6 +36,7 @@ func doTest(cmd *cobra.Command, stdIn string, args []string) (string, string, er
 		err error
 	)
 
+	resetFlags(cmd)
 	inbuf := bytes.NewBufferString(stdIn)
 	outbuf := bytes.NewBufferString("")
 	errbuf := bytes.NewBufferString("")
@@ -54,6 +56,24 @@ func doTest(cmd *cobra.Command, stdIn string, args []string) (string, string, er
 	return string(out), string(errout), err
 }
 
+// resetFlags
+// Cobra keeps what the flags were set to from one Execute to the next
+// so put every one of them back to its default first. A slice flag
+// appends once it has been set so empty it instead.
+func resetFlags(cmd *cobra.Command) {
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		if sv, ok := f.Value.(pflag.SliceValue); ok {
+			sv.Replace(nil)
+		} else {
+			f.Value.Set(f.DefValue)
+		}
+		f.Changed = false
+	})
+	for _, c := range cmd.Commands() {
+		resetFlags(c)
+	}
+}
+
 // Test_Cmds
 // Test basic commmands infrastructure and database creation
 func Test_Cmds(t *testing.T) {
@@ -72,7 +92,7 @@ func Test_Cmds(t *testing.T) {
 	out, errout, err = doTest(rootCmd, "", args)
 	if err == nil {
 		t.Errorf("Bogus command foo should have failed")
-	} else if err.Error() != "unknown command \"foo\" for \"postdove\"" {
+	} else if !strings.HasPrefix(err.Error(), "unknown command \"foo\" for \"postdove\"") {
 		t.Errorf("Bogus command foo unexpected error, %s", err)
 	}
 	if out != "" {
@@ -30,24 +30,30 @@ var (
 	domainLoad  bool
 	aliasFile   string
 	aliasLoad   bool
+	noWAL       bool
 )
 
 // cmdCreate
-func cmdCreate(cmd *cobra.Command, args []string) error {
+func cmdCreate(cmd *cobra.Command, args []string) (err error) {
 	var (
 		inD   *maildb.Input
 		inA   *maildb.Input
 		cmdIn io.Reader
-		err   error
+		tx    *maildb.Tx
 	)
-	if cmd.Flags().Changed("schema") {
-		err = mdb.LoadSchema(schemaFile)
+	if cmd.Flags().Changed("schema") { // checked before anything is done
+		err = mdb.LoadSchemaContext(cmd.Context(), schemaFile)
 	} else {
-		err = mdb.LoadSchema("")
+		err = mdb.LoadSchemaContext(cmd.Context(), "")
+	}
+	if err == nil && !cmd.Flags().Changed("no-wal") { // so postfix and dovecot don't wait on us
+		err = mdb.EnableWAL()
 	}
 	if err == nil {
-		mdb.Begin()
-		defer mdb.End(&err)
+		if tx, err = mdb.BeginContext(cmd.Context()); err != nil {
+			return err
+		}
+		defer tx.End(&err)
 
 		if !cmd.Flags().Changed("no-locals") { // Add default localhost stuff
 			if cmd.Flags().Changed("local") {
@@ -59,7 +65,7 @@ func cmdCreate(cmd *cobra.Command, args []string) error {
 				defer inD.Close()
 				cmdIn = cmd.InOrStdin()
 				cmd.SetIn(inD.Reader())
-				err = procImport(cmd, POSTFIX, procDomain)
+				err = procImport(cmd, tx, POSTFIX, procDomain)
 				cmd.SetIn(cmdIn)
 			}
 		}
@@ -74,7 +80,7 @@ func cmdCreate(cmd *cobra.Command, args []string) error {
 				defer inA.Close()
 				cmdIn = cmd.InOrStdin()
 				cmd.SetIn(inA.Reader())
-				err = procImport(cmd, ALIASES, procAlias)
+				err = procImport(cmd, tx, ALIASES, procAlias)
 				cmd.SetIn(cmdIn)
 			}
 		}
@@ -99,4 +105,6 @@ func init() {
 		"default local domains (localhost, localhost.localdomain)")
 	createCmd.Flags().BoolVarP(&domainLoad, "no-locals", "L", false,
 		"Do not load local domain hosts")
+	createCmd.Flags().BoolVarP(&noWAL, "no-wal", "W", false,
+		"Leave the database in rollback journal mode instead of WAL mode")
 }
@@ -22,9 +22,10 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	//	"strings"
+	"strings"
 	"testing"
-	//"github.com/lieb/postdove/maildb"
+
+	"github.com/lieb/postdove/maildb"
 	//	"github.com/spf13/cobra"
 )
 
@@ -64,7 +65,7 @@ func Test_Create(t *testing.T) {
 	if err != nil {
 		t.Errorf("Show of localhost in good DB: Unexpected error, %s", err)
 	}
-	if out != "Name:\t\tlocalhost\nClass:\t\tlocal\nTransport:\t--\nUserID:\t\t99\nGroup ID:\t99\nRestrictions:\t--\n" {
+	if out != "Name:\t\tlocalhost\nClass:\t\tlocal\nTransport:\t--\nUserID:\t\t99\nGroup ID:\t99\nRestrictions:\t--\nQuota:\t\t--\nPw Policy:\t--\n" {
 		t.Errorf("Show of localhost in good DB: did not get expected output, got %s", out)
 	}
 	if errout != "" {
@@ -76,7 +77,7 @@ func Test_Create(t *testing.T) {
 	if err != nil {
 		t.Errorf("Show of localhost.localdomain in good DB: Unexpected error, %s", err)
 	}
-	if out != "Name:\t\tlocalhost.localdomain\nClass:\t\tlocal\nTransport:\t--\nUserID:\t\t--\nGroup ID:\t--\nRestrictions:\t--\n" {
+	if out != "Name:\t\tlocalhost.localdomain\nClass:\t\tlocal\nTransport:\t--\nUserID:\t\t--\nGroup ID:\t--\nRestrictions:\t--\nQuota:\t\t--\nPw Policy:\t--\n" {
 		t.Errorf("Show of localhost.localdomain in good DB: did not get expected output, got %s", out)
 	}
 	if errout != "" {
@@ -145,7 +146,7 @@ func Test_Create(t *testing.T) {
 	if err != nil {
 		t.Errorf("Show of localhost in good DB: Unexpected error, %s", err)
 	}
-	if out != "Name:\t\tlocalhost\nClass:\t\tlocal\nTransport:\t--\nUserID:\t\t99\nGroup ID:\t99\nRestrictions:\t--\n" {
+	if out != "Name:\t\tlocalhost\nClass:\t\tlocal\nTransport:\t--\nUserID:\t\t99\nGroup ID:\t99\nRestrictions:\t--\nQuota:\t\t--\nPw Policy:\t--\n" {
 		t.Errorf("Show of localhost in good DB: did not get expected output, got %s", out)
 	}
 	if errout != "" {
@@ -167,3 +168,55 @@ func Test_Create(t *testing.T) {
 		t.Errorf("Show of postmaster: expected formatted error output")
 	}
 }
+
+// TestCreateSchema
+// A custom schema is checked before the database is touched
+// and its errors say where in the file they are
+func TestCreateSchema(t *testing.T) {
+	var (
+		err    error
+		dir    string
+		dbfile string
+		args   []string
+	)
+
+	fmt.Println("TestCreateSchema")
+
+	dir, err = ioutil.TempDir("", "TestCreateSchema-*")
+	defer os.RemoveAll(dir)
+	dbfile = filepath.Join(dir, "test.db")
+
+	c, err := maildb.DbContent.ReadFile("files/schema.sql")
+	if err != nil {
+		t.Fatalf("Read of schema: Unexpected error, %s", err)
+	}
+	schema := filepath.Join(dir, "schema.sql")
+	s := strings.Replace(string(c), `CREATE VIEW "user_mailbox"`, `CREATE VIEW "mailbox_user"`, 1)
+	if err = os.WriteFile(schema, []byte(s), 0644); err != nil {
+		t.Fatalf("Write of %s: Unexpected error, %s", schema, err)
+	}
+
+	args = []string{"create", "-d", dbfile, "--schema", schema}
+	_, _, err = doTest(rootCmd, "", args)
+	if err == nil {
+		t.Errorf("Create with incomplete schema: expected error")
+	} else if !strings.Contains(err.Error(), "view user_mailbox") {
+		t.Errorf("Create with incomplete schema: expected missing view user_mailbox, got %s", err)
+	}
+	if _, err = os.Stat(dbfile); !os.IsNotExist(err) {
+		t.Errorf("Create with incomplete schema: expected no database file, got %v", err)
+	}
+
+	// Now one with a semicolon in a comment on line 3 and a bad statement
+	s = "-- a schema\n" + "-- with a comment;\n" + "CREATE TABLE x (a);\n" +
+		"/* and\n another; */\n" + "INSERT INTO y VALUES (1);\n" + string(c)
+	if err = os.WriteFile(schema, []byte(s), 0644); err != nil {
+		t.Fatalf("Write of %s: Unexpected error, %s", schema, err)
+	}
+	_, _, err = doTest(rootCmd, "", args)
+	if err == nil {
+		t.Errorf("Create with bad schema: expected error")
+	} else if want := schema + ":6:"; !strings.Contains(err.Error(), want) {
+		t.Errorf("Create with bad schema: expected error at %s, got %s", want, err)
+	}
+}
@@ -0,0 +1,232 @@
+/*
+Copyright © 2021 Jim Lieb <lieb@sea-troll.net>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lieb/postdove/maildb"
+	"github.com/spf13/cobra"
+)
+
+var (
+	credExpires string
+	credDays    int
+)
+
+// addCredential do add of a credential to a mailbox
+var addCredential = &cobra.Command{
+	Use:   "credential address label [ flags ]",
+	Short: "Add a credential (application password) to a mailbox",
+	Long: `Add a credential to the mailbox of the address. The label names it, such as
+"phone" or "laptop", and must be unique for the mailbox. Any of the mailbox's
+credentials can be used to log in. Without --password or --password-stdin
+a password is generated and printed. It cannot be shown again.`,
+	Args: cobra.ExactArgs(2),
+	RunE: credentialAdd,
+}
+
+// deleteCredential do delete of a credential
+var deleteCredential = &cobra.Command{
+	Use:   "credential address label",
+	Short: "Delete a credential from a mailbox",
+	Long:  `Delete the labeled credential from the mailbox of the address.`,
+	Args:  cobra.ExactArgs(2),
+	RunE:  credentialDelete,
+}
+
+// showCredential display the credentials of a mailbox
+var showCredential = &cobra.Command{
+	Use:   "credential address [ label ]",
+	Short: "Display the credentials of a mailbox",
+	Long: `Display the credentials of the mailbox of the address, or just the labeled one,
+to standard output. The passwords are not shown.`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: credentialShow,
+}
+
+// linkage to top level commands
+func init() {
+	addCmd.AddCommand(addCredential)
+	addCredential.Flags().StringVarP(&password, "password", "p", "",
+		"Credential password")
+	addCredential.Flags().BoolVarP(&pwStdin, "password-stdin", "r", false,
+		"Read the password from stdin, prompt for it if a terminal")
+	addCredential.Flags().StringVarP(&pwScheme, "scheme", "s", maildb.DefaultPwScheme,
+		"Password hash scheme, one of "+strings.Join(maildb.PwSchemes(), ", "))
+	addCredential.Flags().StringVarP(&credExpires, "expires", "x", "",
+		"Date the credential stops working, YYYY-MM-DD")
+	addCredential.Flags().IntVar(&credDays, "days", 0,
+		"Number of days until the credential stops working")
+	addCredential.Flags().StringSliceVarP(&allowProto, "allow", "a", nil,
+		"Protocols to allow, any of "+strings.Join(maildb.CredentialProtocols, ", ")+" or all")
+	addCredential.Flags().StringSliceVarP(&denyProto, "deny", "D", nil,
+		"Protocols to deny, any of "+strings.Join(maildb.CredentialProtocols, ", ")+" or all")
+	deleteCmd.AddCommand(deleteCredential)
+	showCmd.AddCommand(showCredential)
+}
+
+// credentialAdd
+func credentialAdd(cmd *cobra.Command, args []string) (err error) {
+	var (
+		c         *maildb.Credential
+		pw        string
+		generated bool
+		exp       time.Time
+	)
+
+	if cmd.Flags().Changed("expires") && cmd.Flags().Changed("days") {
+		return fmt.Errorf("The expiry is either a date with --expires or a count of --days, not both")
+	}
+	if cmd.Flags().Changed("expires") {
+		if exp, err = time.ParseInLocation("2006-01-02", credExpires, time.Local); err != nil {
+			return fmt.Errorf("--expires: %s", err)
+		}
+	} else if cmd.Flags().Changed("days") {
+		if credDays < 1 {
+			return fmt.Errorf("--days must be at least 1")
+		}
+		exp = time.Now().AddDate(0, 0, credDays)
+	}
+	if cmd.Flags().Changed("password-stdin") {
+		if pw, err = readPassword(cmd, true); err != nil {
+			return err
+		}
+	} else if cmd.Flags().Changed("password") {
+		pw = password
+	} else {
+		if pw, err = maildb.GeneratePassword(); err != nil {
+			return err
+		}
+		generated = true
+	}
+
+	tx, err := mdb.BeginContext(cmd.Context())
+	if err != nil {
+		return err
+	}
+	defer tx.End(&err)
+
+	if c, err = tx.InsertCredential(args[0], args[1], pwScheme, pw); err != nil {
+		return err
+	}
+	if !exp.IsZero() {
+		if err = c.SetExpires(exp); err != nil {
+			return err
+		}
+	}
+	if err = credentialProtocols(cmd, c); err != nil {
+		return err
+	}
+	if generated {
+		cmd.Printf("%s %s: %s\n", c.User(), c.Label(), pw)
+	}
+	return nil
+}
+
+// credentialProtocols
+// Allow and then deny the protocols in the flags like mailboxProtocols.
+func credentialProtocols(cmd *cobra.Command, c *maildb.Credential) error {
+	if cmd.Flags().Changed("allow") {
+		for _, p := range credProtocolList(allowProto) {
+			if err := c.AllowProtocol(p); err != nil {
+				return fmt.Errorf("--allow %s: %s", p, err)
+			}
+		}
+	}
+	if cmd.Flags().Changed("deny") {
+		for _, p := range credProtocolList(denyProto) {
+			if err := c.DenyProtocol(p); err != nil {
+				return fmt.Errorf("--deny %s: %s", p, err)
+			}
+		}
+	}
+	return nil
+}
+
+// credProtocolList
+// expand "all" in a credential protocol flag's list
+func credProtocolList(pl []string) []string {
+	var l []string
+
+	for _, p := range pl {
+		if strings.ToLower(strings.TrimSpace(p)) == "all" {
+			l = append(l, maildb.CredentialProtocols...)
+		} else {
+			l = append(l, p)
+		}
+	}
+	return l
+}
+
+// credentialDelete
+func credentialDelete(cmd *cobra.Command, args []string) error {
+	return mdb.WithTxContext(cmd.Context(), func(tx *maildb.Tx) error {
+		return tx.DeleteCredential(args[0], args[1])
+	})
+}
+
+// credentialShow
+func credentialShow(cmd *cobra.Command, args []string) error {
+	var (
+		cl          []*maildb.Credential
+		err         error
+		MoreThanOne bool
+	)
+
+	if len(args) > 1 {
+		c, err := mdb.LookupCredentialContext(cmd.Context(), args[0], args[1])
+		if err != nil {
+			return err
+		}
+		cl = append(cl, c)
+	} else if cl, err = mdb.FindCredentialsContext(cmd.Context(), args[0]); err != nil {
+		return err
+	}
+	for _, c := range cl {
+		if MoreThanOne {
+			cmd.Printf("=====================\n")
+		}
+		cmd.Printf("Name:\t\t%s\nLabel:\t\t%s\nPassword Type:\t%s\n",
+			c.User(), c.Label(), c.PwType())
+		cmd.Printf("Created:\t%s\nLast Used:\t%s\n",
+			credentialTime(c.Created()), credentialTime(c.LastUsed()))
+		if c.IsExpired() {
+			cmd.Printf("Expires:\t%s (expired)\n", credentialTime(c.Expires()))
+		} else {
+			cmd.Printf("Expires:\t%s\n", credentialTime(c.Expires()))
+		}
+		if pl := c.AllowedProtocols(); len(pl) > 0 {
+			cmd.Printf("Protocols:\t%s\n", strings.Join(pl, ","))
+		} else {
+			cmd.Printf("Protocols:\tnone\n")
+		}
+		MoreThanOne = true
+	}
+	return nil
+}
+
+// credentialTime
+// in the local time zone, "never" if zero
+func credentialTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
@@ -0,0 +1,170 @@
+/*
+Copyright © 2021 Jim Lieb <lieb@sea-troll.net>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/lieb/postdove/maildb"
+)
+
+// TestCredentialCmds
+func TestCredentialCmds(t *testing.T) {
+	var (
+		err         error
+		dir         string
+		dbfile      string
+		args        []string
+		out, errout string
+	)
+
+	fmt.Println("TestCredentialCmds")
+
+	dir, err = ioutil.TempDir("", "TestCredentialCmds-*")
+	defer os.RemoveAll(dir)
+	dbfile = filepath.Join(dir, "test.db")
+
+	args = []string{"create", "-d", dbfile, "--no-locals", "--no-aliases"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Fatalf("Create DB: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "import", "domain"}
+	if _, _, err = doTest(rootCmd, "pobox.org class=vmailbox\n", args); err != nil {
+		t.Fatalf("Import domains: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "import", "mailbox"}
+	if _, _, err = doTest(rootCmd, "a@pobox.org:{PLAIN}mainpw::::::\n", args); err != nil {
+		t.Fatalf("Import mailboxes: Unexpected error, %s", err)
+	}
+
+	// No password so one is made for us
+	args = []string{"-d", dbfile, "add", "credential", "a@pobox.org", "phone"}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err != nil {
+		t.Errorf("Add phone: Unexpected error, %s", err)
+	}
+	m := regexp.MustCompile(`^a@pobox.org phone: ([a-z0-9]{4}-[a-z0-9]{4}-[a-z0-9]{4}-[a-z0-9]{4})\n$`).FindStringSubmatch(out)
+	if m == nil || errout != "" {
+		t.Fatalf("Add phone: expected a generated password, got %q, %q", out, errout)
+	}
+	phonePw := m[1]
+
+	// Either password works and the credential says which
+	args = []string{"-d", dbfile, "verify", "mailbox", "a@pobox.org", "--password", phonePw}
+	out, _, err = doTest(rootCmd, "", args)
+	if err != nil || out != "a@pobox.org: password matches credential phone\n" {
+		t.Errorf("Verify phone password: unexpected result, %q, %v", out, err)
+	}
+	args = []string{"-d", dbfile, "verify", "mailbox", "a@pobox.org", "--password", "mainpw"}
+	out, _, err = doTest(rootCmd, "", args)
+	if err != nil || out != "a@pobox.org: password matches\n" {
+		t.Errorf("Verify main password: unexpected result, %q, %v", out, err)
+	}
+	args = []string{"-d", dbfile, "verify", "mailbox", "a@pobox.org", "--password", "nope"}
+	if _, _, err = doTest(rootCmd, "", args); err == nil ||
+		err.Error() != "a@pobox.org: password does not match" {
+		t.Errorf("Verify bad password: unexpected error, %v", err)
+	}
+
+	// One with a password that is limited and expires
+	args = []string{"-d", dbfile, "add", "credential", "a@pobox.org", "laptop",
+		"--password", "secret", "--days", "30", "--deny", "pop3,sieve"}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err != nil || out != "" || errout != "" {
+		t.Errorf("Add laptop: unexpected result, %q, %q, %v", out, errout, err)
+	}
+	args = []string{"-d", dbfile, "add", "credential", "a@pobox.org", "laptop"}
+	if _, _, err = doTest(rootCmd, "", args); err != maildb.ErrMdbDupCredential {
+		t.Errorf("Add laptop again: expected ErrMdbDupCredential, got %v", err)
+	}
+	args = []string{"-d", dbfile, "add", "credential", "a@pobox.org", "tablet", "--expires", "2099-01-01", "--days", "30"}
+	if _, _, err = doTest(rootCmd, "", args); err == nil {
+		t.Errorf("Add tablet with --expires and --days: expected an error")
+	}
+	args = []string{"-d", dbfile, "add", "credential", "a@pobox.org", "tablet", "--password", "tabletpw",
+		"--expires", "2099-01-01"}
+	if out, errout, err = doTest(rootCmd, "", args); err != nil || out != "" || errout != "" {
+		t.Errorf("Add tablet: unexpected result, %q, %q, %v", out, errout, err)
+	}
+	args = []string{"-d", dbfile, "add", "credential", "nobody@pobox.org", "tablet"}
+	if _, _, err = doTest(rootCmd, "", args); err == nil {
+		t.Errorf("Add to nobody@pobox.org: expected an error")
+	}
+
+	args = []string{"-d", dbfile, "show", "credential", "a@pobox.org"}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err != nil || errout != "" {
+		t.Errorf("Show credentials: unexpected error, %q, %v", errout, err)
+	}
+	parts := strings.Split(out, "=====================\n")
+	if len(parts) != 3 {
+		t.Fatalf("Show credentials: expected three, got %q", out)
+	}
+	for _, re := range []string{
+		"^Name:\t\ta@pobox.org\nLabel:\t\tphone\nPassword Type:\tSHA512-CRYPT\n",
+		"\nLast Used:\t[0-9]{4}-[0-9]{2}-[0-9]{2} ",
+		"\nExpires:\tnever\nProtocols:\timap,pop3,submission,sieve\n$",
+	} {
+		if !regexp.MustCompile(re).MatchString(parts[0]) {
+			t.Errorf("Show phone: %q does not match %q", parts[0], re)
+		}
+	}
+	for _, re := range []string{
+		"\nLabel:\t\tlaptop\n",
+		"\nLast Used:\tnever\nExpires:\t[0-9]{4}-[0-9]{2}-[0-9]{2} [0-9:]{8}\n",
+		"\nProtocols:\timap,submission\n$",
+	} {
+		if !regexp.MustCompile(re).MatchString(parts[1]) {
+			t.Errorf("Show laptop: %q does not match %q", parts[1], re)
+		}
+	}
+	for _, re := range []string{
+		"\nLabel:\t\ttablet\n",
+		"\nExpires:\t2099-01-01 00:00:00\nProtocols:\timap,pop3,submission,sieve\n$",
+	} {
+		if !regexp.MustCompile(re).MatchString(parts[2]) {
+			t.Errorf("Show tablet: %q does not match %q", parts[2], re)
+		}
+	}
+
+	// The log shows them under the mailbox
+	args = []string{"-d", dbfile, "log", "--entity", "credential"}
+	if out, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Errorf("Log credentials: unexpected error, %s", err)
+	} else if strings.Count(out, "a@pobox.org") < 2 || strings.Contains(out, "secret") {
+		t.Errorf("Log credentials: unexpected output, %q", out)
+	}
+
+	args = []string{"-d", dbfile, "delete", "credential", "a@pobox.org", "laptop"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Errorf("Delete laptop: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "show", "credential", "a@pobox.org", "laptop"}
+	if _, _, err = doTest(rootCmd, "", args); err != maildb.ErrMdbCredNotFound {
+		t.Errorf("Show deleted laptop: expected ErrMdbCredNotFound, got %v", err)
+	}
+	args = []string{"-d", dbfile, "show", "credential", "a@pobox.org", "phone"}
+	if out, _, err = doTest(rootCmd, "", args); err != nil || !strings.Contains(out, "\nLabel:\t\tphone\n") {
+		t.Errorf("Show phone: unexpected result, %q, %v", out, err)
+	}
+}
@@ -35,6 +35,10 @@ var (
 	noRClass     bool
 	dTransport   string
 	noDTransport bool
+	pwMaxAge     int64
+	pwMinLength  int64
+	pwMinClasses int64
+	dQuota       string
 )
 
 // importDomain do import of a domains file
@@ -75,6 +79,18 @@ All of the recipients pointed to by this name will be also deleted`,
 	RunE: domainDelete,
 }
 
+// renameDomain do rename of a domain
+var renameDomain = &cobra.Command{
+	Use:   "domain old new [ flags ]",
+	Short: "Rename a domain in the database.",
+	Long: `Rename a domain. Its addresses, and the aliases and mailboxes of them, move
+with it. With --keep-old the old name becomes an alias domain of the new one so mail
+to the old addresses still arrives. With --vmail-root the mail storage of its mailboxes
+is moved to their new homes.`,
+	Args: cobra.ExactArgs(2),
+	RunE: domainRename,
+}
+
 // editDomain do edit of a domains file
 var editDomain = &cobra.Command{
 	Use:   "domain name",
@@ -109,7 +125,18 @@ func init() {
 		"Restriction class for this domain")
 	addDomain.Flags().StringVarP(&dTransport, "transport", "t", "",
 		"Transport to use for this domain")
+	addDomain.Flags().Int64Var(&pwMaxAge, "pw-max-age", 0,
+		"Days until a mailbox password expires, 0 is never")
+	addDomain.Flags().Int64Var(&pwMinLength, "pw-min-length", 0,
+		"Minimum length of a mailbox password, 0 is any")
+	addDomain.Flags().Int64Var(&pwMinClasses, "pw-min-classes", 0,
+		"Minimum number of lower case, upper case, digit and other characters in a mailbox password, 0 is any")
+	addDomain.Flags().StringVarP(&dQuota, "quota", "q", "",
+		"Default quota rule of the domain's mailboxes")
 	deleteCmd.AddCommand(deleteDomain)
+	renameCmd.AddCommand(renameDomain)
+	renameDomain.Flags().BoolVar(&keepOld, "keep-old", false,
+		"Keep the old name as an alias domain of the new one")
 	editCmd.AddCommand(editDomain)
 	editDomain.Flags().StringVarP(&dClass, "class", "c", "",
 		"Domain class (internet, local, relay, virtual, vmailbox) for this domain")
@@ -127,37 +154,46 @@ func init() {
 		"Clear the restriction class for this domain")
 	editDomain.Flags().StringVarP(&dTransport, "transport", "t", "",
 		"Transport to use for this domain")
+	editDomain.Flags().Int64Var(&pwMaxAge, "pw-max-age", 0,
+		"Days until a mailbox password expires, 0 is never")
+	editDomain.Flags().Int64Var(&pwMinLength, "pw-min-length", 0,
+		"Minimum length of a mailbox password, 0 is any")
+	editDomain.Flags().Int64Var(&pwMinClasses, "pw-min-classes", 0,
+		"Minimum number of lower case, upper case, digit and other characters in a mailbox password, 0 is any")
+	editDomain.Flags().StringVarP(&dQuota, "quota", "q", "",
+		"Default quota rule of the domain's mailboxes, none to clear")
 	editDomain.Flags().BoolVarP(&noDTransport, "no-transport", "T", false,
 		"Clear the transport for this domain")
 	showCmd.AddCommand(showDomain)
 }
 
 // domainImport the domains from inFile
-func domainImport(cmd *cobra.Command, args []string) error {
-	var err error
-
-	mdb.Begin()
-	defer mdb.End(&err)
+func domainImport(cmd *cobra.Command, args []string) (err error) {
+	tx, err := mdb.BeginContext(cmd.Context())
+	if err != nil {
+		return err
+	}
+	defer tx.End(&err)
 
-	err = procImport(cmd, POSTFIX, procDomain)
+	err = procImport(cmd, tx, POSTFIX, procDomain)
 	return err
 }
 
 // procDomain
 // options are "option=XXX"
-func procDomain(tokens []string) error {
+func procDomain(tx *maildb.Tx, tokens []string) error {
 	var (
 		d   *maildb.Domain
 		err error
 		id  int64
 	)
 
-	if d, err = mdb.InsertDomain(tokens[0]); err != nil {
+	if d, err = tx.InsertDomain(tokens[0]); err != nil {
 		return err
 	}
 	if len(tokens) > 1 {
 		for _, opt := range tokens[1:] {
-			kv := strings.Split(opt, "=")
+			kv := strings.SplitN(opt, "=", 2)
 			if len(kv) < 2 {
 				return fmt.Errorf("domain import option %s is not a key=value pair", opt)
 			}
@@ -180,6 +216,13 @@ func procDomain(tokens []string) error {
 				err = d.SetRclass(kv[1])
 			case "transport":
 				err = d.SetTransport(kv[1])
+			case "quota":
+				err = d.SetQuota(kv[1])
+			case "pw_max_age", "pw_min_length", "pw_min_classes":
+				id, err = strconv.ParseInt(kv[1], 10, 64)
+				if err == nil {
+					err = domainPwPolicy(d, kv[0], id)
+				}
 			default:
 				return fmt.Errorf("Unknown domain import option %s", kv[0])
 			}
@@ -203,7 +246,7 @@ func domainExport(cmd *cobra.Command, args []string) error {
 	default:
 		return fmt.Errorf("Only one domain can be specified")
 	}
-	dl, err := mdb.FindDomain(domain)
+	dl, err := mdb.FindDomainContext(cmd.Context(), domain)
 	if err == nil {
 		for _, d := range dl {
 			cmd.Printf("%s\n", d.Export())
@@ -213,16 +256,16 @@ func domainExport(cmd *cobra.Command, args []string) error {
 }
 
 // domainAdd the domain and its class
-func domainAdd(cmd *cobra.Command, args []string) error {
-	var (
-		d   *maildb.Domain
-		err error
-	)
+func domainAdd(cmd *cobra.Command, args []string) (err error) {
+	var d *maildb.Domain
 
-	mdb.Begin()
-	defer mdb.End(&err)
+	tx, err := mdb.BeginContext(cmd.Context())
+	if err != nil {
+		return err
+	}
+	defer tx.End(&err)
 
-	d, err = mdb.InsertDomain(args[0])
+	d, err = tx.InsertDomain(args[0])
 	if err == nil && cmd.Flags().Changed("class") {
 		err = d.SetClass(dClass)
 	}
@@ -238,25 +281,107 @@ func domainAdd(cmd *cobra.Command, args []string) error {
 	if err == nil && cmd.Flags().Changed("transport") {
 		err = d.SetTransport(dTransport)
 	}
+	if err == nil && cmd.Flags().Changed("quota") {
+		err = d.SetQuota(dQuota)
+	}
+	if err == nil {
+		err = domainPwFlags(cmd, d)
+	}
 	return err
 }
 
 // domainDelete the domain in the first arg
 func domainDelete(cmd *cobra.Command, args []string) error {
-	return mdb.DeleteDomain(args[0])
+	return mdb.WithTxContext(cmd.Context(), func(tx *maildb.Tx) error {
+		return tx.DeleteDomain(args[0])
+	})
 }
 
-// domainEdit the domain in the first arg
-func domainEdit(cmd *cobra.Command, args []string) error {
+// domainRename
+// The storage of the mailboxes moves once the rename is committed
+func domainRename(cmd *cobra.Command, args []string) error {
+	var moves [][2]*maildb.MailHome
+
+	st, err := mailStorage()
+	if err != nil {
+		return err
+	}
+	err = mdb.WithTxContext(cmd.Context(), func(tx *maildb.Tx) error {
+		var oldHomes []*maildb.MailHome
+
+		moves = nil
+		if st != nil {
+			d, err := tx.GetDomain(args[0])
+			if err != nil {
+				return err
+			}
+			ml, err := d.Mailboxes()
+			if err != nil {
+				return err
+			}
+			for _, m := range ml {
+				mh, err := tx.GetMailHome(m)
+				if err != nil {
+					return err
+				}
+				oldHomes = append(oldHomes, mh)
+			}
+		}
+		d, err := tx.RenameDomain(args[0], args[1], keepOld)
+		if err != nil {
+			return err
+		}
+		for _, oh := range oldHomes {
+			lp := strings.TrimSuffix(oh.User(), "@"+args[0])
+			nh, err := tx.GetMailHome(lp + "@" + d.Name())
+			if err == nil {
+				err = st.CheckMove(oh, nh)
+			}
+			if err != nil {
+				return err
+			}
+			moves = append(moves, [2]*maildb.MailHome{oh, nh})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// each one that can be moved is, and the rest are reported
 	var (
-		err error
-		d   *maildb.Domain
+		failed   []string
+		firstErr error
 	)
+	for _, m := range moves {
+		if e := st.Move(m[0], m[1]); e != nil {
+			failed = append(failed, m[1].User())
+			if firstErr == nil {
+				firstErr = e
+			}
+		}
+	}
+	if firstErr != nil {
+		return storageError(strings.Join(failed, ", "), firstErr)
+	}
+	if st != nil {
+		if e := st.RemoveDomain(args[0]); e != nil {
+			return storageError(args[0], e)
+		}
+	}
+	return nil
+}
+
+// domainEdit the domain in the first arg
+func domainEdit(cmd *cobra.Command, args []string) (err error) {
+	var d *maildb.Domain
 
-	mdb.Begin()
-	defer mdb.End(&err)
+	tx, err := mdb.BeginContext(cmd.Context())
+	if err != nil {
+		return err
+	}
+	defer tx.End(&err)
 
-	d, err = mdb.GetDomain(args[0])
+	d, err = tx.GetDomain(args[0])
 	if err == nil && cmd.Flags().Changed("class") {
 		err = d.SetClass(dClass)
 	}
@@ -288,9 +413,53 @@ func domainEdit(cmd *cobra.Command, args []string) error {
 			err = d.SetTransport(dTransport)
 		}
 	}
+	if err == nil && cmd.Flags().Changed("quota") {
+		if strings.ToLower(dQuota) == "none" {
+			err = d.ClearQuota()
+		} else {
+			err = d.SetQuota(dQuota)
+		}
+	}
+	if err == nil {
+		err = domainPwFlags(cmd, d)
+	}
 	return err
 }
 
+// domainPwFlags
+// Set the password policy from the flags
+func domainPwFlags(cmd *cobra.Command, d *maildb.Domain) error {
+	for _, f := range []struct {
+		flag, key string
+		val       int64
+	}{
+		{"pw-max-age", "pw_max_age", pwMaxAge},
+		{"pw-min-length", "pw_min_length", pwMinLength},
+		{"pw-min-classes", "pw_min_classes", pwMinClasses},
+	} {
+		if cmd.Flags().Changed(f.flag) {
+			if err := domainPwPolicy(d, f.key, f.val); err != nil {
+				return fmt.Errorf("--%s: %s", f.flag, err)
+			}
+		}
+	}
+	return nil
+}
+
+// domainPwPolicy
+// Set the policy named by its import key
+func domainPwPolicy(d *maildb.Domain, key string, val int64) error {
+	switch key {
+	case "pw_max_age":
+		return d.SetPwMaxAge(val)
+	case "pw_min_length":
+		return d.SetPwMinLength(val)
+	case "pw_min_classes":
+		return d.SetPwMinClasses(val)
+	}
+	return fmt.Errorf("Unknown password policy %s", key)
+}
+
 // domainShow
 func domainShow(cmd *cobra.Command, args []string) error {
 	var (
@@ -298,12 +467,19 @@ func domainShow(cmd *cobra.Command, args []string) error {
 		d   *maildb.Domain
 	)
 
-	if d, err = mdb.LookupDomain(args[0]); err != nil {
+	if d, err = mdb.LookupDomainContext(cmd.Context(), args[0]); err != nil {
 		return err
 	}
 	cmd.Printf("Name:\t\t%s\nClass:\t\t%s\nTransport:\t%s\n",
 		d.Name(), d.Class(), d.Transport())
 	cmd.Printf("UserID:\t\t%s\nGroup ID:\t%s\nRestrictions:\t%s\n",
 		d.Vuid(), d.Vgid(), d.Rclass())
+	cmd.Printf("Quota:\t\t%s\n", d.Quota())
+	cmd.Printf("Pw Policy:\t%s\n", d.PwPolicy())
+	if ad, err := mdb.LookupAliasDomainContext(cmd.Context(), d.Name()); err == nil {
+		cmd.Printf("Alias of:\t%s\n", ad.Target())
+	} else if err != maildb.ErrMdbNotAliasDomain {
+		return err
+	}
 	return nil
 }
@@ -17,6 +17,7 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package cmd
 
 import (
+	"database/sql"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -94,7 +95,7 @@ bill.org class=local
 	if err != nil {
 		t.Errorf("Show of somewhere.org in good DB: Unexpected error, %s", err)
 	}
-	if out != "Name:\t\tsomewhere.org\nClass:\t\tinternet\nTransport:\t--\nUserID:\t\t--\nGroup ID:\t--\nRestrictions:\t--\n" {
+	if out != "Name:\t\tsomewhere.org\nClass:\t\tinternet\nTransport:\t--\nUserID:\t\t--\nGroup ID:\t--\nRestrictions:\t--\nQuota:\t\t--\nPw Policy:\t--\n" {
 		t.Errorf("Show of somewhere.org in good DB: did not get expected output, got %s", out)
 	}
 	if errout != "" {
@@ -158,7 +159,7 @@ bill.org class=local
 	if err != nil {
 		t.Errorf("Show of home.net in good DB: Unexpected error, %s", err)
 	}
-	if out != "Name:\t\thome.net\nClass:\t\tvirtual\nTransport:\trelay\nUserID:\t\t88\nGroup ID:\t89\nRestrictions:\tSTALL\n" {
+	if out != "Name:\t\thome.net\nClass:\t\tvirtual\nTransport:\trelay\nUserID:\t\t88\nGroup ID:\t89\nRestrictions:\tSTALL\nQuota:\t\t--\nPw Policy:\t--\n" {
 		t.Errorf("Show of home.net in good DB: did not get expected output, got %s", out)
 	}
 	if errout != "" {
@@ -182,7 +183,7 @@ bill.org class=local
 	if err != nil {
 		t.Errorf("Show of home.net in good DB: Unexpected error, %s", err)
 	}
-	if out != "Name:\t\thome.net\nClass:\t\tvirtual\nTransport:\t--\nUserID:\t\t--\nGroup ID:\t--\nRestrictions:\t--\n" {
+	if out != "Name:\t\thome.net\nClass:\t\tvirtual\nTransport:\t--\nUserID:\t\t--\nGroup ID:\t--\nRestrictions:\t--\nQuota:\t\t--\nPw Policy:\t--\n" {
 		t.Errorf("Show of home.net in good DB: did not get expected output, got %s", out)
 	}
 	if errout != "" {
@@ -324,3 +325,114 @@ bill.org class=local
 		t.Errorf("Export *.com domains: Expected no error output, got %s", errout)
 	}
 }
+
+// TestRenameCmds
+// Domain, transport and access renames in one database
+func TestRenameCmds(t *testing.T) {
+	var (
+		err    error
+		dir    string
+		dbfile string
+		args   []string
+		out    string
+	)
+
+	fmt.Println("TestRenameCmds")
+
+	dir, err = ioutil.TempDir("", "TestRenameCmds-*")
+	defer os.RemoveAll(dir)
+	dbfile = filepath.Join(dir, "test.db")
+	root := filepath.Join(dir, "vmail")
+	if err = os.Mkdir(root, 0755); err != nil {
+		t.Fatalf("Make vmail root: %s", err)
+	}
+
+	args = []string{"create", "-d", dbfile, "--no-locals", "--no-aliases"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Fatalf("Create DB: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "import", "transport"}
+	if _, _, err = doTest(rootCmd, "relay smtp:[mx.example.net]\n", args); err != nil {
+		t.Fatalf("Import transports: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "import", "access"}
+	if _, _, err = doTest(rootCmd, "block REJECT\n", args); err != nil {
+		t.Fatalf("Import access: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "import", "domain"}
+	if _, _, err = doTest(rootCmd, "pobox.org class=vmailbox, transport=relay, rclass=block\n", args); err != nil {
+		t.Fatalf("Import domains: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "--vmail-root", root, "add", "mailbox", "a@pobox.org",
+		"-u", fmt.Sprint(os.Getuid()), "-g", fmt.Sprint(os.Getgid())}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Fatalf("Add a@pobox.org: Unexpected error, %s", err)
+	}
+
+	args = []string{"-d", dbfile, "rename", "transport", "relay", "smarthost"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Errorf("Rename transport: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "rename", "access", "block", "reject"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Errorf("Rename access: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "--vmail-root", root, "rename", "domain", "pobox.org", "mailbox.org", "--keep-old"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Errorf("Rename domain: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "export", "domain"}
+	out, _, err = doTest(rootCmd, "", args)
+	if err != nil || !strings.Contains(out, "mailbox.org class=vmailbox, transport=smarthost, rclass=reject") ||
+		!strings.Contains(out, "pobox.org class=virtual") {
+		t.Errorf("Export domains: got %q, %v", out, err)
+	}
+	args = []string{"-d", dbfile, "show", "domain", "pobox.org"}
+	out, _, err = doTest(rootCmd, "", args)
+	if err != nil || !strings.HasSuffix(out, "Alias of:\tmailbox.org\n") {
+		t.Errorf("Show pobox.org: got %q, %v", out, err)
+	}
+	if _, err = os.Stat(filepath.Join(root, "mailbox.org", "a", maildb.MaildirName, "new")); err != nil {
+		t.Errorf("Rename domain: storage not moved, %s", err)
+	}
+	db, err := sql.Open("sqlite3", "file:"+dbfile+"?mode=ro")
+	if err != nil {
+		t.Fatalf("Open for virt_alias: %s", err)
+	}
+	defer db.Close()
+	var r string
+	row := db.QueryRow("SELECT recipient FROM virt_alias WHERE mailbox = ? AND domain_name = ?",
+		"a", "pobox.org")
+	if err = row.Scan(&r); err != nil || r != "a@mailbox.org" {
+		t.Errorf("virt_alias a@pobox.org: expected a@mailbox.org, got %q, %v", r, err)
+	}
+
+	// the old names are gone or taken
+	args = []string{"-d", dbfile, "rename", "transport", "relay", "uucp"}
+	if _, _, err = doTest(rootCmd, "", args); err != maildb.ErrMdbTransNotFound {
+		t.Errorf("Rename relay again: expected ErrMdbTransNotFound, got %v", err)
+	}
+	args = []string{"-d", dbfile, "--vmail-root", root, "rename", "domain", "mailbox.org", "pobox.org"}
+	if _, _, err = doTest(rootCmd, "", args); err != maildb.ErrMdbDupDomain {
+		t.Errorf("Rename onto pobox.org: expected ErrMdbDupDomain, got %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(root, "mailbox.org", "a")); err != nil {
+		t.Errorf("Failed rename: storage moved anyway, %s", err)
+	}
+
+	// storage in the way is found before the rename is committed
+	if err = os.MkdirAll(filepath.Join(root, "example.net", "a"), 0700); err != nil {
+		t.Fatalf("Make example.net storage: %s", err)
+	}
+	args = []string{"-d", dbfile, "--vmail-root", root, "rename", "domain", "mailbox.org", "example.net"}
+	if _, _, err = doTest(rootCmd, "", args); err != maildb.ErrMdbStorageExists {
+		t.Errorf("Rename onto example.net storage: expected ErrMdbStorageExists, got %v", err)
+	}
+	args = []string{"-d", dbfile, "show", "domain", "mailbox.org"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Errorf("Show mailbox.org: expected it not renamed, got %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(root, "mailbox.org", "a", maildb.MaildirName, "new")); err != nil {
+		t.Errorf("Rename onto example.net storage: storage moved anyway, %s", err)
+	}
+}
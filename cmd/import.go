@@ -23,6 +23,7 @@ import (
 	"os"
 	"strings"
 
+	"github.com/lieb/postdove/maildb"
 	"github.com/spf13/cobra"
 )
 
@@ -86,7 +87,8 @@ const (
 // aliases(5) and postfix postmap rules
 // We are a bit more relaxed here. You can have a comment at the end of a line
 // We can get two errors, one syntax and the other from the "worker" we return both
-func procImport(cmd *cobra.Command, use ImportType, worker func([]string) error) error {
+func procImport(cmd *cobra.Command, tx *maildb.Tx, use ImportType,
+	worker func(*maildb.Tx, []string) error) error {
 	var (
 		lines   = bufio.NewScanner(cmd.InOrStdin())
 		line    string
@@ -99,6 +101,10 @@ func procImport(cmd *cobra.Command, use ImportType, worker func([]string) error)
 	for lines.Scan() {
 		segment = lines.Text()
 		lineno++
+		if err = tx.Context().Err(); err != nil { // interrupted, give up
+			err = fmt.Errorf("At line %d: %s", lineno, err)
+			break
+		}
 		com := strings.IndexByte(segment, '#')
 		if com != -1 { // a comment, strip it
 			segment = segment[0:com]
@@ -119,7 +125,7 @@ func procImport(cmd *cobra.Command, use ImportType, worker func([]string) error)
 			line = strings.TrimLeft(segment, " \t")
 			continue
 		} else {
-			if err = procLine(line, use, worker); err != nil {
+			if err = procLine(tx, line, use, worker); err != nil {
 				err = fmt.Errorf("Near line %d: %s", lineno, err)
 				break
 			}
@@ -128,7 +134,7 @@ func procImport(cmd *cobra.Command, use ImportType, worker func([]string) error)
 		}
 	}
 	if err == nil && line != "" {
-		if err = procLine(line, use, worker); err != nil {
+		if err = procLine(tx, line, use, worker); err != nil {
 			err = fmt.Errorf("Near line %d: %s", lineno, err)
 		}
 		imports++
@@ -143,7 +149,8 @@ func procImport(cmd *cobra.Command, use ImportType, worker func([]string) error)
 }
 
 // procLine
-func procLine(line string, use ImportType, worker func([]string) error) error {
+func procLine(tx *maildb.Tx, line string, use ImportType,
+	worker func(*maildb.Tx, []string) error) error {
 	var (
 		tokens []string
 		err    error
@@ -195,7 +202,7 @@ func procLine(line string, use ImportType, worker func([]string) error) error {
 		tokens = strings.Split(line, ":")
 	}
 	if len(tokens) > 0 {
-		err = worker(tokens)
+		err = worker(tx, tokens)
 	} else {
 		err = fmt.Errorf("Unrecognized import line")
 	}
@@ -18,13 +18,19 @@ package cmd
 
 import (
 	"bytes"
+	"context"
+	"database/sql"
 	"fmt"
-	//"io/ioutil"
-	//"os"
-	//"path/filepath"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
-	//"github.com/lieb/postdove/maildb"
+	"time"
+
+	"github.com/lieb/postdove/maildb"
 	//"github.com/spf13/cobra"
 )
 
@@ -152,7 +158,7 @@ abcde
 }
 
 // test_worker test dummy to compare results to expected tokens
-func test_worker(t []string) error {
+func test_worker(tx *maildb.Tx, t []string) error {
 	var (
 		test Res
 		err  error
@@ -181,7 +187,7 @@ func testImport(t *testing.T, test Res) {
 	inbuf := bytes.NewBufferString(test.importFile)
 	resLine = 0
 	rootCmd.SetIn(inbuf)
-	err = procImport(rootCmd, test.use, test_worker)
+	err = procImport(rootCmd, nil, test.use, test_worker)
 	if err == nil {
 		if test.errcode != "" {
 			t.Errorf("Test %s: Expected error %s, got success", test.test, test.errcode)
@@ -207,3 +213,180 @@ func Test_Import(t *testing.T) {
 	}
 
 }
+
+// cancelReader
+// Hands out its chunks one Read at a time and cancels
+// the context when it gets to the chunk at cancelAt
+type cancelReader struct {
+	chunks   []string
+	cancelAt int
+	cancel   context.CancelFunc
+}
+
+func (r *cancelReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	if r.cancelAt == 0 {
+		r.cancel()
+	}
+	r.cancelAt--
+	n := copy(p, r.chunks[0])
+	r.chunks = r.chunks[1:]
+	return n, nil
+}
+
+// TestImportInterrupt
+// An interrupt part way through an import leaves the database as it was
+func TestImportInterrupt(t *testing.T) {
+	var (
+		err    error
+		dir    string
+		dbfile string
+		tdb    *maildb.MailDB
+	)
+
+	fmt.Println("TestImportInterrupt")
+
+	dir, err = ioutil.TempDir("", "TestImportInterrupt-*")
+	defer os.RemoveAll(dir)
+	dbfile = filepath.Join(dir, "test.db")
+
+	args := []string{"create", "-d", dbfile, "--no-locals", "--no-aliases"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Fatalf("Create DB: Unexpected error, %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rootCmd.SetIn(&cancelReader{
+		chunks:   []string{"bill.org\nsteve.org\n", "mary.org\n"},
+		cancelAt: 1,
+		cancel:   cancel,
+	})
+	rootCmd.SetOut(ioutil.Discard)
+	rootCmd.SetErr(ioutil.Discard)
+	rootCmd.SetArgs([]string{"-d", dbfile, "import", "domain"})
+	err = rootCmd.ExecuteContext(ctx)
+	if err == nil {
+		t.Errorf("Interrupted import: expected an error")
+	} else if !strings.Contains(err.Error(), context.Canceled.Error()) {
+		t.Errorf("Interrupted import: expected %s, got %s", context.Canceled, err)
+	}
+
+	if tdb, err = maildb.OpenMailDB(dbfile); err != nil {
+		t.Fatalf("Open DB: Unexpected error, %s", err)
+	}
+	defer tdb.Close()
+	if dl, err := tdb.FindDomain("*"); err != maildb.ErrMdbDomainNotFound {
+		t.Errorf("Interrupted import: expected no domains, got %d, %v", len(dl), err)
+	}
+}
+
+// TestImportStress
+// Postfix and dovecot keep reading the database while a big import
+// is going. They must never see an error, i.e. SQLITE_BUSY.
+func TestImportStress(t *testing.T) {
+	const (
+		lines   = 100000
+		readers = 4
+	)
+	var (
+		err    error
+		dir    string
+		dbfile string
+		wg     sync.WaitGroup
+		reads  = make([]int, readers)
+		errs   = make([]error, readers)
+		done   = make(chan struct{})
+	)
+
+	if testing.Short() {
+		t.Skip("skipping the big import in short mode")
+	}
+	fmt.Println("TestImportStress")
+
+	dir, err = ioutil.TempDir("", "TestImportStress-*")
+	defer os.RemoveAll(dir)
+	dbfile = filepath.Join(dir, "test.db")
+
+	for _, args := range [][]string{
+		{"create", "-d", dbfile},
+		{"-d", dbfile, "add", "domain", "pobox.org", "-c", "vmailbox"},
+		{"-d", dbfile, "add", "mailbox", "jeff@pobox.org"},
+		{"-d", dbfile, "add", "virtual", "info@pobox.org", "jeff@pobox.org"},
+	} {
+		if _, _, err = doTest(rootCmd, "", args); err != nil {
+			t.Fatalf("%s: Unexpected error, %s", strings.Join(args, " "), err)
+		}
+	}
+
+	var in strings.Builder
+	for i := 0; i < lines; i++ {
+		fmt.Fprintf(&in, "u%d@pobox.org jeff@pobox.org\n", i)
+	}
+
+	// The readers are like postfix, no busy timeout and read only
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+
+			db, err := sql.Open("sqlite3", "file:"+dbfile+"?mode=ro&_busy_timeout=0")
+			if err != nil {
+				errs[r] = err
+				return
+			}
+			defer db.Close()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				var res string
+
+				err = db.QueryRow(
+					"SELECT password FROM user_mailbox WHERE username = ? AND domain = ?",
+					"jeff", "pobox.org").Scan(&res)
+				if err == nil {
+					err = db.QueryRow(
+						"SELECT recipient FROM virt_alias WHERE mailbox = ? AND domain_name = ?",
+						"info", "pobox.org").Scan(&res)
+					if err == nil && res != "jeff@pobox.org" {
+						err = fmt.Errorf("virt_alias: expected jeff@pobox.org, got %s", res)
+					}
+				}
+				if err != nil {
+					errs[r] = err
+					return
+				}
+				reads[r]++
+				time.Sleep(time.Millisecond) // mail doesn't arrive that fast
+			}
+		}(r)
+	}
+
+	start := time.Now()
+	_, _, err = doTest(rootCmd, in.String(), []string{"-d", dbfile, "import", "virtual"})
+	close(done)
+	wg.Wait()
+	if err != nil {
+		t.Errorf("Import of %d lines: Unexpected error, %s", lines, err)
+	}
+	fmt.Printf("imported %d lines in %s, reads %v\n", lines, time.Since(start), reads)
+	for r, e := range errs {
+		if e != nil {
+			t.Errorf("Reader %d: failed after %d reads, %s", r, reads[r], e)
+		} else if reads[r] == 0 {
+			t.Errorf("Reader %d: never got to read", r)
+		}
+	}
+
+	out, _, err := doTest(rootCmd, "", []string{"-d", dbfile, "export", "virtual"})
+	if err != nil {
+		t.Errorf("Export: Unexpected error, %s", err)
+	} else if n := strings.Count(out, "\n"); n != lines+1 {
+		t.Errorf("Export: expected %d aliases, got %d", lines+1, n)
+	}
+}
@@ -0,0 +1,145 @@
+/*
+Copyright © 2021 Jim Lieb <lieb@sea-troll.net>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lieb/postdove/maildb"
+	"github.com/spf13/cobra"
+)
+
+var (
+	logEntity string
+	logUser   string
+	logSince  string
+	logUntil  string
+)
+
+// the things we log and the names we use for them
+var logEntities = []string{"access", "transport", "domain", "address", "alias", "mailbox", "credential", "sieve", "vacation", "forward", "aliasdomain"}
+
+// time formats accepted by --since and --until, in local time
+var logTimeFormats = []string{
+	"2006-01-02",
+	"2006-01-02 15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	time.RFC3339,
+}
+
+// logCmd represents the log command
+var logCmd = &cobra.Command{
+	Use:   "log [key]",
+	Short: "Show the audit log of changes to the database",
+	Long: `Show the audit log of changes made to the database, oldest first.
+Each entry records when the change was made, who made it and with what command,
+and the before and after values of what changed. The optional key is the name
+of what changed, e.g. a domain or user@domain. It can have '*' wildcards.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: cmdLog,
+}
+
+// parseLogTime
+func parseLogTime(s string) (time.Time, bool, error) {
+	for _, f := range logTimeFormats {
+		if t, err := time.ParseInLocation(f, s, time.Local); err == nil {
+			return t, f == logTimeFormats[0], nil
+		}
+	}
+	return time.Time{}, false, fmt.Errorf("Cannot parse time %s, use YYYY-MM-DD [HH:MM[:SS]]", s)
+}
+
+// cmdLog
+func cmdLog(cmd *cobra.Command, args []string) error {
+	var (
+		f   maildb.AuditFilter
+		err error
+	)
+
+	if cmd.Flags().Changed("entity") {
+		f.Entity = strings.ToLower(logEntity)
+		known := false
+		for _, e := range logEntities {
+			if f.Entity == e {
+				known = true
+			}
+		}
+		if !known {
+			return fmt.Errorf("Unknown entity %s, must be one of %s",
+				logEntity, strings.Join(logEntities, ", "))
+		}
+	}
+	if cmd.Flags().Changed("user") {
+		f.User = logUser
+	}
+	if cmd.Flags().Changed("since") {
+		if f.Since, _, err = parseLogTime(logSince); err != nil {
+			return err
+		}
+	}
+	if cmd.Flags().Changed("until") {
+		var dateOnly bool
+
+		if f.Until, dateOnly, err = parseLogTime(logUntil); err != nil {
+			return err
+		}
+		if dateOnly { // until a date includes all of that day
+			f.Until = f.Until.AddDate(0, 0, 1)
+		}
+	}
+	if len(args) > 0 {
+		f.Key = args[0]
+	}
+	al, err := mdb.FindAuditContext(cmd.Context(), &f)
+	if err != nil {
+		return err
+	}
+	for i, e := range al {
+		if i > 0 {
+			cmd.Printf("\n")
+		}
+		cmd.Printf("Time:\t\t%s\nUser:\t\t%s\nCommand:\t%s\nChange:\t\t%s %s %s\n",
+			e.Stamp().Local().Format("2006-01-02 15:04:05 MST"),
+			logValue(e.User()), logValue(e.Command()),
+			e.Op(), e.Entity(), e.Key())
+		cmd.Printf("Before:\t\t%s\nAfter:\t\t%s\n", logValue(e.Before()), logValue(e.After()))
+	}
+	return nil
+}
+
+// logValue
+func logValue(s string) string {
+	if s == "" {
+		return "--"
+	}
+	return s
+}
+
+func init() {
+	rootCmd.AddCommand(logCmd)
+	logCmd.Flags().StringVarP(&logEntity, "entity", "e", "",
+		"Only show changes to this kind of entry: "+strings.Join(logEntities, ", "))
+	logCmd.Flags().StringVarP(&logUser, "user", "u", "",
+		"Only show changes made by this user")
+	logCmd.Flags().StringVarP(&logSince, "since", "s", "",
+		"Only show changes made at or after this time, YYYY-MM-DD [HH:MM[:SS]]")
+	logCmd.Flags().StringVarP(&logUntil, "until", "t", "",
+		"Only show changes made before this time. A date includes the whole day")
+}
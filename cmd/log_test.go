@@ -0,0 +1,135 @@
+/*
+Copyright © 2021 Jim Lieb <lieb@sea-troll.net>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestLogCmd
+// Remember that flag state carries across runs so the tests with
+// fewer flags go first.
+func TestLogCmd(t *testing.T) {
+	var (
+		err         error
+		dir         string
+		dbfile      string
+		args        []string
+		out, errout string
+	)
+
+	fmt.Println("TestLogCmd")
+
+	dir, err = ioutil.TempDir("", "TestLog-*")
+	defer os.RemoveAll(dir)
+	dbfile = filepath.Join(dir, "test.db")
+
+	args = []string{"create", "-d", dbfile, "--no-locals", "--no-aliases"}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err != nil {
+		t.Errorf("Create DB: Unexpected error, %s", err)
+	}
+
+	// A fresh database has nothing to show
+	args = []string{"-d", dbfile, "log"}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err != nil {
+		t.Errorf("Empty log: Unexpected error, %s", err)
+	}
+	if out != "" || errout != "" {
+		t.Errorf("Empty log: did not expect output, got %s, %s", out, errout)
+	}
+
+	args = []string{"-d", dbfile, "add", "virtual", "info@example.com", "bob@example.net", "dave@example.net"}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err != nil {
+		t.Errorf("Add info@example.com: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "delete", "virtual", "info@example.com"}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err != nil {
+		t.Errorf("Delete info@example.com: Unexpected error, %s", err)
+	}
+
+	// Everything about bob@example.net, the add and the cascaded delete
+	args = []string{"-d", dbfile, "log", "bob@*"}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err != nil {
+		t.Errorf("Log bob: Unexpected error, %s", err)
+	}
+	if !strings.Contains(out, "Change:\t\tINSERT address bob@example.net\n") ||
+		!strings.Contains(out, "Change:\t\tDELETE address bob@example.net\n") {
+		t.Errorf("Log bob: did not get expected output, got %s", out)
+	}
+	if !strings.Contains(out, "Command:\t") || strings.Contains(out, "Command:\t--") {
+		t.Errorf("Log bob: expected a command line, got %s", out)
+	}
+	if errout != "" {
+		t.Errorf("Log bob: did not expect error output, got %s", errout)
+	}
+
+	// Who removed the forwarding?
+	args = []string{"-d", dbfile, "log", "--entity", "alias", "--since", "2000-01-01"}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err != nil {
+		t.Errorf("Log alias: Unexpected error, %s", err)
+	}
+	if strings.Count(out, "Change:\t\tDELETE alias info@example.com\n") != 2 {
+		t.Errorf("Log alias: expected two alias deletes, got %s", out)
+	}
+	if !strings.Contains(out, `"target":"dave@example.net"`) {
+		t.Errorf("Log alias: expected before values, got %s", out)
+	}
+	if strings.Contains(out, "Change:\t\tINSERT address") {
+		t.Errorf("Log alias: did not expect address changes, got %s", out)
+	}
+
+	args = []string{"-d", dbfile, "log", "--entity", "alias", "--until", "2000-01-01"}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err != nil {
+		t.Errorf("Log until 2000: Unexpected error, %s", err)
+	}
+	if out != "" {
+		t.Errorf("Log until 2000: did not expect output, got %s", out)
+	}
+
+	args = []string{"-d", dbfile, "log", "--entity", "alias", "--until", "2999-12-31", "--user", "nobody-here"}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err != nil {
+		t.Errorf("Log nobody: Unexpected error, %s", err)
+	}
+	if out != "" {
+		t.Errorf("Log nobody: did not expect output, got %s", out)
+	}
+
+	// Bad args
+	args = []string{"-d", dbfile, "log", "--entity", "bogus"}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err == nil {
+		t.Errorf("Log bogus entity: should have failed")
+	}
+	args = []string{"-d", dbfile, "log", "--entity", "alias", "--since", "yesterday"}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err == nil {
+		t.Errorf("Log bad time: should have failed")
+	}
+}
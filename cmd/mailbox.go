@@ -17,17 +17,25 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package cmd
 
 import (
+	"bufio"
 	"fmt"
+	"io"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/lieb/postdove/maildb"
 	"github.com/spf13/cobra"
+	"golang.org/x/term"
 )
 
 var (
 	pw_type    string
+	pwScheme   string
 	password   string
+	pwStdin    bool
 	noPassword bool
 	uid        int64
 	noUid      bool
@@ -37,6 +45,16 @@ var (
 	noHome     bool
 	quota      string
 	enable     bool
+	allowProto []string
+	denyProto  []string
+	maxAge     int64
+	noMaxAge   bool
+	pwSetDate  string
+	forwardTo  []string
+	keepCopy   bool
+	noForward  bool
+	keepOld    bool
+	expDays    int
 )
 
 // importMailbox do import of an mailboxes file
@@ -65,7 +83,7 @@ var addMailbox = &cobra.Command{
 	Short: "Add an mailbox and its address into the database",
 	Long: `Add an mailbox into the database. The address must be in an already
 existing vmailbox domain. The flags set the various login parameters such as password and
-quota.`,
+quota. The password is hashed with the --scheme unless --type says it already is encoded.`,
 	Args: cobra.ExactArgs(1), // mailbox recipient ...
 	RunE: mailboxAdd,
 }
@@ -84,9 +102,22 @@ All of the aliases that point to it must be changed or deleted first`,
 var editMailbox = &cobra.Command{
 	Use:   "mailbox address [ flags ]",
 	Short: "Edit the mailbox  for the address in the database",
-	Long:  `Edit a mailbox to change attributes such as uid/gid, password, quota.`,
-	Args:  cobra.MaximumNArgs(4), // mailbox to edit
-	RunE:  mailboxEdit,
+	Long: `Edit a mailbox to change attributes such as uid/gid, password, quota.
+The password is hashed with the --scheme unless --type says it already is encoded.`,
+	Args: cobra.MaximumNArgs(4), // mailbox to edit
+	RunE: mailboxEdit,
+}
+
+// renameMailbox give a mailbox a new address
+var renameMailbox = &cobra.Command{
+	Use:   "mailbox old new [ flags ]",
+	Short: "Change the address of a mailbox",
+	Long: `Change the address of a mailbox, in its domain or to another vmailbox domain.
+The mailbox keeps its password, quota and everything else, and the aliases to it
+now deliver to the new address. With --keep-old the old address becomes an alias to
+the new one. With --vmail-root the mail storage is moved if its home changes.`,
+	Args: cobra.ExactArgs(2),
+	RunE: mailboxRename,
 }
 
 // showMailbox display the mailbox and its attributes
@@ -98,15 +129,54 @@ var showMailbox = &cobra.Command{
 	RunE:  mailboxShow,
 }
 
+// verifyMailbox check a password against the mailbox's
+var verifyMailbox = &cobra.Command{
+	Use:   "mailbox address [ flags ]",
+	Short: "Verify a password for the mailbox",
+	Long: `Check a password against the one stored for the mailbox the same way dovecot
+does when the user logs in, and then against its unexpired credentials. A matching
+credential is marked as used. The command fails if nothing matches. Without
+--password, the password is read from stdin or prompted for if stdin is a terminal.`,
+	Args: cobra.ExactArgs(1),
+	RunE: mailboxVerify,
+}
+
+// reportPasswords list the mailboxes whose passwords need work
+var reportPasswords = &cobra.Command{
+	Use:   "passwords [ address ]",
+	Short: "Report mailboxes with no password, plain passwords, or weak hashes",
+	Long: `Report, by domain, how the mailbox passwords are stored. Each mailbox
+with no password, a PLAIN password, or a weak hash is listed with its type.
+The address can be wildcarded, such as "*@example.com". The default is all mailboxes.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: passwordsReport,
+}
+
+// reportExpiring list the mailboxes whose passwords expire soon
+var reportExpiring = &cobra.Command{
+	Use:   "expiring [ address ] [ flags ]",
+	Short: "Report mailboxes whose passwords expire within --days",
+	Long: `Report, by domain, the mailboxes whose passwords have expired or will
+expire within the next --days days, soonest first. An expired password is denied
+by dovecot the same way as a disabled mailbox. The address can be wildcarded,
+such as "*@example.com". The default is all mailboxes.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: expiringReport,
+}
+
 // linkage to top level commands
 func init() {
 	importCmd.AddCommand(importMailbox)
 	exportCmd.AddCommand(exportMailbox)
 	addCmd.AddCommand(addMailbox)
 	addMailbox.Flags().StringVarP(&pw_type, "type", "t", "PLAIN",
-		"Password encoding type")
+		"Encoding type of an already encoded password")
 	addMailbox.Flags().StringVarP(&password, "password", "p", "",
 		"Account password")
+	addMailbox.Flags().StringVarP(&pwScheme, "scheme", "s", maildb.DefaultPwScheme,
+		"Password hash scheme, one of "+strings.Join(maildb.PwSchemes(), ", "))
+	addMailbox.Flags().BoolVarP(&pwStdin, "password-stdin", "r", false,
+		"Read the password from stdin, prompt for it if a terminal")
 	addMailbox.Flags().Int64VarP(&uid, "uid", "u", 99, // nobody user
 		"User ID for this mailbox")
 	addMailbox.Flags().Int64VarP(&gid, "gid", "g", 99, // nobody group
@@ -119,12 +189,22 @@ func init() {
 		"Enable this mailbox for access")
 	addMailbox.Flags().BoolVarP(&enable, "no-enable", "E", false,
 		"Enable this mailbox for access")
+	addMailbox.Flags().StringSliceVarP(&allowProto, "allow", "a", nil,
+		"Protocols to allow, any of "+strings.Join(maildb.MailProtocols, ", ")+" or all")
+	addMailbox.Flags().StringSliceVarP(&denyProto, "deny", "D", nil,
+		"Protocols to deny, any of "+strings.Join(maildb.MailProtocols, ", ")+" or all")
+	addMailbox.Flags().Int64Var(&maxAge, "max-age", 0,
+		"Days until the password expires, instead of the domain's. 0 is never")
 	deleteCmd.AddCommand(deleteMailbox)
 	editCmd.AddCommand(editMailbox)
 	editMailbox.Flags().StringVarP(&pw_type, "type", "t", "PLAIN",
-		"Password encoding type")
+		"Encoding type of an already encoded password")
 	editMailbox.Flags().StringVarP(&password, "password", "p", "",
 		"Account password")
+	editMailbox.Flags().StringVarP(&pwScheme, "scheme", "s", maildb.DefaultPwScheme,
+		"Password hash scheme, one of "+strings.Join(maildb.PwSchemes(), ", "))
+	editMailbox.Flags().BoolVarP(&pwStdin, "password-stdin", "r", false,
+		"Read the password from stdin, prompt for it if a terminal")
 	editMailbox.Flags().BoolVarP(&noPassword, "no-password", "P", false,
 		"Clear Account password")
 	editMailbox.Flags().Int64VarP(&uid, "uid", "u", 99, // nobody user
@@ -145,24 +225,53 @@ func init() {
 		"Enable this mailbox for access")
 	editMailbox.Flags().BoolVarP(&enable, "no-enable", "E", false,
 		"Enable this mailbox for access")
+	editMailbox.Flags().StringSliceVarP(&allowProto, "allow", "a", nil,
+		"Protocols to allow, any of "+strings.Join(maildb.MailProtocols, ", ")+" or all")
+	editMailbox.Flags().StringSliceVarP(&denyProto, "deny", "D", nil,
+		"Protocols to deny, any of "+strings.Join(maildb.MailProtocols, ", ")+" or all")
+	editMailbox.Flags().Int64Var(&maxAge, "max-age", 0,
+		"Days until the password expires, instead of the domain's. 0 is never")
+	editMailbox.Flags().BoolVar(&noMaxAge, "no-max-age", false,
+		"Use the domain's maximum password age")
+	editMailbox.Flags().StringVar(&pwSetDate, "password-set", "",
+		"Date the password was set, YYYY-MM-DD, to start its age from")
+	editMailbox.Flags().StringSliceVar(&forwardTo, "forward", nil,
+		"Forward the mail to these addresses, comma separated")
+	editMailbox.Flags().BoolVar(&keepCopy, "keep-copy", false,
+		"Deliver forwarded mail to the mailbox as well")
+	editMailbox.Flags().BoolVar(&noForward, "no-forward", false,
+		"Stop forwarding the mail")
+	renameCmd.AddCommand(renameMailbox)
+	renameMailbox.Flags().BoolVar(&keepOld, "keep-old", false,
+		"Make the old address an alias to the new one")
 	showCmd.AddCommand(showMailbox)
+	verifyCmd.AddCommand(verifyMailbox)
+	verifyMailbox.Flags().StringVarP(&password, "password", "p", "",
+		"Password to check")
+	verifyMailbox.Flags().BoolVarP(&pwStdin, "password-stdin", "r", false,
+		"Read the password from stdin, prompt for it if a terminal")
+	reportCmd.AddCommand(reportPasswords)
+	reportCmd.AddCommand(reportExpiring)
+	reportExpiring.Flags().IntVar(&expDays, "days", 30,
+		"Report passwords that expire within this many days")
 }
 
 // mailboxImport the mailboxes from inFile
-func mailboxImport(cmd *cobra.Command, args []string) error {
-	var err error
-
-	mdb.Begin()
-	defer mdb.End(&err)
+func mailboxImport(cmd *cobra.Command, args []string) (err error) {
+	tx, err := mdb.BeginContext(cmd.Context())
+	if err != nil {
+		return err
+	}
+	defer tx.End(&err)
 
-	err = procImport(cmd, PWFILE, procMailbox)
+	err = procImport(cmd, tx, PWFILE, procMailbox)
 	return err
 }
 
 // procMailbox
 // user:password:uid:gid:(gecos):home:(shell):extra_fields
 // gecos and shell fields ignored (for now). quota is encoded in extra_fields
-func procMailbox(tokens []string) error {
+func procMailbox(tx *maildb.Tx, tokens []string) error {
 	var (
 		mb               *maildb.VMailbox
 		pwType, password string
@@ -173,7 +282,7 @@ func procMailbox(tokens []string) error {
 		return fmt.Errorf("Must have at least a user field and a password field")
 	}
 	// tokens[0] account email address
-	if mb, err = mdb.InsertVMailbox(tokens[0]); err != nil {
+	if mb, err = tx.InsertVMailbox(tokens[0]); err != nil {
 		return err
 	}
 	// tokens[1] password with possible "{type}" field
@@ -224,18 +333,16 @@ func procMailbox(tokens []string) error {
 		tokens[7] = strings.Join(tokens[7:], ":")
 		ef := strings.Fields(tokens[7])
 		for _, f := range ef {
-			kv := strings.Split(f, "=")
+			kv := strings.SplitN(f, "=", 2)
 			if len(kv) < 2 {
 				return fmt.Errorf("Extra field \"%s\" is not a key=value pair", f)
 			}
 			switch kv[0] {
 			case "userdb_quota_rule":
-				if len(kv) == 2 && strings.ToLower(kv[1]) == "none" {
+				if strings.ToLower(kv[1]) == "none" {
 					err = mb.ClearQuota()
-				} else if len(kv) == 3 {
-					err = mb.SetQuota(kv[1] + "=" + kv[2])
 				} else {
-					err = fmt.Errorf("Badly formatted quota rule")
+					err = mb.SetQuota(kv[1])
 				}
 				if err != nil {
 					return err
@@ -253,6 +360,27 @@ func procMailbox(tokens []string) error {
 				if err != nil {
 					return err
 				}
+			case "mbox_deny":
+				for _, p := range strings.Split(kv[1], ",") {
+					if p == "" {
+						continue
+					}
+					if err = mb.DenyProtocol(p); err != nil {
+						return fmt.Errorf("mbox_deny: %s", err)
+					}
+				}
+			case "mbox_pw_max_age":
+				if days, err := strconv.ParseInt(kv[1], 10, 64); err != nil {
+					return fmt.Errorf("mbox_pw_max_age: %s", err)
+				} else if err = mb.SetPwMaxAge(days); err != nil {
+					return fmt.Errorf("mbox_pw_max_age: %s", err)
+				}
+			case "mbox_pw_set":
+				if t, err := time.Parse(maildb.PwSetFormat, kv[1]); err != nil {
+					return fmt.Errorf("mbox_pw_set: %s", err)
+				} else if err = mb.SetPwSet(t); err != nil {
+					return fmt.Errorf("mbox_pw_set: %s", err)
+				}
 			default:
 				return fmt.Errorf("Unknown extra field")
 			}
@@ -273,7 +401,7 @@ func mailboxExport(cmd *cobra.Command, args []string) error {
 	default:
 		return fmt.Errorf("Only one vMailbox can be specified")
 	}
-	ml, err := mdb.FindVMailbox(vMailbox)
+	ml, err := mdb.FindVMailboxContext(cmd.Context(), vMailbox)
 	if err == nil {
 		for _, m := range ml {
 			cmd.Printf("%s\n", m.Export())
@@ -283,22 +411,35 @@ func mailboxExport(cmd *cobra.Command, args []string) error {
 }
 
 // mailboxAdd the mailbox and its address
+// and then, once that is committed, its storage
 func mailboxAdd(cmd *cobra.Command, args []string) error {
-	var (
-		mb  *maildb.VMailbox
-		err error
-	)
+	st, err := mailStorage()
+	if err != nil {
+		return err
+	}
+	mh, err := mailboxAddTx(cmd, args, st)
+	if err != nil || mh == nil {
+		return err
+	}
+	_, err = st.Provision(mh)
+	return storageError(args[0], err)
+}
 
-	mdb.Begin()
-	defer mdb.End(&err)
+// mailboxAddTx
+// The database part of mailboxAdd. The mail home is checked but not made.
+func mailboxAddTx(cmd *cobra.Command, args []string, st *maildb.Storage) (mh *maildb.MailHome, err error) {
+	var mb *maildb.VMailbox
 
-	mb, err = mdb.InsertVMailbox(args[0])
-	// use flags to add stuff
-	if err == nil && cmd.Flags().Changed("type") {
-		err = mb.SetPwType(pw_type)
+	tx, err := mdb.BeginContext(cmd.Context())
+	if err != nil {
+		return nil, err
 	}
-	if err == nil && cmd.Flags().Changed("password") {
-		err = mb.SetPassword(password)
+	defer tx.End(&err)
+
+	mb, err = tx.InsertVMailbox(args[0])
+	// use flags to add stuff
+	if err == nil {
+		err = mailboxPassword(cmd, mb)
 	}
 	if err == nil && cmd.Flags().Changed("uid") {
 		err = mb.SetUid(uid)
@@ -325,34 +466,95 @@ func mailboxAdd(cmd *cobra.Command, args []string) error {
 	if err == nil && cmd.Flags().Changed("no-enable") {
 		err = mb.Disable()
 	}
-	return err
+	if err == nil {
+		err = mailboxProtocols(cmd, mb)
+	}
+	if err == nil && cmd.Flags().Changed("max-age") {
+		err = mb.SetPwMaxAge(maxAge)
+	}
+	if err == nil && st != nil {
+		if mh, err = tx.GetMailHome(args[0]); err == nil {
+			_, err = st.Path(mh)
+		}
+	}
+	return mh, err
 }
 
 // mailboxDelete the mailbox and address in the first arg
+// and move its mail to the trash if there is a vmail root
+// once the delete is committed
 func mailboxDelete(cmd *cobra.Command, args []string) error {
-	return mdb.DeleteVMailbox(args[0])
+	var mh *maildb.MailHome
+
+	st, err := mailStorage()
+	if err != nil {
+		return err
+	}
+	err = mdb.WithTxContext(cmd.Context(), func(tx *maildb.Tx) error {
+		mh = nil
+		if st == nil {
+			return tx.DeleteVMailbox(args[0])
+		}
+		h, err := tx.GetMailHome(args[0])
+		if err == nil {
+			_, err = st.Path(h)
+		}
+		if err == nil {
+			err = tx.DeleteVMailbox(args[0])
+		}
+		if err == nil {
+			mh = h
+		}
+		return err
+	})
+	if err != nil || mh == nil {
+		return err
+	}
+	_, err = st.Remove(mh, time.Now())
+	return storageError(args[0], err)
 }
 
 // mailboxEdit the mailbox of the address in the first arg
+// and move its storage once that is committed if its home changed
 func mailboxEdit(cmd *cobra.Command, args []string) error {
-	var (
-		mb  *maildb.VMailbox
-		err error
-	)
+	st, err := mailStorage()
+	if err != nil {
+		return err
+	}
+	oldHome, newHome, err := mailboxEditTx(cmd, args, st)
+	if err != nil || oldHome == nil {
+		return err
+	}
+	return storageError(args[0], st.Move(oldHome, newHome))
+}
 
-	mdb.Begin()
-	defer mdb.End(&err)
+// mailboxEditTx
+// The database part of mailboxEdit. The move is checked but not done.
+func mailboxEditTx(cmd *cobra.Command, args []string, st *maildb.Storage) (oldHome, newHome *maildb.MailHome, err error) {
+	var mb *maildb.VMailbox
 
-	mb, err = mdb.GetVMailbox(args[0])
-	// use flags to add stuff
-	if err == nil && cmd.Flags().Changed("type") {
-		err = mb.SetPwType(pw_type)
+	tx, err := mdb.BeginContext(cmd.Context())
+	if err != nil {
+		return nil, nil, err
 	}
+	defer tx.End(&err)
+
+	mb, err = tx.GetVMailbox(args[0])
+	if err == nil && st != nil &&
+		(cmd.Flags().Changed("mail-home") || cmd.Flags().Changed("no-mail-home")) {
+		oldHome, err = tx.GetMailHome(args[0])
+	}
+	// use flags to add stuff
 	if err == nil {
 		if cmd.Flags().Changed("no-password") {
-			err = mb.ClearPassword()
-		} else if cmd.Flags().Changed("password") {
-			err = mb.SetPassword(password)
+			if cmd.Flags().Changed("type") {
+				err = mb.SetPwType(pw_type)
+			}
+			if err == nil {
+				err = mb.ClearPassword()
+			}
+		} else {
+			err = mailboxPassword(cmd, mb)
 		}
 	}
 	if err == nil {
@@ -392,9 +594,201 @@ func mailboxEdit(cmd *cobra.Command, args []string) error {
 			err = mb.Disable()
 		}
 	}
+	if err == nil {
+		err = mailboxProtocols(cmd, mb)
+	}
+	if err == nil {
+		if cmd.Flags().Changed("no-max-age") {
+			err = mb.ClearPwMaxAge()
+		} else if cmd.Flags().Changed("max-age") {
+			err = mb.SetPwMaxAge(maxAge)
+		}
+	}
+	if err == nil && cmd.Flags().Changed("password-set") {
+		var t time.Time
+		if t, err = time.ParseInLocation("2006-01-02", pwSetDate, time.Local); err != nil {
+			return nil, nil, fmt.Errorf("--password-set: %s", err)
+		}
+		err = mb.SetPwSet(t)
+	}
+	if err == nil {
+		err = mailboxForward(cmd, tx, args[0])
+	}
+	if err == nil && oldHome != nil {
+		if newHome, err = tx.GetMailHome(args[0]); err == nil {
+			err = st.CheckMove(oldHome, newHome)
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return oldHome, newHome, nil
+}
+
+// mailboxRename
+// The storage moves once the rename is committed
+func mailboxRename(cmd *cobra.Command, args []string) error {
+	var oldHome, newHome *maildb.MailHome
+
+	st, err := mailStorage()
+	if err != nil {
+		return err
+	}
+	err = mdb.WithTxContext(cmd.Context(), func(tx *maildb.Tx) error {
+		var err error
+
+		oldHome, newHome = nil, nil
+		if st != nil {
+			if oldHome, err = tx.GetMailHome(args[0]); err != nil {
+				return err
+			}
+		}
+		mb, err := tx.RenameVMailbox(args[0], args[1], keepOld)
+		if err != nil || st == nil {
+			return err
+		}
+		if newHome, err = tx.GetMailHome(mb.User()); err != nil {
+			return err
+		}
+		return st.CheckMove(oldHome, newHome)
+	})
+	if err != nil || st == nil {
+		return err
+	}
+	return storageError(args[1], st.Move(oldHome, newHome))
+}
+
+// mailboxForward
+// Forwarding is kept apart from the mailbox so --forward and --keep-copy
+// each leave the other as it was.
+func mailboxForward(cmd *cobra.Command, tx *maildb.Tx, user string) error {
+	f := cmd.Flags()
+	if f.Changed("no-forward") && noForward {
+		if f.Changed("forward") || f.Changed("keep-copy") {
+			return fmt.Errorf("--no-forward cannot be used with --forward or --keep-copy")
+		}
+		return tx.DeleteForward(user)
+	}
+	if !f.Changed("forward") && !f.Changed("keep-copy") {
+		return nil
+	}
+	targets, keep := forwardTo, keepCopy
+	fw, err := tx.GetForward(user)
+	if err == nil {
+		if !f.Changed("forward") {
+			targets = fw.Targets()
+		}
+		if !f.Changed("keep-copy") {
+			keep = fw.KeepCopy()
+		}
+	} else if err != maildb.ErrMdbForwardNotFound {
+		return err
+	}
+	_, err = tx.SetForward(user, targets, keep)
 	return err
 }
 
+// mailboxProtocols
+// Allow and then deny the protocols in the flags so "--allow all --deny pop3"
+// leaves everything but pop3. These are on top of --enable. A disabled
+// mailbox is denied everything no matter what is allowed here.
+func mailboxProtocols(cmd *cobra.Command, mb *maildb.VMailbox) error {
+	if cmd.Flags().Changed("allow") {
+		for _, p := range protocolList(allowProto) {
+			if err := mb.AllowProtocol(p); err != nil {
+				return fmt.Errorf("--allow %s: %s", p, err)
+			}
+		}
+	}
+	if cmd.Flags().Changed("deny") {
+		for _, p := range protocolList(denyProto) {
+			if err := mb.DenyProtocol(p); err != nil {
+				return fmt.Errorf("--deny %s: %s", p, err)
+			}
+		}
+	}
+	return nil
+}
+
+// protocolList
+// expand "all" in a protocol flag's list
+func protocolList(pl []string) []string {
+	var l []string
+
+	for _, p := range pl {
+		if strings.ToLower(strings.TrimSpace(p)) == "all" {
+			l = append(l, maildb.MailProtocols...)
+		} else {
+			l = append(l, p)
+		}
+	}
+	return l
+}
+
+// mailboxPassword
+// Set the password from the flags. A password with a --type is already
+// encoded and is stored as is. Otherwise it is cleartext and we hash it
+// with the --scheme. It comes from --password or, better because it
+// doesn't show up in ps or the shell history, --password-stdin.
+func mailboxPassword(cmd *cobra.Command, mb *maildb.VMailbox) (err error) {
+	var pw string
+
+	if cmd.Flags().Changed("type") && cmd.Flags().Changed("scheme") {
+		return fmt.Errorf("Password is either already encoded with --type or hashed with --scheme, not both")
+	}
+	if cmd.Flags().Changed("password-stdin") {
+		if pw, err = readPassword(cmd, true); err != nil {
+			return err
+		}
+	} else if cmd.Flags().Changed("password") {
+		pw = password
+	} else {
+		if cmd.Flags().Changed("type") {
+			err = mb.SetPwType(pw_type)
+		}
+		return err
+	}
+	if cmd.Flags().Changed("type") {
+		if err = mb.SetPwType(pw_type); err == nil {
+			err = mb.SetPassword(pw)
+		}
+		return err
+	}
+	return mb.HashPassword(pwScheme, pw)
+}
+
+// readPassword
+// Prompt for the password without echo if stdin is a terminal, twice if
+// it is a new one. Otherwise it is the first line of stdin.
+func readPassword(cmd *cobra.Command, confirm bool) (string, error) {
+	in := cmd.InOrStdin()
+	if f, ok := in.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		cmd.PrintErr("Password: ")
+		pw, err := term.ReadPassword(int(f.Fd()))
+		cmd.PrintErrln()
+		if err != nil {
+			return "", fmt.Errorf("Password prompt: %s", err)
+		}
+		if confirm {
+			cmd.PrintErr("Retype password: ")
+			again, err := term.ReadPassword(int(f.Fd()))
+			cmd.PrintErrln()
+			if err != nil {
+				return "", fmt.Errorf("Password prompt: %s", err)
+			}
+			if string(pw) != string(again) {
+				return "", fmt.Errorf("Passwords do not match")
+			}
+		}
+		return string(pw), nil
+	}
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("Password read: %s", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
 // mailboxShow
 func mailboxShow(cmd *cobra.Command, args []string) error {
 	var (
@@ -403,7 +797,7 @@ func mailboxShow(cmd *cobra.Command, args []string) error {
 		MoreThanOne bool
 	)
 
-	if ml, err = mdb.FindVMailbox(args[0]); err != nil {
+	if ml, err = mdb.FindVMailboxContext(cmd.Context(), args[0]); err != nil {
 		return err
 	}
 	for _, m := range ml {
@@ -412,14 +806,200 @@ func mailboxShow(cmd *cobra.Command, args []string) error {
 		}
 		cmd.Printf("Name:\t\t%s\nPassword Type:\t%s\nPassword:\t%s\n",
 			m.User(), m.PwType(), m.Password())
-		cmd.Printf("UserID:\t\t%s\nGroupID:\t%s\nHome:\t\t%s\nQuota:\t\t%s\n",
-			m.Uid(), m.Gid(), m.Home(), m.Quota())
+		if set := m.PwSet(); set.IsZero() {
+			cmd.Printf("Password Set:\t--\n")
+		} else {
+			cmd.Printf("Password Set:\t%s\n", credentialTime(set))
+		}
+		if m.IsPwExpired() {
+			cmd.Printf("Pw Expires:\t%s (expired)\n", credentialTime(m.PwExpires()))
+		} else {
+			cmd.Printf("Pw Expires:\t%s\n", credentialTime(m.PwExpires()))
+		}
+		cmd.Printf("UserID:\t\t%s\nGroupID:\t%s\nHome:\t\t%s\n",
+			m.Uid(), m.Gid(), m.Home())
+		if rule, inherited := m.QuotaRule(); inherited {
+			cmd.Printf("Quota:\t\t%s (domain)\n", rule)
+		} else {
+			cmd.Printf("Quota:\t\t%s\n", rule)
+		}
+		q, err := mdb.LookupQuotaUsageContext(cmd.Context(), m)
+		if err != nil {
+			return err
+		}
+		cmd.Printf("Quota Used:\t%s\n", q)
 		if m.IsEnabled() {
 			cmd.Printf("Enabled:\ttrue\n")
 		} else {
 			cmd.Printf("Enabled:\tfalse\n")
 		}
+		if pl := m.AllowedProtocols(); len(pl) > 0 {
+			cmd.Printf("Protocols:\t%s\n", strings.Join(pl, ","))
+		} else {
+			cmd.Printf("Protocols:\tnone\n")
+		}
+		if fw, err := mdb.LookupForwardContext(cmd.Context(), m.User()); err == nil {
+			if fw.KeepCopy() {
+				cmd.Printf("Forward:\t%s (keep copy)\n", strings.Join(fw.Targets(), ","))
+			} else {
+				cmd.Printf("Forward:\t%s\n", strings.Join(fw.Targets(), ","))
+			}
+		} else if err != maildb.ErrMdbForwardNotFound {
+			return err
+		}
 		MoreThanOne = true
 	}
 	return nil
 }
+
+// mailboxVerify
+func mailboxVerify(cmd *cobra.Command, args []string) (err error) {
+	var (
+		mb *maildb.VMailbox
+		pw string
+		ok bool
+	)
+
+	if mb, err = mdb.LookupVMailboxContext(cmd.Context(), args[0]); err != nil {
+		return err
+	}
+	if cmd.Flags().Changed("password") && !cmd.Flags().Changed("password-stdin") {
+		pw = password
+	} else if pw, err = readPassword(cmd, false); err != nil {
+		return err
+	}
+	if ok, err = mb.VerifyPassword(pw); err != nil {
+		return err
+	}
+	if ok {
+		cmd.Printf("%s: password matches\n", mb.User())
+		return nil
+	}
+	// Dovecot would try the credentials next. Verifying also records the use
+	var c *maildb.Credential
+	err = mdb.WithTxContext(cmd.Context(), func(tx *maildb.Tx) error {
+		c, err = tx.VerifyCredential(mb.User(), pw)
+		return err
+	})
+	if err == maildb.ErrMdbCredNotFound {
+		cmd.SilenceUsage = true // not a usage problem
+		return fmt.Errorf("%s: password does not match", mb.User())
+	} else if err != nil {
+		return err
+	}
+	cmd.Printf("%s: password matches credential %s\n", mb.User(), c.Label())
+	return nil
+}
+
+// passwordsReport
+// Each domain's count of passwords by strength and the
+// mailboxes that are not strong
+func passwordsReport(cmd *cobra.Command, args []string) error {
+	var (
+		ml      []*maildb.VMailbox
+		err     error
+		domains []string
+		total   [maildb.PwStrong + 1]int
+	)
+
+	vMailbox := "*@*"
+	if len(args) > 0 {
+		vMailbox = args[0]
+	}
+	if ml, err = mdb.FindVMailboxContext(cmd.Context(), vMailbox); err != nil {
+		return err
+	}
+	counts := make(map[string]*[maildb.PwStrong + 1]int)
+	weak := make(map[string][]*maildb.VMailbox)
+	for _, m := range ml {
+		d := m.Domain()
+		if counts[d] == nil {
+			counts[d] = &[maildb.PwStrong + 1]int{}
+			domains = append(domains, d)
+		}
+		s := m.PwStrength()
+		counts[d][s]++
+		total[s]++
+		if s != maildb.PwStrong {
+			weak[d] = append(weak[d], m)
+		}
+	}
+	sort.Strings(domains)
+	for _, d := range domains {
+		cmd.Printf("%s\t%s\n", d, strengthCounts(*counts[d]))
+		for _, m := range weak[d] {
+			if m.PwStrength() == maildb.PwNone {
+				cmd.Printf("\t%s\t%s\n", m.User(), m.PwStrength())
+			} else {
+				cmd.Printf("\t%s\t%s\t%s\n", m.User(), m.PwStrength(), m.PwType())
+			}
+		}
+	}
+	cmd.Printf("Total\t%s\n", strengthCounts(total))
+	return nil
+}
+
+// strengthCounts
+func strengthCounts(c [maildb.PwStrong + 1]int) string {
+	n := 0
+	for _, i := range c {
+		n += i
+	}
+	return fmt.Sprintf("%d mailboxes, %d %s, %d %s, %d %s, %d %s", n,
+		c[maildb.PwNone], maildb.PwNone, c[maildb.PwPlain], maildb.PwPlain,
+		c[maildb.PwWeak], maildb.PwWeak, c[maildb.PwStrong], maildb.PwStrong)
+}
+
+// expiringReport
+// The mailboxes whose passwords expire within --days, by domain
+func expiringReport(cmd *cobra.Command, args []string) error {
+	var (
+		ml                []*maildb.VMailbox
+		err               error
+		domains           []string
+		expiring, expired int
+	)
+
+	if expDays < 0 {
+		return fmt.Errorf("--days cannot be negative")
+	}
+	vMailbox := "*@*"
+	if len(args) > 0 {
+		vMailbox = args[0]
+	}
+	if ml, err = mdb.FindVMailboxContext(cmd.Context(), vMailbox); err != nil {
+		return err
+	}
+	limit := time.Now().AddDate(0, 0, expDays)
+	soon := make(map[string][]*maildb.VMailbox)
+	for _, m := range ml {
+		e := m.PwExpires()
+		if e.IsZero() || e.After(limit) {
+			continue
+		}
+		d := m.Domain()
+		if soon[d] == nil {
+			domains = append(domains, d)
+		}
+		soon[d] = append(soon[d], m)
+	}
+	sort.Strings(domains)
+	for _, d := range domains {
+		sl := soon[d]
+		sort.SliceStable(sl, func(i, j int) bool {
+			return sl[i].PwExpires().Before(sl[j].PwExpires())
+		})
+		cmd.Printf("%s\n", d)
+		for _, m := range sl {
+			if m.IsPwExpired() {
+				cmd.Printf("\t%s\t%s (expired)\n", m.User(), credentialTime(m.PwExpires()))
+				expired++
+			} else {
+				cmd.Printf("\t%s\t%s\n", m.User(), credentialTime(m.PwExpires()))
+				expiring++
+			}
+		}
+	}
+	cmd.Printf("Total\t%d expired, %d expiring within %d days\n", expired, expiring, expDays)
+	return nil
+}
@@ -18,17 +18,24 @@ package cmd
 
 import (
 	//"bytes"
+	"database/sql"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"testing"
 
 	"github.com/lieb/postdove/maildb"
 	// "github.com/spf13/cobra"
+	"golang.org/x/crypto/bcrypt"
 )
 
+// pwSetRe
+// The time a password was set is now, so show mailbox tests replace it
+var pwSetRe = regexp.MustCompile(`(Password Set:\t)[0-9]{4}-[0-9]{2}-[0-9]{2} [0-9:]{8}`)
+
 // TestVMailboxCmd
 func TestVMailboxCmd(t *testing.T) {
 	var (
@@ -129,7 +136,7 @@ func TestVMailboxCmd(t *testing.T) {
 
 	// And check it out.
 
-	expectedOut := "Name:\t\tjeff@pobox.org\nPassword Type:\tPLAIN\nPassword:\t--\nUserID:\t\t--\nGroupID:\t--\nHome:\t\t--\nQuota:\t\t*:bytes=300M\nEnabled:\ttrue\n"
+	expectedOut := "Name:\t\tjeff@pobox.org\nPassword Type:\tPLAIN\nPassword:\t--\nPassword Set:\t--\nPw Expires:\tnever\nUserID:\t\t--\nGroupID:\t--\nHome:\t\t--\nQuota:\t\t*:bytes=300M\nQuota Used:\t0B of 300M, 0 messages (0%)\nEnabled:\ttrue\nProtocols:\timap,pop3,lmtp,submission,sieve\n"
 	args = []string{"-d", dbfile, "show", "mailbox", "jeff@pobox.org"}
 	out, errout, err = doTest(rootCmd, "", args)
 	if err != nil {
@@ -157,13 +164,13 @@ func TestVMailboxCmd(t *testing.T) {
 	}
 
 	// check change
-	expectedOut = "Name:\t\tjeff@pobox.org\nPassword Type:\tCRYPT\nPassword:\tfunny\nUserID:\t\t42\nGroupID:\t75\nHome:\t\tblack_hole\nQuota:\t\tnone\nEnabled:\tfalse\n"
+	expectedOut = "Name:\t\tjeff@pobox.org\nPassword Type:\tCRYPT\nPassword:\tfunny\nPassword Set:\tDATE\nPw Expires:\tnever\nUserID:\t\t42\nGroupID:\t75\nHome:\t\tblack_hole\nQuota:\t\tnone\nQuota Used:\t0B, 0 messages\nEnabled:\tfalse\nProtocols:\timap,pop3,lmtp,submission,sieve\n"
 	args = []string{"-d", dbfile, "show", "mailbox", "jeff@pobox.org"}
 	out, errout, err = doTest(rootCmd, "", args)
 	if err != nil {
 		t.Errorf("Edit jeff@pobox.org: Unexpected error, %s", err)
 	}
-	if out != expectedOut {
+	if pwSetRe.ReplaceAllString(out, "${1}DATE") != expectedOut {
 		t.Errorf("Edit jeff@pobox.org: did not get expected output, got %s", out)
 	}
 	if errout != "" {
@@ -185,7 +192,7 @@ func TestVMailboxCmd(t *testing.T) {
 	}
 
 	// check change
-	expectedOut = "Name:\t\tjeff@pobox.org\nPassword Type:\tPLAIN\nPassword:\t--\nUserID:\t\t--\nGroupID:\t--\nHome:\t\t--\nQuota:\t\t*:bytes=300M\nEnabled:\ttrue\n"
+	expectedOut = "Name:\t\tjeff@pobox.org\nPassword Type:\tPLAIN\nPassword:\t--\nPassword Set:\t--\nPw Expires:\tnever\nUserID:\t\t--\nGroupID:\t--\nHome:\t\t--\nQuota:\t\t*:bytes=300M\nQuota Used:\t0B of 300M, 0 messages (0%)\nEnabled:\ttrue\nProtocols:\timap,pop3,lmtp,submission,sieve\n"
 	args = []string{"-d", dbfile, "show", "mailbox", "jeff@pobox.org"}
 	out, errout, err = doTest(rootCmd, "", args)
 	if err != nil {
@@ -217,7 +224,7 @@ func TestVMailboxCmd(t *testing.T) {
 	args = []string{"-d", dbfile, "import", "mailbox"}
 	inputStr := `
 # only one new user
-dave@pobox.org:{sha256}HJJJYGB:56:83::dave::userdb_quota_rule=*:bytes=40G mbox_enabled=false
+dave@pobox.org:{sha256}XohImNooBHFR0OVvjcYpJ3NgPQ1qq73WKhHvch0VQtg=:56:83::dave::userdb_quota_rule=*:bytes=40G mbox_enabled=false
 `
 	out, errout, err = doTest(rootCmd, inputStr, args)
 	if err != nil {
@@ -230,13 +237,13 @@ dave@pobox.org:{sha256}HJJJYGB:56:83::dave::userdb_quota_rule=*:bytes=40G mbox_e
 		t.Errorf("Import of dave@pobox.org: Expected no error output, got %s", errout)
 	}
 	// check import
-	expectedOut = "Name:\t\tdave@pobox.org\nPassword Type:\tSHA256\nPassword:\tHJJJYGB\nUserID:\t\t56\nGroupID:\t83\nHome:\t\tdave\nQuota:\t\t*:bytes=40G\nEnabled:\tfalse\n"
+	expectedOut = "Name:\t\tdave@pobox.org\nPassword Type:\tSHA256\nPassword:\tXohImNooBHFR0OVvjcYpJ3NgPQ1qq73WKhHvch0VQtg=\nPassword Set:\tDATE\nPw Expires:\tnever\nUserID:\t\t56\nGroupID:\t83\nHome:\t\tdave\nQuota:\t\t*:bytes=40G\nQuota Used:\t0B of 40G, 0 messages (0%)\nEnabled:\tfalse\nProtocols:\timap,pop3,lmtp,submission,sieve\n"
 	args = []string{"-d", dbfile, "show", "mailbox", "dave@pobox.org"}
 	out, errout, err = doTest(rootCmd, "", args)
 	if err != nil {
 		t.Errorf("Import dave@pobox.org: Unexpected error, %s", err)
 	}
-	if out != expectedOut {
+	if pwSetRe.ReplaceAllString(out, "${1}DATE") != expectedOut {
 		t.Errorf("import dave@pobox.org: did not get expected output, got %s", out)
 	}
 	if errout != "" {
@@ -244,7 +251,7 @@ dave@pobox.org:{sha256}HJJJYGB:56:83::dave::userdb_quota_rule=*:bytes=40G mbox_e
 	}
 
 	// try export of both
-	exportList = `dave@pobox.org:{SHA256}HJJJYGB:56:83::dave::userdb_quota_rule=*:bytes=40G mbox_enabled=false
+	exportList = `dave@pobox.org:{SHA256}XohImNooBHFR0OVvjcYpJ3NgPQ1qq73WKhHvch0VQtg=:56:83::dave::userdb_quota_rule=*:bytes=40G mbox_enabled=false
 jeff@pobox.org:{PLAIN}*::::::userdb_quota_rule=*:bytes=300M mbox_enabled=true
 `
 	args = []string{"-d", dbfile, "export", "mailbox"}
@@ -288,3 +295,529 @@ jeff@pobox.org:{PLAIN}*::::::userdb_quota_rule=*:bytes=300M mbox_enabled=true
 	}
 
 }
+
+// TestMailboxPassword
+// Passwords are hashed unless they come with a type and can be read from stdin
+func TestMailboxPassword(t *testing.T) {
+	var (
+		err         error
+		dir         string
+		dbfile      string
+		args        []string
+		out, errout string
+	)
+
+	fmt.Println("TestMailboxPassword")
+
+	dir, err = ioutil.TempDir("", "TestMailboxPassword-*")
+	defer os.RemoveAll(dir)
+	dbfile = filepath.Join(dir, "test.db")
+
+	args = []string{"create", "-d", dbfile, "--no-locals", "--no-aliases"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Fatalf("Create DB: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "add", "domain", "pobox.org", "-c", "vmailbox"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Fatalf("Add pobox.org: Unexpected error, %s", err)
+	}
+
+	// What show says the password is
+	showPw := func(name string) (pwType string, pw string) {
+		args := []string{"-d", dbfile, "show", "mailbox", name}
+		out, _, err := doTest(rootCmd, "", args)
+		if err != nil {
+			t.Errorf("Show %s: Unexpected error, %s", name, err)
+		}
+		for _, l := range strings.Split(out, "\n") {
+			if strings.HasPrefix(l, "Password Type:\t") {
+				pwType = strings.TrimPrefix(l, "Password Type:\t")
+			} else if strings.HasPrefix(l, "Password:\t") {
+				pw = strings.TrimPrefix(l, "Password:\t")
+			}
+		}
+		return pwType, pw
+	}
+
+	// A cleartext password gets the default scheme
+	args = []string{"-d", dbfile, "add", "mailbox", "jeff@pobox.org", "-p", "secret"}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err != nil {
+		t.Errorf("Add jeff@pobox.org: Unexpected error, %s", err)
+	}
+	if out != "" || errout != "" {
+		t.Errorf("Add jeff@pobox.org: did not expect output, got %q, %q", out, errout)
+	}
+	if pwType, pw := showPw("jeff@pobox.org"); pwType != maildb.DefaultPwScheme ||
+		!strings.HasPrefix(pw, "$6$") || strings.Contains(pw, "secret") {
+		t.Errorf("Add jeff@pobox.org: expected a SHA512-CRYPT hash, got {%s}%s", pwType, pw)
+	}
+
+	// From stdin with another scheme
+	args = []string{"-d", dbfile, "edit", "mailbox", "jeff@pobox.org", "-s", "blf-crypt", "--password-stdin"}
+	out, errout, err = doTest(rootCmd, "n3w s3cret\n", args)
+	if err != nil {
+		t.Errorf("Edit jeff@pobox.org: Unexpected error, %s", err)
+	}
+	if out != "" || errout != "" {
+		t.Errorf("Edit jeff@pobox.org: did not expect output, got %q, %q", out, errout)
+	}
+	pwType, pw := showPw("jeff@pobox.org")
+	if pwType != "BLF-CRYPT" {
+		t.Errorf("Edit jeff@pobox.org: expected BLF-CRYPT, got %s", pwType)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(pw), []byte("n3w s3cret")) != nil {
+		t.Errorf("Edit jeff@pobox.org: %s is not the hash of the password", pw)
+	}
+
+	// Nothing on stdin is not a password
+	args = []string{"-d", dbfile, "edit", "mailbox", "jeff@pobox.org", "-s", "argon2id", "--password-stdin"}
+	if _, _, err = doTest(rootCmd, "", args); err == nil || !strings.Contains(err.Error(), maildb.ErrMdbPwEmpty.Error()) {
+		t.Errorf("Edit jeff@pobox.org: expected %s, got %v", maildb.ErrMdbPwEmpty, err)
+	}
+	if pwType, _ := showPw("jeff@pobox.org"); pwType != "BLF-CRYPT" {
+		t.Errorf("Edit jeff@pobox.org: expected BLF-CRYPT after failed edit, got %s", pwType)
+	}
+
+	// It is already encoded or it gets hashed, not both
+	args = []string{"-d", dbfile, "edit", "mailbox", "jeff@pobox.org", "-t", "ssha512", "-s", "argon2id", "--password-stdin"}
+	if _, _, err = doTest(rootCmd, "secret\n", args); err == nil || !strings.Contains(err.Error(), "not both") {
+		t.Errorf("Edit jeff@pobox.org: expected --type and --scheme error, got %v", err)
+	}
+
+	// Unknown schemes
+	args = []string{"-d", dbfile, "add", "mailbox", "bill@pobox.org", "-s", "md5", "-p", "secret"}
+	if _, _, err = doTest(rootCmd, "", args); err == nil || !strings.Contains(err.Error(), maildb.ErrMdbMboxBadPw.Error()) {
+		t.Errorf("Add bill@pobox.org: expected %s, got %v", maildb.ErrMdbMboxBadPw, err)
+	}
+	args = []string{"-d", dbfile, "show", "mailbox", "bill@pobox.org"}
+	if _, _, err = doTest(rootCmd, "", args); err == nil {
+		t.Errorf("Add bill@pobox.org: expected no mailbox after the error")
+	}
+
+	// An encoded password has to look like one
+	args = []string{"-d", dbfile, "import", "mailbox"}
+	if _, _, err = doTest(rootCmd, "bill@pobox.org:{ARGON2ID}$argon2id$v=19$m=65536$nope\n", args); err == nil ||
+		!strings.Contains(err.Error(), maildb.ErrMdbPwBadHash.Error()) {
+		t.Errorf("Import bill@pobox.org: expected %s, got %v", maildb.ErrMdbPwBadHash, err)
+	}
+	args = []string{"-d", dbfile, "show", "mailbox", "bill@pobox.org"}
+	if _, _, err = doTest(rootCmd, "", args); err == nil {
+		t.Errorf("Import bill@pobox.org: expected no mailbox after the error")
+	}
+}
+
+// TestPasswordCmds
+// verify mailbox and report passwords
+func TestPasswordCmds(t *testing.T) {
+	var (
+		err         error
+		dir         string
+		dbfile      string
+		args        []string
+		out, errout string
+	)
+
+	fmt.Println("TestPasswordCmds")
+
+	dir, err = ioutil.TempDir("", "TestPasswordCmds-*")
+	defer os.RemoveAll(dir)
+	dbfile = filepath.Join(dir, "test.db")
+
+	args = []string{"create", "-d", dbfile, "--no-locals", "--no-aliases"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Fatalf("Create DB: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "import", "domain"}
+	if _, _, err = doTest(rootCmd, "pobox.org class=vmailbox\npobox.net class=vmailbox\n", args); err != nil {
+		t.Fatalf("Import domains: Unexpected error, %s", err)
+	}
+	mailboxes := `a@pobox.org:{PLAIN}secret
+b@pobox.org:{SHA256}XohImNooBHFR0OVvjcYpJ3NgPQ1qq73WKhHvch0VQtg=
+c@pobox.org:{SHA512-CRYPT}$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1
+d@pobox.net:
+`
+	args = []string{"-d", dbfile, "import", "mailbox"}
+	if _, _, err = doTest(rootCmd, mailboxes, args); err != nil {
+		t.Fatalf("Import mailboxes: Unexpected error, %s", err)
+	}
+
+	// The right passwords
+	args = []string{"-d", dbfile, "verify", "mailbox", "a@pobox.org", "-p", "secret"}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err != nil {
+		t.Errorf("Verify a@pobox.org: Unexpected error, %s", err)
+	}
+	if out != "a@pobox.org: password matches\n" || errout != "" {
+		t.Errorf("Verify a@pobox.org: unexpected output, %q, %q", out, errout)
+	}
+	args = []string{"-d", dbfile, "verify", "mailbox", "c@pobox.org", "--password-stdin"}
+	out, errout, err = doTest(rootCmd, "Hello world!\n", args)
+	if err != nil {
+		t.Errorf("Verify c@pobox.org: Unexpected error, %s", err)
+	}
+	if out != "c@pobox.org: password matches\n" || errout != "" {
+		t.Errorf("Verify c@pobox.org: unexpected output, %q, %q", out, errout)
+	}
+
+	// and the wrong ones
+	for _, mb := range []string{"b@pobox.org", "d@pobox.net"} {
+		args = []string{"-d", dbfile, "verify", "mailbox", mb, "--password-stdin"}
+		out, _, err = doTest(rootCmd, "password1\n", args)
+		if err == nil || err.Error() != mb+": password does not match" {
+			t.Errorf("Verify %s: expected no match, got %v", mb, err)
+		}
+		if out != "" {
+			t.Errorf("Verify %s: did not expect usage, got %q", mb, out)
+		}
+	}
+	args = []string{"-d", dbfile, "verify", "mailbox", "nobody@pobox.org", "--password-stdin"}
+	if _, _, err = doTest(rootCmd, "password1\n", args); err == nil {
+		t.Errorf("Verify nobody@pobox.org: expected error")
+	}
+
+	// The report
+	expected := `pobox.net	1 mailboxes, 1 none, 0 plain, 0 weak, 0 strong
+	d@pobox.net	none
+pobox.org	3 mailboxes, 0 none, 1 plain, 1 weak, 1 strong
+	a@pobox.org	plain	PLAIN
+	b@pobox.org	weak	SHA256
+Total	4 mailboxes, 1 none, 1 plain, 1 weak, 1 strong
+`
+	args = []string{"-d", dbfile, "report", "passwords"}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err != nil {
+		t.Errorf("Report passwords: Unexpected error, %s", err)
+	}
+	if out != expected || errout != "" {
+		t.Errorf("Report passwords: expected %q, got %q, %q", expected, out, errout)
+	}
+
+	// One domain, after fixing one
+	args = []string{"-d", dbfile, "edit", "mailbox", "a@pobox.org", "-s", "argon2id", "-p", "secret"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Errorf("Edit a@pobox.org: Unexpected error, %s", err)
+	}
+	expected = `pobox.org	3 mailboxes, 0 none, 0 plain, 1 weak, 2 strong
+	b@pobox.org	weak	SHA256
+Total	3 mailboxes, 0 none, 0 plain, 1 weak, 2 strong
+`
+	args = []string{"-d", dbfile, "report", "passwords", "*@pobox.org"}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err != nil {
+		t.Errorf("Report passwords: Unexpected error, %s", err)
+	}
+	if out != expected || errout != "" {
+		t.Errorf("Report passwords: expected %q, got %q, %q", expected, out, errout)
+	}
+}
+
+// TestProtocolCmds
+func TestProtocolCmds(t *testing.T) {
+	var (
+		err         error
+		dir         string
+		dbfile      string
+		args        []string
+		out, errout string
+		expected    string
+	)
+
+	fmt.Println("TestProtocolCmds")
+
+	dir, err = ioutil.TempDir("", "TestProtocolCmds-*")
+	defer os.RemoveAll(dir)
+	dbfile = filepath.Join(dir, "test.db")
+
+	args = []string{"create", "-d", dbfile, "--no-locals", "--no-aliases"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Fatalf("Create DB: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "import", "domain"}
+	if _, _, err = doTest(rootCmd, "pobox.org class=vmailbox\n", args); err != nil {
+		t.Fatalf("Import domains: Unexpected error, %s", err)
+	}
+
+	// add one with some denied
+	args = []string{"-d", dbfile, "add", "mailbox", "a@pobox.org", "--deny", "pop3,sieve"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Errorf("Add a@pobox.org: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "show", "mailbox", "a@pobox.org"}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err != nil {
+		t.Errorf("Show a@pobox.org: Unexpected error, %s", err)
+	}
+	if !strings.HasSuffix(out, "\nProtocols:\timap,lmtp,submission\n") || errout != "" {
+		t.Errorf("Show a@pobox.org: unexpected output, %q, %q", out, errout)
+	}
+
+	// allow all but imap
+	args = []string{"-d", dbfile, "edit", "mailbox", "a@pobox.org", "--allow", "all", "--deny", "IMAP"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Errorf("Edit a@pobox.org: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "export", "mailbox", "a@pobox.org"}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err != nil {
+		t.Errorf("Export a@pobox.org: Unexpected error, %s", err)
+	}
+	expected = "a@pobox.org:{PLAIN}*::::::userdb_quota_rule=*:bytes=300M mbox_enabled=true mbox_deny=imap\n"
+	if out != expected || errout != "" {
+		t.Errorf("Export a@pobox.org: expected %q, got %q, %q", expected, out, errout)
+	}
+
+	// a bad protocol changes nothing
+	args = []string{"-d", dbfile, "edit", "mailbox", "a@pobox.org", "--deny", "gopher"}
+	if _, _, err = doTest(rootCmd, "", args); err == nil {
+		t.Errorf("Edit a@pobox.org --deny gopher: expected an error")
+	} else if !strings.Contains(err.Error(), maildb.ErrMdbBadProtocol.Error()) {
+		t.Errorf("Edit a@pobox.org --deny gopher: unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "export", "mailbox", "a@pobox.org"}
+	if out, _, err = doTest(rootCmd, "", args); err != nil || out != expected {
+		t.Errorf("Export a@pobox.org after bad edit: expected %q, got %q, %v", expected, out, err)
+	}
+
+	// and imap back again
+	args = []string{"-d", dbfile, "edit", "mailbox", "a@pobox.org", "--allow", "imap"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Errorf("Edit a@pobox.org --allow imap: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "export", "mailbox", "a@pobox.org"}
+	expected = "a@pobox.org:{PLAIN}*::::::userdb_quota_rule=*:bytes=300M mbox_enabled=true\n"
+	if out, _, err = doTest(rootCmd, "", args); err != nil || out != expected {
+		t.Errorf("Export a@pobox.org after --allow imap: expected %q, got %q, %v", expected, out, err)
+	}
+
+	// import and export round trip
+	mailboxes := `b@pobox.org:{PLAIN}*::::::userdb_quota_rule=*:bytes=300M mbox_enabled=false mbox_deny=lmtp,submission
+c@pobox.org:{PLAIN}*::::::userdb_quota_rule=*:bytes=300M mbox_enabled=true
+`
+	args = []string{"-d", dbfile, "import", "mailbox"}
+	if _, _, err = doTest(rootCmd, mailboxes, args); err != nil {
+		t.Errorf("Import mailboxes: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "export", "mailbox", "*@pobox.org"}
+	out, _, err = doTest(rootCmd, "", args)
+	if err != nil {
+		t.Errorf("Export mailboxes: Unexpected error, %s", err)
+	}
+	if !strings.HasSuffix(out, mailboxes) {
+		t.Errorf("Export mailboxes: expected to end with %q, got %q", mailboxes, out)
+	}
+	args = []string{"-d", dbfile, "import", "mailbox"}
+	_, _, err = doTest(rootCmd, "d@pobox.org:{PLAIN}*::::::mbox_deny=gopher\n", args)
+	if err == nil {
+		t.Errorf("Import bad mbox_deny: expected an error")
+	}
+}
+
+// TestForwardCmds
+func TestForwardCmds(t *testing.T) {
+	var (
+		err    error
+		dir    string
+		dbfile string
+		args   []string
+		out    string
+	)
+
+	fmt.Println("TestForwardCmds")
+
+	dir, err = ioutil.TempDir("", "TestForwardCmds-*")
+	defer os.RemoveAll(dir)
+	dbfile = filepath.Join(dir, "test.db")
+
+	args = []string{"create", "-d", dbfile, "--no-locals", "--no-aliases"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Fatalf("Create DB: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "import", "domain"}
+	if _, _, err = doTest(rootCmd, "pobox.org class=vmailbox\n", args); err != nil {
+		t.Fatalf("Import domains: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "import", "mailbox"}
+	if _, _, err = doTest(rootCmd, "a@pobox.org:{PLAIN}pw::::::\nb@pobox.org:{PLAIN}pw::::::\n", args); err != nil {
+		t.Fatalf("Import mailboxes: Unexpected error, %s", err)
+	}
+
+	// recipients is what postfix gets for a@pobox.org
+	recipients := func() string {
+		var rl []string
+
+		db, err := sql.Open("sqlite3", "file:"+dbfile+"?mode=ro")
+		if err != nil {
+			return err.Error()
+		}
+		defer db.Close()
+		rows, err := db.Query("SELECT recipient FROM virt_alias WHERE mailbox = ? AND domain_name = ? ORDER BY recipient",
+			"a", "pobox.org")
+		if err != nil {
+			return err.Error()
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var r string
+			if err = rows.Scan(&r); err != nil {
+				return err.Error()
+			}
+			rl = append(rl, r)
+		}
+		return strings.Join(rl, ",")
+	}
+
+	args = []string{"-d", dbfile, "edit", "mailbox", "a@pobox.org", "--forward", "a@example.com,b@pobox.org"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Errorf("Forward a@pobox.org: Unexpected error, %s", err)
+	}
+	if r := recipients(); r != "a@example.com,b@pobox.org" {
+		t.Errorf("Forward a@pobox.org: unexpected recipients %q", r)
+	}
+
+	// keep a copy and leave the targets alone
+	args = []string{"-d", dbfile, "edit", "mailbox", "a@pobox.org", "--keep-copy"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Errorf("Keep copy a@pobox.org: Unexpected error, %s", err)
+	}
+	if r := recipients(); r != "a@example.com,a@pobox.org,b@pobox.org" {
+		t.Errorf("Keep copy a@pobox.org: unexpected recipients %q", r)
+	}
+	args = []string{"-d", dbfile, "show", "mailbox", "a@pobox.org"}
+	out, _, err = doTest(rootCmd, "", args)
+	if err != nil || !strings.HasSuffix(out, "\nForward:\ta@example.com,b@pobox.org (keep copy)\n") {
+		t.Errorf("Show a@pobox.org: unexpected output %q, %v", out, err)
+	}
+	args = []string{"-d", dbfile, "show", "mailbox", "b@pobox.org"}
+	out, _, err = doTest(rootCmd, "", args)
+	if err != nil || strings.Contains(out, "Forward:") {
+		t.Errorf("Show b@pobox.org: unexpected output %q, %v", out, err)
+	}
+
+	// mistakes change nothing
+	args = []string{"-d", dbfile, "edit", "mailbox", "a@pobox.org", "--no-forward", "--keep-copy"}
+	if _, _, err = doTest(rootCmd, "", args); err == nil {
+		t.Errorf("No forward with the others: expected an error")
+	}
+	args = []string{"-d", dbfile, "edit", "mailbox", "b@pobox.org", "--no-forward=false", "--forward", "b@pobox.org"}
+	if _, _, err = doTest(rootCmd, "", args); err != maildb.ErrMdbForwardTarget {
+		t.Errorf("Forward b@pobox.org to itself: expected ErrMdbForwardTarget, got %v", err)
+	}
+	if r := recipients(); r != "a@example.com,a@pobox.org,b@pobox.org" {
+		t.Errorf("After mistakes: unexpected recipients %q", r)
+	}
+
+	// a mailbox is still not an alias
+	args = []string{"-d", dbfile, "add", "alias", "a@pobox.org", "a@example.com"}
+	if _, _, err = doTest(rootCmd, "", args); err == nil {
+		t.Errorf("Add alias a@pobox.org: expected an error")
+	}
+	args = []string{"-d", dbfile, "log", "--entity", "forward"}
+	out, _, err = doTest(rootCmd, "", args)
+	if err != nil || strings.Count(out, " forward a@pobox.org\n") != 4 {
+		t.Errorf("Log forward: expected 4 changes, got %q, %v", out, err)
+	}
+
+	// and stop forwarding
+	args = []string{"-d", dbfile, "edit", "mailbox", "a@pobox.org", "--no-forward"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Errorf("No forward a@pobox.org: Unexpected error, %s", err)
+	}
+	if r := recipients(); r != "" {
+		t.Errorf("No forward a@pobox.org: unexpected recipients %q", r)
+	}
+	args = []string{"-d", dbfile, "show", "mailbox", "a@pobox.org"}
+	out, _, err = doTest(rootCmd, "", args)
+	if err != nil || strings.Contains(out, "Forward:") {
+		t.Errorf("Show a@pobox.org after no forward: unexpected output %q, %v", out, err)
+	}
+}
+
+// TestRenameMailboxCmd
+func TestRenameMailboxCmd(t *testing.T) {
+	var (
+		err    error
+		dir    string
+		dbfile string
+		args   []string
+	)
+
+	fmt.Println("TestRenameMailboxCmd")
+
+	dir, err = ioutil.TempDir("", "TestRenameMailboxCmd-*")
+	defer os.RemoveAll(dir)
+	dbfile = filepath.Join(dir, "test.db")
+	root := filepath.Join(dir, "vmail")
+	if err = os.Mkdir(root, 0755); err != nil {
+		t.Fatalf("Make vmail root: %s", err)
+	}
+
+	args = []string{"create", "-d", dbfile, "--no-locals", "--no-aliases"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Fatalf("Create DB: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "import", "domain"}
+	if _, _, err = doTest(rootCmd, "pobox.org class=vmailbox\nexample.com class=vmailbox\n", args); err != nil {
+		t.Fatalf("Import domains: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "--vmail-root", root, "add", "mailbox", "a@pobox.org",
+		"-u", fmt.Sprint(os.Getuid()), "-g", fmt.Sprint(os.Getgid()), "-q", "*:bytes=1G"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Fatalf("Add a@pobox.org: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "add", "virtual", "info@pobox.org", "a@pobox.org"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Fatalf("Add info@pobox.org: Unexpected error, %s", err)
+	}
+
+	args = []string{"-d", dbfile, "--vmail-root", root, "rename", "mailbox", "a@pobox.org", "alice@example.com", "--keep-old"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Errorf("Rename a@pobox.org: Unexpected error, %s", err)
+	}
+	if _, err = os.Stat(filepath.Join(root, "example.com", "alice", maildb.MaildirName, "new")); err != nil {
+		t.Errorf("Rename a@pobox.org: storage not moved, %s", err)
+	}
+	args = []string{"-d", dbfile, "show", "mailbox", "alice@example.com"}
+	out, _, err := doTest(rootCmd, "", args)
+	if err != nil || !strings.Contains(out, "\nQuota:\t\t*:bytes=1G\n") {
+		t.Errorf("Show alice@example.com: got %q, %v", out, err)
+	}
+	db, err := sql.Open("sqlite3", "file:"+dbfile+"?mode=ro")
+	if err != nil {
+		t.Fatalf("Open for virt_alias: %s", err)
+	}
+	defer db.Close()
+	for _, al := range []string{"info", "a"} {
+		var r string
+		row := db.QueryRow("SELECT recipient FROM virt_alias WHERE mailbox = ? AND domain_name = ?",
+			al, "pobox.org")
+		if err = row.Scan(&r); err != nil || r != "alice@example.com" {
+			t.Errorf("virt_alias %s@pobox.org: expected alice@example.com, got %q, %v", al, r, err)
+		}
+	}
+
+	args = []string{"-d", dbfile, "rename", "mailbox", "alice@example.com", "info@pobox.org"}
+	if _, _, err = doTest(rootCmd, "", args); err != maildb.ErrMdbDupAddress {
+		t.Errorf("Rename onto info@pobox.org: expected ErrMdbDupAddress, got %v", err)
+	}
+
+	// Storage in the way is found before the rename is committed
+	args = []string{"-d", dbfile, "--vmail-root", root, "add", "mailbox", "b@pobox.org"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Fatalf("Add b@pobox.org: Unexpected error, %s", err)
+	}
+	if err = os.MkdirAll(filepath.Join(root, "example.com", "bob"), 0700); err != nil {
+		t.Fatalf("Make bob's storage: %s", err)
+	}
+	args = []string{"-d", dbfile, "--vmail-root", root, "rename", "mailbox", "b@pobox.org", "bob@example.com"}
+	if _, _, err = doTest(rootCmd, "", args); err != maildb.ErrMdbStorageExists {
+		t.Errorf("Rename onto bob's storage: expected ErrMdbStorageExists, got %v", err)
+	}
+	args = []string{"-d", dbfile, "show", "mailbox", "b@pobox.org"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Errorf("Show b@pobox.org: expected it not renamed, got %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(root, "pobox.org", "b", maildb.MaildirName, "new")); err != nil {
+		t.Errorf("Rename onto bob's storage: b's storage moved, %s", err)
+	}
+}
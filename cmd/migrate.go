@@ -0,0 +1,109 @@
+/*
+Copyright © 2021 Jim Lieb <lieb@sea-troll.net>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/lieb/postdove/maildb"
+	"github.com/spf13/cobra"
+)
+
+var (
+	dryRun bool
+)
+
+// migrateCmd represents the migrate command
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Upgrade the database schema to the current version",
+	Long: `Upgrade the database schema to the version this program expects.
+All of the pending upgrade scripts are applied in a single transaction so
+either all of them are applied or none of them are.`,
+	Args:        cobra.NoArgs,
+	RunE:        cmdMigrate,
+	Annotations: map[string]string{noSchemaCheck: "true"},
+}
+
+// migrateStatusCmd represents the migrate status command
+var migrateStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Report the database schema version and pending upgrades",
+	Long: `Report the schema version of the database, its upgrade history,
+and any upgrades that migrate would apply.`,
+	Args: cobra.NoArgs,
+	RunE: cmdMigrateStatus,
+}
+
+// cmdMigrate
+func cmdMigrate(cmd *cobra.Command, args []string) error {
+	applied, err := mdb.MigrateContext(cmd.Context(), dryRun)
+	if err != nil {
+		return fmt.Errorf("Migrate command: %s", err)
+	}
+	if len(applied) == 0 {
+		cmd.Printf("Database is at version %d, nothing to do\n", maildb.DbSchemaVersion)
+		return nil
+	}
+	for _, m := range applied {
+		if dryRun {
+			cmd.Printf("Would apply %d: %s\n", m.Version(), m.Name())
+		} else {
+			cmd.Printf("Applied %d: %s\n", m.Version(), m.Name())
+		}
+	}
+	return nil
+}
+
+// cmdMigrateStatus
+func cmdMigrateStatus(cmd *cobra.Command, args []string) error {
+	v, err := mdb.SchemaVersion()
+	if err != nil {
+		return fmt.Errorf("Migrate status: %s", err)
+	}
+	cmd.Printf("Database version:\t%d\nProgram version:\t%d\n", v, maildb.DbSchemaVersion)
+	if v == 0 {
+		cmd.Printf("Database is empty, run create\n")
+		return nil
+	}
+	history, err := mdb.SchemaHistory()
+	if err != nil {
+		return fmt.Errorf("Migrate status: %s", err)
+	}
+	for _, r := range history {
+		cmd.Printf("Applied:\t%d\t%s\t%s\n", r.Version(), r.Applied(), r.Description())
+	}
+	pending, err := mdb.PendingMigrations()
+	if err != nil {
+		if err == maildb.ErrMdbSchemaNew {
+			cmd.Printf("Database is newer than this program\n")
+			return nil
+		}
+		return fmt.Errorf("Migrate status: %s", err)
+	}
+	for _, m := range pending {
+		cmd.Printf("Pending:\t%d\t%s\n", m.Version(), m.Name())
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(migrateCmd)
+	migrateCmd.Flags().BoolVarP(&dryRun, "dry-run", "n", false,
+		"Apply the upgrades and then roll them back")
+	migrateCmd.AddCommand(migrateStatusCmd)
+}
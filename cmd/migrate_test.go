@@ -0,0 +1,210 @@
+/*
+Copyright © 2021 Jim Lieb <lieb@sea-troll.net>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lieb/postdove/maildb"
+)
+
+// TestMigrateCmd
+func TestMigrateCmd(t *testing.T) {
+	var (
+		err         error
+		dir         string
+		dbfile      string
+		args        []string
+		out, errout string
+	)
+
+	fmt.Println("TestMigrateCmd")
+
+	dir, err = ioutil.TempDir("", "TestMigrate-*")
+	defer os.RemoveAll(dir)
+	dbfile = filepath.Join(dir, "test.db")
+
+	args = []string{"create", "-d", dbfile, "--no-locals", "--no-aliases"}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err != nil {
+		t.Errorf("Create DB: Unexpected error, %s", err)
+	}
+	if out != "" || errout != "" {
+		t.Errorf("Create DB: did not expect output, got %s, %s", out, errout)
+	}
+	args = []string{"-d", dbfile, "add", "domain", "example.org"}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err != nil {
+		t.Errorf("Add example.org: Unexpected error, %s", err)
+	}
+
+	// A new database is current
+	expectedOut := fmt.Sprintf("Database version:\t%d\nProgram version:\t%d\n",
+		maildb.DbSchemaVersion, maildb.DbSchemaVersion)
+	args = []string{"-d", dbfile, "migrate", "status"}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err != nil {
+		t.Errorf("Migrate status: Unexpected error, %s", err)
+	}
+	if !strings.HasPrefix(out, expectedOut) || strings.Contains(out, "Pending") {
+		t.Errorf("Migrate status: did not get expected output, got %s", out)
+	}
+	if errout != "" {
+		t.Errorf("Migrate status: did not expect error output, got %s", errout)
+	}
+
+	// Turn it into a pre-version database
+	db, err := sql.Open("sqlite3", dbfile)
+	if err != nil {
+		t.Errorf("Open DB: %s", err)
+		return
+	}
+	_, err = db.Exec("DROP TABLE schema_version")
+	// and undo the schema changes that can't be done twice.
+	// See downgrades in maildb/migrate_test.go
+	for _, q := range []string{
+		"DROP TRIGGER del_cred_login", "DROP TABLE credentiallogin",
+		"DROP TRIGGER audit_alias_domain_insert", "DROP TRIGGER audit_alias_domain_update",
+		"DROP TRIGGER audit_alias_domain_delete", "DROP TABLE aliasdomain",
+		"DROP TRIGGER after_addr_del",
+		`CREATE TRIGGER after_addr_del AFTER DELETE ON address
+ WHEN OLD.domain IS NOT NULL
+    AND (SELECT class FROM domain WHERE id = OLD.domain) != 4
+    AND (SELECT count(*) FROM address WHERE domain = OLD.domain) < 1
+ BEGIN
+  DELETE FROM domain WHERE id = OLD.domain; END`,
+		"DROP TRIGGER audit_forward_insert", "DROP TRIGGER audit_forward_update",
+		"DROP TRIGGER audit_forward_delete", "DROP TRIGGER audit_forward_target_insert",
+		"DROP TRIGGER audit_forward_target_delete", "DROP TABLE forwardtarget",
+		"DROP TABLE forward", "DROP VIEW virt_alias",
+		"DROP TRIGGER audit_vacation_insert", "DROP TRIGGER audit_vacation_update",
+		"DROP TRIGGER audit_vacation_delete", "DROP TABLE vacation",
+		"DROP VIEW user_sieve", "DROP TRIGGER audit_sieve_insert",
+		"DROP TRIGGER audit_sieve_update", "DROP TRIGGER audit_sieve_delete",
+		"DROP TABLE sievescript",
+		"DROP VIEW user_quota", "DROP TRIGGER del_mbox_quota",
+		"DROP TABLE quotausage",
+		"DROP VIEW user_credential", "DROP VIEW credential_service",
+		"DROP TRIGGER audit_credential_insert", "DROP TRIGGER audit_credential_update",
+		"DROP TRIGGER audit_credential_delete",
+		"DROP TABLE credential",
+		"DROP VIEW service_deny", "DROP VIEW imap_deny", "DROP VIEW pop3_deny",
+		"DROP VIEW lmtp_deny", "DROP VIEW submission_deny", "DROP VIEW sieve_deny",
+		"DROP TRIGGER audit_vmailbox_insert", "DROP TRIGGER audit_vmailbox_update",
+		"DROP TRIGGER audit_vmailbox_delete",
+		"DROP TRIGGER audit_domain_insert", "DROP TRIGGER audit_domain_update",
+		"DROP TRIGGER audit_domain_delete",
+		"DROP VIEW user_deny", "DROP VIEW user_mailbox",
+		"ALTER TABLE domain DROP COLUMN pw_max_age",
+		"ALTER TABLE domain DROP COLUMN pw_min_length",
+		"ALTER TABLE domain DROP COLUMN pw_min_classes",
+		"ALTER TABLE domain DROP COLUMN quota",
+		"ALTER TABLE vmailbox DROP COLUMN pw_set",
+		"ALTER TABLE vmailbox DROP COLUMN pw_max_age",
+		"DROP TABLE bannedpassword",
+		`CREATE VIEW "user_mailbox" AS
+		 SELECT mb.id AS id, a.localpart AS username, d.name AS domain, mb.enable AS enable
+		 FROM VMailbox AS mb JOIN address AS a ON (a.id = mb.id)
+		      JOIN domain AS d ON (a.domain = d.id)`,
+		"ALTER TABLE vmailbox DROP COLUMN allow_imap",
+		"ALTER TABLE vmailbox DROP COLUMN allow_pop3",
+		"ALTER TABLE vmailbox DROP COLUMN allow_lmtp",
+		"ALTER TABLE vmailbox DROP COLUMN allow_submission",
+		"ALTER TABLE vmailbox DROP COLUMN allow_sieve",
+	} {
+		if err != nil {
+			break
+		}
+		_, err = db.Exec(q)
+	}
+	db.Close()
+	if err != nil {
+		t.Errorf("Drop schema_version: %s", err)
+		return
+	}
+
+	// Ordinary commands now refuse it
+	args = []string{"-d", dbfile, "show", "domain", "example.org"}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err != maildb.ErrMdbSchemaOld {
+		t.Errorf("Show old DB: expected ErrMdbSchemaOld, got %v", err)
+	}
+
+	args = []string{"-d", dbfile, "migrate", "status"}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err != nil {
+		t.Errorf("Migrate status old DB: Unexpected error, %s", err)
+	}
+	if !strings.Contains(out, "Database version:\t1\n") ||
+		!strings.Contains(out, "Pending:\t2\tschema version\n") {
+		t.Errorf("Migrate status old DB: did not get expected output, got %s", out)
+	}
+
+	args = []string{"-d", dbfile, "migrate", "--dry-run"}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err != nil {
+		t.Errorf("Migrate dry run: Unexpected error, %s", err)
+	}
+	if !strings.HasPrefix(out, "Would apply 2: schema version\n") {
+		t.Errorf("Migrate dry run: did not get expected output, got %s", out)
+	}
+	if errout != "" {
+		t.Errorf("Migrate dry run: did not expect error output, got %s", errout)
+	}
+	args = []string{"-d", dbfile, "show", "domain", "example.org"}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err != maildb.ErrMdbSchemaOld {
+		t.Errorf("Show after dry run: expected ErrMdbSchemaOld, got %v", err)
+	}
+
+	// The flag is a global so turn it off explicitly
+	args = []string{"-d", dbfile, "migrate", "--dry-run=false"}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err != nil {
+		t.Errorf("Migrate: Unexpected error, %s", err)
+	}
+	if !strings.HasPrefix(out, "Applied 2: schema version\n") {
+		t.Errorf("Migrate: did not get expected output, got %s", out)
+	}
+	if errout != "" {
+		t.Errorf("Migrate: did not expect error output, got %s", errout)
+	}
+
+	args = []string{"-d", dbfile, "show", "domain", "example.org"}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err != nil {
+		t.Errorf("Show after migrate: Unexpected error, %s", err)
+	}
+	if !strings.HasPrefix(out, "Name:\t\texample.org\n") {
+		t.Errorf("Show after migrate: did not get expected output, got %s", out)
+	}
+
+	args = []string{"-d", dbfile, "migrate"}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err != nil {
+		t.Errorf("Migrate again: Unexpected error, %s", err)
+	}
+	if out != fmt.Sprintf("Database is at version %d, nothing to do\n", maildb.DbSchemaVersion) {
+		t.Errorf("Migrate again: did not get expected output, got %s", out)
+	}
+}
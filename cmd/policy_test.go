@@ -0,0 +1,162 @@
+/*
+Copyright © 2021 Jim Lieb <lieb@sea-troll.net>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lieb/postdove/maildb"
+)
+
+// TestPwPolicyCmds
+func TestPwPolicyCmds(t *testing.T) {
+	var (
+		err         error
+		dir         string
+		dbfile      string
+		args        []string
+		out, errout string
+	)
+
+	fmt.Println("TestPwPolicyCmds")
+
+	dir, err = ioutil.TempDir("", "TestPwPolicyCmds-*")
+	defer os.RemoveAll(dir)
+	dbfile = filepath.Join(dir, "test.db")
+
+	args = []string{"create", "-d", dbfile, "--no-locals", "--no-aliases"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Fatalf("Create DB: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "import", "domain"}
+	in := "pobox.org class=vmailbox, pw_max_age=30, pw_min_length=8, pw_min_classes=3\n"
+	if _, _, err = doTest(rootCmd, in, args); err != nil {
+		t.Fatalf("Import domains: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "show", "domain", "pobox.org"}
+	out, _, err = doTest(rootCmd, "", args)
+	if err != nil || !strings.HasSuffix(out, "\nPw Policy:\tmax age 30 days, min length 8, min classes 3\n") {
+		t.Errorf("Show pobox.org: unexpected result, %q, %v", out, err)
+	}
+	args = []string{"-d", dbfile, "edit", "domain", "pobox.org", "--pw-min-classes", "5"}
+	if _, _, err = doTest(rootCmd, "", args); err == nil ||
+		!strings.Contains(err.Error(), maildb.ErrMdbBadPwPolicy.Error()) {
+		t.Errorf("Edit pobox.org 5 classes: expected ErrMdbBadPwPolicy, got %v", err)
+	}
+	args = []string{"-d", dbfile, "edit", "domain", "pobox.org", "--pw-min-length", "10"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Errorf("Edit pobox.org min length 10: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "show", "domain", "pobox.org"}
+	out, _, err = doTest(rootCmd, "", args)
+	if err != nil || !strings.HasSuffix(out, "\nPw Policy:\tmax age 30 days, min length 10, min classes 3\n") {
+		t.Errorf("Show pobox.org after edit: unexpected result, %q, %v", out, err)
+	}
+
+	// '#' is part of a password, not a comment
+	args = []string{"-d", dbfile, "import", "banned"}
+	if _, _, err = doTest(rootCmd, "Winter2024!\n#Hash#Tag1\n\nwinter2024!\n", args); err != nil {
+		t.Errorf("Import banned: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "export", "banned"}
+	if out, _, err = doTest(rootCmd, "", args); err != nil || out != "#hash#tag1\nwinter2024!\n" {
+		t.Errorf("Export banned: unexpected result, %q, %v", out, err)
+	}
+
+	// Passwords are checked
+	for _, c := range []struct {
+		pw  string
+		err error
+	}{
+		{"Short1!", maildb.ErrMdbPwTooShort},
+		{"WINTER2024!", maildb.ErrMdbPwBanned},
+		{"Hoth-Base-3", nil},
+	} {
+		args = []string{"-d", dbfile, "add", "mailbox", "a@pobox.org", "--password", c.pw}
+		if _, _, err = doTest(rootCmd, "", args); err != c.err {
+			t.Errorf("Add a@pobox.org with %q: expected %v, got %v", c.pw, c.err, err)
+		}
+	}
+	args = []string{"-d", dbfile, "import", "mailbox"}
+	if _, _, err = doTest(rootCmd, "b@pobox.org:{PLAIN}weakpassword::::::\n", args); err == nil ||
+		!strings.Contains(err.Error(), maildb.ErrMdbPwClasses.Error()) {
+		t.Errorf("Import weak password: expected ErrMdbPwClasses, got %v", err)
+	}
+	in = `b@pobox.org:{SHA256}XohImNooBHFR0OVvjcYpJ3NgPQ1qq73WKhHvch0VQtg=::::::mbox_pw_set=2020-01-01T00:00:00Z
+c@pobox.org:{PLAIN}Dagobah-1977::::::mbox_pw_max_age=0
+`
+	if _, _, err = doTest(rootCmd, in, args); err != nil {
+		t.Errorf("Import mailboxes: Unexpected error, %s", err)
+	}
+
+	// c goes back to the domain's age and a's password is 25 days old
+	args = []string{"-d", dbfile, "edit", "mailbox", "c@pobox.org", "--no-max-age"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Errorf("Edit c@pobox.org: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "edit", "mailbox", "a@pobox.org",
+		"--password-set", time.Now().AddDate(0, 0, -25).Format("2006-01-02")}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Errorf("Edit a@pobox.org: Unexpected error, %s", err)
+	}
+
+	args = []string{"-d", dbfile, "report", "expiring", "--days", "10"}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err != nil || errout != "" {
+		t.Errorf("Report expiring: unexpected error, %q, %v", errout, err)
+	}
+	re := "^pobox.org\n" +
+		"\tb@pobox.org\t2020-01-3[01] [0-9:]{8} \\(expired\\)\n" +
+		"\ta@pobox.org\t[0-9]{4}-[0-9]{2}-[0-9]{2} [0-9:]{8}\n" +
+		"Total\t1 expired, 1 expiring within 10 days\n$"
+	if !regexp.MustCompile(re).MatchString(out) {
+		t.Errorf("Report expiring: %q does not match %q", out, re)
+	}
+
+	args = []string{"-d", dbfile, "show", "mailbox", "b@pobox.org"}
+	out, _, err = doTest(rootCmd, "", args)
+	if err != nil || !regexp.MustCompile("\nPw Expires:\t2020-01-3[01] [0-9:]{8} \\(expired\\)\n").MatchString(out) {
+		t.Errorf("Show b@pobox.org: unexpected result, %q, %v", out, err)
+	}
+	args = []string{"-d", dbfile, "export", "mailbox", "*@pobox.org"}
+	out, _, err = doTest(rootCmd, "", args)
+	if err != nil {
+		t.Errorf("Export mailboxes: Unexpected error, %s", err)
+	}
+	ml := strings.Split(out, "\n")
+	if len(ml) != 4 || !strings.HasSuffix(ml[1], " mbox_pw_set=2020-01-01T00:00:00Z") ||
+		strings.Contains(ml[2], "mbox_pw_max_age") || !strings.Contains(ml[2], " mbox_pw_set=") {
+		t.Errorf("Export mailboxes: unexpected output, %q", out)
+	}
+
+	// Take one off the list and it can be used
+	args = []string{"-d", dbfile, "delete", "banned", "WINTER2024!"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Errorf("Delete banned: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "edit", "mailbox", "c@pobox.org", "--password", "Winter2024!"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Errorf("Edit c@pobox.org password: Unexpected error, %s", err)
+	}
+}
@@ -0,0 +1,125 @@
+/*
+Copyright © 2021 Jim Lieb <lieb@sea-troll.net>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/lieb/postdove/maildb"
+	"github.com/spf13/cobra"
+)
+
+var quotaOver int64
+
+// reportQuota list how much of their quotas the mailboxes use
+var reportQuota = &cobra.Command{
+	Use:   "quota [ address ] [ flags ]",
+	Short: "Report the quota usage of mailboxes",
+	Long: `Report, by domain, how much each mailbox uses of its quota, fullest first.
+The usage is what dovecot's quota dict has recorded. A mailbox dovecot has not
+counted yet uses nothing. With --over only the mailboxes at least that percent
+full are listed. The address can be wildcarded, such as "*@example.com".
+The default is all mailboxes.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: quotaReport,
+}
+
+// linkage to top level commands
+func init() {
+	reportCmd.AddCommand(reportQuota)
+	reportQuota.Flags().Int64Var(&quotaOver, "over", 0,
+		"Only list mailboxes at least this percent full")
+}
+
+// quotaReport
+// The usage of each mailbox and the total of its domain
+func quotaReport(cmd *cobra.Command, args []string) error {
+	var (
+		ql      []*maildb.QuotaUsage
+		err     error
+		domains []string
+		bytes   int64
+		full    int
+	)
+
+	if quotaOver < 0 {
+		return fmt.Errorf("--over cannot be negative")
+	}
+	vMailbox := "*@*"
+	if len(args) > 0 {
+		vMailbox = args[0]
+	}
+	if ql, err = mdb.FindQuotaUsageContext(cmd.Context(), vMailbox); err != nil {
+		return err
+	}
+	byDomain := make(map[string][]*maildb.QuotaUsage)
+	for _, q := range ql {
+		d := q.Domain()
+		if byDomain[d] == nil {
+			domains = append(domains, d)
+		}
+		byDomain[d] = append(byDomain[d], q)
+		bytes += q.Bytes()
+		if q.IsLimited() && q.Percent() >= 100 {
+			full++
+		}
+	}
+	sort.Strings(domains)
+	for _, d := range domains {
+		dl := byDomain[d]
+		sort.SliceStable(dl, func(i, j int) bool {
+			if dl[i].Percent() != dl[j].Percent() {
+				return dl[i].Percent() > dl[j].Percent()
+			}
+			return dl[i].User() < dl[j].User()
+		})
+		cmd.Printf("%s\t%s\n", d, domainQuota(dl))
+		for _, q := range dl {
+			if quotaOver > 0 && (!q.IsLimited() || q.Percent() < quotaOver) {
+				continue
+			}
+			cmd.Printf("\t%s\t%s\n", q.User(), q)
+		}
+	}
+	cmd.Printf("Total\t%d mailboxes, %s used, %d full\n",
+		len(ql), maildb.FormatBytes(bytes), full)
+	return nil
+}
+
+// domainQuota
+// The storage the mailboxes of a domain use. There is only a limit
+// and a percent if every one of them has a storage limit.
+func domainQuota(ql []*maildb.QuotaUsage) string {
+	var bytes, limit, msgs int64
+
+	limited := true
+	for _, q := range ql {
+		bytes += q.Bytes()
+		msgs += q.Messages()
+		if q.BytesLimit() > 0 {
+			limit += q.BytesLimit()
+		} else {
+			limited = false
+		}
+	}
+	if limited {
+		return fmt.Sprintf("%s of %s, %d messages (%d%%)", maildb.FormatBytes(bytes),
+			maildb.FormatBytes(limit), msgs, bytes*100/limit)
+	}
+	return fmt.Sprintf("%s, %d messages", maildb.FormatBytes(bytes), msgs)
+}
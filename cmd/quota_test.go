@@ -0,0 +1,182 @@
+/*
+Copyright © 2021 Jim Lieb <lieb@sea-troll.net>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lieb/postdove/maildb"
+)
+
+// TestQuotaCmds
+// The usage is put in the database the way dovecot's quota dict does.
+func TestQuotaCmds(t *testing.T) {
+	var (
+		err         error
+		dir         string
+		dbfile      string
+		args        []string
+		out, errout string
+	)
+
+	fmt.Println("TestQuotaCmds")
+
+	dir, err = ioutil.TempDir("", "TestQuotaCmds-*")
+	defer os.RemoveAll(dir)
+	dbfile = filepath.Join(dir, "test.db")
+
+	args = []string{"create", "-d", dbfile, "--no-locals", "--no-aliases"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Fatalf("Create DB: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "import", "domain"}
+	in := "pobox.org class=vmailbox\nexample.com class=vmailbox\n"
+	if _, _, err = doTest(rootCmd, in, args); err != nil {
+		t.Fatalf("Import domains: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "import", "mailbox"}
+	in = `a@pobox.org:{PLAIN}*::::::userdb_quota_rule=*:bytes=100M
+b@pobox.org:{PLAIN}*::::::userdb_quota_rule=*:storage=1000
+c@pobox.org:{PLAIN}*::::::userdb_quota_rule=*:bytes=100M
+d@example.com:{PLAIN}*::::::userdb_quota_rule=none
+`
+	if _, _, err = doTest(rootCmd, in, args); err != nil {
+		t.Fatalf("Import mailboxes: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "edit", "mailbox", "b@pobox.org",
+		"--quota", "*:storage=1000:messages=100"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Errorf("Edit b@pobox.org: Unexpected error, %s", err)
+	}
+
+	db, err := sql.Open("sqlite3", dbfile)
+	if err != nil {
+		t.Fatalf("Open DB: %s", err)
+	}
+	for _, q := range []string{
+		"INSERT INTO quotausage (username, bytes, messages) VALUES ('a@pobox.org', 52428800, 10)",
+		"INSERT INTO quotausage (username, bytes, messages) VALUES ('b@pobox.org', 1024, 100)",
+		"INSERT INTO quotausage (username, bytes, messages) VALUES ('d@example.com', 1536, 3)",
+	} {
+		if _, err = db.Exec(q); err != nil {
+			t.Errorf("Insert usage: %s", err)
+		}
+	}
+	db.Close()
+
+	args = []string{"-d", dbfile, "show", "mailbox", "a@pobox.org"}
+	out, _, err = doTest(rootCmd, "", args)
+	if err != nil || !strings.Contains(out,
+		"\nQuota:\t\t*:bytes=100M\nQuota Used:\t50M of 100M, 10 messages (50%)\n") {
+		t.Errorf("Show a@pobox.org: unexpected result, %q, %v", out, err)
+	}
+
+	expectedOut := `example.com	1.5K, 3 messages
+	d@example.com	1.5K, 3 messages
+pobox.org	50M of 201M, 110 messages (24%)
+	b@pobox.org	1K of 1000K, 100 of 100 messages (100%)
+	a@pobox.org	50M of 100M, 10 messages (50%)
+	c@pobox.org	0B of 100M, 0 messages (0%)
+Total	4 mailboxes, 50M used, 1 full
+`
+	args = []string{"-d", dbfile, "report", "quota"}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err != nil || errout != "" {
+		t.Errorf("Report quota: unexpected error, %q, %v", errout, err)
+	}
+	if out != expectedOut {
+		t.Errorf("Report quota: expected %q, got %q", expectedOut, out)
+	}
+
+	expectedOut = `pobox.org	50M of 201M, 110 messages (24%)
+	b@pobox.org	1K of 1000K, 100 of 100 messages (100%)
+	a@pobox.org	50M of 100M, 10 messages (50%)
+Total	3 mailboxes, 50M used, 1 full
+`
+	args = []string{"-d", dbfile, "report", "quota", "*@pobox.org", "--over", "50"}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err != nil || errout != "" {
+		t.Errorf("Report quota over 50: unexpected error, %q, %v", errout, err)
+	}
+	if out != expectedOut {
+		t.Errorf("Report quota over 50: expected %q, got %q", expectedOut, out)
+	}
+
+	// The usage goes with the mailbox
+	args = []string{"-d", dbfile, "delete", "mailbox", "a@pobox.org"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Errorf("Delete a@pobox.org: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "import", "mailbox"}
+	in = "a@pobox.org:{PLAIN}*::::::userdb_quota_rule=*:bytes=100M\n"
+	if _, _, err = doTest(rootCmd, in, args); err != nil {
+		t.Errorf("Import a@pobox.org again: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "show", "mailbox", "a@pobox.org"}
+	out, _, err = doTest(rootCmd, "", args)
+	if err != nil || !strings.Contains(out, "\nQuota Used:\t0B of 100M, 0 messages (0%)\n") {
+		t.Errorf("Show new a@pobox.org: unexpected result, %q, %v", out, err)
+	}
+
+	// Rules are checked before they get to dovecot
+	args = []string{"-d", dbfile, "import", "mailbox"}
+	in = "f@pobox.org:{PLAIN}*::::::userdb_quota_rule=*:bytes=300MB\n"
+	if _, _, err = doTest(rootCmd, in, args); err == nil ||
+		!strings.Contains(err.Error(), maildb.ErrMdbBadQuota.Error()) {
+		t.Errorf("Import bad quota: expected ErrMdbBadQuota, got %v", err)
+	}
+	args = []string{"-d", dbfile, "edit", "mailbox", "b@pobox.org", "--quota", "*:byte=1G"}
+	if _, _, err = doTest(rootCmd, "", args); err != maildb.ErrMdbBadQuota {
+		t.Errorf("Edit b@pobox.org bad quota: expected ErrMdbBadQuota, got %v", err)
+	}
+	args = []string{"-d", dbfile, "add", "domain", "bad.org", "--quota", "*:bytes=+1G"}
+	if _, _, err = doTest(rootCmd, "", args); err != maildb.ErrMdbBadQuota {
+		t.Errorf("Add bad.org: expected ErrMdbBadQuota, got %v", err)
+	}
+
+	// New mailboxes get the domain's default
+	args = []string{"-d", dbfile, "edit", "domain", "pobox.org", "--quota", "*:storage=1G:messages=5000"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Errorf("Edit pobox.org: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "show", "domain", "pobox.org"}
+	out, _, err = doTest(rootCmd, "", args)
+	if err != nil || !strings.Contains(out, "\nQuota:\t\t*:storage=1G:messages=5000\n") {
+		t.Errorf("Show pobox.org: unexpected result, %q, %v", out, err)
+	}
+	args = []string{"-d", dbfile, "export", "domain", "pobox.org"}
+	out, _, err = doTest(rootCmd, "", args)
+	if err != nil || out != "pobox.org class=vmailbox, quota=*:storage=1G:messages=5000\n" {
+		t.Errorf("Export pobox.org: unexpected result, %q, %v", out, err)
+	}
+	args = []string{"-d", dbfile, "add", "mailbox", "e@pobox.org"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Errorf("Add e@pobox.org: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "show", "mailbox", "e@pobox.org"}
+	out, _, err = doTest(rootCmd, "", args)
+	if err != nil || !strings.Contains(out,
+		"\nQuota:\t\t*:storage=1G:messages=5000 (domain)\nQuota Used:\t0B of 1G, 0 of 5000 messages (0%)\n") {
+		t.Errorf("Show e@pobox.org: unexpected result, %q, %v", out, err)
+	}
+}
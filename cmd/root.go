@@ -17,8 +17,12 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package cmd
 
 import (
+	"context"
 	_ "embed"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/lieb/postdove/maildb"
 	"github.com/spf13/cobra"
@@ -29,9 +33,18 @@ var Version string
 
 const defaultDB = "/etc/postfix/private/postdove.sqlite"
 
+// noSchemaCheck
+// Annotation for commands that must open a database whose
+// schema version does not match ours, i.e. create and migrate.
+const noSchemaCheck = "noSchemaCheck"
+
 var (
 	dbFile        string
 	reportVersion bool
+	busyTimeout   time.Duration
+	vmailRoot     string
+	vmailMode     string
+	trashDays     int
 	mdb           *maildb.MailDB
 )
 
@@ -62,8 +75,9 @@ var createCmd = &cobra.Command{
 	Short: "Create the Sqlite database and initialize its tables",
 	Long: `Create the Sqlite database file and initilize its tables.
 You will also have to do some imports and adds to this otherwise empty database.`,
-	Args: cobra.NoArgs,
-	RunE: cmdCreate,
+	Args:        cobra.NoArgs,
+	RunE:        cmdCreate,
+	Annotations: map[string]string{noSchemaCheck: "true"},
 }
 
 // importCmd represents the import command
@@ -117,6 +131,14 @@ var editCmd = &cobra.Command{
 	Long:  `Edit an entry in the specified table.`,
 }
 
+// renameCmd represents the rename command
+var renameCmd = &cobra.Command{
+	Use:   "rename [table]",
+	Short: "Rename an entry in the specified table",
+	Long: `Rename an entry in the specified table. Everything that refers to it
+follows it to its new name.`,
+}
+
 // showCmd represents the show command
 var showCmd = &cobra.Command{
 	Use:   "show [table]",
@@ -125,10 +147,33 @@ var showCmd = &cobra.Command{
 readable format`,
 }
 
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify [table]",
+	Short: "Verify an entry against what is in the database",
+	Long:  `Verify something given, such as a password, against the entry in the specified table.`,
+}
+
+// reportCmd represents the report command
+var reportCmd = &cobra.Command{
+	Use:   "report [subject]",
+	Short: "Report on the state of the database",
+	Long: `Report on the state of something across the whole database, such as
+how the mailbox passwords are stored.`,
+}
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
+// An interrupt or SIGTERM cancels the command's context so whatever transaction
+// it has going is rolled back. A second one kills us the usual way.
 func Execute() {
-	cobra.CheckErr(rootCmd.Execute())
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	cobra.CheckErr(rootCmd.ExecuteContext(ctx))
 }
 
 // callPersistentPreRunE
@@ -150,12 +195,35 @@ func callPersistentPreRunE(cmd *cobra.Command, args []string) error {
 func openDB(cmd *cobra.Command, args []string) error {
 	var err error
 
-	if mdb, err = maildb.NewMailDB(dbFile); err != nil {
+	if skipSchemaCheck(cmd) {
+		mdb, err = maildb.OpenMailDB(dbFile)
+	} else {
+		mdb, err = maildb.NewMailDB(dbFile)
+	}
+	if err != nil {
 		return err
 	}
+	if cmd.Flags().Changed("busy-timeout") {
+		if err = mdb.SetBusyTimeout(busyTimeout); err != nil {
+			mdb.Close()
+			mdb = nil
+			return err
+		}
+	}
 	return nil
 }
 
+// skipSchemaCheck
+// true if this command or one of its parents is annotated noSchemaCheck
+func skipSchemaCheck(cmd *cobra.Command) bool {
+	for c := cmd; c != nil; c = c.Parent() {
+		if _, ok := c.Annotations[noSchemaCheck]; ok {
+			return true
+		}
+	}
+	return false
+}
+
 // closeDB
 // persistent post-run to clean up the DB
 func closeDB(cmd *cobra.Command, args []string) {
@@ -167,7 +235,20 @@ func init() {
 	// dbfile points to a database file that is other than the system default
 	rootCmd.PersistentFlags().StringVarP(&dbFile, "dbfile", "d",
 		defaultDB,
-		"Sqlite3 database file")
+		"Sqlite3 database file or PostgreSQL DSN")
+
+	// How long to wait for another writer before giving up
+	rootCmd.PersistentFlags().DurationVarP(&busyTimeout, "busy-timeout", "b",
+		maildb.DefaultBusyTimeout,
+		"How long to wait for the database when another program is updating it")
+
+	// Mail storage is only touched if there is a vmail root
+	rootCmd.PersistentFlags().StringVar(&vmailRoot, "vmail-root", "",
+		"Directory of the mail homes to make, move and trash with their mailboxes")
+	rootCmd.PersistentFlags().StringVar(&vmailMode, "vmail-mode", "0700",
+		"Mode of the mail home directories that are made, in octal")
+	rootCmd.PersistentFlags().IntVar(&trashDays, "trash-days", maildb.DefaultTrashDays,
+		"Days to keep the mail of deleted mailboxes")
 
 	// Report version
 	rootCmd.PersistentFlags().BoolVarP(&reportVersion, "version", "v",
@@ -196,6 +277,15 @@ func init() {
 	// Edit command
 	rootCmd.AddCommand(editCmd)
 
+	// Rename command
+	rootCmd.AddCommand(renameCmd)
+
 	// Show command
 	rootCmd.AddCommand(showCmd)
+
+	// Verify command
+	rootCmd.AddCommand(verifyCmd)
+
+	// Report command
+	rootCmd.AddCommand(reportCmd)
 }
@@ -0,0 +1,219 @@
+/*
+Copyright © 2021 Jim Lieb <lieb@sea-troll.net>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/lieb/postdove/maildb"
+	"github.com/spf13/cobra"
+)
+
+var (
+	sieveActivate   bool
+	sieveDeactivate bool
+)
+
+// addSieve do add of a sieve script to a mailbox
+var addSieve = &cobra.Command{
+	Use:   "sieve address name [ file ] [ flags ]",
+	Short: "Add a Sieve script to a mailbox",
+	Long: `Add the named Sieve script to the mailbox of the address. The script is read
+from the file, or from stdin if there is no file or it is "-". It is checked
+before it is stored and is not run at delivery until it is made active.`,
+	Args: cobra.RangeArgs(2, 3),
+	RunE: sieveAdd,
+}
+
+// editSieve do edit of a sieve script
+var editSieve = &cobra.Command{
+	Use:   "sieve address name [ file ] [ flags ]",
+	Short: "Edit or activate a Sieve script of a mailbox",
+	Long: `Edit the named Sieve script of the mailbox of the address. If there is a file,
+or "-" for stdin, the script is replaced by it after it is checked. The
+script can also be made the active one, the one run at delivery, or no
+longer be.`,
+	Args: cobra.RangeArgs(2, 3),
+	RunE: sieveEdit,
+}
+
+// deleteSieve do delete of a sieve script
+var deleteSieve = &cobra.Command{
+	Use:   "sieve address name",
+	Short: "Delete a Sieve script from a mailbox",
+	Long:  `Delete the named Sieve script from the mailbox of the address.`,
+	Args:  cobra.ExactArgs(2),
+	RunE:  sieveDelete,
+}
+
+// showSieve display the sieve scripts of a mailbox
+var showSieve = &cobra.Command{
+	Use:   "sieve address [ name ]",
+	Short: "Display the Sieve scripts of a mailbox",
+	Long: `Display the Sieve scripts of the mailbox of the address to standard output.
+With a name, the script itself follows.`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: sieveShow,
+}
+
+// linkage to top level commands
+func init() {
+	addCmd.AddCommand(addSieve)
+	addSieve.Flags().BoolVarP(&sieveActivate, "activate", "a", false,
+		"Make it the script run at delivery")
+	editCmd.AddCommand(editSieve)
+	editSieve.Flags().BoolVarP(&sieveActivate, "activate", "a", false,
+		"Make it the script run at delivery")
+	editSieve.Flags().BoolVar(&sieveDeactivate, "deactivate", false,
+		"No longer run it at delivery")
+	deleteCmd.AddCommand(deleteSieve)
+	showCmd.AddCommand(showSieve)
+}
+
+// readSieve
+// The script from the file, stdin if it is "-"
+func readSieve(cmd *cobra.Command, file string) (string, error) {
+	var (
+		b   []byte
+		err error
+	)
+
+	if file == "-" {
+		b, err = ioutil.ReadAll(cmd.InOrStdin())
+	} else {
+		b, err = ioutil.ReadFile(file)
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// sieveAdd
+func sieveAdd(cmd *cobra.Command, args []string) (err error) {
+	var s *maildb.SieveScript
+
+	file := "-"
+	if len(args) > 2 {
+		file = args[2]
+	}
+	script, err := readSieve(cmd, file)
+	if err != nil {
+		return err
+	}
+	cmd.SilenceUsage = true // not a usage problem from here
+	tx, err := mdb.BeginContext(cmd.Context())
+	if err != nil {
+		return err
+	}
+	defer tx.End(&err)
+
+	if s, err = tx.InsertSieveScript(args[0], args[1], script); err != nil {
+		return err
+	}
+	if cmd.Flags().Changed("activate") && sieveActivate {
+		err = s.Activate()
+	}
+	return err
+}
+
+// sieveEdit
+func sieveEdit(cmd *cobra.Command, args []string) (err error) {
+	var (
+		s      *maildb.SieveScript
+		script string
+	)
+
+	activate := cmd.Flags().Changed("activate") && sieveActivate
+	deactivate := cmd.Flags().Changed("deactivate") && sieveDeactivate
+	if activate && deactivate {
+		return fmt.Errorf("A script cannot be both activated and deactivated")
+	}
+	if len(args) > 2 {
+		if script, err = readSieve(cmd, args[2]); err != nil {
+			return err
+		}
+	}
+	cmd.SilenceUsage = true // not a usage problem from here
+	tx, err := mdb.BeginContext(cmd.Context())
+	if err != nil {
+		return err
+	}
+	defer tx.End(&err)
+
+	if s, err = tx.GetSieveScript(args[0], args[1]); err != nil {
+		return err
+	}
+	if len(args) > 2 {
+		if err = s.SetScript(script); err != nil {
+			return err
+		}
+	}
+	if activate {
+		err = s.Activate()
+	} else if deactivate {
+		err = s.Deactivate()
+	}
+	return err
+}
+
+// sieveDelete
+func sieveDelete(cmd *cobra.Command, args []string) error {
+	return mdb.WithTxContext(cmd.Context(), func(tx *maildb.Tx) error {
+		return tx.DeleteSieveScript(args[0], args[1])
+	})
+}
+
+// sieveShow
+func sieveShow(cmd *cobra.Command, args []string) error {
+	var (
+		sl          []*maildb.SieveScript
+		err         error
+		MoreThanOne bool
+	)
+
+	if len(args) > 1 {
+		s, err := mdb.LookupSieveScriptContext(cmd.Context(), args[0], args[1])
+		if err != nil {
+			return err
+		}
+		sl = append(sl, s)
+	} else if sl, err = mdb.FindSieveScriptsContext(cmd.Context(), args[0]); err != nil {
+		return err
+	}
+	for _, s := range sl {
+		if MoreThanOne {
+			cmd.Printf("=====================\n")
+		}
+		active := "no"
+		if s.IsActive() {
+			active = "yes"
+		}
+		cmd.Printf("Name:\t\t%s\nScript:\t\t%s\nActive:\t\t%s\nVersion:\t%d\nModified:\t%s\n",
+			s.User(), s.Name(), active, s.Version(), credentialTime(s.Modified()))
+		if len(args) > 1 {
+			cmd.Printf("\n%s", s.Script())
+			if !strings.HasSuffix(s.Script(), "\n") {
+				cmd.Printf("\n")
+			}
+		}
+		MoreThanOne = true
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+/*
+Copyright © 2021 Jim Lieb <lieb@sea-troll.net>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/lieb/postdove/maildb"
+)
+
+// TestSieveCmds
+func TestSieveCmds(t *testing.T) {
+	var (
+		err         error
+		dir         string
+		dbfile      string
+		args        []string
+		out, errout string
+	)
+
+	fmt.Println("TestSieveCmds")
+
+	dir, err = ioutil.TempDir("", "TestSieveCmds-*")
+	defer os.RemoveAll(dir)
+	dbfile = filepath.Join(dir, "test.db")
+
+	args = []string{"create", "-d", dbfile, "--no-locals", "--no-aliases"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Fatalf("Create DB: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "import", "domain"}
+	if _, _, err = doTest(rootCmd, "pobox.org class=vmailbox\n", args); err != nil {
+		t.Fatalf("Import domains: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "import", "mailbox"}
+	if _, _, err = doTest(rootCmd, "a@pobox.org:{PLAIN}pw::::::\n", args); err != nil {
+		t.Fatalf("Import mailboxes: Unexpected error, %s", err)
+	}
+
+	// One from stdin and one from a file
+	spam := "require \"fileinto\";\nif header :contains \"subject\" \"SPAM\" {\n  fileinto \"Junk\";\n}\n"
+	args = []string{"-d", dbfile, "add", "sieve", "a@pobox.org", "spam"}
+	if _, _, err = doTest(rootCmd, spam, args); err != nil {
+		t.Errorf("Add spam: Unexpected error, %s", err)
+	}
+	vacation := filepath.Join(dir, "vacation.sieve")
+	err = ioutil.WriteFile(vacation,
+		[]byte("require \"vacation\";\nvacation :days 7 \"Away\";\n"), 0644)
+	if err != nil {
+		t.Fatalf("Write vacation.sieve: %s", err)
+	}
+	args = []string{"-d", dbfile, "add", "sieve", "a@pobox.org", "travel", vacation, "--activate"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Errorf("Add travel: Unexpected error, %s", err)
+	}
+
+	modified := regexp.MustCompile(`Modified:\t[-0-9]+ [:0-9]+\n`)
+	expectedOut := `Name:		a@pobox.org
+Script:		spam
+Active:		no
+Version:	1
+Modified:	TIME
+=====================
+Name:		a@pobox.org
+Script:		travel
+Active:		yes
+Version:	1
+Modified:	TIME
+`
+	args = []string{"-d", dbfile, "show", "sieve", "a@pobox.org"}
+	out, errout, err = doTest(rootCmd, "", args)
+	if err != nil || errout != "" {
+		t.Errorf("Show a@pobox.org: unexpected error, %q, %v", errout, err)
+	}
+	if o := modified.ReplaceAllString(out, "Modified:\tTIME\n"); o != expectedOut {
+		t.Errorf("Show a@pobox.org: expected %q, got %q", expectedOut, out)
+	}
+
+	// A broken one never gets in
+	args = []string{"-d", dbfile, "add", "sieve", "a@pobox.org", "broken"}
+	_, _, err = doTest(rootCmd, "keep;\nfileinto \"Junk\";\n", args)
+	if !errors.Is(err, maildb.ErrMdbBadSieve) ||
+		!strings.HasSuffix(err.Error(), "line 2, fileinto needs require \"fileinto\"") {
+		t.Errorf("Add broken: expected ErrMdbBadSieve at line 2, got %v", err)
+	}
+	args = []string{"-d", dbfile, "add", "sieve", "a@pobox.org", "nofile", filepath.Join(dir, "nofile")}
+	if _, _, err = doTest(rootCmd, "", args); err == nil {
+		t.Errorf("Add nofile: expected an error")
+	}
+	args = []string{"-d", dbfile, "show", "sieve", "a@pobox.org", "broken"}
+	if _, _, err = doTest(rootCmd, "", args); err != maildb.ErrMdbSieveNotFound {
+		t.Errorf("Show broken: expected ErrMdbSieveNotFound, got %v", err)
+	}
+
+	// Switch the active one and then edit it
+	args = []string{"-d", dbfile, "edit", "sieve", "a@pobox.org", "spam", "--activate"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Errorf("Activate spam: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "edit", "sieve", "a@pobox.org", "spam", "--activate", "--deactivate"}
+	if _, _, err = doTest(rootCmd, "", args); err == nil {
+		t.Errorf("Edit spam both: expected an error")
+	}
+	spam2 := strings.Replace(spam, "SPAM", "[SPAM]", 1)
+	args = []string{"-d", dbfile, "edit", "sieve", "a@pobox.org", "spam", "-"}
+	if _, _, err = doTest(rootCmd, spam2, args); err != nil {
+		t.Errorf("Edit spam: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "edit", "sieve", "a@pobox.org", "spam", "-"}
+	if _, _, err = doTest(rootCmd, "if true { keep; }\nelse {}\nelsif false {}\n", args); !errors.Is(err, maildb.ErrMdbBadSieve) {
+		t.Errorf("Edit spam broken: expected ErrMdbBadSieve, got %v", err)
+	}
+	expectedOut = `Name:		a@pobox.org
+Script:		spam
+Active:		yes
+Version:	2
+Modified:	TIME
+
+` + spam2
+	args = []string{"-d", dbfile, "show", "sieve", "a@pobox.org", "spam"}
+	out, _, err = doTest(rootCmd, "", args)
+	if o := modified.ReplaceAllString(out, "Modified:\tTIME\n"); err != nil || o != expectedOut {
+		t.Errorf("Show spam: expected %q, got %q, %v", expectedOut, out, err)
+	}
+	args = []string{"-d", dbfile, "show", "sieve", "a@pobox.org", "travel"}
+	out, _, err = doTest(rootCmd, "", args)
+	if err != nil || !strings.Contains(out, "\nActive:\t\tno\n") {
+		t.Errorf("Show travel: expected inactive, got %q, %v", out, err)
+	}
+
+	// Delete one and look in the log
+	args = []string{"-d", dbfile, "delete", "sieve", "a@pobox.org", "travel"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Errorf("Delete travel: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "delete", "sieve", "a@pobox.org", "travel"}
+	if _, _, err = doTest(rootCmd, "", args); err != maildb.ErrMdbSieveNotFound {
+		t.Errorf("Delete travel again: expected ErrMdbSieveNotFound, got %v", err)
+	}
+	args = []string{"-d", dbfile, "log", "--entity", "sieve"}
+	out, _, err = doTest(rootCmd, "", args)
+	if err != nil || strings.Count(out, "a@pobox.org") != 7 {
+		t.Errorf("Log sieve: expected 7 changes, got %q, %v", out, err)
+	}
+}
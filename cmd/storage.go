@@ -0,0 +1,81 @@
+/*
+Copyright © 2021 Jim Lieb <lieb@sea-troll.net>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/lieb/postdove/maildb"
+	"github.com/spf13/cobra"
+)
+
+// deleteTrash empty the trash of the vmail root
+var deleteTrash = &cobra.Command{
+	Use:   "trash",
+	Short: "Delete the mail of deleted mailboxes after its retention",
+	Long: `Delete the mail homes that deleting their mailboxes moved to the trash of the
+--vmail-root once they have been there for --trash-days. Each one deleted is listed.`,
+	Args: cobra.NoArgs,
+	RunE: trashDelete,
+}
+
+// linkage to top level commands
+func init() {
+	deleteCmd.AddCommand(deleteTrash)
+}
+
+// mailStorage
+// The storage under --vmail-root or nil if there is none
+func mailStorage() (*maildb.Storage, error) {
+	if vmailRoot == "" {
+		return nil, nil
+	}
+	mode, err := strconv.ParseUint(vmailMode, 8, 32)
+	if err != nil || os.FileMode(mode)&^os.ModePerm != 0 {
+		return nil, fmt.Errorf("--vmail-mode must be an octal file mode such as 0700")
+	}
+	return maildb.NewStorage(vmailRoot, os.FileMode(mode), trashDays)
+}
+
+// storageError
+// The storage is done after the database change is committed so
+// say that it is only the storage that needs fixing.
+func storageError(user string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("%s is changed in the database but not its storage, %w", user, err)
+}
+
+// trashDelete
+func trashDelete(cmd *cobra.Command, args []string) error {
+	st, err := mailStorage()
+	if err != nil {
+		return err
+	}
+	if st == nil {
+		return fmt.Errorf("There is no trash without --vmail-root")
+	}
+	gone, err := st.Purge(time.Now())
+	for _, g := range gone {
+		cmd.Printf("%s\n", g)
+	}
+	return err
+}
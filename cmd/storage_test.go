@@ -0,0 +1,170 @@
+/*
+Copyright © 2021 Jim Lieb <lieb@sea-troll.net>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/lieb/postdove/maildb"
+)
+
+// TestStorageCmds
+func TestStorageCmds(t *testing.T) {
+	var (
+		err    error
+		dir    string
+		dbfile string
+		args   []string
+		out    string
+	)
+
+	fmt.Println("TestStorageCmds")
+
+	dir, err = ioutil.TempDir("", "TestStorageCmds-*")
+	defer os.RemoveAll(dir)
+	dbfile = filepath.Join(dir, "test.db")
+	root := filepath.Join(dir, "vmail")
+	if err = os.Mkdir(root, 0755); err != nil {
+		t.Fatalf("Make vmail root: %s", err)
+	}
+
+	args = []string{"create", "-d", dbfile, "--no-locals", "--no-aliases"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Fatalf("Create DB: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "import", "domain"}
+	if _, _, err = doTest(rootCmd, "pobox.org class=vmailbox\n", args); err != nil {
+		t.Fatalf("Import domains: Unexpected error, %s", err)
+	}
+
+	// We can only give the storage to ourselves unless we are root
+	args = []string{"-d", dbfile, "--vmail-root", root, "add", "mailbox", "a@pobox.org",
+		"-u", strconv.Itoa(os.Getuid()), "-g", strconv.Itoa(os.Getgid())}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Errorf("Add a@pobox.org: Unexpected error, %s", err)
+	}
+	for _, d := range []string{"cur", "new", "tmp"} {
+		fi, err := os.Stat(filepath.Join(root, "pobox.org", "a", maildb.MaildirName, d))
+		if err != nil || fi.Mode().Perm() != 0700 {
+			t.Errorf("Add a@pobox.org: Maildir %s, %v, %v", d, fi, err)
+		}
+	}
+
+	// but not outside the root
+	args = []string{"-d", dbfile, "--vmail-root", root, "add", "mailbox", "b@pobox.org", "--mail-home", "/etc"}
+	if _, _, err = doTest(rootCmd, "", args); err != maildb.ErrMdbStorageOutside {
+		t.Errorf("Add b@pobox.org in /etc: expected ErrMdbStorageOutside, got %v", err)
+	}
+	args = []string{"-d", dbfile, "show", "mailbox", "b@pobox.org"}
+	if _, _, err = doTest(rootCmd, "", args); err == nil {
+		t.Errorf("Show b@pobox.org: expected it not to be added")
+	}
+	// nor the domain's directory with a@pobox.org in it
+	args = []string{"-d", dbfile, "--vmail-root", root, "add", "mailbox", "b@pobox.org", "--mail-home", "pobox.org"}
+	if _, _, err = doTest(rootCmd, "", args); err != maildb.ErrMdbStorageShallow {
+		t.Errorf("Add b@pobox.org in pobox.org: expected ErrMdbStorageShallow, got %v", err)
+	}
+
+	args = []string{"-d", dbfile, "--vmail-root", root, "edit", "mailbox", "a@pobox.org", "--mail-home", "moved/a"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Errorf("Edit a@pobox.org: Unexpected error, %s", err)
+	}
+	if _, err = os.Stat(filepath.Join(root, "moved", "a", maildb.MaildirName, "new")); err != nil {
+		t.Errorf("Edit a@pobox.org: storage not moved, %s", err)
+	}
+	if _, err = os.Stat(filepath.Join(root, "pobox.org", "a")); !os.IsNotExist(err) {
+		t.Errorf("Edit a@pobox.org: old storage still there, %v", err)
+	}
+
+	args = []string{"-d", dbfile, "--vmail-root", root, "delete", "mailbox", "a@pobox.org"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Errorf("Delete a@pobox.org: Unexpected error, %s", err)
+	}
+	dl, err := os.ReadDir(filepath.Join(root, maildb.TrashDir))
+	if err != nil || len(dl) != 1 || !strings.HasPrefix(dl[0].Name(), "a@pobox.org.") {
+		t.Errorf("Delete a@pobox.org: expected it in the trash, got %v, %v", dl, err)
+	}
+	args = []string{"-d", dbfile, "--vmail-root", root, "delete", "trash"}
+	if out, _, err = doTest(rootCmd, "", args); err != nil || out != "" {
+		t.Errorf("Delete trash: expected nothing yet, got %q, %v", out, err)
+	}
+	args = []string{"-d", dbfile, "--vmail-root", root, "delete", "trash", "--trash-days", "0"}
+	if out, _, err = doTest(rootCmd, "", args); err != nil || !strings.HasPrefix(out, "a@pobox.org.") {
+		t.Errorf("Delete trash: expected a@pobox.org, got %q, %v", out, err)
+	}
+	args = []string{"-d", dbfile, "--vmail-root", root, "--vmail-mode", "rwx", "delete", "trash"}
+	if _, _, err = doTest(rootCmd, "", args); err == nil {
+		t.Errorf("Delete trash with a bad mode: expected an error")
+	}
+	args = []string{"-d", dbfile, "--vmail-root", filepath.Join(dir, "none"), "delete", "trash"}
+	if _, _, err = doTest(rootCmd, "", args); err != maildb.ErrMdbStorageRoot {
+		t.Errorf("Delete trash with no root: expected ErrMdbStorageRoot, got %v", err)
+	}
+
+	// The storage is made after the commit so the mailbox is there
+	// even though its storage could not be made
+	if err = ioutil.WriteFile(filepath.Join(root, "blocked"), []byte("not a directory\n"), 0600); err != nil {
+		t.Fatalf("Make blocked: %s", err)
+	}
+	args = []string{"-d", dbfile, "--vmail-root", root, "add", "mailbox", "c@pobox.org", "--mail-home", "blocked/c"}
+	if _, _, err = doTest(rootCmd, "", args); err == nil ||
+		!strings.Contains(err.Error(), "c@pobox.org is changed in the database but not its storage") {
+		t.Errorf("Add c@pobox.org in blocked: expected a storage error, got %v", err)
+	}
+	args = []string{"-d", dbfile, "show", "mailbox", "c@pobox.org"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Errorf("Show c@pobox.org: expected it to be added, got %v", err)
+	}
+
+	// A domain rename takes the homes with it and then the empty
+	// domain directory goes so a new pobox.org does not get it
+	args = []string{"-d", dbfile, "--vmail-root", root, "add", "mailbox", "d@pobox.org",
+		"-u", strconv.Itoa(os.Getuid()), "-g", strconv.Itoa(os.Getgid())}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Errorf("Add d@pobox.org: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "--vmail-root", root, "rename", "domain", "pobox.org", "mailbox.org"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Errorf("Rename pobox.org: Unexpected error, %s", err)
+	}
+	if _, err = os.Stat(filepath.Join(root, "mailbox.org", "d", maildb.MaildirName, "new")); err != nil {
+		t.Errorf("Rename pobox.org: d@mailbox.org not moved, %s", err)
+	}
+	if _, err = os.Stat(filepath.Join(root, "pobox.org")); !os.IsNotExist(err) {
+		t.Errorf("Rename pobox.org: its directory is still there, %v", err)
+	}
+	// but not when something else is in it
+	if err = ioutil.WriteFile(filepath.Join(root, "mailbox.org", "notes"), []byte("keep\n"), 0600); err != nil {
+		t.Fatalf("Make notes: %s", err)
+	}
+	args = []string{"-d", dbfile, "--vmail-root", root, "rename", "domain", "mailbox.org", "pobox.org"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Errorf("Rename mailbox.org: Unexpected error, %s", err)
+	}
+	if _, err = os.Stat(filepath.Join(root, "pobox.org", "d", maildb.MaildirName, "new")); err != nil {
+		t.Errorf("Rename mailbox.org: d@pobox.org not moved, %s", err)
+	}
+	if _, err = os.Stat(filepath.Join(root, "mailbox.org", "notes")); err != nil {
+		t.Errorf("Rename mailbox.org: its notes are gone, %s", err)
+	}
+}
@@ -11,6 +11,26 @@ go test -run=Test_Domain
 go test -run=Test_Address
 go test -run=TestAliasCmds
 go test -run=TestVMailboxCmd
+go test -run=TestMailboxPassword
+go test -run=TestPasswordCmds
+go test -run=TestProtocolCmds
+go test -run=TestCredentialCmds
+go test -run=TestPwPolicyCmds
+go test -run=TestQuotaCmds
+go test -run=TestSieveCmds
+go test -run=TestVacationCmds
+go test -run=TestForwardCmds
+go test -run=TestStorageCmds
+go test -run=TestRenameMailboxCmd
+go test -run=TestRenameCmds
+go test -run=TestAliasDomainCmds
 go test -run=Test_Create
+go test -run=TestCreateSchema
 go test -run=TestCreateNoAliases
 go test -run=TestViews
+go test -run=TestMigrateCmd
+go test -run=TestLogCmd
+go test -run=TestBackupCmd
+go test -run=TestCheckCmd
+go test -run=TestImportInterrupt
+go test -run=TestImportStress
@@ -68,6 +68,15 @@ var deleteTransport = &cobra.Command{
 	RunE:  transportDelete,
 }
 
+// renameTransport do rename of a transport
+var renameTransport = &cobra.Command{
+	Use:   "transport old new",
+	Short: "Rename a transport entry in the database.",
+	Long:  "Rename the transport entry. The domains and addresses that use it keep using it.",
+	Args:  cobra.ExactArgs(2),
+	RunE:  transportRename,
+}
+
 // editTransport edit an transport rule
 var editTransport = &cobra.Command{
 	Use:   "transport name",
@@ -96,6 +105,7 @@ func init() {
 	addTransport.Flags().StringVarP(&transNexthop, "nexthop", "n", "",
 		"Transport nexthop to send email")
 	deleteCmd.AddCommand(deleteTransport)
+	renameCmd.AddCommand(renameTransport)
 	editCmd.AddCommand(editTransport)
 	editTransport.Flags().StringVarP(&transTransport, "transport", "t", "",
 		"Transport protocol/method")
@@ -109,17 +119,18 @@ func init() {
 }
 
 // transportImport
-func transportImport(cmd *cobra.Command, args []string) error {
-	var err error
-
-	mdb.Begin()
-	defer mdb.End(&err)
-	err = procImport(cmd, SIMPLE, procTransport)
+func transportImport(cmd *cobra.Command, args []string) (err error) {
+	tx, err := mdb.BeginContext(cmd.Context())
+	if err != nil {
+		return err
+	}
+	defer tx.End(&err)
+	err = procImport(cmd, tx, SIMPLE, procTransport)
 	return err
 }
 
 // procTransport
-func procTransport(tokens []string) error {
+func procTransport(tx *maildb.Tx, tokens []string) error {
 	var (
 		tr  *maildb.Transport
 		err error
@@ -128,7 +139,7 @@ func procTransport(tokens []string) error {
 	if len(tokens) < 2 {
 		return fmt.Errorf("Transport has a key but no value specified")
 	}
-	if tr, err = mdb.InsertTransport(tokens[0]); err != nil {
+	if tr, err = tx.InsertTransport(tokens[0]); err != nil {
 		return err
 	}
 	kv := strings.SplitN(tokens[1], ":", 2)
@@ -157,7 +168,7 @@ func transportExport(cmd *cobra.Command, args []string) error {
 	default:
 		return fmt.Errorf("Only one transport name can be specified")
 	}
-	tl, err := mdb.FindTransport(name)
+	tl, err := mdb.FindTransportContext(cmd.Context(), name)
 	if err == nil {
 		for _, tr := range tl {
 			cmd.Printf("%s\n", tr.Export())
@@ -167,16 +178,16 @@ func transportExport(cmd *cobra.Command, args []string) error {
 }
 
 // transportAdd
-func transportAdd(cmd *cobra.Command, args []string) error {
-	var (
-		err error
-		tr  *maildb.Transport
-	)
+func transportAdd(cmd *cobra.Command, args []string) (err error) {
+	var tr *maildb.Transport
 
-	mdb.Begin()
-	defer mdb.End(&err)
+	tx, err := mdb.BeginContext(cmd.Context())
+	if err != nil {
+		return err
+	}
+	defer tx.End(&err)
 
-	tr, err = mdb.InsertTransport(args[0])
+	tr, err = tx.InsertTransport(args[0])
 	if err == nil && cmd.Flags().Changed("transport") {
 		err = tr.SetTransport(transTransport)
 	}
@@ -188,20 +199,30 @@ func transportAdd(cmd *cobra.Command, args []string) error {
 
 // transportDelete
 func transportDelete(cmd *cobra.Command, args []string) error {
-	return mdb.DeleteTransport(args[0])
+	return mdb.WithTxContext(cmd.Context(), func(tx *maildb.Tx) error {
+		return tx.DeleteTransport(args[0])
+	})
+}
+
+// transportRename
+func transportRename(cmd *cobra.Command, args []string) error {
+	return mdb.WithTxContext(cmd.Context(), func(tx *maildb.Tx) error {
+		_, err := tx.RenameTransport(args[0], args[1])
+		return err
+	})
 }
 
 // transportEdit
-func transportEdit(cmd *cobra.Command, args []string) error {
-	var (
-		err error
-		tr  *maildb.Transport
-	)
+func transportEdit(cmd *cobra.Command, args []string) (err error) {
+	var tr *maildb.Transport
 
-	mdb.Begin()
-	defer mdb.End(&err)
+	tx, err := mdb.BeginContext(cmd.Context())
+	if err != nil {
+		return err
+	}
+	defer tx.End(&err)
 
-	tr, err = mdb.GetTransport(args[0])
+	tr, err = tx.GetTransport(args[0])
 	if err == nil {
 		if cmd.Flags().Changed("no-transport") {
 			err = tr.ClearTransport()
@@ -227,7 +248,7 @@ func transportShow(cmd *cobra.Command, args []string) error {
 		tr  *maildb.Transport
 	)
 
-	if tr, err = mdb.LookupTransport(args[0]); err != nil {
+	if tr, err = mdb.LookupTransportContext(cmd.Context(), args[0]); err != nil {
 		return err
 	}
 	cmd.Printf("Name:\t\t%s\nTransport:\t%s\nNexthop:\t%s\n",
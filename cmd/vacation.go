@@ -0,0 +1,284 @@
+/*
+Copyright © 2021 Jim Lieb <lieb@sea-troll.net>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lieb/postdove/maildb"
+	"github.com/spf13/cobra"
+)
+
+var (
+	vacSubject   string
+	vacBody      string
+	vacBodyFile  string
+	vacStart     string
+	vacEnd       string
+	vacDays      int64
+	vacAddresses []string
+)
+
+// vacationFlags
+// Any of these changes the vacation. Without them it is shown.
+var vacationFlags = []string{"subject", "body", "body-file", "start", "end", "days", "addresses"}
+
+// vacationCmd set up the out of office reply of a mailbox
+var vacationCmd = &cobra.Command{
+	Use:   "vacation address [ flags ]",
+	Short: "Set up the out of office reply of a mailbox",
+	Long: `Set up the out of office reply of the mailbox of the address. Postdove makes
+a Sieve script named "vacation" from it and makes that the active script. The
+script that was active is run after it and is made active again when the
+vacation is deleted. Replies are only sent from the start date to the end
+date, inclusive, in the server's time zone. Dates are YYYY-MM-DD or "none"
+for no limit. With no flags the vacation is shown.`,
+	Args: cobra.ExactArgs(1),
+	RunE: vacationSet,
+}
+
+// deleteVacation do delete of a mailbox's vacation
+var deleteVacation = &cobra.Command{
+	Use:   "vacation address",
+	Short: "Delete the out of office reply of a mailbox",
+	Long: `Delete the vacation of the mailbox of the address and its Sieve script. The
+script that was active before it is made active again.`,
+	Args: cobra.ExactArgs(1),
+	RunE: vacationDelete,
+}
+
+// showVacation display the vacation of a mailbox
+var showVacation = &cobra.Command{
+	Use:   "vacation address",
+	Short: "Display the out of office reply of a mailbox",
+	Long:  `Display the vacation settings of the mailbox of the address followed by its message.`,
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return vacationShow(cmd, args[0])
+	},
+}
+
+// reportVacation list the vacations of mailboxes
+var reportVacation = &cobra.Command{
+	Use:   "vacation [ address ]",
+	Short: "Report the vacations of mailboxes",
+	Long: `Report the vacations of mailboxes and whether each one is active, scheduled,
+expired or inactive, the last meaning its script is not the active one.
+The address can be wildcarded, such as "*@example.com". The default is all
+mailboxes.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: vacationReport,
+}
+
+// linkage to top level commands
+func init() {
+	rootCmd.AddCommand(vacationCmd)
+	vacationCmd.Flags().StringVarP(&vacSubject, "subject", "s", "",
+		"Subject of the reply, made from the message's if empty")
+	vacationCmd.Flags().StringVar(&vacBody, "body", "",
+		"The reply message")
+	vacationCmd.Flags().StringVarP(&vacBodyFile, "body-file", "f", "",
+		"Read the reply message from this file, \"-\" for stdin")
+	vacationCmd.Flags().StringVar(&vacStart, "start", "",
+		"First day to reply, YYYY-MM-DD or none")
+	vacationCmd.Flags().StringVar(&vacEnd, "end", "",
+		"Last day to reply, YYYY-MM-DD or none")
+	vacationCmd.Flags().Int64Var(&vacDays, "days", 7,
+		"Days before the same sender is replied to again")
+	vacationCmd.Flags().StringSliceVarP(&vacAddresses, "addresses", "a", nil,
+		"Other addresses of the mailbox to reply for, comma separated")
+	deleteCmd.AddCommand(deleteVacation)
+	showCmd.AddCommand(showVacation)
+	reportCmd.AddCommand(reportVacation)
+}
+
+// vacationDate
+// A date flag in local time, the zero time for "none"
+func vacationDate(flag string, d string) (time.Time, error) {
+	if d == "" || strings.EqualFold(d, "none") {
+		return time.Time{}, nil
+	}
+	t, err := time.ParseInLocation(maildb.VacationDateFormat, d, time.Local)
+	if err != nil {
+		return t, fmt.Errorf("--%s must be YYYY-MM-DD or none", flag)
+	}
+	return t, nil
+}
+
+// vacationSet
+// Make or change the vacation and its script unless there are no flags
+func vacationSet(cmd *cobra.Command, args []string) (err error) {
+	var (
+		v          *maildb.Vacation
+		start, end time.Time
+		body       string
+	)
+
+	f := cmd.Flags()
+	changed := false
+	for _, fl := range vacationFlags {
+		changed = changed || f.Changed(fl)
+	}
+	if !changed {
+		return vacationShow(cmd, args[0])
+	}
+	if f.Changed("body") && f.Changed("body-file") {
+		return fmt.Errorf("Only one of --body and --body-file can be used")
+	}
+	if start, err = vacationDate("start", vacStart); err != nil {
+		return err
+	}
+	if end, err = vacationDate("end", vacEnd); err != nil {
+		return err
+	}
+	body = vacBody
+	if f.Changed("body-file") {
+		if vacBodyFile == "-" {
+			b, err := ioutil.ReadAll(cmd.InOrStdin())
+			if err != nil {
+				return err
+			}
+			body = string(b)
+		} else {
+			b, err := ioutil.ReadFile(vacBodyFile)
+			if err != nil {
+				return err
+			}
+			body = string(b)
+		}
+	}
+	cmd.SilenceUsage = true // not a usage problem from here
+	tx, err := mdb.BeginContext(cmd.Context())
+	if err != nil {
+		return err
+	}
+	defer tx.End(&err)
+
+	if v, err = tx.GetVacation(args[0]); err == maildb.ErrMdbVacationNotFound {
+		v, err = tx.InsertVacation(args[0])
+	}
+	if err != nil {
+		return err
+	}
+	if f.Changed("subject") {
+		if err = v.SetSubject(vacSubject); err != nil {
+			return err
+		}
+	}
+	if f.Changed("body") || f.Changed("body-file") {
+		if err = v.SetBody(body); err != nil {
+			return err
+		}
+	}
+	if f.Changed("start") || f.Changed("end") {
+		if !f.Changed("start") {
+			start = v.Start()
+		}
+		if !f.Changed("end") {
+			end = v.End()
+		}
+		if err = v.SetDates(start, end); err != nil {
+			return err
+		}
+	}
+	if f.Changed("days") {
+		if err = v.SetDays(vacDays); err != nil {
+			return err
+		}
+	}
+	if f.Changed("addresses") {
+		if err = v.SetAddresses(vacAddresses); err != nil {
+			return err
+		}
+	}
+	return v.Apply()
+}
+
+// vacationDelete
+func vacationDelete(cmd *cobra.Command, args []string) error {
+	return mdb.WithTxContext(cmd.Context(), func(tx *maildb.Tx) error {
+		return tx.DeleteVacation(args[0])
+	})
+}
+
+// vacationDay
+// A vacation date or "none"
+func vacationDay(t time.Time) string {
+	if t.IsZero() {
+		return "none"
+	}
+	return t.Format(maildb.VacationDateFormat)
+}
+
+// vacationShow
+// The settings and then the message
+func vacationShow(cmd *cobra.Command, user string) error {
+	v, err := mdb.LookupVacationContext(cmd.Context(), user)
+	if err != nil {
+		return err
+	}
+	addresses := "none"
+	if al := v.Addresses(); len(al) > 0 {
+		addresses = strings.Join(al, ", ")
+	}
+	cmd.Printf("Name:\t\t%s\nStatus:\t\t%s\nSubject:\t%s\nStart:\t\t%s\nEnd:\t\t%s\n",
+		v.User(), v.Status(time.Now()), v.Subject(), vacationDay(v.Start()), vacationDay(v.End()))
+	cmd.Printf("Days:\t\t%d\nAddresses:\t%s\nModified:\t%s\n",
+		v.Days(), addresses, credentialTime(v.Modified()))
+	cmd.Printf("\n%s", v.Body())
+	if !strings.HasSuffix(v.Body(), "\n") {
+		cmd.Printf("\n")
+	}
+	return nil
+}
+
+// vacationReport
+// Each vacation by user and then how many are in each state
+func vacationReport(cmd *cobra.Command, args []string) error {
+	vMailbox := "*@*"
+	if len(args) > 0 {
+		vMailbox = args[0]
+	}
+	vl, err := mdb.FindVacationsContext(cmd.Context(), vMailbox)
+	if err != nil {
+		return err
+	}
+	sort.Slice(vl, func(i, j int) bool {
+		return vl[i].User() < vl[j].User()
+	})
+	now := time.Now()
+	count := make(map[string]int)
+	for _, v := range vl {
+		st := v.Status(now)
+		count[st]++
+		start, end := "--", "--"
+		if !v.Start().IsZero() {
+			start = vacationDay(v.Start())
+		}
+		if !v.End().IsZero() {
+			end = vacationDay(v.End())
+		}
+		cmd.Printf("%s\t%s\t%s to %s\t%s\n", v.User(), st, start, end, v.Subject())
+	}
+	cmd.Printf("Total\t%d active, %d scheduled, %d expired, %d inactive\n",
+		count["active"], count["scheduled"], count["expired"], count["inactive"])
+	return nil
+}
@@ -0,0 +1,153 @@
+/*
+Copyright © 2021 Jim Lieb <lieb@sea-troll.net>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/lieb/postdove/maildb"
+)
+
+// TestVacationCmds
+func TestVacationCmds(t *testing.T) {
+	var (
+		err    error
+		dir    string
+		dbfile string
+		args   []string
+		out    string
+	)
+
+	fmt.Println("TestVacationCmds")
+
+	dir, err = ioutil.TempDir("", "TestVacationCmds-*")
+	defer os.RemoveAll(dir)
+	dbfile = filepath.Join(dir, "test.db")
+
+	args = []string{"create", "-d", dbfile, "--no-locals", "--no-aliases"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Fatalf("Create DB: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "import", "domain"}
+	if _, _, err = doTest(rootCmd, "pobox.org class=vmailbox\n", args); err != nil {
+		t.Fatalf("Import domains: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "import", "mailbox"}
+	if _, _, err = doTest(rootCmd, "a@pobox.org:{PLAIN}pw::::::\nb@pobox.org:{PLAIN}pw::::::\n", args); err != nil {
+		t.Fatalf("Import mailboxes: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "add", "sieve", "a@pobox.org", "spam", "--activate"}
+	if _, _, err = doTest(rootCmd, "require \"fileinto\";\nfileinto \"Junk\";\n", args); err != nil {
+		t.Fatalf("Add spam: Unexpected error, %s", err)
+	}
+
+	// Nothing yet, and no flags is a show
+	args = []string{"-d", dbfile, "vacation", "a@pobox.org"}
+	if _, _, err = doTest(rootCmd, "", args); err != maildb.ErrMdbVacationNotFound {
+		t.Errorf("Vacation a@pobox.org: expected ErrMdbVacationNotFound, got %v", err)
+	}
+	args = []string{"-d", dbfile, "report", "vacation"}
+	if _, _, err = doTest(rootCmd, "", args); err != maildb.ErrMdbVacationNotFound {
+		t.Errorf("Report vacation: expected ErrMdbVacationNotFound, got %v", err)
+	}
+
+	body := "I am away.\n.Really.\n"
+	args = []string{"-d", dbfile, "vacation", "a@pobox.org", "-s", "Out of office", "-f", "-",
+		"--start", "2026-01-01", "--end", "2099-12-31", "-a", "a2@pobox.org,alpha@pobox.org"}
+	if _, _, err = doTest(rootCmd, body, args); err != nil {
+		t.Errorf("Vacation a@pobox.org: Unexpected error, %s", err)
+	}
+	modified := regexp.MustCompile(`Modified:\t[-0-9]+ [:0-9]+\n`)
+	expectedOut := `Name:		a@pobox.org
+Status:		active
+Subject:	Out of office
+Start:		2026-01-01
+End:		2099-12-31
+Days:		7
+Addresses:	a2@pobox.org, alpha@pobox.org
+Modified:	TIME
+
+` + body
+	args = []string{"-d", dbfile, "show", "vacation", "a@pobox.org"}
+	out, _, err = doTest(rootCmd, "", args)
+	if o := modified.ReplaceAllString(out, "Modified:\tTIME\n"); err != nil || o != expectedOut {
+		t.Errorf("Show vacation: expected %q, got %q, %v", expectedOut, out, err)
+	}
+
+	// Mistakes don't make one
+	args = []string{"-d", dbfile, "vacation", "b@pobox.org", "--start", "2026-13-01"}
+	if _, _, err = doTest(rootCmd, body, args); err == nil {
+		t.Errorf("Vacation bad start: expected an error")
+	}
+	args = []string{"-d", dbfile, "vacation", "b@pobox.org", "--start", "2026-02-01", "-f", "-", "--body", "Away"}
+	if _, _, err = doTest(rootCmd, body, args); err == nil {
+		t.Errorf("Vacation body and body-file: expected an error")
+	}
+	args = []string{"-d", dbfile, "show", "vacation", "b@pobox.org"}
+	if _, _, err = doTest(rootCmd, "", args); err != maildb.ErrMdbVacationNotFound {
+		t.Errorf("Show b@pobox.org: expected ErrMdbVacationNotFound, got %v", err)
+	}
+
+	// Only what is given changes
+	args = []string{"-d", dbfile, "vacation", "a@pobox.org", "--days", "3", "--end", "none"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Errorf("Vacation a@pobox.org change: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "show", "sieve", "a@pobox.org", maildb.VacationScript}
+	out, _, err = doTest(rootCmd, "", args)
+	if err != nil || !strings.Contains(out, "\nActive:\t\tyes\n") ||
+		!strings.Contains(out, "\nVersion:\t2\n") ||
+		!strings.Contains(out, "vacation :days 3 :subject \"Out of office\"") ||
+		!strings.Contains(out, "\n..Really.\n") ||
+		strings.Contains(out, "\"2099-12-31\"") ||
+		!strings.Contains(out, "include :personal :optional \"spam\";") {
+		t.Errorf("Show vacation script: got %q, %v", out, err)
+	}
+	args = []string{"-d", dbfile, "report", "vacation"}
+	out, _, err = doTest(rootCmd, "", args)
+	expectedOut = "a@pobox.org\tactive\t2026-01-01 to --\tOut of office\n" +
+		"Total\t1 active, 0 scheduled, 0 expired, 0 inactive\n"
+	if err != nil || out != expectedOut {
+		t.Errorf("Report vacation: expected %q, got %q, %v", expectedOut, out, err)
+	}
+
+	// Delete puts spam back
+	args = []string{"-d", dbfile, "delete", "vacation", "a@pobox.org"}
+	if _, _, err = doTest(rootCmd, "", args); err != nil {
+		t.Errorf("Delete vacation: Unexpected error, %s", err)
+	}
+	args = []string{"-d", dbfile, "delete", "vacation", "a@pobox.org"}
+	if _, _, err = doTest(rootCmd, "", args); err != maildb.ErrMdbVacationNotFound {
+		t.Errorf("Delete vacation again: expected ErrMdbVacationNotFound, got %v", err)
+	}
+	args = []string{"-d", dbfile, "show", "sieve", "a@pobox.org", "spam"}
+	out, _, err = doTest(rootCmd, "", args)
+	if err != nil || !strings.Contains(out, "\nActive:\t\tyes\n") {
+		t.Errorf("Show spam: expected active, got %q, %v", out, err)
+	}
+	args = []string{"-d", dbfile, "log", "--entity", "vacation"}
+	out, _, err = doTest(rootCmd, "", args)
+	if err != nil || strings.Count(out, " vacation a@pobox.org\n") != 8 {
+		t.Errorf("Log vacation: expected 8 changes, got %q, %v", out, err)
+	}
+}
@@ -602,6 +602,37 @@ SELECT recipient FROM virt_alias WHERE mailbox IS 'bogus' AND domain_name IS 'ex
 		t.Errorf("Lookup virtual alias bogus@example.com: %s", err)
 	}
 
+	// postfix looks up the whole address, then the catch-all of its domain
+	q = `
+SELECT recipient FROM virt_alias WHERE address IS 'roadrunner@wb'
+`
+	expectedRes = []maildb.QueryRes{
+		{
+			"recipient": "coyote@wb",
+		},
+	}
+	if err = queryView(mdb, q, expectedRes); err != nil {
+		t.Errorf("Lookup virtual alias address roadrunner@wb: %s", err)
+	}
+	q = `
+SELECT recipient FROM virt_alias WHERE address IS 'nobody@disney'
+`
+	expectedRes = []maildb.QueryRes{}
+	if err = queryView(mdb, q, expectedRes); err != nil {
+		t.Errorf("Lookup virtual alias address nobody@disney: %s", err)
+	}
+	q = `
+SELECT recipient FROM virt_alias WHERE address IS '@disney'
+`
+	expectedRes = []maildb.QueryRes{
+		{
+			"recipient": "walt@disney",
+		},
+	}
+	if err = queryView(mdb, q, expectedRes); err != nil {
+		t.Errorf("Lookup virtual alias catch-all @disney: %s", err)
+	}
+
 	// Dovecot related view testing
 
 	// Lookup all users
@@ -701,6 +732,53 @@ WHERE username = 'dave' AND domain = 'pobox.org'
 		t.Errorf("Deny deny: %s", err)
 	}
 
+	// per service deny. jeff can't use pop3 or sieve and dave is disabled
+	for _, sd := range []struct {
+		user    string
+		service string
+		deny    bool
+	}{
+		{"jeff", "imap", false},
+		{"jeff", "pop3", true},
+		{"jeff", "lmtp", false},
+		{"jeff", "submission", false},
+		{"jeff", "smtp", false},
+		{"jeff", "sieve", true},
+		{"dave", "imap", true},
+		{"dave", "lmtp", true},
+		{"dave", "smtp", true},
+	} {
+		fmt.Printf("Service deny %s %s\n", sd.user, sd.service)
+		q = fmt.Sprintf(`
+SELECT deny FROM service_deny
+WHERE username = '%s' AND domain = 'pobox.org' AND service = '%s'
+`, sd.user, sd.service)
+		expectedRes = []maildb.QueryRes{}
+		if sd.deny {
+			expectedRes = []maildb.QueryRes{
+				{
+					"deny": "true",
+				},
+			}
+		}
+		if err = queryView(mdb, q, expectedRes); err != nil {
+			t.Errorf("Service deny %s %s: %s", sd.user, sd.service, err)
+		}
+	}
+	fmt.Printf("POP3 deny jeff\n")
+	q = `
+SELECT deny FROM pop3_deny
+WHERE username = 'jeff' AND domain = 'pobox.org'
+`
+	expectedRes = []maildb.QueryRes{
+		{
+			"deny": "true",
+		},
+	}
+	if err = queryView(mdb, q, expectedRes); err != nil {
+		t.Errorf("POP3 deny jeff: %s", err)
+	}
+
 	// add an address into a relay domain
 
 	// look up relay addresses
@@ -108,18 +108,19 @@ func init() {
 }
 
 // virtualImport the virtuales in /etc/virtuales format from inFile
-func virtualImport(cmd *cobra.Command, args []string) error {
-	var err error
-
-	mdb.Begin()
-	defer mdb.End(&err)
+func virtualImport(cmd *cobra.Command, args []string) (err error) {
+	tx, err := mdb.BeginContext(cmd.Context())
+	if err != nil {
+		return err
+	}
+	defer tx.End(&err)
 
-	err = procImport(cmd, POSTFIX, procVirtual) // once past syntax, they are same
+	err = procImport(cmd, tx, POSTFIX, procVirtual) // once past syntax, they are same
 	return err
 }
 
 // procVirtual
-func procVirtual(tokens []string) error {
+func procVirtual(tx *maildb.Tx, tokens []string) error {
 	var (
 		err error
 		a   *maildb.Address
@@ -130,7 +131,7 @@ func procVirtual(tokens []string) error {
 	} else if ap.IsLocal() {
 		return fmt.Errorf("A virtual alias must be 'mailbox@domain'")
 	}
-	if a, err = mdb.GetOrInsAddress(tokens[0]); err == nil {
+	if a, err = tx.GetOrInsAddress(tokens[0]); err == nil {
 		for _, r := range tokens[1:] {
 			if err = a.AttachAlias(r); err != nil {
 				break
@@ -158,7 +159,7 @@ func virtualExport(cmd *cobra.Command, args []string) error {
 		}
 		virtual = args[0]
 	}
-	if alist, err = mdb.LookupAlias(virtual); err == nil {
+	if alist, err = mdb.LookupAliasContext(cmd.Context(), virtual); err == nil {
 		for _, al := range alist {
 			cmd.Printf("%s\n", al.Export())
 		}
@@ -167,13 +168,14 @@ func virtualExport(cmd *cobra.Command, args []string) error {
 }
 
 // virtualAdd the virtual and its recipients
-func virtualAdd(cmd *cobra.Command, args []string) error {
-	var err error
-
-	mdb.Begin()
-	defer mdb.End(&err)
+func virtualAdd(cmd *cobra.Command, args []string) (err error) {
+	tx, err := mdb.BeginContext(cmd.Context())
+	if err != nil {
+		return err
+	}
+	defer tx.End(&err)
 
-	return procVirtual(args)
+	return procVirtual(tx, args)
 }
 
 // virtualDelete the address in the first arg
@@ -182,36 +184,38 @@ func virtualDelete(cmd *cobra.Command, args []string) error {
 	} else if ap.IsLocal() {
 		return fmt.Errorf("A virtual alias must be 'mailbox@domain'")
 	}
-	return mdb.RemoveAlias(args[0])
+	return mdb.WithTxContext(cmd.Context(), func(tx *maildb.Tx) error {
+		return tx.RemoveAlias(args[0])
+	})
 }
 
 // virtualEdit the address in the first arg
-func virtualEdit(cmd *cobra.Command, args []string) error {
-	var (
-		err error
-		a   *maildb.Address
-	)
+func virtualEdit(cmd *cobra.Command, args []string) (err error) {
+	var a *maildb.Address
 
 	if ap, err := maildb.DecodeRFC822(args[0]); err != nil {
 	} else if ap.IsLocal() {
 		return fmt.Errorf("A virtual alias must be 'mailbox@domain'")
 	}
-	// add new ones first so remove doesn't remove an unattached alias...
-	if err == nil && cmd.Flags().Changed("add") {
-		mdb.Begin()
+	tx, err := mdb.BeginContext(cmd.Context())
+	if err != nil {
+		return err
+	}
+	defer tx.End(&err)
 
-		if a, err = mdb.GetAddress(args[0]); err == nil {
+	// add new ones first so remove doesn't remove an unattached alias...
+	if cmd.Flags().Changed("add") {
+		if a, err = tx.GetAddress(args[0]); err == nil {
 			for _, r := range vAddRecipient {
 				if err = a.AttachAlias(r); err != nil {
 					break
 				}
 			}
 		}
-		mdb.End(&err)
 	}
 	if err == nil && cmd.Flags().Changed("remove") {
 		for _, r := range vDelRecipient {
-			if err = mdb.RemoveRecipient(args[0], r); err != nil {
+			if err = tx.RemoveRecipient(args[0], r); err != nil {
 				break
 			}
 		}
@@ -231,8 +235,8 @@ func virtualShow(cmd *cobra.Command, args []string) error {
 	} else if ap.IsLocal() {
 		return fmt.Errorf("A virtual alias must be 'mailbox@domain'")
 	}
-	if a, err = mdb.LookupAddress(args[0]); err == nil {
-		if al, err = a.Alias(); err == nil {
+	if a, err = mdb.LookupAddressContext(cmd.Context(), args[0]); err == nil {
+		if al, err = a.AliasContext(cmd.Context()); err == nil {
 			cmd.Printf("Virtual Alias:\t%s\nTargets:", args[0])
 			for i, t := range al.Targets() {
 				if i == 0 {
@@ -21,6 +21,7 @@ package maildb
  */
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"strings"
@@ -31,6 +32,7 @@ import (
 // Access
 type Access struct {
 	mdb    *MailDB
+	tx     *Tx // nil unless from a transaction
 	id     int64
 	name   string
 	action string
@@ -38,9 +40,9 @@ type Access struct {
 
 // getAccessById
 // make an Access without transaction
-func (mdb *MailDB) getAccessById(id int64) (*Access, error) {
+func (mdb *MailDB) getAccessById(ctx context.Context, id int64) (*Access, error) {
 	ac := &Access{mdb: mdb, id: id}
-	row := mdb.db.QueryRow("SELECT name, action FROM access WHERE id = ?", id)
+	row := mdb.db.QueryRowContext(ctx, "SELECT name, action FROM access WHERE id = ?", id)
 	switch err := row.Scan(&ac.name, &ac.action); err {
 	case sql.ErrNoRows:
 		return nil, ErrMdbAccessNotFound
@@ -51,11 +53,11 @@ func (mdb *MailDB) getAccessById(id int64) (*Access, error) {
 	}
 }
 
-// getAccessByIdTx
+// getAccessById
 // make an Access within a transaction
-func (mdb *MailDB) getAccessByIdTx(id int64) (*Access, error) {
-	ac := &Access{mdb: mdb, id: id}
-	row := mdb.tx.QueryRow("SELECT name, action FROM access WHERE id = ?", id)
+func (tx *Tx) getAccessById(id int64) (*Access, error) {
+	ac := &Access{mdb: tx.mdb, tx: tx, id: id}
+	row := tx.queryRow("SELECT name, action FROM access WHERE id = ?", id)
 	switch err := row.Scan(&ac.name, &ac.action); err {
 	case sql.ErrNoRows:
 		return nil, ErrMdbAccessNotFound
@@ -69,6 +71,12 @@ func (mdb *MailDB) getAccessByIdTx(id int64) (*Access, error) {
 // LookupAccess
 // outside transactions
 func (mdb *MailDB) LookupAccess(name string) (*Access, error) {
+	return mdb.LookupAccessContext(context.Background(), name)
+}
+
+// LookupAccessContext
+// LookupAccess that gives up when ctx is done
+func (mdb *MailDB) LookupAccessContext(ctx context.Context, name string) (*Access, error) {
 	if name == "" {
 		return nil, ErrMdbBadName
 	}
@@ -76,7 +84,7 @@ func (mdb *MailDB) LookupAccess(name string) (*Access, error) {
 		name: name,
 		mdb:  mdb,
 	}
-	row := mdb.db.QueryRow("SELECT id, action FROM access WHERE name = ?", name)
+	row := mdb.db.QueryRowContext(ctx, "SELECT id, action FROM access WHERE name = ?", name)
 	switch err := row.Scan(&a.id, &a.action); err {
 	case sql.ErrNoRows:
 		return nil, ErrMdbAccessNotFound
@@ -91,6 +99,12 @@ func (mdb *MailDB) LookupAccess(name string) (*Access, error) {
 // '*' find all access rules
 // 'something*something' find matching names
 func (mdb *MailDB) FindAccess(name string) ([]*Access, error) {
+	return mdb.FindAccessContext(context.Background(), name)
+}
+
+// FindAccessContext
+// FindAccess that gives up when ctx is done
+func (mdb *MailDB) FindAccessContext(ctx context.Context, name string) ([]*Access, error) {
 	var (
 		err  error
 		rows *sql.Rows
@@ -100,11 +114,11 @@ func (mdb *MailDB) FindAccess(name string) ([]*Access, error) {
 	)
 	if name == "*" {
 		q = `SELECT id, name, action FROM access ORDER BY name`
-		rows, err = mdb.db.Query(q)
+		rows, err = mdb.db.QueryContext(ctx, q)
 	} else {
 		name = strings.ReplaceAll(name, "*", "%")
 		q = `SELECT id, name, action FROM access WHERE name LIKE ? ORDER BY name`
-		rows, err = mdb.db.Query(q, name)
+		rows, err = mdb.db.QueryContext(ctx, q, name)
 	}
 	if err != nil {
 		return nil, err
@@ -136,18 +150,19 @@ func (mdb *MailDB) FindAccess(name string) ([]*Access, error) {
 
 // GetAccess
 // inside transactions
-func (mdb *MailDB) GetAccess(name string) (*Access, error) {
+func (tx *Tx) GetAccess(name string) (*Access, error) {
 	if name == "" {
 		return nil, ErrMdbBadName
 	}
 	a := &Access{
 		name: name,
-		mdb:  mdb,
+		mdb:  tx.mdb,
+		tx:   tx,
 	}
-	if mdb.tx == nil {
+	if !tx.active() {
 		return nil, ErrMdbTransaction
 	}
-	row := mdb.tx.QueryRow("SELECT id, action FROM access WHERE name = ?", name)
+	row := tx.queryRow("SELECT id, action FROM access WHERE name = ?", name)
 	switch err := row.Scan(&a.id, &a.action); err {
 	case sql.ErrNoRows:
 		return nil, ErrMdbAccessNotFound
@@ -159,7 +174,7 @@ func (mdb *MailDB) GetAccess(name string) (*Access, error) {
 }
 
 // InsertAccess
-func (mdb *MailDB) InsertAccess(name string, action string) (*Access, error) {
+func (tx *Tx) InsertAccess(name string, action string) (*Access, error) {
 	var (
 		res sql.Result
 		err error
@@ -170,10 +185,10 @@ func (mdb *MailDB) InsertAccess(name string, action string) (*Access, error) {
 	if action == "" {
 		return nil, ErrMdbAccessBadAction
 	}
-	if mdb.tx == nil {
+	if !tx.active() {
 		return nil, ErrMdbTransaction
 	}
-	res, err = mdb.tx.Exec("INSERT INTO access (name, action) VALUES (?, ?)", name, action)
+	res, err = tx.insert("INSERT INTO access (name, action) VALUES (?, ?)", name, action)
 	if err != nil {
 		if IsErrConstraintUnique(err) {
 			err = ErrMdbDupAccess
@@ -181,7 +196,8 @@ func (mdb *MailDB) InsertAccess(name string, action string) (*Access, error) {
 	} else {
 		if aID, err := res.LastInsertId(); err == nil {
 			a := &Access{
-				mdb:    mdb,
+				mdb:    tx.mdb,
+				tx:     tx,
 				id:     aID,
 				name:   name,
 				action: action,
@@ -192,6 +208,27 @@ func (mdb *MailDB) InsertAccess(name string, action string) (*Access, error) {
 	return nil, err
 }
 
+// RenameAccess
+// Change the name in place so the domains and addresses that use
+// the rule keep it.
+func (tx *Tx) RenameAccess(old string, new string) (*Access, error) {
+	if new == "" {
+		return nil, ErrMdbBadName
+	}
+	a, err := tx.GetAccess(old)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = tx.exec("UPDATE access SET name = ? WHERE id = ?", new, a.id); err != nil {
+		if IsErrConstraintUnique(err) {
+			err = ErrMdbDupAccess
+		}
+		return nil, err
+	}
+	a.name = new
+	return a, nil
+}
+
 // Name
 func (a *Access) Name() string {
 	return a.name
@@ -218,10 +255,10 @@ func (a *Access) SetAction(action string) error {
 	if action == "" {
 		return ErrMdbAccessBadAction
 	} else {
-		if a.mdb.tx == nil {
+		if !a.tx.active() {
 			return ErrMdbTransaction
 		}
-		res, err := a.mdb.tx.Exec("UPDATE access SET action = ? WHERE id = ?",
+		res, err := a.tx.exec("UPDATE access SET action = ? WHERE id = ?",
 			action, a.id)
 		if err == nil {
 			c, err := res.RowsAffected()
@@ -238,8 +275,8 @@ func (a *Access) SetAction(action string) error {
 }
 
 // DeleteAccess
-func (mdb *MailDB) DeleteAccess(name string) error {
-	res, err := mdb.db.Exec("DELETE FROM access WHERE name = ?", name)
+func (tx *Tx) DeleteAccess(name string) error {
+	res, err := tx.exec("DELETE FROM access WHERE name = ?", name)
 	if err != nil {
 		if IsErrConstraintForeignKey(err) {
 			err = ErrMdbAccessBusy
@@ -34,6 +34,7 @@ import (
 // TestAccess
 func TestAccess(t *testing.T) {
 	var (
+		tx  *Tx
 		err error
 		mdb *MailDB
 		dir string
@@ -60,7 +61,7 @@ func TestAccess(t *testing.T) {
 	}
 
 	// Try to insert an action without a transaction
-	a, err = mdb.InsertAccess("permit", "permissive")
+	a, err = tx.InsertAccess("permit", "permissive")
 	if err == nil {
 		t.Errorf("Insert with no transaction did not fail")
 		return
@@ -70,9 +71,9 @@ func TestAccess(t *testing.T) {
 	}
 
 	// Insert an access rule
-	mdb.Begin()
-	a, err = mdb.InsertAccess("permit", "permissive")
-	mdb.End(&err)
+	tx = beginTx(t, mdb)
+	a, err = tx.InsertAccess("permit", "permissive")
+	tx.End(&err)
 	if err != nil {
 		t.Errorf("Insert permit: %s", err)
 		return
@@ -103,7 +104,7 @@ func TestAccess(t *testing.T) {
 	}
 
 	// get it without a transaction
-	a, err = mdb.GetAccess("permit")
+	a, err = tx.GetAccess("permit")
 	if err == nil {
 		t.Errorf("Get of permit with no transaction did not fail")
 	} else if err != ErrMdbTransaction {
@@ -111,11 +112,11 @@ func TestAccess(t *testing.T) {
 	}
 
 	// get it
-	mdb.Begin()
-	a, err = mdb.GetAccess("permit")
+	tx = beginTx(t, mdb)
+	a, err = tx.GetAccess("permit")
 	if err != nil {
 		t.Errorf("Get permit: %s", err)
-		mdb.End(&err)
+		tx.End(&err)
 		return
 	}
 	// set the action
@@ -123,7 +124,7 @@ func TestAccess(t *testing.T) {
 	if err != nil {
 		t.Errorf("Set freedum: %s", err)
 	}
-	mdb.End(&err)
+	tx.End(&err)
 	// try to set it again after closing transaction
 	err = a.SetAction("lost_cause")
 	if err == nil {
@@ -140,20 +141,20 @@ func TestAccess(t *testing.T) {
 	}
 
 	// load some more rules and then find them
-	mdb.Begin()
-	a, err = mdb.InsertAccess("reject", "OverTheSide")
+	tx = beginTx(t, mdb)
+	a, err = tx.InsertAccess("reject", "OverTheSide")
 	if err != nil {
-		mdb.End(&err)
+		tx.End(&err)
 		t.Errorf("Insert reject: %s", err)
 		return
 	}
-	a, err = mdb.InsertAccess("defer", "DeadLetter")
+	a, err = tx.InsertAccess("defer", "DeadLetter")
 	if err != nil {
-		mdb.End(&err)
+		tx.End(&err)
 		t.Errorf("Insert defer: %s", err)
 		return
 	}
-	mdb.End(&err)
+	tx.End(&err)
 	if al, err = mdb.FindAccess("reject"); err != nil {
 		t.Errorf("FindAccess reject, unexpected error, %s", err)
 	} else if len(al) != 1 {
@@ -21,6 +21,7 @@ package maildb
  */
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"strings"
@@ -30,6 +31,7 @@ import (
 
 type Address struct {
 	mdb       *MailDB
+	tx        *Tx // nil unless from a transaction
 	id        int64
 	d         *Domain
 	localpart string
@@ -117,14 +119,21 @@ SELECT id, localpart, transport, access FROM address
 // query for full localpart@domain addresses
 var qaRFC822 string = `
 SELECT a.id, a.localpart, a.transport, a.access,
-       d.id, d.name, d.class, d.transport, d.access, d.vuid, d.vgid
+       d.id, d.name, d.class, d.transport, d.access, d.vuid, d.vgid,
+       d.pw_max_age, d.pw_min_length, d.pw_min_classes, d.quota
  FROM address AS a, domain AS d
- WHERE a.localpart = ? AND a.domain IS d.id AND d.name = ?
+ WHERE a.localpart = ? AND a.domain = d.id AND d.name = ?
 `
 
 // LookupAddress
 // Lookup an address without an active transaction
 func (mdb *MailDB) LookupAddress(addr string) (*Address, error) {
+	return mdb.LookupAddressContext(context.Background(), addr)
+}
+
+// LookupAddressContext
+// LookupAddress that gives up when ctx is done
+func (mdb *MailDB) LookupAddressContext(ctx context.Context, addr string) (*Address, error) {
 	var (
 		ap      *AddressParts
 		row     *sql.Row
@@ -145,37 +154,38 @@ func (mdb *MailDB) LookupAddress(addr string) (*Address, error) {
 		mdb: mdb,
 	}
 	if ap.domain == "" { // A "local" address
-		row = mdb.db.QueryRow(qaLocal, ap.lpart)
+		row = mdb.db.QueryRowContext(ctx, qaLocal, ap.lpart)
 		err = row.Scan(
 			&a.id, &a.localpart, &aTrans, &aAccess)
 	} else { // A full RFC822 address
-		row = mdb.db.QueryRow(qaRFC822, ap.lpart, ap.domain)
+		row = mdb.db.QueryRowContext(ctx, qaRFC822, ap.lpart, ap.domain)
 		err = row.Scan(
 			&a.id, &a.localpart, &aTrans, &aAccess,
-			&d.id, &d.name, &d.class, &dTrans, &dAccess, &d.vuid, &d.vgid)
+			&d.id, &d.name, &d.class, &dTrans, &dAccess, &d.vuid, &d.vgid,
+			&d.pwMaxAge, &d.pwMinLength, &d.pwMinClasses, &d.quota)
 	}
 	switch err {
 	case sql.ErrNoRows:
 		return nil, ErrMdbAddressNotFound
 	case nil:
 		if aAccess.Valid {
-			if ac, err := mdb.getAccessById(aAccess.Int64); err == nil {
+			if ac, err := mdb.getAccessById(ctx, aAccess.Int64); err == nil {
 				a.access = ac
 			}
 		}
 		if err == nil && aTrans.Valid {
-			if tr, err := mdb.getTransportById(aTrans.Int64); err == nil {
+			if tr, err := mdb.getTransportById(ctx, aTrans.Int64); err == nil {
 				a.transport = tr
 			}
 		}
 		if err == nil && ap.domain != "" {
 			if dAccess.Valid {
-				if ac, err := mdb.getAccessById(dAccess.Int64); err == nil {
+				if ac, err := mdb.getAccessById(ctx, dAccess.Int64); err == nil {
 					d.access = ac
 				}
 			}
 			if err == nil && dTrans.Valid {
-				if tr, err := mdb.getTransportById(dTrans.Int64); err == nil {
+				if tr, err := mdb.getTransportById(ctx, dTrans.Int64); err == nil {
 					d.transport = tr
 				}
 			}
@@ -194,7 +204,7 @@ func (mdb *MailDB) LookupAddress(addr string) (*Address, error) {
 // GetAddress
 // Lookup an address under an active transaction
 // really a copy of LookupAddress with transaction queries...
-func (mdb *MailDB) GetAddress(addr string) (*Address, error) {
+func (tx *Tx) GetAddress(addr string) (*Address, error) {
 	var (
 		ap      *AddressParts
 		row     *sql.Row
@@ -208,47 +218,50 @@ func (mdb *MailDB) GetAddress(addr string) (*Address, error) {
 	if ap, err = DecodeRFC822(addr); err != nil {
 		return nil, err
 	}
-	if mdb.tx == nil {
+	if !tx.active() {
 		return nil, ErrMdbTransaction
 	}
 	a := &Address{
-		mdb: mdb,
+		mdb: tx.mdb,
+		tx:  tx,
 	}
 	d := &Domain{
-		mdb: mdb,
+		mdb: tx.mdb,
+		tx:  tx,
 	}
 	if ap.domain == "" { // A "local" address
-		row = mdb.tx.QueryRow(qaLocal, ap.lpart)
+		row = tx.queryRow(qaLocal, ap.lpart)
 		err = row.Scan(
 			&a.id, &a.localpart, &aTrans, &aAccess)
 	} else { // A full RFC822 address
-		row = mdb.tx.QueryRow(qaRFC822, ap.lpart, ap.domain)
+		row = tx.queryRow(qaRFC822, ap.lpart, ap.domain)
 		err = row.Scan(
 			&a.id, &a.localpart, &aTrans, &aAccess,
-			&d.id, &d.name, &d.class, &dTrans, &dAccess, &d.vuid, &d.vgid)
+			&d.id, &d.name, &d.class, &dTrans, &dAccess, &d.vuid, &d.vgid,
+			&d.pwMaxAge, &d.pwMinLength, &d.pwMinClasses, &d.quota)
 	}
 	switch err {
 	case sql.ErrNoRows:
 		return nil, ErrMdbAddressNotFound
 	case nil:
 		if aAccess.Valid {
-			if ac, err := mdb.getAccessByIdTx(aAccess.Int64); err == nil {
+			if ac, err := tx.getAccessById(aAccess.Int64); err == nil {
 				a.access = ac
 			}
 		}
 		if err == nil && aTrans.Valid {
-			if tr, err := mdb.getTransportByIdTx(aTrans.Int64); err == nil {
+			if tr, err := tx.getTransportById(aTrans.Int64); err == nil {
 				a.transport = tr
 			}
 		}
 		if err == nil && ap.domain != "" {
 			if dAccess.Valid {
-				if ac, err := mdb.getAccessByIdTx(dAccess.Int64); err == nil {
+				if ac, err := tx.getAccessById(dAccess.Int64); err == nil {
 					d.access = ac
 				}
 			}
 			if err == nil && dTrans.Valid {
-				if tr, err := mdb.getTransportByIdTx(dTrans.Int64); err == nil {
+				if tr, err := tx.getTransportById(dTrans.Int64); err == nil {
 					d.transport = tr
 				}
 			}
@@ -266,11 +279,11 @@ func (mdb *MailDB) GetAddress(addr string) (*Address, error) {
 
 // GetOrInsAddress get the address and if not found, insert it.
 // Make this common pattern a function on its own. Transaction required
-func (mdb *MailDB) GetOrInsAddress(addr string) (*Address, error) {
-	a, err := mdb.GetAddress(addr)
+func (tx *Tx) GetOrInsAddress(addr string) (*Address, error) {
+	a, err := tx.GetAddress(addr)
 	if err != nil {
 		if err == ErrMdbAddressNotFound || err == ErrMdbDomainNotFound {
-			a, err = mdb.InsertAddress(addr)
+			a, err = tx.InsertAddress(addr)
 		}
 	}
 	return a, err
@@ -279,6 +292,12 @@ func (mdb *MailDB) GetOrInsAddress(addr string) (*Address, error) {
 // Alias
 // Return the alias recipients for this address
 func (a *Address) Alias() (*Alias, error) {
+	return a.AliasContext(context.Background())
+}
+
+// AliasContext
+// Alias that gives up when ctx is done
+func (a *Address) AliasContext(ctx context.Context) (*Alias, error) {
 	var (
 		rows    *sql.Rows
 		row     *sql.Row
@@ -290,18 +309,19 @@ func (a *Address) Alias() (*Alias, error) {
 		err     error
 	)
 
-	qal := `SELECT id, target, extension FROM alias WHERE address IS ? ORDER BY id`
+	qal := `SELECT id, target, extension FROM alias WHERE address = ? ORDER BY id`
 	qa := `
 SELECT localpart, domain, transport, access
-FROM address WHERE id IS ?
+FROM address WHERE id = ?
 `
 	qd := `
-SELECT name, class, transport, access, vuid, vgid FROM domain WHERE id IS ?
+SELECT name, class, transport, access, vuid, vgid,
+       pw_max_age, pw_min_length, pw_min_classes, quota FROM domain WHERE id = ?
 `
 	al := &Alias{
 		addr: a,
 	}
-	rows, err = a.mdb.db.Query(qal, a.id)
+	rows, err = a.mdb.db.QueryContext(ctx, qal, a.id)
 	for rows.Next() {
 		var (
 			target sql.NullInt64
@@ -315,35 +335,36 @@ SELECT name, class, transport, access, vuid, vgid FROM domain WHERE id IS ?
 			ta := &Address{
 				mdb: a.mdb, id: target.Int64,
 			}
-			row = a.mdb.db.QueryRow(qa, target.Int64)
+			row = a.mdb.db.QueryRowContext(ctx, qa, target.Int64)
 			switch err = row.Scan(&ta.localpart, &domain, &aTrans, &aAccess); err {
 			case sql.ErrNoRows:
 				err = ErrMdbAddressNotFound
 			case nil:
 				if aAccess.Valid {
-					if ac, err := a.mdb.getAccessById(aAccess.Int64); err == nil {
+					if ac, err := a.mdb.getAccessById(ctx, aAccess.Int64); err == nil {
 						a.access = ac
 					}
 				}
 				if err != nil && aTrans.Valid {
-					if tr, err := a.mdb.getTransportById(aTrans.Int64); err == nil {
+					if tr, err := a.mdb.getTransportById(ctx, aTrans.Int64); err == nil {
 						a.transport = tr
 					}
 				}
 				if err == nil && domain.Valid {
 					d := &Domain{mdb: a.mdb, id: domain.Int64}
-					row = a.mdb.db.QueryRow(qd, domain.Int64)
-					switch err = row.Scan(&d.name, &d.class, &dTrans, &dAccess, &d.vuid, &d.vgid); err {
+					row = a.mdb.db.QueryRowContext(ctx, qd, domain.Int64)
+					switch err = row.Scan(&d.name, &d.class, &dTrans, &dAccess, &d.vuid, &d.vgid,
+						&d.pwMaxAge, &d.pwMinLength, &d.pwMinClasses, &d.quota); err {
 					case sql.ErrNoRows:
 						err = ErrMdbDomainNotFound
 					case nil:
 						if dAccess.Valid {
-							if ac, err := a.mdb.getAccessById(dAccess.Int64); err == nil {
+							if ac, err := a.mdb.getAccessById(ctx, dAccess.Int64); err == nil {
 								d.access = ac
 							}
 						}
 						if err != nil && dTrans.Valid {
-							if tr, err := a.mdb.getTransportById(dTrans.Int64); err == nil {
+							if tr, err := a.mdb.getTransportById(ctx, dTrans.Int64); err == nil {
 								d.transport = tr
 							}
 						}
@@ -384,6 +405,12 @@ SELECT name, class, transport, access, vuid, vgid FROM domain WHERE id IS ?
 
 // FindAddress
 func (mdb *MailDB) FindAddress(address string) ([]*Address, error) {
+	return mdb.FindAddressContext(context.Background(), address)
+}
+
+// FindAddressContext
+// FindAddress that gives up when ctx is done
+func (mdb *MailDB) FindAddressContext(ctx context.Context, address string) ([]*Address, error) {
 	var (
 		err     error
 		ap      *AddressParts
@@ -403,11 +430,11 @@ func (mdb *MailDB) FindAddress(address string) ([]*Address, error) {
 		qa := q + " WHERE domain IS NULL"
 		if ap.lpart == "*" {
 			qa += " ORDER BY localpart"
-			rows, err = mdb.db.Query(qa)
+			rows, err = mdb.db.QueryContext(ctx, qa)
 		} else {
 			lp := strings.ReplaceAll(ap.lpart, "*", "%")
 			qa += " AND localpart LIKE ? ORDER BY localpart"
-			rows, err = mdb.db.Query(qa, lp)
+			rows, err = mdb.db.QueryContext(ctx, qa, lp)
 		}
 		if err != nil {
 			return nil, err
@@ -421,12 +448,12 @@ func (mdb *MailDB) FindAddress(address string) ([]*Address, error) {
 				break
 			}
 			if aAccess.Valid {
-				if ac, err := mdb.getAccessById(aAccess.Int64); err == nil {
+				if ac, err := mdb.getAccessById(ctx, aAccess.Int64); err == nil {
 					a.access = ac
 				}
 			}
 			if err != nil && aTrans.Valid {
-				if tr, err := mdb.getTransportById(aTrans.Int64); err == nil {
+				if tr, err := mdb.getTransportById(ctx, aTrans.Int64); err == nil {
 					a.transport = tr
 				}
 			}
@@ -441,17 +468,17 @@ func (mdb *MailDB) FindAddress(address string) ([]*Address, error) {
 			return nil, err
 		}
 	} else { // must be "*@*" do get all non-locals
-		if dl, err = mdb.FindDomain(ap.domain); err != nil {
+		if dl, err = mdb.FindDomainContext(ctx, ap.domain); err != nil {
 			return nil, err
 		}
 		for _, d := range dl {
 			if ap.lpart == "*" {
-				qd := q + " WHERE domain IS ? ORDER BY localpart"
-				rows, err = mdb.db.Query(qd, d.Id())
+				qd := q + " WHERE domain = ? ORDER BY localpart"
+				rows, err = mdb.db.QueryContext(ctx, qd, d.Id())
 			} else {
 				lp := strings.ReplaceAll(ap.lpart, "*", "%")
-				qd := q + " WHERE domain IS ? AND localpart LIKE ? ORDER BY localpart"
-				rows, err = mdb.db.Query(qd, d.Id(), lp)
+				qd := q + " WHERE domain = ? AND localpart LIKE ? ORDER BY localpart"
+				rows, err = mdb.db.QueryContext(ctx, qd, d.Id(), lp)
 			}
 			if err != nil {
 				break
@@ -465,12 +492,12 @@ func (mdb *MailDB) FindAddress(address string) ([]*Address, error) {
 					break
 				}
 				if aAccess.Valid {
-					if ac, err := mdb.getAccessById(aAccess.Int64); err == nil {
+					if ac, err := mdb.getAccessById(ctx, aAccess.Int64); err == nil {
 						a.access = ac
 					}
 				}
 				if err != nil && aTrans.Valid {
-					if tr, err := mdb.getTransportById(aTrans.Int64); err == nil {
+					if tr, err := mdb.getTransportById(ctx, aTrans.Int64); err == nil {
 						a.transport = tr
 					}
 				}
@@ -499,7 +526,7 @@ func (mdb *MailDB) FindAddress(address string) ([]*Address, error) {
 
 // InsertAddress
 // Insert an address MUST be under a transaction
-func (mdb *MailDB) InsertAddress(address string) (*Address, error) {
+func (tx *Tx) InsertAddress(address string) (*Address, error) {
 	var (
 		ap  *AddressParts
 		a   *Address
@@ -508,27 +535,28 @@ func (mdb *MailDB) InsertAddress(address string) (*Address, error) {
 		err error
 	)
 
-	if mdb.tx == nil {
+	if !tx.active() {
 		return nil, ErrMdbTransaction
 	}
 	if ap, err = DecodeRFC822(address); err != nil {
 		return nil, err
 	}
 	if ap.domain == "" { // A "local user" entry
-		res, err = mdb.tx.Exec("INSERT INTO address (localpart) VALUES (?)", ap.lpart)
+		res, err = tx.insert("INSERT INTO address (localpart) VALUES (?)", ap.lpart)
 		if err != nil {
-			if strings.Contains(err.Error(), "Duplicate insert") {
-				err = ErrMdbDupAddress // caught by trigger, not constraint
+			if strings.Contains(err.Error(), "Duplicate insert") ||
+				IsErrConstraintUnique(err) {
+				err = ErrMdbDupAddress // caught by trigger or partial index, not constraint
 			}
 		}
 	} else { // A Virtual alias entry
-		if d, err = mdb.GetDomain(ap.domain); err != nil {
+		if d, err = tx.GetDomain(ap.domain); err != nil {
 			if err == ErrMdbDomainNotFound {
-				d, err = mdb.InsertDomain(ap.domain)
+				d, err = tx.InsertDomain(ap.domain)
 			}
 		}
 		if err == nil {
-			res, err = mdb.tx.Exec("INSERT INTO address (localpart, domain) VALUES (?, ?)",
+			res, err = tx.insert("INSERT INTO address (localpart, domain) VALUES (?, ?)",
 				ap.lpart, d.Id())
 			if err != nil {
 				if IsErrConstraintUnique(err) {
@@ -542,7 +570,8 @@ func (mdb *MailDB) InsertAddress(address string) (*Address, error) {
 	if err == nil {
 		if aid, err := res.LastInsertId(); err == nil {
 			a = &Address{
-				mdb:       mdb,
+				mdb:       tx.mdb,
+				tx:        tx,
 				id:        aid,
 				localpart: ap.lpart,
 				d:         d,
@@ -575,18 +604,21 @@ func (a *Address) AttachAlias(target string) error {
 		err = ErrMdbAddressTarget
 		return err
 	}
+	if rp.IsCatchAll() { // only a lookup key, nobody to deliver to
+		return ErrMdbAddressTarget
+	}
 	if rp.extension != "" {
 		ext = sql.NullString{Valid: true, String: rp.extension}
 	}
 	if !rp.IsPipe() { // we have a foo@baz address
-		rAddr, err = a.mdb.GetOrInsAddress(target)
+		rAddr, err = a.tx.GetOrInsAddress(target)
 		if err == nil {
 			recipID = sql.NullInt64{Valid: true, Int64: rAddr.id}
 		}
 	}
 	if err == nil {
 		// Now make the link
-		_, err = a.mdb.tx.Exec("INSERT INTO alias (address, target, extension) VALUES (?, ?, ?)",
+		_, err = a.tx.exec("INSERT INTO alias (address, target, extension) VALUES (?, ?, ?)",
 			a.id, recipID, ext)
 	}
 	return err
@@ -599,10 +631,10 @@ func (a *Address) SetTransport(name string) error {
 		err error
 	)
 
-	if tr, err = a.mdb.GetTransport(name); err != nil {
+	if tr, err = a.tx.GetTransport(name); err != nil {
 		return err
 	}
-	res, err := a.mdb.tx.Exec("UPDATE address SET transport = ? WHERE id = ?", tr.id, a.id)
+	res, err := a.tx.exec("UPDATE address SET transport = ? WHERE id = ?", tr.id, a.id)
 	if err == nil {
 		c, err := res.RowsAffected()
 		if err == nil {
@@ -618,7 +650,7 @@ func (a *Address) SetTransport(name string) error {
 
 // ClearTransport
 func (a *Address) ClearTransport() error {
-	res, err := a.mdb.tx.Exec("UPDATE address SET transport = NULL WHERE id = ?", a.id)
+	res, err := a.tx.exec("UPDATE address SET transport = NULL WHERE id = ?", a.id)
 	if err == nil {
 		c, err := res.RowsAffected()
 		if err == nil {
@@ -639,10 +671,10 @@ func (a *Address) SetRclass(name string) error {
 		err error
 	)
 
-	if ac, err = a.mdb.GetAccess(name); err != nil {
+	if ac, err = a.tx.GetAccess(name); err != nil {
 		return err
 	}
-	res, err := a.mdb.tx.Exec("UPDATE address SET access = ? WHERE id = ?", ac.id, a.id)
+	res, err := a.tx.exec("UPDATE address SET access = ? WHERE id = ?", ac.id, a.id)
 	if err == nil {
 		c, err := res.RowsAffected()
 		if err == nil {
@@ -658,7 +690,7 @@ func (a *Address) SetRclass(name string) error {
 
 // ClearRclass
 func (a *Address) ClearRclass() error {
-	res, err := a.mdb.tx.Exec("UPDATE address SET access = NULL WHERE id = ?", a.id)
+	res, err := a.tx.exec("UPDATE address SET access = NULL WHERE id = ?", a.id)
 	if err == nil {
 		c, err := res.RowsAffected()
 		if err == nil {
@@ -673,9 +705,8 @@ func (a *Address) ClearRclass() error {
 }
 
 // DeleteAddress
-// does not need a transaction because the cleanup delete
-// to an unreferenced domain is done by a trigger
-func (mdb *MailDB) DeleteAddress(addr string) error {
+// the cleanup delete to an unreferenced domain is done by a trigger
+func (tx *Tx) DeleteAddress(addr string) error {
 	var (
 		err error
 		ap  *AddressParts
@@ -687,14 +718,14 @@ func (mdb *MailDB) DeleteAddress(addr string) error {
 	}
 	if ap.domain == "" {
 		dq := "DELETE FROM address WHERE localpart = ? AND domain iS NULL"
-		res, err = mdb.db.Exec(dq, ap.lpart)
+		res, err = tx.exec(dq, ap.lpart)
 	} else {
 		dq := `
 DELETE FROM address WHERE id = 
   (SELECT a.id FROM address a, domain d
     WHERE a.domain = d.id AND a.localpart = ? AND d.name = ?)
 `
-		res, err = mdb.db.Exec(dq, ap.lpart, ap.domain)
+		res, err = tx.exec(dq, ap.lpart, ap.domain)
 	}
 	if err != nil {
 		return err
@@ -33,6 +33,7 @@ import (
 // TestAddress
 func TestAddress(t *testing.T) {
 	var (
+		tx             *Tx
 		err            error
 		mdb            *MailDB
 		dir            string
@@ -51,11 +52,11 @@ func TestAddress(t *testing.T) {
 	defer mdb.Close()
 
 	// First add an access and transport so we can see if we can set them
-	mdb.Begin()
-	if _, err = mdb.InsertAccess("spam", "gooberfilter"); err != nil {
+	tx = beginTx(t, mdb)
+	if _, err = tx.InsertAccess("spam", "gooberfilter"); err != nil {
 		t.Errorf("Insert spam entry unexpectedly failed, %s", err)
 	}
-	if tr, err := mdb.InsertTransport("relay"); err != nil {
+	if tr, err := tx.InsertTransport("relay"); err != nil {
 		t.Errorf("Insert relay unexpectedly failed, %s", err)
 	} else {
 		if err = tr.SetTransport("relay"); err != nil {
@@ -64,12 +65,12 @@ func TestAddress(t *testing.T) {
 			t.Errorf("Insert relay: set nexthop localhost:56 failed, %s", err)
 		}
 	}
-	mdb.End(&err)
+	tx.End(&err)
 
 	// test basic local address insert
-	mdb.Begin()
-	a, err := mdb.InsertAddress("dmr")
-	mdb.End(&err)
+	tx = beginTx(t, mdb)
+	a, err := tx.InsertAddress("dmr")
+	tx.End(&err)
 	if err != nil {
 		t.Errorf("insert of dmr failed %s", err)
 	} else {
@@ -90,17 +91,17 @@ func TestAddress(t *testing.T) {
 	}
 
 	// try to insert it again
-	mdb.Begin()
-	a, err = mdb.InsertAddress("dmr")
-	mdb.End(&err)
+	tx = beginTx(t, mdb)
+	a, err = tx.InsertAddress("dmr")
+	tx.End(&err)
 	if err != nil && err != ErrMdbDupAddress {
 		t.Errorf("duplicate insert of dmr, unexpected error %s", err)
 	}
 
 	// test basic insert. Should have one address row and one domain row
-	mdb.Begin()
-	a, err = mdb.InsertAddress("mary@goof.com")
-	mdb.End(&err)
+	tx = beginTx(t, mdb)
+	a, err = tx.InsertAddress("mary@goof.com")
+	tx.End(&err)
 	if err != nil {
 		t.Errorf("insert of mary@goof.com failed %s", err)
 	} else {
@@ -121,17 +122,17 @@ func TestAddress(t *testing.T) {
 	}
 
 	// try inserting it again
-	mdb.Begin()
-	a, err = mdb.InsertAddress("mary@goof.com")
-	mdb.End(&err)
+	tx = beginTx(t, mdb)
+	a, err = tx.InsertAddress("mary@goof.com")
+	tx.End(&err)
 	if err != nil && err != ErrMdbDupAddress {
 		t.Errorf("duplicate insert of mary@goof.com, unexpected error %s", err)
 	}
 
 	// second insert, same domain. should now have 2 address rows and 1 domain
-	mdb.Begin()
-	a, err = mdb.InsertAddress("bill@goof.com")
-	mdb.End(&err)
+	tx = beginTx(t, mdb)
+	a, err = tx.InsertAddress("bill@goof.com")
+	tx.End(&err)
 	if err != nil {
 		t.Errorf("insert of bill@goof.com failed %s", err)
 	} else {
@@ -152,9 +153,9 @@ func TestAddress(t *testing.T) {
 	}
 
 	// third insert is new domain. should have 4 addresses and 2 domains
-	mdb.Begin()
-	a, err = mdb.InsertAddress("dave@slip.com")
-	mdb.End(&err)
+	tx = beginTx(t, mdb)
+	a, err = tx.InsertAddress("dave@slip.com")
+	tx.End(&err)
 	if err != nil {
 		t.Errorf("insert of dave@slip.com failed %s", err)
 	} else {
@@ -187,7 +188,7 @@ func TestAddress(t *testing.T) {
 	}
 
 	// now delete it and check. We should have 3 addresses and 2 domains
-	if err = mdb.DeleteAddress("dmr"); err != nil {
+	if err = mdb.WithTx(func(tx *Tx) error { return tx.DeleteAddress("dmr") }); err != nil {
 		t.Errorf("delete of dmr failed: %s", err)
 	}
 	aCount, dCount = countAddresses(mdb)
@@ -210,11 +211,11 @@ func TestAddress(t *testing.T) {
 	}
 
 	// Set and clear Rclass and transport for poor mary
-	mdb.Begin()
-	a, err = mdb.GetAddress("mary@goof.com")
+	tx = beginTx(t, mdb)
+	a, err = tx.GetAddress("mary@goof.com")
 	if err != nil {
 		t.Errorf("Get mary@goof.com: unexpected error %s", err)
-		mdb.End(&err)
+		tx.End(&err)
 	} else {
 		if err = a.SetTransport("relay"); err != nil {
 			t.Errorf("mary@goof.com: SetTransport relay, %s", err)
@@ -223,7 +224,7 @@ func TestAddress(t *testing.T) {
 			t.Errorf("mary@goof.com: SetRclass spam, %s", err)
 		}
 	}
-	mdb.End(&err)
+	tx.End(&err)
 
 	var exportLine string = "mary@goof.com rclass=spam, transport=relay"
 	a, err = mdb.LookupAddress("mary@goof.com")
@@ -241,11 +242,11 @@ func TestAddress(t *testing.T) {
 	}
 
 	// Now clear them
-	mdb.Begin()
-	a, err = mdb.GetAddress("mary@goof.com")
+	tx = beginTx(t, mdb)
+	a, err = tx.GetAddress("mary@goof.com")
 	if err != nil {
 		t.Errorf("Get mary@goof.com to clear: unexpected error %s", err)
-		mdb.End(&err)
+		tx.End(&err)
 	} else {
 		if err = a.ClearTransport(); err != nil {
 			t.Errorf("mary@goof.com: ClearTransport, %s", err)
@@ -254,7 +255,7 @@ func TestAddress(t *testing.T) {
 			t.Errorf("mary@goof.com: ClearRclass, %s", err)
 		}
 	}
-	mdb.End(&err)
+	tx.End(&err)
 
 	a, err = mdb.LookupAddress("mary@goof.com")
 	if err != nil {
@@ -268,7 +269,7 @@ func TestAddress(t *testing.T) {
 	}
 
 	// now delete it and check. We should have 2 addresses and 2 domains
-	if err = mdb.DeleteAddress("mary@goof.com"); err != nil {
+	if err = mdb.WithTx(func(tx *Tx) error { return tx.DeleteAddress("mary@goof.com") }); err != nil {
 		t.Errorf("delete of mary@goof.com failed: %s", err)
 	}
 	aCount, dCount = countAddresses(mdb)
@@ -277,7 +278,7 @@ func TestAddress(t *testing.T) {
 	}
 
 	// delete dave@slip.com and see if his domain also gets deleted
-	if err = mdb.DeleteAddress("dave@slip.com"); err != nil {
+	if err = mdb.WithTx(func(tx *Tx) error { return tx.DeleteAddress("dave@slip.com") }); err != nil {
 		t.Errorf("delete of dave@slip.com failed: %s", err)
 	}
 	aCount, dCount = countAddresses(mdb)
@@ -286,7 +287,7 @@ func TestAddress(t *testing.T) {
 	}
 
 	// delete a bogus address in a legit domain. We should see an error
-	if err = mdb.DeleteAddress("foo@goof.com"); err != nil {
+	if err = mdb.WithTx(func(tx *Tx) error { return tx.DeleteAddress("foo@goof.com") }); err != nil {
 		if err != ErrMdbAddressNotFound {
 			t.Errorf("delete of foo@goof.com failed: %s", err)
 		}
@@ -299,7 +300,7 @@ func TestAddress(t *testing.T) {
 	}
 
 	// delete a bogus address in a bogus domain
-	if err = mdb.DeleteAddress("foo@baz"); err != nil {
+	if err = mdb.WithTx(func(tx *Tx) error { return tx.DeleteAddress("foo@baz") }); err != nil {
 		if err != ErrMdbAddressNotFound {
 			t.Errorf("delete of foo@baz failed: %s", err)
 		}
@@ -312,7 +313,7 @@ func TestAddress(t *testing.T) {
 	}
 
 	// now delete bill@goof.com. That should be it. no more rows
-	if err = mdb.DeleteAddress("bill@goof.com"); err != nil {
+	if err = mdb.WithTx(func(tx *Tx) error { return tx.DeleteAddress("bill@goof.com") }); err != nil {
 		t.Errorf("delete of bill@goof.com failed: %s", err)
 	}
 	aCount, dCount = countAddresses(mdb)
@@ -21,6 +21,7 @@ package maildb
  */
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"strings"
@@ -80,6 +81,12 @@ func (al *Alias) Targets() []*Recipient {
 // name@*      returns all aliases of this name, e.g. abuse@foo.com, abuse@example.org
 // *@*         returns all virtual aliases in the database
 func (mdb *MailDB) LookupAlias(alias string) ([]*Alias, error) {
+	return mdb.LookupAliasContext(context.Background(), alias)
+}
+
+// LookupAliasContext
+// LookupAlias that gives up when ctx is done
+func (mdb *MailDB) LookupAliasContext(ctx context.Context, alias string) ([]*Alias, error) {
 	var (
 		al_list []*Alias
 		a_list  []*Address
@@ -87,11 +94,11 @@ func (mdb *MailDB) LookupAlias(alias string) ([]*Alias, error) {
 		rowCnt  int
 	)
 
-	if a_list, err = mdb.FindAddress(alias); err != nil {
+	if a_list, err = mdb.FindAddressContext(ctx, alias); err != nil {
 		return nil, err
 	}
 	for _, a := range a_list {
-		al, err := a.Alias()
+		al, err := a.AliasContext(ctx)
 		if err != nil {
 			if err == ErrMdbNotAlias {
 				continue
@@ -136,7 +143,7 @@ func (al *Alias) Export() string {
 // All we need to do here is delete the aliases that aliasAddr points to
 // As the set of aliases disappear, their delete triggers clean up all the
 // orphan targets (and the alias address itself) on the way out
-func (mdb *MailDB) RemoveAlias(alias string) error {
+func (tx *Tx) RemoveAlias(alias string) error {
 	var (
 		ap  *AddressParts
 		err error
@@ -152,14 +159,14 @@ func (mdb *MailDB) RemoveAlias(alias string) error {
 DELETE FROM alias WHERE address =
 (SELECT a.id FROM address a  WHERE a.domain IS NULL AND a.localpart = ?)
 `
-		res, err = mdb.db.Exec(qd, ap.lpart)
+		res, err = tx.exec(qd, ap.lpart)
 	} else {
 		qd := `
 DELETE FROM alias WHERE address =
 (SELECT a.id FROM address a, domain d
   WHERE a.domain = d.id AND a.localpart = ? AND d.name = ?)
 `
-		res, err = mdb.db.Exec(qd, ap.lpart, ap.domain)
+		res, err = tx.exec(qd, ap.lpart, ap.domain)
 	}
 	if err == nil {
 		c, err = res.RowsAffected()
@@ -173,7 +180,7 @@ DELETE FROM alias WHERE address =
 }
 
 // RemoveRecipient. Remove the alias as well if this is the last target
-func (mdb *MailDB) RemoveRecipient(alias string, recipient string) error {
+func (tx *Tx) RemoveRecipient(alias string, recipient string) error {
 	var (
 		ap  *AddressParts
 		err error
@@ -191,10 +198,10 @@ func (mdb *MailDB) RemoveRecipient(alias string, recipient string) error {
 	if ap.IsLocal() {
 		if rp.IsPipe() {
 			qd := `
-DELETE FROM alias WHERE target IS NULL AND extension IS ? AND address =
+DELETE FROM alias WHERE target IS NULL AND extension = ? AND address =
   (SELECT id FROM address WHERE localpart = ? AND domain IS NULL)
 `
-			res, err = mdb.db.Exec(qd, rp.extension, ap.lpart)
+			res, err = tx.exec(qd, rp.extension, ap.lpart)
 		} else {
 			qd := `
 DELETE FROM alias WHERE address =
@@ -204,13 +211,13 @@ DELETE FROM alias WHERE address =
 				qd += `
  AND target = (SELECT id from address WHERE localpart = ? AND domain IS NULL)
 `
-				res, err = mdb.db.Exec(qd, ap.lpart, rp.lpart)
+				res, err = tx.exec(qd, ap.lpart, rp.lpart)
 			} else {
 				qd += `
  AND target = (SELECT a.id from address a, domain d
    WHERE a.localpart = ? AND a.domain = d.id AND d.name = ?)
 `
-				res, err = mdb.db.Exec(qd, ap.lpart, rp.lpart, rp.domain)
+				res, err = tx.exec(qd, ap.lpart, rp.lpart, rp.domain)
 			}
 		}
 	} else { // name@domain
@@ -223,13 +230,13 @@ DELETE FROM alias WHERE address =
 				qd += `
  AND target = (SELECT id from address WHERE localpart = ? AND domain IS NULL)
 `
-				res, err = mdb.db.Exec(qd, ap.lpart, ap.domain, rp.lpart)
+				res, err = tx.exec(qd, ap.lpart, ap.domain, rp.lpart)
 			} else {
 				qd += `
  AND target = (SELECT a.id from address a, domain d
    WHERE a.localpart = ? AND a.domain = d.id AND d.name = ?)
 `
-				res, err = mdb.db.Exec(qd, ap.lpart, ap.domain, rp.lpart, rp.domain)
+				res, err = tx.exec(qd, ap.lpart, ap.domain, rp.lpart, rp.domain)
 			}
 		} else {
 			err = ErrMdbNoLocalPipe // for name@domain virtuals
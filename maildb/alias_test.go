@@ -35,6 +35,7 @@ import (
 // makeAlias
 func makeAlias(mdb *MailDB, alias string, recipients []string) error {
 	var (
+		tx        *Tx
 		err       error
 		aliasAddr *Address
 	)
@@ -43,10 +44,12 @@ func makeAlias(mdb *MailDB, alias string, recipients []string) error {
 		return ErrMdbNoRecipients
 	}
 	// Enter a transaction for everything else
-	mdb.Begin()
-	defer mdb.End(&err)
+	if tx, err = mdb.Begin(); err != nil {
+		return err
+	}
+	defer tx.End(&err)
 
-	if aliasAddr, err = mdb.GetOrInsAddress(alias); err != nil {
+	if aliasAddr, err = tx.GetOrInsAddress(alias); err != nil {
 		return err
 	}
 
@@ -334,7 +337,7 @@ func TestAliasOps(t *testing.T) {
 	}
 
 	// Now delete bill@plumbers.com of steve@office
-	if err = mdb.RemoveRecipient("steve@office", "bill@plumbers.com"); err != nil {
+	if err = mdb.WithTx(func(tx *Tx) error { return tx.RemoveRecipient("steve@office", "bill@plumbers.com") }); err != nil {
 		t.Errorf("Remove bill@plumbers.com: %s", err)
 	} else if al_list, err = mdb.LookupAlias("steve@office"); err != nil {
 		t.Errorf("Lookup truncated steve@office: %s", err)
@@ -350,7 +353,7 @@ func TestAliasOps(t *testing.T) {
 	}
 
 	// delete a bogus recipient
-	err = mdb.RemoveRecipient("steve@office", "bronco.billy@the.ranch")
+	err = mdb.WithTx(func(tx *Tx) error { return tx.RemoveRecipient("steve@office", "bronco.billy@the.ranch") })
 	if err == nil {
 		t.Errorf("delete of bronco.billy should have failed")
 	} else if err != ErrMdbRecipientNotFound {
@@ -358,7 +361,7 @@ func TestAliasOps(t *testing.T) {
 	}
 
 	// delete a bogus pipe recipient
-	err = mdb.RemoveRecipient("steve@office", "\"| cat > /dev/null\"")
+	err = mdb.WithTx(func(tx *Tx) error { return tx.RemoveRecipient("steve@office", "\"| cat > /dev/null\"") })
 	if err == nil {
 		t.Errorf("delete of '\"|cat > /dev/null\"' should have failed")
 	} else if err != ErrMdbNoLocalPipe {
@@ -366,7 +369,7 @@ func TestAliasOps(t *testing.T) {
 	}
 
 	// try to delete a recipient as an alias
-	err = mdb.RemoveAlias("mike@shovel.org")
+	err = mdb.WithTx(func(tx *Tx) error { return tx.RemoveAlias("mike@shovel.org") })
 	if err == nil {
 		t.Errorf("delete of a mike@shovel.org as an alias did not fail")
 	} else if err != ErrMdbNotAlias {
@@ -374,7 +377,7 @@ func TestAliasOps(t *testing.T) {
 	}
 
 	// then the other (last) from steve@office
-	if err = mdb.RemoveRecipient("steve@office", "mike@shovel.org"); err != nil {
+	if err = mdb.WithTx(func(tx *Tx) error { return tx.RemoveRecipient("steve@office", "mike@shovel.org") }); err != nil {
 		t.Errorf("Remove mike@shovel.org: %s", err)
 	}
 	al_list, err = mdb.LookupAlias("steve@office")
@@ -385,7 +388,7 @@ func TestAliasOps(t *testing.T) {
 	}
 
 	// remove a pipe recipient
-	if err = mdb.RemoveRecipient("rebar", "\"| cat > /dev/null\""); err != nil {
+	if err = mdb.WithTx(func(tx *Tx) error { return tx.RemoveRecipient("rebar", "\"| cat > /dev/null\"") }); err != nil {
 		t.Errorf("Remove | cat > /dev/null: %s", err)
 	} else if al_list, err = mdb.LookupAlias("rebar"); err != nil {
 		t.Errorf("Lookup truncated rebar: %s", err)
@@ -401,7 +404,7 @@ func TestAliasOps(t *testing.T) {
 	}
 
 	// then the other (last) from rebar
-	if err = mdb.RemoveRecipient("rebar", "/tmp/rubbish"); err != nil {
+	if err = mdb.WithTx(func(tx *Tx) error { return tx.RemoveRecipient("rebar", "/tmp/rubbish") }); err != nil {
 		t.Errorf("Remove bill@plumbers.com: %s", err)
 	}
 	al_list, err = mdb.LookupAlias("rebar")
@@ -412,7 +415,7 @@ func TestAliasOps(t *testing.T) {
 	}
 
 	// try to remove a bogus alias
-	err = mdb.RemoveAlias("orange.one@putz")
+	err = mdb.WithTx(func(tx *Tx) error { return tx.RemoveAlias("orange.one@putz") })
 	if err == nil {
 		t.Errorf("delete of a putz did not fail")
 	} else if err != ErrMdbNotAlias {
@@ -420,13 +423,13 @@ func TestAliasOps(t *testing.T) {
 	}
 
 	// try to remove a domain out from under an alias
-	if err = mdb.DeleteDomain("office"); err == nil {
+	if err = mdb.WithTx(func(tx *Tx) error { return tx.DeleteDomain("office") }); err == nil {
 		t.Errorf("delete of office out from under alias should have failed")
 	} else if err != ErrMdbDomainBusy {
 		t.Errorf("delete of office: unexpected error, %s", err)
 	}
 	// now remove the whole alias of all that remain
-	if err = mdb.RemoveAlias("miller@office"); err != nil {
+	if err = mdb.WithTx(func(tx *Tx) error { return tx.RemoveAlias("miller@office") }); err != nil {
 		t.Errorf("Remove miller@office: %s", err)
 	}
 	al_list, err = mdb.LookupAlias("miller@office")
@@ -436,7 +439,7 @@ func TestAliasOps(t *testing.T) {
 		t.Errorf("Lookup of deleted miller@office: %s", err)
 	}
 
-	if err = mdb.RemoveAlias("bozo@clown.com"); err != nil {
+	if err = mdb.WithTx(func(tx *Tx) error { return tx.RemoveAlias("bozo@clown.com") }); err != nil {
 		t.Errorf("Remove bozo@clown.com: %s", err)
 	}
 	al_list, err = mdb.LookupAlias("bozo@clown.com")
@@ -446,7 +449,7 @@ func TestAliasOps(t *testing.T) {
 		t.Errorf("Lookup of deleted bozo@clown.com: %s", err)
 	}
 
-	if err = mdb.RemoveAlias("steve@clown.com"); err != nil {
+	if err = mdb.WithTx(func(tx *Tx) error { return tx.RemoveAlias("steve@clown.com") }); err != nil {
 		t.Errorf("Remove steve@clown.com: %s", err)
 	}
 	al_list, err = mdb.LookupAlias("steve@clown.com")
@@ -457,7 +460,7 @@ func TestAliasOps(t *testing.T) {
 	}
 
 	// now remove the whole alias
-	if err = mdb.RemoveAlias("postfix"); err != nil {
+	if err = mdb.WithTx(func(tx *Tx) error { return tx.RemoveAlias("postfix") }); err != nil {
 		t.Errorf("Remove postfix: %s", err)
 	}
 	al_list, err = mdb.LookupAlias("postfix")
@@ -499,7 +502,7 @@ func TestAliasOps(t *testing.T) {
 	if err = makeAlias(mdb, "junk@soho.org", recips); err != nil {
 		t.Errorf("makeAlias of junk@soho.org, %s", err)
 	}
-	if err = mdb.RemoveRecipient("spam@soho.org", "bill+spam@soho.org"); err != nil {
+	if err = mdb.WithTx(func(tx *Tx) error { return tx.RemoveRecipient("spam@soho.org", "bill+spam@soho.org") }); err != nil {
 		t.Errorf("RemoveRecipient bill+spam@soho.org: %s", err)
 	}
 	if al_list, err = mdb.LookupAlias("spam@soho.org"); err != nil {
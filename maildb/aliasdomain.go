@@ -0,0 +1,236 @@
+package maildb
+
+/*
+ * Copyright (C) 2020, Jim Lieb <lieb@sea-troll.net>
+ *
+ * This program is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 3 of the License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ *
+ * -------------
+ */
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+)
+
+// AliasDomain
+// A domain whose addresses are the mailboxes and aliases of its target,
+// e.g. user@example.net is user@example.com. Postfix gets them from
+// virt_alias. The alias domain is a virtual domain and can still have
+// aliases of its own which are used instead.
+type AliasDomain struct {
+	name   string
+	target string
+}
+
+const aliasDomainQuery = `
+SELECT ald.name, td.name FROM aliasdomain AS dm
+ JOIN domain AS ald ON (dm.domain = ald.id)
+ JOIN domain AS td ON (dm.target = td.id)`
+
+// LookupAliasDomain
+// outside transactions
+func (mdb *MailDB) LookupAliasDomain(name string) (*AliasDomain, error) {
+	return mdb.LookupAliasDomainContext(context.Background(), name)
+}
+
+// LookupAliasDomainContext
+// LookupAliasDomain that gives up when ctx is done
+func (mdb *MailDB) LookupAliasDomainContext(ctx context.Context, name string) (*AliasDomain, error) {
+	ad := &AliasDomain{}
+	row := mdb.db.QueryRowContext(ctx, aliasDomainQuery+" WHERE ald.name = ?", name)
+	switch err := row.Scan(&ad.name, &ad.target); err {
+	case sql.ErrNoRows:
+		return nil, ErrMdbNotAliasDomain
+	case nil:
+		return ad, nil
+	default:
+		return nil, err
+	}
+}
+
+// FindAliasDomain
+// LookupAliasDomain with the wildcards of FindDomain
+func (mdb *MailDB) FindAliasDomain(name string) ([]*AliasDomain, error) {
+	return mdb.FindAliasDomainContext(context.Background(), name)
+}
+
+// FindAliasDomainContext
+// FindAliasDomain that gives up when ctx is done
+func (mdb *MailDB) FindAliasDomainContext(ctx context.Context, name string) ([]*AliasDomain, error) {
+	var adl []*AliasDomain
+
+	name = strings.ReplaceAll(name, "*", "%")
+	rows, err := mdb.db.QueryContext(ctx, aliasDomainQuery+" WHERE ald.name LIKE ? ORDER BY ald.name", name)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		ad := &AliasDomain{}
+		if err = rows.Scan(&ad.name, &ad.target); err != nil {
+			break
+		}
+		adl = append(adl, ad)
+	}
+	if e := rows.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(adl) == 0 {
+		return nil, ErrMdbNotAliasDomain
+	}
+	return adl, nil
+}
+
+// GetAliasDomain
+// inside transactions
+func (tx *Tx) GetAliasDomain(name string) (*AliasDomain, error) {
+	if !tx.active() {
+		return nil, ErrMdbTransaction
+	}
+	ad := &AliasDomain{}
+	row := tx.queryRow(aliasDomainQuery+" WHERE ald.name = ?", name)
+	switch err := row.Scan(&ad.name, &ad.target); err {
+	case sql.ErrNoRows:
+		return nil, ErrMdbNotAliasDomain
+	case nil:
+		return ad, nil
+	default:
+		return nil, err
+	}
+}
+
+// isAliasTarget
+// Do any alias domains point to the domain?
+func (tx *Tx) isAliasTarget(d *Domain) (bool, error) {
+	var cnt int
+
+	row := tx.queryRow("SELECT count(*) FROM aliasdomain WHERE target = ?", d.id)
+	if err := row.Scan(&cnt); err != nil {
+		return false, err
+	}
+	return cnt > 0, nil
+}
+
+// SetAliasDomain
+// Make name an alias domain of target, or change its target if it
+// already is one. The domain is added if it is new and made virtual.
+// Alias domains do not chain so the target cannot be one and name
+// cannot be the target of another.
+func (tx *Tx) SetAliasDomain(name string, target string) (*AliasDomain, error) {
+	var cur int64
+
+	if !tx.active() {
+		return nil, ErrMdbTransaction
+	}
+	if badDomainName(name) || badDomainName(target) {
+		return nil, ErrMdbBadName
+	}
+	if strings.EqualFold(name, target) {
+		return nil, ErrMdbAliasDomTarget
+	}
+	td, err := tx.GetDomain(target)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = tx.GetAliasDomain(target); err == nil {
+		return nil, ErrMdbAliasDomTarget
+	} else if err != ErrMdbNotAliasDomain {
+		return nil, err
+	}
+	d, err := tx.GetDomain(name)
+	switch err {
+	case ErrMdbDomainNotFound:
+		d, err = tx.InsertDomain(name)
+	case nil:
+		if d.class != internet && d.class != virtual {
+			return nil, ErrMdbAliasDomClass
+		}
+		var busy bool
+		if busy, err = tx.isAliasTarget(d); err == nil && busy {
+			return nil, ErrMdbDomainIsTarget
+		}
+	}
+	if err == nil && d.class != virtual {
+		err = d.SetClass("virtual")
+	}
+	if err != nil {
+		return nil, err
+	}
+	row := tx.queryRow("SELECT target FROM aliasdomain WHERE domain = ?", d.id)
+	switch err = row.Scan(&cur); err {
+	case sql.ErrNoRows:
+		_, err = tx.exec("INSERT INTO aliasdomain (domain, target) VALUES (?, ?)", d.id, td.id)
+	case nil:
+		if cur != td.id {
+			_, err = tx.exec("UPDATE aliasdomain SET target = ? WHERE domain = ?", td.id, d.id)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &AliasDomain{name: d.name, target: td.name}, nil
+}
+
+// DeleteAliasDomain
+// Stop the mapping. The domain goes too unless it has addresses of
+// its own, like the domains of deleted addresses.
+func (tx *Tx) DeleteAliasDomain(name string) error {
+	var cnt int
+
+	if !tx.active() {
+		return ErrMdbTransaction
+	}
+	d, err := tx.GetDomain(name)
+	if err != nil {
+		return err
+	}
+	res, err := tx.exec("DELETE FROM aliasdomain WHERE domain = ?", d.id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrMdbNotAliasDomain
+	}
+	row := tx.queryRow("SELECT count(*) FROM address WHERE domain = ?", d.id)
+	if err = row.Scan(&cnt); err != nil {
+		return err
+	}
+	if cnt == 0 {
+		return tx.DeleteDomain(name)
+	}
+	return nil
+}
+
+// Name
+func (ad *AliasDomain) Name() string {
+	return ad.name
+}
+
+// Target
+// The domain whose addresses the alias domain has
+func (ad *AliasDomain) Target() string {
+	return ad.target
+}
+
+// String
+func (ad *AliasDomain) String() string {
+	return ad.name + " -> " + ad.target
+}
@@ -0,0 +1,321 @@
+package maildb
+
+/*
+ * Copyright (C) 2020, Jim Lieb <lieb@sea-troll.net>
+ *
+ * This program is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 3 of the License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ *
+ * -------------
+ */
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// TestAliasDomain
+func TestAliasDomain(t *testing.T) {
+	var (
+		err error
+		mdb *MailDB
+		dir string
+		cnt int
+	)
+
+	fmt.Printf("Alias Domain Test\n")
+
+	dir, err = ioutil.TempDir("", "TestAliasDomain-*")
+	defer os.RemoveAll(dir)
+	mdb, err = makeTestDB(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Errorf("Database load failed, %s", err)
+		return
+	}
+	defer mdb.Close()
+
+	// virtuals is what postfix gets for user
+	virtuals := func(lpart, domain string) string {
+		var rl []string
+		rows, err := mdb.db.Query("SELECT recipient FROM virt_alias WHERE mailbox = ? AND domain_name = ?",
+			lpart, domain)
+		if err != nil {
+			return err.Error()
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var r string
+			if err = rows.Scan(&r); err != nil {
+				return err.Error()
+			}
+			rl = append(rl, r)
+		}
+		sort.Strings(rl)
+		return strings.Join(rl, ",")
+	}
+
+	err = mdb.WithTx(func(tx *Tx) error {
+		d, err := tx.InsertDomain("example.com")
+		if err == nil {
+			err = d.SetClass("vmailbox")
+		}
+		if err == nil {
+			_, err = tx.InsertVMailbox("user@example.com")
+		}
+		if err != nil {
+			return err
+		}
+		a, err := tx.GetOrInsAddress("sales@example.com")
+		if err == nil {
+			err = a.AttachAlias("user@example.com")
+		}
+		if err != nil {
+			return err
+		}
+		// only a recipient, not an address of example.com's own
+		if a, err = tx.GetOrInsAddress("boss@example.org"); err == nil {
+			err = a.AttachAlias("nobody@example.com")
+		}
+		if err != nil {
+			return err
+		}
+		ad, err := tx.SetAliasDomain("example.net", "example.com")
+		if err != nil {
+			return err
+		}
+		if ad.Name() != "example.net" || ad.Target() != "example.com" {
+			return fmt.Errorf("example.net: got %s", ad)
+		}
+		_, err = tx.SetAliasDomain("example.org", "example.com")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Make alias domains: %s", err)
+	}
+	if d, err := mdb.LookupDomain("example.net"); err != nil || !d.IsVirtual() {
+		t.Errorf("example.net: expected a virtual domain, got %v, %v", d, err)
+	}
+	for _, c := range [][]string{
+		{"user", "example.net", "user@example.com"},
+		{"sales", "example.net", "sales@example.com"},
+		{"nobody", "example.net", ""},
+		{"user", "example.org", "user@example.com"},
+		{"boss", "example.org", "nobody@example.com"},
+	} {
+		if v := virtuals(c[0], c[1]); v != c[2] {
+			t.Errorf("virt_alias %s@%s: expected %q, got %q", c[0], c[1], c[2], v)
+		}
+	}
+	adl, err := mdb.FindAliasDomain("*")
+	if err != nil || len(adl) != 2 || adl[1].String() != "example.org -> example.com" {
+		t.Errorf("Find alias domains: got %v, %v", adl, err)
+	}
+
+	// Own aliases win, and the mapping survives losing them
+	err = mdb.WithTx(func(tx *Tx) error {
+		a, err := tx.GetOrInsAddress("sales@example.net")
+		if err == nil {
+			err = a.AttachAlias("sales@example.org")
+		}
+		return err
+	})
+	if err != nil {
+		t.Errorf("Own alias: %s", err)
+	}
+	if v := virtuals("sales", "example.net"); v != "sales@example.org" {
+		t.Errorf("virt_alias sales@example.net: got %q", v)
+	}
+	err = mdb.WithTx(func(tx *Tx) error {
+		return tx.RemoveAlias("sales@example.net")
+	})
+	if err != nil {
+		t.Errorf("Delete own alias: %s", err)
+	}
+	if v := virtuals("sales", "example.net"); v != "sales@example.com" {
+		t.Errorf("virt_alias sales@example.net after delete: got %q", v)
+	}
+
+	// The catch-all of the target, then one of its own
+	err = mdb.WithTx(func(tx *Tx) error {
+		a, err := tx.GetOrInsAddress("@example.com")
+		if err == nil {
+			err = a.AttachAlias("user@example.com")
+		}
+		return err
+	})
+	if err != nil {
+		t.Errorf("Catch-all @example.com: %s", err)
+	}
+	for _, c := range [][]string{
+		{"", "example.com", "user@example.com"},
+		{"user", "example.com", "user@example.com"},
+		{"sales", "example.com", "user@example.com"},
+		{"", "example.net", "user@example.com"},
+		{"user", "example.net", "user@example.com"},
+		{"nobody", "example.net", ""},
+	} {
+		if v := virtuals(c[0], c[1]); v != c[2] {
+			t.Errorf("virt_alias %s@%s: expected %q, got %q", c[0], c[1], c[2], v)
+		}
+	}
+	err = mdb.WithTx(func(tx *Tx) error {
+		a, err := tx.GetOrInsAddress("@example.net")
+		if err == nil {
+			err = a.AttachAlias("sales@example.org")
+		}
+		return err
+	})
+	if err != nil {
+		t.Errorf("Catch-all @example.net: %s", err)
+	}
+	if v := virtuals("", "example.net"); v != "sales@example.org" {
+		t.Errorf("virt_alias @example.net: got %q", v)
+	}
+
+	// A forwarded mailbox already has its lines
+	err = mdb.WithTx(func(tx *Tx) error {
+		_, err := tx.SetForward("user@example.com", []string{"boss@example.org"}, false)
+		return err
+	})
+	if err != nil {
+		t.Errorf("Forward user@example.com: %s", err)
+	}
+	if v := virtuals("user", "example.com"); v != "boss@example.org" {
+		t.Errorf("virt_alias forwarded user@example.com: got %q", v)
+	}
+	err = mdb.WithTx(func(tx *Tx) error {
+		return tx.DeleteForward("user@example.com")
+	})
+	if err != nil {
+		t.Errorf("Unforward user@example.com: %s", err)
+	}
+	err = mdb.WithTx(func(tx *Tx) error {
+		if err := tx.RemoveAlias("@example.net"); err != nil {
+			return err
+		}
+		a, err := tx.GetAddress("sales@example.com")
+		if err != nil {
+			return err
+		}
+		if err = a.AttachAlias("@example.org"); err != ErrMdbAddressTarget {
+			return fmt.Errorf("catch-all recipient: expected ErrMdbAddressTarget, got %v", err)
+		}
+		if _, err = tx.InsertVMailbox("@example.com"); err != ErrMdbCatchAll {
+			return fmt.Errorf("catch-all mailbox: expected ErrMdbCatchAll, got %v", err)
+		}
+		if _, err = tx.RenameVMailbox("user@example.com", "@example.com", false); err != ErrMdbCatchAll {
+			return fmt.Errorf("rename to catch-all: expected ErrMdbCatchAll, got %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Catch-all mistakes: %s", err)
+	}
+
+	// Mistakes
+	err = mdb.WithTx(func(tx *Tx) error {
+		d, err := tx.InsertDomain("pobox")
+		if err == nil {
+			err = d.SetClass("local")
+		}
+		if err != nil {
+			return err
+		}
+		for _, c := range []struct {
+			name, target string
+			want         error
+		}{
+			{"example.com", "example.com", ErrMdbAliasDomTarget},
+			{"example.info", "example.net", ErrMdbAliasDomTarget},
+			{"example.info", "example.biz", ErrMdbDomainNotFound},
+			{"example.com", "example.net", ErrMdbAliasDomTarget},
+			{"ex..ample", "example.com", ErrMdbBadName},
+			{"pobox", "example.com", ErrMdbAliasDomClass},
+		} {
+			if _, err := tx.SetAliasDomain(c.name, c.target); err != c.want {
+				return fmt.Errorf("%s -> %s: expected %v, got %v", c.name, c.target, c.want, err)
+			}
+		}
+		if _, err = tx.InsertDomain("example.info"); err != nil {
+			return err
+		}
+		if _, err = tx.SetAliasDomain("example.biz", "example.info"); err != nil {
+			return err
+		}
+		if _, err = tx.SetAliasDomain("example.info", "example.com"); err != ErrMdbDomainIsTarget {
+			return fmt.Errorf("example.info -> example.com: expected ErrMdbDomainIsTarget, got %v", err)
+		}
+		if err := tx.DeleteAliasDomain("example.com"); err != ErrMdbNotAliasDomain {
+			return fmt.Errorf("delete example.com: expected ErrMdbNotAliasDomain, got %v", err)
+		}
+		if err := tx.DeleteDomain("example.com"); err != ErrMdbDomainBusy {
+			return fmt.Errorf("delete domain example.com: expected ErrMdbDomainBusy, got %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Alias domain mistakes: %s", err)
+	}
+
+	// Change the target, then delete
+	err = mdb.WithTx(func(tx *Tx) error {
+		d, err := tx.InsertDomain("example.co.uk")
+		if err == nil {
+			err = d.SetClass("vmailbox")
+		}
+		if err == nil {
+			_, err = tx.InsertVMailbox("user@example.co.uk")
+		}
+		if err == nil {
+			_, err = tx.SetAliasDomain("example.net", "example.co.uk")
+		}
+		return err
+	})
+	if err != nil {
+		t.Errorf("Change target: %s", err)
+	}
+	if v := virtuals("user", "example.net"); v != "user@example.co.uk" {
+		t.Errorf("virt_alias user@example.net after change: got %q", v)
+	}
+	err = mdb.WithTx(func(tx *Tx) error {
+		if err := tx.DeleteAliasDomain("example.net"); err != nil {
+			return err
+		}
+		return tx.DeleteAliasDomain("example.org")
+	})
+	if err != nil {
+		t.Errorf("Delete alias domains: %s", err)
+	}
+	if _, err = mdb.LookupDomain("example.net"); err != ErrMdbDomainNotFound {
+		t.Errorf("example.net after delete: expected ErrMdbDomainNotFound, got %v", err)
+	}
+	if d, err := mdb.LookupDomain("example.org"); err != nil || !d.IsVirtual() {
+		t.Errorf("example.org after delete: expected it kept for boss, got %v, %v", d, err)
+	}
+	if _, err = mdb.LookupAliasDomain("example.org"); err != ErrMdbNotAliasDomain {
+		t.Errorf("Lookup example.org: expected ErrMdbNotAliasDomain, got %v", err)
+	}
+	if v := virtuals("user", "example.org"); v != "" {
+		t.Errorf("virt_alias user@example.org after delete: got %q", v)
+	}
+	row := mdb.db.QueryRow("SELECT count(*) FROM audit WHERE entity = 'aliasdomain'")
+	if err = row.Scan(&cnt); err != nil || cnt != 6 {
+		t.Errorf("Alias domain audit: expected 6 records, got %d, %v", cnt, err)
+	}
+}
@@ -0,0 +1,248 @@
+package maildb
+
+/*
+ * Copyright (C) 2020, Jim Lieb <lieb@sea-troll.net>
+ *
+ * This program is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 3 of the License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ *
+ * -------------
+ */
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The audit trail is written by triggers in the schema. All we do here
+// is tell them who is making the changes at the start of every transaction
+// and clear it before commit. How that is done depends on the dialect.
+
+// AuditStampFormat
+// The format of the audit timestamps. They are always UTC.
+const AuditStampFormat = "2006-01-02 15:04:05"
+
+// AuditEntry
+type AuditEntry struct {
+	id      int64
+	stamp   string
+	user    sql.NullString
+	command sql.NullString
+	entity  string
+	op      string
+	key     sql.NullString
+	before  sql.NullString
+	after   sql.NullString
+}
+
+// AuditFilter
+// Select audit entries. Empty or zero fields match everything.
+// Key can have '*' wildcards like the Find* functions.
+type AuditFilter struct {
+	Entity string
+	Key    string
+	User   string
+	Since  time.Time
+	Until  time.Time
+}
+
+// loginUser
+// Who is really running this. On a shared root account the effective
+// user is no help so look for who became root, first by sudo and
+// then by the audit login uid the kernel keeps across su.
+func loginUser() string {
+	if su := os.Getenv("SUDO_USER"); su != "" {
+		return su
+	}
+	if b, err := os.ReadFile("/proc/self/loginuid"); err == nil {
+		uid := strings.TrimSpace(string(b))
+		// (uint32)-1 means not set, i.e. a daemon or no pam_loginuid
+		if uid != "" && uid != "4294967295" && uid != strconv.Itoa(os.Getuid()) {
+			if u, err := user.LookupId(uid); err == nil {
+				return u.Username
+			}
+			return uid
+		}
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return strconv.Itoa(os.Getuid())
+}
+
+// SetAuditInfo
+// Override who and what gets recorded in the audit trail.
+// The defaults are the login user and the program's command line.
+func (mdb *MailDB) SetAuditInfo(user string, command string) {
+	mdb.mu.Lock()
+	mdb.auditUser = user
+	mdb.auditCmd = command
+	mdb.mu.Unlock()
+}
+
+// auditing
+// Does this database have an audit trail? A custom schema may not.
+func (mdb *MailDB) auditing() bool {
+	mdb.mu.Lock()
+	defer mdb.mu.Unlock()
+
+	if mdb.audit == nil {
+		ok, err := mdb.hasTable(mdb.dialect.auditTable())
+		if err != nil {
+			return false // don't remember, the schema may not be loaded yet
+		}
+		mdb.audit = &ok
+	}
+	return *mdb.audit
+}
+
+// setAuditContext
+// tell the triggers who we are for this transaction
+func (mdb *MailDB) setAuditContext(ctx context.Context, tx *sql.Tx) error {
+	if !mdb.auditing() {
+		return nil
+	}
+	mdb.mu.Lock()
+	user, command := mdb.auditUser, mdb.auditCmd
+	mdb.mu.Unlock()
+	return mdb.dialect.setAuditContext(ctx, tx, user, command)
+}
+
+// clearAuditContext
+// don't leave our name on changes someone else makes outside postdove
+func (mdb *MailDB) clearAuditContext(ctx context.Context, tx *sql.Tx) error {
+	if !mdb.auditing() {
+		return nil
+	}
+	return mdb.dialect.clearAuditContext(ctx, tx)
+}
+
+// FindAudit
+// Return the audit entries that match the filter, oldest first.
+// No matches is not an error, just an empty list.
+func (mdb *MailDB) FindAudit(f *AuditFilter) ([]*AuditEntry, error) {
+	return mdb.FindAuditContext(context.Background(), f)
+}
+
+// FindAuditContext
+// FindAudit that gives up when ctx is done
+func (mdb *MailDB) FindAuditContext(ctx context.Context, f *AuditFilter) ([]*AuditEntry, error) {
+	var (
+		err   error
+		rows  *sql.Rows
+		al    []*AuditEntry
+		where []string
+		args  []interface{}
+	)
+
+	if f.Entity != "" {
+		where = append(where, "entity = ?")
+		args = append(args, strings.ToLower(f.Entity))
+	}
+	if f.Key != "" && f.Key != "*" {
+		where = append(where, "key LIKE ?")
+		args = append(args, strings.ReplaceAll(f.Key, "*", "%"))
+	}
+	if f.User != "" {
+		where = append(where, `"user" = ?`)
+		args = append(args, f.User)
+	}
+	if !f.Since.IsZero() {
+		where = append(where, "stamp >= ?")
+		args = append(args, f.Since.UTC().Format(AuditStampFormat))
+	}
+	if !f.Until.IsZero() {
+		where = append(where, "stamp < ?")
+		args = append(args, f.Until.UTC().Format(AuditStampFormat))
+	}
+	q := `SELECT id, stamp, "user", command, entity, op, key, before, after FROM audit`
+	if len(where) > 0 {
+		q += " WHERE " + strings.Join(where, " AND ")
+	}
+	q += " ORDER BY id"
+	if rows, err = mdb.db.QueryContext(ctx, q, args...); err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		e := &AuditEntry{}
+		if err = rows.Scan(&e.id, &e.stamp, &e.user, &e.command, &e.entity,
+			&e.op, &e.key, &e.before, &e.after); err != nil {
+			break
+		}
+		al = append(al, e)
+	}
+	if e := rows.Close(); e != nil {
+		if err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return al, nil
+}
+
+// Stamp
+// When it happened, in UTC
+func (e *AuditEntry) Stamp() time.Time {
+	t, err := time.ParseInLocation(AuditStampFormat, e.stamp, time.UTC)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// User
+func (e *AuditEntry) User() string {
+	return e.user.String
+}
+
+// Command
+func (e *AuditEntry) Command() string {
+	return e.command.String
+}
+
+// Entity
+// what kind of thing changed, e.g. domain or mailbox
+func (e *AuditEntry) Entity() string {
+	return e.entity
+}
+
+// Op
+// INSERT, UPDATE, or DELETE
+func (e *AuditEntry) Op() string {
+	return e.op
+}
+
+// Key
+func (e *AuditEntry) Key() string {
+	return e.key.String
+}
+
+// Before
+// JSON of the entity before the change, "" for an insert
+func (e *AuditEntry) Before() string {
+	return e.before.String
+}
+
+// After
+// JSON of the entity after the change, "" for a delete
+func (e *AuditEntry) After() string {
+	return e.after.String
+}
@@ -0,0 +1,186 @@
+package maildb
+
+/*
+ * Copyright (C) 2020, Jim Lieb <lieb@sea-troll.net>
+ *
+ * This program is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 3 of the License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ *
+ * -------------
+ */
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3" // do I really need this here?
+)
+
+// TestAudit
+func TestAudit(t *testing.T) {
+	var (
+		tx  *Tx
+		err error
+		mdb *MailDB
+		d   *Domain
+		a   *Address
+		mb  *VMailbox
+		dir string
+		al  []*AuditEntry
+	)
+
+	fmt.Printf("Audit Test\n")
+
+	dir, err = ioutil.TempDir("", "TestAudit-*")
+	defer os.RemoveAll(dir)
+	mdb, err = makeTestDB(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Errorf("Database load failed, %s", err)
+		return
+	}
+	defer mdb.Close()
+
+	// alice sets things up
+	mdb.SetAuditInfo("alice", "postdove add")
+	tx = beginTx(t, mdb)
+	if d, err = tx.InsertDomain("pobox.org"); err == nil {
+		err = d.SetClass("vmailbox")
+	}
+	if err == nil {
+		if mb, err = tx.InsertVMailbox("jeff@pobox.org"); err == nil {
+			err = mb.SetPassword("secret")
+		}
+	}
+	if err == nil {
+		if a, err = tx.InsertAddress("bob@example.com"); err == nil {
+			err = a.AttachAlias("jeff@pobox.org")
+		}
+	}
+	if err == nil {
+		err = a.AttachAlias("dave@example.net")
+	}
+	tx.End(&err)
+	if err != nil {
+		t.Errorf("Setup: unexpected error, %s", err)
+		return
+	}
+
+	al, err = mdb.FindAudit(&AuditFilter{User: "alice"})
+	if err != nil {
+		t.Errorf("Find alice: unexpected error, %s", err)
+	} else if len(al) == 0 {
+		t.Errorf("Find alice: expected audit entries, got none")
+	}
+	for _, e := range al {
+		if e.Command() != "postdove add" {
+			t.Errorf("Find alice: expected command 'postdove add', got %s", e.Command())
+		}
+		if strings.Contains(e.Before(), "secret") || strings.Contains(e.After(), "secret") {
+			t.Errorf("Find alice: password leaked into audit, %s -> %s", e.Before(), e.After())
+		}
+	}
+	al, err = mdb.FindAudit(&AuditFilter{Entity: "mailbox", Key: "jeff@*"})
+	if err != nil {
+		t.Errorf("Find jeff: unexpected error, %s", err)
+	} else if len(al) != 2 {
+		t.Errorf("Find jeff: expected insert and update, got %d", len(al))
+	} else if al[0].Op() != "INSERT" || al[1].Op() != "UPDATE" {
+		t.Errorf("Find jeff: expected INSERT, UPDATE, got %s, %s", al[0].Op(), al[1].Op())
+	} else if !strings.Contains(al[1].After(), `"password":"changed"`) {
+		t.Errorf("Find jeff: expected password change, got %s", al[1].After())
+	}
+
+	// The context must not outlive the transaction
+	row := mdb.db.QueryRow("SELECT count(*) FROM audit_context")
+	var cnt int
+	if err = row.Scan(&cnt); err != nil || cnt != 0 {
+		t.Errorf("Audit context: expected empty, got %d (%v)", cnt, err)
+	}
+
+	// bob removes the forwarding outside a transaction. The trigger cascades
+	// clean up the addresses and example.net and they get bob's name too.
+	mdb.SetAuditInfo("bob", "postdove delete virtual")
+	if err = mdb.WithTx(func(tx *Tx) error { return tx.RemoveAlias("bob@example.com") }); err != nil {
+		t.Errorf("Remove bob@example.com: unexpected error, %s", err)
+		return
+	}
+	al, err = mdb.FindAudit(&AuditFilter{User: "bob", Entity: "alias"})
+	if err != nil {
+		t.Errorf("Find bob alias: unexpected error, %s", err)
+	} else if len(al) != 2 {
+		t.Errorf("Find bob alias: expected 2 deletes, got %d", len(al))
+	} else {
+		for _, e := range al {
+			if e.Op() != "DELETE" || e.Key() != "bob@example.com" || e.After() != "" {
+				t.Errorf("Find bob alias: unexpected entry %s %s %s", e.Op(), e.Key(), e.After())
+			}
+			if e.Command() != "postdove delete virtual" {
+				t.Errorf("Find bob alias: unexpected command %s", e.Command())
+			}
+		}
+		if !strings.Contains(al[0].Before()+al[1].Before(), `"target":"dave@example.net"`) {
+			t.Errorf("Find bob alias: expected dave@example.net in %s, %s",
+				al[0].Before(), al[1].Before())
+		}
+	}
+	al, err = mdb.FindAudit(&AuditFilter{User: "bob", Entity: "address"})
+	if err != nil {
+		t.Errorf("Find bob address: unexpected error, %s", err)
+	} else {
+		keys := ""
+		for _, e := range al {
+			keys += e.Key() + " "
+		}
+		if !strings.Contains(keys, "bob@example.com") || !strings.Contains(keys, "dave@example.net") {
+			t.Errorf("Find bob address: expected cascaded deletes, got %s", keys)
+		}
+		if strings.Contains(keys, "jeff@pobox.org") {
+			t.Errorf("Find bob address: mailbox address should not be deleted, got %s", keys)
+		}
+	}
+	al, err = mdb.FindAudit(&AuditFilter{User: "bob", Entity: "domain"})
+	if err != nil {
+		t.Errorf("Find bob domain: unexpected error, %s", err)
+	} else if len(al) != 2 {
+		t.Errorf("Find bob domain: expected example.com and example.net deletes, got %d", len(al))
+	}
+
+	// time ranges
+	al, err = mdb.FindAudit(&AuditFilter{Since: time.Now().Add(time.Hour)})
+	if err != nil || len(al) != 0 {
+		t.Errorf("Find future: expected nothing, got %d (%v)", len(al), err)
+	}
+	al, err = mdb.FindAudit(&AuditFilter{Since: time.Now().Add(-time.Hour),
+		Until: time.Now().Add(time.Hour)})
+	if err != nil || len(al) == 0 {
+		t.Errorf("Find last hour: expected everything, got %d (%v)", len(al), err)
+	} else if al[0].Stamp().IsZero() {
+		t.Errorf("Find last hour: bad stamp")
+	}
+
+	// a failed change leaves no trace
+	mdb.SetAuditInfo("carol", "postdove delete mailbox")
+	if err = mdb.WithTx(func(tx *Tx) error { return tx.DeleteDomain("pobox.org") }); err != ErrMdbDomainBusy {
+		t.Errorf("Delete pobox.org: expected ErrMdbDomainBusy, got %v", err)
+	}
+	al, err = mdb.FindAudit(&AuditFilter{User: "carol"})
+	if err != nil || len(al) != 0 {
+		t.Errorf("Find carol: expected nothing, got %d (%v)", len(al), err)
+	}
+}
@@ -0,0 +1,364 @@
+package maildb
+
+/*
+ * Copyright (C) 2020, Jim Lieb <lieb@sea-troll.net>
+ *
+ * This program is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 3 of the License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ *
+ * -------------
+ */
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// backupStepPages
+// How many pages to copy at a time. Between steps the source is
+// unlocked so postfix and dovecot (and us) are never held up for long.
+// If someone writes to the source in between, the backup starts over so
+// the copy is always consistent.
+const backupStepPages = 256
+
+// the gzip header comment we leave in compressed backups
+const backupComment = "postdove schema version %d"
+
+// rawConn
+// get at the sqlite3 connection underneath database/sql
+func rawConn(ctx context.Context, db *sql.DB, fn func(*sqlite3.SQLiteConn) error) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Raw(func(dc interface{}) error {
+		c, ok := dc.(*sqlite3.SQLiteConn)
+		if !ok {
+			return fmt.Errorf("not a sqlite3 connection")
+		}
+		return fn(c)
+	})
+}
+
+// Backup
+// Make a consistent copy of the database to file using the sqlite
+// online backup API. The copy has its PRAGMA user_version set to the schema
+// version as well as having the schema_version table. If compress, the file is
+// gzipped. The file is written next to its final name and renamed into place
+// so a failed backup never leaves a partial file behind.
+// Return the schema version of the backup.
+func (mdb *MailDB) Backup(file string, compress bool) (int, error) {
+	return mdb.BackupContext(context.Background(), file, compress)
+}
+
+// BackupContext
+// Backup that gives up when ctx is done. Nothing is left behind.
+func (mdb *MailDB) BackupContext(ctx context.Context, file string, compress bool) (int, error) {
+	var (
+		version int
+		tmp     string
+		err     error
+	)
+
+	if !mdb.dialect.isFile() {
+		return 0, fmt.Errorf("Backup: %s, use the %s tools", ErrMdbNotFile, mdb.dialect.name())
+	}
+	if version, err = mdb.SchemaVersion(); err != nil {
+		return 0, err
+	}
+	if tmp, err = tempName(filepath.Dir(file), ".postdove-backup-*"); err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp)
+	if err = mdb.backupTo(ctx, tmp, version); err != nil {
+		return 0, fmt.Errorf("Backup: %s", err)
+	}
+	if compress {
+		var gz string
+
+		if gz, err = tempName(filepath.Dir(file), ".postdove-backup-*.gz"); err != nil {
+			return 0, err
+		}
+		defer os.Remove(gz)
+		if err = gzipFile(tmp, gz, version); err != nil {
+			return 0, fmt.Errorf("Backup: %s", err)
+		}
+		tmp = gz
+	}
+	if err = os.Chmod(tmp, 0600); err != nil { // it has passwords in it
+		return 0, err
+	}
+	if err = os.Rename(tmp, file); err != nil {
+		return 0, fmt.Errorf("Backup: %s", err)
+	}
+	return version, nil
+}
+
+// backupTo
+// do the sqlite backup to an empty file
+func (mdb *MailDB) backupTo(ctx context.Context, dest string, version int) error {
+	ddb, err := sql.Open("sqlite3", "file:"+dest)
+	if err != nil {
+		return err
+	}
+	defer ddb.Close()
+
+	err = rawConn(ctx, ddb, func(dc *sqlite3.SQLiteConn) error {
+		return rawConn(ctx, mdb.db, func(sc *sqlite3.SQLiteConn) error {
+			b, err := dc.Backup("main", sc, "main")
+			if err != nil {
+				return err
+			}
+			for {
+				done, err := b.Step(backupStepPages)
+				if err != nil {
+					b.Close()
+					return err
+				}
+				if done {
+					break
+				}
+				if err = ctx.Err(); err != nil {
+					b.Close()
+					return err
+				}
+				time.Sleep(time.Millisecond) // let others have a go
+			}
+			return b.Close()
+		})
+	})
+	if err != nil {
+		return err
+	}
+	_, err = ddb.Exec(fmt.Sprintf("PRAGMA user_version = %d", version))
+	return err
+}
+
+// tempName
+// a new, empty file in dir to be renamed later
+func tempName(dir string, pattern string) (string, error) {
+	f, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return "", err
+	}
+	name := f.Name()
+	if err = f.Close(); err != nil {
+		os.Remove(name)
+		return "", err
+	}
+	return name, nil
+}
+
+// gzipFile
+func gzipFile(src string, dest string, version int) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	zw.Comment = fmt.Sprintf(backupComment, version)
+	zw.ModTime = time.Now()
+	if _, err = io.Copy(zw, in); err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if e := out.Close(); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
+
+// copyBackup
+// Copy a backup, unzipping it if need be, to dest.
+func copyBackup(src string, dest string) error {
+	var r io.Reader
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	br := bufio.NewReader(in)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	} else {
+		r = br
+	}
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, r); err == nil {
+		err = out.Sync()
+	}
+	if e := out.Close(); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
+
+// checkBackup
+// Make sure a restored copy is sane and something we can use.
+// An older schema is migrated up to date. Return the version it had.
+func checkBackup(file string) (int, error) {
+	var (
+		res     string
+		version int
+	)
+
+	bdb, err := OpenMailDB(file)
+	if err != nil {
+		return 0, err
+	}
+	defer bdb.Close()
+
+	rows, err := bdb.db.Query("PRAGMA integrity_check")
+	if err != nil {
+		return 0, fmt.Errorf("%s, %s", ErrMdbBadBackup, err)
+	}
+	for rows.Next() {
+		if err = rows.Scan(&res); err != nil || res != "ok" {
+			break
+		}
+	}
+	rows.Close()
+	if err != nil {
+		return 0, fmt.Errorf("%s, %s", ErrMdbBadBackup, err)
+	} else if res != "ok" {
+		return 0, fmt.Errorf("%s, %s", ErrMdbBadBackup, res)
+	}
+	rows, err = bdb.db.Query("PRAGMA foreign_key_check")
+	if err != nil {
+		return 0, fmt.Errorf("%s, %s", ErrMdbBadBackup, err)
+	}
+	bad := rows.Next()
+	rows.Close()
+	if bad {
+		return 0, fmt.Errorf("%s, foreign key violations", ErrMdbBadBackup)
+	}
+	if version, err = bdb.SchemaVersion(); err != nil {
+		return 0, err
+	}
+	if version == 0 {
+		return 0, fmt.Errorf("%s, no postdove schema", ErrMdbBadBackup)
+	}
+	if version > DbSchemaVersion {
+		return 0, ErrMdbSchemaNew
+	}
+	if _, err = bdb.Migrate(false); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// Restore
+// Replace the contents of the database with a backup file, gzipped or not.
+// The backup is copied next to the database and checked, and then copied into
+// the live database with the sqlite online backup API. The copy is done in one
+// write transaction on the database so postfix and dovecot, which keep their own
+// connections, see either the old contents or the restored ones and
+// nothing in between. The database file keeps its ownership and mode.
+// Return the schema version of the backup.
+func (mdb *MailDB) Restore(file string) (int, error) {
+	var (
+		version int
+		tmp     string
+		err     error
+	)
+
+	mdb.mu.Lock()
+	busy := mdb.txCount > 0
+	mdb.mu.Unlock()
+	if busy {
+		return 0, ErrMdbInTransaction
+	}
+	if !mdb.dialect.isFile() {
+		return 0, fmt.Errorf("Restore: %s, use the %s tools", ErrMdbNotFile, mdb.dialect.name())
+	}
+	if tmp, err = tempName(filepath.Dir(mdb.path), ".postdove-restore-*"); err != nil {
+		return 0, err
+	}
+	defer func() {
+		for _, suffix := range []string{"", "-journal", "-wal", "-shm"} {
+			os.Remove(tmp + suffix)
+		}
+	}()
+	if err = copyBackup(file, tmp); err != nil {
+		return 0, fmt.Errorf("Restore: %s", err)
+	}
+	if version, err = checkBackup(tmp); err != nil {
+		return 0, fmt.Errorf("Restore: %s", err)
+	}
+	if err = mdb.restoreFrom(tmp); err != nil {
+		if IsErrBusy(err) {
+			return 0, ErrMdbDbBusy
+		}
+		return 0, fmt.Errorf("Restore: %s", err)
+	}
+	mdb.mu.Lock()
+	mdb.dflts = make(map[string]TableInfo)
+	mdb.audit = nil
+	mdb.mu.Unlock()
+	return version, nil
+}
+
+// restoreFrom
+// do the sqlite backup from a checked copy into the database.
+// All of it in one step so another writer cannot get in part way.
+// A writer that holds the database past the busy timeout makes it fail
+// and the database is left as it was.
+func (mdb *MailDB) restoreFrom(src string) error {
+	ctx := context.Background()
+	sdb, err := sql.Open("sqlite3", "file:"+src+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer sdb.Close()
+
+	return rawConn(ctx, mdb.db, func(dc *sqlite3.SQLiteConn) error {
+		return rawConn(ctx, sdb, func(sc *sqlite3.SQLiteConn) error {
+			b, err := dc.Backup("main", sc, "main")
+			if err != nil {
+				return err
+			}
+			if _, err = b.Step(-1); err != nil {
+				b.Close()
+				return err
+			}
+			return b.Close()
+		})
+	})
+}
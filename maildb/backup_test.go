@@ -0,0 +1,232 @@
+package maildb
+
+/*
+ * Copyright (C) 2020, Jim Lieb <lieb@sea-troll.net>
+ *
+ * This program is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 3 of the License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ *
+ * -------------
+ */
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3" // do I really need this here?
+)
+
+// TestBackup
+func TestBackup(t *testing.T) {
+	var (
+		tx      *Tx
+		err     error
+		mdb     *MailDB
+		bdb     *MailDB
+		dir     string
+		version int
+	)
+
+	fmt.Printf("Backup Test\n")
+
+	dir, err = ioutil.TempDir("", "TestBackup-*")
+	defer os.RemoveAll(dir)
+	dbFile := filepath.Join(dir, "test.db")
+	mdb, err = makeTestDB(dbFile)
+	if err != nil {
+		t.Errorf("Database load failed, %s", err)
+		return
+	}
+	defer mdb.Close()
+	if err = os.Chmod(dbFile, 0640); err != nil {
+		t.Errorf("Chmod: %s", err)
+		return
+	}
+
+	tx = beginTx(t, mdb)
+	_, err = tx.InsertDomain("pobox.org")
+	tx.End(&err)
+	if err != nil {
+		t.Errorf("Insert of pobox.org failed, %s", err)
+		return
+	}
+
+	// Plain and compressed backups
+	plain := filepath.Join(dir, "plain.backup")
+	if version, err = mdb.Backup(plain, false); err != nil {
+		t.Errorf("Backup: unexpected error, %s", err)
+		return
+	} else if version != DbSchemaVersion {
+		t.Errorf("Backup: expected version %d, got %d", DbSchemaVersion, version)
+	}
+	if bdb, err = NewMailDB(plain); err != nil {
+		t.Errorf("Open backup: unexpected error, %s", err)
+	} else {
+		var uv int
+
+		if _, err = bdb.LookupDomain("pobox.org"); err != nil {
+			t.Errorf("Backup: pobox.org missing, %s", err)
+		}
+		row := bdb.db.QueryRow("PRAGMA user_version")
+		if err = row.Scan(&uv); err != nil || uv != DbSchemaVersion {
+			t.Errorf("Backup: expected user_version %d, got %d (%v)", DbSchemaVersion, uv, err)
+		}
+		bdb.Close()
+	}
+	if fi, err := os.Stat(plain); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("Backup: expected mode 0600, got %v (%v)", fi.Mode(), err)
+	}
+
+	zipped := filepath.Join(dir, "zipped.backup.gz")
+	if _, err = mdb.Backup(zipped, true); err != nil {
+		t.Errorf("Backup gzip: unexpected error, %s", err)
+		return
+	}
+	if f, err := os.Open(zipped); err != nil {
+		t.Errorf("Open gzip: %s", err)
+	} else {
+		if zr, err := gzip.NewReader(f); err != nil {
+			t.Errorf("Backup gzip: not gzipped, %s", err)
+		} else if zr.Comment != fmt.Sprintf(backupComment, DbSchemaVersion) {
+			t.Errorf("Backup gzip: expected version comment, got %s", zr.Comment)
+		}
+		f.Close()
+	}
+
+	// Now mess up the live one and restore it
+	if err = mdb.WithTx(func(tx *Tx) error { return tx.DeleteDomain("pobox.org") }); err != nil {
+		t.Errorf("Delete pobox.org: unexpected error, %s", err)
+	}
+	if version, err = mdb.Restore(zipped); err != nil {
+		t.Errorf("Restore: unexpected error, %s", err)
+		return
+	} else if version != DbSchemaVersion {
+		t.Errorf("Restore: expected version %d, got %d", DbSchemaVersion, version)
+	}
+	if _, err = mdb.LookupDomain("pobox.org"); err != nil {
+		t.Errorf("Restore: pobox.org missing, %s", err)
+	}
+	if fi, err := os.Stat(dbFile); err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("Restore: expected mode 0640, got %v (%v)", fi.Mode(), err)
+	}
+	if m, _ := filepath.Glob(filepath.Join(dir, ".postdove-*")); len(m) > 0 {
+		t.Errorf("Restore: left temp files behind, %v", m)
+	}
+
+	// junk is refused and the live database is untouched
+	junk := filepath.Join(dir, "junk")
+	if err = ioutil.WriteFile(junk, []byte("this is not a database\n"), 0600); err != nil {
+		t.Errorf("Write junk: %s", err)
+	}
+	if _, err = mdb.Restore(junk); err == nil {
+		t.Errorf("Restore junk: should have failed")
+	}
+	if _, err = mdb.LookupDomain("pobox.org"); err != nil {
+		t.Errorf("Restore junk: pobox.org missing, %s", err)
+	}
+
+	// so is a backup from a newer postdove
+	if bdb, err = NewMailDB(plain); err == nil {
+		_, err = bdb.db.Exec("INSERT INTO schema_version (version) VALUES (?)", DbSchemaVersion+1)
+		bdb.Close()
+	}
+	if err != nil {
+		t.Errorf("Make newer backup: %s", err)
+	}
+	if _, err = mdb.Restore(plain); err == nil {
+		t.Errorf("Restore newer: should have failed")
+	} else if !strings.Contains(err.Error(), ErrMdbSchemaNew.Error()) {
+		t.Errorf("Restore newer: expected ErrMdbSchemaNew, got %s", err)
+	}
+
+	// but an older one is brought up to date
+	if bdb, err = OpenMailDB(plain); err == nil {
+		if _, err = bdb.db.Exec("DROP TABLE schema_version"); err == nil {
+			err = downgrade(bdb)
+		}
+		bdb.Close()
+	}
+	if err != nil {
+		t.Errorf("Make older backup: %s", err)
+	}
+	if version, err = mdb.Restore(plain); err != nil {
+		t.Errorf("Restore older: unexpected error, %s", err)
+	} else if version != legacySchema {
+		t.Errorf("Restore older: expected version %d, got %d", legacySchema, version)
+	}
+	if err = mdb.CheckSchema(); err != nil {
+		t.Errorf("Restore older: not migrated, %s", err)
+	}
+
+	// In WAL mode a reader, e.g. postfix, keeps its view until it is done
+	// and a writer holds the restore off
+	if err = mdb.EnableWAL(); err == nil {
+		err = mdb.SetBusyTimeout(50 * time.Millisecond)
+	}
+	if err == nil {
+		err = mdb.WithTx(func(tx *Tx) error { return tx.DeleteDomain("pobox.org") })
+	}
+	if err != nil {
+		t.Fatalf("WAL mode: %s", err)
+	}
+	rdb, err := sql.Open("sqlite3", "file:"+dbFile)
+	if err != nil {
+		t.Fatalf("Open reader: %s", err)
+	}
+	defer rdb.Close()
+	rdb.SetMaxOpenConns(1)
+	wtx, err := rdb.Begin()
+	if err == nil {
+		_, err = wtx.Exec("INSERT INTO access (name, action) VALUES ('held', 'REJECT')")
+	}
+	if err != nil {
+		t.Fatalf("Writer: %s", err)
+	}
+	if _, err = mdb.Restore(zipped); err != ErrMdbDbBusy {
+		t.Errorf("Restore with a writer: expected ErrMdbDbBusy, got %v", err)
+	}
+	if _, err = mdb.LookupDomain("pobox.org"); err != ErrMdbDomainNotFound {
+		t.Errorf("Restore with a writer: expected the live database, got %v", err)
+	}
+	wtx.Rollback()
+
+	var cnt int
+	rtx, err := rdb.Begin()
+	if err == nil {
+		err = rtx.QueryRow("SELECT count(*) FROM domain WHERE name = 'pobox.org'").Scan(&cnt)
+	}
+	if err != nil {
+		t.Fatalf("Reader: %s", err)
+	}
+	if _, err = mdb.Restore(zipped); err != nil {
+		t.Errorf("Restore with a reader: unexpected error, %s", err)
+	}
+	if _, err = mdb.LookupDomain("pobox.org"); err != nil {
+		t.Errorf("Restore with a reader: pobox.org missing, %s", err)
+	}
+	if err = rtx.QueryRow("SELECT count(*) FROM domain WHERE name = 'pobox.org'").Scan(&cnt); err != nil || cnt != 0 {
+		t.Errorf("Restore with a reader: reader should still see its view, got %d (%v)", cnt, err)
+	}
+	rtx.Rollback()
+	if err = rdb.QueryRow("SELECT count(*) FROM domain WHERE name = 'pobox.org'").Scan(&cnt); err != nil || cnt != 1 {
+		t.Errorf("Restore with a reader: reader should now see pobox.org, got %d (%v)", cnt, err)
+	}
+}
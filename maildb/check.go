@@ -0,0 +1,466 @@
+package maildb
+
+/*
+ * Copyright (C) 2020, Jim Lieb <lieb@sea-troll.net>
+ *
+ * This program is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 3 of the License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ *
+ * -------------
+ */
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Severity of a check finding
+type Severity int
+
+const (
+	SevInfo    Severity = iota // worth knowing, nothing is broken
+	SevWarning                 // clutter or something that will break later
+	SevError                   // mail is or will be lost or misdirected
+)
+
+// severity names
+var severityName = map[Severity]string{
+	SevInfo:    "info",
+	SevWarning: "warning",
+	SevError:   "error",
+}
+
+// String
+func (s Severity) String() string {
+	return severityName[s]
+}
+
+// Finding
+// One problem found by Check. If it is safe to fix, repair is
+// the statement that does it and args are its arguments.
+type Finding struct {
+	severity Severity
+	check    string
+	key      string
+	message  string
+	repair   string
+	args     []interface{}
+}
+
+// Severity
+func (f *Finding) Severity() Severity {
+	return f.severity
+}
+
+// Check
+// the name of the check that found it
+func (f *Finding) Check() string {
+	return f.check
+}
+
+// Key
+// the thing that has the problem
+func (f *Finding) Key() string {
+	return f.key
+}
+
+// Message
+func (f *Finding) Message() string {
+	return f.message
+}
+
+// Repairable
+func (f *Finding) Repairable() bool {
+	return f.repair != ""
+}
+
+// String
+func (f *Finding) String() string {
+	return fmt.Sprintf("%s\t%s\t%s\t%s", f.severity, f.check, f.key, f.message)
+}
+
+// a check is a function that adds its findings
+type checkFunc func(ctx context.Context, mdb *MailDB) ([]*Finding, error)
+
+// the checks in the order we run them. The database level ones come
+// first because if they fail the rest may not make sense.
+var checks = []checkFunc{
+	checkIntegrity,
+	checkForeignKeys,
+	checkOrphanAddresses,
+	checkDanglingAliases,
+	checkUnresolvedTargets,
+	checkMailboxDomains,
+	checkMailboxIds,
+	checkUnusedTransports,
+	checkUnusedAccess,
+	checkAliasLoops,
+}
+
+// Check
+// Run all the consistency checks and return what they found.
+// No findings is a clean database.
+func (mdb *MailDB) Check() ([]*Finding, error) {
+	return mdb.CheckContext(context.Background())
+}
+
+// CheckContext
+// Check that gives up when ctx is done
+func (mdb *MailDB) CheckContext(ctx context.Context) ([]*Finding, error) {
+	var fl []*Finding
+
+	for _, c := range checks {
+		f, err := c(ctx, mdb)
+		if err != nil {
+			return nil, fmt.Errorf("Check: %s", err)
+		}
+		fl = append(fl, f...)
+	}
+	return fl, nil
+}
+
+// Repair
+// Run the checks and fix the findings that are safe to fix, all in one
+// transaction. Each fix is tried in a savepoint so one that trips over a
+// constraint or trigger is left alone rather than spoiling the rest.
+// Return the findings that were repaired.
+func (mdb *MailDB) Repair() (fixed []*Finding, err error) {
+	return mdb.RepairContext(context.Background())
+}
+
+// RepairContext
+// Repair that gives up, and rolls back, when ctx is done
+func (mdb *MailDB) RepairContext(ctx context.Context) (fixed []*Finding, err error) {
+	var fl []*Finding
+
+	if fl, err = mdb.CheckContext(ctx); err != nil {
+		return nil, err
+	}
+	tx, err := mdb.BeginContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.End(&err)
+
+	for _, f := range fl {
+		if !f.Repairable() {
+			continue
+		}
+		if _, err = tx.exec("SAVEPOINT repair"); err != nil {
+			return nil, err
+		}
+		if _, e := tx.exec(f.repair, f.args...); e != nil {
+			_, err = tx.exec("ROLLBACK TO repair")
+		} else {
+			fixed = append(fixed, f)
+		}
+		if err == nil {
+			_, err = tx.exec("RELEASE repair")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fixed, nil
+}
+
+// queryFindings
+// Turn the rows of q into findings. The first column is the key and the
+// optional second is the id passed to the repair statement.
+func (mdb *MailDB) queryFindings(ctx context.Context, sev Severity, check string, msg string,
+	repair string, q string) ([]*Finding, error) {
+	var (
+		fl   []*Finding
+		key  string
+		id   int64
+		cols []string
+	)
+
+	rows, err := mdb.db.QueryContext(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	if cols, err = rows.Columns(); err != nil {
+		rows.Close()
+		return nil, err
+	}
+	for rows.Next() {
+		f := &Finding{severity: sev, check: check, message: msg}
+		if len(cols) > 1 {
+			err = rows.Scan(&key, &id)
+		} else {
+			err = rows.Scan(&key)
+		}
+		if err != nil {
+			break
+		}
+		f.key = key
+		if repair != "" {
+			f.repair = repair
+			f.args = []interface{}{id}
+		}
+		fl = append(fl, f)
+	}
+	if e := rows.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err != nil {
+		return nil, err
+	}
+	return fl, nil
+}
+
+// checkIntegrity
+// The engine's own check of the file. This is the serious stuff.
+func checkIntegrity(ctx context.Context, mdb *MailDB) ([]*Finding, error) {
+	q := mdb.dialect.integrityQuery()
+	if q == "" {
+		return nil, nil
+	}
+	fl, err := mdb.queryFindings(ctx, SevError, "integrity", "database file is damaged", "", q)
+	if err != nil {
+		return nil, err
+	}
+	if len(fl) == 1 && fl[0].key == "ok" {
+		return nil, nil
+	}
+	for _, f := range fl { // the key is the problem so swap them
+		f.message, f.key = f.key, "database"
+	}
+	return fl, nil
+}
+
+// checkForeignKeys
+// These can only happen if someone edited with foreign keys off
+func checkForeignKeys(ctx context.Context, mdb *MailDB) ([]*Finding, error) {
+	q := mdb.dialect.foreignKeyQuery()
+	if q == "" {
+		return nil, nil
+	}
+	return mdb.queryFindings(ctx, SevError, "foreign-key", "references a missing row", "", q)
+}
+
+// checkOrphanAddresses
+// An address that nothing uses and that has no properties of its own.
+// The triggers normally clean these up.
+func checkOrphanAddresses(ctx context.Context, mdb *MailDB) ([]*Finding, error) {
+	return mdb.queryFindings(ctx, SevWarning, "orphan-address",
+		"address is not an alias, recipient, or mailbox",
+		"DELETE FROM address WHERE id = ?", `
+SELECT an.name, a.id FROM address AS a JOIN address_name AS an ON (an.id = a.id)
+  WHERE a.transport IS NULL AND a.access IS NULL
+    AND NOT EXISTS (SELECT 1 FROM alias WHERE address = a.id)
+    AND NOT EXISTS (SELECT 1 FROM alias WHERE target = a.id)
+    AND NOT EXISTS (SELECT 1 FROM vmailbox WHERE id = a.id)
+  ORDER BY an.name`)
+}
+
+// checkDanglingAliases
+// An alias row pointing at an address that is gone. It can't deliver
+// anything so it is safe to remove.
+func checkDanglingAliases(ctx context.Context, mdb *MailDB) ([]*Finding, error) {
+	return mdb.queryFindings(ctx, SevError, "dangling-alias",
+		"alias or its recipient address no longer exists",
+		"DELETE FROM alias WHERE id = ?", `
+SELECT COALESCE(an.name, '#' || al.address) || ' -> ' ||
+       COALESCE(tn.name, '#' || al.target, al.extension), al.id
+  FROM alias AS al
+  LEFT JOIN address_name AS an ON (an.id = al.address)
+  LEFT JOIN address_name AS tn ON (tn.id = al.target)
+  WHERE an.id IS NULL OR (al.target IS NOT NULL AND tn.id IS NULL)
+  ORDER BY 1`)
+}
+
+// checkUnresolvedTargets
+// An alias recipient in one of our vmailbox domains that is neither a
+// mailbox nor an alias itself. Postfix will bounce it.
+func checkUnresolvedTargets(ctx context.Context, mdb *MailDB) ([]*Finding, error) {
+	return mdb.queryFindings(ctx, SevError, "unresolved-target",
+		"recipient is in a vmailbox domain but is not a mailbox or alias", "", `
+SELECT DISTINCT an.name || ' -> ' || tn.name
+  FROM alias AS al
+  JOIN address_name AS an ON (an.id = al.address)
+  JOIN address_name AS tn ON (tn.id = al.target)
+  JOIN address AS ta ON (ta.id = al.target)
+  JOIN domain AS d ON (d.id = ta.domain)
+  WHERE d.class = 4
+    AND NOT EXISTS (SELECT 1 FROM vmailbox WHERE id = al.target)
+    AND NOT EXISTS (SELECT 1 FROM alias WHERE address = al.target)
+  ORDER BY 1`)
+}
+
+// checkMailboxDomains
+// Dovecot mailboxes only belong in vmailbox domains
+func checkMailboxDomains(ctx context.Context, mdb *MailDB) ([]*Finding, error) {
+	return mdb.queryFindings(ctx, SevError, "mailbox-domain",
+		"mailbox is not in a vmailbox domain", "", `
+SELECT an.name
+  FROM vmailbox AS mb
+  JOIN address AS a ON (a.id = mb.id)
+  JOIN address_name AS an ON (an.id = mb.id)
+  LEFT JOIN domain AS d ON (d.id = a.domain)
+  WHERE d.id IS NULL OR d.class != 4
+  ORDER BY an.name`)
+}
+
+// checkMailboxIds
+// The mailbox, its domain, and localhost all failed to supply a uid or gid.
+// Dovecot will refuse the login.
+func checkMailboxIds(ctx context.Context, mdb *MailDB) ([]*Finding, error) {
+	return mdb.queryFindings(ctx, SevError, "mailbox-ids",
+		"mailbox has no uid or gid from itself, its domain, or localhost", "", `
+SELECT username || '@' || domain FROM user_mailbox
+  WHERE uid IS NULL OR gid IS NULL
+  ORDER BY 1`)
+}
+
+// checkUnusedTransports
+func checkUnusedTransports(ctx context.Context, mdb *MailDB) ([]*Finding, error) {
+	return mdb.queryFindings(ctx, SevInfo, "unused-transport",
+		"transport is not used by any domain or address", "", `
+SELECT name FROM transport AS t
+  WHERE NOT EXISTS (SELECT 1 FROM domain WHERE transport = t.id)
+    AND NOT EXISTS (SELECT 1 FROM address WHERE transport = t.id)
+  ORDER BY name`)
+}
+
+// checkUnusedAccess
+func checkUnusedAccess(ctx context.Context, mdb *MailDB) ([]*Finding, error) {
+	return mdb.queryFindings(ctx, SevInfo, "unused-access",
+		"access rule is not used by any domain or address", "", `
+SELECT name FROM access AS ac
+  WHERE NOT EXISTS (SELECT 1 FROM domain WHERE access = ac.id)
+    AND NOT EXISTS (SELECT 1 FROM address WHERE access = ac.id)
+  ORDER BY name`)
+}
+
+// the longest alias chain we follow looking for loops
+const maxAliasDepth = 32
+
+// checkAliasLoops
+// Walk the alias graph from each alias and see if we get back to where we
+// started. Postfix will bounce anything sent into one of these. Each loop is
+// reported once, starting from its lowest numbered address.
+func checkAliasLoops(ctx context.Context, mdb *MailDB) ([]*Finding, error) {
+	var (
+		fl    []*Finding
+		paths []string
+		path  string
+		err   error
+	)
+
+	q := `
+WITH RECURSIVE walk(start, node, path, depth) AS (
+  SELECT DISTINCT address, address, ',' || address || ',', 0 FROM alias
+  UNION ALL
+  SELECT w.start, al.target, w.path || al.target || ',', w.depth + 1
+    FROM walk AS w JOIN alias AS al ON (al.address = w.node)
+    WHERE al.target IS NOT NULL AND w.depth < ?
+      AND w.path NOT LIKE '%,' || al.target || ',%'
+)
+SELECT w.path FROM walk AS w JOIN alias AS al ON (al.address = w.node)
+  WHERE al.target = w.start`
+	rows, err := mdb.db.QueryContext(ctx, q, maxAliasDepth)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		if err = rows.Scan(&path); err != nil {
+			break
+		}
+		paths = append(paths, path)
+	}
+	if e := rows.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	names, err := mdb.addressNames(ctx)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, p := range paths {
+		var ids []int64
+
+		for _, s := range strings.Split(strings.Trim(p, ","), ",") {
+			if id, err := strconv.ParseInt(s, 10, 64); err == nil {
+				ids = append(ids, id)
+			}
+		}
+		// rotate so the lowest id is first and we only report it once
+		low := 0
+		for i, id := range ids {
+			if id < ids[low] {
+				low = i
+			}
+		}
+		ids = append(ids[low:], ids[:low]...)
+		var loop []string
+		for _, id := range ids {
+			loop = append(loop, names[id])
+		}
+		loop = append(loop, names[ids[0]])
+		key := strings.Join(loop, " -> ")
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		fl = append(fl, &Finding{
+			severity: SevError,
+			check:    "alias-loop",
+			key:      key,
+			message:  "aliases loop back on themselves",
+		})
+	}
+	sort.Slice(fl, func(i, j int) bool { return fl[i].key < fl[j].key })
+	return fl, nil
+}
+
+// addressNames
+// map of address id to its full name
+func (mdb *MailDB) addressNames(ctx context.Context) (map[int64]string, error) {
+	var (
+		id   int64
+		name sql.NullString
+		err  error
+	)
+
+	names := make(map[int64]string)
+	rows, err := mdb.db.QueryContext(ctx, "SELECT id, name FROM address_name")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		if err = rows.Scan(&id, &name); err != nil {
+			break
+		}
+		names[id] = name.String
+	}
+	if e := rows.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
@@ -0,0 +1,205 @@
+package maildb
+
+/*
+ * Copyright (C) 2020, Jim Lieb <lieb@sea-troll.net>
+ *
+ * This program is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 3 of the License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ *
+ * -------------
+ */
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3" // do I really need this here?
+)
+
+// findingsByCheck
+func findingsByCheck(fl []*Finding) map[string][]*Finding {
+	m := make(map[string][]*Finding)
+	for _, f := range fl {
+		m[f.Check()] = append(m[f.Check()], f)
+	}
+	return m
+}
+
+// TestCheck
+func TestCheck(t *testing.T) {
+	var (
+		tx    *Tx
+		err   error
+		mdb   *MailDB
+		d     *Domain
+		mb    *VMailbox
+		dir   string
+		fl    []*Finding
+		fixed []*Finding
+	)
+
+	fmt.Printf("Check Test\n")
+
+	dir, err = ioutil.TempDir("", "TestCheck-*")
+	defer os.RemoveAll(dir)
+	dbFile := filepath.Join(dir, "test.db")
+	mdb, err = makeTestDB(dbFile)
+	if err != nil {
+		t.Errorf("Database load failed, %s", err)
+		return
+	}
+	defer mdb.Close()
+
+	// A new database is clean
+	if fl, err = mdb.Check(); err != nil {
+		t.Errorf("Check empty: unexpected error, %s", err)
+	} else if len(fl) != 0 {
+		t.Errorf("Check empty: expected no findings, got %v", fl)
+	}
+
+	// Build something sane through the API
+	tx = beginTx(t, mdb)
+	if d, err = tx.InsertDomain("pobox.org"); err == nil {
+		err = d.SetClass("vmailbox")
+	}
+	if err == nil {
+		if mb, err = tx.InsertVMailbox("jeff@pobox.org"); err == nil {
+			if err = mb.SetUid(500); err == nil {
+				err = mb.SetGid(500)
+			}
+		}
+	}
+	if err == nil {
+		_, err = tx.InsertDomain("bad.org")
+	}
+	if err == nil {
+		_, err = tx.InsertTransport("spare")
+	}
+	if err == nil {
+		_, err = tx.InsertAccess("spare", "REJECT")
+	}
+	tx.End(&err)
+	if err != nil {
+		t.Errorf("Setup: unexpected error, %s", err)
+		return
+	}
+	if fl, err = mdb.Check(); err != nil {
+		t.Errorf("Check sane: unexpected error, %s", err)
+	} else {
+		m := findingsByCheck(fl)
+		if len(m["unused-transport"]) != 1 || len(m["unused-access"]) != 1 || len(fl) != 2 {
+			t.Errorf("Check sane: expected only unused transport and access, got %v", fl)
+		}
+	}
+
+	// Now hand edit it the way we found it, i.e. with foreign keys off
+	raw, err := sql.Open("sqlite3", "file:"+dbFile)
+	if err != nil {
+		t.Errorf("Raw open: %s", err)
+		return
+	}
+	defer raw.Close()
+	edits := []string{
+		// an orphan
+		"INSERT INTO address (id, localpart) VALUES (100, 'lonely')",
+		// a mailbox in an internet domain and no uid or gid anywhere
+		"INSERT INTO address (id, localpart, domain) VALUES (101, 'wrong', (SELECT id FROM domain WHERE name = 'bad.org'))",
+		"INSERT INTO vmailbox (id) VALUES (101)",
+		// a loop
+		"INSERT INTO address (id, localpart) VALUES (102, 'ping')",
+		"INSERT INTO address (id, localpart) VALUES (103, 'pong')",
+		"INSERT INTO alias (address, target) VALUES (102, 103)",
+		"INSERT INTO alias (address, target) VALUES (103, 102)",
+		// a dangling target
+		"INSERT INTO address (id, localpart) VALUES (104, 'gone')",
+		"INSERT INTO alias (id, address, target) VALUES (200, 104, 9999)",
+		// a recipient without a mailbox
+		"INSERT INTO address (id, localpart) VALUES (105, 'info')",
+		"INSERT INTO address (id, localpart, domain) VALUES (106, 'ghost', (SELECT id FROM domain WHERE name = 'pobox.org'))",
+		"INSERT INTO alias (address, target) VALUES (105, 106)",
+		// a dangling target that is itself a recipient so removing it
+		// would cascade into a constraint. Repair must leave it be.
+		"INSERT INTO address (id, localpart) VALUES (107, 'relay')",
+		"INSERT INTO alias (id, address, target) VALUES (300, 107, 9998)",
+		"INSERT INTO alias (address, target) VALUES (105, 107)",
+	}
+	for _, e := range edits {
+		if _, err = raw.Exec(e); err != nil {
+			t.Errorf("Hand edit %s: %s", e, err)
+			return
+		}
+	}
+
+	if fl, err = mdb.Check(); err != nil {
+		t.Errorf("Check edited: unexpected error, %s", err)
+		return
+	}
+	m := findingsByCheck(fl)
+	expect := map[string]string{
+		"orphan-address":    "lonely",
+		"unresolved-target": "info -> ghost@pobox.org",
+		"mailbox-domain":    "wrong@bad.org",
+		"mailbox-ids":       "wrong@bad.org",
+		"alias-loop":        "ping -> pong -> ping",
+	}
+	for c, k := range expect {
+		if len(m[c]) != 1 {
+			t.Errorf("Check edited: expected one %s, got %v", c, m[c])
+		} else if m[c][0].Key() != k {
+			t.Errorf("Check edited: expected %s key %s, got %s", c, k, m[c][0].Key())
+		}
+	}
+	if len(m["foreign-key"]) != 2 || len(m["dangling-alias"]) != 2 {
+		t.Errorf("Check edited: expected two foreign key and dangling findings, got %v, %v",
+			m["foreign-key"], m["dangling-alias"])
+	} else if m["dangling-alias"][0].Key() != "gone -> #9999" ||
+		m["dangling-alias"][1].Key() != "relay -> #9998" {
+		t.Errorf("Check edited: unexpected dangling keys %s, %s",
+			m["dangling-alias"][0].Key(), m["dangling-alias"][1].Key())
+	}
+	if len(m["integrity"]) != 0 {
+		t.Errorf("Check edited: did not expect integrity errors, got %v", m["integrity"])
+	}
+	if len(m["alias-loop"]) == 1 && m["alias-loop"][0].Severity() != SevError {
+		t.Errorf("Check edited: alias loop should be an error")
+	}
+
+	// Fix what can be fixed
+	if fixed, err = mdb.Repair(); err != nil {
+		t.Errorf("Repair: unexpected error, %s", err)
+		return
+	}
+	m = findingsByCheck(fixed)
+	if len(m["orphan-address"]) != 1 || len(m["dangling-alias"]) != 1 || len(fixed) != 2 {
+		t.Errorf("Repair: expected orphan and dangling fixed, got %v", fixed)
+	}
+	if fl, err = mdb.Check(); err != nil {
+		t.Errorf("Check repaired: unexpected error, %s", err)
+		return
+	}
+	m = findingsByCheck(fl)
+	if len(m["orphan-address"]) != 0 {
+		t.Errorf("Check repaired: orphan still there, %v", m["orphan-address"])
+	}
+	for _, c := range []string{"foreign-key", "dangling-alias", "unresolved-target",
+		"mailbox-domain", "mailbox-ids", "alias-loop"} {
+		if len(m[c]) != 1 {
+			t.Errorf("Check repaired: expected %s to be left alone, got %v", c, m[c])
+		}
+	}
+}
@@ -0,0 +1,440 @@
+package maildb
+
+/*
+ * Copyright (C) 2020, Jim Lieb <lieb@sea-troll.net>
+ *
+ * This program is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 3 of the License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ *
+ * -------------
+ */
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// Credential
+// An extra password for a mailbox, e.g. an application password
+// for a phone. The times are UTC in AuditStampFormat.
+type Credential struct {
+	mdb       *MailDB
+	tx        *Tx // nil unless from a transaction
+	id        int64
+	user      string
+	label     string
+	pw_type   string
+	password  string
+	created   string
+	lastUsed  sql.NullString
+	lastLogin sql.NullInt64 // unix time from CredentialLogin
+	expires   sql.NullString
+	allow     [numCredProtocols]int64
+}
+
+// CredentialProtocols
+// The services a credential can be limited to, in the order of their
+// allow_ columns in credential. These are MailProtocols without lmtp
+// because delivery doesn't log in.
+var CredentialProtocols = []string{"imap", "pop3", "submission", "sieve"}
+
+const numCredProtocols = 4
+
+// credentialCols
+// The credential columns, in scan() order
+const credentialCols = `c.id, c.label, c.pw_type, c.password, c.created, c.last_used,
+ cl.last_login, c.expires, c.allow_imap, c.allow_pop3, c.allow_submission, c.allow_sieve`
+
+// scan
+// The destinations for the credentialCols of a row
+func (c *Credential) scan() []interface{} {
+	dest := []interface{}{&c.id, &c.label, &c.pw_type, &c.password,
+		&c.created, &c.lastUsed, &c.lastLogin, &c.expires}
+	for i := range c.allow {
+		dest = append(dest, &c.allow[i])
+	}
+	return dest
+}
+
+// credProtocolIndex
+// Where p is in CredentialProtocols
+func credProtocolIndex(p string) (int, error) {
+	p = strings.ToLower(strings.TrimSpace(p))
+	for i, cp := range CredentialProtocols {
+		if p == cp {
+			return i, nil
+		}
+	}
+	return -1, ErrMdbBadProtocol
+}
+
+// credentialQuery
+// All the credentials of a mailbox. Add to the WHERE.
+const credentialQuery = `SELECT ` + credentialCols + `
+ FROM credential AS c JOIN address AS a ON (a.id = c.mailbox)
+ JOIN domain AS d ON (a.domain = d.id)
+ LEFT JOIN credentiallogin AS cl ON (cl.credential = CAST(c.id AS TEXT))
+ WHERE a.localpart = ? AND d.name = ?`
+
+// FindCredentials
+// The credentials of the user's mailbox in the order
+// dovecot tries them
+func (mdb *MailDB) FindCredentials(user string) ([]*Credential, error) {
+	return mdb.FindCredentialsContext(context.Background(), user)
+}
+
+// FindCredentialsContext
+// FindCredentials that gives up when ctx is done
+func (mdb *MailDB) FindCredentialsContext(ctx context.Context, user string) ([]*Credential, error) {
+	var (
+		ap   *AddressParts
+		rows *sql.Rows
+		cl   []*Credential
+		err  error
+	)
+
+	if ap, err = DecodeRFC822(user); err != nil {
+		return nil, err
+	}
+	if _, err = mdb.LookupVMailboxContext(ctx, user); err != nil {
+		return nil, err
+	}
+	rows, err = mdb.db.QueryContext(ctx, credentialQuery+" ORDER BY c.id", ap.lpart, ap.domain)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		c := &Credential{mdb: mdb, user: user}
+		if err = rows.Scan(c.scan()...); err != nil {
+			break
+		}
+		cl = append(cl, c)
+	}
+	if e := rows.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err == nil && len(cl) == 0 {
+		err = ErrMdbCredNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cl, nil
+}
+
+// LookupCredential
+// outside transactions
+func (mdb *MailDB) LookupCredential(user string, label string) (*Credential, error) {
+	return mdb.LookupCredentialContext(context.Background(), user, label)
+}
+
+// LookupCredentialContext
+// LookupCredential that gives up when ctx is done
+func (mdb *MailDB) LookupCredentialContext(ctx context.Context, user string, label string) (*Credential, error) {
+	ap, err := DecodeRFC822(user)
+	if err != nil {
+		return nil, err
+	}
+	c := &Credential{mdb: mdb, user: user}
+	row := mdb.db.QueryRowContext(ctx, credentialQuery+" AND c.label = ?",
+		ap.lpart, ap.domain, label)
+	switch err := row.Scan(c.scan()...); err {
+	case sql.ErrNoRows:
+		return nil, ErrMdbCredNotFound
+	case nil:
+		return c, nil
+	default:
+		return nil, err
+	}
+}
+
+// GetCredential
+// inside transactions
+func (tx *Tx) GetCredential(user string, label string) (*Credential, error) {
+	if !tx.active() {
+		return nil, ErrMdbTransaction
+	}
+	ap, err := DecodeRFC822(user)
+	if err != nil {
+		return nil, err
+	}
+	c := &Credential{mdb: tx.mdb, tx: tx, user: user}
+	row := tx.queryRow(credentialQuery+" AND c.label = ?", ap.lpart, ap.domain, label)
+	switch err := row.Scan(c.scan()...); err {
+	case sql.ErrNoRows:
+		return nil, ErrMdbCredNotFound
+	case nil:
+		return c, nil
+	default:
+		return nil, err
+	}
+}
+
+// InsertCredential
+// Add a credential with the label to the user's mailbox. The password is
+// hashed with scheme, DefaultPwScheme if empty.
+func (tx *Tx) InsertCredential(user string, label string, scheme string, clear string) (*Credential, error) {
+	var (
+		mb  *VMailbox
+		err error
+	)
+
+	if !tx.active() {
+		return nil, ErrMdbTransaction
+	}
+	label = strings.TrimSpace(label)
+	if label == "" {
+		return nil, ErrMdbCredBadLabel
+	}
+	if strings.TrimSpace(scheme) == "" {
+		scheme = DefaultPwScheme
+	}
+	pwType, pw, err := hashPassword(scheme, clear)
+	if err != nil {
+		return nil, err
+	}
+	if mb, err = tx.GetVMailbox(user); err != nil {
+		return nil, err
+	}
+	_, err = tx.insert("INSERT INTO credential (mailbox, label, pw_type, password) VALUES (?, ?, ?, ?)",
+		mb.a.Id(), label, pwType, pw)
+	if err != nil {
+		if IsErrConstraintUnique(err) {
+			err = ErrMdbDupCredential
+		}
+		return nil, err
+	}
+	return tx.GetCredential(user, label)
+}
+
+// DeleteCredential
+func (tx *Tx) DeleteCredential(user string, label string) error {
+	c, err := tx.GetCredential(user, label)
+	if err != nil {
+		return err
+	}
+	res, err := tx.exec("DELETE FROM credential WHERE id = ?", c.id)
+	if err == nil {
+		n, err := res.RowsAffected()
+		if err == nil && n == 0 {
+			return ErrMdbCredNotFound
+		}
+	}
+	return err
+}
+
+// VerifyCredential
+// Find the unexpired credential of the user whose password is clear and
+// record that it was used. No match is ErrMdbCredNotFound.
+func (tx *Tx) VerifyCredential(user string, clear string) (*Credential, error) {
+	var cl []*Credential
+
+	if !tx.active() {
+		return nil, ErrMdbTransaction
+	}
+	ap, err := DecodeRFC822(user)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := tx.query(credentialQuery+" ORDER BY c.id", ap.lpart, ap.domain)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		c := &Credential{mdb: tx.mdb, tx: tx, user: user}
+		if err = rows.Scan(c.scan()...); err != nil {
+			break
+		}
+		cl = append(cl, c)
+	}
+	if e := rows.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range cl {
+		if c.IsExpired() {
+			continue
+		}
+		if ok, err := c.Verify(clear); err != nil {
+			return nil, err
+		} else if ok {
+			return c, c.MarkUsed()
+		}
+	}
+	return nil, ErrMdbCredNotFound
+}
+
+// User
+func (c *Credential) User() string {
+	return c.user
+}
+
+// Label
+func (c *Credential) Label() string {
+	return c.label
+}
+
+// PwType
+func (c *Credential) PwType() string {
+	return c.pw_type
+}
+
+// PwStrength
+func (c *Credential) PwStrength() PwStrength {
+	return PasswordStrength(c.pw_type)
+}
+
+// Verify
+// Is clear the password of this credential?
+func (c *Credential) Verify(clear string) (bool, error) {
+	return VerifyPassword(c.pw_type, c.password, clear)
+}
+
+// parseStamp
+func parseStamp(s string) time.Time {
+	t, err := time.ParseInLocation(AuditStampFormat, s, time.UTC)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// Created
+// When it was made, in UTC
+func (c *Credential) Created() time.Time {
+	return parseStamp(c.created)
+}
+
+// LastUsed
+// When dovecot last logged in with it or postdove last verified it,
+// whichever is later. Zero if never
+func (c *Credential) LastUsed() time.Time {
+	var t time.Time
+	if c.lastUsed.Valid {
+		t = parseStamp(c.lastUsed.String)
+	}
+	if c.lastLogin.Valid && c.lastLogin.Int64 > 0 {
+		if l := time.Unix(c.lastLogin.Int64, 0).UTC(); l.After(t) {
+			t = l
+		}
+	}
+	return t
+}
+
+// Expires
+// When it stops working. Zero if never
+func (c *Credential) Expires() time.Time {
+	if !c.expires.Valid {
+		return time.Time{}
+	}
+	return parseStamp(c.expires.String)
+}
+
+// IsExpired
+func (c *Credential) IsExpired() bool {
+	e := c.Expires()
+	return !e.IsZero() && !time.Now().Before(e)
+}
+
+// IsAllowed
+// Can this credential be used for protocol p? The mailbox must
+// allow it too.
+func (c *Credential) IsAllowed(p string) (bool, error) {
+	i, err := credProtocolIndex(p)
+	if err != nil {
+		return false, err
+	}
+	return c.allow[i] != 0, nil
+}
+
+// AllowedProtocols
+// The protocols this credential may use, in CredentialProtocols order
+func (c *Credential) AllowedProtocols() []string {
+	var pl []string
+
+	for i, p := range CredentialProtocols {
+		if c.allow[i] != 0 {
+			pl = append(pl, p)
+		}
+	}
+	return pl
+}
+
+// update
+// Set one column of this credential
+func (c *Credential) update(col string, val interface{}) error {
+	if c.tx == nil || !c.tx.active() {
+		return ErrMdbTransaction
+	}
+	res, err := c.tx.exec("UPDATE credential SET "+col+" = ? WHERE id = ?", val, c.id)
+	if err == nil {
+		n, err := res.RowsAffected()
+		if err == nil && n != 1 {
+			return ErrMdbBadUpdate
+		}
+	}
+	return err
+}
+
+// SetExpires
+// The credential stops working at t. A zero t is never.
+func (c *Credential) SetExpires(t time.Time) error {
+	exp := NullStr
+	if !t.IsZero() {
+		exp = sql.NullString{Valid: true, String: t.UTC().Format(AuditStampFormat)}
+	}
+	if err := c.update("expires", exp); err != nil {
+		return err
+	}
+	c.expires = exp
+	return nil
+}
+
+// MarkUsed
+// Record that it was used just now
+func (c *Credential) MarkUsed() error {
+	now := sql.NullString{Valid: true, String: time.Now().UTC().Format(AuditStampFormat)}
+	if err := c.update("last_used", now); err != nil {
+		return err
+	}
+	c.lastUsed = now
+	return nil
+}
+
+// setProtocol
+func (c *Credential) setProtocol(p string, allow int64) error {
+	i, err := credProtocolIndex(p)
+	if err != nil {
+		return err
+	}
+	if err = c.update("allow_"+CredentialProtocols[i], allow); err != nil {
+		return err
+	}
+	c.allow[i] = allow
+	return nil
+}
+
+// AllowProtocol
+func (c *Credential) AllowProtocol(p string) error {
+	return c.setProtocol(p, 1)
+}
+
+// DenyProtocol
+func (c *Credential) DenyProtocol(p string) error {
+	return c.setProtocol(p, 0)
+}
@@ -0,0 +1,309 @@
+package maildb
+
+/*
+ * Copyright (C) 2020, Jim Lieb <lieb@sea-troll.net>
+ *
+ * This program is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 3 of the License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ *
+ * -------------
+ */
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// credentialSlots
+// who can log into service with which credential in which passdb slot
+func credentialSlots(mdb *MailDB, service string) (string, error) {
+	var sl []string
+
+	rows, err := mdb.db.Query(`
+SELECT username, label, slot FROM user_credential
+ WHERE domain = 'skywalker' AND service = ? ORDER BY username, slot`, service)
+	if err != nil {
+		return "", err
+	}
+	for rows.Next() {
+		var (
+			user, label string
+			slot        int
+		)
+		if err = rows.Scan(&user, &label, &slot); err != nil {
+			break
+		}
+		sl = append(sl, fmt.Sprintf("%s/%s/%d", user, label, slot))
+	}
+	if e := rows.Close(); e != nil && err == nil {
+		err = e
+	}
+	return strings.Join(sl, " "), err
+}
+
+// TestCredential
+func TestCredential(t *testing.T) {
+	var (
+		err error
+		mdb *MailDB
+		dir string
+		c   *Credential
+		cl  []*Credential
+	)
+
+	fmt.Printf("Credential Test\n")
+
+	dir, err = ioutil.TempDir("", "TestCredential-*")
+	defer os.RemoveAll(dir)
+	mdb, err = makeTestDB(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Errorf("Database load failed, %s", err)
+		return
+	}
+	defer mdb.Close()
+
+	err = mdb.WithTx(func(tx *Tx) error {
+		d, err := tx.InsertDomain("skywalker")
+		if err == nil {
+			err = d.SetClass("vmailbox")
+		}
+		if err == nil {
+			_, err = tx.InsertVMailbox("luke@skywalker")
+		}
+		if err == nil {
+			_, err = tx.InsertVMailbox("leia@skywalker")
+		}
+		return err
+	})
+	if err != nil {
+		t.Errorf("Insert of mailboxes failed, %s", err)
+		return
+	}
+
+	// Generated passwords are easy to type and don't repeat
+	seen := make(map[string]bool)
+	genRe := regexp.MustCompile(`^[` + genAlphabet + `]{4}(-[` + genAlphabet + `]{4}){3}$`)
+	for i := 0; i < 100; i++ {
+		pw, err := GeneratePassword()
+		if err != nil || !genRe.MatchString(pw) || seen[pw] {
+			t.Errorf("GeneratePassword: bad password %q, %v", pw, err)
+			break
+		}
+		seen[pw] = true
+	}
+
+	// Some credentials
+	if _, err = mdb.FindCredentials("luke@skywalker"); err != ErrMdbCredNotFound {
+		t.Errorf("Find with none: expected ErrMdbCredNotFound, got %v", err)
+	}
+	err = mdb.WithTx(func(tx *Tx) error {
+		if _, err := tx.InsertCredential("luke@skywalker", "phone", "", "xwing"); err != nil {
+			return err
+		}
+		if _, err := tx.InsertCredential("luke@skywalker", "desktop", "ssha512", "tatooine"); err != nil {
+			return err
+		}
+		_, err := tx.InsertCredential("leia@skywalker", "phone", "", "alderaan")
+		return err
+	})
+	if err != nil {
+		t.Errorf("Insert credentials, %s", err)
+		return
+	}
+	for _, bad := range []struct {
+		user, label, pw string
+		err             error
+	}{
+		{"luke@skywalker", "phone", "again", ErrMdbDupCredential},
+		{"luke@skywalker", " ", "blank", ErrMdbCredBadLabel},
+		{"luke@skywalker", "scripts", "", ErrMdbPwEmpty},
+		{"yoda@skywalker", "phone", "swamp", ErrMdbAddressNotFound},
+	} {
+		err = mdb.WithTx(func(tx *Tx) error {
+			_, err := tx.InsertCredential(bad.user, bad.label, "", bad.pw)
+			return err
+		})
+		if err != bad.err {
+			t.Errorf("Insert %s %q: expected %v, got %v", bad.user, bad.label, bad.err, err)
+		}
+	}
+	if cl, err = mdb.FindCredentials("luke@skywalker"); err != nil {
+		t.Errorf("Find luke@skywalker, %s", err)
+	} else if len(cl) != 2 || cl[0].Label() != "phone" || cl[1].Label() != "desktop" {
+		t.Errorf("Find luke@skywalker: expected phone and desktop, got %d", len(cl))
+	} else {
+		if cl[0].PwType() != DefaultPwScheme || cl[1].PwType() != "SSHA512" {
+			t.Errorf("Find luke@skywalker: wrong types %s and %s", cl[0].PwType(), cl[1].PwType())
+		}
+		if time.Since(cl[0].Created()) > time.Minute || !cl[0].LastUsed().IsZero() ||
+			!cl[0].Expires().IsZero() || cl[0].IsExpired() {
+			t.Errorf("Find luke@skywalker: bad times %v, %v, %v",
+				cl[0].Created(), cl[0].LastUsed(), cl[0].Expires())
+		}
+	}
+
+	// Verify finds the right one and records its use
+	err = mdb.WithTx(func(tx *Tx) error {
+		c, err = tx.VerifyCredential("luke@skywalker", "tatooine")
+		return err
+	})
+	if err != nil || c.Label() != "desktop" {
+		t.Errorf("Verify tatooine: expected desktop, got %v", err)
+	}
+	if c, err = mdb.LookupCredential("luke@skywalker", "desktop"); err != nil {
+		t.Errorf("Lookup desktop, %s", err)
+	} else if time.Since(c.LastUsed()) > time.Minute {
+		t.Errorf("Lookup desktop: last used not set, %v", c.LastUsed())
+	}
+	err = mdb.WithTx(func(tx *Tx) error {
+		_, err := tx.VerifyCredential("luke@skywalker", "alderaan")
+		return err
+	})
+	if err != ErrMdbCredNotFound {
+		t.Errorf("Verify alderaan for luke: expected ErrMdbCredNotFound, got %v", err)
+	}
+
+	// dovecot's last_login dict keys its rows by the credential id from
+	// user_credential. A login is used if it is later than a verify.
+	login := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, u := range []struct {
+		user  string
+		label string
+		when  int64
+	}{
+		{"luke@skywalker", "phone", 1700000000},
+		{"luke@skywalker", "desktop", login.Unix()},
+		{"leia@skywalker", "phone", 1700000000},
+	} {
+		var id int64
+		row := mdb.db.QueryRow("SELECT credential FROM user_credential"+
+			" WHERE username || '@' || domain = ? AND label = ? AND service = 'imap'", u.user, u.label)
+		if err = row.Scan(&id); err != nil {
+			t.Errorf("user_credential %s %s: no id, %v", u.user, u.label, err)
+			continue
+		}
+		if _, err = mdb.db.Exec("INSERT INTO credentiallogin (credential, last_login) VALUES (?, ?)",
+			fmt.Sprintf("%d", id), u.when); err != nil {
+			t.Errorf("Login %s %s, %s", u.user, u.label, err)
+		}
+	}
+	if c, err = mdb.LookupCredential("luke@skywalker", "phone"); err != nil {
+		t.Errorf("Lookup phone, %s", err)
+	} else if !c.LastUsed().Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("Lookup phone: expected the login time, got %v", c.LastUsed())
+	}
+	if c, err = mdb.LookupCredential("luke@skywalker", "desktop"); err != nil {
+		t.Errorf("Lookup desktop, %s", err)
+	} else if !c.LastUsed().Equal(login) {
+		t.Errorf("Lookup desktop: expected %v, got %v", login, c.LastUsed())
+	}
+	if cl, err = mdb.FindCredentials("leia@skywalker"); err != nil || len(cl) != 1 ||
+		!cl[0].LastUsed().Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("Find leia@skywalker: expected the login time, %v", err)
+	}
+
+	// What dovecot sees
+	if sl, err := credentialSlots(mdb, "imap"); err != nil ||
+		sl != "leia/phone/1 luke/phone/1 luke/desktop/2" {
+		t.Errorf("user_credential imap: got %q, %v", sl, err)
+	}
+
+	// Limit the phone to imap and submission and expire the desktop
+	err = mdb.WithTx(func(tx *Tx) error {
+		c, err := tx.GetCredential("luke@skywalker", "phone")
+		if err != nil {
+			return err
+		}
+		for _, p := range []string{"pop3", "SIEVE"} {
+			if err = c.DenyProtocol(p); err != nil {
+				return err
+			}
+		}
+		if err = c.DenyProtocol("lmtp"); err != ErrMdbBadProtocol {
+			return fmt.Errorf("deny lmtp: expected ErrMdbBadProtocol, got %v", err)
+		}
+		if c, err = tx.GetCredential("luke@skywalker", "desktop"); err != nil {
+			return err
+		}
+		return c.SetExpires(time.Now().Add(-time.Hour))
+	})
+	if err != nil {
+		t.Errorf("Edit credentials, %s", err)
+	}
+	if c, err = mdb.LookupCredential("luke@skywalker", "phone"); err != nil {
+		t.Errorf("Lookup phone, %s", err)
+	} else if pl := strings.Join(c.AllowedProtocols(), ","); pl != "imap,submission" {
+		t.Errorf("Lookup phone: expected imap,submission, got %s", pl)
+	}
+	if c, err = mdb.LookupCredential("luke@skywalker", "desktop"); err != nil {
+		t.Errorf("Lookup desktop, %s", err)
+	} else if !c.IsExpired() {
+		t.Errorf("Lookup desktop: should be expired, %v", c.Expires())
+	}
+	for svc, expected := range map[string]string{
+		"imap": "leia/phone/1 luke/phone/1",
+		"pop3": "leia/phone/1",
+		"smtp": "leia/phone/1 luke/phone/1",
+	} {
+		if sl, err := credentialSlots(mdb, svc); err != nil || sl != expected {
+			t.Errorf("user_credential %s: expected %q, got %q, %v", svc, expected, sl, err)
+		}
+	}
+	err = mdb.WithTx(func(tx *Tx) error {
+		_, err := tx.VerifyCredential("luke@skywalker", "tatooine")
+		return err
+	})
+	if err != ErrMdbCredNotFound {
+		t.Errorf("Verify expired: expected ErrMdbCredNotFound, got %v", err)
+	}
+
+	// The audit has them under the mailbox but never the password
+	al, err := mdb.FindAudit(&AuditFilter{Entity: "credential", Key: "luke@skywalker"})
+	if err != nil || len(al) != 5 {
+		t.Errorf("Audit credential: expected 5 entries, got %d, %v", len(al), err)
+	}
+	pwRe := regexp.MustCompile(`tatooine|xwing|\$6\$`)
+	for _, e := range al {
+		if pwRe.MatchString(e.Before()) || pwRe.MatchString(e.After()) {
+			t.Errorf("Audit credential: password leaked, %s %s", e.Before(), e.After())
+		}
+	}
+
+	// Delete one and then the mailbox takes the rest with it
+	if err = mdb.WithTx(func(tx *Tx) error { return tx.DeleteCredential("luke@skywalker", "phone") }); err != nil {
+		t.Errorf("Delete phone, %s", err)
+	}
+	err = mdb.WithTx(func(tx *Tx) error { return tx.DeleteCredential("luke@skywalker", "phone") })
+	if err != ErrMdbCredNotFound {
+		t.Errorf("Delete phone again: expected ErrMdbCredNotFound, got %v", err)
+	}
+	if err = mdb.WithTx(func(tx *Tx) error { return tx.DeleteVMailbox("luke@skywalker") }); err != nil {
+		t.Errorf("Delete luke@skywalker, %s", err)
+	}
+	var cnt int
+	row := mdb.db.QueryRow("SELECT count(*) FROM credential")
+	if err = row.Scan(&cnt); err != nil || cnt != 1 {
+		t.Errorf("Credentials after delete: expected only leia's, got %d, %v", cnt, err)
+	}
+	row = mdb.db.QueryRow("SELECT count(*) FROM credentiallogin")
+	if err = row.Scan(&cnt); err != nil || cnt != 1 {
+		t.Errorf("Logins after delete: expected only leia's, got %d, %v", cnt, err)
+	}
+}
@@ -21,11 +21,14 @@ package maildb
  */
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 
 	_ "github.com/mattn/go-sqlite3" // do I really need this here?
@@ -85,50 +88,406 @@ func TestDBdefaults(t *testing.T) {
 }
 
 // test DefaultString
-// in a separate function to recover the panics
 func doDefaultString(mdb *MailDB, t *testing.T) {
+	s, err := mdb.DefaultString("vmailbox.pw_type")
+	if err != nil {
+		t.Errorf("DefaultString: unexpected error, %s", err)
+	} else if s != "PLAIN" {
+		t.Errorf("DefaultString: expected 'PLAIN', got '%s'", s)
+	}
+	if _, err = mdb.DefaultString("domain.name"); err != ErrMdbNoDefault { // no default
+		t.Errorf("DefaultString: expected %s on 'domain.name', got %v", ErrMdbNoDefault, err)
+	}
+	if _, err = mdb.DefaultString("vmailbox.enable"); err != ErrMdbDefaultType { // an INTEGER
+		t.Errorf("DefaultString: expected %s on 'vmailbox.enable', got %v", ErrMdbDefaultType, err)
+	}
+}
 
-	defer func() {
-		if p := recover(); p != nil {
-			if strings.Contains(string(p.(error).Error()), "not found") {
-				return // intentional error
-			} else { // all others really bad
-				t.Errorf("DefaultString: unexpected panic: %v", p)
-			}
+// test DefaultInt
+func doDefaultInt(mdb *MailDB, t *testing.T) {
+	i, err := mdb.DefaultInt("vmailbox.enable")
+	if err != nil {
+		t.Errorf("DefaultInt: unexpected error, %s", err)
+	} else if i != 1 {
+		t.Errorf("DefaultInt: expected 1, got %d", i)
+	}
+	if _, err = mdb.DefaultInt("vmailbox.uid"); err != ErrMdbNoDefault { // no default
+		t.Errorf("DefaultInt: expected %s on 'vmailbox.uid', got %v", ErrMdbNoDefault, err)
+	}
+	if _, err = mdb.DefaultInt("vmailbox.pw_type"); err != ErrMdbDefaultType { // a TEXT
+		t.Errorf("DefaultInt: expected %s on 'vmailbox.pw_type', got %v", ErrMdbDefaultType, err)
+	}
+
+	// A schema someone has been "improving"
+	mdb.dflts["vmailbox.bogus"] = TableInfo{colType: "INTEGER",
+		dflt: sql.NullString{String: "'lots'", Valid: true}}
+	if _, err = mdb.DefaultInt("vmailbox.bogus"); err == nil ||
+		!strings.Contains(err.Error(), "parse of vmailbox.bogus") {
+		t.Errorf("DefaultInt: expected parse error on 'vmailbox.bogus', got %v", err)
+	}
+	delete(mdb.dflts, "vmailbox.bogus")
+}
+
+// TestTransaction
+// Misusing transactions, the database, or the constraint tests
+// must get an error, not a crash.
+func TestTransaction(t *testing.T) {
+	var (
+		err  error
+		mdb  *MailDB
+		dir  string
+		tx   *Tx
+		none *Tx
+		d    *Domain
+	)
+
+	fmt.Printf("Transaction test\n")
+
+	dir, err = ioutil.TempDir("", "TestTransaction-*")
+	defer os.RemoveAll(dir)
+	mdb, err = makeTestDB(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatalf("Database load failed, %s", err)
+	}
+
+	// End without a Begin
+	none.End(&err)
+	if err != ErrMdbTransaction {
+		t.Errorf("End: expected %s, got %v", ErrMdbTransaction, err)
+	}
+	err = ErrMdbBadUpdate // the caller's error is not replaced
+	none.End(&err)
+	if err != ErrMdbBadUpdate {
+		t.Errorf("End: expected %s to be kept, got %v", ErrMdbBadUpdate, err)
+	}
+	if _, err = none.InsertDomain("pobox.org"); err != ErrMdbTransaction {
+		t.Errorf("InsertDomain: expected %s, got %v", ErrMdbTransaction, err)
+	}
+
+	// A good one, then use it after it is over
+	tx = beginTx(t, mdb)
+	d, err = tx.InsertDomain("pobox.org")
+	tx.End(&err)
+	if err != nil {
+		t.Errorf("End: unexpected error, %s", err)
+	}
+	if _, err = mdb.LookupDomain("pobox.org"); err != nil {
+		t.Errorf("LookupDomain: pobox.org should have been committed, %v", err)
+	}
+	tx.End(&err)
+	if err != ErrMdbTransaction {
+		t.Errorf("End again: expected %s, got %v", ErrMdbTransaction, err)
+	}
+	if _, err = tx.GetDomain("pobox.org"); err != ErrMdbTransaction {
+		t.Errorf("GetDomain after End: expected %s, got %v", ErrMdbTransaction, err)
+	}
+	if err = d.SetClass("relay"); err != ErrMdbTransaction {
+		t.Errorf("SetClass after End: expected %s, got %v", ErrMdbTransaction, err)
+	}
+	if d, err = mdb.LookupDomain("pobox.org"); err != nil {
+		t.Errorf("LookupDomain: unexpected error, %s", err)
+	} else if err = d.SetClass("relay"); err != ErrMdbTransaction {
+		t.Errorf("SetClass on a lookup: expected %s, got %v", ErrMdbTransaction, err)
+	}
+
+	// The commit fails. Pull the transaction out from under it.
+	tx = beginTx(t, mdb)
+	if _, err = tx.InsertAddress("bill"); err == nil {
+		_, err = tx.tx.Exec("ROLLBACK")
+	}
+	if err != nil {
+		t.Fatalf("Commit setup: unexpected error, %s", err)
+	}
+	tx.End(&err)
+	if err == nil || !strings.Contains(err.Error(), "End: commit") {
+		t.Errorf("End: expected commit error, got %v", err)
+	}
+	if _, err = mdb.LookupAddress("bill"); err != ErrMdbAddressNotFound {
+		t.Errorf("LookupAddress: bill should have been rolled back, got %v", err)
+	}
+
+	// WithTx commits, rolls back on an error, and rolls back on a panic
+	err = mdb.WithTx(func(tx *Tx) error {
+		_, err := tx.InsertDomain("example.com")
+		return err
+	})
+	if err != nil {
+		t.Errorf("WithTx: unexpected error, %s", err)
+	}
+	if _, err = mdb.LookupDomain("example.com"); err != nil {
+		t.Errorf("LookupDomain: example.com should have been committed, %v", err)
+	}
+	err = mdb.WithTx(func(tx *Tx) error {
+		if _, err := tx.InsertDomain("example.org"); err != nil {
+			return err
 		}
+		return ErrMdbBadUpdate
+	})
+	if err != ErrMdbBadUpdate {
+		t.Errorf("WithTx: expected %s, got %v", ErrMdbBadUpdate, err)
+	}
+	if _, err = mdb.LookupDomain("example.org"); err != ErrMdbDomainNotFound {
+		t.Errorf("LookupDomain: example.org should have been rolled back, got %v", err)
+	}
+	func() {
+		defer func() {
+			if p := recover(); p != "boom" {
+				t.Errorf("WithTx: expected the panic to be passed on, got %v", p)
+			}
+		}()
+		mdb.WithTx(func(tx *Tx) error {
+			tx.InsertDomain("example.net")
+			panic("boom")
+		})
 	}()
+	if _, err = mdb.LookupDomain("example.net"); err != ErrMdbDomainNotFound {
+		t.Errorf("LookupDomain: example.net should have been rolled back, got %v", err)
+	}
+
+	// No restore with a transaction open
+	tx = beginTx(t, mdb)
+	if _, err = mdb.Restore(filepath.Join(dir, "nothing.db")); err != ErrMdbInTransaction {
+		t.Errorf("Restore: expected %s, got %v", ErrMdbInTransaction, err)
+	}
+	tx.End(&err)
+
+	// Clearing the audit context fails. That rolls back too
+	tx = beginTx(t, mdb)
+	if _, err = tx.InsertDomain("example.edu"); err == nil {
+		_, err = tx.tx.Exec("DROP TABLE audit_context")
+	}
+	if err != nil {
+		t.Fatalf("Audit setup: unexpected error, %s", err)
+	}
+	tx.End(&err)
+	if err == nil || !strings.Contains(err.Error(), "End: audit context") {
+		t.Errorf("End: expected audit context error, got %v", err)
+	}
+	if _, err = mdb.LookupDomain("example.edu"); err != ErrMdbDomainNotFound {
+		t.Errorf("LookupDomain: example.edu should have been rolled back, got %v", err)
+	}
 
-	// now play
-	s := mdb.DefaultString("domain.rclass")
-	if s != "DEFAULT" {
-		t.Errorf("DefaultString: expected 'DEFAULT', got '%s'", s)
+	// Setting the audit context fails
+	if _, err = mdb.db.Exec("DROP TABLE audit_context"); err != nil {
+		t.Fatalf("Audit setup: unexpected error, %s", err)
+	}
+	if tx, err = mdb.Begin(); err == nil || !strings.Contains(err.Error(), "Begin: audit context") {
+		t.Errorf("Begin: expected audit context error, got %v", err)
+	}
+	if tx != nil {
+		t.Errorf("Begin: failed Begin returned a transaction")
 	}
-	s = mdb.DefaultString("domain.name") // no default, should panic
-	if len(s) >= 0 {                     // succeeded with something
-		t.Errorf("DefaultString: should have panic'd on 'domain.name'")
+	if mdb.txCount != 0 {
+		t.Errorf("Begin: expected no transactions in progress, got %d", mdb.txCount)
+	}
+
+	// Our own errors are not constraint errors
+	for _, e := range []error{nil, ErrMdbBadUpdate, fmt.Errorf("wrapped %w", ErrMdbDupDomain)} {
+		if IsErrConstraintForeignKey(e) || IsErrConstraintUnique(e) || IsErrConstraintNotNull(e) {
+			t.Errorf("IsErrConstraint: %v is not a constraint error", e)
+		}
+	}
+
+	// Close it and then try to use it
+	if err = mdb.Close(); err != nil {
+		t.Errorf("Close: unexpected error, %s", err)
+	}
+	if err = mdb.Close(); err != ErrMdbNotOpen {
+		t.Errorf("Close: expected %s, got %v", ErrMdbNotOpen, err)
+	}
+	if _, err = mdb.Begin(); err != ErrMdbNotOpen {
+		t.Errorf("Begin: expected %s, got %v", ErrMdbNotOpen, err)
+	}
+	if err = mdb.WithTx(func(tx *Tx) error { return nil }); err != ErrMdbNotOpen {
+		t.Errorf("WithTx: expected %s, got %v", ErrMdbNotOpen, err)
+	}
+	mdb.dflts = make(map[string]TableInfo)
+	if _, err = mdb.DefaultString("vmailbox.pw_type"); err != ErrMdbNotOpen {
+		t.Errorf("DefaultString: expected %s, got %v", ErrMdbNotOpen, err)
 	}
 }
 
-// test DefaultInt
-func doDefaultInt(mdb *MailDB, t *testing.T) {
+// TestConcurrentTx
+// Transactions from a bunch of goroutines at once. Each one gets its
+// own domain and addresses. Every other one fails and must leave nothing.
+func TestConcurrentTx(t *testing.T) {
+	var (
+		err  error
+		mdb  *MailDB
+		dir  string
+		wg   sync.WaitGroup
+		errs = make([]error, 16)
+	)
+
+	fmt.Printf("Concurrent transaction test\n")
+
+	dir, err = ioutil.TempDir("", "TestConcurrentTx-*")
+	defer os.RemoveAll(dir)
+	mdb, err = makeTestDB(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatalf("Database load failed, %s", err)
+	}
+	defer mdb.Close()
 
-	defer func() {
-		if p := recover(); p != nil {
-			if strings.Contains(p.(error).Error(), "not found") {
-				return // intentional error
-			} else { // all others really bad
-				t.Errorf("DefaultInt: unexpected panic: %v", p)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = mdb.WithTx(func(tx *Tx) error {
+				for _, u := range []string{"bill", "dave", "mary"} {
+					if _, err := tx.InsertAddress(fmt.Sprintf("%s@d%d.org", u, i)); err != nil {
+						return err
+					}
+				}
+				if _, err := tx.GetDomain(fmt.Sprintf("d%d.org", i)); err != nil {
+					return err
+				}
+				if i%2 == 1 {
+					return ErrMdbBadUpdate
+				}
+				return nil
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	for i, e := range errs {
+		al, err := mdb.FindAddress(fmt.Sprintf("*@d%d.org", i))
+		if i%2 == 1 {
+			if e != ErrMdbBadUpdate {
+				t.Errorf("tx %d: expected %s, got %v", i, ErrMdbBadUpdate, e)
+			}
+			if err != ErrMdbDomainNotFound {
+				t.Errorf("tx %d: expected rollback, got %d addresses, %v", i, len(al), err)
+			}
+		} else {
+			if e != nil {
+				t.Errorf("tx %d: unexpected error, %s", i, e)
+			} else if err != nil || len(al) != 3 {
+				t.Errorf("tx %d: expected 3 addresses, got %d, %v", i, len(al), err)
 			}
 		}
-	}()
+	}
+	if mdb.txCount != 0 {
+		t.Errorf("expected no transactions in progress, got %d", mdb.txCount)
+	}
+}
 
-	// now play
-	i := mdb.DefaultInt("vmailbox.enable")
-	if i != 1 {
-		t.Errorf("DefaultInt: expected 1, got %d", i)
+// TestContext
+// A cancelled context stops the work and rolls back whatever its
+// transaction did.
+func TestContext(t *testing.T) {
+	var (
+		err error
+		mdb *MailDB
+		dir string
+		tx  *Tx
+	)
+
+	fmt.Printf("Context test\n")
+
+	dir, err = ioutil.TempDir("", "TestContext-*")
+	defer os.RemoveAll(dir)
+	mdb, err = makeTestDB(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatalf("Database load failed, %s", err)
+	}
+	defer mdb.Close()
+
+	done, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Nothing starts with a dead context
+	if _, err = mdb.BeginContext(done); err != context.Canceled {
+		t.Errorf("BeginContext: expected %s, got %v", context.Canceled, err)
+	}
+	if err = mdb.WithTxContext(done, func(tx *Tx) error {
+		t.Errorf("WithTxContext: fn should not be called")
+		return nil
+	}); err != context.Canceled {
+		t.Errorf("WithTxContext: expected %s, got %v", context.Canceled, err)
+	}
+	if _, err = mdb.FindDomainContext(done, "*"); err == nil {
+		t.Errorf("FindDomainContext: expected error")
+	}
+	if _, err = mdb.LookupAddressContext(done, "bill@example.com"); err == nil {
+		t.Errorf("LookupAddressContext: expected error")
+	}
+	if _, err = mdb.CheckContext(done); err == nil {
+		t.Errorf("CheckContext: expected error")
+	}
+	if _, err = mdb.QueryContext(done, "SELECT count(*) FROM domain"); err == nil {
+		t.Errorf("QueryContext: expected error")
+	}
+	bkup := filepath.Join(dir, "backup.db")
+	if _, err = mdb.BackupContext(done, bkup, false); err == nil {
+		t.Errorf("BackupContext: expected error")
+	} else if _, e := os.Stat(bkup); !os.IsNotExist(e) {
+		t.Errorf("BackupContext: expected no backup file, got %v", e)
+	}
+
+	// Cancel in the middle, the rest fails and End rolls it all back
+	ctx, cancel := context.WithCancel(context.Background())
+	if tx, err = mdb.BeginContext(ctx); err != nil {
+		t.Fatalf("BeginContext: unexpected error, %s", err)
+	}
+	if tx.Context() != ctx {
+		t.Errorf("Context: expected the one we began with")
 	}
-	i = mdb.DefaultInt("vmailbox.uid")
-	if i >= 0 { // succeeded with something
-		t.Errorf("DefaultInt: should have panic'd on 'vmailbox.uid'")
+	if _, err = tx.InsertDomain("first.org"); err != nil {
+		t.Errorf("InsertDomain: first.org, unexpected error, %s", err)
+	}
+	cancel()
+	if _, err = tx.InsertDomain("second.org"); err == nil {
+		t.Errorf("InsertDomain: second.org, expected error after cancel")
+	}
+	tx.End(&err)
+	for _, name := range []string{"first.org", "second.org"} {
+		if _, err = mdb.LookupDomain(name); err != ErrMdbDomainNotFound {
+			t.Errorf("LookupDomain: %s, expected %s, got %v", name, ErrMdbDomainNotFound, err)
+		}
+	}
+
+	// Even a clean End can't commit once the context is gone
+	ctx, cancel = context.WithCancel(context.Background())
+	if tx, err = mdb.BeginContext(ctx); err != nil {
+		t.Fatalf("BeginContext: unexpected error, %s", err)
+	}
+	if _, err = tx.InsertDomain("third.org"); err != nil {
+		t.Errorf("InsertDomain: third.org, unexpected error, %s", err)
+	}
+	cancel()
+	tx.End(&err)
+	if err == nil {
+		t.Errorf("End: expected commit to fail after cancel")
+	}
+	if _, err = mdb.LookupDomain("third.org"); err != ErrMdbDomainNotFound {
+		t.Errorf("LookupDomain: third.org, expected %s, got %v", ErrMdbDomainNotFound, err)
+	}
+
+	// and a live context works like no context at all
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	if err = mdb.WithTxContext(ctx, func(tx *Tx) error {
+		_, err := tx.InsertDomain("fourth.org")
+		return err
+	}); err != nil {
+		t.Errorf("WithTxContext: unexpected error, %s", err)
+	}
+	if dl, err := mdb.FindDomainContext(ctx, "*"); err != nil || len(dl) != 1 {
+		t.Errorf("FindDomainContext: expected 1 domain, got %d, %v", len(dl), err)
+	}
+	if mdb.txCount != 0 {
+		t.Errorf("expected no transactions in progress, got %d", mdb.txCount)
+	}
+}
+
+// beginTx
+// A transaction for the test or die trying
+func beginTx(t *testing.T, mdb *MailDB) *Tx {
+	tx, err := mdb.Begin()
+	if err != nil {
+		t.Fatalf("Begin: unexpected error, %s", err)
 	}
+	return tx
 }
@@ -56,6 +56,9 @@ func DecodeRFC822(addr string) (*AddressParts, error) {
 	} else { // just local
 		local = a
 	}
+	if local == "" && domain == "" { // just "@"
+		return nil, ErrMdbAddressEmpty
+	}
 	if strings.Contains(local, "+") { // we have an address extension
 		pl := strings.Index(local, "+")
 		loc := local[0:pl]
@@ -128,6 +131,12 @@ func (ap *AddressParts) IsLocal() bool {
 	return ap.lpart != "" && ap.domain == ""
 }
 
+// IsCatchAll
+// The "@domain" key of virtual(5) that matches any user of the domain
+func (ap *AddressParts) IsCatchAll() bool {
+	return ap.lpart == "" && ap.domain != ""
+}
+
 func (ap *AddressParts) String() string {
 	var (
 		line strings.Builder
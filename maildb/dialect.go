@@ -0,0 +1,340 @@
+package maildb
+
+/*
+ * Copyright (C) 2020, Jim Lieb <lieb@sea-troll.net>
+ *
+ * This program is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 3 of the License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ *
+ * -------------
+ */
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// The code was written against database/sql so it could be ported but
+// every engine has its own way of doing a few things. A dialect hides
+// them. Everything else, i.e. the queries in the rest of this package,
+// is plain enough SQL that all the engines we support accept it.
+
+// constraint
+// The kinds of constraint errors the rest of the code cares about
+type constraint int
+
+const (
+	notConstraint constraint = iota
+	constraintForeignKey
+	constraintUnique
+	constraintNotNull
+)
+
+// dialect
+type dialect interface {
+	// name is what we call it in messages
+	name() string
+
+	// open the database. busy is how long to wait for a lock
+	// before giving up, if the engine does the waiting
+	open(dbPath string, busy time.Duration) (*sql.DB, error)
+
+	// enableWAL turns on write-ahead logging so readers and
+	// the writer don't get in each other's way
+	enableWAL(db *sql.DB) error
+
+	// isFile is true if the database is a local file we can copy
+	isFile() bool
+
+	// schemaFile is the embedded default schema and migrationDir
+	// is where its embedded migration scripts are
+	schemaFile() string
+	migrationDir() string
+
+	// hasTable looks for a table by name, ignoring case
+	hasTable(db *sql.DB, name string) (bool, error)
+
+	// findDefaults fills dflts with the default values of columns
+	findDefaults(db *sql.DB, dflts map[string]TableInfo) error
+
+	// insert does an INSERT and returns a result that knows the new id
+	insert(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) (sql.Result, error)
+
+	// auditTable is there if the schema has an audit trail. setAuditContext
+	// and clearAuditContext tell the audit triggers who is doing the work
+	auditTable() string
+	setAuditContext(ctx context.Context, tx *sql.Tx, user string, command string) error
+	clearAuditContext(ctx context.Context, tx *sql.Tx) error
+
+	// integrityQuery and foreignKeyQuery are the check queries for
+	// damage that the engine itself can find. Empty if it can't happen
+	integrityQuery() string
+	foreignKeyQuery() string
+
+	// constraint classifies an error. ok is false if it is not one of ours
+	constraint(err error) (c constraint, ok bool)
+
+	// message is the message raised by a trigger without the engine's decorations
+	message(err error) (msg string, ok bool)
+
+	// busy is true if err is the engine telling us to try again later
+	busy(err error) bool
+
+	// position is where in the statement, counting characters from 1,
+	// the engine found the error. 0 if it doesn't say
+	position(err error) int
+}
+
+// the dialects we know about. The first one is the default
+var dialects = []dialect{
+	&sqliteDialect{},
+	&pgDialect{},
+}
+
+// dialectFor
+// Pick the dialect from the database name. A PostgreSQL DSN is either
+// a URL or a list of key=value pairs. Anything else is an sqlite file.
+func dialectFor(dbPath string) dialect {
+	if isPgDSN(dbPath) {
+		return &pgDialect{}
+	}
+	return &sqliteDialect{}
+}
+
+// constraintOf
+// Ask each dialect what this error is
+func constraintOf(err error) (constraint, bool) {
+	for _, d := range dialects {
+		if c, ok := d.constraint(err); ok {
+			return c, true
+		}
+	}
+	return notConstraint, false
+}
+
+// raisedMessage
+// The message a trigger raised. If the engine decorates it, take that off.
+func raisedMessage(err error) string {
+	for _, d := range dialects {
+		if msg, ok := d.message(err); ok {
+			return msg
+		}
+	}
+	return err.Error()
+}
+
+// sqliteDialect
+// This is the original and the default.
+type sqliteDialect struct{}
+
+// name
+func (d *sqliteDialect) name() string {
+	return "sqlite"
+}
+
+// open
+func (d *sqliteDialect) open(dbPath string, busy time.Duration) (*sql.DB, error) {
+	return sql.Open("sqlite3", dsn(dbPath, busy))
+}
+
+// dsn
+// how we tell the sqlite3 driver what we want. Transactions take the
+// write lock up front so concurrent ones wait their turn (busy timeout)
+// rather than deadlock when one of them goes from reading to writing.
+func dsn(dbPath string, busy time.Duration) string {
+	return fmt.Sprintf("file:%s?_foreign_keys=on&_txlock=immediate&_busy_timeout=%d",
+		dbPath, busy.Milliseconds())
+}
+
+// enableWAL
+// The journal mode is a property of the file so this only has to be
+// done once. In WAL mode readers see the last commit while a writer is
+// busy rather than waiting for it and maybe getting SQLITE_BUSY.
+func (d *sqliteDialect) enableWAL(db *sql.DB) error {
+	var mode string
+
+	if err := db.QueryRow("PRAGMA journal_mode = WAL").Scan(&mode); err != nil {
+		return err
+	}
+	if strings.ToLower(mode) != "wal" {
+		return fmt.Errorf("journal mode is still %s", mode)
+	}
+	return nil
+}
+
+// isFile
+func (d *sqliteDialect) isFile() bool {
+	return true
+}
+
+// schemaFile
+func (d *sqliteDialect) schemaFile() string {
+	return "files/schema.sql"
+}
+
+// migrationDir
+func (d *sqliteDialect) migrationDir() string {
+	return "files/migrations"
+}
+
+// hasTable
+func (d *sqliteDialect) hasTable(db *sql.DB, name string) (bool, error) {
+	var cnt int
+
+	row := db.QueryRow(
+		"SELECT count(*) FROM sqlite_master WHERE type = 'table' AND lower(name) = lower(?)",
+		name)
+	if err := row.Scan(&cnt); err != nil {
+		return false, err
+	}
+	return cnt > 0, nil
+}
+
+// findDefaults
+// This is deep Sqlite3 magic. We build a map of default fields by
+// doing SELECTs from magic tables and functions.
+func (d *sqliteDialect) findDefaults(db *sql.DB, dflts map[string]TableInfo) error {
+	var (
+		info   TableInfo
+		tables []string
+		table  string
+		rows   *sql.Rows
+		err    error
+	)
+
+	rows, err = db.Query("SELECT name FROM sqlite_master WHERE type = 'table'")
+	if err != nil {
+		return fmt.Errorf("table lookup broke: %s", err)
+	}
+	for rows.Next() {
+		if err = rows.Scan(&table); err != nil {
+			return fmt.Errorf("Table lookup scan failed: %s", err)
+		}
+		tables = append(tables, strings.ToLower(table))
+	}
+	if err = rows.Close(); err != nil {
+		return fmt.Errorf("table lookup scan close broke: %s", err)
+	}
+	for _, table = range tables {
+
+		rows, err = db.Query("SELECT * FROM pragma_table_info(?)", table)
+		if err != nil {
+			return fmt.Errorf("table_info broke: %s", err)
+		}
+		for rows.Next() {
+			if err = rows.Scan(&info.cid, &info.name, &info.colType,
+				&info.notNull, &info.dflt, &info.pk); err != nil {
+				return fmt.Errorf("table_info scan broke: %s", err)
+			}
+			if info.dflt.Valid { // we are only interested in cols with defaults
+				dflts[table+"."+info.name] = info
+			}
+		}
+	}
+	if err = rows.Close(); err != nil {
+		return fmt.Errorf("table_info scan close broke: %s", err)
+	}
+	return nil
+}
+
+// insert
+func (d *sqliteDialect) insert(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) (sql.Result, error) {
+	return tx.ExecContext(ctx, query, args...)
+}
+
+// auditTable
+// The triggers get who and what from the one row of audit_context
+func (d *sqliteDialect) auditTable() string {
+	return "audit_context"
+}
+
+// setAuditContext
+func (d *sqliteDialect) setAuditContext(ctx context.Context, tx *sql.Tx, user string, command string) error {
+	_, err := tx.ExecContext(ctx, "INSERT OR REPLACE INTO audit_context (id, user, command) VALUES (1, ?, ?)",
+		user, command)
+	return err
+}
+
+// clearAuditContext
+// don't leave our name on changes someone else makes outside postdove
+func (d *sqliteDialect) clearAuditContext(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, "DELETE FROM audit_context")
+	return err
+}
+
+// integrityQuery
+func (d *sqliteDialect) integrityQuery() string {
+	return "PRAGMA integrity_check"
+}
+
+// foreignKeyQuery
+// Foreign keys are only enforced if the connection turns them on. The sqlite3
+// shell does not by default.
+func (d *sqliteDialect) foreignKeyQuery() string {
+	return `
+SELECT lower("table") || ' row ' || rowid || ' -> ' || lower(parent)
+  FROM pragma_foreign_key_check`
+}
+
+// constraint
+func (d *sqliteDialect) constraint(err error) (constraint, bool) {
+	e, ok := err.(sqlite3.Error)
+	if !ok {
+		return notConstraint, false
+	}
+	if e.Code != sqlite3.ErrConstraint {
+		return notConstraint, true
+	}
+	switch e.ExtendedCode {
+	case sqlite3.ErrConstraintForeignKey:
+		return constraintForeignKey, true
+	case sqlite3.ErrConstraintUnique, sqlite3.ErrConstraintPrimaryKey:
+		return constraintUnique, true // PostgreSQL doesn't tell them apart
+	case sqlite3.ErrConstraintNotNull:
+		return constraintNotNull, true
+	}
+	return notConstraint, true
+}
+
+// message
+// RAISE() messages come back as they are
+func (d *sqliteDialect) message(err error) (string, bool) {
+	if _, ok := err.(sqlite3.Error); !ok {
+		return "", false
+	}
+	return err.Error(), true
+}
+
+// position
+// sqlite doesn't say where
+func (d *sqliteDialect) position(err error) int {
+	return 0
+}
+
+// busy
+// The busy timeout ran out or a lock could not be had
+func (d *sqliteDialect) busy(err error) bool {
+	var e sqlite3.Error
+
+	if !errors.As(err, &e) {
+		return false
+	}
+	return e.Code == sqlite3.ErrBusy || e.Code == sqlite3.ErrLocked
+}
@@ -21,6 +21,7 @@ package maildb
  */
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"strings"
@@ -42,6 +43,7 @@ const (
 // Domain
 type Domain struct {
 	mdb       *MailDB // only valid after successful GetDomain
+	tx        *Tx     // nil unless from a transaction
 	id        int64
 	name      string
 	class     Class
@@ -49,6 +51,11 @@ type Domain struct {
 	access    *Access
 	vuid      sql.NullInt64
 	vgid      sql.NullInt64
+	// password policy, NULL is no rule
+	pwMaxAge     sql.NullInt64
+	pwMinLength  sql.NullInt64
+	pwMinClasses sql.NullInt64
+	quota        sql.NullString // default quota rule of its mailboxes
 }
 
 var domainClass = []string{
@@ -94,6 +101,18 @@ func (d *Domain) Export() string {
 	if d.access != nil {
 		fmt.Fprintf(&line, ", rclass=%s", d.access.Name())
 	}
+	if d.pwMaxAge.Valid {
+		fmt.Fprintf(&line, ", pw_max_age=%d", d.pwMaxAge.Int64)
+	}
+	if d.pwMinLength.Valid {
+		fmt.Fprintf(&line, ", pw_min_length=%d", d.pwMinLength.Int64)
+	}
+	if d.pwMinClasses.Valid {
+		fmt.Fprintf(&line, ", pw_min_classes=%d", d.pwMinClasses.Int64)
+	}
+	if d.quota.Valid {
+		fmt.Fprintf(&line, ", quota=%s", d.quota.String)
+	}
 	return line.String()
 }
 
@@ -147,6 +166,33 @@ func (d *Domain) Rclass() string {
 	}
 }
 
+// Quota
+// The default quota rule of the domain's mailboxes
+func (d *Domain) Quota() string {
+	if d.quota.Valid {
+		return d.quota.String
+	} else {
+		return "--"
+	}
+}
+
+// PwPolicy
+// The password rules of a domain's mailboxes. Zero is no rule.
+type PwPolicy struct {
+	MaxAge     int64 // days until a password expires
+	MinLength  int64
+	MinClasses int64 // of lower case, upper case, digits and others
+}
+
+// PwPolicy
+func (d *Domain) PwPolicy() PwPolicy {
+	return PwPolicy{
+		MaxAge:     d.pwMaxAge.Int64,
+		MinLength:  d.pwMinLength.Int64,
+		MinClasses: d.pwMinClasses.Int64,
+	}
+}
+
 // IsInternet
 func (d *Domain) IsInternet() bool {
 	if d.class == internet {
@@ -195,6 +241,12 @@ func (d *Domain) IsVmailbox() bool {
 // LookupDomain
 // Does lookup outside a transaction
 func (mdb *MailDB) LookupDomain(name string) (*Domain, error) {
+	return mdb.LookupDomainContext(context.Background(), name)
+}
+
+// LookupDomainContext
+// LookupDomain that gives up when ctx is done
+func (mdb *MailDB) LookupDomainContext(ctx context.Context, name string) (*Domain, error) {
 	var (
 		access sql.NullInt64
 		trans  sql.NullInt64
@@ -208,20 +260,22 @@ func (mdb *MailDB) LookupDomain(name string) (*Domain, error) {
 		mdb:  mdb,
 		name: name,
 	}
-	row := mdb.db.QueryRow(
-		"SELECT id, class, transport, access, vuid, vgid FROM domain WHERE name = ?",
+	row := mdb.db.QueryRowContext(ctx,
+		`SELECT id, class, transport, access, vuid, vgid,
+ pw_max_age, pw_min_length, pw_min_classes, quota FROM domain WHERE name = ?`,
 		name)
-	switch err := row.Scan(&d.id, &d.class, &trans, &access, &d.vuid, &d.vgid); err {
+	switch err := row.Scan(&d.id, &d.class, &trans, &access, &d.vuid, &d.vgid,
+		&d.pwMaxAge, &d.pwMinLength, &d.pwMinClasses, &d.quota); err {
 	case sql.ErrNoRows:
 		return nil, ErrMdbDomainNotFound
 	case nil:
 		if access.Valid {
-			if ac, err := mdb.getAccessById(access.Int64); err == nil {
+			if ac, err := mdb.getAccessById(ctx, access.Int64); err == nil {
 				d.access = ac
 			}
 		}
 		if err == nil && trans.Valid {
-			if tr, err := mdb.getTransportById(trans.Int64); err == nil {
+			if tr, err := mdb.getTransportById(ctx, trans.Int64); err == nil {
 				d.transport = tr
 			}
 		}
@@ -241,6 +295,12 @@ func (mdb *MailDB) LookupDomain(name string) (*Domain, error) {
 // '*.somedomain' - find all subdomains of somedomain
 // '*.*' - find all domains with subdomains
 func (mdb *MailDB) FindDomain(name string) ([]*Domain, error) {
+	return mdb.FindDomainContext(context.Background(), name)
+}
+
+// FindDomainContext
+// FindDomain that gives up when ctx is done
+func (mdb *MailDB) FindDomainContext(ctx context.Context, name string) ([]*Domain, error) {
 	var (
 		err    error
 		access sql.NullInt64
@@ -251,27 +311,30 @@ func (mdb *MailDB) FindDomain(name string) ([]*Domain, error) {
 	)
 	if name == "*" {
 		q = `
-SELECT id, name, class, transport, access, vuid, vgid FROM domain ORDER BY NAME`
+SELECT id, name, class, transport, access, vuid, vgid,
+ pw_max_age, pw_min_length, pw_min_classes, quota FROM domain ORDER BY NAME`
 	} else {
 		name = strings.ReplaceAll(name, "*", "%")
 		q = `
-SELECT id, name, class, transport, access, vuid, vgid FROM domain WHERE name LIKE ? ORDER BY name`
+SELECT id, name, class, transport, access, vuid, vgid,
+ pw_max_age, pw_min_length, pw_min_classes, quota FROM domain WHERE name LIKE ? ORDER BY name`
 	}
-	rows, err := mdb.db.Query(q, name)
+	rows, err := mdb.db.QueryContext(ctx, q, name)
 	if err == nil {
 		for rows.Next() {
 			d = &Domain{mdb: mdb}
 			if err = rows.Scan(&d.id, &d.name, &d.class, &trans,
-				&access, &d.vuid, &d.vgid); err != nil {
+				&access, &d.vuid, &d.vgid,
+				&d.pwMaxAge, &d.pwMinLength, &d.pwMinClasses, &d.quota); err != nil {
 				break
 			}
 			if access.Valid {
-				if ac, err := mdb.getAccessById(access.Int64); err == nil {
+				if ac, err := mdb.getAccessById(ctx, access.Int64); err == nil {
 					d.access = ac
 				}
 			}
 			if err == nil && trans.Valid {
-				if tr, err := mdb.getTransportById(trans.Int64); err == nil {
+				if tr, err := mdb.getTransportById(ctx, trans.Int64); err == nil {
 					d.transport = tr
 				}
 			}
@@ -296,23 +359,29 @@ SELECT id, name, class, transport, access, vuid, vgid FROM domain WHERE name LIK
 	}
 }
 
+// badDomainName
+// '..' means an empty sub-domain. not allowed
+func badDomainName(name string) bool {
+	return name == "" || strings.ContainsAny(name, "\n\r\t\f{}()[];\"") ||
+		strings.Contains(name, "..")
+}
+
 // InsertDomain
 // returns a *Domain. If error, rollback the transaction.
-func (mdb *MailDB) InsertDomain(name string) (*Domain, error) {
+func (tx *Tx) InsertDomain(name string) (*Domain, error) {
 	var (
 		res sql.Result
 		err error
 	)
 
-	if name == "" || strings.ContainsAny(name, "\n\r\t\f{}()[];\"") ||
-		strings.Contains(name, "..") { // '..' means an empty sub-domain. not allowed
+	if badDomainName(name) {
 		return nil, ErrMdbBadName
 	}
 
-	if mdb.tx == nil {
+	if !tx.active() {
 		return nil, ErrMdbTransaction
 	}
-	res, err = mdb.tx.Exec("INSERT INTO domain (name) VALUES (?)", name)
+	res, err = tx.insert("INSERT INTO domain (name) VALUES (?)", name)
 	if err != nil {
 		if IsErrConstraintUnique(err) {
 			err = ErrMdbDupDomain
@@ -321,12 +390,13 @@ func (mdb *MailDB) InsertDomain(name string) (*Domain, error) {
 		if dID, err := res.LastInsertId(); err == nil {
 			// Now query it to pick up the schema defaults
 			d := &Domain{
-				mdb:  mdb,
+				mdb:  tx.mdb,
+				tx:   tx,
 				id:   dID,
 				name: name,
 			}
 			// pick up the default class
-			row := mdb.tx.QueryRow("SELECT class FROM domain WHERE id = ?", dID)
+			row := tx.queryRow("SELECT class FROM domain WHERE id = ?", dID)
 			if err = row.Scan(&d.class); err == nil {
 				return d, nil
 			}
@@ -337,7 +407,7 @@ func (mdb *MailDB) InsertDomain(name string) (*Domain, error) {
 
 // GetDomain
 // fetch the domain under transaction
-func (mdb *MailDB) GetDomain(name string) (*Domain, error) {
+func (tx *Tx) GetDomain(name string) (*Domain, error) {
 	var (
 		access sql.NullInt64
 		trans  sql.NullInt64
@@ -348,26 +418,29 @@ func (mdb *MailDB) GetDomain(name string) (*Domain, error) {
 		return nil, ErrMdbBadName
 	}
 	d := &Domain{
-		mdb:  mdb,
+		mdb:  tx.mdb,
+		tx:   tx,
 		name: name,
 	}
-	if mdb.tx == nil {
+	if !tx.active() {
 		return nil, ErrMdbTransaction
 	}
-	row := mdb.tx.QueryRow(
-		"SELECT id, class, transport, access, vuid, vgid FROM domain WHERE name = ?",
+	row := tx.queryRow(
+		`SELECT id, class, transport, access, vuid, vgid,
+ pw_max_age, pw_min_length, pw_min_classes, quota FROM domain WHERE name = ?`,
 		name)
-	switch err = row.Scan(&d.id, &d.class, &trans, &access, &d.vuid, &d.vgid); err {
+	switch err = row.Scan(&d.id, &d.class, &trans, &access, &d.vuid, &d.vgid,
+		&d.pwMaxAge, &d.pwMinLength, &d.pwMinClasses, &d.quota); err {
 	case sql.ErrNoRows:
 		err = ErrMdbDomainNotFound
 	case nil:
 		if access.Valid {
-			if ac, err := mdb.getAccessByIdTx(access.Int64); err == nil {
+			if ac, err := tx.getAccessById(access.Int64); err == nil {
 				d.access = ac
 			}
 		}
 		if err == nil && trans.Valid {
-			if tr, err := mdb.getTransportByIdTx(trans.Int64); err == nil {
+			if tr, err := tx.getTransportById(trans.Int64); err == nil {
 				d.transport = tr
 			}
 		}
@@ -390,14 +463,18 @@ func (d *Domain) SetClass(class string) error {
 	)
 
 	if class == "" {
-		dclass = Class(d.mdb.DefaultInt("domain.class"))
+		dc, err := d.mdb.DefaultInt("domain.class")
+		if err != nil {
+			return err
+		}
+		dclass = Class(dc)
 	} else {
 		if dclass, ok = className[strings.ToLower(class)]; !ok {
 			fmt.Printf("Bad class (%s)\n", class)
 			return ErrMdbBadClass
 		}
 	}
-	res, err := d.mdb.tx.Exec("UPDATE domain SET class = ? WHERE id = ?", dclass, d.id)
+	res, err := d.tx.exec("UPDATE domain SET class = ? WHERE id = ?", dclass, d.id)
 	if err == nil {
 		c, err := res.RowsAffected()
 		if err == nil {
@@ -420,10 +497,10 @@ func (d *Domain) SetTransport(name string) error {
 		err error
 	)
 
-	if tr, err = d.mdb.GetTransport(name); err != nil {
+	if tr, err = d.tx.GetTransport(name); err != nil {
 		return err
 	}
-	res, err := d.mdb.tx.Exec("UPDATE domain SET transport = ? WHERE id = ?", tr.id, d.id)
+	res, err := d.tx.exec("UPDATE domain SET transport = ? WHERE id = ?", tr.id, d.id)
 	if err == nil {
 		c, err := res.RowsAffected()
 		if err == nil {
@@ -439,7 +516,7 @@ func (d *Domain) SetTransport(name string) error {
 
 // ClearTransport
 func (d *Domain) ClearTransport() error {
-	res, err := d.mdb.tx.Exec("UPDATE domain SET transport = NULL WHERE id = ?", d.id)
+	res, err := d.tx.exec("UPDATE domain SET transport = NULL WHERE id = ?", d.id)
 	if err == nil {
 		c, err := res.RowsAffected()
 		if err == nil {
@@ -457,7 +534,7 @@ func (d *Domain) ClearTransport() error {
 func (d *Domain) SetVUid(vuid int64) error {
 	var err error
 
-	res, err := d.mdb.tx.Exec("UPDATE domain SET vuid = ? WHERE id = ?", vuid, d.id)
+	res, err := d.tx.exec("UPDATE domain SET vuid = ? WHERE id = ?", vuid, d.id)
 	if err == nil {
 		c, err := res.RowsAffected()
 		if err == nil {
@@ -475,7 +552,7 @@ func (d *Domain) SetVUid(vuid int64) error {
 func (d *Domain) ClearVUid() error {
 	var err error
 
-	res, err := d.mdb.tx.Exec("UPDATE domain SET vuid = NULL WHERE id = ?", d.id)
+	res, err := d.tx.exec("UPDATE domain SET vuid = NULL WHERE id = ?", d.id)
 	if err == nil {
 		c, err := res.RowsAffected()
 		if err == nil {
@@ -493,7 +570,7 @@ func (d *Domain) ClearVUid() error {
 func (d *Domain) SetVGid(vgid int64) error {
 	var err error
 
-	res, err := d.mdb.tx.Exec("UPDATE domain SET vgid = ? WHERE id = ?", vgid, d.id)
+	res, err := d.tx.exec("UPDATE domain SET vgid = ? WHERE id = ?", vgid, d.id)
 	if err == nil {
 		c, err := res.RowsAffected()
 		if err == nil {
@@ -511,7 +588,7 @@ func (d *Domain) SetVGid(vgid int64) error {
 func (d *Domain) ClearVGid() error {
 	var err error
 
-	res, err := d.mdb.tx.Exec("UPDATE domain SET vgid = NULL WHERE id = ?", d.id)
+	res, err := d.tx.exec("UPDATE domain SET vgid = NULL WHERE id = ?", d.id)
 	if err == nil {
 		c, err := res.RowsAffected()
 		if err == nil {
@@ -532,10 +609,10 @@ func (d *Domain) SetRclass(rclass string) error {
 		err error
 	)
 
-	if a, err = d.mdb.GetAccess(rclass); err != nil {
+	if a, err = d.tx.GetAccess(rclass); err != nil {
 		return err
 	}
-	res, err := d.mdb.tx.Exec("UPDATE domain SET access = ? WHERE id = ?", a.id, d.id)
+	res, err := d.tx.exec("UPDATE domain SET access = ? WHERE id = ?", a.id, d.id)
 	if err == nil {
 		c, err := res.RowsAffected()
 		if err == nil {
@@ -551,7 +628,7 @@ func (d *Domain) SetRclass(rclass string) error {
 
 // ClearRclass
 func (d *Domain) ClearRclass() error {
-	res, err := d.mdb.tx.Exec("UPDATE domain SET access = NULL WHERE id = ?", d.id)
+	res, err := d.tx.exec("UPDATE domain SET access = NULL WHERE id = ?", d.id)
 	if err == nil {
 		c, err := res.RowsAffected()
 		if err == nil {
@@ -565,9 +642,84 @@ func (d *Domain) ClearRclass() error {
 	return err
 }
 
+// setPolicy
+// Set one password policy column. Zero clears it.
+func (d *Domain) setPolicy(col string, n int64, max int64, field *sql.NullInt64) error {
+	if n < 0 || (max > 0 && n > max) {
+		return ErrMdbBadPwPolicy
+	}
+	val := sql.NullInt64{Valid: n > 0, Int64: n}
+	res, err := d.tx.exec("UPDATE domain SET "+col+" = ? WHERE id = ?", val, d.id)
+	if err == nil {
+		c, err := res.RowsAffected()
+		if err == nil {
+			if c == 1 {
+				*field = val
+			} else {
+				err = ErrMdbDomainNotFound
+			}
+		}
+	}
+	return err
+}
+
+// SetPwMaxAge
+// Passwords of the domain's mailboxes expire after days. Zero is never.
+func (d *Domain) SetPwMaxAge(days int64) error {
+	return d.setPolicy("pw_max_age", days, 0, &d.pwMaxAge)
+}
+
+// SetPwMinLength
+func (d *Domain) SetPwMinLength(length int64) error {
+	return d.setPolicy("pw_min_length", length, 0, &d.pwMinLength)
+}
+
+// SetPwMinClasses
+// How many of the four kinds of characters a password needs
+func (d *Domain) SetPwMinClasses(classes int64) error {
+	return d.setPolicy("pw_min_classes", classes, 4, &d.pwMinClasses)
+}
+
+// SetQuota
+// The quota rule of the domain's mailboxes that don't have their own
+func (d *Domain) SetQuota(quota string) error {
+	quota = strings.TrimSpace(quota)
+	if _, err := ParseQuotaRule(quota); err != nil {
+		return err
+	}
+	res, err := d.tx.exec("UPDATE domain SET quota = ? WHERE id = ?", quota, d.id)
+	if err == nil {
+		c, err := res.RowsAffected()
+		if err == nil {
+			if c == 1 {
+				d.quota = sql.NullString{Valid: true, String: quota}
+			} else {
+				err = ErrMdbDomainNotFound
+			}
+		}
+	}
+	return err
+}
+
+// ClearQuota
+func (d *Domain) ClearQuota() error {
+	res, err := d.tx.exec("UPDATE domain SET quota = NULL WHERE id = ?", d.id)
+	if err == nil {
+		c, err := res.RowsAffected()
+		if err == nil {
+			if c == 1 {
+				d.quota = NullStr
+			} else {
+				err = ErrMdbDomainNotFound
+			}
+		}
+	}
+	return err
+}
+
 // DeleteDomain
-func (mdb *MailDB) DeleteDomain(name string) error {
-	res, err := mdb.db.Exec("DELETE FROM domain WHERE name = ?", name)
+func (tx *Tx) DeleteDomain(name string) error {
+	res, err := tx.exec("DELETE FROM domain WHERE name = ?", name)
 	if err != nil {
 		if IsErrConstraintForeignKey(err) {
 			err = ErrMdbDomainBusy
@@ -582,3 +734,83 @@ func (mdb *MailDB) DeleteDomain(name string) error {
 	}
 	return err
 }
+
+// localparts
+// The localparts of the domain's mailboxes
+func (d *Domain) localparts() ([]string, error) {
+	var lpl []string
+
+	rows, err := d.tx.query(`SELECT localpart FROM address
+ WHERE domain = ? AND id IN (SELECT id FROM vmailbox) ORDER BY localpart`, d.id)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var lp string
+		if err = rows.Scan(&lp); err != nil {
+			break
+		}
+		lpl = append(lpl, lp)
+	}
+	if e := rows.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err != nil {
+		return nil, err
+	}
+	return lpl, nil
+}
+
+// Mailboxes
+// The addresses of the domain's mailboxes. Transaction required
+func (d *Domain) Mailboxes() ([]string, error) {
+	if !d.tx.active() {
+		return nil, ErrMdbTransaction
+	}
+	lpl, err := d.localparts()
+	if err != nil {
+		return nil, err
+	}
+	for i, lp := range lpl {
+		lpl[i] = lp + "@" + d.name
+	}
+	return lpl, nil
+}
+
+// RenameDomain
+// Change the name of the domain in place so its addresses, and the
+// aliases and mailboxes of them, stay with it. If keepOld, the old name
+// becomes an alias domain of the new one so mail to it still arrives.
+func (tx *Tx) RenameDomain(old string, new string, keepOld bool) (*Domain, error) {
+	if badDomainName(new) {
+		return nil, ErrMdbBadName
+	}
+	d, err := tx.GetDomain(old)
+	if err != nil {
+		return nil, err
+	}
+	mbl, err := d.localparts()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = tx.exec("UPDATE domain SET name = ? WHERE id = ?", new, d.id); err != nil {
+		if IsErrConstraintUnique(err) {
+			err = ErrMdbDupDomain
+		}
+		return nil, err
+	}
+	// dovecot keeps the usage by name, not id
+	for _, lp := range mbl {
+		_, err = tx.exec("UPDATE quotausage SET username = ? WHERE username = ?",
+			lp+"@"+new, lp+"@"+old)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if keepOld {
+		if _, err = tx.SetAliasDomain(old, new); err != nil {
+			return nil, err
+		}
+	}
+	return tx.GetDomain(new)
+}
@@ -35,6 +35,7 @@ import (
 // TestDomain
 func TestDomain(t *testing.T) {
 	var (
+		tx  *Tx
 		err error
 		mdb *MailDB
 		dir string
@@ -53,7 +54,7 @@ func TestDomain(t *testing.T) {
 	defer mdb.Close()
 
 	// Try to insert a domain without a transaction
-	d, err = mdb.InsertDomain("foo")
+	d, err = tx.InsertDomain("foo")
 	if err == nil {
 		t.Errorf("Insert with no transaction did not fail")
 		return
@@ -63,9 +64,9 @@ func TestDomain(t *testing.T) {
 	}
 
 	// Try to insert a domain
-	mdb.Begin()
-	d, err = mdb.InsertDomain("foo")
-	mdb.End(&err)
+	tx = beginTx(t, mdb)
+	d, err = tx.InsertDomain("foo")
+	tx.End(&err)
 	if err != nil {
 		t.Errorf("Insert foo: %s", err)
 		return // no need to go further this early
@@ -105,29 +106,29 @@ func TestDomain(t *testing.T) {
 	}
 
 	// Try some bad args...
-	mdb.Begin()
-	d, err = mdb.InsertDomain("")
-	mdb.End(&err)
+	tx = beginTx(t, mdb)
+	d, err = tx.InsertDomain("")
+	tx.End(&err)
 	if err == nil {
 		t.Errorf("Insert \"\" should have failed")
 	} else if err != ErrMdbBadName {
 		t.Errorf("Insert of \"\": %s", err)
 	}
-	mdb.Begin()
-	d, err = mdb.InsertDomain(";bogus")
-	mdb.End(&err)
+	tx = beginTx(t, mdb)
+	d, err = tx.InsertDomain(";bogus")
+	tx.End(&err)
 	if err == nil {
 		t.Errorf("Insert \";bogus\" should have failed")
 	} else if err != ErrMdbBadName {
 		t.Errorf("Insert of \";bogus\": %s", err)
 	}
 
-	mdb.Begin()
-	d, err = mdb.InsertDomain("baz")
+	tx = beginTx(t, mdb)
+	d, err = tx.InsertDomain("baz")
 	if err == nil {
 		err = d.SetClass("jazz")
 	}
-	mdb.End(&err)
+	tx.End(&err)
 	if err == nil {
 		t.Errorf("Insert \"jazz\" should have failed")
 	} else if err != ErrMdbBadClass {
@@ -175,11 +176,11 @@ func TestDomain(t *testing.T) {
 
 	// First add an access and transport so we can see if we can set them
 	// get the domain for transactions, set some of the fields, and check
-	mdb.Begin()
-	if _, err = mdb.InsertAccess("spam", "gooberfilter"); err != nil {
+	tx = beginTx(t, mdb)
+	if _, err = tx.InsertAccess("spam", "gooberfilter"); err != nil {
 		t.Errorf("Insert spam entry unexpectedly failed, %s", err)
 	}
-	if tr, err := mdb.InsertTransport("relay"); err != nil {
+	if tr, err := tx.InsertTransport("relay"); err != nil {
 		t.Errorf("Insert relay unexpectedly failed, %s", err)
 	} else {
 		if err = tr.SetTransport("relay"); err != nil {
@@ -188,15 +189,15 @@ func TestDomain(t *testing.T) {
 			t.Errorf("Insert relay: set nexthop localhost:56 failed, %s", err)
 		}
 	}
-	mdb.End(&err)
+	tx.End(&err)
 
 	var exportLine string = "foo class=internet, transport=relay, vuid=53, vgid=42, rclass=spam"
 	// new transaction
-	mdb.Begin()
-	d, err = mdb.GetDomain("foo")
+	tx = beginTx(t, mdb)
+	d, err = tx.GetDomain("foo")
 	if err != nil {
 		t.Errorf("Get foo: %s", err)
-		mdb.End(&err)
+		tx.End(&err)
 	} else {
 		if err = d.SetVUid(53); err != nil {
 			t.Errorf("SetVUid foo, %s", err)
@@ -210,7 +211,7 @@ func TestDomain(t *testing.T) {
 		if err = d.SetTransport("relay"); err != nil {
 			t.Errorf("SetTransport foo, %s", err)
 		}
-		mdb.End(&err)
+		tx.End(&err)
 		// now check it
 		if dn, err := mdb.LookupDomain("foo"); err != nil {
 			t.Errorf("Lookup foo after sets, %s", err)
@@ -237,10 +238,10 @@ func TestDomain(t *testing.T) {
 	}
 
 	// Now clear fields
-	mdb.Begin()
-	d, err = mdb.GetDomain("foo")
+	tx = beginTx(t, mdb)
+	d, err = tx.GetDomain("foo")
 	if err != nil {
-		mdb.End(&err)
+		tx.End(&err)
 		t.Errorf("Get foo: %s", err)
 	} else {
 		if err = d.ClearVUid(); err != nil {
@@ -255,7 +256,7 @@ func TestDomain(t *testing.T) {
 		if err = d.ClearTransport(); err != nil {
 			t.Errorf("ClearTransport foo, %s", err)
 		}
-		mdb.End(&err)
+		tx.End(&err)
 		// now check it
 		if dn, err := mdb.LookupDomain("foo"); err != nil {
 			t.Errorf("Lookup foo after clears, %s", err)
@@ -318,14 +319,14 @@ func TestDomain(t *testing.T) {
 			"tie.bar.net",
 			"zip.bar.net"},
 	}
-	mdb.Begin()
+	tx = beginTx(t, mdb)
 	for _, dom := range domainList {
-		if d, err = mdb.InsertDomain(dom); err != nil {
+		if d, err = tx.InsertDomain(dom); err != nil {
 			t.Errorf("Insert domains: unexpected error, %s", err)
 			break
 		}
 	}
-	mdb.End(&err)
+	tx.End(&err)
 	if err == nil { // only check if inserts passed
 		for q, l := range dlists {
 			dl, err := mdb.FindDomain(q)
@@ -344,12 +345,155 @@ func TestDomain(t *testing.T) {
 	}
 
 	// Delete stuff
-	err = mdb.DeleteDomain("baz")
+	err = mdb.WithTx(func(tx *Tx) error { return tx.DeleteDomain("baz") })
 	if err == nil {
 		t.Errorf("Delete baz should have failed")
 	}
-	err = mdb.DeleteDomain("foo")
+	err = mdb.WithTx(func(tx *Tx) error { return tx.DeleteDomain("foo") })
 	if err != nil {
 		t.Errorf("Delete foo: %s", err)
 	}
 }
+
+// TestRename
+// Domains, transports and access rules keep everything that uses them
+func TestRename(t *testing.T) {
+	var (
+		err error
+		mdb *MailDB
+		dir string
+		d   *Domain
+	)
+
+	fmt.Printf("Rename Test\n")
+
+	dir, err = ioutil.TempDir("", "TestRename-*")
+	defer os.RemoveAll(dir)
+	mdb, err = makeTestDB(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Errorf("Database load failed, %s", err)
+		return
+	}
+	defer mdb.Close()
+
+	err = mdb.WithTx(func(tx *Tx) error {
+		for _, n := range []string{"relay", "lmtp"} {
+			if _, err := tx.InsertTransport(n); err != nil {
+				return err
+			}
+		}
+		for _, n := range []string{"block", "allow"} {
+			if _, err := tx.InsertAccess(n, "OK"); err != nil {
+				return err
+			}
+		}
+		d, err := tx.InsertDomain("empire.org")
+		if err == nil {
+			err = d.SetClass("vmailbox")
+		}
+		if err == nil {
+			err = d.SetTransport("relay")
+		}
+		if err == nil {
+			err = d.SetRclass("block")
+		}
+		if err != nil {
+			return err
+		}
+		if _, err = tx.InsertDomain("rebels.org"); err != nil {
+			return err
+		}
+		if _, err = tx.InsertVMailbox("vader@empire.org"); err != nil {
+			return err
+		}
+		a, err := tx.GetOrInsAddress("lord@empire.org")
+		if err == nil {
+			err = a.AttachAlias("vader@empire.org")
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Setup: %s", err)
+	}
+	if _, err = mdb.db.Exec("INSERT INTO quotausage (username, bytes, messages) VALUES (?, ?, ?)",
+		"vader@empire.org", 2048, 3); err != nil {
+		t.Fatalf("Make usage: %s", err)
+	}
+
+	err = mdb.WithTx(func(tx *Tx) error {
+		if tr, err := tx.RenameTransport("relay", "smarthost"); err != nil || tr.Name() != "smarthost" {
+			return fmt.Errorf("rename relay: got %v, %v", tr, err)
+		}
+		if a, err := tx.RenameAccess("block", "reject"); err != nil || a.Name() != "reject" {
+			return fmt.Errorf("rename block: got %v, %v", a, err)
+		}
+		d, err = tx.RenameDomain("empire.org", "first-order.org", true)
+		if err != nil {
+			return err
+		}
+		ml, err := d.Mailboxes()
+		if err != nil || len(ml) != 1 || ml[0] != "vader@first-order.org" {
+			return fmt.Errorf("mailboxes of first-order.org: got %v, %v", ml, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Renames: %s", err)
+	}
+	if d.Transport() != "smarthost" || d.Rclass() != "reject" || !d.IsVmailbox() {
+		t.Errorf("first-order.org: got %s", d.Export())
+	}
+	if od, err := mdb.LookupDomain("empire.org"); err != nil || !od.IsVirtual() {
+		t.Errorf("empire.org: expected a virtual domain, got %v, %v", od, err)
+	}
+	if ad, err := mdb.LookupAliasDomain("empire.org"); err != nil || ad.Target() != "first-order.org" {
+		t.Errorf("empire.org: expected an alias domain of first-order.org, got %v, %v", ad, err)
+	}
+	vm, err := mdb.LookupVMailbox("vader@first-order.org")
+	if err != nil {
+		t.Errorf("Lookup vader@first-order.org: %s", err)
+	} else if q, err := mdb.LookupQuotaUsage(vm); err != nil || q.Bytes() != 2048 {
+		t.Errorf("Usage of vader@first-order.org: got %v, %v", q, err)
+	}
+	for _, c := range [][]string{
+		{"vader", "empire.org", "vader@first-order.org"},
+		{"lord", "empire.org", "lord@first-order.org"},
+		{"lord", "first-order.org", "vader@first-order.org"},
+	} {
+		var r string
+		row := mdb.db.QueryRow("SELECT recipient FROM virt_alias WHERE mailbox = ? AND domain_name = ?",
+			c[0], c[1])
+		if err = row.Scan(&r); err != nil || r != c[2] {
+			t.Errorf("virt_alias %s@%s: expected %s, got %q, %v", c[0], c[1], c[2], r, err)
+		}
+	}
+
+	// Mistakes
+	err = mdb.WithTx(func(tx *Tx) error {
+		if _, err := tx.RenameTransport("smarthost", "lmtp"); err != ErrMdbDupTrans {
+			return fmt.Errorf("transport onto lmtp: expected ErrMdbDupTrans, got %v", err)
+		}
+		if _, err := tx.RenameTransport("relay", "uucp"); err != ErrMdbTransNotFound {
+			return fmt.Errorf("transport relay: expected ErrMdbTransNotFound, got %v", err)
+		}
+		if _, err := tx.RenameAccess("reject", "allow"); err != ErrMdbDupAccess {
+			return fmt.Errorf("access onto allow: expected ErrMdbDupAccess, got %v", err)
+		}
+		if _, err := tx.RenameAccess("reject", ""); err != ErrMdbBadName {
+			return fmt.Errorf("access to nothing: expected ErrMdbBadName, got %v", err)
+		}
+		if _, err := tx.RenameDomain("first-order.org", "rebels.org", false); err != ErrMdbDupDomain {
+			return fmt.Errorf("domain onto rebels.org: expected ErrMdbDupDomain, got %v", err)
+		}
+		if _, err := tx.RenameDomain("first-order.org", "first..order", false); err != ErrMdbBadName {
+			return fmt.Errorf("domain to first..order: expected ErrMdbBadName, got %v", err)
+		}
+		if _, err := tx.RenameDomain("sith.org", "jedi.org", false); err != ErrMdbDomainNotFound {
+			return fmt.Errorf("domain sith.org: expected ErrMdbDomainNotFound, got %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Rename mistakes: %s", err)
+	}
+}
@@ -0,0 +1,10 @@
+-- Version 2
+-- Add the schema_version table to a database created before
+-- we tracked schema versions. Migrate inserts the row for this
+-- version so we only create the table here.
+-- No BEGIN/COMMIT here. Migrate wraps all the scripts in one transaction.
+CREATE TABLE IF NOT EXISTS "schema_version" (
+       version INTEGER PRIMARY KEY,
+       applied TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+       description TEXT
+       );
@@ -0,0 +1,253 @@
+-- Version 3
+-- Add the audit trail. See schema.sql for the details.
+-- No BEGIN/COMMIT here. Migrate wraps all the scripts in one transaction.
+-- Audit trail
+-- Every change to the tables above is recorded by the triggers below.
+-- The maildb transaction code fills in audit_context with who did it and
+-- the command line at the start of each transaction so the triggers,
+-- including the ones fired by cascaded deletes, can record it. Changes made
+-- outside postdove, e.g. by the sqlite3 shell, have no context and are
+-- recorded with a NULL user and command. Passwords are never recorded.
+DROP TABLE IF EXISTS "audit_context";
+CREATE TABLE "audit_context" (
+       id INTEGER PRIMARY KEY CHECK (id = 1), -- there is only ever one row
+       user TEXT,
+       command TEXT
+       );
+
+DROP INDEX IF EXISTS audit_stamp;
+DROP TABLE IF EXISTS "Audit";
+CREATE TABLE "Audit" (
+       id INTEGER PRIMARY KEY,
+       stamp TEXT NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%S', 'now')), -- UTC
+       user TEXT,
+       command TEXT,
+       entity TEXT NOT NULL, -- what changed, e.g. domain or mailbox
+       op TEXT NOT NULL, -- INSERT|UPDATE|DELETE
+       key TEXT, -- the name of the row in postdove terms
+       before TEXT, -- JSON object of the row before the change
+       after TEXT -- JSON object of the row after the change
+       );
+
+CREATE INDEX audit_stamp ON audit(stamp);
+
+-- address_name
+-- The full name of an address, i.e. 'localpart' or 'localpart@domain'
+DROP VIEW IF EXISTS "address_name";
+CREATE VIEW "address_name" AS
+       SELECT a.id AS id,
+              a.localpart || COALESCE('@' || d.name, '') AS name
+       FROM address AS a LEFT JOIN domain AS d ON (a.domain = d.id);
+
+-- Deletes are recorded BEFORE the row goes so we can still resolve
+-- the names of what it references. The cascade triggers run after.
+DROP TRIGGER IF EXISTS audit_access_insert;
+CREATE TRIGGER audit_access_insert AFTER INSERT ON access
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'access', 'INSERT', NEW.name,
+           json_object('name', NEW.name, 'action', NEW.action)); END;
+
+DROP TRIGGER IF EXISTS audit_access_update;
+CREATE TRIGGER audit_access_update AFTER UPDATE ON access
+ WHEN OLD.name IS NOT NEW.name OR OLD.action IS NOT NEW.action
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'access', 'UPDATE', NEW.name,
+           json_object('name', OLD.name, 'action', OLD.action),
+           json_object('name', NEW.name, 'action', NEW.action)); END;
+
+DROP TRIGGER IF EXISTS audit_access_delete;
+CREATE TRIGGER audit_access_delete BEFORE DELETE ON access
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'access', 'DELETE', OLD.name,
+           json_object('name', OLD.name, 'action', OLD.action)); END;
+
+DROP TRIGGER IF EXISTS audit_transport_insert;
+CREATE TRIGGER audit_transport_insert AFTER INSERT ON transport
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'transport', 'INSERT', NEW.name,
+           json_object('name', NEW.name, 'transport', NEW.transport,
+                       'nexthop', NEW.nexthop)); END;
+
+DROP TRIGGER IF EXISTS audit_transport_update;
+CREATE TRIGGER audit_transport_update AFTER UPDATE ON transport
+ WHEN OLD.name IS NOT NEW.name OR OLD.transport IS NOT NEW.transport
+      OR OLD.nexthop IS NOT NEW.nexthop
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'transport', 'UPDATE', NEW.name,
+           json_object('name', OLD.name, 'transport', OLD.transport,
+                       'nexthop', OLD.nexthop),
+           json_object('name', NEW.name, 'transport', NEW.transport,
+                       'nexthop', NEW.nexthop)); END;
+
+DROP TRIGGER IF EXISTS audit_transport_delete;
+CREATE TRIGGER audit_transport_delete BEFORE DELETE ON transport
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'transport', 'DELETE', OLD.name,
+           json_object('name', OLD.name, 'transport', OLD.transport,
+                       'nexthop', OLD.nexthop)); END;
+
+DROP TRIGGER IF EXISTS audit_domain_insert;
+CREATE TRIGGER audit_domain_insert AFTER INSERT ON domain
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'domain', 'INSERT', NEW.name,
+           json_object('name', NEW.name, 'class', NEW.class,
+                       'transport', (SELECT name FROM transport WHERE id = NEW.transport),
+                       'access', (SELECT name FROM access WHERE id = NEW.access),
+                       'vuid', NEW.vuid, 'vgid', NEW.vgid)); END;
+
+DROP TRIGGER IF EXISTS audit_domain_update;
+CREATE TRIGGER audit_domain_update AFTER UPDATE ON domain
+ WHEN OLD.name IS NOT NEW.name OR OLD.class IS NOT NEW.class
+      OR OLD.transport IS NOT NEW.transport OR OLD.access IS NOT NEW.access
+      OR OLD.vuid IS NOT NEW.vuid OR OLD.vgid IS NOT NEW.vgid
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'domain', 'UPDATE', NEW.name,
+           json_object('name', OLD.name, 'class', OLD.class,
+                       'transport', (SELECT name FROM transport WHERE id = OLD.transport),
+                       'access', (SELECT name FROM access WHERE id = OLD.access),
+                       'vuid', OLD.vuid, 'vgid', OLD.vgid),
+           json_object('name', NEW.name, 'class', NEW.class,
+                       'transport', (SELECT name FROM transport WHERE id = NEW.transport),
+                       'access', (SELECT name FROM access WHERE id = NEW.access),
+                       'vuid', NEW.vuid, 'vgid', NEW.vgid)); END;
+
+DROP TRIGGER IF EXISTS audit_domain_delete;
+CREATE TRIGGER audit_domain_delete BEFORE DELETE ON domain
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'domain', 'DELETE', OLD.name,
+           json_object('name', OLD.name, 'class', OLD.class,
+                       'transport', (SELECT name FROM transport WHERE id = OLD.transport),
+                       'access', (SELECT name FROM access WHERE id = OLD.access),
+                       'vuid', OLD.vuid, 'vgid', OLD.vgid)); END;
+
+DROP TRIGGER IF EXISTS audit_address_insert;
+CREATE TRIGGER audit_address_insert AFTER INSERT ON address
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'address', 'INSERT', (SELECT name FROM address_name WHERE id = NEW.id),
+           json_object('localpart', NEW.localpart,
+                       'domain', (SELECT name FROM domain WHERE id = NEW.domain),
+                       'transport', (SELECT name FROM transport WHERE id = NEW.transport),
+                       'access', (SELECT name FROM access WHERE id = NEW.access))); END;
+
+DROP TRIGGER IF EXISTS audit_address_update;
+CREATE TRIGGER audit_address_update AFTER UPDATE ON address
+ WHEN OLD.localpart IS NOT NEW.localpart OR OLD.domain IS NOT NEW.domain
+      OR OLD.transport IS NOT NEW.transport OR OLD.access IS NOT NEW.access
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'address', 'UPDATE', (SELECT name FROM address_name WHERE id = NEW.id),
+           json_object('localpart', OLD.localpart,
+                       'domain', (SELECT name FROM domain WHERE id = OLD.domain),
+                       'transport', (SELECT name FROM transport WHERE id = OLD.transport),
+                       'access', (SELECT name FROM access WHERE id = OLD.access)),
+           json_object('localpart', NEW.localpart,
+                       'domain', (SELECT name FROM domain WHERE id = NEW.domain),
+                       'transport', (SELECT name FROM transport WHERE id = NEW.transport),
+                       'access', (SELECT name FROM access WHERE id = NEW.access))); END;
+
+DROP TRIGGER IF EXISTS audit_address_delete;
+CREATE TRIGGER audit_address_delete BEFORE DELETE ON address
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'address', 'DELETE', (SELECT name FROM address_name WHERE id = OLD.id),
+           json_object('localpart', OLD.localpart,
+                       'domain', (SELECT name FROM domain WHERE id = OLD.domain),
+                       'transport', (SELECT name FROM transport WHERE id = OLD.transport),
+                       'access', (SELECT name FROM access WHERE id = OLD.access))); END;
+
+DROP TRIGGER IF EXISTS audit_alias_insert;
+CREATE TRIGGER audit_alias_insert AFTER INSERT ON alias
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'alias', 'INSERT', (SELECT name FROM address_name WHERE id = NEW.address),
+           json_object('address', (SELECT name FROM address_name WHERE id = NEW.address),
+                       'target', (SELECT name FROM address_name WHERE id = NEW.target),
+                       'extension', NEW.extension)); END;
+
+DROP TRIGGER IF EXISTS audit_alias_update;
+CREATE TRIGGER audit_alias_update AFTER UPDATE ON alias
+ WHEN OLD.address IS NOT NEW.address OR OLD.target IS NOT NEW.target
+      OR OLD.extension IS NOT NEW.extension
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'alias', 'UPDATE', (SELECT name FROM address_name WHERE id = NEW.address),
+           json_object('address', (SELECT name FROM address_name WHERE id = OLD.address),
+                       'target', (SELECT name FROM address_name WHERE id = OLD.target),
+                       'extension', OLD.extension),
+           json_object('address', (SELECT name FROM address_name WHERE id = NEW.address),
+                       'target', (SELECT name FROM address_name WHERE id = NEW.target),
+                       'extension', NEW.extension)); END;
+
+DROP TRIGGER IF EXISTS audit_alias_delete;
+CREATE TRIGGER audit_alias_delete BEFORE DELETE ON alias
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'alias', 'DELETE', (SELECT name FROM address_name WHERE id = OLD.address),
+           json_object('address', (SELECT name FROM address_name WHERE id = OLD.address),
+                       'target', (SELECT name FROM address_name WHERE id = OLD.target),
+                       'extension', OLD.extension)); END;
+
+DROP TRIGGER IF EXISTS audit_vmailbox_insert;
+CREATE TRIGGER audit_vmailbox_insert AFTER INSERT ON vmailbox
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'mailbox', 'INSERT', (SELECT name FROM address_name WHERE id = NEW.id),
+           json_object('pw_type', NEW.pw_type, 'password', NEW.password IS NOT NULL,
+                       'uid', NEW.uid, 'gid', NEW.gid, 'home', NEW.home,
+                       'quota', NEW.quota, 'enable', NEW.enable)); END;
+
+DROP TRIGGER IF EXISTS audit_vmailbox_update;
+CREATE TRIGGER audit_vmailbox_update AFTER UPDATE ON vmailbox
+ WHEN OLD.pw_type IS NOT NEW.pw_type OR OLD.password IS NOT NEW.password
+      OR OLD.uid IS NOT NEW.uid OR OLD.gid IS NOT NEW.gid
+      OR OLD.home IS NOT NEW.home OR OLD.quota IS NOT NEW.quota
+      OR OLD.enable IS NOT NEW.enable
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'mailbox', 'UPDATE', (SELECT name FROM address_name WHERE id = NEW.id),
+           json_object('pw_type', OLD.pw_type, 'password', OLD.password IS NOT NULL,
+                       'uid', OLD.uid, 'gid', OLD.gid, 'home', OLD.home,
+                       'quota', OLD.quota, 'enable', OLD.enable),
+           json_object('pw_type', NEW.pw_type,
+                       'password', CASE WHEN OLD.password IS NOT NEW.password
+                                        THEN 'changed'
+                                        ELSE NEW.password IS NOT NULL END,
+                       'uid', NEW.uid, 'gid', NEW.gid, 'home', NEW.home,
+                       'quota', NEW.quota, 'enable', NEW.enable)); END;
+
+DROP TRIGGER IF EXISTS audit_vmailbox_delete;
+CREATE TRIGGER audit_vmailbox_delete BEFORE DELETE ON vmailbox
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'mailbox', 'DELETE', (SELECT name FROM address_name WHERE id = OLD.id),
+           json_object('pw_type', OLD.pw_type, 'password', OLD.password IS NOT NULL,
+                       'uid', OLD.uid, 'gid', OLD.gid, 'home', OLD.home,
+                       'quota', OLD.quota, 'enable', OLD.enable)); END;
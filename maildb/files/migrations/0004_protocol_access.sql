@@ -0,0 +1,131 @@
+-- Version 4
+-- Per protocol access for mailboxes. See schema.sql for the details.
+-- No BEGIN/COMMIT here. Migrate wraps all the scripts in one transaction.
+ALTER TABLE "VMailbox" ADD COLUMN allow_imap INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE "VMailbox" ADD COLUMN allow_pop3 INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE "VMailbox" ADD COLUMN allow_lmtp INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE "VMailbox" ADD COLUMN allow_submission INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE "VMailbox" ADD COLUMN allow_sieve INTEGER NOT NULL DEFAULT 1;
+
+-- user_mailbox
+-- The new columns are added to the view
+DROP VIEW IF EXISTS "user_mailbox";
+CREATE VIEW "user_mailbox" AS
+       SELECT mb.id AS id, a.localpart AS username, d.name AS domain,
+       	      '{' || mb.pw_type || '}' || COALESCE(mb.password, '*') AS password,
+	      COALESCE(mb.uid,
+	              COALESCE(d.vuid,
+		              (SELECT vuid FROM domain WHERE name = 'localhost'))) AS uid,
+	      COALESCE(mb.gid,
+	             COALESCE(d.vgid,
+		              (SELECT vgid FROM domain WHERE name = 'localhost'))) AS gid,
+	      COALESCE(mb.home, '') AS home,
+	      COALESCE(mb.quota, '*:bytes=0') AS quota_rule,
+       	      mb.enable AS enable,
+	      mb.allow_imap AS allow_imap, mb.allow_pop3 AS allow_pop3,
+	      mb.allow_lmtp AS allow_lmtp, mb.allow_submission AS allow_submission,
+	      mb.allow_sieve AS allow_sieve
+       FROM VMailbox AS mb
+       	      JOIN address AS a ON (a.id = mb.id)
+	      JOIN domain AS d ON (a.domain = d.id);
+
+-- Per service deny views
+-- A user is denied a service if the mailbox is disabled or the service
+-- is. service_deny has them all with dovecot's name for the service, %s
+-- in a query, so one passdb can do them all. Submission covers both the
+-- submission service and postfix's SMTP AUTH which dovecot calls smtp.
+-- ManageSieve is sieve.
+DROP VIEW IF EXISTS "imap_deny";
+CREATE VIEW "imap_deny" AS
+     SELECT username, domain, 'true' AS deny
+     FROM user_mailbox WHERE enable = 0 OR allow_imap = 0;
+
+DROP VIEW IF EXISTS "pop3_deny";
+CREATE VIEW "pop3_deny" AS
+     SELECT username, domain, 'true' AS deny
+     FROM user_mailbox WHERE enable = 0 OR allow_pop3 = 0;
+
+DROP VIEW IF EXISTS "lmtp_deny";
+CREATE VIEW "lmtp_deny" AS
+     SELECT username, domain, 'true' AS deny
+     FROM user_mailbox WHERE enable = 0 OR allow_lmtp = 0;
+
+DROP VIEW IF EXISTS "submission_deny";
+CREATE VIEW "submission_deny" AS
+     SELECT username, domain, 'true' AS deny
+     FROM user_mailbox WHERE enable = 0 OR allow_submission = 0;
+
+DROP VIEW IF EXISTS "sieve_deny";
+CREATE VIEW "sieve_deny" AS
+     SELECT username, domain, 'true' AS deny
+     FROM user_mailbox WHERE enable = 0 OR allow_sieve = 0;
+
+DROP VIEW IF EXISTS "service_deny";
+CREATE VIEW "service_deny" AS
+     SELECT username, domain, 'imap' AS service, deny FROM imap_deny
+     UNION ALL
+     SELECT username, domain, 'pop3' AS service, deny FROM pop3_deny
+     UNION ALL
+     SELECT username, domain, 'lmtp' AS service, deny FROM lmtp_deny
+     UNION ALL
+     SELECT username, domain, 'submission' AS service, deny FROM submission_deny
+     UNION ALL
+     SELECT username, domain, 'smtp' AS service, deny FROM submission_deny
+     UNION ALL
+     SELECT username, domain, 'sieve' AS service, deny FROM sieve_deny;
+
+-- The audit triggers record the new columns
+DROP TRIGGER IF EXISTS audit_vmailbox_insert;
+CREATE TRIGGER audit_vmailbox_insert AFTER INSERT ON vmailbox
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'mailbox', 'INSERT', (SELECT name FROM address_name WHERE id = NEW.id),
+           json_object('pw_type', NEW.pw_type, 'password', NEW.password IS NOT NULL,
+                       'uid', NEW.uid, 'gid', NEW.gid, 'home', NEW.home,
+                       'quota', NEW.quota, 'enable', NEW.enable,
+                       'allow_imap', NEW.allow_imap, 'allow_pop3', NEW.allow_pop3,
+                       'allow_lmtp', NEW.allow_lmtp, 'allow_submission', NEW.allow_submission,
+                       'allow_sieve', NEW.allow_sieve)); END;
+
+DROP TRIGGER IF EXISTS audit_vmailbox_update;
+CREATE TRIGGER audit_vmailbox_update AFTER UPDATE ON vmailbox
+ WHEN OLD.pw_type IS NOT NEW.pw_type OR OLD.password IS NOT NEW.password
+      OR OLD.uid IS NOT NEW.uid OR OLD.gid IS NOT NEW.gid
+      OR OLD.home IS NOT NEW.home OR OLD.quota IS NOT NEW.quota
+      OR OLD.enable IS NOT NEW.enable
+      OR OLD.allow_imap IS NOT NEW.allow_imap OR OLD.allow_pop3 IS NOT NEW.allow_pop3
+      OR OLD.allow_lmtp IS NOT NEW.allow_lmtp OR OLD.allow_submission IS NOT NEW.allow_submission
+      OR OLD.allow_sieve IS NOT NEW.allow_sieve
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'mailbox', 'UPDATE', (SELECT name FROM address_name WHERE id = NEW.id),
+           json_object('pw_type', OLD.pw_type, 'password', OLD.password IS NOT NULL,
+                       'uid', OLD.uid, 'gid', OLD.gid, 'home', OLD.home,
+                       'quota', OLD.quota, 'enable', OLD.enable,
+                       'allow_imap', OLD.allow_imap, 'allow_pop3', OLD.allow_pop3,
+                       'allow_lmtp', OLD.allow_lmtp, 'allow_submission', OLD.allow_submission,
+                       'allow_sieve', OLD.allow_sieve),
+           json_object('pw_type', NEW.pw_type,
+                       'password', CASE WHEN OLD.password IS NOT NEW.password
+                                        THEN 'changed'
+                                        ELSE NEW.password IS NOT NULL END,
+                       'uid', NEW.uid, 'gid', NEW.gid, 'home', NEW.home,
+                       'quota', NEW.quota, 'enable', NEW.enable,
+                       'allow_imap', NEW.allow_imap, 'allow_pop3', NEW.allow_pop3,
+                       'allow_lmtp', NEW.allow_lmtp, 'allow_submission', NEW.allow_submission,
+                       'allow_sieve', NEW.allow_sieve)); END;
+
+DROP TRIGGER IF EXISTS audit_vmailbox_delete;
+CREATE TRIGGER audit_vmailbox_delete BEFORE DELETE ON vmailbox
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'mailbox', 'DELETE', (SELECT name FROM address_name WHERE id = OLD.id),
+           json_object('pw_type', OLD.pw_type, 'password', OLD.password IS NOT NULL,
+                       'uid', OLD.uid, 'gid', OLD.gid, 'home', OLD.home,
+                       'quota', OLD.quota, 'enable', OLD.enable,
+                       'allow_imap', OLD.allow_imap, 'allow_pop3', OLD.allow_pop3,
+                       'allow_lmtp', OLD.allow_lmtp, 'allow_submission', OLD.allow_submission,
+                       'allow_sieve', OLD.allow_sieve)); END;
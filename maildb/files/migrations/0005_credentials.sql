@@ -0,0 +1,113 @@
+-- Version 5
+-- Extra credentials, i.e. application passwords, for mailboxes.
+-- See schema.sql for the details.
+-- No BEGIN/COMMIT here. Migrate wraps all the scripts in one transaction.
+-- Credential
+-- Extra passwords for a mailbox, e.g. one each for a phone, a desktop
+-- client, and scripts, so each can be revoked on its own. A credential can
+-- expire and can be limited to some of the services. There is no lmtp
+-- because delivery doesn't log in. The times are UTC in the same form as
+-- the audit stamp. last_used is only set by postdove when it verifies a
+-- password because dovecot doesn't write to its passdb.
+DROP TABLE IF EXISTS "Credential";
+CREATE TABLE "Credential" (
+       id INTEGER PRIMARY KEY,
+       mailbox INTEGER NOT NULL,
+       label TEXT NOT NULL,
+       pw_type TEXT NOT NULL DEFAULT 'SHA512-CRYPT',
+       password TEXT NOT NULL,
+       created TEXT NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%S', 'now')),
+       last_used TEXT,
+       expires TEXT, -- NULL never expires
+       allow_imap INTEGER NOT NULL DEFAULT 1,
+       allow_pop3 INTEGER NOT NULL DEFAULT 1,
+       allow_submission INTEGER NOT NULL DEFAULT 1, -- and SMTP AUTH
+       allow_sieve INTEGER NOT NULL DEFAULT 1, -- ManageSieve
+       CONSTRAINT cred_mbox FOREIGN KEY(mailbox) REFERENCES VMailbox(id) ON DELETE CASCADE,
+       UNIQUE (mailbox, label));
+
+-- credential_service
+-- A row for each dovecot service, %s, each credential can be used for.
+-- Like service_deny, submission covers the smtp service too.
+DROP VIEW IF EXISTS "credential_service";
+CREATE VIEW "credential_service" AS
+     SELECT id, 'imap' AS service FROM credential WHERE allow_imap = 1
+     UNION ALL
+     SELECT id, 'pop3' AS service FROM credential WHERE allow_pop3 = 1
+     UNION ALL
+     SELECT id, 'submission' AS service FROM credential WHERE allow_submission = 1
+     UNION ALL
+     SELECT id, 'smtp' AS service FROM credential WHERE allow_submission = 1
+     UNION ALL
+     SELECT id, 'sieve' AS service FROM credential WHERE allow_sieve = 1;
+
+-- user_credential
+-- The unexpired credentials of a mailbox for a service in the form of a
+-- user_mailbox password_query. A dovecot sql passdb can only check one
+-- password per lookup so the credentials are numbered by slot from 1
+-- for each mailbox and service. Each passdb after the user_mailbox one
+-- looks up its slot and dovecot goes on to the next when one fails.
+DROP VIEW IF EXISTS "user_credential";
+CREATE VIEW "user_credential" AS
+       SELECT um.username AS username, um.domain AS domain,
+	      c.label AS label, cs.service AS service,
+	      ROW_NUMBER() OVER (PARTITION BY c.mailbox, cs.service ORDER BY c.id) AS slot,
+	      '{' || c.pw_type || '}' || c.password AS password,
+	      um.uid AS uid, um.gid AS gid, um.home AS home,
+	      um.quota_rule AS quota_rule
+       FROM credential_service AS cs
+	      JOIN credential AS c ON (c.id = cs.id)
+	      JOIN user_mailbox AS um ON (um.id = c.mailbox)
+       WHERE c.expires IS NULL
+	      OR c.expires > strftime('%Y-%m-%d %H:%M:%S', 'now');
+
+-- Audit the credentials too
+-- The credential key is its mailbox so the log of a mailbox has them too.
+DROP TRIGGER IF EXISTS audit_credential_insert;
+CREATE TRIGGER audit_credential_insert AFTER INSERT ON credential
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'credential', 'INSERT', (SELECT name FROM address_name WHERE id = NEW.mailbox),
+           json_object('label', NEW.label, 'pw_type', NEW.pw_type, 'password', 1,
+                       'expires', NEW.expires,
+                       'allow_imap', NEW.allow_imap, 'allow_pop3', NEW.allow_pop3,
+                       'allow_submission', NEW.allow_submission,
+                       'allow_sieve', NEW.allow_sieve)); END;
+
+-- last_used is bookkeeping, not a change
+DROP TRIGGER IF EXISTS audit_credential_update;
+CREATE TRIGGER audit_credential_update AFTER UPDATE ON credential
+ WHEN OLD.label IS NOT NEW.label OR OLD.pw_type IS NOT NEW.pw_type
+      OR OLD.password IS NOT NEW.password OR OLD.expires IS NOT NEW.expires
+      OR OLD.allow_imap IS NOT NEW.allow_imap OR OLD.allow_pop3 IS NOT NEW.allow_pop3
+      OR OLD.allow_submission IS NOT NEW.allow_submission
+      OR OLD.allow_sieve IS NOT NEW.allow_sieve
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'credential', 'UPDATE', (SELECT name FROM address_name WHERE id = NEW.mailbox),
+           json_object('label', OLD.label, 'pw_type', OLD.pw_type, 'password', 1,
+                       'expires', OLD.expires,
+                       'allow_imap', OLD.allow_imap, 'allow_pop3', OLD.allow_pop3,
+                       'allow_submission', OLD.allow_submission,
+                       'allow_sieve', OLD.allow_sieve),
+           json_object('label', NEW.label, 'pw_type', NEW.pw_type,
+                       'password', CASE WHEN OLD.password IS NOT NEW.password
+                                        THEN 'changed' ELSE 1 END,
+                       'expires', NEW.expires,
+                       'allow_imap', NEW.allow_imap, 'allow_pop3', NEW.allow_pop3,
+                       'allow_submission', NEW.allow_submission,
+                       'allow_sieve', NEW.allow_sieve)); END;
+
+DROP TRIGGER IF EXISTS audit_credential_delete;
+CREATE TRIGGER audit_credential_delete BEFORE DELETE ON credential
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'credential', 'DELETE', (SELECT name FROM address_name WHERE id = OLD.mailbox),
+           json_object('label', OLD.label, 'pw_type', OLD.pw_type, 'password', 1,
+                       'expires', OLD.expires,
+                       'allow_imap', OLD.allow_imap, 'allow_pop3', OLD.allow_pop3,
+                       'allow_submission', OLD.allow_submission,
+                       'allow_sieve', OLD.allow_sieve)); END;
@@ -0,0 +1,218 @@
+-- Version 6
+-- Password age and policy. See schema.sql for the details.
+-- No BEGIN/COMMIT here. Migrate wraps all the scripts in one transaction.
+ALTER TABLE "Domain" ADD COLUMN pw_max_age INTEGER;
+ALTER TABLE "Domain" ADD COLUMN pw_min_length INTEGER;
+ALTER TABLE "Domain" ADD COLUMN pw_min_classes INTEGER;
+ALTER TABLE "VMailbox" ADD COLUMN pw_set TEXT;
+ALTER TABLE "VMailbox" ADD COLUMN pw_max_age INTEGER;
+
+-- We don't know when the existing passwords were set so their
+-- age starts now.
+UPDATE "VMailbox" SET pw_set = strftime('%Y-%m-%d %H:%M:%S', 'now')
+ WHERE password IS NOT NULL;
+
+-- user_mailbox
+-- The password expiry is added to the view
+DROP VIEW IF EXISTS "user_mailbox";
+CREATE VIEW "user_mailbox" AS
+       SELECT mb.id AS id, a.localpart AS username, d.name AS domain,
+       	      '{' || mb.pw_type || '}' || COALESCE(mb.password, '*') AS password,
+	      COALESCE(mb.uid,
+	              COALESCE(d.vuid,
+		              (SELECT vuid FROM domain WHERE name = 'localhost'))) AS uid,
+	      COALESCE(mb.gid,
+	             COALESCE(d.vgid,
+		              (SELECT vgid FROM domain WHERE name = 'localhost'))) AS gid,
+	      COALESCE(mb.home, '') AS home,
+	      COALESCE(mb.quota, '*:bytes=0') AS quota_rule,
+       	      mb.enable AS enable,
+	      mb.allow_imap AS allow_imap, mb.allow_pop3 AS allow_pop3,
+	      mb.allow_lmtp AS allow_lmtp, mb.allow_submission AS allow_submission,
+	      mb.allow_sieve AS allow_sieve,
+	      CASE WHEN mb.password IS NOT NULL AND mb.pw_set IS NOT NULL
+	                AND COALESCE(mb.pw_max_age, d.pw_max_age, 0) > 0
+	           THEN datetime(mb.pw_set, '+' || COALESCE(mb.pw_max_age, d.pw_max_age) || ' days')
+	      END AS pw_expires,
+	      CASE WHEN mb.password IS NOT NULL AND mb.pw_set IS NOT NULL
+	                AND COALESCE(mb.pw_max_age, d.pw_max_age, 0) > 0
+	                AND datetime(mb.pw_set, '+' || COALESCE(mb.pw_max_age, d.pw_max_age) || ' days')
+	                    <= datetime('now')
+	           THEN 1 ELSE 0
+	      END AS pw_expired
+       FROM VMailbox AS mb
+       	      JOIN address AS a ON (a.id = mb.id)
+	      JOIN domain AS d ON (a.domain = d.id);
+
+-- user_deny
+-- This query looks for denied (locked out) users, disabled or with an
+-- expired password
+DROP VIEW IF EXISTS "user_deny";
+CREATE VIEW "user_deny" AS
+     SELECT username, domain, 'true' AS deny
+     FROM user_mailbox WHERE enable = 0 OR pw_expired = 1;
+
+-- Per service deny views
+-- A user is denied a service if the mailbox is disabled, its password
+-- has expired, or the service is denied. An expired password doesn't
+-- stop lmtp delivery. service_deny has them all with
+-- dovecot's name for the service, %s in a query, so one passdb can do
+-- them all. Submission covers both the submission service and postfix's
+-- SMTP AUTH which dovecot calls smtp. ManageSieve is sieve.
+DROP VIEW IF EXISTS "imap_deny";
+CREATE VIEW "imap_deny" AS
+     SELECT username, domain, 'true' AS deny
+     FROM user_mailbox WHERE enable = 0 OR pw_expired = 1 OR allow_imap = 0;
+
+DROP VIEW IF EXISTS "pop3_deny";
+CREATE VIEW "pop3_deny" AS
+     SELECT username, domain, 'true' AS deny
+     FROM user_mailbox WHERE enable = 0 OR pw_expired = 1 OR allow_pop3 = 0;
+
+DROP VIEW IF EXISTS "lmtp_deny";
+CREATE VIEW "lmtp_deny" AS
+     SELECT username, domain, 'true' AS deny
+     FROM user_mailbox WHERE enable = 0 OR allow_lmtp = 0;
+
+DROP VIEW IF EXISTS "submission_deny";
+CREATE VIEW "submission_deny" AS
+     SELECT username, domain, 'true' AS deny
+     FROM user_mailbox WHERE enable = 0 OR pw_expired = 1 OR allow_submission = 0;
+
+DROP VIEW IF EXISTS "sieve_deny";
+CREATE VIEW "sieve_deny" AS
+     SELECT username, domain, 'true' AS deny
+     FROM user_mailbox WHERE enable = 0 OR pw_expired = 1 OR allow_sieve = 0;
+
+DROP VIEW IF EXISTS "service_deny";
+CREATE VIEW "service_deny" AS
+     SELECT username, domain, 'imap' AS service, deny FROM imap_deny
+     UNION ALL
+     SELECT username, domain, 'pop3' AS service, deny FROM pop3_deny
+     UNION ALL
+     SELECT username, domain, 'lmtp' AS service, deny FROM lmtp_deny
+     UNION ALL
+     SELECT username, domain, 'submission' AS service, deny FROM submission_deny
+     UNION ALL
+     SELECT username, domain, 'smtp' AS service, deny FROM submission_deny
+     UNION ALL
+     SELECT username, domain, 'sieve' AS service, deny FROM sieve_deny;
+
+-- BannedPassword
+-- Passwords that cannot be used for a mailbox no matter what the
+-- domain's policy is, such as the common ones from a breach list. They
+-- are lower case and matched without regard to case.
+DROP TABLE IF EXISTS "BannedPassword";
+CREATE TABLE "BannedPassword" (
+       password TEXT PRIMARY KEY);
+
+-- The audit triggers record the new columns
+DROP TRIGGER IF EXISTS audit_domain_insert;
+CREATE TRIGGER audit_domain_insert AFTER INSERT ON domain
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'domain', 'INSERT', NEW.name,
+           json_object('name', NEW.name, 'class', NEW.class,
+                       'transport', (SELECT name FROM transport WHERE id = NEW.transport),
+                       'access', (SELECT name FROM access WHERE id = NEW.access),
+                       'vuid', NEW.vuid, 'vgid', NEW.vgid,
+                       'pw_max_age', NEW.pw_max_age, 'pw_min_length', NEW.pw_min_length,
+                       'pw_min_classes', NEW.pw_min_classes)); END;
+
+DROP TRIGGER IF EXISTS audit_domain_update;
+CREATE TRIGGER audit_domain_update AFTER UPDATE ON domain
+ WHEN OLD.name IS NOT NEW.name OR OLD.class IS NOT NEW.class
+      OR OLD.transport IS NOT NEW.transport OR OLD.access IS NOT NEW.access
+      OR OLD.vuid IS NOT NEW.vuid OR OLD.vgid IS NOT NEW.vgid
+      OR OLD.pw_max_age IS NOT NEW.pw_max_age OR OLD.pw_min_length IS NOT NEW.pw_min_length
+      OR OLD.pw_min_classes IS NOT NEW.pw_min_classes
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'domain', 'UPDATE', NEW.name,
+           json_object('name', OLD.name, 'class', OLD.class,
+                       'transport', (SELECT name FROM transport WHERE id = OLD.transport),
+                       'access', (SELECT name FROM access WHERE id = OLD.access),
+                       'vuid', OLD.vuid, 'vgid', OLD.vgid,
+                       'pw_max_age', OLD.pw_max_age, 'pw_min_length', OLD.pw_min_length,
+                       'pw_min_classes', OLD.pw_min_classes),
+           json_object('name', NEW.name, 'class', NEW.class,
+                       'transport', (SELECT name FROM transport WHERE id = NEW.transport),
+                       'access', (SELECT name FROM access WHERE id = NEW.access),
+                       'vuid', NEW.vuid, 'vgid', NEW.vgid,
+                       'pw_max_age', NEW.pw_max_age, 'pw_min_length', NEW.pw_min_length,
+                       'pw_min_classes', NEW.pw_min_classes)); END;
+
+DROP TRIGGER IF EXISTS audit_domain_delete;
+CREATE TRIGGER audit_domain_delete BEFORE DELETE ON domain
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'domain', 'DELETE', OLD.name,
+           json_object('name', OLD.name, 'class', OLD.class,
+                       'transport', (SELECT name FROM transport WHERE id = OLD.transport),
+                       'access', (SELECT name FROM access WHERE id = OLD.access),
+                       'vuid', OLD.vuid, 'vgid', OLD.vgid,
+                       'pw_max_age', OLD.pw_max_age, 'pw_min_length', OLD.pw_min_length,
+                       'pw_min_classes', OLD.pw_min_classes)); END;
+
+DROP TRIGGER IF EXISTS audit_vmailbox_insert;
+CREATE TRIGGER audit_vmailbox_insert AFTER INSERT ON vmailbox
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'mailbox', 'INSERT', (SELECT name FROM address_name WHERE id = NEW.id),
+           json_object('pw_type', NEW.pw_type, 'password', NEW.password IS NOT NULL,
+                       'uid', NEW.uid, 'gid', NEW.gid, 'home', NEW.home,
+                       'quota', NEW.quota, 'enable', NEW.enable,
+                       'allow_imap', NEW.allow_imap, 'allow_pop3', NEW.allow_pop3,
+                       'allow_lmtp', NEW.allow_lmtp, 'allow_submission', NEW.allow_submission,
+                       'allow_sieve', NEW.allow_sieve,
+                       'pw_set', NEW.pw_set, 'pw_max_age', NEW.pw_max_age)); END;
+
+DROP TRIGGER IF EXISTS audit_vmailbox_update;
+CREATE TRIGGER audit_vmailbox_update AFTER UPDATE ON vmailbox
+ WHEN OLD.pw_type IS NOT NEW.pw_type OR OLD.password IS NOT NEW.password
+      OR OLD.uid IS NOT NEW.uid OR OLD.gid IS NOT NEW.gid
+      OR OLD.home IS NOT NEW.home OR OLD.quota IS NOT NEW.quota
+      OR OLD.enable IS NOT NEW.enable
+      OR OLD.allow_imap IS NOT NEW.allow_imap OR OLD.allow_pop3 IS NOT NEW.allow_pop3
+      OR OLD.allow_lmtp IS NOT NEW.allow_lmtp OR OLD.allow_submission IS NOT NEW.allow_submission
+      OR OLD.allow_sieve IS NOT NEW.allow_sieve
+      OR OLD.pw_set IS NOT NEW.pw_set OR OLD.pw_max_age IS NOT NEW.pw_max_age
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'mailbox', 'UPDATE', (SELECT name FROM address_name WHERE id = NEW.id),
+           json_object('pw_type', OLD.pw_type, 'password', OLD.password IS NOT NULL,
+                       'uid', OLD.uid, 'gid', OLD.gid, 'home', OLD.home,
+                       'quota', OLD.quota, 'enable', OLD.enable,
+                       'allow_imap', OLD.allow_imap, 'allow_pop3', OLD.allow_pop3,
+                       'allow_lmtp', OLD.allow_lmtp, 'allow_submission', OLD.allow_submission,
+                       'allow_sieve', OLD.allow_sieve,
+                       'pw_set', OLD.pw_set, 'pw_max_age', OLD.pw_max_age),
+           json_object('pw_type', NEW.pw_type,
+                       'password', CASE WHEN OLD.password IS NOT NEW.password
+                                        THEN 'changed'
+                                        ELSE NEW.password IS NOT NULL END,
+                       'uid', NEW.uid, 'gid', NEW.gid, 'home', NEW.home,
+                       'quota', NEW.quota, 'enable', NEW.enable,
+                       'allow_imap', NEW.allow_imap, 'allow_pop3', NEW.allow_pop3,
+                       'allow_lmtp', NEW.allow_lmtp, 'allow_submission', NEW.allow_submission,
+                       'allow_sieve', NEW.allow_sieve,
+                       'pw_set', NEW.pw_set, 'pw_max_age', NEW.pw_max_age)); END;
+
+DROP TRIGGER IF EXISTS audit_vmailbox_delete;
+CREATE TRIGGER audit_vmailbox_delete BEFORE DELETE ON vmailbox
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'mailbox', 'DELETE', (SELECT name FROM address_name WHERE id = OLD.id),
+           json_object('pw_type', OLD.pw_type, 'password', OLD.password IS NOT NULL,
+                       'uid', OLD.uid, 'gid', OLD.gid, 'home', OLD.home,
+                       'quota', OLD.quota, 'enable', OLD.enable,
+                       'allow_imap', OLD.allow_imap, 'allow_pop3', OLD.allow_pop3,
+                       'allow_lmtp', OLD.allow_lmtp, 'allow_submission', OLD.allow_submission,
+                       'allow_sieve', OLD.allow_sieve,
+                       'pw_set', OLD.pw_set, 'pw_max_age', OLD.pw_max_age)); END;
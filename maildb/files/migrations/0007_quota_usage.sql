@@ -0,0 +1,35 @@
+-- Version 7
+-- Quota usage from the dovecot quota dict. See schema.sql for the details.
+-- No BEGIN/COMMIT here. Migrate wraps all the scripts in one transaction.
+-- QuotaUsage
+-- What each mailbox is using as kept by dovecot's quota dict. The
+-- layout is the one dovecot's dict sql driver expects for the
+-- priv/quota/storage and priv/quota/messages keys so dovecot writes
+-- it and we only read it. username is the full user@domain, %u.
+-- Changes are not audited because every delivery makes one.
+DROP TABLE IF EXISTS "QuotaUsage";
+CREATE TABLE "QuotaUsage" (
+       username TEXT PRIMARY KEY,
+       bytes INTEGER NOT NULL DEFAULT 0,
+       messages INTEGER NOT NULL DEFAULT 0);
+
+-- Clean up the usage of a deleted mailbox. This has to be done before
+-- after_del_mbox deletes the address we need for the name.
+DROP TRIGGER IF EXISTS del_mbox_quota;
+CREATE TRIGGER del_mbox_quota BEFORE DELETE ON vmailbox
+  BEGIN
+    DELETE FROM QuotaUsage
+     WHERE username = (SELECT a.localpart || '@' || d.name
+     	   	       FROM address AS a JOIN domain AS d ON (a.domain = d.id)
+		       WHERE a.id = OLD.id); END;
+
+-- user_quota
+-- The usage of each mailbox along with its quota rule. A mailbox that
+-- dovecot has not counted yet has no QuotaUsage row and uses nothing.
+DROP VIEW IF EXISTS "user_quota";
+CREATE VIEW "user_quota" AS
+       SELECT um.id AS id, um.username AS username, um.domain AS domain,
+	      um.quota_rule AS quota_rule,
+	      COALESCE(q.bytes, 0) AS bytes, COALESCE(q.messages, 0) AS messages
+       FROM user_mailbox AS um
+	      LEFT JOIN QuotaUsage AS q ON (q.username = um.username || '@' || um.domain);
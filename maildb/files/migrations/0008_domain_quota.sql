@@ -0,0 +1,87 @@
+-- Version 8
+-- Domain default quotas. See schema.sql for the details.
+-- No BEGIN/COMMIT here. Migrate wraps all the scripts in one transaction.
+ALTER TABLE "Domain" ADD COLUMN quota TEXT;
+
+-- user_mailbox
+-- The quota rule is the mailbox's own or its domain's default
+DROP VIEW IF EXISTS "user_mailbox";
+CREATE VIEW "user_mailbox" AS
+       SELECT mb.id AS id, a.localpart AS username, d.name AS domain,
+       	      '{' || mb.pw_type || '}' || COALESCE(mb.password, '*') AS password,
+	      COALESCE(mb.uid,
+	              COALESCE(d.vuid,
+		              (SELECT vuid FROM domain WHERE name = 'localhost'))) AS uid,
+	      COALESCE(mb.gid,
+	             COALESCE(d.vgid,
+		              (SELECT vgid FROM domain WHERE name = 'localhost'))) AS gid,
+	      COALESCE(mb.home, '') AS home,
+	      COALESCE(mb.quota, d.quota) AS quota_rule,
+       	      mb.enable AS enable,
+	      mb.allow_imap AS allow_imap, mb.allow_pop3 AS allow_pop3,
+	      mb.allow_lmtp AS allow_lmtp, mb.allow_submission AS allow_submission,
+	      mb.allow_sieve AS allow_sieve,
+	      CASE WHEN mb.password IS NOT NULL AND mb.pw_set IS NOT NULL
+	                AND COALESCE(mb.pw_max_age, d.pw_max_age, 0) > 0
+	           THEN datetime(mb.pw_set, '+' || COALESCE(mb.pw_max_age, d.pw_max_age) || ' days')
+	      END AS pw_expires,
+	      CASE WHEN mb.password IS NOT NULL AND mb.pw_set IS NOT NULL
+	                AND COALESCE(mb.pw_max_age, d.pw_max_age, 0) > 0
+	                AND datetime(mb.pw_set, '+' || COALESCE(mb.pw_max_age, d.pw_max_age) || ' days')
+	                    <= datetime('now')
+	           THEN 1 ELSE 0
+	      END AS pw_expired
+       FROM VMailbox AS mb
+       	      JOIN address AS a ON (a.id = mb.id)
+	      JOIN domain AS d ON (a.domain = d.id);
+
+-- The audit of domains records the quota
+DROP TRIGGER IF EXISTS audit_domain_insert;
+CREATE TRIGGER audit_domain_insert AFTER INSERT ON domain
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'domain', 'INSERT', NEW.name,
+           json_object('name', NEW.name, 'class', NEW.class,
+                       'transport', (SELECT name FROM transport WHERE id = NEW.transport),
+                       'access', (SELECT name FROM access WHERE id = NEW.access),
+                       'vuid', NEW.vuid, 'vgid', NEW.vgid,
+                       'pw_max_age', NEW.pw_max_age, 'pw_min_length', NEW.pw_min_length,
+                       'pw_min_classes', NEW.pw_min_classes, 'quota', NEW.quota)); END;
+
+DROP TRIGGER IF EXISTS audit_domain_update;
+CREATE TRIGGER audit_domain_update AFTER UPDATE ON domain
+ WHEN OLD.name IS NOT NEW.name OR OLD.class IS NOT NEW.class
+      OR OLD.transport IS NOT NEW.transport OR OLD.access IS NOT NEW.access
+      OR OLD.vuid IS NOT NEW.vuid OR OLD.vgid IS NOT NEW.vgid
+      OR OLD.pw_max_age IS NOT NEW.pw_max_age OR OLD.pw_min_length IS NOT NEW.pw_min_length
+      OR OLD.pw_min_classes IS NOT NEW.pw_min_classes OR OLD.quota IS NOT NEW.quota
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'domain', 'UPDATE', NEW.name,
+           json_object('name', OLD.name, 'class', OLD.class,
+                       'transport', (SELECT name FROM transport WHERE id = OLD.transport),
+                       'access', (SELECT name FROM access WHERE id = OLD.access),
+                       'vuid', OLD.vuid, 'vgid', OLD.vgid,
+                       'pw_max_age', OLD.pw_max_age, 'pw_min_length', OLD.pw_min_length,
+                       'pw_min_classes', OLD.pw_min_classes, 'quota', OLD.quota),
+           json_object('name', NEW.name, 'class', NEW.class,
+                       'transport', (SELECT name FROM transport WHERE id = NEW.transport),
+                       'access', (SELECT name FROM access WHERE id = NEW.access),
+                       'vuid', NEW.vuid, 'vgid', NEW.vgid,
+                       'pw_max_age', NEW.pw_max_age, 'pw_min_length', NEW.pw_min_length,
+                       'pw_min_classes', NEW.pw_min_classes, 'quota', NEW.quota)); END;
+
+DROP TRIGGER IF EXISTS audit_domain_delete;
+CREATE TRIGGER audit_domain_delete BEFORE DELETE ON domain
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'domain', 'DELETE', OLD.name,
+           json_object('name', OLD.name, 'class', OLD.class,
+                       'transport', (SELECT name FROM transport WHERE id = OLD.transport),
+                       'access', (SELECT name FROM access WHERE id = OLD.access),
+                       'vuid', OLD.vuid, 'vgid', OLD.vgid,
+                       'pw_max_age', OLD.pw_max_age, 'pw_min_length', OLD.pw_min_length,
+                       'pw_min_classes', OLD.pw_min_classes, 'quota', OLD.quota)); END;
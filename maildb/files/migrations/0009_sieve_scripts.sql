@@ -0,0 +1,75 @@
+-- Version 9
+-- Sieve scripts of mailboxes for Pigeonhole's dict storage.
+-- See schema.sql for the details.
+-- No BEGIN/COMMIT here. Migrate wraps all the scripts in one transaction.
+-- SieveScript
+-- The Sieve filters of each mailbox, kept here rather than as files under
+-- its home. A mailbox can have any number of named scripts but only the
+-- active one is run by LMTP delivery. version counts the edits of the
+-- script so the id dovecot sees changes with it and it knows to compile
+-- it again. The scripts are checked by postdove before they get here.
+DROP INDEX IF EXISTS sieve_active;
+DROP TABLE IF EXISTS "SieveScript";
+CREATE TABLE "SieveScript" (
+       id INTEGER PRIMARY KEY,
+       mailbox INTEGER NOT NULL,
+       name TEXT NOT NULL,
+       script TEXT NOT NULL,
+       active INTEGER NOT NULL DEFAULT 0,
+       version INTEGER NOT NULL DEFAULT 1,
+       modified TEXT NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%S', 'now')),
+       CONSTRAINT sieve_mbox FOREIGN KEY(mailbox) REFERENCES VMailbox(id) ON DELETE CASCADE,
+       UNIQUE (mailbox, name));
+
+-- There is at most one active script per mailbox
+CREATE UNIQUE INDEX sieve_active ON SieveScript(mailbox) WHERE active = 1;
+
+-- user_sieve
+-- The scripts in the layout of Pigeonhole's dict storage. dovecot looks
+-- up priv/sieve/name/<script_name> for the id of a script and then
+-- priv/sieve/data/<id> for the script. The active script is there a
+-- second time named "active", the name that sieve = dict:...;name=active
+-- loads, which is why no script can be named that.
+DROP VIEW IF EXISTS "user_sieve";
+CREATE VIEW "user_sieve" AS
+       SELECT um.username || '@' || um.domain AS username, s.name AS script_name,
+	      s.id || '.' || s.version AS id, s.script AS script_data
+       FROM SieveScript AS s JOIN user_mailbox AS um ON (um.id = s.mailbox)
+       UNION ALL
+       SELECT um.username || '@' || um.domain AS username, 'active' AS script_name,
+	      s.id || '.' || s.version AS id, s.script AS script_data
+       FROM SieveScript AS s JOIN user_mailbox AS um ON (um.id = s.mailbox)
+       WHERE s.active = 1;
+
+-- The sieve key is its mailbox like credential. The script itself is
+-- not recorded, only that it changed.
+DROP TRIGGER IF EXISTS audit_sieve_insert;
+CREATE TRIGGER audit_sieve_insert AFTER INSERT ON sievescript
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'sieve', 'INSERT', (SELECT name FROM address_name WHERE id = NEW.mailbox),
+           json_object('name', NEW.name, 'active', NEW.active,
+                       'version', NEW.version)); END;
+
+DROP TRIGGER IF EXISTS audit_sieve_update;
+CREATE TRIGGER audit_sieve_update AFTER UPDATE ON sievescript
+ WHEN OLD.name IS NOT NEW.name OR OLD.script IS NOT NEW.script
+      OR OLD.active IS NOT NEW.active
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'sieve', 'UPDATE', (SELECT name FROM address_name WHERE id = NEW.mailbox),
+           json_object('name', OLD.name, 'active', OLD.active,
+                       'version', OLD.version),
+           json_object('name', NEW.name, 'active', NEW.active,
+                       'version', NEW.version)); END;
+
+DROP TRIGGER IF EXISTS audit_sieve_delete;
+CREATE TRIGGER audit_sieve_delete BEFORE DELETE ON sievescript
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'sieve', 'DELETE', (SELECT name FROM address_name WHERE id = OLD.mailbox),
+           json_object('name', OLD.name, 'active', OLD.active,
+                       'version', OLD.version)); END;
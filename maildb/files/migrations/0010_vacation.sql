@@ -0,0 +1,61 @@
+-- Version 10
+-- Vacation replies of mailboxes. See schema.sql for the details.
+-- No BEGIN/COMMIT here. Migrate wraps all the scripts in one transaction.
+-- Vacation
+-- The out of office reply of a mailbox. postdove makes the Sieve script
+-- named "vacation" from it and makes that the active script. The dates
+-- are YYYY-MM-DD in the server's time zone, NULL for no limit, and are
+-- tested in the script so the replies start and stop on their own. days
+-- is how often a sender is replied to. addresses are the comma separated
+-- other addresses of the mailbox. previous is the script that was active
+-- before, which the vacation script includes and which is made active
+-- again when the vacation is removed.
+DROP TABLE IF EXISTS "Vacation";
+CREATE TABLE "Vacation" (
+       mailbox INTEGER PRIMARY KEY,
+       subject TEXT,
+       body TEXT NOT NULL DEFAULT '',
+       start_date TEXT,
+       end_date TEXT,
+       days INTEGER NOT NULL DEFAULT 7,
+       addresses TEXT,
+       previous TEXT,
+       modified TEXT NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%S', 'now')),
+       CONSTRAINT vacation_mbox FOREIGN KEY(mailbox) REFERENCES VMailbox(id) ON DELETE CASCADE);
+
+-- The vacation key is its mailbox. The message is not recorded.
+DROP TRIGGER IF EXISTS audit_vacation_insert;
+CREATE TRIGGER audit_vacation_insert AFTER INSERT ON vacation
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'vacation', 'INSERT', (SELECT name FROM address_name WHERE id = NEW.mailbox),
+           json_object('subject', NEW.subject, 'start_date', NEW.start_date,
+                       'end_date', NEW.end_date, 'days', NEW.days,
+                       'addresses', NEW.addresses)); END;
+
+DROP TRIGGER IF EXISTS audit_vacation_update;
+CREATE TRIGGER audit_vacation_update AFTER UPDATE ON vacation
+ WHEN OLD.subject IS NOT NEW.subject OR OLD.body IS NOT NEW.body
+      OR OLD.start_date IS NOT NEW.start_date OR OLD.end_date IS NOT NEW.end_date
+      OR OLD.days IS NOT NEW.days OR OLD.addresses IS NOT NEW.addresses
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'vacation', 'UPDATE', (SELECT name FROM address_name WHERE id = NEW.mailbox),
+           json_object('subject', OLD.subject, 'start_date', OLD.start_date,
+                       'end_date', OLD.end_date, 'days', OLD.days,
+                       'addresses', OLD.addresses),
+           json_object('subject', NEW.subject, 'start_date', NEW.start_date,
+                       'end_date', NEW.end_date, 'days', NEW.days,
+                       'addresses', NEW.addresses)); END;
+
+DROP TRIGGER IF EXISTS audit_vacation_delete;
+CREATE TRIGGER audit_vacation_delete BEFORE DELETE ON vacation
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'vacation', 'DELETE', (SELECT name FROM address_name WHERE id = OLD.mailbox),
+           json_object('subject', OLD.subject, 'start_date', OLD.start_date,
+                       'end_date', OLD.end_date, 'days', OLD.days,
+                       'addresses', OLD.addresses)); END;
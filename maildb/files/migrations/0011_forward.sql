@@ -0,0 +1,100 @@
+-- Version 11
+-- Forwarding of mailboxes and the virt_alias lines for it. See schema.sql
+-- for the details.
+-- No BEGIN/COMMIT here. Migrate wraps all the scripts in one transaction.
+-- Forward
+-- Mail to a mailbox sent on to other addresses, and to the mailbox as
+-- well if keep_copy. An address cannot be both a mailbox and an alias,
+-- so a forward is kept here and virt_alias makes the alias lines for it.
+-- When it keeps a copy the mailbox is one of its own recipients, which
+-- postfix delivers to rather than expanding again. The targets are text
+-- because they are usually someone else's addresses.
+DROP TABLE IF EXISTS "Forward";
+CREATE TABLE "Forward" (
+       mailbox INTEGER PRIMARY KEY,
+       keep_copy INTEGER NOT NULL DEFAULT 0,
+       CONSTRAINT forward_mbox FOREIGN KEY(mailbox) REFERENCES VMailbox(id) ON DELETE CASCADE);
+
+DROP TABLE IF EXISTS "ForwardTarget";
+CREATE TABLE "ForwardTarget" (
+       id INTEGER PRIMARY KEY,
+       forward INTEGER NOT NULL,
+       target TEXT NOT NULL,
+       CONSTRAINT forward_target FOREIGN KEY(forward) REFERENCES Forward(mailbox) ON DELETE CASCADE,
+       UNIQUE(forward, target));
+
+-- virt_alias models the virtuals file where a line is
+--   alias    recipient
+-- The aliases and then the forwards of mailboxes.
+DROP VIEW IF EXISTS "virt_alias";
+CREATE VIEW "virt_alias" AS
+       SELECT aa.localpart AS mailbox, ad.name AS domain_name,
+	      ta.localpart ||
+	      (CASE WHEN va.extension IS NOT NULL
+	      	    THEN '+' || va.extension
+		    ELSE ''
+	      END) ||
+	      (SELECT CASE WHEN ta.domain IS NULL
+		    THEN ''
+		    ELSE '@' || (SELECT name FROM domain WHERE id IS ta.domain)
+	      END) AS recipient
+	FROM Alias AS va
+	JOIN address AS aa ON (va.address = aa.id)
+	JOIN domain AS ad ON (aa.domain = ad.id)
+	JOIN address AS ta ON (va.target = ta.id)
+       UNION ALL
+       SELECT fa.localpart AS mailbox, fd.name AS domain_name, ft.target AS recipient
+	FROM ForwardTarget AS ft
+	JOIN address AS fa ON (ft.forward = fa.id)
+	JOIN domain AS fd ON (fa.domain = fd.id)
+       UNION ALL
+       SELECT fa.localpart AS mailbox, fd.name AS domain_name,
+	      fa.localpart || '@' || fd.name AS recipient
+	FROM Forward AS f
+	JOIN address AS fa ON (f.mailbox = fa.id)
+	JOIN domain AS fd ON (fa.domain = fd.id)
+	WHERE f.keep_copy = 1
+	  AND (SELECT count(*) FROM ForwardTarget WHERE forward = f.mailbox) > 0;
+
+-- The forward key is its mailbox. Its targets are logged one by one.
+DROP TRIGGER IF EXISTS audit_forward_insert;
+CREATE TRIGGER audit_forward_insert AFTER INSERT ON forward
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'forward', 'INSERT', (SELECT name FROM address_name WHERE id = NEW.mailbox),
+           json_object('keep_copy', NEW.keep_copy)); END;
+
+DROP TRIGGER IF EXISTS audit_forward_update;
+CREATE TRIGGER audit_forward_update AFTER UPDATE ON forward
+ WHEN OLD.keep_copy IS NOT NEW.keep_copy
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'forward', 'UPDATE', (SELECT name FROM address_name WHERE id = NEW.mailbox),
+           json_object('keep_copy', OLD.keep_copy),
+           json_object('keep_copy', NEW.keep_copy)); END;
+
+DROP TRIGGER IF EXISTS audit_forward_delete;
+CREATE TRIGGER audit_forward_delete BEFORE DELETE ON forward
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'forward', 'DELETE', (SELECT name FROM address_name WHERE id = OLD.mailbox),
+           json_object('keep_copy', OLD.keep_copy)); END;
+
+DROP TRIGGER IF EXISTS audit_forward_target_insert;
+CREATE TRIGGER audit_forward_target_insert AFTER INSERT ON forwardtarget
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'forward', 'INSERT', (SELECT name FROM address_name WHERE id = NEW.forward),
+           json_object('target', NEW.target)); END;
+
+DROP TRIGGER IF EXISTS audit_forward_target_delete;
+CREATE TRIGGER audit_forward_target_delete BEFORE DELETE ON forwardtarget
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'forward', 'DELETE', (SELECT name FROM address_name WHERE id = OLD.forward),
+           json_object('target', OLD.target)); END;
@@ -0,0 +1,100 @@
+-- Version 12
+-- Alias domains and the virt_alias lines for them. See schema.sql
+-- for the details.
+-- No BEGIN/COMMIT here. Migrate wraps all the scripts in one transaction.
+-- AliasDomain
+-- Every address of the target domain also works in the alias domain, e.g.
+-- user@example.net is user@example.com. The alias domain is a virtual
+-- domain so postfix takes mail for it. virt_alias maps only the target's
+-- mailboxes and aliases so nothing else is accepted, and an alias of the
+-- alias domain's own is used instead of the mapped one.
+DROP TABLE IF EXISTS "AliasDomain";
+CREATE TABLE "AliasDomain" (
+       domain INTEGER PRIMARY KEY,
+       target INTEGER NOT NULL,
+       CONSTRAINT alias_domain FOREIGN KEY(domain) REFERENCES Domain(id) ON DELETE CASCADE,
+       CONSTRAINT alias_domain_target FOREIGN KEY(target) REFERENCES Domain(id));
+
+-- virt_alias models the virtuals file where a line is
+--   alias    recipient
+-- The aliases, the forwards of mailboxes, and then the addresses of
+-- alias domains.
+DROP VIEW IF EXISTS "virt_alias";
+CREATE VIEW "virt_alias" AS
+       SELECT aa.localpart AS mailbox, ad.name AS domain_name,
+	      ta.localpart ||
+	      (CASE WHEN va.extension IS NOT NULL
+	      	    THEN '+' || va.extension
+		    ELSE ''
+	      END) ||
+	      (SELECT CASE WHEN ta.domain IS NULL
+		    THEN ''
+		    ELSE '@' || (SELECT name FROM domain WHERE id IS ta.domain)
+	      END) AS recipient
+	FROM Alias AS va
+	JOIN address AS aa ON (va.address = aa.id)
+	JOIN domain AS ad ON (aa.domain = ad.id)
+	JOIN address AS ta ON (va.target = ta.id)
+       UNION ALL
+       SELECT fa.localpart AS mailbox, fd.name AS domain_name, ft.target AS recipient
+	FROM ForwardTarget AS ft
+	JOIN address AS fa ON (ft.forward = fa.id)
+	JOIN domain AS fd ON (fa.domain = fd.id)
+       UNION ALL
+       SELECT fa.localpart AS mailbox, fd.name AS domain_name,
+	      fa.localpart || '@' || fd.name AS recipient
+	FROM Forward AS f
+	JOIN address AS fa ON (f.mailbox = fa.id)
+	JOIN domain AS fd ON (fa.domain = fd.id)
+	WHERE f.keep_copy = 1
+	  AND (SELECT count(*) FROM ForwardTarget WHERE forward = f.mailbox) > 0
+       UNION ALL
+       SELECT ta.localpart AS mailbox, ald.name AS domain_name,
+	      ta.localpart || '@' || td.name AS recipient
+	FROM AliasDomain AS dm
+	JOIN domain AS ald ON (dm.domain = ald.id)
+	JOIN domain AS td ON (dm.target = td.id)
+	JOIN address AS ta ON (ta.domain = td.id)
+	WHERE (ta.id IN (SELECT id FROM VMailbox) OR ta.id IN (SELECT address FROM Alias))
+	  AND NOT EXISTS (SELECT 1 FROM address AS oa JOIN Alias AS oal ON (oal.address = oa.id)
+	      	  	  WHERE oa.localpart = ta.localpart AND oa.domain = dm.domain);
+
+-- create a trigger to delete the domain when addr refs are 0 meaning this is the only
+-- one pointing to it and domain.class != vmailbox. Alias domains and their targets
+-- stay because they are still in use by AliasDomain
+DROP TRIGGER  IF EXISTS after_addr_del;
+CREATE TRIGGER after_addr_del AFTER DELETE ON address
+ WHEN OLD.domain IS NOT NULL
+    AND (SELECT class FROM domain WHERE id = OLD.domain) != 4
+    AND (SELECT count(*) FROM address WHERE domain = OLD.domain) < 1
+    AND (SELECT count(*) FROM AliasDomain
+         WHERE domain = OLD.domain OR target = OLD.domain) < 1
+ BEGIN
+  DELETE FROM domain WHERE id = OLD.domain; END;
+
+-- The alias domain key is its name. The target is logged by name.
+DROP TRIGGER IF EXISTS audit_alias_domain_insert;
+CREATE TRIGGER audit_alias_domain_insert AFTER INSERT ON aliasdomain
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'aliasdomain', 'INSERT', (SELECT name FROM domain WHERE id = NEW.domain),
+           json_object('target', (SELECT name FROM domain WHERE id = NEW.target))); END;
+
+DROP TRIGGER IF EXISTS audit_alias_domain_update;
+CREATE TRIGGER audit_alias_domain_update AFTER UPDATE ON aliasdomain
+ WHEN OLD.target IS NOT NEW.target
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'aliasdomain', 'UPDATE', (SELECT name FROM domain WHERE id = NEW.domain),
+           json_object('target', (SELECT name FROM domain WHERE id = OLD.target)),
+           json_object('target', (SELECT name FROM domain WHERE id = NEW.target))); END;
+
+DROP TRIGGER IF EXISTS audit_alias_domain_delete;
+CREATE TRIGGER audit_alias_domain_delete BEFORE DELETE ON aliasdomain
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'aliasdomain', 'DELETE', (SELECT name FROM domain WHERE id = OLD.domain),
+           json_object('target', (SELECT name FROM domain WHERE id = OLD.target))); END;
@@ -0,0 +1,82 @@
+-- Version 13
+-- The catch-all @domain in virt_alias. See schema.sql
+-- for the details.
+-- No BEGIN/COMMIT here. Migrate wraps all the scripts in one transaction.
+-- virt_alias models the virtuals file where a line is
+--   alias    recipient
+-- The aliases, the forwards of mailboxes, and then the addresses of
+-- alias domains. address is the whole key postfix looks up, first
+-- user@domain and then the catch-all @domain, whose localpart is empty.
+-- An alias domain has the catch-all of its target unless it has its own.
+-- The mailboxes of a domain with a catch-all are mapped to themselves so
+-- that postfix finds them before the catch-all, see VIRTUAL_README.
+DROP VIEW IF EXISTS "virt_alias";
+CREATE VIEW "virt_alias" AS
+ SELECT mailbox, domain_name, mailbox || '@' || domain_name AS address, recipient
+ FROM (
+       SELECT aa.localpart AS mailbox, ad.name AS domain_name,
+	      ta.localpart ||
+	      (CASE WHEN va.extension IS NOT NULL
+	      	    THEN '+' || va.extension
+		    ELSE ''
+	      END) ||
+	      (SELECT CASE WHEN ta.domain IS NULL
+		    THEN ''
+		    ELSE '@' || (SELECT name FROM domain WHERE id IS ta.domain)
+	      END) AS recipient
+	FROM Alias AS va
+	JOIN address AS aa ON (va.address = aa.id)
+	JOIN domain AS ad ON (aa.domain = ad.id)
+	JOIN address AS ta ON (va.target = ta.id)
+       UNION ALL
+       SELECT fa.localpart AS mailbox, fd.name AS domain_name, ft.target AS recipient
+	FROM ForwardTarget AS ft
+	JOIN address AS fa ON (ft.forward = fa.id)
+	JOIN domain AS fd ON (fa.domain = fd.id)
+       UNION ALL
+       SELECT fa.localpart AS mailbox, fd.name AS domain_name,
+	      fa.localpart || '@' || fd.name AS recipient
+	FROM Forward AS f
+	JOIN address AS fa ON (f.mailbox = fa.id)
+	JOIN domain AS fd ON (fa.domain = fd.id)
+	WHERE f.keep_copy = 1
+	  AND (SELECT count(*) FROM ForwardTarget WHERE forward = f.mailbox) > 0
+       UNION ALL
+       SELECT ta.localpart AS mailbox, ald.name AS domain_name,
+	      ta.localpart || '@' || td.name AS recipient
+	FROM AliasDomain AS dm
+	JOIN domain AS ald ON (dm.domain = ald.id)
+	JOIN domain AS td ON (dm.target = td.id)
+	JOIN address AS ta ON (ta.domain = td.id)
+	WHERE ta.localpart <> ''
+	  AND (ta.id IN (SELECT id FROM VMailbox) OR ta.id IN (SELECT address FROM Alias))
+	  AND NOT EXISTS (SELECT 1 FROM address AS oa JOIN Alias AS oal ON (oal.address = oa.id)
+	      	  	  WHERE oa.localpart = ta.localpart AND oa.domain = dm.domain)
+       UNION ALL
+       SELECT '' AS mailbox, ald.name AS domain_name,
+	      ta.localpart ||
+	      (CASE WHEN va.extension IS NOT NULL
+	      	    THEN '+' || va.extension
+		    ELSE ''
+	      END) ||
+	      (SELECT CASE WHEN ta.domain IS NULL
+		    THEN ''
+		    ELSE '@' || (SELECT name FROM domain WHERE id IS ta.domain)
+	      END) AS recipient
+	FROM AliasDomain AS dm
+	JOIN domain AS ald ON (dm.domain = ald.id)
+	JOIN address AS ca ON (ca.domain = dm.target AND ca.localpart = '')
+	JOIN Alias AS va ON (va.address = ca.id)
+	JOIN address AS ta ON (va.target = ta.id)
+	WHERE NOT EXISTS (SELECT 1 FROM address AS oa JOIN Alias AS oal ON (oal.address = oa.id)
+	      	  	  WHERE oa.localpart = '' AND oa.domain = dm.domain)
+       UNION ALL
+       SELECT ma.localpart AS mailbox, md.name AS domain_name,
+	      ma.localpart || '@' || md.name AS recipient
+	FROM VMailbox AS vm
+	JOIN address AS ma ON (vm.id = ma.id)
+	JOIN domain AS md ON (ma.domain = md.id)
+	WHERE EXISTS (SELECT 1 FROM address AS ca JOIN Alias AS cal ON (cal.address = ca.id)
+	      	      WHERE ca.localpart = '' AND ca.domain = ma.domain)
+	  AND NOT EXISTS (SELECT 1 FROM ForwardTarget WHERE forward = vm.id)
+ ) AS v;
@@ -0,0 +1,35 @@
+-- Version 14
+-- When dovecot last logged a credential in. See schema.sql for the details.
+-- No BEGIN/COMMIT here. Migrate wraps all the scripts in one transaction.
+-- CredentialLogin
+-- When each credential last logged in to dovecot, kept by dovecot's
+-- last_login plugin through a dict. The credential passdb sets the
+-- plugin's key to the credential's id so the key is the id as text and
+-- last_login is the unix time. dovecot writes it and we only read it.
+-- Changes are not audited because every login makes one.
+DROP TABLE IF EXISTS "CredentialLogin";
+CREATE TABLE "CredentialLogin" (
+       credential TEXT PRIMARY KEY,
+       last_login INTEGER NOT NULL DEFAULT 0);
+
+-- Clean up the logins of a deleted credential
+DROP TRIGGER IF EXISTS del_cred_login;
+CREATE TRIGGER del_cred_login AFTER DELETE ON credential
+  BEGIN
+    DELETE FROM CredentialLogin WHERE credential = CAST(OLD.id AS TEXT); END;
+
+-- user_credential
+-- credential is the id for the last_login key
+DROP VIEW IF EXISTS "user_credential";
+CREATE VIEW "user_credential" AS
+       SELECT um.username AS username, um.domain AS domain,
+	      c.label AS label, cs.service AS service,
+	      ROW_NUMBER() OVER (PARTITION BY c.mailbox, cs.service ORDER BY c.id) AS slot,
+	      '{' || c.pw_type || '}' || c.password AS password,
+	      um.uid AS uid, um.gid AS gid, um.home AS home,
+	      um.quota_rule AS quota_rule, c.id AS credential
+       FROM credential_service AS cs
+	      JOIN credential AS c ON (c.id = cs.id)
+	      JOIN user_mailbox AS um ON (um.id = c.mailbox)
+       WHERE c.expires IS NULL
+	      OR c.expires > strftime('%Y-%m-%d %H:%M:%S', 'now');
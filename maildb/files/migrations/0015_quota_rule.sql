@@ -0,0 +1,46 @@
+-- Version 15
+-- An explicit no limit quota rule. See schema.sql for the details.
+-- No BEGIN/COMMIT here. Migrate wraps all the scripts in one transaction.
+
+-- user_mailbox
+-- The quota rule is the mailbox's own or its domain's default or else
+-- *:storage=0, no limit, rather than NULL
+DROP VIEW IF EXISTS "user_mailbox";
+CREATE VIEW "user_mailbox" AS
+       SELECT mb.id AS id, a.localpart AS username, d.name AS domain,
+       	      '{' || mb.pw_type || '}' || COALESCE(mb.password, '*') AS password,
+	      COALESCE(mb.uid,
+	              COALESCE(d.vuid,
+		              (SELECT vuid FROM domain WHERE name = 'localhost'))) AS uid,
+	      COALESCE(mb.gid,
+	             COALESCE(d.vgid,
+		              (SELECT vgid FROM domain WHERE name = 'localhost'))) AS gid,
+	      COALESCE(mb.home, '') AS home,
+	      COALESCE(mb.quota, d.quota, '*:storage=0') AS quota_rule,
+       	      mb.enable AS enable,
+	      mb.allow_imap AS allow_imap, mb.allow_pop3 AS allow_pop3,
+	      mb.allow_lmtp AS allow_lmtp, mb.allow_submission AS allow_submission,
+	      mb.allow_sieve AS allow_sieve,
+	      CASE WHEN mb.password IS NOT NULL AND mb.pw_set IS NOT NULL
+	                AND COALESCE(mb.pw_max_age, d.pw_max_age, 0) > 0
+	           THEN datetime(mb.pw_set, '+' || COALESCE(mb.pw_max_age, d.pw_max_age) || ' days')
+	      END AS pw_expires,
+	      CASE WHEN mb.password IS NOT NULL AND mb.pw_set IS NOT NULL
+	                AND COALESCE(mb.pw_max_age, d.pw_max_age, 0) > 0
+	                AND datetime(mb.pw_set, '+' || COALESCE(mb.pw_max_age, d.pw_max_age) || ' days')
+	                    <= datetime('now')
+	           THEN 1 ELSE 0
+	      END AS pw_expired
+       FROM VMailbox AS mb
+       	      JOIN address AS a ON (a.id = mb.id)
+	      JOIN domain AS d ON (a.domain = d.id);
+
+-- user_quota
+-- The no limit rule reads as "none"
+DROP VIEW IF EXISTS "user_quota";
+CREATE VIEW "user_quota" AS
+       SELECT um.id AS id, um.username AS username, um.domain AS domain,
+	      NULLIF(um.quota_rule, '*:storage=0') AS quota_rule,
+	      COALESCE(q.bytes, 0) AS bytes, COALESCE(q.messages, 0) AS messages
+       FROM user_mailbox AS um
+	      LEFT JOIN QuotaUsage AS q ON (q.username = um.username || '@' || um.domain);
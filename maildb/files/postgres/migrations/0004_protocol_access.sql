@@ -0,0 +1,79 @@
+-- Version 4
+-- Per protocol access for mailboxes. See ../schema.sql for the details.
+-- No BEGIN/COMMIT here. Migrate wraps all the scripts in one transaction.
+ALTER TABLE vmailbox ADD COLUMN allow_imap INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE vmailbox ADD COLUMN allow_pop3 INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE vmailbox ADD COLUMN allow_lmtp INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE vmailbox ADD COLUMN allow_submission INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE vmailbox ADD COLUMN allow_sieve INTEGER NOT NULL DEFAULT 1;
+
+-- user_mailbox
+-- The new columns are added to the view. Its dependents go with it.
+DROP VIEW IF EXISTS user_mailbox CASCADE;
+CREATE VIEW user_mailbox AS
+       SELECT mb.id AS id, a.localpart AS username, d.name AS domain,
+       	      '{' || mb.pw_type || '}' || COALESCE(mb.password, '*') AS password,
+	      COALESCE(mb.uid,
+	              COALESCE(d.vuid,
+		              (SELECT vuid FROM domain WHERE name = 'localhost'))) AS uid,
+	      COALESCE(mb.gid,
+	             COALESCE(d.vgid,
+		              (SELECT vgid FROM domain WHERE name = 'localhost'))) AS gid,
+	      COALESCE(mb.home, '') AS home,
+	      COALESCE(mb.quota, '*:bytes=0') AS quota_rule,
+       	      mb.enable AS enable,
+	      mb.allow_imap AS allow_imap, mb.allow_pop3 AS allow_pop3,
+	      mb.allow_lmtp AS allow_lmtp, mb.allow_submission AS allow_submission,
+	      mb.allow_sieve AS allow_sieve
+       FROM vmailbox AS mb
+       	      JOIN address AS a ON (a.id = mb.id)
+	      JOIN domain AS d ON (a.domain = d.id);
+
+CREATE VIEW user_deny AS
+     SELECT username, domain, 'true' AS deny
+     FROM user_mailbox WHERE enable = 0;
+
+-- Per service deny views
+-- See ../schema.sql for which dovecot service is which.
+CREATE VIEW imap_deny AS
+     SELECT username, domain, 'true' AS deny
+     FROM user_mailbox WHERE enable = 0 OR allow_imap = 0;
+
+CREATE VIEW pop3_deny AS
+     SELECT username, domain, 'true' AS deny
+     FROM user_mailbox WHERE enable = 0 OR allow_pop3 = 0;
+
+CREATE VIEW lmtp_deny AS
+     SELECT username, domain, 'true' AS deny
+     FROM user_mailbox WHERE enable = 0 OR allow_lmtp = 0;
+
+CREATE VIEW submission_deny AS
+     SELECT username, domain, 'true' AS deny
+     FROM user_mailbox WHERE enable = 0 OR allow_submission = 0;
+
+CREATE VIEW sieve_deny AS
+     SELECT username, domain, 'true' AS deny
+     FROM user_mailbox WHERE enable = 0 OR allow_sieve = 0;
+
+CREATE VIEW service_deny AS
+     SELECT username, domain, 'imap' AS service, deny FROM imap_deny
+     UNION ALL
+     SELECT username, domain, 'pop3' AS service, deny FROM pop3_deny
+     UNION ALL
+     SELECT username, domain, 'lmtp' AS service, deny FROM lmtp_deny
+     UNION ALL
+     SELECT username, domain, 'submission' AS service, deny FROM submission_deny
+     UNION ALL
+     SELECT username, domain, 'smtp' AS service, deny FROM submission_deny
+     UNION ALL
+     SELECT username, domain, 'sieve' AS service, deny FROM sieve_deny;
+
+-- The audit records the new columns
+CREATE OR REPLACE FUNCTION audit_vmailbox_json(mb vmailbox, pw JSON) RETURNS JSON AS $$
+  SELECT json_build_object('pw_type', mb.pw_type, 'password', pw,
+                           'uid', mb.uid, 'gid', mb.gid, 'home', mb.home,
+                           'quota', mb.quota, 'enable', mb.enable,
+                           'allow_imap', mb.allow_imap, 'allow_pop3', mb.allow_pop3,
+                           'allow_lmtp', mb.allow_lmtp, 'allow_submission', mb.allow_submission,
+                           'allow_sieve', mb.allow_sieve);
+$$ LANGUAGE sql;
@@ -0,0 +1,94 @@
+-- Version 5
+-- Extra credentials, i.e. application passwords, for mailboxes.
+-- See ../schema.sql for the details.
+-- No BEGIN/COMMIT here. Migrate wraps all the scripts in one transaction.
+-- credential
+-- Extra passwords for a mailbox. See ../schema.sql for the full story.
+DROP TABLE IF EXISTS credential CASCADE;
+CREATE TABLE credential (
+       id SERIAL PRIMARY KEY,
+       mailbox INTEGER NOT NULL,
+       label TEXT NOT NULL,
+       pw_type TEXT NOT NULL DEFAULT 'SHA512-CRYPT',
+       password TEXT NOT NULL,
+       created TEXT NOT NULL DEFAULT to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS'),
+       last_used TEXT,
+       expires TEXT, -- NULL never expires
+       allow_imap INTEGER NOT NULL DEFAULT 1,
+       allow_pop3 INTEGER NOT NULL DEFAULT 1,
+       allow_submission INTEGER NOT NULL DEFAULT 1, -- and SMTP AUTH
+       allow_sieve INTEGER NOT NULL DEFAULT 1, -- ManageSieve
+       CONSTRAINT cred_mbox FOREIGN KEY(mailbox) REFERENCES vmailbox(id) ON DELETE CASCADE,
+       UNIQUE (mailbox, label));
+
+-- credential_service
+CREATE VIEW credential_service AS
+     SELECT id, 'imap' AS service FROM credential WHERE allow_imap = 1
+     UNION ALL
+     SELECT id, 'pop3' AS service FROM credential WHERE allow_pop3 = 1
+     UNION ALL
+     SELECT id, 'submission' AS service FROM credential WHERE allow_submission = 1
+     UNION ALL
+     SELECT id, 'smtp' AS service FROM credential WHERE allow_submission = 1
+     UNION ALL
+     SELECT id, 'sieve' AS service FROM credential WHERE allow_sieve = 1;
+
+-- user_credential
+CREATE VIEW user_credential AS
+       SELECT um.username AS username, um.domain AS domain,
+	      c.label AS label, cs.service AS service,
+	      ROW_NUMBER() OVER (PARTITION BY c.mailbox, cs.service ORDER BY c.id) AS slot,
+	      '{' || c.pw_type || '}' || c.password AS password,
+	      um.uid AS uid, um.gid AS gid, um.home AS home,
+	      um.quota_rule AS quota_rule
+       FROM credential_service AS cs
+	      JOIN credential AS c ON (c.id = cs.id)
+	      JOIN user_mailbox AS um ON (um.id = c.mailbox)
+       WHERE c.expires IS NULL
+	      OR c.expires > to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS');
+
+-- Audit the credentials too
+-- The credential key is its mailbox so the log of a mailbox has them too.
+CREATE OR REPLACE FUNCTION audit_credential_json(c credential, pw JSON) RETURNS JSON AS $$
+  SELECT json_build_object('label', c.label, 'pw_type', c.pw_type, 'password', pw,
+                           'expires', c.expires,
+                           'allow_imap', c.allow_imap, 'allow_pop3', c.allow_pop3,
+                           'allow_submission', c.allow_submission,
+                           'allow_sieve', c.allow_sieve);
+$$ LANGUAGE sql;
+
+CREATE OR REPLACE FUNCTION audit_credential() RETURNS trigger AS $$
+BEGIN
+  IF TG_OP = 'INSERT' THEN
+    PERFORM audit_log('credential', TG_OP,
+            (SELECT name FROM address_name WHERE id = NEW.mailbox), NULL,
+            audit_credential_json(NEW, to_json(1)));
+  ELSIF TG_OP = 'UPDATE' THEN
+    PERFORM audit_log('credential', TG_OP,
+            (SELECT name FROM address_name WHERE id = NEW.mailbox),
+            audit_credential_json(OLD, to_json(1)),
+            audit_credential_json(NEW,
+              CASE WHEN OLD.password IS DISTINCT FROM NEW.password
+                   THEN to_json('changed'::text) ELSE to_json(1) END));
+  ELSE
+    PERFORM audit_log('credential', TG_OP,
+            (SELECT name FROM address_name WHERE id = OLD.mailbox),
+            audit_credential_json(OLD, to_json(1)), NULL);
+    RETURN OLD;
+  END IF;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+-- last_used is bookkeeping, not a change
+CREATE TRIGGER audit_credential_insert AFTER INSERT ON credential
+  FOR EACH ROW EXECUTE FUNCTION audit_credential();
+CREATE TRIGGER audit_credential_update AFTER UPDATE ON credential
+  FOR EACH ROW WHEN ((OLD.label, OLD.pw_type, OLD.password, OLD.expires, OLD.allow_imap,
+                      OLD.allow_pop3, OLD.allow_submission, OLD.allow_sieve)
+                     IS DISTINCT FROM
+                     (NEW.label, NEW.pw_type, NEW.password, NEW.expires, NEW.allow_imap,
+                      NEW.allow_pop3, NEW.allow_submission, NEW.allow_sieve))
+  EXECUTE FUNCTION audit_credential();
+CREATE TRIGGER audit_credential_delete BEFORE DELETE ON credential
+  FOR EACH ROW EXECUTE FUNCTION audit_credential();
@@ -0,0 +1,131 @@
+-- Version 6
+-- Password age and policy. See ../schema.sql for the details.
+-- No BEGIN/COMMIT here. Migrate wraps all the scripts in one transaction.
+ALTER TABLE domain ADD COLUMN pw_max_age INTEGER;
+ALTER TABLE domain ADD COLUMN pw_min_length INTEGER;
+ALTER TABLE domain ADD COLUMN pw_min_classes INTEGER;
+ALTER TABLE vmailbox ADD COLUMN pw_set TEXT;
+ALTER TABLE vmailbox ADD COLUMN pw_max_age INTEGER;
+
+-- We don't know when the existing passwords were set so their
+-- age starts now.
+UPDATE vmailbox SET pw_set = to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS')
+ WHERE password IS NOT NULL;
+
+-- user_mailbox
+-- The password expiry is added to the view. Its dependents go with it.
+DROP VIEW IF EXISTS user_mailbox CASCADE;
+CREATE VIEW user_mailbox AS
+       SELECT mb.id AS id, a.localpart AS username, d.name AS domain,
+       	      '{' || mb.pw_type || '}' || COALESCE(mb.password, '*') AS password,
+	      COALESCE(mb.uid,
+	              COALESCE(d.vuid,
+		              (SELECT vuid FROM domain WHERE name = 'localhost'))) AS uid,
+	      COALESCE(mb.gid,
+	             COALESCE(d.vgid,
+		              (SELECT vgid FROM domain WHERE name = 'localhost'))) AS gid,
+	      COALESCE(mb.home, '') AS home,
+	      COALESCE(mb.quota, '*:bytes=0') AS quota_rule,
+       	      mb.enable AS enable,
+	      mb.allow_imap AS allow_imap, mb.allow_pop3 AS allow_pop3,
+	      mb.allow_lmtp AS allow_lmtp, mb.allow_submission AS allow_submission,
+	      mb.allow_sieve AS allow_sieve,
+	      CASE WHEN mb.password IS NOT NULL AND mb.pw_set IS NOT NULL
+	                AND COALESCE(mb.pw_max_age, d.pw_max_age, 0) > 0
+	           THEN to_char(mb.pw_set::timestamp
+	                        + COALESCE(mb.pw_max_age, d.pw_max_age) * interval '1 day',
+	                        'YYYY-MM-DD HH24:MI:SS')
+	      END AS pw_expires,
+	      CASE WHEN mb.password IS NOT NULL AND mb.pw_set IS NOT NULL
+	                AND COALESCE(mb.pw_max_age, d.pw_max_age, 0) > 0
+	                AND mb.pw_set::timestamp
+	                    + COALESCE(mb.pw_max_age, d.pw_max_age) * interval '1 day'
+	                    <= now() AT TIME ZONE 'UTC'
+	           THEN 1 ELSE 0
+	      END AS pw_expired
+       FROM vmailbox AS mb
+       	      JOIN address AS a ON (a.id = mb.id)
+	      JOIN domain AS d ON (a.domain = d.id);
+
+-- user_deny
+-- This query looks for denied (locked out) users, disabled or with an
+-- expired password
+CREATE VIEW user_deny AS
+     SELECT username, domain, 'true' AS deny
+     FROM user_mailbox WHERE enable = 0 OR pw_expired = 1;
+
+-- Per service deny views
+-- See ../schema.sql for which dovecot service is which.
+CREATE VIEW imap_deny AS
+     SELECT username, domain, 'true' AS deny
+     FROM user_mailbox WHERE enable = 0 OR pw_expired = 1 OR allow_imap = 0;
+
+CREATE VIEW pop3_deny AS
+     SELECT username, domain, 'true' AS deny
+     FROM user_mailbox WHERE enable = 0 OR pw_expired = 1 OR allow_pop3 = 0;
+
+CREATE VIEW lmtp_deny AS
+     SELECT username, domain, 'true' AS deny
+     FROM user_mailbox WHERE enable = 0 OR allow_lmtp = 0;
+
+CREATE VIEW submission_deny AS
+     SELECT username, domain, 'true' AS deny
+     FROM user_mailbox WHERE enable = 0 OR pw_expired = 1 OR allow_submission = 0;
+
+CREATE VIEW sieve_deny AS
+     SELECT username, domain, 'true' AS deny
+     FROM user_mailbox WHERE enable = 0 OR pw_expired = 1 OR allow_sieve = 0;
+
+CREATE VIEW service_deny AS
+     SELECT username, domain, 'imap' AS service, deny FROM imap_deny
+     UNION ALL
+     SELECT username, domain, 'pop3' AS service, deny FROM pop3_deny
+     UNION ALL
+     SELECT username, domain, 'lmtp' AS service, deny FROM lmtp_deny
+     UNION ALL
+     SELECT username, domain, 'submission' AS service, deny FROM submission_deny
+     UNION ALL
+     SELECT username, domain, 'smtp' AS service, deny FROM submission_deny
+     UNION ALL
+     SELECT username, domain, 'sieve' AS service, deny FROM sieve_deny;
+
+-- bannedpassword
+-- Passwords no mailbox can have, lower case.
+DROP TABLE IF EXISTS bannedpassword CASCADE;
+CREATE TABLE bannedpassword (
+       password TEXT PRIMARY KEY);
+
+-- user_credential
+-- It went with user_mailbox too
+CREATE VIEW user_credential AS
+       SELECT um.username AS username, um.domain AS domain,
+	      c.label AS label, cs.service AS service,
+	      ROW_NUMBER() OVER (PARTITION BY c.mailbox, cs.service ORDER BY c.id) AS slot,
+	      '{' || c.pw_type || '}' || c.password AS password,
+	      um.uid AS uid, um.gid AS gid, um.home AS home,
+	      um.quota_rule AS quota_rule
+       FROM credential_service AS cs
+	      JOIN credential AS c ON (c.id = cs.id)
+	      JOIN user_mailbox AS um ON (um.id = c.mailbox)
+       WHERE c.expires IS NULL
+	      OR c.expires > to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS');
+
+-- The audit records the new columns
+CREATE OR REPLACE FUNCTION audit_domain_json(d "domain") RETURNS JSON AS $$
+  SELECT json_build_object('name', d.name, 'class', d.class,
+                           'transport', (SELECT name FROM transport WHERE id = d.transport),
+                           'access', (SELECT name FROM access WHERE id = d.access),
+                           'vuid', d.vuid, 'vgid', d.vgid,
+                           'pw_max_age', d.pw_max_age, 'pw_min_length', d.pw_min_length,
+                           'pw_min_classes', d.pw_min_classes);
+$$ LANGUAGE sql;
+
+CREATE OR REPLACE FUNCTION audit_vmailbox_json(mb vmailbox, pw JSON) RETURNS JSON AS $$
+  SELECT json_build_object('pw_type', mb.pw_type, 'password', pw,
+                           'uid', mb.uid, 'gid', mb.gid, 'home', mb.home,
+                           'quota', mb.quota, 'enable', mb.enable,
+                           'allow_imap', mb.allow_imap, 'allow_pop3', mb.allow_pop3,
+                           'allow_lmtp', mb.allow_lmtp, 'allow_submission', mb.allow_submission,
+                           'allow_sieve', mb.allow_sieve,
+                           'pw_set', mb.pw_set, 'pw_max_age', mb.pw_max_age);
+$$ LANGUAGE sql;
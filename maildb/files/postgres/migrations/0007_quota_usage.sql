@@ -0,0 +1,34 @@
+-- Version 7
+-- Quota usage from the dovecot quota dict. See ../schema.sql for the details.
+-- No BEGIN/COMMIT here. Migrate wraps all the scripts in one transaction.
+-- quotausage
+-- What each mailbox is using as kept by dovecot's quota dict.
+-- See ../schema.sql for the full story.
+DROP TABLE IF EXISTS quotausage CASCADE;
+CREATE TABLE quotausage (
+       username TEXT PRIMARY KEY,
+       bytes BIGINT NOT NULL DEFAULT 0,
+       messages INTEGER NOT NULL DEFAULT 0);
+
+-- Clean up the usage of a deleted mailbox before after_del_mbox
+-- deletes the address we need for the name.
+CREATE OR REPLACE FUNCTION del_mbox_quota() RETURNS trigger AS $$
+BEGIN
+  DELETE FROM quotausage
+   WHERE username = (SELECT a.localpart || '@' || d.name
+   	 	     FROM address AS a JOIN domain AS d ON (a.domain = d.id)
+		     WHERE a.id = OLD.id);
+  RETURN OLD;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER del_mbox_quota BEFORE DELETE ON vmailbox
+  FOR EACH ROW EXECUTE FUNCTION del_mbox_quota();
+
+-- user_quota
+CREATE VIEW user_quota AS
+       SELECT um.id AS id, um.username AS username, um.domain AS domain,
+	      um.quota_rule AS quota_rule,
+	      COALESCE(q.bytes, 0) AS bytes, COALESCE(q.messages, 0) AS messages
+       FROM user_mailbox AS um
+	      LEFT JOIN quotausage AS q ON (q.username = um.username || '@' || um.domain);
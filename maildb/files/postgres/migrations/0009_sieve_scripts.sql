@@ -0,0 +1,67 @@
+-- Version 9
+-- Sieve scripts of mailboxes for Pigeonhole's dict storage.
+-- See ../schema.sql for the details.
+-- No BEGIN/COMMIT here. Migrate wraps all the scripts in one transaction.
+-- sievescript
+-- The Sieve filters of each mailbox. See ../schema.sql for the full story.
+DROP TABLE IF EXISTS sievescript CASCADE;
+CREATE TABLE sievescript (
+       id SERIAL PRIMARY KEY,
+       mailbox INTEGER NOT NULL,
+       name TEXT NOT NULL,
+       script TEXT NOT NULL,
+       active INTEGER NOT NULL DEFAULT 0,
+       version INTEGER NOT NULL DEFAULT 1,
+       modified TEXT NOT NULL DEFAULT to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS'),
+       CONSTRAINT sieve_mbox FOREIGN KEY(mailbox) REFERENCES vmailbox(id) ON DELETE CASCADE,
+       UNIQUE (mailbox, name));
+
+-- There is at most one active script per mailbox
+CREATE UNIQUE INDEX sieve_active ON sievescript(mailbox) WHERE active = 1;
+
+-- user_sieve
+-- The scripts in the layout of Pigeonhole's dict storage
+CREATE VIEW user_sieve AS
+       SELECT um.username || '@' || um.domain AS username, s.name AS script_name,
+	      s.id || '.' || s.version AS id, s.script AS script_data
+       FROM sievescript AS s JOIN user_mailbox AS um ON (um.id = s.mailbox)
+       UNION ALL
+       SELECT um.username || '@' || um.domain AS username, 'active' AS script_name,
+	      s.id || '.' || s.version AS id, s.script AS script_data
+       FROM sievescript AS s JOIN user_mailbox AS um ON (um.id = s.mailbox)
+       WHERE s.active = 1;
+
+-- The sieve key is its mailbox like credential. The script itself is
+-- not recorded, only that it changed.
+CREATE OR REPLACE FUNCTION audit_sieve_json(s sievescript) RETURNS JSON AS $$
+  SELECT json_build_object('name', s.name, 'active', s.active, 'version', s.version);
+$$ LANGUAGE sql;
+
+CREATE OR REPLACE FUNCTION audit_sieve() RETURNS trigger AS $$
+BEGIN
+  IF TG_OP = 'INSERT' THEN
+    PERFORM audit_log('sieve', TG_OP,
+            (SELECT name FROM address_name WHERE id = NEW.mailbox), NULL,
+            audit_sieve_json(NEW));
+  ELSIF TG_OP = 'UPDATE' THEN
+    PERFORM audit_log('sieve', TG_OP,
+            (SELECT name FROM address_name WHERE id = NEW.mailbox),
+            audit_sieve_json(OLD), audit_sieve_json(NEW));
+  ELSE
+    PERFORM audit_log('sieve', TG_OP,
+            (SELECT name FROM address_name WHERE id = OLD.mailbox),
+            audit_sieve_json(OLD), NULL);
+    RETURN OLD;
+  END IF;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_sieve_insert AFTER INSERT ON sievescript
+  FOR EACH ROW EXECUTE FUNCTION audit_sieve();
+CREATE TRIGGER audit_sieve_update AFTER UPDATE ON sievescript
+  FOR EACH ROW WHEN ((OLD.name, OLD.script, OLD.active)
+                     IS DISTINCT FROM (NEW.name, NEW.script, NEW.active))
+  EXECUTE FUNCTION audit_sieve();
+CREATE TRIGGER audit_sieve_delete BEFORE DELETE ON sievescript
+  FOR EACH ROW EXECUTE FUNCTION audit_sieve();
@@ -0,0 +1,56 @@
+-- Version 10
+-- Vacation replies of mailboxes. See ../schema.sql for the details.
+-- No BEGIN/COMMIT here. Migrate wraps all the scripts in one transaction.
+-- vacation
+-- The out of office reply of a mailbox. See ../schema.sql for the full story.
+DROP TABLE IF EXISTS vacation CASCADE;
+CREATE TABLE vacation (
+       mailbox INTEGER PRIMARY KEY,
+       subject TEXT,
+       body TEXT NOT NULL DEFAULT '',
+       start_date TEXT,
+       end_date TEXT,
+       days INTEGER NOT NULL DEFAULT 7,
+       addresses TEXT,
+       previous TEXT,
+       modified TEXT NOT NULL DEFAULT to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS'),
+       CONSTRAINT vacation_mbox FOREIGN KEY(mailbox) REFERENCES vmailbox(id) ON DELETE CASCADE);
+
+-- The vacation key is its mailbox. The message is not recorded.
+CREATE OR REPLACE FUNCTION audit_vacation_json(v vacation) RETURNS JSON AS $$
+  SELECT json_build_object('subject', v.subject, 'start_date', v.start_date,
+                           'end_date', v.end_date, 'days', v.days,
+                           'addresses', v.addresses);
+$$ LANGUAGE sql;
+
+CREATE OR REPLACE FUNCTION audit_vacation() RETURNS trigger AS $$
+BEGIN
+  IF TG_OP = 'INSERT' THEN
+    PERFORM audit_log('vacation', TG_OP,
+            (SELECT name FROM address_name WHERE id = NEW.mailbox), NULL,
+            audit_vacation_json(NEW));
+  ELSIF TG_OP = 'UPDATE' THEN
+    PERFORM audit_log('vacation', TG_OP,
+            (SELECT name FROM address_name WHERE id = NEW.mailbox),
+            audit_vacation_json(OLD), audit_vacation_json(NEW));
+  ELSE
+    PERFORM audit_log('vacation', TG_OP,
+            (SELECT name FROM address_name WHERE id = OLD.mailbox),
+            audit_vacation_json(OLD), NULL);
+    RETURN OLD;
+  END IF;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_vacation_insert AFTER INSERT ON vacation
+  FOR EACH ROW EXECUTE FUNCTION audit_vacation();
+CREATE TRIGGER audit_vacation_update AFTER UPDATE ON vacation
+  FOR EACH ROW WHEN ((OLD.subject, OLD.body, OLD.start_date, OLD.end_date,
+                      OLD.days, OLD.addresses)
+                     IS DISTINCT FROM
+                     (NEW.subject, NEW.body, NEW.start_date, NEW.end_date,
+                      NEW.days, NEW.addresses))
+  EXECUTE FUNCTION audit_vacation();
+CREATE TRIGGER audit_vacation_delete BEFORE DELETE ON vacation
+  FOR EACH ROW EXECUTE FUNCTION audit_vacation();
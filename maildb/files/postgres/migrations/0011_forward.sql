@@ -0,0 +1,104 @@
+-- Version 11
+-- Forwarding of mailboxes and the virt_alias lines for it. See ../schema.sql
+-- for the details.
+-- No BEGIN/COMMIT here. Migrate wraps all the scripts in one transaction.
+-- forward
+-- Mail to a mailbox sent on to other addresses, and kept too if
+-- keep_copy. See ../schema.sql for the full story.
+DROP TABLE IF EXISTS forward CASCADE;
+CREATE TABLE forward (
+       mailbox INTEGER PRIMARY KEY,
+       keep_copy INTEGER NOT NULL DEFAULT 0,
+       CONSTRAINT forward_mbox FOREIGN KEY(mailbox) REFERENCES vmailbox(id) ON DELETE CASCADE);
+
+DROP TABLE IF EXISTS forwardtarget CASCADE;
+CREATE TABLE forwardtarget (
+       id SERIAL PRIMARY KEY,
+       forward INTEGER NOT NULL,
+       target TEXT NOT NULL,
+       CONSTRAINT forward_target FOREIGN KEY(forward) REFERENCES forward(mailbox) ON DELETE CASCADE,
+       UNIQUE(forward, target));
+
+-- virt_alias models the virtuals file where a line is
+--   alias    recipient
+-- The aliases and then the forwards of mailboxes.
+DROP VIEW IF EXISTS virt_alias;
+CREATE VIEW virt_alias AS
+       SELECT aa.localpart AS mailbox, ad.name AS domain_name,
+	      ta.localpart ||
+	      (CASE WHEN va.extension IS NOT NULL
+	      	    THEN '+' || va.extension
+		    ELSE ''
+	      END) ||
+	      (SELECT CASE WHEN ta.domain IS NULL
+		    THEN ''
+		    ELSE '@' || (SELECT name FROM domain WHERE id = ta.domain)
+	      END) AS recipient
+	FROM alias AS va
+	JOIN address AS aa ON (va.address = aa.id)
+	JOIN domain AS ad ON (aa.domain = ad.id)
+	JOIN address AS ta ON (va.target = ta.id)
+       UNION ALL
+       SELECT fa.localpart AS mailbox, fd.name AS domain_name, ft.target AS recipient
+	FROM forwardtarget AS ft
+	JOIN address AS fa ON (ft.forward = fa.id)
+	JOIN domain AS fd ON (fa.domain = fd.id)
+       UNION ALL
+       SELECT fa.localpart AS mailbox, fd.name AS domain_name,
+	      fa.localpart || '@' || fd.name AS recipient
+	FROM forward AS f
+	JOIN address AS fa ON (f.mailbox = fa.id)
+	JOIN domain AS fd ON (fa.domain = fd.id)
+	WHERE f.keep_copy = 1
+	  AND (SELECT count(*) FROM forwardtarget WHERE forward = f.mailbox) > 0;
+
+-- The forward key is its mailbox. Its targets are logged one by one.
+CREATE OR REPLACE FUNCTION audit_forward() RETURNS trigger AS $$
+BEGIN
+  IF TG_OP = 'INSERT' THEN
+    PERFORM audit_log('forward', TG_OP,
+            (SELECT name FROM address_name WHERE id = NEW.mailbox), NULL,
+            json_build_object('keep_copy', NEW.keep_copy));
+  ELSIF TG_OP = 'UPDATE' THEN
+    PERFORM audit_log('forward', TG_OP,
+            (SELECT name FROM address_name WHERE id = NEW.mailbox),
+            json_build_object('keep_copy', OLD.keep_copy),
+            json_build_object('keep_copy', NEW.keep_copy));
+  ELSE
+    PERFORM audit_log('forward', TG_OP,
+            (SELECT name FROM address_name WHERE id = OLD.mailbox),
+            json_build_object('keep_copy', OLD.keep_copy), NULL);
+    RETURN OLD;
+  END IF;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_forward_insert AFTER INSERT ON forward
+  FOR EACH ROW EXECUTE FUNCTION audit_forward();
+CREATE TRIGGER audit_forward_update AFTER UPDATE ON forward
+  FOR EACH ROW WHEN (OLD.keep_copy IS DISTINCT FROM NEW.keep_copy)
+  EXECUTE FUNCTION audit_forward();
+CREATE TRIGGER audit_forward_delete BEFORE DELETE ON forward
+  FOR EACH ROW EXECUTE FUNCTION audit_forward();
+
+CREATE OR REPLACE FUNCTION audit_forward_target() RETURNS trigger AS $$
+BEGIN
+  IF TG_OP = 'INSERT' THEN
+    PERFORM audit_log('forward', TG_OP,
+            (SELECT name FROM address_name WHERE id = NEW.forward), NULL,
+            json_build_object('target', NEW.target));
+  ELSE
+    PERFORM audit_log('forward', TG_OP,
+            (SELECT name FROM address_name WHERE id = OLD.forward),
+            json_build_object('target', OLD.target), NULL);
+    RETURN OLD;
+  END IF;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_forward_target_insert AFTER INSERT ON forwardtarget
+  FOR EACH ROW EXECUTE FUNCTION audit_forward_target();
+CREATE TRIGGER audit_forward_target_delete BEFORE DELETE ON forwardtarget
+  FOR EACH ROW EXECUTE FUNCTION audit_forward_target();
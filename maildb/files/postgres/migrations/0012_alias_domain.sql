@@ -0,0 +1,101 @@
+-- Version 12
+-- Alias domains and the virt_alias lines for them. See ../schema.sql
+-- for the details.
+-- No BEGIN/COMMIT here. Migrate wraps all the scripts in one transaction.
+-- aliasdomain
+-- Every address of the target domain also works in the alias domain.
+-- See ../schema.sql for the full story.
+DROP TABLE IF EXISTS aliasdomain CASCADE;
+CREATE TABLE aliasdomain (
+       domain INTEGER PRIMARY KEY,
+       target INTEGER NOT NULL,
+       CONSTRAINT alias_domain FOREIGN KEY(domain) REFERENCES domain(id) ON DELETE CASCADE,
+       CONSTRAINT alias_domain_target FOREIGN KEY(target) REFERENCES domain(id));
+
+-- virt_alias models the virtuals file where a line is
+--   alias    recipient
+-- The aliases, the forwards of mailboxes, and then the addresses of
+-- alias domains.
+DROP VIEW IF EXISTS virt_alias;
+CREATE VIEW virt_alias AS
+       SELECT aa.localpart AS mailbox, ad.name AS domain_name,
+	      ta.localpart ||
+	      (CASE WHEN va.extension IS NOT NULL
+	      	    THEN '+' || va.extension
+		    ELSE ''
+	      END) ||
+	      (SELECT CASE WHEN ta.domain IS NULL
+		    THEN ''
+		    ELSE '@' || (SELECT name FROM domain WHERE id = ta.domain)
+	      END) AS recipient
+	FROM alias AS va
+	JOIN address AS aa ON (va.address = aa.id)
+	JOIN domain AS ad ON (aa.domain = ad.id)
+	JOIN address AS ta ON (va.target = ta.id)
+       UNION ALL
+       SELECT fa.localpart AS mailbox, fd.name AS domain_name, ft.target AS recipient
+	FROM forwardtarget AS ft
+	JOIN address AS fa ON (ft.forward = fa.id)
+	JOIN domain AS fd ON (fa.domain = fd.id)
+       UNION ALL
+       SELECT fa.localpart AS mailbox, fd.name AS domain_name,
+	      fa.localpart || '@' || fd.name AS recipient
+	FROM forward AS f
+	JOIN address AS fa ON (f.mailbox = fa.id)
+	JOIN domain AS fd ON (fa.domain = fd.id)
+	WHERE f.keep_copy = 1
+	  AND (SELECT count(*) FROM forwardtarget WHERE forward = f.mailbox) > 0
+       UNION ALL
+       SELECT ta.localpart AS mailbox, ald.name AS domain_name,
+	      ta.localpart || '@' || td.name AS recipient
+	FROM aliasdomain AS dm
+	JOIN domain AS ald ON (dm.domain = ald.id)
+	JOIN domain AS td ON (dm.target = td.id)
+	JOIN address AS ta ON (ta.domain = td.id)
+	WHERE (ta.id IN (SELECT id FROM vmailbox) OR ta.id IN (SELECT address FROM alias))
+	  AND NOT EXISTS (SELECT 1 FROM address AS oa JOIN alias AS oal ON (oal.address = oa.id)
+	      	  	  WHERE oa.localpart = ta.localpart AND oa.domain = dm.domain);
+
+-- Alias domains and their targets stay when their last address goes
+CREATE OR REPLACE FUNCTION after_addr_del() RETURNS trigger AS $$
+BEGIN
+  IF OLD.domain IS NOT NULL
+     AND (SELECT class FROM domain WHERE id = OLD.domain) != 4
+     AND (SELECT count(*) FROM address WHERE domain = OLD.domain) < 1
+     AND (SELECT count(*) FROM aliasdomain
+          WHERE domain = OLD.domain OR target = OLD.domain) < 1 THEN
+    DELETE FROM domain WHERE id = OLD.domain;
+  END IF;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+-- The alias domain key is its name. The target is logged by name.
+CREATE OR REPLACE FUNCTION audit_alias_domain() RETURNS trigger AS $$
+BEGIN
+  IF TG_OP = 'INSERT' THEN
+    PERFORM audit_log('aliasdomain', TG_OP,
+            (SELECT name FROM domain WHERE id = NEW.domain), NULL,
+            json_build_object('target', (SELECT name FROM domain WHERE id = NEW.target)));
+  ELSIF TG_OP = 'UPDATE' THEN
+    PERFORM audit_log('aliasdomain', TG_OP,
+            (SELECT name FROM domain WHERE id = NEW.domain),
+            json_build_object('target', (SELECT name FROM domain WHERE id = OLD.target)),
+            json_build_object('target', (SELECT name FROM domain WHERE id = NEW.target)));
+  ELSE
+    PERFORM audit_log('aliasdomain', TG_OP,
+            (SELECT name FROM domain WHERE id = OLD.domain),
+            json_build_object('target', (SELECT name FROM domain WHERE id = OLD.target)), NULL);
+    RETURN OLD;
+  END IF;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_alias_domain_insert AFTER INSERT ON aliasdomain
+  FOR EACH ROW EXECUTE FUNCTION audit_alias_domain();
+CREATE TRIGGER audit_alias_domain_update AFTER UPDATE ON aliasdomain
+  FOR EACH ROW WHEN (OLD.target IS DISTINCT FROM NEW.target)
+  EXECUTE FUNCTION audit_alias_domain();
+CREATE TRIGGER audit_alias_domain_delete BEFORE DELETE ON aliasdomain
+  FOR EACH ROW EXECUTE FUNCTION audit_alias_domain();
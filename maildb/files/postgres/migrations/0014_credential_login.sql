@@ -0,0 +1,36 @@
+-- Version 14
+-- When dovecot last logged a credential in. See ../schema.sql for the details.
+-- No BEGIN/COMMIT here. Migrate wraps all the scripts in one transaction.
+-- credentiallogin
+-- When each credential last logged in, kept by dovecot's last_login plugin.
+-- See ../schema.sql for the full story.
+DROP TABLE IF EXISTS credentiallogin CASCADE;
+CREATE TABLE credentiallogin (
+       credential TEXT PRIMARY KEY,
+       last_login BIGINT NOT NULL DEFAULT 0);
+
+-- Clean up the logins of a deleted credential
+CREATE OR REPLACE FUNCTION del_cred_login() RETURNS trigger AS $$
+BEGIN
+  DELETE FROM credentiallogin WHERE credential = CAST(OLD.id AS TEXT);
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER del_cred_login AFTER DELETE ON credential
+  FOR EACH ROW EXECUTE FUNCTION del_cred_login();
+
+-- user_credential
+-- credential is the id for the last_login key
+CREATE OR REPLACE VIEW user_credential AS
+       SELECT um.username AS username, um.domain AS domain,
+	      c.label AS label, cs.service AS service,
+	      ROW_NUMBER() OVER (PARTITION BY c.mailbox, cs.service ORDER BY c.id) AS slot,
+	      '{' || c.pw_type || '}' || c.password AS password,
+	      um.uid AS uid, um.gid AS gid, um.home AS home,
+	      um.quota_rule AS quota_rule, c.id AS credential
+       FROM credential_service AS cs
+	      JOIN credential AS c ON (c.id = cs.id)
+	      JOIN user_mailbox AS um ON (um.id = c.mailbox)
+       WHERE c.expires IS NULL
+	      OR c.expires > to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS');
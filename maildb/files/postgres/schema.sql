@@ -0,0 +1,1077 @@
+-- The PostgreSQL version of ../schema.sql. The tables, views, and their
+-- columns have the same names and meanings so the postfix and dovecot
+-- queries and the maildb code work the same on either. Where sqlite does
+-- something with a trigger or a quirk, this does it the PostgreSQL way.
+-- Keep the two in step. The schema_version must match too.
+--
+-- Table names are unquoted here. PostgreSQL folds them to lower case
+-- which is how the code refers to them.
+--
+-- The whole script is sent to the server in one go and runs in one
+-- transaction.
+
+BEGIN;
+--
+-- schema_version table
+-- One row per schema revision applied. The highest version is the
+-- current schema. It must match DbSchemaVersion in maildb/migrate.go
+-- and the last script in files/postgres/migrations.
+DROP TABLE IF EXISTS schema_version CASCADE;
+CREATE TABLE schema_version (
+       version INTEGER PRIMARY KEY,
+       applied TEXT NOT NULL DEFAULT to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS'),
+       description TEXT
+       );
+INSERT INTO schema_version (version, description)
+       VALUES (15, 'initial schema');
+
+--
+-- Access table
+-- Table rows match smtpd_restriction_classes list actually implemented
+-- in postfix. The names are the set of acceptable choices in the UI and
+-- we catch editing errors here rather than in the postfix runtime
+DROP TABLE IF EXISTS access CASCADE;
+CREATE TABLE access (
+       id SERIAL PRIMARY KEY,
+       name TEXT UNIQUE NOT NULL,
+       action TEXT NOT NULL
+       );
+
+-- transport table
+DROP TABLE IF EXISTS transport CASCADE;
+CREATE TABLE transport (
+       id SERIAL PRIMARY KEY,
+       name TEXT UNIQUE NOT NULL,
+       transport TEXT,  -- lmtp|smtp|relay|local|throttled|custom|...
+       nexthop TEXT,	-- [domain]:port or domain:port
+       UNIQUE (transport,nexthop)
+       );
+
+-- domain table
+DROP TABLE IF EXISTS domain CASCADE;
+CREATE TABLE domain (
+       id SERIAL PRIMARY KEY,
+       name TEXT NOT NULL,
+       class INTEGER DEFAULT 0, -- 1 == local, 2 == relay, 3 == valias,
+       	     	     	     	-- 4 == vmailbox, 0 == default (internet), none
+       transport INTEGER,
+       access INTEGER,
+       vuid INTEGER,		-- virtual UID for dovecot general mboxes
+       vgid INTEGER,		-- virtual GID
+       pw_max_age INTEGER,	-- password policy for its mailboxes, NULL is none
+       pw_min_length INTEGER,	-- days, characters, and character classes
+       pw_min_classes INTEGER,
+       quota TEXT,		-- default quota rule of its mailboxes, NULL is none
+       CONSTRAINT dom_trans FOREIGN KEY(transport) REFERENCES transport(id),
+       CONSTRAINT dom_access FOREIGN KEY(access) REFERENCES access(id)
+       );
+
+CREATE UNIQUE INDEX domain_name ON domain(name);
+
+-- domain_access
+CREATE VIEW domain_access AS
+       SELECT d.name AS domain_name, ac.action AS access_key
+       FROM domain AS d, access AS ac WHERE d.access = ac.id;
+
+-- domain_transport
+CREATE VIEW domain_transport AS
+       SELECT d.name AS domain_name,
+       	      COALESCE(tr.transport, '') || ':' || COALESCE(tr.nexthop, '') AS transport
+       FROM domain AS d, transport AS tr WHERE d.transport = tr.id;
+
+-- internet_domain
+CREATE VIEW internet_domain AS
+  SELECT name FROM domain WHERE class = 0;
+
+-- local_domain
+CREATE VIEW local_domain AS
+  SELECT name FROM domain WHERE class = 1;
+
+-- relay_domain
+CREATE VIEW relay_domain AS
+  SELECT name FROM domain WHERE class = 2;
+
+-- virtual_domain
+CREATE VIEW virtual_domain AS
+  SELECT name FROM domain WHERE class = 3;
+
+-- vmailbox_domain
+CREATE VIEW vmailbox_domain AS
+  SELECT name FROM domain WHERE class = 4;
+
+-- Address table
+DROP TABLE IF EXISTS address CASCADE;
+CREATE TABLE address (
+       id SERIAL PRIMARY KEY,
+       localpart TEXT NOT NULL,
+       domain INTEGER,
+       transport INTEGER,
+       access INTEGER,
+       CONSTRAINT addr_domain FOREIGN KEY(domain) REFERENCES domain(id),
+       CONSTRAINT addr_trans FOREIGN KEY(transport) REFERENCES transport(id),
+       CONSTRAINT addr_access FOREIGN KEY(access) REFERENCES access(id),
+       UNIQUE (localpart, domain)
+       );
+
+-- UNIQUE lets rows with a NULL domain, i.e. local users, through.
+-- Sqlite uses a trigger to catch them. A partial index does it here
+-- and holds up when two transactions try at once.
+CREATE UNIQUE INDEX address_local ON address(localpart) WHERE domain IS NULL;
+
+-- delete the domain when addr refs are 0 meaning this is the only
+-- one pointing to it and domain.class != vmailbox. Alias domains and
+-- their targets stay because they are still in use by aliasdomain
+CREATE OR REPLACE FUNCTION after_addr_del() RETURNS trigger AS $$
+BEGIN
+  IF OLD.domain IS NOT NULL
+     AND (SELECT class FROM domain WHERE id = OLD.domain) != 4
+     AND (SELECT count(*) FROM address WHERE domain = OLD.domain) < 1
+     AND (SELECT count(*) FROM aliasdomain
+          WHERE domain = OLD.domain OR target = OLD.domain) < 1 THEN
+    DELETE FROM domain WHERE id = OLD.domain;
+  END IF;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER after_addr_del AFTER DELETE ON address
+  FOR EACH ROW EXECUTE FUNCTION after_addr_del();
+
+-- address_access
+-- view to handle access(5) processing
+CREATE VIEW address_access AS
+       SELECT a.localpart AS username, d.name AS domain_name,
+          CASE WHEN a.access IS NOT NULL
+	  THEN (SELECT action FROM access WHERE id=a.access)
+	  ELSE (SELECT action FROM access WHERE id=d.access)
+	  END AS access_key
+       FROM address AS a
+          JOIN domain AS d ON a.domain=d.id
+       WHERE a.access IS NOT NULL OR d.access IS NOT NULL;
+
+-- address_transport
+-- return transport for address/domain.
+-- if address doesn't have one, use its domain's transport
+CREATE VIEW address_transport AS
+   SELECT a.localpart as username, d.name as domain_name,
+       CASE WHEN a.transport IS NOT NULL
+          THEN (SELECT coalesce (tr.transport, '') || ':' ||
+	               coalesce (tr.nexthop, '') FROM transport AS tr
+		WHERE a.transport = tr.id)
+	  ELSE (SELECT coalesce (tr.transport, '') || ':' ||
+	               coalesce (tr.nexthop, '') FROM transport AS tr
+		WHERE d.transport = tr.id)
+	  END AS transport
+  FROM address AS a
+     JOIN domain AS d ON a.domain = d.id
+  WHERE a.transport IS NOT NULL OR d.transport IS NOT NULL;
+
+-- address_relay
+-- return a "key" to indicate the address is one to be relayed
+CREATE VIEW address_relay AS
+       SELECT 'x' AS key, a.localpart AS username, d.name AS domain_name
+       FROM address AS a, domain AS d
+       WHERE a.domain = d.id AND d.class = 2;
+
+-- Alias table
+DROP TABLE IF EXISTS alias CASCADE;
+CREATE TABLE alias (
+       id SERIAL PRIMARY KEY,
+       address INTEGER NOT NULL,
+       target INTEGER,
+       extension TEXT,
+       CONSTRAINT alias_addr FOREIGN KEY(address) REFERENCES address(id),
+       CONSTRAINT alias_target FOREIGN KEY(target) REFERENCES address(id),
+       UNIQUE(address, target, extension),
+       CHECK (target IS NOT NULL OR extension IS NOT NULL));
+
+-- Clean up the mess left behind when an alias is deleted. One for the
+-- recipient (target) and one for the alias key (address) itself. Protect
+-- over-eager deletes by checking the reference linkage. This can cascade
+-- via the after_addr_del trigger to a domain.
+
+-- Delete addresses so long as no other alias target or a vmailbox references it
+CREATE OR REPLACE FUNCTION after_alias_del_recip() RETURNS trigger AS $$
+BEGIN
+  IF (SELECT count(*) FROM alias WHERE target = OLD.target) < 1
+     AND (SELECT count(*) FROM vmailbox WHERE id = OLD.target) < 1 THEN
+    DELETE FROM address WHERE id = OLD.target;
+  END IF;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER after_alias_del_recip AFTER DELETE ON alias
+  FOR EACH ROW EXECUTE FUNCTION after_alias_del_recip();
+
+-- Delete addresses so long as no other alias references it as a target
+CREATE OR REPLACE FUNCTION after_alias_del_addr() RETURNS trigger AS $$
+BEGIN
+  IF (SELECT count(*) FROM alias WHERE address = OLD.address) < 1 THEN
+    DELETE FROM address WHERE id = OLD.address;
+  END IF;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER after_alias_del_addr AFTER DELETE ON alias
+  FOR EACH ROW EXECUTE FUNCTION after_alias_del_addr();
+
+-- etc_aliases (local aliases)
+-- alias	recipient, recipient ...
+CREATE VIEW etc_aliases AS
+  SELECT DISTINCT aa.localpart AS local_user,
+        (CASE WHEN al.target IS NULL
+              THEN al.extension
+              ELSE
+               (SELECT (CASE WHEN ta.domain IS NULL
+	                     THEN ta.localpart
+	                     ELSE ta.localpart || '@' ||
+			          (SELECT name FROM domain WHERE id = ta.domain)
+	                END)
+	       FROM address ta WHERE ta.id = al.target)
+         END) AS recipient
+  FROM alias AS al, address AS aa
+  WHERE al.address = aa.id AND aa.domain IS NULL;
+
+-- vmailbox, dovecot user database
+DROP TABLE IF EXISTS vmailbox CASCADE;
+CREATE TABLE vmailbox (
+       id INTEGER PRIMARY KEY,
+       pw_type TEXT NOT NULL DEFAULT 'PLAIN',
+       password TEXT,
+       uid INTEGER, -- if these are NULL, use domain values
+       gid INTEGER,
+       home TEXT,  -- just home part for dovecot config of mail_home
+       quota TEXT DEFAULT '*:bytes=300M', -- in Dovecot form. NULL is the domain's
+       enable INTEGER NOT NULL DEFAULT 1, -- bool to disable all services
+       allow_imap INTEGER NOT NULL DEFAULT 1, -- bools for each service
+       allow_pop3 INTEGER NOT NULL DEFAULT 1,
+       allow_lmtp INTEGER NOT NULL DEFAULT 1, -- delivery
+       allow_submission INTEGER NOT NULL DEFAULT 1, -- and SMTP AUTH
+       allow_sieve INTEGER NOT NULL DEFAULT 1, -- ManageSieve
+       pw_set TEXT, -- when the password was set, UTC like the audit stamp
+       pw_max_age INTEGER, -- days. NULL is the domain's, 0 never expires
+       CONSTRAINT vmbox_addr FOREIGN KEY(id) REFERENCES address(id));
+
+-- An address can either be an alias or a mailbox but not both.
+-- See ../schema.sql for the why.
+CREATE OR REPLACE FUNCTION alias_insert_mailbox_check() RETURNS trigger AS $$
+BEGIN
+  IF (SELECT count(*) FROM vmailbox WHERE id = NEW.address) > 0 THEN
+    RAISE EXCEPTION 'New alias already a mailbox';
+  END IF;
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER alias_insert_mailbox_check BEFORE INSERT ON alias
+  FOR EACH ROW EXECUTE FUNCTION alias_insert_mailbox_check();
+
+CREATE OR REPLACE FUNCTION mailbox_insert_alias_check() RETURNS trigger AS $$
+BEGIN
+  IF (SELECT count(*) FROM alias WHERE address = NEW.id) > 0 THEN
+    RAISE EXCEPTION 'New mailbox already an alias';
+  END IF;
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER mailbox_insert_alias_check BEFORE INSERT ON vmailbox
+  FOR EACH ROW EXECUTE FUNCTION mailbox_insert_alias_check();
+
+-- Extend address constraint to vmailbox which shares its id
+-- We return an error string naming the app err
+CREATE OR REPLACE FUNCTION before_del_mbox() RETURNS trigger AS $$
+BEGIN
+  IF (SELECT count(*) FROM alias WHERE target = OLD.id) > 0 THEN
+    RAISE EXCEPTION 'ErrMdbMboxIsRecip';
+  END IF;
+  RETURN OLD;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER before_del_mbox BEFORE DELETE ON vmailbox
+  FOR EACH ROW EXECUTE FUNCTION before_del_mbox();
+
+-- Clean up the address on delete
+CREATE OR REPLACE FUNCTION after_del_mbox() RETURNS trigger AS $$
+BEGIN
+  IF (SELECT count(*) FROM alias WHERE target = OLD.id) < 1 THEN
+    DELETE FROM address WHERE id = OLD.id;
+  END IF;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER after_del_mbox AFTER DELETE ON vmailbox
+  FOR EACH ROW EXECUTE FUNCTION after_del_mbox();
+
+-- user_mailbox is a combination of an address row and a vmailbox row.
+-- Field names are chosen to match dovecot variables.
+-- See ../schema.sql for the full story.
+CREATE VIEW user_mailbox AS
+       SELECT mb.id AS id, a.localpart AS username, d.name AS domain,
+       	      '{' || mb.pw_type || '}' || COALESCE(mb.password, '*') AS password,
+	      COALESCE(mb.uid,
+	              COALESCE(d.vuid,
+		              (SELECT vuid FROM domain WHERE name = 'localhost'))) AS uid,
+	      COALESCE(mb.gid,
+	             COALESCE(d.vgid,
+		              (SELECT vgid FROM domain WHERE name = 'localhost'))) AS gid,
+	      COALESCE(mb.home, '') AS home,
+	      COALESCE(mb.quota, d.quota, '*:storage=0') AS quota_rule,
+       	      mb.enable AS enable,
+	      mb.allow_imap AS allow_imap, mb.allow_pop3 AS allow_pop3,
+	      mb.allow_lmtp AS allow_lmtp, mb.allow_submission AS allow_submission,
+	      mb.allow_sieve AS allow_sieve,
+	      CASE WHEN mb.password IS NOT NULL AND mb.pw_set IS NOT NULL
+	                AND COALESCE(mb.pw_max_age, d.pw_max_age, 0) > 0
+	           THEN to_char(mb.pw_set::timestamp
+	                        + COALESCE(mb.pw_max_age, d.pw_max_age) * interval '1 day',
+	                        'YYYY-MM-DD HH24:MI:SS')
+	      END AS pw_expires,
+	      CASE WHEN mb.password IS NOT NULL AND mb.pw_set IS NOT NULL
+	                AND COALESCE(mb.pw_max_age, d.pw_max_age, 0) > 0
+	                AND mb.pw_set::timestamp
+	                    + COALESCE(mb.pw_max_age, d.pw_max_age) * interval '1 day'
+	                    <= now() AT TIME ZONE 'UTC'
+	           THEN 1 ELSE 0
+	      END AS pw_expired
+       FROM vmailbox AS mb
+       	      JOIN address AS a ON (a.id = mb.id)
+	      JOIN domain AS d ON (a.domain = d.id);
+
+-- user_deny
+-- This query looks for denied (locked out) users, disabled or with an
+-- expired password
+CREATE VIEW user_deny AS
+     SELECT username, domain, 'true' AS deny
+     FROM user_mailbox WHERE enable = 0 OR pw_expired = 1;
+
+-- Per service deny views
+-- See ../schema.sql for which dovecot service is which.
+CREATE VIEW imap_deny AS
+     SELECT username, domain, 'true' AS deny
+     FROM user_mailbox WHERE enable = 0 OR pw_expired = 1 OR allow_imap = 0;
+
+CREATE VIEW pop3_deny AS
+     SELECT username, domain, 'true' AS deny
+     FROM user_mailbox WHERE enable = 0 OR pw_expired = 1 OR allow_pop3 = 0;
+
+CREATE VIEW lmtp_deny AS
+     SELECT username, domain, 'true' AS deny
+     FROM user_mailbox WHERE enable = 0 OR allow_lmtp = 0;
+
+CREATE VIEW submission_deny AS
+     SELECT username, domain, 'true' AS deny
+     FROM user_mailbox WHERE enable = 0 OR pw_expired = 1 OR allow_submission = 0;
+
+CREATE VIEW sieve_deny AS
+     SELECT username, domain, 'true' AS deny
+     FROM user_mailbox WHERE enable = 0 OR pw_expired = 1 OR allow_sieve = 0;
+
+CREATE VIEW service_deny AS
+     SELECT username, domain, 'imap' AS service, deny FROM imap_deny
+     UNION ALL
+     SELECT username, domain, 'pop3' AS service, deny FROM pop3_deny
+     UNION ALL
+     SELECT username, domain, 'lmtp' AS service, deny FROM lmtp_deny
+     UNION ALL
+     SELECT username, domain, 'submission' AS service, deny FROM submission_deny
+     UNION ALL
+     SELECT username, domain, 'smtp' AS service, deny FROM submission_deny
+     UNION ALL
+     SELECT username, domain, 'sieve' AS service, deny FROM sieve_deny;
+
+-- bannedpassword
+-- Passwords no mailbox can have, lower case.
+DROP TABLE IF EXISTS bannedpassword CASCADE;
+CREATE TABLE bannedpassword (
+       password TEXT PRIMARY KEY);
+
+-- credential
+-- Extra passwords for a mailbox. See ../schema.sql for the full story.
+DROP TABLE IF EXISTS credential CASCADE;
+CREATE TABLE credential (
+       id SERIAL PRIMARY KEY,
+       mailbox INTEGER NOT NULL,
+       label TEXT NOT NULL,
+       pw_type TEXT NOT NULL DEFAULT 'SHA512-CRYPT',
+       password TEXT NOT NULL,
+       created TEXT NOT NULL DEFAULT to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS'),
+       last_used TEXT,
+       expires TEXT, -- NULL never expires
+       allow_imap INTEGER NOT NULL DEFAULT 1,
+       allow_pop3 INTEGER NOT NULL DEFAULT 1,
+       allow_submission INTEGER NOT NULL DEFAULT 1, -- and SMTP AUTH
+       allow_sieve INTEGER NOT NULL DEFAULT 1, -- ManageSieve
+       CONSTRAINT cred_mbox FOREIGN KEY(mailbox) REFERENCES vmailbox(id) ON DELETE CASCADE,
+       UNIQUE (mailbox, label));
+
+-- credential_service
+CREATE VIEW credential_service AS
+     SELECT id, 'imap' AS service FROM credential WHERE allow_imap = 1
+     UNION ALL
+     SELECT id, 'pop3' AS service FROM credential WHERE allow_pop3 = 1
+     UNION ALL
+     SELECT id, 'submission' AS service FROM credential WHERE allow_submission = 1
+     UNION ALL
+     SELECT id, 'smtp' AS service FROM credential WHERE allow_submission = 1
+     UNION ALL
+     SELECT id, 'sieve' AS service FROM credential WHERE allow_sieve = 1;
+
+-- user_credential
+CREATE VIEW user_credential AS
+       SELECT um.username AS username, um.domain AS domain,
+	      c.label AS label, cs.service AS service,
+	      ROW_NUMBER() OVER (PARTITION BY c.mailbox, cs.service ORDER BY c.id) AS slot,
+	      '{' || c.pw_type || '}' || c.password AS password,
+	      um.uid AS uid, um.gid AS gid, um.home AS home,
+	      um.quota_rule AS quota_rule, c.id AS credential
+       FROM credential_service AS cs
+	      JOIN credential AS c ON (c.id = cs.id)
+	      JOIN user_mailbox AS um ON (um.id = c.mailbox)
+       WHERE c.expires IS NULL
+	      OR c.expires > to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS');
+
+-- quotausage
+-- What each mailbox is using as kept by dovecot's quota dict.
+-- See ../schema.sql for the full story.
+DROP TABLE IF EXISTS quotausage CASCADE;
+CREATE TABLE quotausage (
+       username TEXT PRIMARY KEY,
+       bytes BIGINT NOT NULL DEFAULT 0,
+       messages INTEGER NOT NULL DEFAULT 0);
+
+-- Clean up the usage of a deleted mailbox before after_del_mbox
+-- deletes the address we need for the name.
+CREATE OR REPLACE FUNCTION del_mbox_quota() RETURNS trigger AS $$
+BEGIN
+  DELETE FROM quotausage
+   WHERE username = (SELECT a.localpart || '@' || d.name
+   	 	     FROM address AS a JOIN domain AS d ON (a.domain = d.id)
+		     WHERE a.id = OLD.id);
+  RETURN OLD;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER del_mbox_quota BEFORE DELETE ON vmailbox
+  FOR EACH ROW EXECUTE FUNCTION del_mbox_quota();
+
+-- user_quota
+CREATE VIEW user_quota AS
+       SELECT um.id AS id, um.username AS username, um.domain AS domain,
+	      NULLIF(um.quota_rule, '*:storage=0') AS quota_rule,
+	      COALESCE(q.bytes, 0) AS bytes, COALESCE(q.messages, 0) AS messages
+       FROM user_mailbox AS um
+	      LEFT JOIN quotausage AS q ON (q.username = um.username || '@' || um.domain);
+
+-- credentiallogin
+-- When each credential last logged in, kept by dovecot's last_login plugin.
+-- See ../schema.sql for the full story.
+DROP TABLE IF EXISTS credentiallogin CASCADE;
+CREATE TABLE credentiallogin (
+       credential TEXT PRIMARY KEY,
+       last_login BIGINT NOT NULL DEFAULT 0);
+
+-- Clean up the logins of a deleted credential
+CREATE OR REPLACE FUNCTION del_cred_login() RETURNS trigger AS $$
+BEGIN
+  DELETE FROM credentiallogin WHERE credential = CAST(OLD.id AS TEXT);
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER del_cred_login AFTER DELETE ON credential
+  FOR EACH ROW EXECUTE FUNCTION del_cred_login();
+
+-- sievescript
+-- The Sieve filters of each mailbox. See ../schema.sql for the full story.
+DROP TABLE IF EXISTS sievescript CASCADE;
+CREATE TABLE sievescript (
+       id SERIAL PRIMARY KEY,
+       mailbox INTEGER NOT NULL,
+       name TEXT NOT NULL,
+       script TEXT NOT NULL,
+       active INTEGER NOT NULL DEFAULT 0,
+       version INTEGER NOT NULL DEFAULT 1,
+       modified TEXT NOT NULL DEFAULT to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS'),
+       CONSTRAINT sieve_mbox FOREIGN KEY(mailbox) REFERENCES vmailbox(id) ON DELETE CASCADE,
+       UNIQUE (mailbox, name));
+
+-- There is at most one active script per mailbox
+CREATE UNIQUE INDEX sieve_active ON sievescript(mailbox) WHERE active = 1;
+
+-- user_sieve
+-- The scripts in the layout of Pigeonhole's dict storage
+CREATE VIEW user_sieve AS
+       SELECT um.username || '@' || um.domain AS username, s.name AS script_name,
+	      s.id || '.' || s.version AS id, s.script AS script_data
+       FROM sievescript AS s JOIN user_mailbox AS um ON (um.id = s.mailbox)
+       UNION ALL
+       SELECT um.username || '@' || um.domain AS username, 'active' AS script_name,
+	      s.id || '.' || s.version AS id, s.script AS script_data
+       FROM sievescript AS s JOIN user_mailbox AS um ON (um.id = s.mailbox)
+       WHERE s.active = 1;
+
+-- vacation
+-- The out of office reply of a mailbox. See ../schema.sql for the full story.
+DROP TABLE IF EXISTS vacation CASCADE;
+CREATE TABLE vacation (
+       mailbox INTEGER PRIMARY KEY,
+       subject TEXT,
+       body TEXT NOT NULL DEFAULT '',
+       start_date TEXT,
+       end_date TEXT,
+       days INTEGER NOT NULL DEFAULT 7,
+       addresses TEXT,
+       previous TEXT,
+       modified TEXT NOT NULL DEFAULT to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS'),
+       CONSTRAINT vacation_mbox FOREIGN KEY(mailbox) REFERENCES vmailbox(id) ON DELETE CASCADE);
+
+-- forward
+-- Mail to a mailbox sent on to other addresses, and kept too if
+-- keep_copy. See ../schema.sql for the full story.
+DROP TABLE IF EXISTS forward CASCADE;
+CREATE TABLE forward (
+       mailbox INTEGER PRIMARY KEY,
+       keep_copy INTEGER NOT NULL DEFAULT 0,
+       CONSTRAINT forward_mbox FOREIGN KEY(mailbox) REFERENCES vmailbox(id) ON DELETE CASCADE);
+
+DROP TABLE IF EXISTS forwardtarget CASCADE;
+CREATE TABLE forwardtarget (
+       id SERIAL PRIMARY KEY,
+       forward INTEGER NOT NULL,
+       target TEXT NOT NULL,
+       CONSTRAINT forward_target FOREIGN KEY(forward) REFERENCES forward(mailbox) ON DELETE CASCADE,
+       UNIQUE(forward, target));
+
+-- aliasdomain
+-- Every address of the target domain also works in the alias domain.
+-- See ../schema.sql for the full story.
+DROP TABLE IF EXISTS aliasdomain CASCADE;
+CREATE TABLE aliasdomain (
+       domain INTEGER PRIMARY KEY,
+       target INTEGER NOT NULL,
+       CONSTRAINT alias_domain FOREIGN KEY(domain) REFERENCES domain(id) ON DELETE CASCADE,
+       CONSTRAINT alias_domain_target FOREIGN KEY(target) REFERENCES domain(id));
+
+-- virt_alias models the virtuals file where a line is
+--   alias    recipient
+-- The aliases, the forwards of mailboxes, and then the addresses of
+-- alias domains. address is the whole key postfix looks up, first
+-- user@domain and then the catch-all @domain, whose localpart is empty.
+-- Look up by mailbox and domain_name rather than address. They are
+-- pushed down to the indexes of each part of the union while address
+-- has to be computed for every row of the view.
+-- An alias domain has the catch-all of its target unless it has its own.
+-- The mailboxes of a domain with a catch-all are mapped to themselves so
+-- that postfix finds them before the catch-all, see VIRTUAL_README.
+CREATE VIEW virt_alias AS
+ SELECT mailbox, domain_name, mailbox || '@' || domain_name AS address, recipient
+ FROM (
+       SELECT aa.localpart AS mailbox, ad.name AS domain_name,
+	      ta.localpart ||
+	      (CASE WHEN va.extension IS NOT NULL
+	      	    THEN '+' || va.extension
+		    ELSE ''
+	      END) ||
+	      (SELECT CASE WHEN ta.domain IS NULL
+		    THEN ''
+		    ELSE '@' || (SELECT name FROM domain WHERE id = ta.domain)
+	      END) AS recipient
+	FROM alias AS va
+	JOIN address AS aa ON (va.address = aa.id)
+	JOIN domain AS ad ON (aa.domain = ad.id)
+	JOIN address AS ta ON (va.target = ta.id)
+       UNION ALL
+       SELECT fa.localpart AS mailbox, fd.name AS domain_name, ft.target AS recipient
+	FROM forwardtarget AS ft
+	JOIN address AS fa ON (ft.forward = fa.id)
+	JOIN domain AS fd ON (fa.domain = fd.id)
+       UNION ALL
+       SELECT fa.localpart AS mailbox, fd.name AS domain_name,
+	      fa.localpart || '@' || fd.name AS recipient
+	FROM forward AS f
+	JOIN address AS fa ON (f.mailbox = fa.id)
+	JOIN domain AS fd ON (fa.domain = fd.id)
+	WHERE f.keep_copy = 1
+	  AND (SELECT count(*) FROM forwardtarget WHERE forward = f.mailbox) > 0
+       UNION ALL
+       SELECT ta.localpart AS mailbox, ald.name AS domain_name,
+	      ta.localpart || '@' || td.name AS recipient
+	FROM aliasdomain AS dm
+	JOIN domain AS ald ON (dm.domain = ald.id)
+	JOIN domain AS td ON (dm.target = td.id)
+	JOIN address AS ta ON (ta.domain = td.id)
+	WHERE ta.localpart <> ''
+	  AND (ta.id IN (SELECT id FROM vmailbox) OR ta.id IN (SELECT address FROM alias))
+	  AND NOT EXISTS (SELECT 1 FROM address AS oa JOIN alias AS oal ON (oal.address = oa.id)
+	      	  	  WHERE oa.localpart = ta.localpart AND oa.domain = dm.domain)
+       UNION ALL
+       SELECT '' AS mailbox, ald.name AS domain_name,
+	      ta.localpart ||
+	      (CASE WHEN va.extension IS NOT NULL
+	      	    THEN '+' || va.extension
+		    ELSE ''
+	      END) ||
+	      (SELECT CASE WHEN ta.domain IS NULL
+		    THEN ''
+		    ELSE '@' || (SELECT name FROM domain WHERE id = ta.domain)
+	      END) AS recipient
+	FROM aliasdomain AS dm
+	JOIN domain AS ald ON (dm.domain = ald.id)
+	JOIN address AS ca ON (ca.domain = dm.target AND ca.localpart = '')
+	JOIN alias AS va ON (va.address = ca.id)
+	JOIN address AS ta ON (va.target = ta.id)
+	WHERE NOT EXISTS (SELECT 1 FROM address AS oa JOIN alias AS oal ON (oal.address = oa.id)
+	      	  	  WHERE oa.localpart = '' AND oa.domain = dm.domain)
+       UNION ALL
+       SELECT ma.localpart AS mailbox, md.name AS domain_name,
+	      ma.localpart || '@' || md.name AS recipient
+	FROM vmailbox AS vm
+	JOIN address AS ma ON (vm.id = ma.id)
+	JOIN domain AS md ON (ma.domain = md.id)
+	WHERE EXISTS (SELECT 1 FROM address AS ca JOIN alias AS cal ON (cal.address = ca.id)
+	      	      WHERE ca.localpart = '' AND ca.domain = ma.domain)
+	  AND NOT EXISTS (SELECT 1 FROM forwardtarget WHERE forward = vm.id)
+ ) AS v;
+
+-- Audit trail
+-- Every change to the tables above is recorded by the triggers below.
+-- The maildb transaction code sets postdove.user and postdove.command for
+-- the transaction so the triggers, including the ones fired by cascaded
+-- deletes, can record it. Changes made outside postdove, e.g. by psql,
+-- have no context and are recorded with a NULL user and command.
+-- Passwords are never recorded.
+DROP TABLE IF EXISTS audit CASCADE;
+CREATE TABLE audit (
+       id BIGSERIAL PRIMARY KEY,
+       stamp TEXT NOT NULL DEFAULT to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS'),
+       "user" TEXT,
+       command TEXT,
+       entity TEXT NOT NULL, -- what changed, e.g. domain or mailbox
+       op TEXT NOT NULL, -- INSERT|UPDATE|DELETE
+       key TEXT, -- the name of the row in postdove terms
+       before TEXT, -- JSON object of the row before the change
+       after TEXT -- JSON object of the row after the change
+       );
+
+CREATE INDEX audit_stamp ON audit(stamp);
+
+-- address_name
+-- The full name of an address, i.e. 'localpart' or 'localpart@domain'
+CREATE VIEW address_name AS
+       SELECT a.id AS id,
+              a.localpart || COALESCE('@' || d.name, '') AS name
+       FROM address AS a LEFT JOIN domain AS d ON (a.domain = d.id);
+
+-- audit_log
+-- Write one audit row. The settings are '' rather than NULL once
+-- a transaction that set them is over.
+CREATE OR REPLACE FUNCTION audit_log(TEXT, TEXT, TEXT, JSON, JSON) RETURNS void AS $$
+  INSERT INTO audit ("user", command, entity, op, key, before, after)
+    VALUES (NULLIF(current_setting('postdove.user', true), ''),
+            NULLIF(current_setting('postdove.command', true), ''),
+            $1, $2, $3, $4::text, $5::text);
+$$ LANGUAGE sql;
+
+-- Deletes are recorded BEFORE the row goes so we can still resolve
+-- the names of what it references. The cascade triggers run after.
+CREATE OR REPLACE FUNCTION audit_access() RETURNS trigger AS $$
+BEGIN
+  IF TG_OP = 'INSERT' THEN
+    PERFORM audit_log('access', TG_OP, NEW.name, NULL,
+            json_build_object('name', NEW.name, 'action', NEW.action));
+  ELSIF TG_OP = 'UPDATE' THEN
+    PERFORM audit_log('access', TG_OP, NEW.name,
+            json_build_object('name', OLD.name, 'action', OLD.action),
+            json_build_object('name', NEW.name, 'action', NEW.action));
+  ELSE
+    PERFORM audit_log('access', TG_OP, OLD.name,
+            json_build_object('name', OLD.name, 'action', OLD.action), NULL);
+    RETURN OLD;
+  END IF;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_access_insert AFTER INSERT ON access
+  FOR EACH ROW EXECUTE FUNCTION audit_access();
+CREATE TRIGGER audit_access_update AFTER UPDATE ON access
+  FOR EACH ROW WHEN (OLD.* IS DISTINCT FROM NEW.*) EXECUTE FUNCTION audit_access();
+CREATE TRIGGER audit_access_delete BEFORE DELETE ON access
+  FOR EACH ROW EXECUTE FUNCTION audit_access();
+
+CREATE OR REPLACE FUNCTION audit_transport() RETURNS trigger AS $$
+BEGIN
+  IF TG_OP = 'INSERT' THEN
+    PERFORM audit_log('transport', TG_OP, NEW.name, NULL,
+            json_build_object('name', NEW.name, 'transport', NEW.transport,
+                              'nexthop', NEW.nexthop));
+  ELSIF TG_OP = 'UPDATE' THEN
+    PERFORM audit_log('transport', TG_OP, NEW.name,
+            json_build_object('name', OLD.name, 'transport', OLD.transport,
+                              'nexthop', OLD.nexthop),
+            json_build_object('name', NEW.name, 'transport', NEW.transport,
+                              'nexthop', NEW.nexthop));
+  ELSE
+    PERFORM audit_log('transport', TG_OP, OLD.name,
+            json_build_object('name', OLD.name, 'transport', OLD.transport,
+                              'nexthop', OLD.nexthop), NULL);
+    RETURN OLD;
+  END IF;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_transport_insert AFTER INSERT ON transport
+  FOR EACH ROW EXECUTE FUNCTION audit_transport();
+CREATE TRIGGER audit_transport_update AFTER UPDATE ON transport
+  FOR EACH ROW WHEN (OLD.* IS DISTINCT FROM NEW.*) EXECUTE FUNCTION audit_transport();
+CREATE TRIGGER audit_transport_delete BEFORE DELETE ON transport
+  FOR EACH ROW EXECUTE FUNCTION audit_transport();
+
+CREATE OR REPLACE FUNCTION audit_domain_json(d "domain") RETURNS JSON AS $$
+  SELECT json_build_object('name', d.name, 'class', d.class,
+                           'transport', (SELECT name FROM transport WHERE id = d.transport),
+                           'access', (SELECT name FROM access WHERE id = d.access),
+                           'vuid', d.vuid, 'vgid', d.vgid,
+                           'pw_max_age', d.pw_max_age, 'pw_min_length', d.pw_min_length,
+                           'pw_min_classes', d.pw_min_classes, 'quota', d.quota);
+$$ LANGUAGE sql;
+
+CREATE OR REPLACE FUNCTION audit_domain() RETURNS trigger AS $$
+BEGIN
+  IF TG_OP = 'INSERT' THEN
+    PERFORM audit_log('domain', TG_OP, NEW.name, NULL, audit_domain_json(NEW));
+  ELSIF TG_OP = 'UPDATE' THEN
+    PERFORM audit_log('domain', TG_OP, NEW.name,
+            audit_domain_json(OLD), audit_domain_json(NEW));
+  ELSE
+    PERFORM audit_log('domain', TG_OP, OLD.name, audit_domain_json(OLD), NULL);
+    RETURN OLD;
+  END IF;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_domain_insert AFTER INSERT ON domain
+  FOR EACH ROW EXECUTE FUNCTION audit_domain();
+CREATE TRIGGER audit_domain_update AFTER UPDATE ON domain
+  FOR EACH ROW WHEN (OLD.* IS DISTINCT FROM NEW.*) EXECUTE FUNCTION audit_domain();
+CREATE TRIGGER audit_domain_delete BEFORE DELETE ON domain
+  FOR EACH ROW EXECUTE FUNCTION audit_domain();
+
+CREATE OR REPLACE FUNCTION audit_address_json(a address) RETURNS JSON AS $$
+  SELECT json_build_object('localpart', a.localpart,
+                           'domain', (SELECT name FROM domain WHERE id = a.domain),
+                           'transport', (SELECT name FROM transport WHERE id = a.transport),
+                           'access', (SELECT name FROM access WHERE id = a.access));
+$$ LANGUAGE sql;
+
+CREATE OR REPLACE FUNCTION audit_address() RETURNS trigger AS $$
+BEGIN
+  IF TG_OP = 'INSERT' THEN
+    PERFORM audit_log('address', TG_OP,
+            (SELECT name FROM address_name WHERE id = NEW.id),
+            NULL, audit_address_json(NEW));
+  ELSIF TG_OP = 'UPDATE' THEN
+    PERFORM audit_log('address', TG_OP,
+            (SELECT name FROM address_name WHERE id = NEW.id),
+            audit_address_json(OLD), audit_address_json(NEW));
+  ELSE
+    PERFORM audit_log('address', TG_OP,
+            (SELECT name FROM address_name WHERE id = OLD.id),
+            audit_address_json(OLD), NULL);
+    RETURN OLD;
+  END IF;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_address_insert AFTER INSERT ON address
+  FOR EACH ROW EXECUTE FUNCTION audit_address();
+CREATE TRIGGER audit_address_update AFTER UPDATE ON address
+  FOR EACH ROW WHEN (OLD.* IS DISTINCT FROM NEW.*) EXECUTE FUNCTION audit_address();
+CREATE TRIGGER audit_address_delete BEFORE DELETE ON address
+  FOR EACH ROW EXECUTE FUNCTION audit_address();
+
+CREATE OR REPLACE FUNCTION audit_alias_json(al alias) RETURNS JSON AS $$
+  SELECT json_build_object('address', (SELECT name FROM address_name WHERE id = al.address),
+                           'target', (SELECT name FROM address_name WHERE id = al.target),
+                           'extension', al.extension);
+$$ LANGUAGE sql;
+
+CREATE OR REPLACE FUNCTION audit_alias() RETURNS trigger AS $$
+BEGIN
+  IF TG_OP = 'INSERT' THEN
+    PERFORM audit_log('alias', TG_OP,
+            (SELECT name FROM address_name WHERE id = NEW.address),
+            NULL, audit_alias_json(NEW));
+  ELSIF TG_OP = 'UPDATE' THEN
+    PERFORM audit_log('alias', TG_OP,
+            (SELECT name FROM address_name WHERE id = NEW.address),
+            audit_alias_json(OLD), audit_alias_json(NEW));
+  ELSE
+    PERFORM audit_log('alias', TG_OP,
+            (SELECT name FROM address_name WHERE id = OLD.address),
+            audit_alias_json(OLD), NULL);
+    RETURN OLD;
+  END IF;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_alias_insert AFTER INSERT ON alias
+  FOR EACH ROW EXECUTE FUNCTION audit_alias();
+CREATE TRIGGER audit_alias_update AFTER UPDATE ON alias
+  FOR EACH ROW WHEN (OLD.* IS DISTINCT FROM NEW.*) EXECUTE FUNCTION audit_alias();
+CREATE TRIGGER audit_alias_delete BEFORE DELETE ON alias
+  FOR EACH ROW EXECUTE FUNCTION audit_alias();
+
+-- The password is only ever true/false for there or not, the same
+-- 1 or 0 sqlite's json_object gives, or "changed".
+CREATE OR REPLACE FUNCTION audit_vmailbox_json(mb vmailbox, pw JSON) RETURNS JSON AS $$
+  SELECT json_build_object('pw_type', mb.pw_type, 'password', pw,
+                           'uid', mb.uid, 'gid', mb.gid, 'home', mb.home,
+                           'quota', mb.quota, 'enable', mb.enable,
+                           'allow_imap', mb.allow_imap, 'allow_pop3', mb.allow_pop3,
+                           'allow_lmtp', mb.allow_lmtp, 'allow_submission', mb.allow_submission,
+                           'allow_sieve', mb.allow_sieve,
+                           'pw_set', mb.pw_set, 'pw_max_age', mb.pw_max_age);
+$$ LANGUAGE sql;
+
+CREATE OR REPLACE FUNCTION audit_vmailbox() RETURNS trigger AS $$
+BEGIN
+  IF TG_OP = 'INSERT' THEN
+    PERFORM audit_log('mailbox', TG_OP,
+            (SELECT name FROM address_name WHERE id = NEW.id), NULL,
+            audit_vmailbox_json(NEW, to_json((NEW.password IS NOT NULL)::int)));
+  ELSIF TG_OP = 'UPDATE' THEN
+    PERFORM audit_log('mailbox', TG_OP,
+            (SELECT name FROM address_name WHERE id = NEW.id),
+            audit_vmailbox_json(OLD, to_json((OLD.password IS NOT NULL)::int)),
+            audit_vmailbox_json(NEW,
+              CASE WHEN OLD.password IS DISTINCT FROM NEW.password
+                   THEN to_json('changed'::text)
+                   ELSE to_json((NEW.password IS NOT NULL)::int) END));
+  ELSE
+    PERFORM audit_log('mailbox', TG_OP,
+            (SELECT name FROM address_name WHERE id = OLD.id),
+            audit_vmailbox_json(OLD, to_json((OLD.password IS NOT NULL)::int)), NULL);
+    RETURN OLD;
+  END IF;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_vmailbox_insert AFTER INSERT ON vmailbox
+  FOR EACH ROW EXECUTE FUNCTION audit_vmailbox();
+CREATE TRIGGER audit_vmailbox_update AFTER UPDATE ON vmailbox
+  FOR EACH ROW WHEN (OLD.* IS DISTINCT FROM NEW.*) EXECUTE FUNCTION audit_vmailbox();
+CREATE TRIGGER audit_vmailbox_delete BEFORE DELETE ON vmailbox
+  FOR EACH ROW EXECUTE FUNCTION audit_vmailbox();
+
+-- The credential key is its mailbox so the log of a mailbox has them too.
+CREATE OR REPLACE FUNCTION audit_credential_json(c credential, pw JSON) RETURNS JSON AS $$
+  SELECT json_build_object('label', c.label, 'pw_type', c.pw_type, 'password', pw,
+                           'expires', c.expires,
+                           'allow_imap', c.allow_imap, 'allow_pop3', c.allow_pop3,
+                           'allow_submission', c.allow_submission,
+                           'allow_sieve', c.allow_sieve);
+$$ LANGUAGE sql;
+
+CREATE OR REPLACE FUNCTION audit_credential() RETURNS trigger AS $$
+BEGIN
+  IF TG_OP = 'INSERT' THEN
+    PERFORM audit_log('credential', TG_OP,
+            (SELECT name FROM address_name WHERE id = NEW.mailbox), NULL,
+            audit_credential_json(NEW, to_json(1)));
+  ELSIF TG_OP = 'UPDATE' THEN
+    PERFORM audit_log('credential', TG_OP,
+            (SELECT name FROM address_name WHERE id = NEW.mailbox),
+            audit_credential_json(OLD, to_json(1)),
+            audit_credential_json(NEW,
+              CASE WHEN OLD.password IS DISTINCT FROM NEW.password
+                   THEN to_json('changed'::text) ELSE to_json(1) END));
+  ELSE
+    PERFORM audit_log('credential', TG_OP,
+            (SELECT name FROM address_name WHERE id = OLD.mailbox),
+            audit_credential_json(OLD, to_json(1)), NULL);
+    RETURN OLD;
+  END IF;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+-- last_used is bookkeeping, not a change
+CREATE TRIGGER audit_credential_insert AFTER INSERT ON credential
+  FOR EACH ROW EXECUTE FUNCTION audit_credential();
+CREATE TRIGGER audit_credential_update AFTER UPDATE ON credential
+  FOR EACH ROW WHEN ((OLD.label, OLD.pw_type, OLD.password, OLD.expires, OLD.allow_imap,
+                      OLD.allow_pop3, OLD.allow_submission, OLD.allow_sieve)
+                     IS DISTINCT FROM
+                     (NEW.label, NEW.pw_type, NEW.password, NEW.expires, NEW.allow_imap,
+                      NEW.allow_pop3, NEW.allow_submission, NEW.allow_sieve))
+  EXECUTE FUNCTION audit_credential();
+CREATE TRIGGER audit_credential_delete BEFORE DELETE ON credential
+  FOR EACH ROW EXECUTE FUNCTION audit_credential();
+
+-- The sieve key is its mailbox like credential. The script itself is
+-- not recorded, only that it changed.
+CREATE OR REPLACE FUNCTION audit_sieve_json(s sievescript) RETURNS JSON AS $$
+  SELECT json_build_object('name', s.name, 'active', s.active, 'version', s.version);
+$$ LANGUAGE sql;
+
+CREATE OR REPLACE FUNCTION audit_sieve() RETURNS trigger AS $$
+BEGIN
+  IF TG_OP = 'INSERT' THEN
+    PERFORM audit_log('sieve', TG_OP,
+            (SELECT name FROM address_name WHERE id = NEW.mailbox), NULL,
+            audit_sieve_json(NEW));
+  ELSIF TG_OP = 'UPDATE' THEN
+    PERFORM audit_log('sieve', TG_OP,
+            (SELECT name FROM address_name WHERE id = NEW.mailbox),
+            audit_sieve_json(OLD), audit_sieve_json(NEW));
+  ELSE
+    PERFORM audit_log('sieve', TG_OP,
+            (SELECT name FROM address_name WHERE id = OLD.mailbox),
+            audit_sieve_json(OLD), NULL);
+    RETURN OLD;
+  END IF;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_sieve_insert AFTER INSERT ON sievescript
+  FOR EACH ROW EXECUTE FUNCTION audit_sieve();
+CREATE TRIGGER audit_sieve_update AFTER UPDATE ON sievescript
+  FOR EACH ROW WHEN ((OLD.name, OLD.script, OLD.active)
+                     IS DISTINCT FROM (NEW.name, NEW.script, NEW.active))
+  EXECUTE FUNCTION audit_sieve();
+CREATE TRIGGER audit_sieve_delete BEFORE DELETE ON sievescript
+  FOR EACH ROW EXECUTE FUNCTION audit_sieve();
+
+-- The vacation key is its mailbox. The message is not recorded.
+CREATE OR REPLACE FUNCTION audit_vacation_json(v vacation) RETURNS JSON AS $$
+  SELECT json_build_object('subject', v.subject, 'start_date', v.start_date,
+                           'end_date', v.end_date, 'days', v.days,
+                           'addresses', v.addresses);
+$$ LANGUAGE sql;
+
+CREATE OR REPLACE FUNCTION audit_vacation() RETURNS trigger AS $$
+BEGIN
+  IF TG_OP = 'INSERT' THEN
+    PERFORM audit_log('vacation', TG_OP,
+            (SELECT name FROM address_name WHERE id = NEW.mailbox), NULL,
+            audit_vacation_json(NEW));
+  ELSIF TG_OP = 'UPDATE' THEN
+    PERFORM audit_log('vacation', TG_OP,
+            (SELECT name FROM address_name WHERE id = NEW.mailbox),
+            audit_vacation_json(OLD), audit_vacation_json(NEW));
+  ELSE
+    PERFORM audit_log('vacation', TG_OP,
+            (SELECT name FROM address_name WHERE id = OLD.mailbox),
+            audit_vacation_json(OLD), NULL);
+    RETURN OLD;
+  END IF;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_vacation_insert AFTER INSERT ON vacation
+  FOR EACH ROW EXECUTE FUNCTION audit_vacation();
+CREATE TRIGGER audit_vacation_update AFTER UPDATE ON vacation
+  FOR EACH ROW WHEN ((OLD.subject, OLD.body, OLD.start_date, OLD.end_date,
+                      OLD.days, OLD.addresses)
+                     IS DISTINCT FROM
+                     (NEW.subject, NEW.body, NEW.start_date, NEW.end_date,
+                      NEW.days, NEW.addresses))
+  EXECUTE FUNCTION audit_vacation();
+CREATE TRIGGER audit_vacation_delete BEFORE DELETE ON vacation
+  FOR EACH ROW EXECUTE FUNCTION audit_vacation();
+
+-- The forward key is its mailbox. Its targets are logged one by one.
+CREATE OR REPLACE FUNCTION audit_forward() RETURNS trigger AS $$
+BEGIN
+  IF TG_OP = 'INSERT' THEN
+    PERFORM audit_log('forward', TG_OP,
+            (SELECT name FROM address_name WHERE id = NEW.mailbox), NULL,
+            json_build_object('keep_copy', NEW.keep_copy));
+  ELSIF TG_OP = 'UPDATE' THEN
+    PERFORM audit_log('forward', TG_OP,
+            (SELECT name FROM address_name WHERE id = NEW.mailbox),
+            json_build_object('keep_copy', OLD.keep_copy),
+            json_build_object('keep_copy', NEW.keep_copy));
+  ELSE
+    PERFORM audit_log('forward', TG_OP,
+            (SELECT name FROM address_name WHERE id = OLD.mailbox),
+            json_build_object('keep_copy', OLD.keep_copy), NULL);
+    RETURN OLD;
+  END IF;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_forward_insert AFTER INSERT ON forward
+  FOR EACH ROW EXECUTE FUNCTION audit_forward();
+CREATE TRIGGER audit_forward_update AFTER UPDATE ON forward
+  FOR EACH ROW WHEN (OLD.keep_copy IS DISTINCT FROM NEW.keep_copy)
+  EXECUTE FUNCTION audit_forward();
+CREATE TRIGGER audit_forward_delete BEFORE DELETE ON forward
+  FOR EACH ROW EXECUTE FUNCTION audit_forward();
+
+CREATE OR REPLACE FUNCTION audit_forward_target() RETURNS trigger AS $$
+BEGIN
+  IF TG_OP = 'INSERT' THEN
+    PERFORM audit_log('forward', TG_OP,
+            (SELECT name FROM address_name WHERE id = NEW.forward), NULL,
+            json_build_object('target', NEW.target));
+  ELSE
+    PERFORM audit_log('forward', TG_OP,
+            (SELECT name FROM address_name WHERE id = OLD.forward),
+            json_build_object('target', OLD.target), NULL);
+    RETURN OLD;
+  END IF;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_forward_target_insert AFTER INSERT ON forwardtarget
+  FOR EACH ROW EXECUTE FUNCTION audit_forward_target();
+CREATE TRIGGER audit_forward_target_delete BEFORE DELETE ON forwardtarget
+  FOR EACH ROW EXECUTE FUNCTION audit_forward_target();
+
+-- The alias domain key is its name. The target is logged by name.
+CREATE OR REPLACE FUNCTION audit_alias_domain() RETURNS trigger AS $$
+BEGIN
+  IF TG_OP = 'INSERT' THEN
+    PERFORM audit_log('aliasdomain', TG_OP,
+            (SELECT name FROM domain WHERE id = NEW.domain), NULL,
+            json_build_object('target', (SELECT name FROM domain WHERE id = NEW.target)));
+  ELSIF TG_OP = 'UPDATE' THEN
+    PERFORM audit_log('aliasdomain', TG_OP,
+            (SELECT name FROM domain WHERE id = NEW.domain),
+            json_build_object('target', (SELECT name FROM domain WHERE id = OLD.target)),
+            json_build_object('target', (SELECT name FROM domain WHERE id = NEW.target)));
+  ELSE
+    PERFORM audit_log('aliasdomain', TG_OP,
+            (SELECT name FROM domain WHERE id = OLD.domain),
+            json_build_object('target', (SELECT name FROM domain WHERE id = OLD.target)), NULL);
+    RETURN OLD;
+  END IF;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_alias_domain_insert AFTER INSERT ON aliasdomain
+  FOR EACH ROW EXECUTE FUNCTION audit_alias_domain();
+CREATE TRIGGER audit_alias_domain_update AFTER UPDATE ON aliasdomain
+  FOR EACH ROW WHEN (OLD.target IS DISTINCT FROM NEW.target)
+  EXECUTE FUNCTION audit_alias_domain();
+CREATE TRIGGER audit_alias_domain_delete BEFORE DELETE ON aliasdomain
+  FOR EACH ROW EXECUTE FUNCTION audit_alias_domain();
+
+COMMIT;
@@ -12,6 +12,20 @@
 -- remove active in most places. an inactive is simply removed...
 PRAGMA foreign_keys=ON;
 BEGIN TRANSACTION;
+--
+-- schema_version table
+-- One row per schema revision applied. The highest version is the
+-- current schema. It must match DbSchemaVersion in maildb/migrate.go
+-- and the last script in files/migrations.
+DROP TABLE IF EXISTS "schema_version";
+CREATE TABLE "schema_version" (
+       version INTEGER PRIMARY KEY,
+       applied TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+       description TEXT
+       );
+INSERT INTO "schema_version" (version, description)
+       VALUES (15, 'initial schema');
+
 --
 -- Access table
 -- Table rows match smtpd_restriction_classes list actually implemented
@@ -46,6 +60,10 @@ CREATE TABLE "Domain" (
        access INTEGER,
        vuid INTEGER,		-- virtual UID for dovecot general mboxes
        vgid INTEGER,		-- virtual GID
+       pw_max_age INTEGER,	-- password policy for its mailboxes, NULL is none
+       pw_min_length INTEGER,	-- days, characters, and character classes
+       pw_min_classes INTEGER,
+       quota TEXT,		-- default quota rule of its mailboxes, NULL is none
        CONSTRAINT dom_trans FOREIGN KEY(transport) REFERENCES Transport(id),
        CONSTRAINT dom_access FOREIGN KEY(access) REFERENCES Access(id)
        );
@@ -134,12 +152,15 @@ CREATE TRIGGER addr_update_null_check BEFORE UPDATE ON Address
      END;  END;
 
 -- create a trigger to delete the domain when addr refs are 0 meaning this is the only
--- one pointing to it and domain.class != vmailbox
+-- one pointing to it and domain.class != vmailbox. Alias domains and their targets
+-- stay because they are still in use by AliasDomain
 DROP TRIGGER  IF EXISTS after_addr_del;
 CREATE TRIGGER after_addr_del AFTER DELETE ON address
  WHEN OLD.domain IS NOT NULL
     AND (SELECT class FROM domain WHERE id = OLD.domain) != 4
     AND (SELECT count(*) FROM address WHERE domain = OLD.domain) < 1
+    AND (SELECT count(*) FROM AliasDomain
+         WHERE domain = OLD.domain OR target = OLD.domain) < 1
  BEGIN
   DELETE FROM domain WHERE id = OLD.domain; END;
 
@@ -232,26 +253,6 @@ CREATE VIEW "etc_aliases" AS
   FROM alias AS al, address AS aa
   WHERE al.address IS aa.id AND aa.domain IS NULL;
 
--- virt_alias models the virtuals file where a line is
---   alias    recipient
---
-DROP VIEW IF EXISTS "virt_alias";
-CREATE VIEW "virt_alias" AS
-       SELECT aa.localpart AS mailbox, ad.name AS domain_name,
-	      ta.localpart ||
-	      (CASE WHEN va.extension IS NOT NULL
-	      	    THEN '+' || va.extension
-		    ELSE ''
-	      END) ||
-	      (SELECT CASE WHEN ta.domain IS NULL
-		    THEN ''
-		    ELSE '@' || (SELECT name FROM domain WHERE id IS ta.domain)
-	      END) AS recipient
-	FROM Alias AS va
-	JOIN address AS aa ON (va.address = aa.id)
-	JOIN domain AS ad ON (aa.domain = ad.id)
-	JOIN address AS ta ON (va.target = ta.id);
-
 -- vmailbox, dovecot user database
 DROP TABLE IF EXISTS "VMailbox";
 CREATE TABLE "VMailbox" (
@@ -261,8 +262,15 @@ CREATE TABLE "VMailbox" (
        uid INTEGER, -- if these are NULL, use domain values
        gid INTEGER,
        home TEXT,  -- just home part for dovecot config of mail_home
-       quota TEXT DEFAULT '*:bytes=300M', -- in Dovecot form. NULL is no quota
-       enable INTEGER NOT NULL DEFAULT 1, -- bool to disable imap+lmtp
+       quota TEXT DEFAULT '*:bytes=300M', -- in Dovecot form. NULL is the domain's
+       enable INTEGER NOT NULL DEFAULT 1, -- bool to disable all services
+       allow_imap INTEGER NOT NULL DEFAULT 1, -- bools for each service
+       allow_pop3 INTEGER NOT NULL DEFAULT 1,
+       allow_lmtp INTEGER NOT NULL DEFAULT 1, -- delivery
+       allow_submission INTEGER NOT NULL DEFAULT 1, -- and SMTP AUTH
+       allow_sieve INTEGER NOT NULL DEFAULT 1, -- ManageSieve
+       pw_set TEXT, -- when the password was set, UTC like the audit stamp
+       pw_max_age INTEGER, -- days. NULL is the domain's, 0 never expires
        CONSTRAINT vmbox_addr FOREIGN KEY(id) REFERENCES Address(id));
 
 -- An address can either be an alias or a mailbox but not both. Just imagine
@@ -303,6 +311,11 @@ CREATE TRIGGER after_del_mbox AFTER DELETE ON vmailbox
 -- home_dir in dovecot's config.
 -- This view brings together all this together. It is used as the base for
 -- the specializes views and dovecot queries
+-- A password expires pw_max_age days after it was set, the mailbox's
+-- own max age or its domain's. pw_expired makes the deny views deny it
+-- like a disabled mailbox.
+-- The quota rule is the mailbox's own or its domain's default. If neither
+-- has one it is *:storage=0, no limit, which is the "none" postdove shows.
 DROP VIEW IF EXISTS "user_mailbox";
 CREATE VIEW "user_mailbox" AS
        SELECT mb.id AS id, a.localpart AS username, d.name AS domain,
@@ -314,19 +327,846 @@ CREATE VIEW "user_mailbox" AS
 	             COALESCE(d.vgid,
 		              (SELECT vgid FROM domain WHERE name = 'localhost'))) AS gid,
 	      COALESCE(mb.home, '') AS home,
-	      COALESCE(mb.quota, '*:bytes=0') AS quota_rule,
-       	      mb.enable AS enable
+	      COALESCE(mb.quota, d.quota, '*:storage=0') AS quota_rule,
+       	      mb.enable AS enable,
+	      mb.allow_imap AS allow_imap, mb.allow_pop3 AS allow_pop3,
+	      mb.allow_lmtp AS allow_lmtp, mb.allow_submission AS allow_submission,
+	      mb.allow_sieve AS allow_sieve,
+	      CASE WHEN mb.password IS NOT NULL AND mb.pw_set IS NOT NULL
+	                AND COALESCE(mb.pw_max_age, d.pw_max_age, 0) > 0
+	           THEN datetime(mb.pw_set, '+' || COALESCE(mb.pw_max_age, d.pw_max_age) || ' days')
+	      END AS pw_expires,
+	      CASE WHEN mb.password IS NOT NULL AND mb.pw_set IS NOT NULL
+	                AND COALESCE(mb.pw_max_age, d.pw_max_age, 0) > 0
+	                AND datetime(mb.pw_set, '+' || COALESCE(mb.pw_max_age, d.pw_max_age) || ' days')
+	                    <= datetime('now')
+	           THEN 1 ELSE 0
+	      END AS pw_expired
        FROM VMailbox AS mb
        	      JOIN address AS a ON (a.id = mb.id)
 	      JOIN domain AS d ON (a.domain = d.id);
 
 -- user_deny
--- This query looks for denied (locked out) users
+-- This query looks for denied (locked out) users, disabled or with an
+-- expired password
 DROP VIEW IF EXISTS "user_deny";
 CREATE VIEW "user_deny" AS
      SELECT username, domain, 'true' AS deny
-     FROM user_mailbox WHERE enable = 0;
+     FROM user_mailbox WHERE enable = 0 OR pw_expired = 1;
+
+-- Per service deny views
+-- A user is denied a service if the mailbox is disabled, its password
+-- has expired, or the service is denied. An expired password doesn't
+-- stop lmtp delivery. service_deny has them all with
+-- dovecot's name for the service, %s in a query, so one passdb can do
+-- them all. Submission covers both the submission service and postfix's
+-- SMTP AUTH which dovecot calls smtp. ManageSieve is sieve.
+DROP VIEW IF EXISTS "imap_deny";
+CREATE VIEW "imap_deny" AS
+     SELECT username, domain, 'true' AS deny
+     FROM user_mailbox WHERE enable = 0 OR pw_expired = 1 OR allow_imap = 0;
+
+DROP VIEW IF EXISTS "pop3_deny";
+CREATE VIEW "pop3_deny" AS
+     SELECT username, domain, 'true' AS deny
+     FROM user_mailbox WHERE enable = 0 OR pw_expired = 1 OR allow_pop3 = 0;
+
+DROP VIEW IF EXISTS "lmtp_deny";
+CREATE VIEW "lmtp_deny" AS
+     SELECT username, domain, 'true' AS deny
+     FROM user_mailbox WHERE enable = 0 OR allow_lmtp = 0;
+
+DROP VIEW IF EXISTS "submission_deny";
+CREATE VIEW "submission_deny" AS
+     SELECT username, domain, 'true' AS deny
+     FROM user_mailbox WHERE enable = 0 OR pw_expired = 1 OR allow_submission = 0;
+
+DROP VIEW IF EXISTS "sieve_deny";
+CREATE VIEW "sieve_deny" AS
+     SELECT username, domain, 'true' AS deny
+     FROM user_mailbox WHERE enable = 0 OR pw_expired = 1 OR allow_sieve = 0;
+
+DROP VIEW IF EXISTS "service_deny";
+CREATE VIEW "service_deny" AS
+     SELECT username, domain, 'imap' AS service, deny FROM imap_deny
+     UNION ALL
+     SELECT username, domain, 'pop3' AS service, deny FROM pop3_deny
+     UNION ALL
+     SELECT username, domain, 'lmtp' AS service, deny FROM lmtp_deny
+     UNION ALL
+     SELECT username, domain, 'submission' AS service, deny FROM submission_deny
+     UNION ALL
+     SELECT username, domain, 'smtp' AS service, deny FROM submission_deny
+     UNION ALL
+     SELECT username, domain, 'sieve' AS service, deny FROM sieve_deny;
+
+-- BannedPassword
+-- Passwords that cannot be used for a mailbox no matter what the
+-- domain's policy is, such as the common ones from a breach list. They
+-- are lower case and matched without regard to case.
+DROP TABLE IF EXISTS "BannedPassword";
+CREATE TABLE "BannedPassword" (
+       password TEXT PRIMARY KEY);
+
+-- Credential
+-- Extra passwords for a mailbox, e.g. one each for a phone, a desktop
+-- client, and scripts, so each can be revoked on its own. A credential can
+-- expire and can be limited to some of the services. There is no lmtp
+-- because delivery doesn't log in. The times are UTC in the same form as
+-- the audit stamp. last_used is set by postdove when it verifies a
+-- password. dovecot's logins are in CredentialLogin.
+DROP TABLE IF EXISTS "Credential";
+CREATE TABLE "Credential" (
+       id INTEGER PRIMARY KEY,
+       mailbox INTEGER NOT NULL,
+       label TEXT NOT NULL,
+       pw_type TEXT NOT NULL DEFAULT 'SHA512-CRYPT',
+       password TEXT NOT NULL,
+       created TEXT NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%S', 'now')),
+       last_used TEXT,
+       expires TEXT, -- NULL never expires
+       allow_imap INTEGER NOT NULL DEFAULT 1,
+       allow_pop3 INTEGER NOT NULL DEFAULT 1,
+       allow_submission INTEGER NOT NULL DEFAULT 1, -- and SMTP AUTH
+       allow_sieve INTEGER NOT NULL DEFAULT 1, -- ManageSieve
+       CONSTRAINT cred_mbox FOREIGN KEY(mailbox) REFERENCES VMailbox(id) ON DELETE CASCADE,
+       UNIQUE (mailbox, label));
+
+-- credential_service
+-- A row for each dovecot service, %s, each credential can be used for.
+-- Like service_deny, submission covers the smtp service too.
+DROP VIEW IF EXISTS "credential_service";
+CREATE VIEW "credential_service" AS
+     SELECT id, 'imap' AS service FROM credential WHERE allow_imap = 1
+     UNION ALL
+     SELECT id, 'pop3' AS service FROM credential WHERE allow_pop3 = 1
+     UNION ALL
+     SELECT id, 'submission' AS service FROM credential WHERE allow_submission = 1
+     UNION ALL
+     SELECT id, 'smtp' AS service FROM credential WHERE allow_submission = 1
+     UNION ALL
+     SELECT id, 'sieve' AS service FROM credential WHERE allow_sieve = 1;
+
+-- user_credential
+-- The unexpired credentials of a mailbox for a service in the form of a
+-- user_mailbox password_query. A dovecot sql passdb can only check one
+-- password per lookup so the credentials are numbered by slot from 1
+-- for each mailbox and service. Each passdb after the user_mailbox one
+-- looks up its slot and dovecot goes on to the next when one fails.
+-- credential is the id for the last_login key, see CredentialLogin.
+DROP VIEW IF EXISTS "user_credential";
+CREATE VIEW "user_credential" AS
+       SELECT um.username AS username, um.domain AS domain,
+	      c.label AS label, cs.service AS service,
+	      ROW_NUMBER() OVER (PARTITION BY c.mailbox, cs.service ORDER BY c.id) AS slot,
+	      '{' || c.pw_type || '}' || c.password AS password,
+	      um.uid AS uid, um.gid AS gid, um.home AS home,
+	      um.quota_rule AS quota_rule, c.id AS credential
+       FROM credential_service AS cs
+	      JOIN credential AS c ON (c.id = cs.id)
+	      JOIN user_mailbox AS um ON (um.id = c.mailbox)
+       WHERE c.expires IS NULL
+	      OR c.expires > strftime('%Y-%m-%d %H:%M:%S', 'now');
      
+-- QuotaUsage
+-- What each mailbox is using as kept by dovecot's quota dict. The
+-- layout is the one dovecot's dict sql driver expects for the
+-- priv/quota/storage and priv/quota/messages keys so dovecot writes
+-- it and we only read it. username is the full user@domain, %u.
+-- Changes are not audited because every delivery makes one.
+DROP TABLE IF EXISTS "QuotaUsage";
+CREATE TABLE "QuotaUsage" (
+       username TEXT PRIMARY KEY,
+       bytes INTEGER NOT NULL DEFAULT 0,
+       messages INTEGER NOT NULL DEFAULT 0);
+
+-- Clean up the usage of a deleted mailbox. This has to be done before
+-- after_del_mbox deletes the address we need for the name.
+DROP TRIGGER IF EXISTS del_mbox_quota;
+CREATE TRIGGER del_mbox_quota BEFORE DELETE ON vmailbox
+  BEGIN
+    DELETE FROM QuotaUsage
+     WHERE username = (SELECT a.localpart || '@' || d.name
+     	   	       FROM address AS a JOIN domain AS d ON (a.domain = d.id)
+		       WHERE a.id = OLD.id); END;
+
+-- user_quota
+-- The usage of each mailbox along with its quota rule. A mailbox that
+-- dovecot has not counted yet has no QuotaUsage row and uses nothing.
+-- The no limit rule is NULL here so it reads as "none".
+DROP VIEW IF EXISTS "user_quota";
+CREATE VIEW "user_quota" AS
+       SELECT um.id AS id, um.username AS username, um.domain AS domain,
+	      NULLIF(um.quota_rule, '*:storage=0') AS quota_rule,
+	      COALESCE(q.bytes, 0) AS bytes, COALESCE(q.messages, 0) AS messages
+       FROM user_mailbox AS um
+	      LEFT JOIN QuotaUsage AS q ON (q.username = um.username || '@' || um.domain);
+
+-- CredentialLogin
+-- When each credential last logged in to dovecot, kept by dovecot's
+-- last_login plugin through a dict. The credential passdb sets the
+-- plugin's key to the credential's id so the key is the id as text and
+-- last_login is the unix time. dovecot writes it and we only read it.
+-- Changes are not audited because every login makes one.
+DROP TABLE IF EXISTS "CredentialLogin";
+CREATE TABLE "CredentialLogin" (
+       credential TEXT PRIMARY KEY,
+       last_login INTEGER NOT NULL DEFAULT 0);
+
+-- Clean up the logins of a deleted credential
+DROP TRIGGER IF EXISTS del_cred_login;
+CREATE TRIGGER del_cred_login AFTER DELETE ON credential
+  BEGIN
+    DELETE FROM CredentialLogin WHERE credential = CAST(OLD.id AS TEXT); END;
+
+-- SieveScript
+-- The Sieve filters of each mailbox, kept here rather than as files under
+-- its home. A mailbox can have any number of named scripts but only the
+-- active one is run by LMTP delivery. version counts the edits of the
+-- script so the id dovecot sees changes with it and it knows to compile
+-- it again. The scripts are checked by postdove before they get here.
+DROP INDEX IF EXISTS sieve_active;
+DROP TABLE IF EXISTS "SieveScript";
+CREATE TABLE "SieveScript" (
+       id INTEGER PRIMARY KEY,
+       mailbox INTEGER NOT NULL,
+       name TEXT NOT NULL,
+       script TEXT NOT NULL,
+       active INTEGER NOT NULL DEFAULT 0,
+       version INTEGER NOT NULL DEFAULT 1,
+       modified TEXT NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%S', 'now')),
+       CONSTRAINT sieve_mbox FOREIGN KEY(mailbox) REFERENCES VMailbox(id) ON DELETE CASCADE,
+       UNIQUE (mailbox, name));
+
+-- There is at most one active script per mailbox
+CREATE UNIQUE INDEX sieve_active ON SieveScript(mailbox) WHERE active = 1;
+
+-- user_sieve
+-- The scripts in the layout of Pigeonhole's dict storage. dovecot looks
+-- up priv/sieve/name/<script_name> for the id of a script and then
+-- priv/sieve/data/<id> for the script. The active script is there a
+-- second time named "active", the name that sieve = dict:...;name=active
+-- loads, which is why no script can be named that.
+DROP VIEW IF EXISTS "user_sieve";
+CREATE VIEW "user_sieve" AS
+       SELECT um.username || '@' || um.domain AS username, s.name AS script_name,
+	      s.id || '.' || s.version AS id, s.script AS script_data
+       FROM SieveScript AS s JOIN user_mailbox AS um ON (um.id = s.mailbox)
+       UNION ALL
+       SELECT um.username || '@' || um.domain AS username, 'active' AS script_name,
+	      s.id || '.' || s.version AS id, s.script AS script_data
+       FROM SieveScript AS s JOIN user_mailbox AS um ON (um.id = s.mailbox)
+       WHERE s.active = 1;
+
+-- Vacation
+-- The out of office reply of a mailbox. postdove makes the Sieve script
+-- named "vacation" from it and makes that the active script. The dates
+-- are YYYY-MM-DD in the server's time zone, NULL for no limit, and are
+-- tested in the script so the replies start and stop on their own. days
+-- is how often a sender is replied to. addresses are the comma separated
+-- other addresses of the mailbox. previous is the script that was active
+-- before, which the vacation script includes and which is made active
+-- again when the vacation is removed.
+DROP TABLE IF EXISTS "Vacation";
+CREATE TABLE "Vacation" (
+       mailbox INTEGER PRIMARY KEY,
+       subject TEXT,
+       body TEXT NOT NULL DEFAULT '',
+       start_date TEXT,
+       end_date TEXT,
+       days INTEGER NOT NULL DEFAULT 7,
+       addresses TEXT,
+       previous TEXT,
+       modified TEXT NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%S', 'now')),
+       CONSTRAINT vacation_mbox FOREIGN KEY(mailbox) REFERENCES VMailbox(id) ON DELETE CASCADE);
+
+-- Forward
+-- Mail to a mailbox sent on to other addresses, and to the mailbox as
+-- well if keep_copy. An address cannot be both a mailbox and an alias,
+-- so a forward is kept here and virt_alias makes the alias lines for it.
+-- When it keeps a copy the mailbox is one of its own recipients, which
+-- postfix delivers to rather than expanding again. The targets are text
+-- because they are usually someone else's addresses.
+DROP TABLE IF EXISTS "Forward";
+CREATE TABLE "Forward" (
+       mailbox INTEGER PRIMARY KEY,
+       keep_copy INTEGER NOT NULL DEFAULT 0,
+       CONSTRAINT forward_mbox FOREIGN KEY(mailbox) REFERENCES VMailbox(id) ON DELETE CASCADE);
+
+DROP TABLE IF EXISTS "ForwardTarget";
+CREATE TABLE "ForwardTarget" (
+       id INTEGER PRIMARY KEY,
+       forward INTEGER NOT NULL,
+       target TEXT NOT NULL,
+       CONSTRAINT forward_target FOREIGN KEY(forward) REFERENCES Forward(mailbox) ON DELETE CASCADE,
+       UNIQUE(forward, target));
+
+-- AliasDomain
+-- Every address of the target domain also works in the alias domain, e.g.
+-- user@example.net is user@example.com. The alias domain is a virtual
+-- domain so postfix takes mail for it. virt_alias maps only the target's
+-- mailboxes and aliases so nothing else is accepted, and an alias of the
+-- alias domain's own is used instead of the mapped one.
+DROP TABLE IF EXISTS "AliasDomain";
+CREATE TABLE "AliasDomain" (
+       domain INTEGER PRIMARY KEY,
+       target INTEGER NOT NULL,
+       CONSTRAINT alias_domain FOREIGN KEY(domain) REFERENCES Domain(id) ON DELETE CASCADE,
+       CONSTRAINT alias_domain_target FOREIGN KEY(target) REFERENCES Domain(id));
+
+-- virt_alias models the virtuals file where a line is
+--   alias    recipient
+-- The aliases, the forwards of mailboxes, and then the addresses of
+-- alias domains. address is the whole key postfix looks up, first
+-- user@domain and then the catch-all @domain, whose localpart is empty.
+-- Look up by mailbox and domain_name rather than address. They are
+-- pushed down to the indexes of each part of the union while address
+-- has to be computed for every row of the view.
+-- An alias domain has the catch-all of its target unless it has its own.
+-- The mailboxes of a domain with a catch-all are mapped to themselves so
+-- that postfix finds them before the catch-all, see VIRTUAL_README.
+DROP VIEW IF EXISTS "virt_alias";
+CREATE VIEW "virt_alias" AS
+ SELECT mailbox, domain_name, mailbox || '@' || domain_name AS address, recipient
+ FROM (
+       SELECT aa.localpart AS mailbox, ad.name AS domain_name,
+	      ta.localpart ||
+	      (CASE WHEN va.extension IS NOT NULL
+	      	    THEN '+' || va.extension
+		    ELSE ''
+	      END) ||
+	      (SELECT CASE WHEN ta.domain IS NULL
+		    THEN ''
+		    ELSE '@' || (SELECT name FROM domain WHERE id IS ta.domain)
+	      END) AS recipient
+	FROM Alias AS va
+	JOIN address AS aa ON (va.address = aa.id)
+	JOIN domain AS ad ON (aa.domain = ad.id)
+	JOIN address AS ta ON (va.target = ta.id)
+       UNION ALL
+       SELECT fa.localpart AS mailbox, fd.name AS domain_name, ft.target AS recipient
+	FROM ForwardTarget AS ft
+	JOIN address AS fa ON (ft.forward = fa.id)
+	JOIN domain AS fd ON (fa.domain = fd.id)
+       UNION ALL
+       SELECT fa.localpart AS mailbox, fd.name AS domain_name,
+	      fa.localpart || '@' || fd.name AS recipient
+	FROM Forward AS f
+	JOIN address AS fa ON (f.mailbox = fa.id)
+	JOIN domain AS fd ON (fa.domain = fd.id)
+	WHERE f.keep_copy = 1
+	  AND (SELECT count(*) FROM ForwardTarget WHERE forward = f.mailbox) > 0
+       UNION ALL
+       SELECT ta.localpart AS mailbox, ald.name AS domain_name,
+	      ta.localpart || '@' || td.name AS recipient
+	FROM AliasDomain AS dm
+	JOIN domain AS ald ON (dm.domain = ald.id)
+	JOIN domain AS td ON (dm.target = td.id)
+	JOIN address AS ta ON (ta.domain = td.id)
+	WHERE ta.localpart <> ''
+	  AND (ta.id IN (SELECT id FROM VMailbox) OR ta.id IN (SELECT address FROM Alias))
+	  AND NOT EXISTS (SELECT 1 FROM address AS oa JOIN Alias AS oal ON (oal.address = oa.id)
+	      	  	  WHERE oa.localpart = ta.localpart AND oa.domain = dm.domain)
+       UNION ALL
+       SELECT '' AS mailbox, ald.name AS domain_name,
+	      ta.localpart ||
+	      (CASE WHEN va.extension IS NOT NULL
+	      	    THEN '+' || va.extension
+		    ELSE ''
+	      END) ||
+	      (SELECT CASE WHEN ta.domain IS NULL
+		    THEN ''
+		    ELSE '@' || (SELECT name FROM domain WHERE id IS ta.domain)
+	      END) AS recipient
+	FROM AliasDomain AS dm
+	JOIN domain AS ald ON (dm.domain = ald.id)
+	JOIN address AS ca ON (ca.domain = dm.target AND ca.localpart = '')
+	JOIN Alias AS va ON (va.address = ca.id)
+	JOIN address AS ta ON (va.target = ta.id)
+	WHERE NOT EXISTS (SELECT 1 FROM address AS oa JOIN Alias AS oal ON (oal.address = oa.id)
+	      	  	  WHERE oa.localpart = '' AND oa.domain = dm.domain)
+       UNION ALL
+       SELECT ma.localpart AS mailbox, md.name AS domain_name,
+	      ma.localpart || '@' || md.name AS recipient
+	FROM VMailbox AS vm
+	JOIN address AS ma ON (vm.id = ma.id)
+	JOIN domain AS md ON (ma.domain = md.id)
+	WHERE EXISTS (SELECT 1 FROM address AS ca JOIN Alias AS cal ON (cal.address = ca.id)
+	      	      WHERE ca.localpart = '' AND ca.domain = ma.domain)
+	  AND NOT EXISTS (SELECT 1 FROM ForwardTarget WHERE forward = vm.id)
+ ) AS v;
+
+-- Audit trail
+-- Every change to the tables above is recorded by the triggers below.
+-- The maildb transaction code fills in audit_context with who did it and
+-- the command line at the start of each transaction so the triggers,
+-- including the ones fired by cascaded deletes, can record it. Changes made
+-- outside postdove, e.g. by the sqlite3 shell, have no context and are
+-- recorded with a NULL user and command. Passwords are never recorded.
+DROP TABLE IF EXISTS "audit_context";
+CREATE TABLE "audit_context" (
+       id INTEGER PRIMARY KEY CHECK (id = 1), -- there is only ever one row
+       user TEXT,
+       command TEXT
+       );
+
+DROP INDEX IF EXISTS audit_stamp;
+DROP TABLE IF EXISTS "Audit";
+CREATE TABLE "Audit" (
+       id INTEGER PRIMARY KEY,
+       stamp TEXT NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%S', 'now')), -- UTC
+       user TEXT,
+       command TEXT,
+       entity TEXT NOT NULL, -- what changed, e.g. domain or mailbox
+       op TEXT NOT NULL, -- INSERT|UPDATE|DELETE
+       key TEXT, -- the name of the row in postdove terms
+       before TEXT, -- JSON object of the row before the change
+       after TEXT -- JSON object of the row after the change
+       );
+
+CREATE INDEX audit_stamp ON audit(stamp);
+
+-- address_name
+-- The full name of an address, i.e. 'localpart' or 'localpart@domain'
+DROP VIEW IF EXISTS "address_name";
+CREATE VIEW "address_name" AS
+       SELECT a.id AS id,
+              a.localpart || COALESCE('@' || d.name, '') AS name
+       FROM address AS a LEFT JOIN domain AS d ON (a.domain = d.id);
+
+-- Deletes are recorded BEFORE the row goes so we can still resolve
+-- the names of what it references. The cascade triggers run after.
+DROP TRIGGER IF EXISTS audit_access_insert;
+CREATE TRIGGER audit_access_insert AFTER INSERT ON access
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'access', 'INSERT', NEW.name,
+           json_object('name', NEW.name, 'action', NEW.action)); END;
+
+DROP TRIGGER IF EXISTS audit_access_update;
+CREATE TRIGGER audit_access_update AFTER UPDATE ON access
+ WHEN OLD.name IS NOT NEW.name OR OLD.action IS NOT NEW.action
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'access', 'UPDATE', NEW.name,
+           json_object('name', OLD.name, 'action', OLD.action),
+           json_object('name', NEW.name, 'action', NEW.action)); END;
+
+DROP TRIGGER IF EXISTS audit_access_delete;
+CREATE TRIGGER audit_access_delete BEFORE DELETE ON access
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'access', 'DELETE', OLD.name,
+           json_object('name', OLD.name, 'action', OLD.action)); END;
+
+DROP TRIGGER IF EXISTS audit_transport_insert;
+CREATE TRIGGER audit_transport_insert AFTER INSERT ON transport
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'transport', 'INSERT', NEW.name,
+           json_object('name', NEW.name, 'transport', NEW.transport,
+                       'nexthop', NEW.nexthop)); END;
+
+DROP TRIGGER IF EXISTS audit_transport_update;
+CREATE TRIGGER audit_transport_update AFTER UPDATE ON transport
+ WHEN OLD.name IS NOT NEW.name OR OLD.transport IS NOT NEW.transport
+      OR OLD.nexthop IS NOT NEW.nexthop
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'transport', 'UPDATE', NEW.name,
+           json_object('name', OLD.name, 'transport', OLD.transport,
+                       'nexthop', OLD.nexthop),
+           json_object('name', NEW.name, 'transport', NEW.transport,
+                       'nexthop', NEW.nexthop)); END;
+
+DROP TRIGGER IF EXISTS audit_transport_delete;
+CREATE TRIGGER audit_transport_delete BEFORE DELETE ON transport
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'transport', 'DELETE', OLD.name,
+           json_object('name', OLD.name, 'transport', OLD.transport,
+                       'nexthop', OLD.nexthop)); END;
+
+DROP TRIGGER IF EXISTS audit_domain_insert;
+CREATE TRIGGER audit_domain_insert AFTER INSERT ON domain
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'domain', 'INSERT', NEW.name,
+           json_object('name', NEW.name, 'class', NEW.class,
+                       'transport', (SELECT name FROM transport WHERE id = NEW.transport),
+                       'access', (SELECT name FROM access WHERE id = NEW.access),
+                       'vuid', NEW.vuid, 'vgid', NEW.vgid,
+                       'pw_max_age', NEW.pw_max_age, 'pw_min_length', NEW.pw_min_length,
+                       'pw_min_classes', NEW.pw_min_classes, 'quota', NEW.quota)); END;
+
+DROP TRIGGER IF EXISTS audit_domain_update;
+CREATE TRIGGER audit_domain_update AFTER UPDATE ON domain
+ WHEN OLD.name IS NOT NEW.name OR OLD.class IS NOT NEW.class
+      OR OLD.transport IS NOT NEW.transport OR OLD.access IS NOT NEW.access
+      OR OLD.vuid IS NOT NEW.vuid OR OLD.vgid IS NOT NEW.vgid
+      OR OLD.pw_max_age IS NOT NEW.pw_max_age OR OLD.pw_min_length IS NOT NEW.pw_min_length
+      OR OLD.pw_min_classes IS NOT NEW.pw_min_classes OR OLD.quota IS NOT NEW.quota
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'domain', 'UPDATE', NEW.name,
+           json_object('name', OLD.name, 'class', OLD.class,
+                       'transport', (SELECT name FROM transport WHERE id = OLD.transport),
+                       'access', (SELECT name FROM access WHERE id = OLD.access),
+                       'vuid', OLD.vuid, 'vgid', OLD.vgid,
+                       'pw_max_age', OLD.pw_max_age, 'pw_min_length', OLD.pw_min_length,
+                       'pw_min_classes', OLD.pw_min_classes, 'quota', OLD.quota),
+           json_object('name', NEW.name, 'class', NEW.class,
+                       'transport', (SELECT name FROM transport WHERE id = NEW.transport),
+                       'access', (SELECT name FROM access WHERE id = NEW.access),
+                       'vuid', NEW.vuid, 'vgid', NEW.vgid,
+                       'pw_max_age', NEW.pw_max_age, 'pw_min_length', NEW.pw_min_length,
+                       'pw_min_classes', NEW.pw_min_classes, 'quota', NEW.quota)); END;
+
+DROP TRIGGER IF EXISTS audit_domain_delete;
+CREATE TRIGGER audit_domain_delete BEFORE DELETE ON domain
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'domain', 'DELETE', OLD.name,
+           json_object('name', OLD.name, 'class', OLD.class,
+                       'transport', (SELECT name FROM transport WHERE id = OLD.transport),
+                       'access', (SELECT name FROM access WHERE id = OLD.access),
+                       'vuid', OLD.vuid, 'vgid', OLD.vgid,
+                       'pw_max_age', OLD.pw_max_age, 'pw_min_length', OLD.pw_min_length,
+                       'pw_min_classes', OLD.pw_min_classes, 'quota', OLD.quota)); END;
+
+DROP TRIGGER IF EXISTS audit_address_insert;
+CREATE TRIGGER audit_address_insert AFTER INSERT ON address
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'address', 'INSERT', (SELECT name FROM address_name WHERE id = NEW.id),
+           json_object('localpart', NEW.localpart,
+                       'domain', (SELECT name FROM domain WHERE id = NEW.domain),
+                       'transport', (SELECT name FROM transport WHERE id = NEW.transport),
+                       'access', (SELECT name FROM access WHERE id = NEW.access))); END;
+
+DROP TRIGGER IF EXISTS audit_address_update;
+CREATE TRIGGER audit_address_update AFTER UPDATE ON address
+ WHEN OLD.localpart IS NOT NEW.localpart OR OLD.domain IS NOT NEW.domain
+      OR OLD.transport IS NOT NEW.transport OR OLD.access IS NOT NEW.access
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'address', 'UPDATE', (SELECT name FROM address_name WHERE id = NEW.id),
+           json_object('localpart', OLD.localpart,
+                       'domain', (SELECT name FROM domain WHERE id = OLD.domain),
+                       'transport', (SELECT name FROM transport WHERE id = OLD.transport),
+                       'access', (SELECT name FROM access WHERE id = OLD.access)),
+           json_object('localpart', NEW.localpart,
+                       'domain', (SELECT name FROM domain WHERE id = NEW.domain),
+                       'transport', (SELECT name FROM transport WHERE id = NEW.transport),
+                       'access', (SELECT name FROM access WHERE id = NEW.access))); END;
+
+DROP TRIGGER IF EXISTS audit_address_delete;
+CREATE TRIGGER audit_address_delete BEFORE DELETE ON address
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'address', 'DELETE', (SELECT name FROM address_name WHERE id = OLD.id),
+           json_object('localpart', OLD.localpart,
+                       'domain', (SELECT name FROM domain WHERE id = OLD.domain),
+                       'transport', (SELECT name FROM transport WHERE id = OLD.transport),
+                       'access', (SELECT name FROM access WHERE id = OLD.access))); END;
+
+DROP TRIGGER IF EXISTS audit_alias_insert;
+CREATE TRIGGER audit_alias_insert AFTER INSERT ON alias
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'alias', 'INSERT', (SELECT name FROM address_name WHERE id = NEW.address),
+           json_object('address', (SELECT name FROM address_name WHERE id = NEW.address),
+                       'target', (SELECT name FROM address_name WHERE id = NEW.target),
+                       'extension', NEW.extension)); END;
+
+DROP TRIGGER IF EXISTS audit_alias_update;
+CREATE TRIGGER audit_alias_update AFTER UPDATE ON alias
+ WHEN OLD.address IS NOT NEW.address OR OLD.target IS NOT NEW.target
+      OR OLD.extension IS NOT NEW.extension
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'alias', 'UPDATE', (SELECT name FROM address_name WHERE id = NEW.address),
+           json_object('address', (SELECT name FROM address_name WHERE id = OLD.address),
+                       'target', (SELECT name FROM address_name WHERE id = OLD.target),
+                       'extension', OLD.extension),
+           json_object('address', (SELECT name FROM address_name WHERE id = NEW.address),
+                       'target', (SELECT name FROM address_name WHERE id = NEW.target),
+                       'extension', NEW.extension)); END;
+
+DROP TRIGGER IF EXISTS audit_alias_delete;
+CREATE TRIGGER audit_alias_delete BEFORE DELETE ON alias
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'alias', 'DELETE', (SELECT name FROM address_name WHERE id = OLD.address),
+           json_object('address', (SELECT name FROM address_name WHERE id = OLD.address),
+                       'target', (SELECT name FROM address_name WHERE id = OLD.target),
+                       'extension', OLD.extension)); END;
+
+DROP TRIGGER IF EXISTS audit_vmailbox_insert;
+CREATE TRIGGER audit_vmailbox_insert AFTER INSERT ON vmailbox
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'mailbox', 'INSERT', (SELECT name FROM address_name WHERE id = NEW.id),
+           json_object('pw_type', NEW.pw_type, 'password', NEW.password IS NOT NULL,
+                       'uid', NEW.uid, 'gid', NEW.gid, 'home', NEW.home,
+                       'quota', NEW.quota, 'enable', NEW.enable,
+                       'allow_imap', NEW.allow_imap, 'allow_pop3', NEW.allow_pop3,
+                       'allow_lmtp', NEW.allow_lmtp, 'allow_submission', NEW.allow_submission,
+                       'allow_sieve', NEW.allow_sieve,
+                       'pw_set', NEW.pw_set, 'pw_max_age', NEW.pw_max_age)); END;
+
+DROP TRIGGER IF EXISTS audit_vmailbox_update;
+CREATE TRIGGER audit_vmailbox_update AFTER UPDATE ON vmailbox
+ WHEN OLD.pw_type IS NOT NEW.pw_type OR OLD.password IS NOT NEW.password
+      OR OLD.uid IS NOT NEW.uid OR OLD.gid IS NOT NEW.gid
+      OR OLD.home IS NOT NEW.home OR OLD.quota IS NOT NEW.quota
+      OR OLD.enable IS NOT NEW.enable
+      OR OLD.allow_imap IS NOT NEW.allow_imap OR OLD.allow_pop3 IS NOT NEW.allow_pop3
+      OR OLD.allow_lmtp IS NOT NEW.allow_lmtp OR OLD.allow_submission IS NOT NEW.allow_submission
+      OR OLD.allow_sieve IS NOT NEW.allow_sieve
+      OR OLD.pw_set IS NOT NEW.pw_set OR OLD.pw_max_age IS NOT NEW.pw_max_age
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'mailbox', 'UPDATE', (SELECT name FROM address_name WHERE id = NEW.id),
+           json_object('pw_type', OLD.pw_type, 'password', OLD.password IS NOT NULL,
+                       'uid', OLD.uid, 'gid', OLD.gid, 'home', OLD.home,
+                       'quota', OLD.quota, 'enable', OLD.enable,
+                       'allow_imap', OLD.allow_imap, 'allow_pop3', OLD.allow_pop3,
+                       'allow_lmtp', OLD.allow_lmtp, 'allow_submission', OLD.allow_submission,
+                       'allow_sieve', OLD.allow_sieve,
+                       'pw_set', OLD.pw_set, 'pw_max_age', OLD.pw_max_age),
+           json_object('pw_type', NEW.pw_type,
+                       'password', CASE WHEN OLD.password IS NOT NEW.password
+                                        THEN 'changed'
+                                        ELSE NEW.password IS NOT NULL END,
+                       'uid', NEW.uid, 'gid', NEW.gid, 'home', NEW.home,
+                       'quota', NEW.quota, 'enable', NEW.enable,
+                       'allow_imap', NEW.allow_imap, 'allow_pop3', NEW.allow_pop3,
+                       'allow_lmtp', NEW.allow_lmtp, 'allow_submission', NEW.allow_submission,
+                       'allow_sieve', NEW.allow_sieve,
+                       'pw_set', NEW.pw_set, 'pw_max_age', NEW.pw_max_age)); END;
+
+DROP TRIGGER IF EXISTS audit_vmailbox_delete;
+CREATE TRIGGER audit_vmailbox_delete BEFORE DELETE ON vmailbox
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'mailbox', 'DELETE', (SELECT name FROM address_name WHERE id = OLD.id),
+           json_object('pw_type', OLD.pw_type, 'password', OLD.password IS NOT NULL,
+                       'uid', OLD.uid, 'gid', OLD.gid, 'home', OLD.home,
+                       'quota', OLD.quota, 'enable', OLD.enable,
+                       'allow_imap', OLD.allow_imap, 'allow_pop3', OLD.allow_pop3,
+                       'allow_lmtp', OLD.allow_lmtp, 'allow_submission', OLD.allow_submission,
+                       'allow_sieve', OLD.allow_sieve,
+                       'pw_set', OLD.pw_set, 'pw_max_age', OLD.pw_max_age)); END;
+
+-- The credential key is its mailbox so the log of a mailbox has them too.
+DROP TRIGGER IF EXISTS audit_credential_insert;
+CREATE TRIGGER audit_credential_insert AFTER INSERT ON credential
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'credential', 'INSERT', (SELECT name FROM address_name WHERE id = NEW.mailbox),
+           json_object('label', NEW.label, 'pw_type', NEW.pw_type, 'password', 1,
+                       'expires', NEW.expires,
+                       'allow_imap', NEW.allow_imap, 'allow_pop3', NEW.allow_pop3,
+                       'allow_submission', NEW.allow_submission,
+                       'allow_sieve', NEW.allow_sieve)); END;
+
+-- last_used is bookkeeping, not a change
+DROP TRIGGER IF EXISTS audit_credential_update;
+CREATE TRIGGER audit_credential_update AFTER UPDATE ON credential
+ WHEN OLD.label IS NOT NEW.label OR OLD.pw_type IS NOT NEW.pw_type
+      OR OLD.password IS NOT NEW.password OR OLD.expires IS NOT NEW.expires
+      OR OLD.allow_imap IS NOT NEW.allow_imap OR OLD.allow_pop3 IS NOT NEW.allow_pop3
+      OR OLD.allow_submission IS NOT NEW.allow_submission
+      OR OLD.allow_sieve IS NOT NEW.allow_sieve
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'credential', 'UPDATE', (SELECT name FROM address_name WHERE id = NEW.mailbox),
+           json_object('label', OLD.label, 'pw_type', OLD.pw_type, 'password', 1,
+                       'expires', OLD.expires,
+                       'allow_imap', OLD.allow_imap, 'allow_pop3', OLD.allow_pop3,
+                       'allow_submission', OLD.allow_submission,
+                       'allow_sieve', OLD.allow_sieve),
+           json_object('label', NEW.label, 'pw_type', NEW.pw_type,
+                       'password', CASE WHEN OLD.password IS NOT NEW.password
+                                        THEN 'changed' ELSE 1 END,
+                       'expires', NEW.expires,
+                       'allow_imap', NEW.allow_imap, 'allow_pop3', NEW.allow_pop3,
+                       'allow_submission', NEW.allow_submission,
+                       'allow_sieve', NEW.allow_sieve)); END;
+
+DROP TRIGGER IF EXISTS audit_credential_delete;
+CREATE TRIGGER audit_credential_delete BEFORE DELETE ON credential
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'credential', 'DELETE', (SELECT name FROM address_name WHERE id = OLD.mailbox),
+           json_object('label', OLD.label, 'pw_type', OLD.pw_type, 'password', 1,
+                       'expires', OLD.expires,
+                       'allow_imap', OLD.allow_imap, 'allow_pop3', OLD.allow_pop3,
+                       'allow_submission', OLD.allow_submission,
+                       'allow_sieve', OLD.allow_sieve)); END;
+
+-- The sieve key is its mailbox like credential. The script itself is
+-- not recorded, only that it changed.
+DROP TRIGGER IF EXISTS audit_sieve_insert;
+CREATE TRIGGER audit_sieve_insert AFTER INSERT ON sievescript
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'sieve', 'INSERT', (SELECT name FROM address_name WHERE id = NEW.mailbox),
+           json_object('name', NEW.name, 'active', NEW.active,
+                       'version', NEW.version)); END;
+
+DROP TRIGGER IF EXISTS audit_sieve_update;
+CREATE TRIGGER audit_sieve_update AFTER UPDATE ON sievescript
+ WHEN OLD.name IS NOT NEW.name OR OLD.script IS NOT NEW.script
+      OR OLD.active IS NOT NEW.active
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'sieve', 'UPDATE', (SELECT name FROM address_name WHERE id = NEW.mailbox),
+           json_object('name', OLD.name, 'active', OLD.active,
+                       'version', OLD.version),
+           json_object('name', NEW.name, 'active', NEW.active,
+                       'version', NEW.version)); END;
+
+DROP TRIGGER IF EXISTS audit_sieve_delete;
+CREATE TRIGGER audit_sieve_delete BEFORE DELETE ON sievescript
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'sieve', 'DELETE', (SELECT name FROM address_name WHERE id = OLD.mailbox),
+           json_object('name', OLD.name, 'active', OLD.active,
+                       'version', OLD.version)); END;
+
+-- The vacation key is its mailbox. The message is not recorded.
+DROP TRIGGER IF EXISTS audit_vacation_insert;
+CREATE TRIGGER audit_vacation_insert AFTER INSERT ON vacation
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'vacation', 'INSERT', (SELECT name FROM address_name WHERE id = NEW.mailbox),
+           json_object('subject', NEW.subject, 'start_date', NEW.start_date,
+                       'end_date', NEW.end_date, 'days', NEW.days,
+                       'addresses', NEW.addresses)); END;
+
+DROP TRIGGER IF EXISTS audit_vacation_update;
+CREATE TRIGGER audit_vacation_update AFTER UPDATE ON vacation
+ WHEN OLD.subject IS NOT NEW.subject OR OLD.body IS NOT NEW.body
+      OR OLD.start_date IS NOT NEW.start_date OR OLD.end_date IS NOT NEW.end_date
+      OR OLD.days IS NOT NEW.days OR OLD.addresses IS NOT NEW.addresses
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'vacation', 'UPDATE', (SELECT name FROM address_name WHERE id = NEW.mailbox),
+           json_object('subject', OLD.subject, 'start_date', OLD.start_date,
+                       'end_date', OLD.end_date, 'days', OLD.days,
+                       'addresses', OLD.addresses),
+           json_object('subject', NEW.subject, 'start_date', NEW.start_date,
+                       'end_date', NEW.end_date, 'days', NEW.days,
+                       'addresses', NEW.addresses)); END;
+
+DROP TRIGGER IF EXISTS audit_vacation_delete;
+CREATE TRIGGER audit_vacation_delete BEFORE DELETE ON vacation
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'vacation', 'DELETE', (SELECT name FROM address_name WHERE id = OLD.mailbox),
+           json_object('subject', OLD.subject, 'start_date', OLD.start_date,
+                       'end_date', OLD.end_date, 'days', OLD.days,
+                       'addresses', OLD.addresses)); END;
+
+-- The forward key is its mailbox. Its targets are logged one by one.
+DROP TRIGGER IF EXISTS audit_forward_insert;
+CREATE TRIGGER audit_forward_insert AFTER INSERT ON forward
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'forward', 'INSERT', (SELECT name FROM address_name WHERE id = NEW.mailbox),
+           json_object('keep_copy', NEW.keep_copy)); END;
+
+DROP TRIGGER IF EXISTS audit_forward_update;
+CREATE TRIGGER audit_forward_update AFTER UPDATE ON forward
+ WHEN OLD.keep_copy IS NOT NEW.keep_copy
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'forward', 'UPDATE', (SELECT name FROM address_name WHERE id = NEW.mailbox),
+           json_object('keep_copy', OLD.keep_copy),
+           json_object('keep_copy', NEW.keep_copy)); END;
+
+DROP TRIGGER IF EXISTS audit_forward_delete;
+CREATE TRIGGER audit_forward_delete BEFORE DELETE ON forward
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'forward', 'DELETE', (SELECT name FROM address_name WHERE id = OLD.mailbox),
+           json_object('keep_copy', OLD.keep_copy)); END;
+
+DROP TRIGGER IF EXISTS audit_forward_target_insert;
+CREATE TRIGGER audit_forward_target_insert AFTER INSERT ON forwardtarget
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'forward', 'INSERT', (SELECT name FROM address_name WHERE id = NEW.forward),
+           json_object('target', NEW.target)); END;
+
+DROP TRIGGER IF EXISTS audit_forward_target_delete;
+CREATE TRIGGER audit_forward_target_delete BEFORE DELETE ON forwardtarget
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'forward', 'DELETE', (SELECT name FROM address_name WHERE id = OLD.forward),
+           json_object('target', OLD.target)); END;
+
+-- The alias domain key is its name. The target is logged by name.
+DROP TRIGGER IF EXISTS audit_alias_domain_insert;
+CREATE TRIGGER audit_alias_domain_insert AFTER INSERT ON aliasdomain
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'aliasdomain', 'INSERT', (SELECT name FROM domain WHERE id = NEW.domain),
+           json_object('target', (SELECT name FROM domain WHERE id = NEW.target))); END;
+
+DROP TRIGGER IF EXISTS audit_alias_domain_update;
+CREATE TRIGGER audit_alias_domain_update AFTER UPDATE ON aliasdomain
+ WHEN OLD.target IS NOT NEW.target
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before, after)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'aliasdomain', 'UPDATE', (SELECT name FROM domain WHERE id = NEW.domain),
+           json_object('target', (SELECT name FROM domain WHERE id = OLD.target)),
+           json_object('target', (SELECT name FROM domain WHERE id = NEW.target))); END;
+
+DROP TRIGGER IF EXISTS audit_alias_domain_delete;
+CREATE TRIGGER audit_alias_domain_delete BEFORE DELETE ON aliasdomain
+ BEGIN
+  INSERT INTO audit (user, command, entity, op, key, before)
+   VALUES ((SELECT user FROM audit_context), (SELECT command FROM audit_context),
+           'aliasdomain', 'DELETE', (SELECT name FROM domain WHERE id = OLD.domain),
+           json_object('target', (SELECT name FROM domain WHERE id = OLD.target))); END;
+
 -- backscatter and catchall here are for example. I don't do it so
 -- scratch this bit.
 --
@@ -0,0 +1,266 @@
+package maildb
+
+/*
+ * Copyright (C) 2020, Jim Lieb <lieb@sea-troll.net>
+ *
+ * This program is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 3 of the License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ *
+ * -------------
+ */
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+)
+
+// Forward
+// Where the mail of a mailbox is sent on to and whether the mailbox
+// keeps a copy. The mailbox stays a mailbox. Postfix gets the forward
+// from virt_alias.
+type Forward struct {
+	user     string
+	mailbox  int64
+	keepCopy int64
+	targets  []string
+}
+
+// LookupForward
+// outside transactions
+func (mdb *MailDB) LookupForward(user string) (*Forward, error) {
+	return mdb.LookupForwardContext(context.Background(), user)
+}
+
+// LookupForwardContext
+// LookupForward that gives up when ctx is done
+func (mdb *MailDB) LookupForwardContext(ctx context.Context, user string) (*Forward, error) {
+	vm, err := mdb.LookupVMailboxContext(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	f := &Forward{user: vm.a.Address(), mailbox: vm.a.Id()}
+	row := mdb.db.QueryRowContext(ctx, "SELECT keep_copy FROM forward WHERE mailbox = ?", f.mailbox)
+	switch err = row.Scan(&f.keepCopy); err {
+	case sql.ErrNoRows:
+		return nil, ErrMdbForwardNotFound
+	case nil:
+	default:
+		return nil, err
+	}
+	rows, err := mdb.db.QueryContext(ctx,
+		"SELECT target FROM forwardtarget WHERE forward = ? ORDER BY id", f.mailbox)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var t string
+		if err = rows.Scan(&t); err != nil {
+			break
+		}
+		f.targets = append(f.targets, t)
+	}
+	if e := rows.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// GetForward
+// inside transactions
+func (tx *Tx) GetForward(user string) (*Forward, error) {
+	if !tx.active() {
+		return nil, ErrMdbTransaction
+	}
+	vm, err := tx.GetVMailbox(user)
+	if err != nil {
+		return nil, err
+	}
+	f := &Forward{user: vm.a.Address(), mailbox: vm.a.Id()}
+	row := tx.queryRow("SELECT keep_copy FROM forward WHERE mailbox = ?", f.mailbox)
+	switch err = row.Scan(&f.keepCopy); err {
+	case sql.ErrNoRows:
+		return nil, ErrMdbForwardNotFound
+	case nil:
+	default:
+		return nil, err
+	}
+	rows, err := tx.query("SELECT target FROM forwardtarget WHERE forward = ? ORDER BY id", f.mailbox)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var t string
+		if err = rows.Scan(&t); err != nil {
+			break
+		}
+		f.targets = append(f.targets, t)
+	}
+	if e := rows.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// forwardTargets
+// The targets as name@domain addresses, without duplicates. A
+// mailbox cannot forward to itself. That is what keepCopy is for.
+func forwardTargets(user string, targets []string) ([]string, error) {
+	var tl []string
+
+	seen := make(map[string]bool)
+	for _, t := range targets {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		ap, err := DecodeRFC822(t)
+		if err != nil {
+			return nil, err
+		}
+		if ap.IsLocal() || ap.IsCatchAll() || strings.EqualFold(ap.String(), user) {
+			return nil, ErrMdbForwardTarget
+		}
+		if !seen[strings.ToLower(ap.String())] {
+			seen[strings.ToLower(ap.String())] = true
+			tl = append(tl, ap.String())
+		}
+	}
+	if len(tl) == 0 {
+		return nil, ErrMdbForwardNoTarget
+	}
+	return tl, nil
+}
+
+// SetForward
+// Forward the user's mailbox to the targets, replacing the ones it
+// has, and keep a copy in the mailbox if keepCopy.
+func (tx *Tx) SetForward(user string, targets []string, keepCopy bool) (*Forward, error) {
+	var keep int64
+
+	if !tx.active() {
+		return nil, ErrMdbTransaction
+	}
+	vm, err := tx.GetVMailbox(user)
+	if err != nil {
+		return nil, err
+	}
+	tl, err := forwardTargets(vm.a.Address(), targets)
+	if err != nil {
+		return nil, err
+	}
+	if keepCopy {
+		keep = 1
+	}
+	f, err := tx.GetForward(user)
+	switch err {
+	case ErrMdbForwardNotFound:
+		_, err = tx.exec("INSERT INTO forward (mailbox, keep_copy) VALUES (?, ?)", vm.a.Id(), keep)
+		if err != nil {
+			return nil, err
+		}
+		f = &Forward{user: vm.a.Address(), mailbox: vm.a.Id(), keepCopy: keep}
+	case nil:
+		if f.keepCopy != keep {
+			if _, err = tx.exec("UPDATE forward SET keep_copy = ? WHERE mailbox = ?", keep, f.mailbox); err != nil {
+				return nil, err
+			}
+			f.keepCopy = keep
+		}
+	default:
+		return nil, err
+	}
+	want := make(map[string]bool)
+	for _, t := range tl {
+		want[t] = true
+	}
+	for _, t := range f.targets {
+		if want[t] {
+			delete(want, t)
+			continue
+		}
+		if _, err = tx.exec("DELETE FROM forwardtarget WHERE forward = ? AND target = ?", f.mailbox, t); err != nil {
+			return nil, err
+		}
+	}
+	for _, t := range tl {
+		if !want[t] {
+			continue
+		}
+		if _, err = tx.exec("INSERT INTO forwardtarget (forward, target) VALUES (?, ?)", f.mailbox, t); err != nil {
+			return nil, err
+		}
+	}
+	f.targets = tl
+	return f, nil
+}
+
+// DeleteForward
+// Stop forwarding the user's mailbox. Its mail is only delivered to it.
+func (tx *Tx) DeleteForward(user string) error {
+	if !tx.active() {
+		return ErrMdbTransaction
+	}
+	vm, err := tx.GetVMailbox(user)
+	if err != nil {
+		return err
+	}
+	res, err := tx.exec("DELETE FROM forward WHERE mailbox = ?", vm.a.Id())
+	if err == nil {
+		n, err := res.RowsAffected()
+		if err == nil && n == 0 {
+			return ErrMdbForwardNotFound
+		}
+	}
+	return err
+}
+
+// User
+func (f *Forward) User() string {
+	return f.user
+}
+
+// Targets
+// The addresses the mail is forwarded to
+func (f *Forward) Targets() []string {
+	return f.targets
+}
+
+// KeepCopy
+// Is the mail delivered to the mailbox as well?
+func (f *Forward) KeepCopy() bool {
+	return f.keepCopy != 0
+}
+
+// Recipients
+// Where postfix sends the mailbox's mail, as virt_alias has it
+func (f *Forward) Recipients() []string {
+	rl := append([]string{}, f.targets...)
+	if f.KeepCopy() {
+		rl = append(rl, f.user)
+	}
+	return rl
+}
+
+// String
+// The recipients as they would be in a virtual(5) file
+func (f *Forward) String() string {
+	return strings.Join(f.Recipients(), ", ")
+}
@@ -0,0 +1,189 @@
+package maildb
+
+/*
+ * Copyright (C) 2020, Jim Lieb <lieb@sea-troll.net>
+ *
+ * This program is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 3 of the License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ *
+ * -------------
+ */
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// TestForward
+func TestForward(t *testing.T) {
+	var (
+		err error
+		mdb *MailDB
+		dir string
+		cnt int
+	)
+
+	fmt.Printf("Forward Test\n")
+
+	dir, err = ioutil.TempDir("", "TestForward-*")
+	defer os.RemoveAll(dir)
+	mdb, err = makeTestDB(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Errorf("Database load failed, %s", err)
+		return
+	}
+	defer mdb.Close()
+
+	// virtuals is what postfix gets for user
+	virtuals := func(lpart, domain string) string {
+		var rl []string
+		rows, err := mdb.db.Query("SELECT recipient FROM virt_alias WHERE mailbox = ? AND domain_name = ?",
+			lpart, domain)
+		if err != nil {
+			return err.Error()
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var r string
+			if err = rows.Scan(&r); err != nil {
+				return err.Error()
+			}
+			rl = append(rl, r)
+		}
+		sort.Strings(rl)
+		return strings.Join(rl, ",")
+	}
+
+	err = mdb.WithTx(func(tx *Tx) error {
+		d, err := tx.InsertDomain("skywalker")
+		if err == nil {
+			err = d.SetClass("vmailbox")
+		}
+		for _, u := range []string{"luke", "leia"} {
+			if err != nil {
+				break
+			}
+			_, err = tx.InsertVMailbox(u + "@skywalker")
+		}
+		if err != nil {
+			return err
+		}
+		a, err := tx.GetOrInsAddress("han@skywalker")
+		if err == nil {
+			err = a.AttachAlias("leia@skywalker")
+		}
+		if err != nil {
+			return err
+		}
+		f, err := tx.SetForward("luke@skywalker",
+			[]string{"luke@rebels", " luke@rebels", "red5@rebels"}, true)
+		if err != nil {
+			return err
+		}
+		if len(f.Targets()) != 2 || !f.KeepCopy() {
+			return fmt.Errorf("luke: expected 2 targets and a copy, got %v", f.Recipients())
+		}
+		_, err = tx.SetForward("leia@skywalker", []string{"leia@rebels"}, false)
+		return err
+	})
+	if err != nil {
+		t.Errorf("Set forwards failed, %s", err)
+		return
+	}
+	if v := virtuals("luke", "skywalker"); v != "luke@rebels,luke@skywalker,red5@rebels" {
+		t.Errorf("virt_alias luke: got %q", v)
+	}
+	if v := virtuals("leia", "skywalker"); v != "leia@rebels" {
+		t.Errorf("virt_alias leia: got %q", v)
+	}
+	if v := virtuals("han", "skywalker"); v != "leia@skywalker" {
+		t.Errorf("virt_alias han: got %q", v)
+	}
+
+	// Mistakes, and a mailbox is still not an alias
+	err = mdb.WithTx(func(tx *Tx) error {
+		for _, tl := range [][]string{{"luke@skywalker"}, {"luke"}, {"@rebels"}, {"red5@rebels", "LUKE@skywalker"}} {
+			if _, err := tx.SetForward("luke@skywalker", tl, false); err != ErrMdbForwardTarget {
+				return fmt.Errorf("targets %v: expected ErrMdbForwardTarget, got %v", tl, err)
+			}
+		}
+		if _, err := tx.SetForward("luke@skywalker", []string{" "}, false); err != ErrMdbForwardNoTarget {
+			return fmt.Errorf("no targets: expected ErrMdbForwardNoTarget, got %v", err)
+		}
+		if _, err := tx.SetForward("han@skywalker", []string{"han@falcon"}, false); err != ErrMdbNotMbox {
+			return fmt.Errorf("han: expected ErrMdbNotMbox, got %v", err)
+		}
+		if _, err := tx.SetForward("chewie@skywalker", []string{"chewie@falcon"}, false); err != ErrMdbAddressNotFound {
+			return fmt.Errorf("chewie: expected ErrMdbAddressNotFound, got %v", err)
+		}
+		a, err := tx.GetAddress("luke@skywalker")
+		if err != nil {
+			return err
+		}
+		if err = a.AttachAlias("red5@rebels"); err == nil ||
+			!strings.Contains(err.Error(), "already a mailbox") {
+			return fmt.Errorf("alias luke: expected already a mailbox, got %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Forward mistakes: %s", err)
+	}
+	if f, err := mdb.LookupForward("luke@skywalker"); err != nil ||
+		f.String() != "luke@rebels, red5@rebels, luke@skywalker" {
+		t.Errorf("Lookup luke: got %v, %v", f, err)
+	}
+
+	// Change, stop, and delete with the mailbox
+	err = mdb.WithTx(func(tx *Tx) error {
+		if _, err := tx.SetForward("luke@skywalker", []string{"red5@rebels", "gold5@rebels"}, false); err != nil {
+			return err
+		}
+		if err := tx.DeleteForward("leia@skywalker"); err != nil {
+			return err
+		}
+		if err := tx.DeleteForward("leia@skywalker"); err != ErrMdbForwardNotFound {
+			return fmt.Errorf("delete leia again: expected ErrMdbForwardNotFound, got %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Change forwards: %s", err)
+	}
+	if v := virtuals("luke", "skywalker"); v != "gold5@rebels,red5@rebels" {
+		t.Errorf("virt_alias luke after change: got %q", v)
+	}
+	if v := virtuals("leia", "skywalker"); v != "" {
+		t.Errorf("virt_alias leia after delete: got %q", v)
+	}
+	if _, err = mdb.LookupForward("leia@skywalker"); err != ErrMdbForwardNotFound {
+		t.Errorf("Lookup leia: expected ErrMdbForwardNotFound, got %v", err)
+	}
+	if err = mdb.WithTx(func(tx *Tx) error { return tx.DeleteVMailbox("luke@skywalker") }); err != nil {
+		t.Errorf("Delete luke: %s", err)
+	}
+	row := mdb.db.QueryRow("SELECT count(*) FROM forwardtarget")
+	if err = row.Scan(&cnt); err != nil || cnt != 0 {
+		t.Errorf("Targets after delete: expected 0, got %d, %v", cnt, err)
+	}
+	row = mdb.db.QueryRow("SELECT count(*) FROM audit WHERE entity = 'forward'")
+	if err = row.Scan(&cnt); err != nil || cnt != 13 {
+		t.Errorf("Forward audit: expected 13 records, got %d, %v", cnt, err)
+	}
+}
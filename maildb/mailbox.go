@@ -21,9 +21,11 @@ package maildb
  */
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3" // do I really need this?
 )
@@ -38,6 +40,45 @@ type VMailbox struct {
 	home     sql.NullString
 	quota    sql.NullString
 	enable   int64
+	allow    [numProtocols]int64
+	pwSet    sql.NullString // UTC, AuditStampFormat
+	pwMaxAge sql.NullInt64  // days, NULL is the domain's
+}
+
+// MailProtocols
+// The services a mailbox can be allowed or denied, in the order of
+// their allow_ columns in vmailbox. lmtp is delivery, submission
+// covers SMTP AUTH too, and sieve is ManageSieve.
+var MailProtocols = []string{"imap", "pop3", "lmtp", "submission", "sieve"}
+
+const numProtocols = 5
+
+// vmailboxCols
+// The vmailbox columns, in scan() order
+const vmailboxCols = `pw_type, password, uid, gid, quota, home, enable,
+ allow_imap, allow_pop3, allow_lmtp, allow_submission, allow_sieve, pw_set, pw_max_age`
+
+// scan
+// The destinations for the vmailboxCols of a row
+func (vm *VMailbox) scan() []interface{} {
+	dest := []interface{}{&vm.pw_type, &vm.password, &vm.uid, &vm.gid,
+		&vm.quota, &vm.home, &vm.enable}
+	for i := range vm.allow {
+		dest = append(dest, &vm.allow[i])
+	}
+	return append(dest, &vm.pwSet, &vm.pwMaxAge)
+}
+
+// protocolIndex
+// Where p is in MailProtocols
+func protocolIndex(p string) (int, error) {
+	p = strings.ToLower(strings.TrimSpace(p))
+	for i, mp := range MailProtocols {
+		if p == mp {
+			return i, nil
+		}
+	}
+	return -1, ErrMdbBadProtocol
 }
 
 // String
@@ -121,6 +162,16 @@ func (vm *VMailbox) Export() string {
 	} else {
 		fmt.Fprintf(&line, "mbox_enabled=false")
 	}
+	if denied := vm.DeniedProtocols(); len(denied) > 0 {
+		fmt.Fprintf(&line, " mbox_deny=%s", strings.Join(denied, ","))
+	}
+	if vm.pwMaxAge.Valid {
+		fmt.Fprintf(&line, " mbox_pw_max_age=%d", vm.pwMaxAge.Int64)
+	}
+	// the set time only matters if the password can expire
+	if !vm.PwExpires().IsZero() {
+		fmt.Fprintf(&line, " mbox_pw_set=%s", vm.PwSet().Format(PwSetFormat))
+	}
 
 	return line.String()
 }
@@ -150,6 +201,76 @@ func (vm *VMailbox) Password() string {
 	return line.String()
 }
 
+// Domain
+func (vm *VMailbox) Domain() string {
+	if vm.a.d == nil {
+		return ""
+	}
+	return vm.a.d.Name()
+}
+
+// PwStrength
+// How strong the stored password is
+func (vm *VMailbox) PwStrength() PwStrength {
+	if !vm.password.Valid {
+		return PwNone
+	}
+	return PasswordStrength(vm.pw_type)
+}
+
+// VerifyPassword
+// Is clear the password? No password matches nothing.
+func (vm *VMailbox) VerifyPassword(clear string) (bool, error) {
+	if !vm.password.Valid {
+		return false, nil
+	}
+	return VerifyPassword(vm.pw_type, vm.password.String, clear)
+}
+
+// PwSetFormat
+// How the time a password was set is exported
+const PwSetFormat = "2006-01-02T15:04:05Z"
+
+// PwSet
+// When the password was set. Zero if there is none or we don't know.
+func (vm *VMailbox) PwSet() time.Time {
+	if !vm.password.Valid || !vm.pwSet.Valid {
+		return time.Time{}
+	}
+	return parseStamp(vm.pwSet.String)
+}
+
+// PwMaxAge
+// How many days the password lasts, the mailbox's own or else
+// its domain's. Zero is forever.
+func (vm *VMailbox) PwMaxAge() int64 {
+	if vm.pwMaxAge.Valid {
+		return vm.pwMaxAge.Int64
+	}
+	if vm.a.d != nil {
+		return vm.a.d.pwMaxAge.Int64
+	}
+	return 0
+}
+
+// PwExpires
+// When the password stops working, the same as the user_mailbox view
+// works it out. Zero if never.
+func (vm *VMailbox) PwExpires() time.Time {
+	set := vm.PwSet()
+	age := vm.PwMaxAge()
+	if set.IsZero() || age <= 0 {
+		return time.Time{}
+	}
+	return set.AddDate(0, 0, int(age))
+}
+
+// IsPwExpired
+func (vm *VMailbox) IsPwExpired() bool {
+	e := vm.PwExpires()
+	return !e.IsZero() && !time.Now().Before(e)
+}
+
 // Uid
 func (vm *VMailbox) Uid() string {
 	var line strings.Builder
@@ -199,6 +320,19 @@ func (vm *VMailbox) Quota() string {
 	return line.String()
 }
 
+// QuotaRule
+// The rule dovecot gets, the mailbox's own or its domain's default,
+// and whether it is the domain's. It is "none" if neither has one.
+func (vm *VMailbox) QuotaRule() (string, bool) {
+	if vm.quota.Valid {
+		return vm.quota.String, false
+	}
+	if vm.a.d != nil && vm.a.d.quota.Valid {
+		return vm.a.d.quota.String, true
+	}
+	return "none", false
+}
+
 // IsEnabled
 func (mb *VMailbox) IsEnabled() bool {
 	if mb.enable != 0 {
@@ -208,6 +342,43 @@ func (mb *VMailbox) IsEnabled() bool {
 	}
 }
 
+// IsAllowed
+// Is the mailbox allowed to use protocol p? This is only the
+// protocol's own setting. A disabled mailbox is denied all of them.
+func (mb *VMailbox) IsAllowed(p string) (bool, error) {
+	i, err := protocolIndex(p)
+	if err != nil {
+		return false, err
+	}
+	return mb.allow[i] != 0, nil
+}
+
+// AllowedProtocols
+// The protocols this mailbox may use, in MailProtocols order
+func (mb *VMailbox) AllowedProtocols() []string {
+	var pl []string
+
+	for i, p := range MailProtocols {
+		if mb.allow[i] != 0 {
+			pl = append(pl, p)
+		}
+	}
+	return pl
+}
+
+// DeniedProtocols
+// The protocols this mailbox may not use, in MailProtocols order
+func (mb *VMailbox) DeniedProtocols() []string {
+	var pl []string
+
+	for i, p := range MailProtocols {
+		if mb.allow[i] == 0 {
+			pl = append(pl, p)
+		}
+	}
+	return pl
+}
+
 // FindVMailbox
 // name@domain username for mailbox
 // *@domain all users in this domain
@@ -215,6 +386,12 @@ func (mb *VMailbox) IsEnabled() bool {
 // * error. No local system users (for now)
 // return a list of matched mailboxes
 func (mdb *MailDB) FindVMailbox(user string) ([]*VMailbox, error) {
+	return mdb.FindVMailboxContext(context.Background(), user)
+}
+
+// FindVMailboxContext
+// FindVMailbox that gives up when ctx is done
+func (mdb *MailDB) FindVMailboxContext(ctx context.Context, user string) ([]*VMailbox, error) {
 	var (
 		mb_list []*VMailbox
 		a_list  []*Address
@@ -222,16 +399,16 @@ func (mdb *MailDB) FindVMailbox(user string) ([]*VMailbox, error) {
 		rowCnt  int
 	)
 
-	if a_list, err = mdb.FindAddress(user); err != nil {
+	if a_list, err = mdb.FindAddressContext(ctx, user); err != nil {
 		return nil, err
 	}
 	for _, a := range a_list {
 		mb := &VMailbox{
 			a: a,
 		}
-		qmb := `SELECT pw_type, password, uid, gid, quota, home, enable FROM vmailbox WHERE id IS ?`
-		row := mdb.db.QueryRow(qmb, a.id)
-		switch err := row.Scan(&mb.pw_type, &mb.password, &mb.uid, &mb.gid, &mb.quota, &mb.home, &mb.enable); err {
+		qmb := `SELECT ` + vmailboxCols + ` FROM vmailbox WHERE id = ?`
+		row := mdb.db.QueryRowContext(ctx, qmb, a.id)
+		switch err := row.Scan(mb.scan()...); err {
 		case sql.ErrNoRows:
 			continue // not a mailbox
 		case nil:
@@ -250,20 +427,26 @@ func (mdb *MailDB) FindVMailbox(user string) ([]*VMailbox, error) {
 // LookupVmailbox
 // lookup a mailbox without transactions
 func (mdb *MailDB) LookupVMailbox(user string) (*VMailbox, error) {
+	return mdb.LookupVMailboxContext(context.Background(), user)
+}
+
+// LookupVMailboxContext
+// LookupVMailbox that gives up when ctx is done
+func (mdb *MailDB) LookupVMailboxContext(ctx context.Context, user string) (*VMailbox, error) {
 	var (
 		a   *Address
 		err error
 	)
 
-	if a, err = mdb.LookupAddress(user); err != nil {
+	if a, err = mdb.LookupAddressContext(ctx, user); err != nil {
 		return nil, err
 	}
 	mb := &VMailbox{
 		a: a,
 	}
-	qmb := `SELECT pw_type, password, uid, gid, quota, home, enable FROM vmailbox WHERE id IS ?`
-	row := mdb.db.QueryRow(qmb, a.id)
-	switch err := row.Scan(&mb.pw_type, &mb.password, &mb.uid, &mb.gid, &mb.quota, &mb.home, &mb.enable); err {
+	qmb := `SELECT ` + vmailboxCols + ` FROM vmailbox WHERE id = ?`
+	row := mdb.db.QueryRowContext(ctx, qmb, a.id)
+	switch err := row.Scan(mb.scan()...); err {
 	case sql.ErrNoRows:
 		return nil, ErrMdbNotMbox
 	case nil:
@@ -275,23 +458,23 @@ func (mdb *MailDB) LookupVMailbox(user string) (*VMailbox, error) {
 
 // GetVmailbox
 // lookup a mailbox under a transaction
-func (mdb *MailDB) GetVMailbox(user string) (*VMailbox, error) {
+func (tx *Tx) GetVMailbox(user string) (*VMailbox, error) {
 	var (
 		a   *Address
 		err error
 	)
-	if mdb.tx == nil {
+	if !tx.active() {
 		return nil, ErrMdbTransaction
 	}
-	if a, err = mdb.GetAddress(user); err != nil {
+	if a, err = tx.GetAddress(user); err != nil {
 		return nil, err
 	}
 	mb := &VMailbox{
 		a: a,
 	}
-	qmb := `SELECT pw_type, password, uid, gid, quota, home, enable FROM vmailbox WHERE id IS ?`
-	row := mdb.tx.QueryRow(qmb, a.id)
-	switch err := row.Scan(&mb.pw_type, &mb.password, &mb.uid, &mb.gid, &mb.quota, &mb.home, &mb.enable); err {
+	qmb := `SELECT ` + vmailboxCols + ` FROM vmailbox WHERE id = ?`
+	row := tx.queryRow(qmb, a.id)
+	switch err := row.Scan(mb.scan()...); err {
 	case sql.ErrNoRows:
 		return nil, ErrMdbNotMbox
 	case nil:
@@ -303,27 +486,35 @@ func (mdb *MailDB) GetVMailbox(user string) (*VMailbox, error) {
 
 // InsertVMailbox
 // must be under a transaction
-func (mdb *MailDB) InsertVMailbox(user string) (*VMailbox, error) {
+func (tx *Tx) InsertVMailbox(user string) (*VMailbox, error) {
 	var (
 		a   *Address
 		err error
 	)
 
-	if mdb.tx == nil {
+	if !tx.active() {
 		return nil, ErrMdbTransaction
 	}
 	// the domain must exist and be a vmailbox class
 	// if we fail with a dup entry that could be either an already existing mbox
 	// or this address is an alias or something (which must be deleted before we can proceed)
-	if a, err = mdb.InsertAddress(user); err != nil {
+	if ap, err := DecodeRFC822(user); err == nil && ap.IsCatchAll() {
+		return nil, ErrMdbCatchAll
+	}
+	if a, err = tx.InsertAddress(user); err != nil {
 		return nil, err
 	}
 	// if we just created a new domain, it will be the default (not vmailbox) and fail
 	if !a.InVMailDomain() {
 		return nil, ErrMdbMboxNotMboxDomain
 	}
-	// Now we can insert the mailbox.
-	_, err = mdb.tx.Exec("INSERT INTO vmailbox (id) VALUES (?)", a.Id())
+	// Now we can insert the mailbox. If its domain has a default quota
+	// it gets that rather than the schema's
+	if a.d.quota.Valid {
+		_, err = tx.exec("INSERT INTO vmailbox (id, quota) VALUES (?, NULL)", a.Id())
+	} else {
+		_, err = tx.exec("INSERT INTO vmailbox (id) VALUES (?)", a.Id())
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -331,9 +522,9 @@ func (mdb *MailDB) InsertVMailbox(user string) (*VMailbox, error) {
 	vm := &VMailbox{
 		a: a,
 	}
-	row := mdb.tx.QueryRow("SELECT pw_type, password, uid, gid, quota, home, enable FROM vmailbox WHERE id IS ?",
+	row := tx.queryRow("SELECT "+vmailboxCols+" FROM vmailbox WHERE id = ?",
 		a.Id())
-	if err = row.Scan(&vm.pw_type, &vm.password, &vm.uid, &vm.gid, &vm.quota, &vm.home, &vm.enable); err != nil {
+	if err = row.Scan(vm.scan()...); err != nil {
 		return nil, err
 	}
 	return vm, nil
@@ -344,20 +535,14 @@ func (m *VMailbox) SetPwType(pwType string) error {
 	var err error
 
 	// Check for legit type
-	switch strings.ToLower(pwType) { // This is not an exhaustive list ATM
-	case "":
-		pwType = m.a.mdb.DefaultString("vmailbox.pw_type")
-		break // use default
-	case "plain":
-		pwType = "PLAIN"
-	case "crypt":
-		pwType = "CRYPT"
-	case "sha256":
-		pwType = "SHA256"
-	default:
-		return ErrMdbMboxBadPw
+	if strings.TrimSpace(pwType) == "" {
+		if pwType, err = m.a.mdb.DefaultString("vmailbox.pw_type"); err != nil {
+			return err
+		}
+	} else if pwType, err = pwScheme(pwType); err != nil {
+		return err
 	}
-	res, err := m.a.mdb.tx.Exec("UPDATE vmailbox SET pw_type = ? WHERE id = ?", pwType, m.a.id)
+	res, err := m.a.tx.exec("UPDATE vmailbox SET pw_type = ? WHERE id = ?", pwType, m.a.id)
 	if err == nil {
 		c, err := res.RowsAffected()
 		if err == nil {
@@ -372,23 +557,38 @@ func (m *VMailbox) SetPwType(pwType string) error {
 }
 
 // SetPassword
+// Store ps as is, already encoded with the pw_type. A PLAIN one is
+// cleartext so it must pass the domain's password policy. Any other
+// must be in its type's format. The password's age starts now.
 func (m *VMailbox) SetPassword(ps string) error {
 	var (
 		err error
 		pw  sql.NullString
+		set sql.NullString
 	)
 
 	if ps == "" {
 		pw = NullStr
+		set = NullStr
 	} else {
+		if strings.ToUpper(m.pw_type) == "PLAIN" {
+			if err = m.a.tx.checkPassword(m.a.d, ps); err != nil {
+				return err
+			}
+		} else if err = checkPasswordHash(m.pw_type, ps); err != nil {
+			return err
+		}
 		pw = sql.NullString{Valid: true, String: ps}
+		set = sql.NullString{Valid: true, String: time.Now().UTC().Format(AuditStampFormat)}
 	}
-	res, err := m.a.mdb.tx.Exec("UPDATE vmailbox SET password = ? WHERE id = ?", pw, m.a.id)
+	res, err := m.a.tx.exec("UPDATE vmailbox SET password = ?, pw_set = ? WHERE id = ?",
+		pw, set, m.a.id)
 	if err == nil {
 		c, err := res.RowsAffected()
 		if err == nil {
 			if c == 1 {
 				m.password = pw
+				m.pwSet = set
 			} else {
 				err = ErrMdbBadUpdate
 			}
@@ -397,18 +597,102 @@ func (m *VMailbox) SetPassword(ps string) error {
 	return err
 }
 
+// HashPassword
+// Hash the cleartext password with scheme and set both the
+// password and its type. An empty scheme is DefaultPwScheme.
+// The password must pass the domain's password policy.
+func (m *VMailbox) HashPassword(scheme string, clear string) error {
+	if strings.TrimSpace(scheme) == "" {
+		scheme = DefaultPwScheme
+	}
+	if clear != "" {
+		if err := m.a.tx.checkPassword(m.a.d, clear); err != nil {
+			return err
+		}
+	}
+	pwType, pw, err := hashPassword(scheme, clear)
+	if err != nil {
+		return err
+	}
+	if err = m.SetPwType(pwType); err != nil {
+		return err
+	}
+	return m.SetPassword(pw)
+}
+
 // ClearPassword
 func (m *VMailbox) ClearPassword() error {
 	var (
 		err error
 	)
 
-	res, err := m.a.mdb.tx.Exec("UPDATE vmailbox SET password = NULL WHERE id = ?", m.a.id)
+	res, err := m.a.tx.exec("UPDATE vmailbox SET password = NULL, pw_set = NULL WHERE id = ?", m.a.id)
 	if err == nil {
 		c, err := res.RowsAffected()
 		if err == nil {
 			if c == 1 {
 				m.password = NullStr
+				m.pwSet = NullStr
+			} else {
+				err = ErrMdbBadUpdate
+			}
+		}
+	}
+	return err
+}
+
+// SetPwSet
+// Say when the password was set, e.g. when it came from another
+// system. A zero t means we don't know.
+func (m *VMailbox) SetPwSet(t time.Time) error {
+	set := NullStr
+	if !t.IsZero() {
+		set = sql.NullString{Valid: true, String: t.UTC().Format(AuditStampFormat)}
+	}
+	res, err := m.a.tx.exec("UPDATE vmailbox SET pw_set = ? WHERE id = ?", set, m.a.id)
+	if err == nil {
+		c, err := res.RowsAffected()
+		if err == nil {
+			if c == 1 {
+				m.pwSet = set
+			} else {
+				err = ErrMdbBadUpdate
+			}
+		}
+	}
+	return err
+}
+
+// SetPwMaxAge
+// The password expires days after it is set, whatever the domain
+// says. Zero is never.
+func (m *VMailbox) SetPwMaxAge(days int64) error {
+	if days < 0 {
+		return ErrMdbBadPwPolicy
+	}
+	res, err := m.a.tx.exec("UPDATE vmailbox SET pw_max_age = ? WHERE id = ?", days, m.a.id)
+	if err == nil {
+		c, err := res.RowsAffected()
+		if err == nil {
+			if c == 1 {
+				m.pwMaxAge = sql.NullInt64{Valid: true, Int64: days}
+			} else {
+				err = ErrMdbBadUpdate
+			}
+		}
+	}
+	return err
+}
+
+// ClearPwMaxAge
+// Go back to the domain's maximum password age
+func (m *VMailbox) ClearPwMaxAge() error {
+	res, err := m.a.tx.exec("UPDATE vmailbox SET pw_max_age = NULL WHERE id = ?", m.a.id)
+	if err == nil {
+		c, err := res.RowsAffected()
+		if err == nil {
+			if c == 1 {
+				m.pwMaxAge = NullInt
 			} else {
 				err = ErrMdbBadUpdate
 			}
@@ -421,7 +705,7 @@ func (m *VMailbox) ClearPassword() error {
 func (m *VMailbox) SetUid(uid int64) error {
 	var err error
 
-	res, err := m.a.mdb.tx.Exec("UPDATE vmailbox SET uid = ? WHERE id = ?", uid, m.a.id)
+	res, err := m.a.tx.exec("UPDATE vmailbox SET uid = ? WHERE id = ?", uid, m.a.id)
 	if err == nil {
 		c, err := res.RowsAffected()
 		if err == nil {
@@ -439,7 +723,7 @@ func (m *VMailbox) SetUid(uid int64) error {
 func (m *VMailbox) ClearUid() error {
 	var err error
 
-	res, err := m.a.mdb.tx.Exec("UPDATE vmailbox SET uid = NULL WHERE id = ?", m.a.id)
+	res, err := m.a.tx.exec("UPDATE vmailbox SET uid = NULL WHERE id = ?", m.a.id)
 	if err == nil {
 		c, err := res.RowsAffected()
 		if err == nil {
@@ -457,7 +741,7 @@ func (m *VMailbox) ClearUid() error {
 func (m *VMailbox) SetGid(gid int64) error {
 	var err error
 
-	res, err := m.a.mdb.tx.Exec("UPDATE vmailbox SET gid = ? WHERE id = ?", gid, m.a.id)
+	res, err := m.a.tx.exec("UPDATE vmailbox SET gid = ? WHERE id = ?", gid, m.a.id)
 	if err == nil {
 		c, err := res.RowsAffected()
 		if err == nil {
@@ -475,7 +759,7 @@ func (m *VMailbox) SetGid(gid int64) error {
 func (m *VMailbox) ClearGid() error {
 	var err error
 
-	res, err := m.a.mdb.tx.Exec("UPDATE vmailbox SET gid = NULL WHERE id = ?", m.a.id)
+	res, err := m.a.tx.exec("UPDATE vmailbox SET gid = NULL WHERE id = ?", m.a.id)
 	if err == nil {
 		c, err := res.RowsAffected()
 		if err == nil {
@@ -501,7 +785,7 @@ func (m *VMailbox) SetHome(home string) error {
 	} else {
 		hm = sql.NullString{Valid: true, String: home}
 	}
-	res, err := m.a.mdb.tx.Exec("UPDATE vmailbox SET home = ? WHERE id = ?", hm, m.a.id)
+	res, err := m.a.tx.exec("UPDATE vmailbox SET home = ? WHERE id = ?", hm, m.a.id)
 	if err == nil {
 		c, err := res.RowsAffected()
 		if err == nil {
@@ -521,7 +805,7 @@ func (m *VMailbox) ClearHome() error {
 		err error
 	)
 
-	res, err := m.a.mdb.tx.Exec("UPDATE vmailbox SET home = NULL WHERE id = ?", m.a.id)
+	res, err := m.a.tx.exec("UPDATE vmailbox SET home = NULL WHERE id = ?", m.a.id)
 	if err == nil {
 		c, err := res.RowsAffected()
 		if err == nil {
@@ -536,10 +820,15 @@ func (m *VMailbox) ClearHome() error {
 }
 
 // SetQuota
+// quota must be a rule dovecot will take
 func (m *VMailbox) SetQuota(quota string) error {
 	var err error
 
-	res, err := m.a.mdb.tx.Exec("UPDATE vmailbox SET quota = ? WHERE id = ?", quota, m.a.id)
+	quota = strings.TrimSpace(quota)
+	if _, err = ParseQuotaRule(quota); err != nil {
+		return err
+	}
+	res, err := m.a.tx.exec("UPDATE vmailbox SET quota = ? WHERE id = ?", quota, m.a.id)
 	if err == nil {
 		c, err := res.RowsAffected()
 		if err == nil {
@@ -557,7 +846,7 @@ func (m *VMailbox) SetQuota(quota string) error {
 func (m *VMailbox) ClearQuota() error {
 	var err error
 
-	res, err := m.a.mdb.tx.Exec("UPDATE vmailbox SET quota = NULL WHERE id = ?", m.a.id)
+	res, err := m.a.tx.exec("UPDATE vmailbox SET quota = NULL WHERE id = ?", m.a.id)
 	if err == nil {
 		c, err := res.RowsAffected()
 		if err == nil {
@@ -572,16 +861,23 @@ func (m *VMailbox) ClearQuota() error {
 }
 
 // ResetQuota
+// Back to the domain's default quota or, if it has none, the schema's
 func (m *VMailbox) ResetQuota() error {
-	var err error
-
-	res, err := m.a.mdb.tx.Exec("UPDATE vmailbox SET quota = ? WHERE id = ?",
-		m.a.mdb.DefaultString("vmailbox.quota"), m.a.id)
+	quota := NullStr
+	if m.a.d == nil || !m.a.d.quota.Valid {
+		q, err := m.a.mdb.DefaultString("vmailbox.quota")
+		if err != nil {
+			return err
+		}
+		quota = sql.NullString{Valid: true, String: q}
+	}
+	res, err := m.a.tx.exec("UPDATE vmailbox SET quota = ? WHERE id = ?",
+		quota, m.a.id)
 	if err == nil {
 		c, err := res.RowsAffected()
 		if err == nil {
 			if c == 1 {
-				row := m.a.mdb.tx.QueryRow("SELECT quota FROM vmailbox WHERE id IS ?",
+				row := m.a.tx.queryRow("SELECT quota FROM vmailbox WHERE id = ?",
 					m.a.Id())
 				err = row.Scan(&m.quota)
 			} else {
@@ -596,7 +892,7 @@ func (m *VMailbox) ResetQuota() error {
 func (m *VMailbox) Enable() error {
 	var err error
 
-	res, err := m.a.mdb.tx.Exec("UPDATE vmailbox SET enable = 1 WHERE id = ?", m.a.id)
+	res, err := m.a.tx.exec("UPDATE vmailbox SET enable = 1 WHERE id = ?", m.a.id)
 	if err == nil {
 		c, err := res.RowsAffected()
 		if err == nil {
@@ -614,7 +910,7 @@ func (m *VMailbox) Enable() error {
 func (m *VMailbox) Disable() error {
 	var err error
 
-	res, err := m.a.mdb.tx.Exec("UPDATE vmailbox SET enable = 0 WHERE id = ?", m.a.id)
+	res, err := m.a.tx.exec("UPDATE vmailbox SET enable = 0 WHERE id = ?", m.a.id)
 	if err == nil {
 		c, err := res.RowsAffected()
 		if err == nil {
@@ -628,9 +924,41 @@ func (m *VMailbox) Disable() error {
 	return err
 }
 
+// setProtocol
+// Set the allow_ column for protocol p
+func (m *VMailbox) setProtocol(p string, allow int64) error {
+	i, err := protocolIndex(p)
+	if err != nil {
+		return err
+	}
+	res, err := m.a.tx.exec("UPDATE vmailbox SET allow_"+MailProtocols[i]+" = ? WHERE id = ?",
+		allow, m.a.id)
+	if err == nil {
+		c, err := res.RowsAffected()
+		if err == nil {
+			if c == 1 {
+				m.allow[i] = allow
+			} else {
+				err = ErrMdbBadUpdate
+			}
+		}
+	}
+	return err
+}
+
+// AllowProtocol
+func (m *VMailbox) AllowProtocol(p string) error {
+	return m.setProtocol(p, 1)
+}
+
+// DenyProtocol
+func (m *VMailbox) DenyProtocol(p string) error {
+	return m.setProtocol(p, 0)
+}
+
 // DeleteVMailbox
 // Potential cascaded delete of address is handled by triggers
-func (mdb *MailDB) DeleteVMailbox(address string) error {
+func (tx *Tx) DeleteVMailbox(address string) error {
 	var (
 		ap  *AddressParts
 		err error
@@ -644,9 +972,9 @@ DELETE FROM vmailbox WHERE id =
   (SELECT a.id FROM address a, domain d
      WHERE a.domain = d.id AND a.localpart = ? AND d.name = ?)
 `
-	res, err := mdb.db.Exec(qd, ap.lpart, ap.domain)
+	res, err := tx.exec(qd, ap.lpart, ap.domain)
 	if err != nil {
-		if err.Error() == "ErrMdbMboxIsRecip" {
+		if raisedMessage(err) == "ErrMdbMboxIsRecip" {
 			err = ErrMdbMboxIsRecip
 		}
 	} else {
@@ -659,3 +987,74 @@ DELETE FROM vmailbox WHERE id =
 	}
 	return err
 }
+
+// RenameVMailbox
+// Give the mailbox a new address. The address is changed in place so
+// the aliases to it, its credentials, Sieve scripts, vacation and
+// forward stay with it. The new address must not be in use and must be
+// in a vmailbox domain. If keepOld, the old address is made an alias
+// to the new one so mail sent to it still arrives.
+func (tx *Tx) RenameVMailbox(old string, new string, keepOld bool) (*VMailbox, error) {
+	if !tx.active() {
+		return nil, ErrMdbTransaction
+	}
+	vm, err := tx.GetVMailbox(old)
+	if err != nil {
+		return nil, err
+	}
+	np, err := DecodeRFC822(new)
+	if err != nil {
+		return nil, err
+	}
+	if np.IsLocal() {
+		return nil, ErrMdbMboxNoDomain
+	}
+	if np.IsCatchAll() {
+		return nil, ErrMdbCatchAll
+	}
+	if _, err = tx.GetAddress(new); err == nil {
+		return nil, ErrMdbDupAddress
+	} else if err != ErrMdbAddressNotFound {
+		return nil, err
+	}
+	d, err := tx.GetDomain(np.domain)
+	if err == ErrMdbDomainNotFound || (err == nil && !d.IsVmailbox()) {
+		return nil, ErrMdbMboxNotMboxDomain
+	} else if err != nil {
+		return nil, err
+	}
+	oldName := vm.a.Address()
+	newName := np.lpart + "@" + d.Name()
+	if f, err := tx.GetForward(oldName); err == nil {
+		for _, t := range f.Targets() {
+			if strings.EqualFold(t, newName) {
+				return nil, ErrMdbForwardTarget
+			}
+		}
+	} else if err != ErrMdbForwardNotFound {
+		return nil, err
+	}
+	_, err = tx.exec("UPDATE address SET localpart = ?, domain = ? WHERE id = ?",
+		np.lpart, d.Id(), vm.a.Id())
+	if err != nil {
+		if IsErrConstraintUnique(err) {
+			err = ErrMdbDupAddress
+		}
+		return nil, err
+	}
+	// dovecot keys the usage by name, not id
+	_, err = tx.exec("UPDATE quotausage SET username = ? WHERE username = ?", newName, oldName)
+	if err != nil {
+		return nil, err
+	}
+	if keepOld {
+		a, err := tx.InsertAddress(oldName)
+		if err != nil {
+			return nil, err
+		}
+		if err = a.AttachAlias(newName); err != nil {
+			return nil, err
+		}
+	}
+	return tx.GetVMailbox(newName)
+}
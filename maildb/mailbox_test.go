@@ -26,7 +26,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	//"strings"
+	"strings"
 	"testing"
 
 	_ "github.com/mattn/go-sqlite3" // do I really need this here?
@@ -35,6 +35,7 @@ import (
 // TestMailbox
 func TestMailbox(t *testing.T) {
 	var (
+		tx  *Tx
 		err error
 		mdb *MailDB
 		d   *Domain
@@ -56,41 +57,41 @@ func TestMailbox(t *testing.T) {
 	// Test creating a new mailbox with all of the empties and defaults
 	// we first need a real domain so create a few because
 	// we need a domain before we can add mailboxes
-	mdb.Begin()
-	d, err = mdb.InsertDomain("skywalker")
+	tx = beginTx(t, mdb)
+	d, err = tx.InsertDomain("skywalker")
 	if err == nil {
 		err = d.SetClass("vmailbox")
 	}
-	mdb.End(&err)
+	tx.End(&err)
 	if err != nil {
 		t.Errorf("Insert of skywalker failed, %s", err)
 		return
 	}
 
-	mdb.Begin()
-	d, err = mdb.InsertDomain("nowhere")
+	tx = beginTx(t, mdb)
+	d, err = tx.InsertDomain("nowhere")
 	if err != nil {
 		err = d.SetClass("relay") // fodder for busted mailboxes
 	}
-	mdb.End(&err)
+	tx.End(&err)
 	if err != nil {
 		t.Errorf("Insert of nowhere failed, %s", err)
 		return
 	}
 
 	// See if we can create a mailbox in nowhere
-	mdb.Begin()
-	mb, err = mdb.InsertVMailbox("lost@nowhere")
-	mdb.End(&err)
+	tx = beginTx(t, mdb)
+	mb, err = tx.InsertVMailbox("lost@nowhere")
+	tx.End(&err)
 	if err == nil {
 		t.Errorf("Add of lost@nowhere should have failed")
 	} else if err != ErrMdbMboxNotMboxDomain {
 		t.Errorf("Add of lost@nowhere, %s", err)
 	}
 	// see if we can add a user
-	mdb.Begin()
-	mb, err = mdb.InsertVMailbox("luke@skywalker")
-	mdb.End(&err)
+	tx = beginTx(t, mdb)
+	mb, err = tx.InsertVMailbox("luke@skywalker")
+	tx.End(&err)
 	if err != nil {
 		t.Errorf("luke@skywalker: %s", err)
 		return // no sense continuing if we can do this...
@@ -115,8 +116,8 @@ func TestMailbox(t *testing.T) {
 	}
 
 	// Play with it
-	mdb.Begin()
-	if mb, err = mdb.GetVMailbox("luke@skywalker"); err != nil {
+	tx = beginTx(t, mdb)
+	if mb, err = tx.GetVMailbox("luke@skywalker"); err != nil {
 		t.Errorf("Get luke@skywalker failed, %s", err)
 	} else {
 		if err = mb.Disable(); err != nil {
@@ -127,7 +128,7 @@ func TestMailbox(t *testing.T) {
 			}
 		}
 	}
-	mdb.End(&err)
+	tx.End(&err)
 	mb, err = mdb.LookupVMailbox("luke@skywalker")
 	if err != nil {
 		t.Errorf("luke@skywalker after disable, %s", err)
@@ -136,8 +137,8 @@ func TestMailbox(t *testing.T) {
 			t.Errorf("luke@skywalker should be disabled")
 		}
 	}
-	mdb.Begin()
-	if mb, err = mdb.GetVMailbox("luke@skywalker"); err != nil {
+	tx = beginTx(t, mdb)
+	if mb, err = tx.GetVMailbox("luke@skywalker"); err != nil {
 		t.Errorf("Get luke@skywalker failed, %s", err)
 	} else {
 		if err = mb.Enable(); err != nil {
@@ -148,7 +149,7 @@ func TestMailbox(t *testing.T) {
 			}
 		}
 	}
-	mdb.End(&err)
+	tx.End(&err)
 	mb, err = mdb.LookupVMailbox("luke@skywalker")
 	if err != nil {
 		t.Errorf("lookup luke@skywalker after enable, %s", err)
@@ -159,15 +160,15 @@ func TestMailbox(t *testing.T) {
 	}
 
 	// Change password
-	mdb.Begin()
-	if mb, err = mdb.GetVMailbox("luke@skywalker"); err != nil {
+	tx = beginTx(t, mdb)
+	if mb, err = tx.GetVMailbox("luke@skywalker"); err != nil {
 		t.Errorf("Get luke@skywalker failed, %s", err)
 	} else {
 		if err = mb.SetPassword("Not123456"); err != nil {
 			t.Errorf("Set password for luke@skywalker failed, %s", err)
 		}
 	}
-	mdb.End(&err)
+	tx.End(&err)
 	// See if it changes
 	mb, err = mdb.LookupVMailbox("luke@skywalker")
 	if err != nil {
@@ -179,8 +180,8 @@ func TestMailbox(t *testing.T) {
 		}
 	}
 	// Change password and type
-	mdb.Begin()
-	if mb, err = mdb.GetVMailbox("luke@skywalker"); err != nil {
+	tx = beginTx(t, mdb)
+	if mb, err = tx.GetVMailbox("luke@skywalker"); err != nil {
 		t.Errorf("Get luke@skywalker failed, %s", err)
 	} else {
 		if err = mb.SetPassword("Sn3@kyB1ts"); err != nil {
@@ -191,7 +192,7 @@ func TestMailbox(t *testing.T) {
 			}
 		}
 	}
-	mdb.End(&err)
+	tx.End(&err)
 	// See if it changed
 	mb, err = mdb.LookupVMailbox("luke@skywalker")
 	if err != nil {
@@ -208,7 +209,7 @@ func TestMailbox(t *testing.T) {
 	if err = makeAlias(mdb, "rebel@skywalker", luke); err != nil {
 		t.Errorf("Make rebel@skywalker, %s", err)
 	}
-	err = mdb.DeleteVMailbox("luke@skywalker")
+	err = mdb.WithTx(func(tx *Tx) error { return tx.DeleteVMailbox("luke@skywalker") })
 	if err == nil {
 		t.Errorf("First delete of luke@skywalker should have failed")
 	} else {
@@ -216,15 +217,15 @@ func TestMailbox(t *testing.T) {
 			t.Errorf("Delete luke@skywalker, %s", err)
 		}
 	}
-	if err = mdb.RemoveAlias("rebel@skywalker"); err != nil {
+	if err = mdb.WithTx(func(tx *Tx) error { return tx.RemoveAlias("rebel@skywalker") }); err != nil {
 		t.Errorf("remove alias rebel@skywalker, %s", err)
 	}
-	if err = mdb.DeleteVMailbox("luke@skywalker"); err != nil {
+	if err = mdb.WithTx(func(tx *Tx) error { return tx.DeleteVMailbox("luke@skywalker") }); err != nil {
 		t.Errorf("Delete mbox luke@skywalker, %s", err)
 	}
 
 	// Delete a bogus
-	err = mdb.DeleteVMailbox("yoda@skywalker")
+	err = mdb.WithTx(func(tx *Tx) error { return tx.DeleteVMailbox("yoda@skywalker") })
 	if err == nil {
 		t.Errorf("Delete yoda@skywalker should have failed")
 	} else if err != ErrMdbNotMbox {
@@ -232,10 +233,288 @@ func TestMailbox(t *testing.T) {
 	}
 
 	// Clean up by deleting the domains too
-	if err = mdb.DeleteDomain("nowhere"); err != nil {
+	if err = mdb.WithTx(func(tx *Tx) error { return tx.DeleteDomain("nowhere") }); err != nil {
 		t.Errorf("Failed to remove nowhere, %s", err)
 	}
-	if err = mdb.DeleteDomain("skywalker"); err != nil {
+	if err = mdb.WithTx(func(tx *Tx) error { return tx.DeleteDomain("skywalker") }); err != nil {
 		t.Errorf("Failed to remove skywalker, %s", err)
 	}
 }
+
+// TestProtocols
+func TestProtocols(t *testing.T) {
+	var (
+		err error
+		mdb *MailDB
+		dir string
+		mb  *VMailbox
+	)
+
+	fmt.Printf("Mailbox protocols Test\n")
+
+	dir, err = ioutil.TempDir("", "TestProtocols-*")
+	defer os.RemoveAll(dir)
+	mdb, err = makeTestDB(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Errorf("Database load failed, %s", err)
+		return
+	}
+	defer mdb.Close()
+
+	err = mdb.WithTx(func(tx *Tx) error {
+		d, err := tx.InsertDomain("skywalker")
+		if err == nil {
+			err = d.SetClass("vmailbox")
+		}
+		if err == nil {
+			_, err = tx.InsertVMailbox("luke@skywalker")
+		}
+		if err == nil {
+			_, err = tx.InsertVMailbox("leia@skywalker")
+		}
+		return err
+	})
+	if err != nil {
+		t.Errorf("Insert of mailboxes failed, %s", err)
+		return
+	}
+
+	// everything is allowed to start with
+	if mb, err = mdb.LookupVMailbox("luke@skywalker"); err != nil {
+		t.Errorf("Lookup luke@skywalker, %s", err)
+		return
+	}
+	if al := mb.AllowedProtocols(); len(al) != len(MailProtocols) {
+		t.Errorf("luke@skywalker: expected all protocols allowed, got %v", al)
+	}
+	if dl := mb.DeniedProtocols(); len(dl) != 0 {
+		t.Errorf("luke@skywalker: expected no protocols denied, got %v", dl)
+	}
+	if _, err = mb.IsAllowed("gopher"); err != ErrMdbBadProtocol {
+		t.Errorf("IsAllowed gopher: expected ErrMdbBadProtocol, got %v", err)
+	}
+
+	// Deny some
+	err = mdb.WithTx(func(tx *Tx) error {
+		mb, err := tx.GetVMailbox("luke@skywalker")
+		if err != nil {
+			return err
+		}
+		for _, p := range []string{"pop3", "IMAP", "sieve"} {
+			if err = mb.DenyProtocol(p); err != nil {
+				return err
+			}
+		}
+		return mb.AllowProtocol("imap")
+	})
+	if err != nil {
+		t.Errorf("Deny protocols for luke@skywalker, %s", err)
+	}
+	err = mdb.WithTx(func(tx *Tx) error {
+		mb, err := tx.GetVMailbox("luke@skywalker")
+		if err != nil {
+			return err
+		}
+		return mb.DenyProtocol("gopher")
+	})
+	if err != ErrMdbBadProtocol {
+		t.Errorf("Deny gopher: expected ErrMdbBadProtocol, got %v", err)
+	}
+	if mb, err = mdb.LookupVMailbox("luke@skywalker"); err != nil {
+		t.Errorf("Lookup luke@skywalker, %s", err)
+		return
+	}
+	if dl := strings.Join(mb.DeniedProtocols(), ","); dl != "pop3,sieve" {
+		t.Errorf("luke@skywalker: expected pop3,sieve denied, got %s", dl)
+	}
+	if ok, err := mb.IsAllowed("imap"); err != nil || !ok {
+		t.Errorf("luke@skywalker: expected imap allowed, got %v, %v", ok, err)
+	}
+	if ok, err := mb.IsAllowed("pop3"); err != nil || ok {
+		t.Errorf("luke@skywalker: expected pop3 denied, got %v, %v", ok, err)
+	}
+	expected := "luke@skywalker:{PLAIN}*::::::userdb_quota_rule=*:bytes=300M mbox_enabled=true mbox_deny=pop3,sieve"
+	if mb.Export() != expected {
+		t.Errorf("luke@skywalker export: expected %s, got %s", expected, mb.Export())
+	}
+
+	// The deny views follow along. leia is disabled so she is denied everything
+	err = mdb.WithTx(func(tx *Tx) error {
+		mb, err := tx.GetVMailbox("leia@skywalker")
+		if err != nil {
+			return err
+		}
+		return mb.Disable()
+	})
+	if err != nil {
+		t.Errorf("Disable leia@skywalker, %s", err)
+	}
+	denied := map[string]string{
+		"imap":       "leia",
+		"pop3":       "leia,luke",
+		"lmtp":       "leia",
+		"submission": "leia",
+		"smtp":       "leia",
+		"sieve":      "leia,luke",
+	}
+	for svc, users := range denied {
+		var got []string
+
+		rows, err := mdb.db.Query(
+			"SELECT username FROM service_deny WHERE service = ? AND domain = 'skywalker' ORDER BY username",
+			svc)
+		if err != nil {
+			t.Errorf("service_deny %s: %s", svc, err)
+			continue
+		}
+		for rows.Next() {
+			var u string
+			if err = rows.Scan(&u); err != nil {
+				t.Errorf("service_deny %s: %s", svc, err)
+			}
+			got = append(got, u)
+		}
+		rows.Close()
+		if strings.Join(got, ",") != users {
+			t.Errorf("service_deny %s: expected %s, got %v", svc, users, got)
+		}
+	}
+	var cnt int
+	row := mdb.db.QueryRow("SELECT count(*) FROM pop3_deny WHERE username = 'luke' AND deny = 'true'")
+	if err = row.Scan(&cnt); err != nil || cnt != 1 {
+		t.Errorf("pop3_deny luke: expected 1, got %d, %v", cnt, err)
+	}
+	row = mdb.db.QueryRow("SELECT count(*) FROM user_deny")
+	if err = row.Scan(&cnt); err != nil || cnt != 1 {
+		t.Errorf("user_deny: expected only leia, got %d, %v", cnt, err)
+	}
+}
+
+// TestRenameMailbox
+func TestRenameMailbox(t *testing.T) {
+	var (
+		err error
+		mdb *MailDB
+		dir string
+		cnt int
+		vm  *VMailbox
+	)
+
+	fmt.Printf("Rename Mailbox Test\n")
+
+	dir, err = ioutil.TempDir("", "TestRenameMailbox-*")
+	defer os.RemoveAll(dir)
+	mdb, err = makeTestDB(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Errorf("Database load failed, %s", err)
+		return
+	}
+	defer mdb.Close()
+
+	err = mdb.WithTx(func(tx *Tx) error {
+		for _, dn := range []string{"skywalker", "rebels"} {
+			d, err := tx.InsertDomain(dn)
+			if err == nil {
+				err = d.SetClass("vmailbox")
+			}
+			if err != nil {
+				return err
+			}
+		}
+		for _, u := range []string{"luke@skywalker", "leia@skywalker"} {
+			if _, err := tx.InsertVMailbox(u); err != nil {
+				return err
+			}
+		}
+		vm, err := tx.GetVMailbox("luke@skywalker")
+		if err == nil {
+			err = vm.SetQuota("*:bytes=1G")
+		}
+		if err != nil {
+			return err
+		}
+		a, err := tx.GetOrInsAddress("jedi@skywalker")
+		if err == nil {
+			err = a.AttachAlias("luke@skywalker")
+		}
+		if err != nil {
+			return err
+		}
+		_, err = tx.SetForward("leia@skywalker", []string{"leia@rebels"}, true)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Make mailboxes: %s", err)
+	}
+	if _, err = mdb.db.Exec("INSERT INTO quotausage (username, bytes, messages) VALUES (?, ?, ?)",
+		"luke@skywalker", 1024, 2); err != nil {
+		t.Fatalf("Make usage: %s", err)
+	}
+
+	// Move luke to another domain and keep the old address
+	err = mdb.WithTx(func(tx *Tx) error {
+		vm, err = tx.RenameVMailbox("luke@skywalker", "red5@rebels", true)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Rename luke: %s", err)
+	}
+	if vm.User() != "red5@rebels" || vm.Quota() != "*:bytes=1G" {
+		t.Errorf("Rename luke: got %s with quota %s", vm.User(), vm.Quota())
+	}
+	if _, err = mdb.LookupVMailbox("luke@skywalker"); err == nil {
+		t.Errorf("Lookup luke@skywalker: expected it to not be a mailbox")
+	}
+	for _, al := range []string{"jedi", "luke"} {
+		var r string
+		row := mdb.db.QueryRow("SELECT recipient FROM virt_alias WHERE mailbox = ? AND domain_name = ?",
+			al, "skywalker")
+		if err = row.Scan(&r); err != nil || r != "red5@rebels" {
+			t.Errorf("virt_alias %s: expected red5@rebels, got %q, %v", al, r, err)
+		}
+	}
+	if q, err := mdb.LookupQuotaUsage(vm); err != nil || q.Bytes() != 1024 {
+		t.Errorf("Usage of red5@rebels: got %v, %v", q, err)
+	}
+
+	// Mistakes change nothing
+	err = mdb.WithTx(func(tx *Tx) error {
+		for _, c := range []struct {
+			old, new string
+			err      error
+		}{
+			{"leia@skywalker", "red5@rebels", ErrMdbDupAddress},
+			{"leia@skywalker", "jedi@skywalker", ErrMdbDupAddress},
+			{"leia@skywalker", "leia@empire", ErrMdbMboxNotMboxDomain},
+			{"leia@skywalker", "leia", ErrMdbMboxNoDomain},
+			{"leia@skywalker", "leia@rebels", ErrMdbForwardTarget},
+			{"jedi@skywalker", "yoda@skywalker", ErrMdbNotMbox},
+			{"han@skywalker", "han@rebels", ErrMdbAddressNotFound},
+		} {
+			if _, err := tx.RenameVMailbox(c.old, c.new, false); err != c.err {
+				return fmt.Errorf("%s to %s: expected %v, got %v", c.old, c.new, c.err, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Rename mistakes: %s", err)
+	}
+
+	// Leia keeps her forward and does not leave an alias
+	err = mdb.WithTx(func(tx *Tx) error {
+		_, err := tx.RenameVMailbox("leia@skywalker", "leia.organa@skywalker", false)
+		return err
+	})
+	if err != nil {
+		t.Errorf("Rename leia: %s", err)
+	}
+	if f, err := mdb.LookupForward("leia.organa@skywalker"); err != nil ||
+		f.String() != "leia@rebels, leia.organa@skywalker" {
+		t.Errorf("Forward of leia.organa: got %v, %v", f, err)
+	}
+	row := mdb.db.QueryRow("SELECT count(*) FROM address_name WHERE name = 'leia@skywalker'")
+	if err = row.Scan(&cnt); err != nil || cnt != 0 {
+		t.Errorf("leia@skywalker: expected no address, got %d, %v", cnt, err)
+	}
+}
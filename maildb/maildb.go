@@ -21,6 +21,7 @@ package maildb
  */
 
 import (
+	"context"
 	"database/sql"
 	"embed"
 	"errors"
@@ -31,8 +32,8 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
-
-	"github.com/mattn/go-sqlite3" // do I really need this here?
+	"sync"
+	"time"
 )
 
 // Error return constants
@@ -72,12 +73,58 @@ var (
 	ErrMdbIsAlias           = errors.New("New mailbox already an alias")
 	ErrMdbIsMbox            = errors.New("New alias already a mailbox")
 	ErrMdbMboxBadPw         = errors.New("Unrecognized password type")
+	ErrMdbPwEmpty           = errors.New("Password cannot be empty")
+	ErrMdbPwNoHash          = errors.New("Password type cannot be made from cleartext")
+	ErrMdbPwNoVerify        = errors.New("Password type cannot be checked here")
+	ErrMdbPwBadHash         = errors.New("Stored password is not in its type's format")
+	ErrMdbPwTooShort        = errors.New("Password is shorter than the domain allows")
+	ErrMdbPwClasses         = errors.New("Password needs more kinds of characters")
+	ErrMdbPwBanned          = errors.New("Password is in the banned password list")
+	ErrMdbBadPwPolicy       = errors.New("Password policy values must be positive or zero")
+	ErrMdbBadQuota          = errors.New("Badly formatted quota rule")
+	ErrMdbBadProtocol       = errors.New("Unknown mail protocol")
+	ErrMdbCredNotFound      = errors.New("Credential not found")
+	ErrMdbDupCredential     = errors.New("Credential already exists")
+	ErrMdbCredBadLabel      = errors.New("Credential label cannot be empty")
+	ErrMdbSieveNotFound     = errors.New("Sieve script not found")
+	ErrMdbDupSieve          = errors.New("Sieve script already exists")
+	ErrMdbSieveBadName      = errors.New("Sieve script name cannot be empty, have a /, or be active or vacation")
+	ErrMdbBadSieve          = errors.New("Sieve script has errors")
+	ErrMdbVacationNotFound  = errors.New("Vacation not found")
+	ErrMdbDupVacation       = errors.New("Mailbox already has a vacation")
+	ErrMdbVacationNoBody    = errors.New("Vacation message cannot be empty")
+	ErrMdbVacationDates     = errors.New("Vacation cannot end before it starts")
+	ErrMdbVacationDays      = errors.New("Vacation reply interval must be at least one day")
+	ErrMdbForwardNotFound   = errors.New("Mailbox is not forwarded")
+	ErrMdbForwardNoTarget   = errors.New("Forward needs at least one target address")
+	ErrMdbForwardTarget     = errors.New("Forward target must be name@domain and not the mailbox itself")
+	ErrMdbStorageRoot       = errors.New("Vmail root must be an existing directory")
+	ErrMdbStorageOutside    = errors.New("Mail home must be inside the vmail root and not in its trash")
+	ErrMdbStorageExists     = errors.New("Mail storage is already there")
+	ErrMdbStorageShallow    = errors.New("Mail home must be at least two levels into the vmail root, like domain/name")
+	ErrMdbStorageRetention  = errors.New("Trash retention cannot be negative")
+	ErrMdbNotAliasDomain    = errors.New("Domain is not an alias domain")
+	ErrMdbAliasDomTarget    = errors.New("Alias domain target must be another domain that is not an alias domain")
+	ErrMdbAliasDomClass     = errors.New("Alias domain must be an internet or virtual domain")
+	ErrMdbDomainIsTarget    = errors.New("Domain is the target of an alias domain")
+	ErrMdbCatchAll          = errors.New("A catch-all @domain can only be a virtual alias")
 	ErrMdbBadName           = errors.New("Not a correct name")
 	ErrMdbBadClass          = errors.New("Unknown domain class")
 	ErrMdbBadUid            = errors.New("User ID must be unsigned decimal integer")
 	ErrMdbBadGid            = errors.New("Group ID must be unsigned decimal integer")
 	ErrMdbBadUpdate         = errors.New("Update did not happen")
 	ErrMdbMboxIsRecip       = errors.New("Mailbox is an alias recipient")
+	ErrMdbSchemaOld         = errors.New("Database schema is older than this program, run migrate")
+	ErrMdbSchemaNew         = errors.New("Database schema is newer than this program")
+	ErrMdbBadMigration      = errors.New("Badly named migration script")
+	ErrMdbInTransaction     = errors.New("Already in a transaction")
+	ErrMdbBadBackup         = errors.New("Backup failed integrity check")
+	ErrMdbDbBusy            = errors.New("Database is locked by another writer, try again later")
+	ErrMdbNotFile           = errors.New("Database is not a local file")
+	ErrMdbSchemaIncomplete  = errors.New("Schema is missing tables or views")
+	ErrMdbNotOpen           = errors.New("Database not open")
+	ErrMdbNoDefault         = errors.New("Column has no default")
+	ErrMdbDefaultType       = errors.New("Column default is the wrong type")
 )
 
 // Embedded files for database
@@ -90,69 +137,80 @@ var (
 	NullInt = sql.NullInt64{Valid: false}
 )
 
-// Sqlite3 errors we are interested in
+// Database errors we are interested in. Each dialect knows how
+// its driver reports them. Anything else, including our own errors,
+// is not a constraint error.
 
 // IsErrConstraintForeignKey
 // attempting insert with either non-existent ref or
 // delete with refs pointing to it.
 func IsErrConstraintForeignKey(err error) bool {
-	if e, ok := err.(sqlite3.Error); ok {
-		if e.Code == sqlite3.ErrConstraint &&
-			e.ExtendedCode == sqlite3.ErrConstraintForeignKey {
-			return true
-		} else {
-			return false
-		}
-	} else {
-		panic(err)
-	}
+	c, _ := constraintOf(err)
+	return c == constraintForeignKey
 }
 
 // IsErrConstraintUnique
 func IsErrConstraintUnique(err error) bool {
-	if e, ok := err.(sqlite3.Error); ok {
-		if e.Code == sqlite3.ErrConstraint &&
-			e.ExtendedCode == sqlite3.ErrConstraintUnique {
-			return true
-		} else {
-			return false
-		}
-	} else {
-		panic(err)
-	}
+	c, _ := constraintOf(err)
+	return c == constraintUnique
 }
 
 // IsErrConstraintNotNull
 func IsErrConstraintNotNull(err error) bool {
-	if e, ok := err.(sqlite3.Error); ok {
-		if e.Code == sqlite3.ErrConstraint &&
-			e.ExtendedCode == sqlite3.ErrConstraintNotNull {
-			return true
-		} else {
-			return false
-		}
-	} else {
-		panic(err)
-	}
+	c, _ := constraintOf(err)
+	return c == constraintNotNull
 }
 
 // MailDB
 type MailDB struct {
-	db    *sql.DB
-	tx    *sql.Tx
-	dflts map[string]TableInfo
+	db          *sql.DB
+	path        string
+	dialect     dialect
+	mu          sync.Mutex // the rest are shared by concurrent transactions
+	txCount     int        // transactions in progress
+	dflts       map[string]TableInfo
+	audit       *bool // nil until we know if there is an audit trail
+	auditUser   string
+	auditCmd    string
+	busyTimeout time.Duration
+	retry       RetryPolicy
 }
 
 // NewMailDB
 // Sqlite DB open.  ":memory:" for testing...
+// A PostgreSQL DSN, either a postgres:// URL or key=value pairs,
+// opens that instead.
+// The database schema must either match what this program expects
+// or be empty, i.e. a new file waiting for a LoadSchema.
 func NewMailDB(dbPath string) (*MailDB, error) {
+	mdb, err := OpenMailDB(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	if err = mdb.CheckSchema(); err != nil {
+		mdb.Close()
+		return nil, err
+	}
+	return mdb, nil
+}
 
-	db, err := sql.Open("sqlite3", "file:"+dbPath+"?_foreign_keys=on")
+// OpenMailDB
+// Open the database without checking the schema version. This is
+// only for the things that fix the schema, i.e. create and migrate.
+func OpenMailDB(dbPath string) (*MailDB, error) {
+	dl := dialectFor(dbPath)
+	db, err := dl.open(dbPath, DefaultBusyTimeout)
 	if err != nil {
 		return nil, fmt.Errorf("NewMailDB: open, %s", err)
 	}
 	mdb := &MailDB{
-		db: db,
+		db:          db,
+		path:        dbPath,
+		dialect:     dl,
+		auditUser:   loginUser(),
+		auditCmd:    strings.Join(os.Args, " "),
+		busyTimeout: DefaultBusyTimeout,
+		retry:       DefaultRetryPolicy,
 	}
 	mdb.dflts = make(map[string]TableInfo)
 	return mdb, nil
@@ -168,56 +226,18 @@ type TableInfo struct {
 }
 
 // FindDefaults
-// This is deep Sqlite3 magic. The problem is that one can
-// do and INSERT and get a column default (from the schema) for
-// any column un-named in the INSERT. Wouldn't it be also nice to be able to:
+// The problem is that one can do and INSERT and get a column default
+// (from the schema) for any column un-named in the INSERT. Wouldn't it be
+// also nice to be able to:
 //
 //     UPDATE table SET foo = DEFAULT
 //
 // Yes it would but SQL doesn't allow it so everybody does a workaround.
-// Here is how we do it for Sqlite3. We build a map of default fields by
-// doing SELECTs from magic tables and functions. Porting to another DB
-// will require engine specific incantations/supplications to the query god.
+// We build a map of default fields from the engine's catalog. Each dialect
+// has its own engine specific incantations/supplications to the query god.
 func (mdb *MailDB) findDefaults() error {
-	var (
-		info   TableInfo
-		tables []string
-		table  string
-		rows   *sql.Rows
-		err    error
-	)
-
-	rows, err = mdb.db.Query("SELECT name FROM sqlite_master WHERE type = 'table'")
-	if err != nil {
-		return fmt.Errorf("table lookup broke: %s", err)
-	}
-	for rows.Next() {
-		if err = rows.Scan(&table); err != nil {
-			return fmt.Errorf("Table lookup scan failed: %s", err)
-		}
-		tables = append(tables, strings.ToLower(table))
-	}
-	if err = rows.Close(); err != nil {
-		return fmt.Errorf("table lookup scan close broke: %s", err)
-	}
-	for _, table = range tables {
-
-		rows, err = mdb.db.Query("SELECT * FROM pragma_table_info(?)", table)
-		if err != nil {
-			return fmt.Errorf("table_info broke: %s", err)
-		}
-		for rows.Next() {
-			if err = rows.Scan(&info.cid, &info.name, &info.colType,
-				&info.notNull, &info.dflt, &info.pk); err != nil {
-				return fmt.Errorf("table_info scan broke: %s", err)
-			}
-			if info.dflt.Valid { // we are only interested in cols with defaults
-				mdb.dflts[table+"."+info.name] = info
-			}
-		}
-	}
-	if err = rows.Close(); err != nil {
-		return fmt.Errorf("table_info scan close broke: %s", err)
+	if err := mdb.dialect.findDefaults(mdb.db, mdb.dflts); err != nil {
+		return err
 	}
 	if len(mdb.dflts) == 0 {
 		return fmt.Errorf("No defaults found")
@@ -226,83 +246,114 @@ func (mdb *MailDB) findDefaults() error {
 }
 
 // DefaultString
-// We panic() here because an error here means someone has
-// changed/mis-matched to the schema and at that point
-// the best thing to do is crash, not mess up the DB
-func (mdb *MailDB) DefaultString(sym string) string {
-	var (
-		i  TableInfo
-		ok bool
-	)
-
-	if len(mdb.dflts) == 0 {
-		err := mdb.findDefaults()
-		if err != nil {
-			panic(fmt.Errorf("findDefaults: %s", err))
-		}
+// An error here means someone has changed/mis-matched the schema.
+// The caller should not go on and mess up the DB
+func (mdb *MailDB) DefaultString(sym string) (string, error) {
+	i, err := mdb.columnDefault(sym, "TEXT")
+	if err != nil {
+		return "", err
 	}
-	if i, ok = mdb.dflts[sym]; !ok {
-		panic(fmt.Errorf("%s not found", sym))
+	return strings.Trim(i.dflt.String, "'\""), nil // gets stored with the schema quote marks...
+}
+
+// DefaultInt
+func (mdb *MailDB) DefaultInt(sym string) (int64, error) {
+	i, err := mdb.columnDefault(sym, "INTEGER")
+	if err != nil {
+		return 0, err
 	}
-	if i.colType != "TEXT" {
-		panic(fmt.Errorf("DefaultString: %s is %s, should be 'TEXT'", sym, i.colType))
+	num, err := strconv.ParseInt(i.dflt.String, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("DefaultInt: parse of %s(%s) to integer failed, %s",
+			sym, i.dflt.String, err)
 	}
-	return strings.Trim(i.dflt.String, "'\"") // gets stored with the schema quote marks...
+	return num, nil
 }
 
-func (mdb *MailDB) DefaultInt(sym string) int64 {
-	var (
-		i  TableInfo
-		ok bool
-	)
+// columnDefault
+// Look up sym, "table.column", and check that it is colType
+func (mdb *MailDB) columnDefault(sym string, colType string) (TableInfo, error) {
+	mdb.mu.Lock()
+	defer mdb.mu.Unlock()
 
 	if len(mdb.dflts) == 0 {
-		err := mdb.findDefaults()
-		if err != nil {
-			panic(fmt.Errorf("findDefaults: %s", err))
+		if mdb.db == nil {
+			return TableInfo{}, ErrMdbNotOpen
+		}
+		if err := mdb.findDefaults(); err != nil {
+			return TableInfo{}, fmt.Errorf("findDefaults: %s", err)
 		}
 	}
-	if i, ok = mdb.dflts[sym]; !ok {
-		panic(fmt.Errorf("%s not found", sym))
-	}
-	if i.colType != "INTEGER" {
-		panic(fmt.Errorf("DefaultInt: %s is %s, should be 'INTEGER'", sym, i.colType))
+	i, ok := mdb.dflts[sym]
+	if !ok {
+		return TableInfo{}, ErrMdbNoDefault
 	}
-	if num, err := strconv.ParseInt(i.dflt.String, 10, 64); err != nil {
-		panic(fmt.Errorf("DefaultInt: parse of %s(%s) to integer failed, %s",
-			sym, i.dflt.String, err))
-	} else {
-		return num
+	if i.colType != colType {
+		return TableInfo{}, ErrMdbDefaultType
 	}
+	return i, nil
 }
 
 // LoadSchema
 // if the schema name starts with "/" or ".", read from the
-// filesystem otherwise read from the embedded files
+// filesystem otherwise read from the embedded files.
+// A schema from the filesystem must have the tables and views
+// we need. It is checked before anything is done to the database.
 func (mdb *MailDB) LoadSchema(schema string) error {
+	return mdb.LoadSchemaContext(context.Background(), schema)
+}
+
+// LoadSchemaContext
+// LoadSchema that gives up when ctx is done
+func (mdb *MailDB) LoadSchemaContext(ctx context.Context, schema string) error {
 	var (
-		c   []byte
-		err error
+		c     []byte
+		name  = schema
+		stmts []statement
+		err   error
 	)
 	if strings.HasPrefix(schema, "/") || strings.HasPrefix(schema, ".") {
 		c, err = os.ReadFile(schema)
 	} else if schema == "" { // "" uses the default schema from the embedded
-		c, err = DbContent.ReadFile("files/schema.sql")
+		name = mdb.dialect.schemaFile()
+		c, err = DbContent.ReadFile(name)
 	} else {
 		err = fmt.Errorf("schema file name must begin with '/' or '.'")
 	}
 	if err != nil {
 		return fmt.Errorf("LoadSchema: ReadFile, %s", err)
 	}
-	lines := strings.Split(string(c), ";\n")
-	for line, req := range lines {
-		if _, err = mdb.db.Exec(req); err != nil {
-			return fmt.Errorf("loadSchema: line %d: %s, %s", line, req, err)
+	if stmts, err = splitScript(name, string(c)); err != nil {
+		return fmt.Errorf("LoadSchema: %s", err)
+	}
+	if schema != "" {
+		if err = checkSchemaScript(name, stmts); err != nil {
+			return fmt.Errorf("LoadSchema: %s", err)
 		}
 	}
+	// The script has its own BEGIN and COMMIT so it all has to go
+	// down the same connection
+	conn, err := mdb.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("LoadSchema: %s", err)
+	}
+	defer conn.Close()
+	if err = mdb.execStatements(ctx, conn, name, stmts); err != nil {
+		conn.ExecContext(context.Background(), "ROLLBACK") // don't leave it half done
+		return fmt.Errorf("LoadSchema: %s", err)
+	}
+	mdb.mu.Lock()
+	mdb.audit = nil // new schema, look again
+	mdb.mu.Unlock()
 	return nil
 }
 
+// execer
+// sql.DB, sql.Conn, and sql.Tx can all run a script
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
 type Input struct {
 	inFile fs.File
 	stream io.Reader
@@ -345,43 +396,17 @@ func (i *Input) Close() {
 	}
 }
 
-// Begin
-// If a begin() goes bad, we are in serious trouble. Just crash
-func (mdb *MailDB) Begin() {
-	if tx, err := mdb.db.Begin(); err != nil {
-		panic(fmt.Errorf("begin(): failed %s", err))
-	} else {
-		mdb.tx = tx
-	}
-}
-
-// End
-// This is deferred so pass a reference to the error var
-// Commit on no errors, rollback otherwise
-func (mdb *MailDB) End(err *error) {
-	if mdb.tx == nil {
-		panic("End(): not in a transaction")
-	}
-	if *err == nil {
-		if err := mdb.tx.Commit(); err != nil {
-			panic(fmt.Errorf("end(): commit, %s", err)) // we are really screwed
-		}
-	} else {
-		mdb.tx.Rollback()
-	}
-	mdb.tx = nil
-}
-
 // Close
-// This must match a successful NewMailDB or it will panic
+// This must match a successful NewMailDB.
 // best practice is to defer a call here in the same function
 // that did the open
-func (mdb *MailDB) Close() {
+func (mdb *MailDB) Close() error {
 	if mdb.db == nil {
-		panic("mdb.Close called with database not open")
+		return ErrMdbNotOpen
 	}
-	mdb.db.Close()
+	err := mdb.db.Close()
 	mdb.db = nil
+	return err
 }
 
 // QueryRes
@@ -397,11 +422,17 @@ func (r QueryRes) NumColumns() int {
 // Generic query. Used mainly for testing
 // return empty slice for no rows
 func (mdb *MailDB) Query(q string) ([]QueryRes, error) {
+	return mdb.QueryContext(context.Background(), q)
+}
+
+// QueryContext
+// Query that gives up when ctx is done
+func (mdb *MailDB) QueryContext(ctx context.Context, q string) ([]QueryRes, error) {
 	var (
 	//err error
 	//rows
 	)
-	rows, err := mdb.db.Query(q)
+	rows, err := mdb.db.QueryContext(ctx, q)
 	if err != nil {
 		return nil, err
 	}
@@ -76,6 +76,16 @@ func TestDecode(t *testing.T) {
 	} else if err != ErrMdbAddrNoAddr {
 		t.Errorf("+bar@baz: err code, %s", err)
 	}
+	ap, err = DecodeRFC822("@")
+	if err != ErrMdbAddressEmpty {
+		t.Errorf("@: expected ErrMdbAddressEmpty, got %v", err)
+	}
+	if ap, err = DecodeRFC822("@baz"); err != nil || !ap.IsCatchAll() {
+		t.Errorf("@baz: expected a catch-all, got %v", err)
+	}
+	if ap, err = DecodeRFC822("foo@baz"); err != nil || ap.IsCatchAll() {
+		t.Errorf("foo@baz: not a catch-all, got %v", err)
+	}
 }
 
 // TestTarget
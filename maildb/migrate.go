@@ -0,0 +1,289 @@
+package maildb
+
+/*
+ * Copyright (C) 2020, Jim Lieb <lieb@sea-troll.net>
+ *
+ * This program is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 3 of the License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ *
+ * -------------
+ */
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DbSchemaVersion
+// The schema version this program expects. This must match the
+// version inserted by files/schema.sql and the highest numbered
+// script in files/migrations. Bump all three together, and do the
+// same for files/postgres.
+const DbSchemaVersion = 15
+
+// legacySchema
+// The original schema had no schema_version table. If we find its
+// tables but no version we call it this.
+const legacySchema = 1
+
+// Migration
+// An upgrade script from the version before it to Version.
+// Scripts are named NNNN_some_description.sql and must not
+// have their own BEGIN/COMMIT because they all run inside
+// one transaction.
+type Migration struct {
+	version int
+	name    string
+	file    string
+}
+
+// Version
+func (m *Migration) Version() int {
+	return m.version
+}
+
+// Name
+func (m *Migration) Name() string {
+	return m.name
+}
+
+// SchemaRev
+// A row from the schema_version history
+type SchemaRev struct {
+	version     int
+	applied     string
+	description string
+}
+
+// Version
+func (r *SchemaRev) Version() int {
+	return r.version
+}
+
+// Applied
+func (r *SchemaRev) Applied() string {
+	return r.applied
+}
+
+// Description
+func (r *SchemaRev) Description() string {
+	return r.description
+}
+
+// hasTable
+func (mdb *MailDB) hasTable(name string) (bool, error) {
+	return mdb.dialect.hasTable(mdb.db, name)
+}
+
+// SchemaVersion
+// Return the schema version of the database.
+// 0 means an empty database, i.e. no schema loaded yet.
+func (mdb *MailDB) SchemaVersion() (int, error) {
+	var (
+		version sql.NullInt64
+		ok      bool
+		err     error
+	)
+
+	if ok, err = mdb.hasTable("schema_version"); err != nil {
+		return 0, err
+	} else if ok {
+		row := mdb.db.QueryRow("SELECT max(version) FROM schema_version")
+		if err = row.Scan(&version); err != nil {
+			return 0, err
+		}
+		if version.Valid {
+			return int(version.Int64), nil
+		}
+		return legacySchema, nil // a table but no rows. treat as old
+	}
+	if ok, err = mdb.hasTable("address"); err != nil {
+		return 0, err
+	} else if ok {
+		return legacySchema, nil
+	}
+	return 0, nil
+}
+
+// CheckSchema
+// Make sure the database schema is what we expect.
+// An empty database is ok because it is waiting for a schema.
+func (mdb *MailDB) CheckSchema() error {
+	v, err := mdb.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if v == 0 || v == DbSchemaVersion {
+		return nil
+	} else if v < DbSchemaVersion {
+		return ErrMdbSchemaOld
+	} else {
+		return ErrMdbSchemaNew
+	}
+}
+
+// SchemaHistory
+// return the applied schema revisions, oldest first
+func (mdb *MailDB) SchemaHistory() ([]*SchemaRev, error) {
+	var (
+		revs []*SchemaRev
+		ok   bool
+		err  error
+	)
+
+	if ok, err = mdb.hasTable("schema_version"); err != nil || !ok {
+		return nil, err
+	}
+	rows, err := mdb.db.Query(
+		"SELECT version, applied, COALESCE(description, '') FROM schema_version ORDER BY version")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		r := &SchemaRev{}
+		if err = rows.Scan(&r.version, &r.applied, &r.description); err != nil {
+			break
+		}
+		revs = append(revs, r)
+	}
+	if e := rows.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err != nil {
+		return nil, err
+	}
+	return revs, nil
+}
+
+// migrations
+// All the embedded migration scripts for a dialect in version order.
+// A dialect with no migrations yet has no directory.
+func migrations(dl dialect) ([]*Migration, error) {
+	var ml []*Migration
+
+	migrationDir := dl.migrationDir()
+	ents, err := fs.ReadDir(DbContent, migrationDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, e := range ents {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".sql") {
+			continue
+		}
+		base := strings.TrimSuffix(e.Name(), ".sql")
+		i := strings.Index(base, "_")
+		if i < 1 {
+			return nil, ErrMdbBadMigration
+		}
+		v, err := strconv.Atoi(base[:i])
+		if err != nil {
+			return nil, ErrMdbBadMigration
+		}
+		ml = append(ml, &Migration{
+			version: v,
+			name:    strings.ReplaceAll(base[i+1:], "_", " "),
+			file:    path.Join(migrationDir, e.Name()),
+		})
+	}
+	sort.Slice(ml, func(i, j int) bool { return ml[i].version < ml[j].version })
+	return ml, nil
+}
+
+// PendingMigrations
+// The migrations needed to bring this database up to DbSchemaVersion
+func (mdb *MailDB) PendingMigrations() ([]*Migration, error) {
+	var pending []*Migration
+
+	v, err := mdb.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	if v == 0 {
+		return nil, nil // nothing there to migrate
+	}
+	if v > DbSchemaVersion {
+		return nil, ErrMdbSchemaNew
+	}
+	ml, err := migrations(mdb.dialect)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range ml {
+		if m.version > v && m.version <= DbSchemaVersion {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate
+// Apply all the pending migrations inside one transaction.
+// If dryRun, do all the work and then roll it back. Either way,
+// return the list of migrations that were (or would be) applied.
+func (mdb *MailDB) Migrate(dryRun bool) ([]*Migration, error) {
+	return mdb.MigrateContext(context.Background(), dryRun)
+}
+
+// MigrateContext
+// Migrate that gives up, and rolls back, when ctx is done
+func (mdb *MailDB) MigrateContext(ctx context.Context, dryRun bool) ([]*Migration, error) {
+	var (
+		pending []*Migration
+		c       []byte
+		err     error
+	)
+
+	if pending, err = mdb.PendingMigrations(); err != nil || len(pending) == 0 {
+		return nil, err
+	}
+	tx, err := mdb.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range pending {
+		if c, err = DbContent.ReadFile(m.file); err != nil {
+			break
+		}
+		if err = mdb.execScript(ctx, tx, m.file, string(c)); err != nil {
+			err = fmt.Errorf("Migrate: %s", err)
+			break
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO schema_version (version, description) VALUES (?, ?)",
+			m.version, m.name)
+		if err != nil {
+			break
+		}
+	}
+	if err != nil || dryRun {
+		tx.Rollback()
+	} else {
+		err = tx.Commit()
+		mdb.mu.Lock()
+		mdb.audit = nil // the schema changed
+		mdb.mu.Unlock()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
@@ -0,0 +1,539 @@
+package maildb
+
+/*
+ * Copyright (C) 2020, Jim Lieb <lieb@sea-troll.net>
+ *
+ * This program is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 3 of the License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ *
+ * -------------
+ */
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// downgrades
+// The statements that take a fresh database back to the version
+// before the key for the migrations that cannot be run over the
+// current schema, e.g. ALTER TABLE ADD COLUMN. The legacy database
+// in TestMigrate is made by running these from the newest down.
+var downgrades = map[int][]string{
+	14: {
+		"DROP TRIGGER del_cred_login", "DROP TABLE credentiallogin",
+	},
+	12: {
+		"DROP TRIGGER audit_alias_domain_insert", "DROP TRIGGER audit_alias_domain_update",
+		"DROP TRIGGER audit_alias_domain_delete", "DROP TABLE aliasdomain",
+		"DROP TRIGGER after_addr_del",
+		`CREATE TRIGGER after_addr_del AFTER DELETE ON address
+ WHEN OLD.domain IS NOT NULL
+    AND (SELECT class FROM domain WHERE id = OLD.domain) != 4
+    AND (SELECT count(*) FROM address WHERE domain = OLD.domain) < 1
+ BEGIN
+  DELETE FROM domain WHERE id = OLD.domain; END`,
+	},
+	11: {
+		"DROP TRIGGER audit_forward_insert", "DROP TRIGGER audit_forward_update",
+		"DROP TRIGGER audit_forward_delete", "DROP TRIGGER audit_forward_target_insert",
+		"DROP TRIGGER audit_forward_target_delete", "DROP TABLE forwardtarget",
+		"DROP TABLE forward", "DROP VIEW virt_alias",
+	},
+	10: {
+		"DROP TRIGGER audit_vacation_insert", "DROP TRIGGER audit_vacation_update",
+		"DROP TRIGGER audit_vacation_delete", "DROP TABLE vacation",
+	},
+	9: {
+		"DROP VIEW user_sieve", "DROP TRIGGER audit_sieve_insert",
+		"DROP TRIGGER audit_sieve_update", "DROP TRIGGER audit_sieve_delete",
+		"DROP TABLE sievescript",
+	},
+	8: {
+		"DROP VIEW user_quota", "DROP VIEW user_credential",
+		"DROP VIEW service_deny", "DROP VIEW imap_deny", "DROP VIEW pop3_deny",
+		"DROP VIEW lmtp_deny", "DROP VIEW submission_deny", "DROP VIEW sieve_deny",
+		"DROP VIEW user_deny", "DROP VIEW user_mailbox",
+		"DROP TRIGGER audit_domain_insert", "DROP TRIGGER audit_domain_update",
+		"DROP TRIGGER audit_domain_delete",
+		"ALTER TABLE domain DROP COLUMN quota",
+	},
+	7: {
+		"DROP VIEW IF EXISTS user_quota", "DROP TRIGGER del_mbox_quota",
+		"DROP TABLE quotausage",
+	},
+	6: {
+		"DROP VIEW IF EXISTS user_credential",
+		"DROP VIEW IF EXISTS service_deny", "DROP VIEW IF EXISTS imap_deny",
+		"DROP VIEW IF EXISTS pop3_deny", "DROP VIEW IF EXISTS lmtp_deny",
+		"DROP VIEW IF EXISTS submission_deny", "DROP VIEW IF EXISTS sieve_deny",
+		"DROP VIEW IF EXISTS user_deny", "DROP VIEW IF EXISTS user_mailbox",
+		"DROP TRIGGER IF EXISTS audit_domain_insert",
+		"DROP TRIGGER IF EXISTS audit_domain_update",
+		"DROP TRIGGER IF EXISTS audit_domain_delete",
+		"DROP TRIGGER audit_vmailbox_insert", "DROP TRIGGER audit_vmailbox_update",
+		"DROP TRIGGER audit_vmailbox_delete",
+		"ALTER TABLE domain DROP COLUMN pw_max_age",
+		"ALTER TABLE domain DROP COLUMN pw_min_length",
+		"ALTER TABLE domain DROP COLUMN pw_min_classes",
+		"ALTER TABLE vmailbox DROP COLUMN pw_set",
+		"ALTER TABLE vmailbox DROP COLUMN pw_max_age",
+		"DROP TABLE bannedpassword",
+	},
+	5: {
+		"DROP VIEW IF EXISTS user_credential", "DROP VIEW credential_service",
+		"DROP TRIGGER audit_credential_insert", "DROP TRIGGER audit_credential_update",
+		"DROP TRIGGER audit_credential_delete",
+		"DROP TABLE credential",
+	},
+	4: {
+		"DROP VIEW IF EXISTS service_deny", "DROP VIEW IF EXISTS imap_deny",
+		"DROP VIEW IF EXISTS pop3_deny", "DROP VIEW IF EXISTS lmtp_deny",
+		"DROP VIEW IF EXISTS submission_deny", "DROP VIEW IF EXISTS sieve_deny",
+		"DROP TRIGGER IF EXISTS audit_vmailbox_insert",
+		"DROP TRIGGER IF EXISTS audit_vmailbox_update",
+		"DROP TRIGGER IF EXISTS audit_vmailbox_delete",
+		"DROP VIEW IF EXISTS user_mailbox",
+		`CREATE VIEW "user_mailbox" AS
+		 SELECT mb.id AS id, a.localpart AS username, d.name AS domain,
+		        '{' || mb.pw_type || '}' || COALESCE(mb.password, '*') AS password,
+		        mb.uid AS uid, mb.gid AS gid, COALESCE(mb.home, '') AS home,
+		        COALESCE(mb.quota, '*:bytes=0') AS quota_rule, mb.enable AS enable
+		 FROM VMailbox AS mb JOIN address AS a ON (a.id = mb.id)
+		      JOIN domain AS d ON (a.domain = d.id)`,
+		"ALTER TABLE vmailbox DROP COLUMN allow_imap",
+		"ALTER TABLE vmailbox DROP COLUMN allow_pop3",
+		"ALTER TABLE vmailbox DROP COLUMN allow_lmtp",
+		"ALTER TABLE vmailbox DROP COLUMN allow_submission",
+		"ALTER TABLE vmailbox DROP COLUMN allow_sieve",
+	},
+}
+
+// downgrade
+// Take a fresh database back to legacySchema
+func downgrade(mdb *MailDB) error {
+	for v := DbSchemaVersion; v > legacySchema; v-- {
+		for _, s := range downgrades[v] {
+			if _, err := mdb.db.Exec(s); err != nil {
+				return fmt.Errorf("downgrade %d: %s, %s", v, s, err)
+			}
+		}
+	}
+	return nil
+}
+
+// schemaObjects
+// the views, triggers, and indexes along with their SQL and the
+// columns and foreign keys of each table. The SQL of a table is
+// left out because ALTER TABLE edits it.
+func schemaObjects(mdb *MailDB) (map[string]string, error) {
+	objs := make(map[string]string)
+
+	rows, err := mdb.db.Query(
+		"SELECT type, name, CASE type WHEN 'table' THEN '' ELSE COALESCE(sql, '') END " +
+			"FROM sqlite_master WHERE name NOT LIKE 'sqlite_%'")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var oType, name, sql string
+
+		if err = rows.Scan(&oType, &name, &sql); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		objs[oType+":"+name] = sql
+	}
+	if err = rows.Close(); err != nil {
+		return nil, err
+	}
+	rows, err = mdb.db.Query(
+		"SELECT m.name, p.name, p.type, p.\"notnull\", COALESCE(p.dflt_value, '') " +
+			"FROM sqlite_master AS m JOIN pragma_table_info(m.name) AS p " +
+			"WHERE m.type = 'table' AND m.name NOT LIKE 'sqlite_%'")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var table, col, cType, dflt string
+		var notNull int
+
+		if err = rows.Scan(&table, &col, &cType, &notNull, &dflt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		objs["column:"+table+"."+col] = fmt.Sprintf("%s %d %s", cType, notNull, dflt)
+	}
+	if err = rows.Close(); err != nil {
+		return nil, err
+	}
+	rows, err = mdb.db.Query(
+		"SELECT m.name, p.id, p.seq, p.\"table\", p.\"from\", COALESCE(p.\"to\", ''), p.on_delete " +
+			"FROM sqlite_master AS m JOIN pragma_foreign_key_list(m.name) AS p " +
+			"WHERE m.type = 'table' AND m.name NOT LIKE 'sqlite_%'")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var table, ref, from, to, onDelete string
+		var id, seq int
+
+		if err = rows.Scan(&table, &id, &seq, &ref, &from, &to, &onDelete); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		objs[fmt.Sprintf("fkey:%s.%d.%d", table, id, seq)] =
+			fmt.Sprintf("%s %s %s %s", from, ref, to, onDelete)
+	}
+	if err = rows.Close(); err != nil {
+		return nil, err
+	}
+	return objs, nil
+}
+
+// TestMigrate
+func TestMigrate(t *testing.T) {
+	var (
+		err     error
+		mdb     *MailDB
+		dir     string
+		v       int
+		applied []*Migration
+	)
+
+	fmt.Printf("Schema migrate test\n")
+
+	dir, err = ioutil.TempDir("", "TestMigrate-*")
+	defer os.RemoveAll(dir)
+
+	// An empty database has no version and is ok to open
+	emptyFile := filepath.Join(dir, "empty.db")
+	if mdb, err = NewMailDB(emptyFile); err != nil {
+		t.Errorf("Open of empty DB: unexpected error, %s", err)
+		return
+	}
+	if v, err = mdb.SchemaVersion(); err != nil || v != 0 {
+		t.Errorf("Empty DB: expected version 0, got %d (%v)", v, err)
+	}
+	if applied, err = mdb.Migrate(false); err != nil || len(applied) != 0 {
+		t.Errorf("Empty DB: expected nothing to migrate, got %d (%v)", len(applied), err)
+	}
+	mdb.Close()
+
+	// A fresh database is at the current version
+	freshFile := filepath.Join(dir, "fresh.db")
+	mdb, err = makeTestDB(freshFile)
+	if err != nil {
+		t.Errorf("Fresh DB: %s", err)
+		return
+	}
+	if v, err = mdb.SchemaVersion(); err != nil || v != DbSchemaVersion {
+		t.Errorf("Fresh DB: expected version %d, got %d (%v)", DbSchemaVersion, v, err)
+	}
+	if err = mdb.CheckSchema(); err != nil {
+		t.Errorf("Fresh DB: unexpected schema check error, %s", err)
+	}
+	if applied, err = mdb.Migrate(false); err != nil || len(applied) != 0 {
+		t.Errorf("Fresh DB: expected nothing to migrate, got %d (%v)", len(applied), err)
+	}
+	fresh, err := schemaObjects(mdb)
+	if err != nil {
+		t.Errorf("Fresh DB: schema objects, %s", err)
+		return
+	}
+	mdb.Close()
+
+	// Fake up a database from before we had versions
+	legacyFile := filepath.Join(dir, "legacy.db")
+	mdb, err = makeTestDB(legacyFile)
+	if err != nil {
+		t.Errorf("Legacy DB: %s", err)
+		return
+	}
+	if _, err = mdb.db.Exec("DROP TABLE schema_version"); err != nil {
+		t.Errorf("Legacy DB: drop schema_version, %s", err)
+		return
+	}
+	if err = downgrade(mdb); err != nil {
+		t.Errorf("Legacy DB: %s", err)
+		return
+	}
+	mdb.Close()
+	if _, err = NewMailDB(legacyFile); err != ErrMdbSchemaOld {
+		t.Errorf("Legacy DB: expected ErrMdbSchemaOld, got %v", err)
+	}
+	if mdb, err = OpenMailDB(legacyFile); err != nil {
+		t.Errorf("Legacy DB: open, %s", err)
+		return
+	}
+	defer mdb.Close()
+	if v, err = mdb.SchemaVersion(); err != nil || v != legacySchema {
+		t.Errorf("Legacy DB: expected version %d, got %d (%v)", legacySchema, v, err)
+	}
+	pending, err := mdb.PendingMigrations()
+	if err != nil || len(pending) != DbSchemaVersion-legacySchema {
+		t.Errorf("Legacy DB: expected %d pending, got %d (%v)",
+			DbSchemaVersion-legacySchema, len(pending), err)
+	}
+
+	// A dry run does the work but leaves the database alone
+	if applied, err = mdb.Migrate(true); err != nil {
+		t.Errorf("Legacy DB: dry run, %s", err)
+	} else if len(applied) != len(pending) {
+		t.Errorf("Legacy DB: dry run expected %d, got %d", len(pending), len(applied))
+	}
+	if v, err = mdb.SchemaVersion(); err != nil || v != legacySchema {
+		t.Errorf("Legacy DB: dry run changed version to %d (%v)", v, err)
+	}
+
+	// Now do it for real
+	if applied, err = mdb.Migrate(false); err != nil {
+		t.Errorf("Legacy DB: migrate, %s", err)
+	} else if len(applied) != len(pending) {
+		t.Errorf("Legacy DB: migrate expected %d, got %d", len(pending), len(applied))
+	}
+	if err = mdb.CheckSchema(); err != nil {
+		t.Errorf("Legacy DB: schema check after migrate, %s", err)
+	}
+	migrated, err := schemaObjects(mdb)
+	if err != nil {
+		t.Errorf("Legacy DB: schema objects, %s", err)
+		return
+	}
+	for k, s := range fresh {
+		if m, ok := migrated[k]; !ok {
+			t.Errorf("Migrated DB: missing %s", k)
+		} else if m != s {
+			t.Errorf("Migrated DB: %s differs, expected %s, got %s", k, s, m)
+		}
+	}
+	for k := range migrated {
+		if _, ok := fresh[k]; !ok {
+			t.Errorf("Migrated DB: unexpected %s", k)
+		}
+	}
+	hist, err := mdb.SchemaHistory()
+	if err != nil || len(hist) != len(pending) {
+		t.Errorf("Migrated DB: expected %d history rows, got %d (%v)", len(pending), len(hist), err)
+	}
+
+	// A database from the future is refused
+	if _, err = mdb.db.Exec("INSERT INTO schema_version (version) VALUES (?)",
+		DbSchemaVersion+1); err != nil {
+		t.Errorf("Future DB: insert, %s", err)
+		return
+	}
+	if err = mdb.CheckSchema(); err != ErrMdbSchemaNew {
+		t.Errorf("Future DB: expected ErrMdbSchemaNew, got %v", err)
+	}
+	if _, err = mdb.Migrate(false); err != ErrMdbSchemaNew {
+		t.Errorf("Future DB: migrate expected ErrMdbSchemaNew, got %v", err)
+	}
+}
+
+// v1Data
+// Rows that fit the original schema, and so every one after it
+var v1Data = []string{
+	"INSERT INTO access (id, name, action) VALUES (1, 'block', 'REJECT')",
+	"INSERT INTO transport (id, name, transport, nexthop) VALUES (1, 'relay', 'smtp', '[mx.example.net]')",
+	"INSERT INTO domain (id, name, class, transport, access) VALUES (1, 'pobox.org', 4, 1, 1)",
+	"INSERT INTO domain (id, name, class) VALUES (2, 'example.com', 3)",
+	"INSERT INTO address (id, localpart, domain) VALUES (1, 'jeff', 1)",
+	"INSERT INTO address (id, localpart, domain, access) VALUES (2, 'dave', 1, 1)",
+	"INSERT INTO address (id, localpart, domain) VALUES (3, 'sales', 2)",
+	"INSERT INTO address (id, localpart, domain) VALUES (4, 'root', NULL)",
+	"INSERT INTO vmailbox (id, pw_type, password, quota) VALUES (1, 'SHA256', 'XohImNooBHFR0OVvjcYpJ3NgPQ1qq73WKhHvch0VQtg=', '*:bytes=1G')",
+	"INSERT INTO vmailbox (id, password, uid, gid, home, enable) VALUES (2, 'secret', 2000, 2000, 'dave', 0)",
+	"INSERT INTO alias (id, address, target) VALUES (1, 3, 1)",
+	"INSERT INTO alias (id, address, target) VALUES (2, 3, 2)",
+	"INSERT INTO alias (id, address, target) VALUES (3, 4, 1)",
+	"INSERT INTO alias (id, address, extension) VALUES (4, 4, '/dev/null')",
+}
+
+// tableRows
+// Every row of the tables we both have, by column name because
+// ALTER TABLE puts the new columns at the end. The audit trail and
+// the version history are what the schema load and migrate add.
+func tableRows(mdb *MailDB) (map[string][]string, error) {
+	var tables []string
+
+	rows, err := mdb.db.Query("SELECT name FROM sqlite_master WHERE type = 'table' " +
+		"AND name NOT LIKE 'sqlite_%' AND lower(name) NOT IN ('audit', 'schema_version')")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tables = append(tables, name)
+	}
+	if err = rows.Close(); err != nil {
+		return nil, err
+	}
+	data := make(map[string][]string)
+	for _, table := range tables {
+		rows, err := mdb.db.Query("SELECT * FROM \"" + table + "\"")
+		if err != nil {
+			return nil, err
+		}
+		cols, err := rows.Columns()
+		for err == nil && rows.Next() {
+			vals := make([]interface{}, len(cols))
+			ptrs := make([]interface{}, len(cols))
+			for i := range vals {
+				ptrs[i] = &vals[i]
+			}
+			if err = rows.Scan(ptrs...); err != nil {
+				break
+			}
+			var fields []string
+			for i, c := range cols {
+				if b, ok := vals[i].([]byte); ok {
+					vals[i] = string(b)
+				}
+				fields = append(fields, fmt.Sprintf("%s=%v", strings.ToLower(c), vals[i]))
+			}
+			sort.Strings(fields)
+			data[table] = append(data[table], strings.Join(fields, " "))
+		}
+		if e := rows.Close(); e != nil && err == nil {
+			err = e
+		}
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(data[table])
+	}
+	return data, nil
+}
+
+// TestMigrateV1
+// A database made by the original schema.sql, not one faked by the
+// downgrades, comes out of all the migrations the same as a fresh one
+func TestMigrateV1(t *testing.T) {
+	fmt.Printf("Schema migrate from v1 test\n")
+
+	dir, err := ioutil.TempDir("", "TestMigrateV1-*")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fresh, err := makeTestDB(filepath.Join(dir, "fresh.db"))
+	if err != nil {
+		t.Fatalf("Fresh DB: %s", err)
+	}
+	defer fresh.Close()
+
+	v1, err := NewMailDB(filepath.Join(dir, "v1.db"))
+	if err != nil {
+		t.Fatalf("V1 DB: %s", err)
+	}
+	defer v1.Close()
+	script, err := ioutil.ReadFile("testdata/schema_v1.sql")
+	if err != nil {
+		t.Fatalf("V1 DB: %s", err)
+	}
+	stmts, err := splitScript("schema_v1.sql", string(script))
+	if err == nil {
+		err = v1.execStatements(context.Background(), v1.db, "schema_v1.sql", stmts)
+	}
+	if err != nil {
+		t.Fatalf("V1 DB: load schema, %s", err)
+	}
+	for _, s := range v1Data {
+		if _, err = v1.db.Exec(s); err != nil {
+			t.Fatalf("V1 DB: %s, %s", s, err)
+		}
+		if _, err = fresh.db.Exec(s); err != nil {
+			t.Fatalf("Fresh DB: %s, %s", s, err)
+		}
+	}
+	if v, err := v1.SchemaVersion(); err != nil || v != legacySchema {
+		t.Fatalf("V1 DB: expected version %d, got %d (%v)", legacySchema, v, err)
+	}
+
+	applied, err := v1.Migrate(false)
+	if err != nil {
+		t.Fatalf("V1 DB: migrate, %s", err)
+	} else if len(applied) != DbSchemaVersion-legacySchema {
+		t.Errorf("V1 DB: expected %d migrations, got %d", DbSchemaVersion-legacySchema, len(applied))
+	}
+	if err = v1.CheckSchema(); err != nil {
+		t.Errorf("V1 DB: schema check after migrate, %s", err)
+	}
+
+	want, err := schemaObjects(fresh)
+	if err != nil {
+		t.Fatalf("Fresh DB: schema objects, %s", err)
+	}
+	got, err := schemaObjects(v1)
+	if err != nil {
+		t.Fatalf("V1 DB: schema objects, %s", err)
+	}
+	for k, s := range want {
+		if m, ok := got[k]; !ok {
+			t.Errorf("V1 DB: missing %s", k)
+		} else if m != s {
+			t.Errorf("V1 DB: %s differs, expected %s, got %s", k, s, m)
+		}
+	}
+	for k := range got {
+		if _, ok := want[k]; !ok {
+			t.Errorf("V1 DB: unexpected %s", k)
+		}
+	}
+
+	// The password age migration starts the clock on the passwords it finds
+	var unset int
+	err = v1.db.QueryRow("SELECT count(*) FROM vmailbox " +
+		"WHERE password IS NOT NULL AND pw_set IS NULL").Scan(&unset)
+	if err != nil {
+		t.Fatalf("V1 DB: pw_set, %s", err)
+	} else if unset != 0 {
+		t.Errorf("V1 DB: expected pw_set on every password, %d without", unset)
+	}
+	if _, err = v1.db.Exec("UPDATE vmailbox SET pw_set = NULL"); err != nil {
+		t.Fatalf("V1 DB: clear pw_set, %s", err)
+	}
+
+	wantRows, err := tableRows(fresh)
+	if err != nil {
+		t.Fatalf("Fresh DB: rows, %s", err)
+	}
+	gotRows, err := tableRows(v1)
+	if err != nil {
+		t.Fatalf("V1 DB: rows, %s", err)
+	}
+	for table, rl := range wantRows {
+		if strings.Join(gotRows[table], "\n") != strings.Join(rl, "\n") {
+			t.Errorf("V1 DB: %s rows differ, expected\n%s\ngot\n%s",
+				table, strings.Join(rl, "\n"), strings.Join(gotRows[table], "\n"))
+		}
+	}
+	for table := range gotRows {
+		if _, ok := wantRows[table]; !ok {
+			t.Errorf("V1 DB: unexpected table %s", table)
+		}
+	}
+}
@@ -0,0 +1,705 @@
+package maildb
+
+/*
+ * Copyright (C) 2020, Jim Lieb <lieb@sea-troll.net>
+ *
+ * This program is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 3 of the License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ *
+ * -------------
+ */
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Dovecot stores a password as "{SCHEME}encoded". The vmailbox table keeps
+// the two parts in pw_type and password and the user_mailbox view puts them
+// back together. The schemes here are the ones dovecot's "doveadm pw" makes
+// and we make them the same way so dovecot can check them.
+
+// DefaultPwScheme
+// What a cleartext password is hashed with if nobody says otherwise
+const DefaultPwScheme = "SHA512-CRYPT"
+
+// pwSchemes
+// The password types we know about, how to make each one from cleartext
+// and how to check cleartext against it. CRYPT is whatever crypt(3)
+// makes. It can be imported but we don't make it. check looks at the
+// form of an encoded password without the cost of verifying it.
+var pwSchemes = map[string]struct {
+	hash     func(clear string) (string, error)
+	verify   func(encoded string, clear string) (bool, error)
+	check    func(encoded string) error
+	strength PwStrength
+}{
+	"PLAIN":        {plainHash, plainVerify, nil, PwPlain},
+	"CRYPT":        {nil, cryptVerify, cryptCheck, PwWeak},
+	"SHA256":       {sha256Hash, sha256Verify, sha256Check, PwWeak},
+	"SSHA512":      {ssha512Hash, ssha512Verify, ssha512Check, PwWeak},
+	"PBKDF2":       {pbkdf2Hash, pbkdf2Verify, pbkdf2Check, PwWeak},
+	"SHA512-CRYPT": {sha512CryptHash, cryptVerify, sha512CryptCheck, PwStrong},
+	"BLF-CRYPT":    {blfCryptHash, blfCryptVerify, blfCryptCheck, PwStrong},
+	"ARGON2ID":     {argon2idHash, argon2idVerify, argon2idCheck, PwStrong},
+}
+
+// PwStrength
+// How hard a stored password is to crack if the database gets out
+type PwStrength int
+
+const (
+	PwNone   PwStrength = iota // no password, nobody can log in
+	PwPlain                    // cleartext
+	PwWeak                     // a fast or unsalted hash, or one we don't know
+	PwStrong                   // a slow, salted hash
+)
+
+// pwStrengthName
+var pwStrengthName = map[PwStrength]string{
+	PwNone:   "none",
+	PwPlain:  "plain",
+	PwWeak:   "weak",
+	PwStrong: "strong",
+}
+
+// String
+func (s PwStrength) String() string {
+	if n, ok := pwStrengthName[s]; ok {
+		return n
+	}
+	return "unknown"
+}
+
+// PasswordStrength
+// The strength of a password stored with pwType. The fast hashes are
+// weak because they can be tried by the billion on a GPU.
+func PasswordStrength(pwType string) PwStrength {
+	if ps, ok := pwSchemes[strings.ToUpper(pwType)]; ok {
+		return ps.strength
+	}
+	return PwWeak
+}
+
+// PwSchemes
+// The names of the password types we can hash a cleartext password with
+func PwSchemes() []string {
+	return []string{"SHA512-CRYPT", "BLF-CRYPT", "ARGON2ID", "PBKDF2", "SSHA512", "SHA256", "PLAIN"}
+}
+
+// pwScheme
+// The name of the scheme the way dovecot spells it
+func pwScheme(scheme string) (string, error) {
+	s := strings.ToUpper(strings.TrimSpace(scheme))
+	if _, ok := pwSchemes[s]; !ok {
+		return "", ErrMdbMboxBadPw
+	}
+	return s, nil
+}
+
+// HashPassword
+// Hash the cleartext password with scheme and return it in
+// dovecot's "{SCHEME}encoded" form
+func HashPassword(scheme string, clear string) (string, error) {
+	s, pw, err := hashPassword(scheme, clear)
+	if err != nil {
+		return "", err
+	}
+	return "{" + s + "}" + pw, nil
+}
+
+// hashPassword
+// The scheme's name and the hashed password, separately for the vmailbox table
+func hashPassword(scheme string, clear string) (string, string, error) {
+	s, err := pwScheme(scheme)
+	if err != nil {
+		return "", "", err
+	}
+	if clear == "" {
+		return "", "", ErrMdbPwEmpty
+	}
+	gen := pwSchemes[s].hash
+	if gen == nil {
+		return "", "", ErrMdbPwNoHash
+	}
+	pw, err := gen(clear)
+	if err != nil {
+		return "", "", fmt.Errorf("HashPassword: %s, %s", s, err)
+	}
+	return s, pw, nil
+}
+
+// VerifyPassword
+// Check clear against a password stored as encoded with pwType,
+// the way dovecot does when someone logs in
+func VerifyPassword(pwType string, encoded string, clear string) (bool, error) {
+	s, err := pwScheme(pwType)
+	if err != nil {
+		return false, err
+	}
+	ok, err := pwSchemes[s].verify(encoded, clear)
+	if err != nil {
+		return false, fmt.Errorf("VerifyPassword: %s, %w", s, err)
+	}
+	return ok, nil
+}
+
+// checkPasswordHash
+// Is encoded in the form pwType stores? Dovecot can't use one that isn't
+// and it would only turn up when someone tries to log in.
+func checkPasswordHash(pwType string, encoded string) error {
+	s, err := pwScheme(pwType)
+	if err != nil {
+		return err
+	}
+	if check := pwSchemes[s].check; check != nil {
+		return check(encoded)
+	}
+	return nil
+}
+
+// decodeDigest
+// dovecot stores digests in base64. Like dovecot, we take hex too if it is
+// the right length for a digest of size bytes. A salted one has no size.
+func decodeDigest(encoded string, size int) ([]byte, error) {
+	if size > 0 && len(encoded) == 2*size {
+		if b, err := hex.DecodeString(encoded); err == nil {
+			return b, nil
+		}
+	}
+	b, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrMdbPwBadHash
+	}
+	return b, nil
+}
+
+// cryptAlphabet
+// The base 64 digits of crypt(3), not the same order as RFC 4648
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// makeSalt
+// n random characters from the crypt alphabet
+func makeSalt(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = cryptAlphabet[int(b[i])%len(cryptAlphabet)]
+	}
+	return string(b), nil
+}
+
+// genAlphabet
+// Lower case letters and digits without the ones that look alike
+const genAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+// GeneratePassword
+// A random password for a credential, four groups of four characters,
+// e.g. "k7pm-x2qa-9dnf-tw3e". It is easy to type on a phone and has
+// almost 80 bits of randomness.
+func GeneratePassword() (string, error) {
+	var (
+		pw strings.Builder
+		n  int
+	)
+
+	// take only the bytes below the largest multiple of the
+	// alphabet size so every character is equally likely
+	limit := 256 - 256%len(genAlphabet)
+	b := make([]byte, 32)
+	for n < 16 {
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		for i := 0; i < len(b) && n < 16; i++ {
+			if int(b[i]) >= limit {
+				continue
+			}
+			if n > 0 && n%4 == 0 {
+				pw.WriteByte('-')
+			}
+			pw.WriteByte(genAlphabet[int(b[i])%len(genAlphabet)])
+			n++
+		}
+	}
+	return pw.String(), nil
+}
+
+// plainHash
+// No hash at all
+func plainHash(clear string) (string, error) {
+	return clear, nil
+}
+
+// plainVerify
+func plainVerify(encoded string, clear string) (bool, error) {
+	return subtle.ConstantTimeCompare([]byte(encoded), []byte(clear)) == 1, nil
+}
+
+// sha256Hash
+// An unsalted SHA256 digest, base64 encoded
+func sha256Hash(clear string) (string, error) {
+	sum := sha256.Sum256([]byte(clear))
+	return base64.StdEncoding.EncodeToString(sum[:]), nil
+}
+
+// sha256Decode
+func sha256Decode(encoded string) ([]byte, error) {
+	d, err := decodeDigest(encoded, sha256.Size)
+	if err != nil || len(d) != sha256.Size {
+		return nil, ErrMdbPwBadHash
+	}
+	return d, nil
+}
+
+// sha256Check
+func sha256Check(encoded string) error {
+	_, err := sha256Decode(encoded)
+	return err
+}
+
+// sha256Verify
+func sha256Verify(encoded string, clear string) (bool, error) {
+	d, err := sha256Decode(encoded)
+	if err != nil {
+		return false, err
+	}
+	sum := sha256.Sum256([]byte(clear))
+	return subtle.ConstantTimeCompare(d, sum[:]) == 1, nil
+}
+
+// ssha512Hash
+// A salted SHA512 digest with the salt after it, base64 encoded
+func ssha512Hash(clear string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(ssha512(clear, salt)), nil
+}
+
+// ssha512
+func ssha512(clear string, salt []byte) []byte {
+	h := sha512.New()
+	h.Write([]byte(clear))
+	h.Write(salt)
+	return append(h.Sum(nil), salt...)
+}
+
+// ssha512Decode
+// The salt is whatever is after the digest
+func ssha512Decode(encoded string) ([]byte, error) {
+	d, err := decodeDigest(encoded, 0)
+	if err != nil || len(d) <= sha512.Size {
+		return nil, ErrMdbPwBadHash
+	}
+	return d, nil
+}
+
+// ssha512Check
+func ssha512Check(encoded string) error {
+	_, err := ssha512Decode(encoded)
+	return err
+}
+
+// ssha512Verify
+func ssha512Verify(encoded string, clear string) (bool, error) {
+	d, err := ssha512Decode(encoded)
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(d, ssha512(clear, d[sha512.Size:])) == 1, nil
+}
+
+// SHA512-CRYPT is the "$6$" scheme of glibc's crypt(3), described in
+// https://www.akkadia.org/drepper/SHA-crypt.txt
+
+const (
+	sha512CryptRounds    = 5000 // the default, not written into our hashes
+	sha512CryptMinRounds = 1000
+	sha512CryptMaxRounds = 999999999
+	sha512CryptSaltLen   = 16
+)
+
+// sha512CryptHash
+func sha512CryptHash(clear string) (string, error) {
+	salt, err := makeSalt(sha512CryptSaltLen)
+	if err != nil {
+		return "", err
+	}
+	return sha512Crypt(clear, salt, 0), nil
+}
+
+// sha512CryptDecode
+// The salt and rounds of a "$6$" hash. A rounds of 0 is the default.
+func sha512CryptDecode(encoded string) (string, int, error) {
+	f := strings.Split(encoded, "$")
+	if len(f) < 4 || f[0] != "" || f[1] != "6" {
+		return "", 0, ErrMdbPwBadHash
+	}
+	rounds := 0
+	salt := f[2]
+	if strings.HasPrefix(salt, "rounds=") {
+		if len(f) != 5 {
+			return "", 0, ErrMdbPwBadHash
+		}
+		r, err := strconv.Atoi(strings.TrimPrefix(salt, "rounds="))
+		if err != nil {
+			return "", 0, ErrMdbPwBadHash
+		}
+		rounds, salt = r, f[3]
+	} else if len(f) != 4 {
+		return "", 0, ErrMdbPwBadHash
+	}
+	return salt, rounds, nil
+}
+
+// sha512CryptCheck
+func sha512CryptCheck(encoded string) error {
+	_, _, err := sha512CryptDecode(encoded)
+	return err
+}
+
+// cryptCheck
+// The ones we can't verify can't be checked either
+func cryptCheck(encoded string) error {
+	switch {
+	case strings.HasPrefix(encoded, "$6$"):
+		return sha512CryptCheck(encoded)
+	case strings.HasPrefix(encoded, "$2"):
+		return blfCryptCheck(encoded)
+	}
+	return nil
+}
+
+// cryptVerify
+// crypt(3) says which one it is with the $id$ at the front. We do
+// the two that dovecot makes, $6$ and bcrypt, not the old DES or MD5 ones.
+func cryptVerify(encoded string, clear string) (bool, error) {
+	switch {
+	case strings.HasPrefix(encoded, "$6$"):
+		salt, rounds, err := sha512CryptDecode(encoded)
+		if err != nil {
+			return false, err
+		}
+		h := sha512Crypt(clear, salt, rounds)
+		return subtle.ConstantTimeCompare([]byte(h), []byte(encoded)) == 1, nil
+	case strings.HasPrefix(encoded, "$2"):
+		return blfCryptVerify(encoded, clear)
+	}
+	return false, ErrMdbPwNoVerify
+}
+
+// sha512CryptPerm
+// The order the bytes of the final digest are encoded in
+var sha512CryptPerm = [...][3]int{
+	{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+	{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+	{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+	{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+	{62, 20, 41},
+}
+
+// sha512Crypt
+// The "$6$[rounds=N$]salt$hash" string for clear. A rounds of 0 is the
+// default and is not written out. Any other is, even 5000, the way
+// crypt(3) keeps the "rounds=N$" it was given in the salt.
+func sha512Crypt(clear string, salt string, rounds int) string {
+	var out strings.Builder
+
+	key := []byte(clear)
+	explicit := rounds != 0
+	if len(salt) > sha512CryptSaltLen {
+		salt = salt[:sha512CryptSaltLen]
+	}
+	if !explicit {
+		rounds = sha512CryptRounds
+	} else if rounds < sha512CryptMinRounds {
+		rounds = sha512CryptMinRounds
+	} else if rounds > sha512CryptMaxRounds {
+		rounds = sha512CryptMaxRounds
+	}
+
+	// digest B, key salt key
+	h := sha512.New()
+	h.Write(key)
+	h.Write([]byte(salt))
+	h.Write(key)
+	b := h.Sum(nil)
+
+	// digest A, key salt and then B and key depending on the key length
+	h.Reset()
+	h.Write(key)
+	h.Write([]byte(salt))
+	i := len(key)
+	for ; i > 64; i -= 64 {
+		h.Write(b)
+	}
+	h.Write(b[:i])
+	for i = len(key); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(key)
+		}
+	}
+	c := h.Sum(nil)
+
+	// P, the key hashed once for each of its bytes
+	h.Reset()
+	for range key {
+		h.Write(key)
+	}
+	p := repeatTo(h.Sum(nil), len(key))
+
+	// S, the salt hashed 16 + A[0] times
+	h.Reset()
+	for i = 0; i < 16+int(c[0]); i++ {
+		h.Write([]byte(salt))
+	}
+	s := repeatTo(h.Sum(nil), len(salt))
+
+	for i = 0; i < rounds; i++ {
+		h.Reset()
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(s)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(p)
+		}
+		c = h.Sum(c[:0])
+	}
+
+	out.WriteString("$6$")
+	if explicit {
+		fmt.Fprintf(&out, "rounds=%d$", rounds)
+	}
+	out.WriteString(salt)
+	out.WriteByte('$')
+	for _, t := range sha512CryptPerm {
+		crypt64(&out, uint(c[t[0]])<<16|uint(c[t[1]])<<8|uint(c[t[2]]), 4)
+	}
+	crypt64(&out, uint(c[63]), 2)
+	return out.String()
+}
+
+// repeatTo
+// d repeated, and cut, to n bytes
+func repeatTo(d []byte, n int) []byte {
+	r := make([]byte, 0, n)
+	for len(r) < n {
+		r = append(r, d...)
+	}
+	return r[:n]
+}
+
+// crypt64
+// n characters of w, low 6 bits first
+func crypt64(out *strings.Builder, w uint, n int) {
+	for ; n > 0; n-- {
+		out.WriteByte(cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+}
+
+// blfCryptHash
+// bcrypt, dovecot's BLF-CRYPT
+func blfCryptHash(clear string) (string, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(clear), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(h), nil
+}
+
+// blfCryptCheck
+func blfCryptCheck(encoded string) error {
+	if _, err := bcrypt.Cost([]byte(encoded)); err != nil {
+		return ErrMdbPwBadHash
+	}
+	return nil
+}
+
+// blfCryptVerify
+func blfCryptVerify(encoded string, clear string) (bool, error) {
+	switch err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(clear)); err {
+	case nil:
+		return true, nil
+	case bcrypt.ErrMismatchedHashAndPassword:
+		return false, nil
+	default:
+		return false, ErrMdbPwBadHash
+	}
+}
+
+// ARGON2ID is in the PHC string format dovecot gets from libsodium,
+// "$argon2id$v=19$m=65536,t=3,p=1$salt$hash" with unpadded base64.
+
+const (
+	argon2idMemory  = 64 * 1024 // KiB
+	argon2idTime    = 3
+	argon2idThreads = 1
+	argon2idSaltLen = 16
+	argon2idKeyLen  = 32
+
+	// The most a stored hash can make one verify use. Well past
+	// anything dovecot is set up to make, well short of taking the host down.
+	argon2idMaxMemory = 1024 * 1024 // KiB
+	argon2idMaxTime   = 64
+)
+
+// argon2idHash
+func argon2idHash(clear string) (string, error) {
+	salt := make([]byte, argon2idSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(clear), salt, argon2idTime, argon2idMemory, argon2idThreads, argon2idKeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argon2idMemory, argon2idTime, argon2idThreads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// argon2idParams
+// What an ARGON2ID hash was made with
+type argon2idParams struct {
+	m, t uint32
+	p    uint8
+	salt []byte
+	key  []byte
+}
+
+// argon2idDecode
+// argon2.IDKey panics on a time of 0 or less memory than 8 KiB a
+// thread so those, and ones too big to be worth trying, are bad.
+func argon2idDecode(encoded string) (*argon2idParams, error) {
+	var (
+		v       int
+		m, t, p uint32
+	)
+
+	f := strings.Split(encoded, "$")
+	if len(f) != 6 || f[0] != "" || f[1] != "argon2id" {
+		return nil, ErrMdbPwBadHash
+	}
+	if _, err := fmt.Sscanf(f[2]+" "+f[3], "v=%d m=%d,t=%d,p=%d", &v, &m, &t, &p); err != nil ||
+		v != argon2.Version || p < 1 || p > 255 {
+		return nil, ErrMdbPwBadHash
+	}
+	if t < 1 || t > argon2idMaxTime || m < 8*p || m > argon2idMaxMemory {
+		return nil, ErrMdbPwBadHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(f[4])
+	if err != nil {
+		return nil, ErrMdbPwBadHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(f[5])
+	if err != nil || len(key) == 0 {
+		return nil, ErrMdbPwBadHash
+	}
+	return &argon2idParams{m: m, t: t, p: uint8(p), salt: salt, key: key}, nil
+}
+
+// argon2idCheck
+func argon2idCheck(encoded string) error {
+	_, err := argon2idDecode(encoded)
+	return err
+}
+
+// argon2idVerify
+// The parameters are the ones it was made with, not ours
+func argon2idVerify(encoded string, clear string) (bool, error) {
+	a, err := argon2idDecode(encoded)
+	if err != nil {
+		return false, err
+	}
+	k := argon2.IDKey([]byte(clear), a.salt, a.t, a.m, a.p, uint32(len(a.key)))
+	return subtle.ConstantTimeCompare(k, a.key) == 1, nil
+}
+
+// PBKDF2 is dovecot's "$1$salt$rounds$hex" with HMAC-SHA1
+
+const (
+	pbkdf2Rounds  = 5000
+	pbkdf2SaltLen = 16
+)
+
+// pbkdf2Hash
+func pbkdf2Hash(clear string) (string, error) {
+	salt, err := makeSalt(pbkdf2SaltLen)
+	if err != nil {
+		return "", err
+	}
+	key := pbkdf2.Key([]byte(clear), []byte(salt), pbkdf2Rounds, sha1.Size, sha1.New)
+	return "$1$" + salt + "$" + strconv.Itoa(pbkdf2Rounds) + "$" + hex.EncodeToString(key), nil
+}
+
+// pbkdf2Decode
+// The salt, rounds, and key of a PBKDF2 hash
+func pbkdf2Decode(encoded string) (string, int, []byte, error) {
+	f := strings.Split(encoded, "$")
+	if len(f) != 5 || f[0] != "" || f[1] != "1" {
+		return "", 0, nil, ErrMdbPwBadHash
+	}
+	rounds, err := strconv.Atoi(f[3])
+	if err != nil || rounds < 1 {
+		return "", 0, nil, ErrMdbPwBadHash
+	}
+	key, err := hex.DecodeString(f[4])
+	if err != nil || len(key) == 0 {
+		return "", 0, nil, ErrMdbPwBadHash
+	}
+	return f[2], rounds, key, nil
+}
+
+// pbkdf2Check
+func pbkdf2Check(encoded string) error {
+	_, _, _, err := pbkdf2Decode(encoded)
+	return err
+}
+
+// pbkdf2Verify
+func pbkdf2Verify(encoded string, clear string) (bool, error) {
+	salt, rounds, key, err := pbkdf2Decode(encoded)
+	if err != nil {
+		return false, err
+	}
+	k := pbkdf2.Key([]byte(clear), []byte(salt), rounds, len(key), sha1.New)
+	return subtle.ConstantTimeCompare(k, key) == 1, nil
+}
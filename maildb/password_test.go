@@ -0,0 +1,386 @@
+package maildb
+
+/*
+ * Copyright (C) 2020, Jim Lieb <lieb@sea-troll.net>
+ *
+ * This program is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 3 of the License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ *
+ * -------------
+ */
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// TestPassword
+// Hashing cleartext passwords the way dovecot does
+func TestPassword(t *testing.T) {
+	var (
+		err error
+		mdb *MailDB
+		dir string
+		d   *Domain
+		mb  *VMailbox
+		tx  *Tx
+	)
+
+	fmt.Printf("Password test\n")
+
+	// Examples from the SHA-crypt spec and glibc crypt(3)
+	vectors := []struct {
+		clear  string
+		salt   string
+		rounds int
+		hash   string
+	}{
+		{"Hello world!", "saltstring", 0,
+			"$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+		{"This is just a test", "toolongsaltstring", 5000,
+			"$6$rounds=5000$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0"},
+		{"Hello world!", "saltstringsaltstring", 10000,
+			"$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v."},
+		{"we have a short salt string but not a short password", "anotherlongsaltstring", 1400,
+			"$6$rounds=1400$anotherlongsalts$AP.vbZcNbWD30OfPAcUJe702LINHtb7RqILoLW9vJ/DHPMJyr6a.5rQHcOzBXuDOEzAqm8/9xW6EF/z3vOBQp0"},
+		{"the minimum number is still observed", "roundstoolow", 10,
+			"$6$rounds=1000$roundstoolow$kUMsbe306n21p9R.FRkW3IGn.S9NPN0x50YhH1xhLsPuWGsUSklZt58jaTfF4ZEQpyUNGc0dqbpBYYBaHHrsX."},
+	}
+	for _, v := range vectors {
+		if h := sha512Crypt(v.clear, v.salt, v.rounds); h != v.hash {
+			t.Errorf("sha512Crypt: %q, expected %s, got %s", v.clear, v.hash, h)
+		}
+	}
+
+	// Each scheme in its dovecot form and it checks out against the cleartext
+	clear := "Sn3@kyB1ts"
+	for _, s := range PwSchemes() {
+		h, err := HashPassword(strings.ToLower(s), clear)
+		if err != nil {
+			t.Errorf("HashPassword: %s, unexpected error, %s", s, err)
+			continue
+		}
+		prefix := "{" + s + "}"
+		if !strings.HasPrefix(h, prefix) {
+			t.Errorf("HashPassword: %s, expected %s prefix, got %s", s, prefix, h)
+			continue
+		}
+		if !checkHash(t, s, h[len(prefix):], clear) {
+			t.Errorf("HashPassword: %s, %s does not match the cleartext", s, h)
+		}
+		if checkHash(t, s, h[len(prefix):], "not"+clear) {
+			t.Errorf("HashPassword: %s, %s matches the wrong cleartext", s, h)
+		}
+		if s != "PLAIN" && s != "SHA256" { // salted, never the same twice
+			if h2, _ := HashPassword(s, clear); h2 == h {
+				t.Errorf("HashPassword: %s, expected a different salt, got %s twice", s, h)
+			}
+		}
+	}
+	if _, err = HashPassword("md5", clear); err != ErrMdbMboxBadPw {
+		t.Errorf("HashPassword: expected %s for md5, got %v", ErrMdbMboxBadPw, err)
+	}
+	if _, err = HashPassword("crypt", clear); err != ErrMdbPwNoHash {
+		t.Errorf("HashPassword: expected %s for crypt, got %v", ErrMdbPwNoHash, err)
+	}
+	if _, err = HashPassword("sha512-crypt", ""); err != ErrMdbPwEmpty {
+		t.Errorf("HashPassword: expected %s for empty password, got %v", ErrMdbPwEmpty, err)
+	}
+
+	// And into a mailbox
+	dir, err = ioutil.TempDir("", "TestPassword-*")
+	defer os.RemoveAll(dir)
+	mdb, err = makeTestDB(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatalf("Database load failed, %s", err)
+	}
+	defer mdb.Close()
+
+	tx = beginTx(t, mdb)
+	if d, err = tx.InsertDomain("skywalker"); err == nil {
+		if err = d.SetClass("vmailbox"); err == nil {
+			if mb, err = tx.InsertVMailbox("luke@skywalker"); err == nil {
+				err = mb.HashPassword("", clear)
+			}
+		}
+	}
+	tx.End(&err)
+	if err != nil {
+		t.Fatalf("Mailbox luke@skywalker: unexpected error, %s", err)
+	}
+	if mb, err = mdb.LookupVMailbox("luke@skywalker"); err != nil {
+		t.Fatalf("Lookup luke@skywalker: unexpected error, %s", err)
+	}
+	if mb.PwType() != DefaultPwScheme {
+		t.Errorf("HashPassword: expected %s type, got %s", DefaultPwScheme, mb.PwType())
+	}
+	if !strings.HasPrefix(mb.Password(), "$6$") || !checkHash(t, mb.PwType(), mb.Password(), clear) {
+		t.Errorf("HashPassword: expected a SHA512-CRYPT hash, got %s", mb.Password())
+	}
+
+	tx = beginTx(t, mdb)
+	if mb, err = tx.GetVMailbox("luke@skywalker"); err == nil {
+		if err = mb.HashPassword("argon2id", clear); err == nil {
+			err = mb.HashPassword("crypt", clear)
+		}
+	}
+	if err != ErrMdbPwNoHash {
+		t.Errorf("HashPassword: expected %s for crypt, got %v", ErrMdbPwNoHash, err)
+	}
+	err = nil
+	tx.End(&err)
+	if mb, err = mdb.LookupVMailbox("luke@skywalker"); err != nil {
+		t.Fatalf("Lookup luke@skywalker: unexpected error, %s", err)
+	}
+	if mb.PwType() != "ARGON2ID" || !strings.HasPrefix(mb.Password(), "$argon2id$v=19$m=65536,t=3,p=1$") {
+		t.Errorf("HashPassword: expected an ARGON2ID hash, got {%s}%s", mb.PwType(), mb.Password())
+	}
+}
+
+// checkHash
+// Does the hash match clear? This is the other side of each hash,
+// done with what is in the spec for it.
+func checkHash(t *testing.T, scheme string, hash string, clear string) bool {
+	switch scheme {
+	case "PLAIN":
+		return hash == clear
+	case "SHA256":
+		h, _ := sha256Hash(clear)
+		return hash == h
+	case "SSHA512":
+		b, err := base64.StdEncoding.DecodeString(hash)
+		if err != nil || len(b) <= 64 {
+			t.Errorf("SSHA512: bad hash %s, %v", hash, err)
+			return false
+		}
+		return bytes.Equal(b, ssha512(clear, b[64:]))
+	case "SHA512-CRYPT":
+		f := strings.Split(hash, "$")
+		if len(f) != 4 {
+			t.Errorf("SHA512-CRYPT: bad hash %s", hash)
+			return false
+		}
+		return hash == sha512Crypt(clear, f[2], 0)
+	case "BLF-CRYPT":
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(clear)) == nil
+	case "ARGON2ID":
+		var (
+			v       int
+			m, i, p uint32
+		)
+		f := strings.Split(hash, "$")
+		if len(f) != 6 || f[1] != "argon2id" {
+			t.Errorf("ARGON2ID: bad hash %s", hash)
+			return false
+		}
+		if _, err := fmt.Sscanf(f[2]+" "+f[3], "v=%d m=%d,t=%d,p=%d", &v, &m, &i, &p); err != nil {
+			t.Errorf("ARGON2ID: bad parameters %s, %s", hash, err)
+			return false
+		}
+		salt, _ := base64.RawStdEncoding.DecodeString(f[4])
+		key, _ := base64.RawStdEncoding.DecodeString(f[5])
+		return bytes.Equal(key, argon2.IDKey([]byte(clear), salt, i, m, uint8(p), uint32(len(key))))
+	case "PBKDF2":
+		f := strings.Split(hash, "$")
+		if len(f) != 5 || f[1] != "1" {
+			t.Errorf("PBKDF2: bad hash %s", hash)
+			return false
+		}
+		rounds, err := strconv.Atoi(f[3])
+		if err != nil {
+			t.Errorf("PBKDF2: bad rounds %s", hash)
+			return false
+		}
+		return f[4] == hex.EncodeToString(pbkdf2.Key([]byte(clear), []byte(f[2]), rounds, sha1.Size, sha1.New))
+	}
+	t.Errorf("checkHash: no check for %s", scheme)
+	return false
+}
+
+// TestVerifyPassword
+// Checking a password against what is stored, for each scheme
+func TestVerifyPassword(t *testing.T) {
+	var (
+		err error
+		mdb *MailDB
+		dir string
+		d   *Domain
+		mb  *VMailbox
+		tx  *Tx
+		ok  bool
+	)
+
+	fmt.Printf("Verify password test\n")
+
+	clear := "Sn3@kyB1ts"
+	for _, s := range PwSchemes() {
+		h, err := HashPassword(s, clear)
+		if err != nil {
+			t.Errorf("HashPassword: %s, unexpected error, %s", s, err)
+			continue
+		}
+		h = strings.TrimPrefix(h, "{"+s+"}")
+		if ok, err = VerifyPassword(strings.ToLower(s), h, clear); err != nil || !ok {
+			t.Errorf("VerifyPassword: %s, expected a match for %s, got %v, %v", s, h, ok, err)
+		}
+		if ok, err = VerifyPassword(s, h, clear+"x"); err != nil || ok {
+			t.Errorf("VerifyPassword: %s, expected no match for %s, got %v, %v", s, h, ok, err)
+		}
+	}
+
+	// Ones made elsewhere
+	tests := []struct {
+		pwType  string
+		encoded string
+		clear   string
+		ok      bool
+		err     error
+	}{
+		{"SHA512-CRYPT", "$6$rounds=1000$roundstoolow$kUMsbe306n21p9R.FRkW3IGn.S9NPN0x50YhH1xhLsPuWGsUSklZt58jaTfF4ZEQpyUNGc0dqbpBYYBaHHrsX.",
+			"the minimum number is still observed", true, nil},
+		{"SHA512-CRYPT", "$6$rounds=5000$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0",
+			"This is just a test", true, nil},
+		{"CRYPT", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1",
+			"Hello world!", true, nil},
+		{"CRYPT", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1",
+			"Hello world", false, nil},
+		{"CRYPT", "abJnggxhB/yWI", "password", false, ErrMdbPwNoVerify}, // DES
+		{"SHA256", "XohImNooBHFR0OVvjcYpJ3NgPQ1qq73WKhHvch0VQtg=", "password", true, nil},
+		{"SHA256", "5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8", "password", true, nil},
+		{"SHA256", "c2hvcnQ=", "password", false, ErrMdbPwBadHash},
+		{"PBKDF2", "$1$salt$4096$4b007901b765489abead49d926f721d065a429c1", "password", true, nil}, // RFC 6070
+		{"PBKDF2", "$1$salt$4096$4b007901b765489abead49d926f721d065a429c1", "Password", false, nil},
+		{"PBKDF2", "$1$salt$many$4b00", "password", false, ErrMdbPwBadHash},
+		{"SHA512-CRYPT", "$6$rounds=lots$salt$hash", "password", false, ErrMdbPwBadHash},
+		{"ARGON2ID", "$argon2id$v=19$m=65536$nope", "password", false, ErrMdbPwBadHash},
+		{"ARGON2ID", "$argon2id$v=19$m=65536,t=0,p=1$c2FsdHNhbHQ$aGFzaGhhc2g", "password", false, ErrMdbPwBadHash},
+		{"ARGON2ID", "$argon2id$v=19$m=15,t=3,p=2$c2FsdHNhbHQ$aGFzaGhhc2g", "password", false, ErrMdbPwBadHash},
+		{"ARGON2ID", "$argon2id$v=19$m=0,t=3,p=1$c2FsdHNhbHQ$aGFzaGhhc2g", "password", false, ErrMdbPwBadHash},
+		{"ARGON2ID", "$argon2id$v=19$m=4194304,t=3,p=1$c2FsdHNhbHQ$aGFzaGhhc2g", "password", false, ErrMdbPwBadHash},
+		{"ARGON2ID", "$argon2id$v=19$m=65536,t=100000,p=1$c2FsdHNhbHQ$aGFzaGhhc2g", "password", false, ErrMdbPwBadHash},
+		{"ARGON2ID", "$argon2id$v=19$m=16,t=1,p=2$c2FsdHNhbHQ$aGFzaGhhc2g", "password", false, nil},
+		{"BLF-CRYPT", "$2y$10$tooshort", "password", false, ErrMdbPwBadHash},
+		{"PLAIN", "password", "password", true, nil},
+		{"MD5", "whatever", "password", false, ErrMdbMboxBadPw},
+	}
+	for _, test := range tests {
+		ok, err = VerifyPassword(test.pwType, test.encoded, test.clear)
+		if !errors.Is(err, test.err) {
+			t.Errorf("VerifyPassword: {%s}%s, expected error %v, got %v", test.pwType, test.encoded, test.err, err)
+		} else if ok != test.ok {
+			t.Errorf("VerifyPassword: {%s}%s, expected %v, got %v", test.pwType, test.encoded, test.ok, ok)
+		}
+	}
+
+	// The same ones are checked for their form before they are stored.
+	// What can't be verified can't be checked either.
+	for _, test := range tests {
+		want := test.err
+		if want == ErrMdbPwNoVerify {
+			want = nil
+		}
+		if err = checkPasswordHash(test.pwType, test.encoded); err != want {
+			t.Errorf("checkPasswordHash: {%s}%s, expected %v, got %v", test.pwType, test.encoded, want, err)
+		}
+	}
+
+	// How strong they are
+	for pwType, want := range map[string]PwStrength{
+		"PLAIN": PwPlain, "sha256": PwWeak, "SSHA512": PwWeak, "PBKDF2": PwWeak, "CRYPT": PwWeak,
+		"MD5": PwWeak, "SHA512-CRYPT": PwStrong, "blf-crypt": PwStrong, "ARGON2ID": PwStrong,
+	} {
+		if s := PasswordStrength(pwType); s != want {
+			t.Errorf("PasswordStrength: %s, expected %s, got %s", pwType, want, s)
+		}
+	}
+
+	// And what is in a mailbox
+	dir, err = ioutil.TempDir("", "TestVerifyPassword-*")
+	defer os.RemoveAll(dir)
+	mdb, err = makeTestDB(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatalf("Database load failed, %s", err)
+	}
+	defer mdb.Close()
+
+	tx = beginTx(t, mdb)
+	if d, err = tx.InsertDomain("skywalker"); err == nil {
+		if err = d.SetClass("vmailbox"); err == nil {
+			if _, err = tx.InsertVMailbox("leia@skywalker"); err == nil {
+				if mb, err = tx.InsertVMailbox("luke@skywalker"); err == nil {
+					err = mb.HashPassword("blf-crypt", clear)
+				}
+			}
+		}
+	}
+	tx.End(&err)
+	if err != nil {
+		t.Fatalf("Mailboxes: unexpected error, %s", err)
+	}
+	if mb, err = mdb.LookupVMailbox("luke@skywalker"); err != nil {
+		t.Fatalf("Lookup luke@skywalker: unexpected error, %s", err)
+	}
+	if mb.Domain() != "skywalker" || mb.PwStrength() != PwStrong {
+		t.Errorf("luke@skywalker: expected a strong password in skywalker, got %s in %s", mb.PwStrength(), mb.Domain())
+	}
+	if ok, err = mb.VerifyPassword(clear); err != nil || !ok {
+		t.Errorf("luke@skywalker: expected a match, got %v, %v", ok, err)
+	}
+	if ok, err = mb.VerifyPassword("guess"); err != nil || ok {
+		t.Errorf("luke@skywalker: expected no match, got %v, %v", ok, err)
+	}
+	if mb, err = mdb.LookupVMailbox("leia@skywalker"); err != nil {
+		t.Fatalf("Lookup leia@skywalker: unexpected error, %s", err)
+	}
+	if mb.PwStrength() != PwNone {
+		t.Errorf("leia@skywalker: expected no password, got %s", mb.PwStrength())
+	}
+	if ok, err = mb.VerifyPassword(""); err != nil || ok {
+		t.Errorf("leia@skywalker: expected nothing to match no password, got %v, %v", ok, err)
+	}
+
+	// An encoded password has to be in its type's form to be stored
+	for _, pwType := range []string{"ARGON2ID", "BLF-CRYPT", "PBKDF2", "SHA512-CRYPT", "SSHA512", "SHA256"} {
+		tx = beginTx(t, mdb)
+		if mb, err = tx.GetVMailbox("leia@skywalker"); err == nil {
+			if err = mb.SetPwType(pwType); err == nil {
+				err = mb.SetPassword("junk")
+			}
+		}
+		tx.End(&err)
+		if err != ErrMdbPwBadHash {
+			t.Errorf("leia@skywalker: {%s}junk, expected %s, got %v", pwType, ErrMdbPwBadHash, err)
+		}
+	}
+	if mb, err = mdb.LookupVMailbox("leia@skywalker"); err != nil {
+		t.Fatalf("Lookup leia@skywalker: unexpected error, %s", err)
+	}
+	if mb.PwStrength() != PwNone {
+		t.Errorf("leia@skywalker: expected the junk passwords to be rolled back, got %s", mb.PwStrength())
+	}
+}
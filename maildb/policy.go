@@ -0,0 +1,193 @@
+package maildb
+
+/*
+ * Copyright (C) 2020, Jim Lieb <lieb@sea-troll.net>
+ *
+ * This program is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 3 of the License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ *
+ * -------------
+ */
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A domain's password policy is its minimum length and number of
+// character classes. The banned password list is for everybody.
+// Only cleartext can be checked so an already hashed password
+// that is imported or set with a type gets by.
+
+// pwClasses
+// How many of lower case, upper case, digits and everything
+// else are in clear
+func pwClasses(clear string) int64 {
+	var lower, upper, digit, other int64
+
+	for _, r := range clear {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	return lower + upper + digit + other
+}
+
+// Check
+// Does clear meet the policy? This doesn't look at the banned list.
+func (p PwPolicy) Check(clear string) error {
+	if p.MinLength > 0 && int64(utf8.RuneCountInString(clear)) < p.MinLength {
+		return ErrMdbPwTooShort
+	}
+	if p.MinClasses > 0 && pwClasses(clear) < p.MinClasses {
+		return ErrMdbPwClasses
+	}
+	return nil
+}
+
+// checkPassword
+// Can clear be a password of a mailbox in d?
+func (tx *Tx) checkPassword(d *Domain, clear string) error {
+	if d != nil {
+		if err := d.PwPolicy().Check(clear); err != nil {
+			return err
+		}
+	}
+	banned, err := tx.IsBannedPassword(clear)
+	if err != nil {
+		return err
+	}
+	if banned {
+		return ErrMdbPwBanned
+	}
+	return nil
+}
+
+// CheckPassword
+// Would clear be accepted as the password of user's mailbox?
+func (tx *Tx) CheckPassword(user string, clear string) error {
+	mb, err := tx.GetVMailbox(user)
+	if err != nil {
+		return err
+	}
+	return tx.checkPassword(mb.a.d, clear)
+}
+
+// IsBannedPassword
+// Is clear in the banned list? Case doesn't matter.
+func (tx *Tx) IsBannedPassword(clear string) (bool, error) {
+	var cnt int64
+
+	if !tx.active() {
+		return false, ErrMdbTransaction
+	}
+	row := tx.queryRow("SELECT count(*) FROM bannedpassword WHERE password = ?",
+		strings.ToLower(clear))
+	if err := row.Scan(&cnt); err != nil {
+		return false, err
+	}
+	return cnt > 0, nil
+}
+
+// InsertBannedPassword
+// Add clear to the banned list. It is not an error if it is
+// already there.
+func (tx *Tx) InsertBannedPassword(clear string) error {
+	if !tx.active() {
+		return ErrMdbTransaction
+	}
+	if clear == "" {
+		return ErrMdbPwEmpty
+	}
+	_, err := tx.exec("INSERT INTO bannedpassword (password) VALUES (?) ON CONFLICT DO NOTHING",
+		strings.ToLower(clear))
+	return err
+}
+
+// DeleteBannedPassword
+func (tx *Tx) DeleteBannedPassword(clear string) error {
+	if !tx.active() {
+		return ErrMdbTransaction
+	}
+	res, err := tx.exec("DELETE FROM bannedpassword WHERE password = ?",
+		strings.ToLower(clear))
+	if err == nil {
+		c, err := res.RowsAffected()
+		if err == nil && c == 0 {
+			return ErrMdbBadUpdate
+		}
+	}
+	return err
+}
+
+// BannedPasswords
+// The whole banned list, sorted
+func (mdb *MailDB) BannedPasswords() ([]string, error) {
+	return mdb.BannedPasswordsContext(context.Background())
+}
+
+// BannedPasswordsContext
+// BannedPasswords that gives up when ctx is done
+func (mdb *MailDB) BannedPasswordsContext(ctx context.Context) ([]string, error) {
+	var bl []string
+
+	rows, err := mdb.db.QueryContext(ctx, "SELECT password FROM bannedpassword ORDER BY password")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var pw string
+		if err = rows.Scan(&pw); err != nil {
+			break
+		}
+		bl = append(bl, pw)
+	}
+	if e := rows.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bl, nil
+}
+
+// String
+// The rules for show, "--" if there are none
+func (p PwPolicy) String() string {
+	var rules []string
+
+	if p.MaxAge > 0 {
+		rules = append(rules, fmt.Sprintf("max age %d days", p.MaxAge))
+	}
+	if p.MinLength > 0 {
+		rules = append(rules, fmt.Sprintf("min length %d", p.MinLength))
+	}
+	if p.MinClasses > 0 {
+		rules = append(rules, fmt.Sprintf("min classes %d", p.MinClasses))
+	}
+	if len(rules) == 0 {
+		return "--"
+	}
+	return strings.Join(rules, ", ")
+}
@@ -0,0 +1,280 @@
+package maildb
+
+/*
+ * Copyright (C) 2020, Jim Lieb <lieb@sea-troll.net>
+ *
+ * This program is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 3 of the License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ *
+ * -------------
+ */
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// deniedUsers
+// who in skywalker user_deny has
+func deniedUsers(mdb *MailDB) (string, error) {
+	var ul []string
+
+	rows, err := mdb.db.Query(`
+SELECT username FROM user_deny WHERE domain = 'skywalker' ORDER BY username`)
+	if err != nil {
+		return "", err
+	}
+	for rows.Next() {
+		var user string
+		if err = rows.Scan(&user); err != nil {
+			break
+		}
+		ul = append(ul, user)
+	}
+	if e := rows.Close(); e != nil && err == nil {
+		err = e
+	}
+	return strings.Join(ul, " "), err
+}
+
+// TestPwPolicy
+func TestPwPolicy(t *testing.T) {
+	var (
+		err error
+		mdb *MailDB
+		dir string
+		mb  *VMailbox
+	)
+
+	fmt.Printf("Password Policy Test\n")
+
+	dir, err = ioutil.TempDir("", "TestPwPolicy-*")
+	defer os.RemoveAll(dir)
+	mdb, err = makeTestDB(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Errorf("Database load failed, %s", err)
+		return
+	}
+	defer mdb.Close()
+
+	// No policy, anything goes
+	err = mdb.WithTx(func(tx *Tx) error {
+		d, err := tx.InsertDomain("skywalker")
+		if err == nil {
+			err = d.SetClass("vmailbox")
+		}
+		if err == nil {
+			mb, err = tx.InsertVMailbox("luke@skywalker")
+		}
+		if err == nil {
+			err = mb.HashPassword("", "x")
+		}
+		if err == nil {
+			_, err = tx.InsertVMailbox("leia@skywalker")
+		}
+		return err
+	})
+	if err != nil {
+		t.Errorf("Insert of mailboxes failed, %s", err)
+		return
+	}
+	if mb, err = mdb.LookupVMailbox("luke@skywalker"); err != nil {
+		t.Errorf("Lookup luke, %s", err)
+	} else if time.Since(mb.PwSet()) > time.Minute || !mb.PwExpires().IsZero() {
+		t.Errorf("Lookup luke: bad times, set %v, expires %v", mb.PwSet(), mb.PwExpires())
+	}
+
+	// Set a policy and ban some
+	err = mdb.WithTx(func(tx *Tx) error {
+		d, err := tx.GetDomain("skywalker")
+		if err != nil {
+			return err
+		}
+		if err = d.SetPwMinClasses(5); err != ErrMdbBadPwPolicy {
+			return fmt.Errorf("5 classes: expected ErrMdbBadPwPolicy, got %v", err)
+		}
+		if err = d.SetPwMinLength(-1); err != ErrMdbBadPwPolicy {
+			return fmt.Errorf("length -1: expected ErrMdbBadPwPolicy, got %v", err)
+		}
+		if err = d.SetPwMaxAge(90); err != nil {
+			return err
+		}
+		if err = d.SetPwMinLength(8); err != nil {
+			return err
+		}
+		if err = d.SetPwMinClasses(3); err != nil {
+			return err
+		}
+		for _, pw := range []string{"Password1", "Tatooine!", "password1"} {
+			if err = tx.InsertBannedPassword(pw); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Set policy, %s", err)
+	}
+	if bl, err := mdb.BannedPasswords(); err != nil || strings.Join(bl, " ") != "password1 tatooine!" {
+		t.Errorf("Banned passwords: expected two, got %v, %v", bl, err)
+	}
+	d, err := mdb.LookupDomain("skywalker")
+	if err != nil {
+		t.Errorf("Lookup skywalker, %s", err)
+	} else {
+		if p := d.PwPolicy(); p.MaxAge != 90 || p.MinLength != 8 || p.MinClasses != 3 {
+			t.Errorf("Lookup skywalker: wrong policy, %v", p)
+		}
+		if ex := d.Export(); ex != "skywalker class=vmailbox, pw_max_age=90, pw_min_length=8, pw_min_classes=3" {
+			t.Errorf("Export skywalker: got %q", ex)
+		}
+	}
+
+	// Now the passwords are checked when cleartext
+	for _, c := range []struct {
+		scheme, pw string
+		err        error
+	}{
+		{"", "Short1!", ErrMdbPwTooShort},
+		{"", "alllowercase", ErrMdbPwClasses},
+		{"PLAIN", "tatooinE!", ErrMdbPwBanned},
+		{"", "Dagobah-1977", nil},
+	} {
+		err = mdb.WithTx(func(tx *Tx) error {
+			mb, err := tx.GetVMailbox("leia@skywalker")
+			if err != nil {
+				return err
+			}
+			return mb.HashPassword(c.scheme, c.pw)
+		})
+		if err != c.err {
+			t.Errorf("Set password %q: expected %v, got %v", c.pw, c.err, err)
+		}
+	}
+	err = mdb.WithTx(func(tx *Tx) error {
+		mb, err := tx.GetVMailbox("leia@skywalker")
+		if err != nil {
+			return err
+		}
+		if err = mb.SetPwType("PLAIN"); err != nil {
+			return err
+		}
+		if err = mb.SetPassword("password1"); err != ErrMdbPwClasses {
+			return fmt.Errorf("PLAIN password1: expected ErrMdbPwClasses, got %v", err)
+		}
+		if err = mb.SetPwType("SHA256"); err != nil {
+			return err
+		}
+		// a hash can't be held to the policy, only to its type's format
+		if err = mb.SetPassword("HJJJYGB"); err != ErrMdbPwBadHash {
+			return fmt.Errorf("SHA256 HJJJYGB: expected ErrMdbPwBadHash, got %v", err)
+		}
+		return mb.SetPassword("XohImNooBHFR0OVvjcYpJ3NgPQ1qq73WKhHvch0VQtg=")
+	})
+	if err != nil {
+		t.Errorf("Set passwords with a type, %s", err)
+	}
+
+	// Both expire in 90 days and then luke's is made old
+	if mb, err = mdb.LookupVMailbox("leia@skywalker"); err != nil {
+		t.Errorf("Lookup leia, %s", err)
+	} else if d := time.Until(mb.PwExpires()); d < 89*24*time.Hour || d > 90*24*time.Hour {
+		t.Errorf("Lookup leia: expected to expire in 90 days, got %v", mb.PwExpires())
+	}
+	if s, err := deniedUsers(mdb); err != nil || s != "" {
+		t.Errorf("user_deny: expected nobody, got %q, %v", s, err)
+	}
+	err = mdb.WithTx(func(tx *Tx) error {
+		mb, err := tx.GetVMailbox("luke@skywalker")
+		if err != nil {
+			return err
+		}
+		return mb.SetPwSet(time.Now().AddDate(0, 0, -91))
+	})
+	if err != nil {
+		t.Errorf("Age luke's password, %s", err)
+	}
+	if mb, err = mdb.LookupVMailbox("luke@skywalker"); err != nil {
+		t.Errorf("Lookup luke, %s", err)
+	} else if !mb.IsPwExpired() {
+		t.Errorf("Lookup luke: should be expired, %v", mb.PwExpires())
+	}
+	if s, err := deniedUsers(mdb); err != nil || s != "luke" {
+		t.Errorf("user_deny: expected luke, got %q, %v", s, err)
+	}
+	var expired int
+	row := mdb.db.QueryRow(`
+SELECT pw_expired FROM user_mailbox WHERE username = 'luke' AND domain = 'skywalker'`)
+	if err = row.Scan(&expired); err != nil || expired != 1 {
+		t.Errorf("user_mailbox: expected luke expired, got %d, %v", expired, err)
+	}
+
+	// His own max age wins, and 0 is never
+	err = mdb.WithTx(func(tx *Tx) error {
+		mb, err := tx.GetVMailbox("luke@skywalker")
+		if err != nil {
+			return err
+		}
+		return mb.SetPwMaxAge(0)
+	})
+	if err != nil {
+		t.Errorf("Luke's max age, %s", err)
+	}
+	if mb, err = mdb.LookupVMailbox("luke@skywalker"); err != nil {
+		t.Errorf("Lookup luke, %s", err)
+	} else if !mb.PwExpires().IsZero() ||
+		mb.Export() != "luke@skywalker:{SHA512-CRYPT}"+mb.Password()+
+			"::::::userdb_quota_rule=*:bytes=300M mbox_enabled=true mbox_pw_max_age=0" {
+		t.Errorf("Lookup luke: should not expire, %v, %s", mb.PwExpires(), mb.Export())
+	}
+	if s, err := deniedUsers(mdb); err != nil || s != "" {
+		t.Errorf("user_deny: expected nobody, got %q, %v", s, err)
+	}
+
+	// Clearing the password clears its age
+	err = mdb.WithTx(func(tx *Tx) error {
+		mb, err := tx.GetVMailbox("luke@skywalker")
+		if err != nil {
+			return err
+		}
+		if err = mb.ClearPwMaxAge(); err != nil {
+			return err
+		}
+		return mb.ClearPassword()
+	})
+	if err != nil {
+		t.Errorf("Clear luke's password, %s", err)
+	}
+	if mb, err = mdb.LookupVMailbox("luke@skywalker"); err != nil {
+		t.Errorf("Lookup luke, %s", err)
+	} else if !mb.PwSet().IsZero() || !mb.PwExpires().IsZero() || mb.PwMaxAge() != 90 {
+		t.Errorf("Lookup luke: expected no password age, %v, %d", mb.PwSet(), mb.PwMaxAge())
+	}
+
+	// Unban one
+	err = mdb.WithTx(func(tx *Tx) error {
+		if err := tx.DeleteBannedPassword("PASSWORD1"); err != nil {
+			return err
+		}
+		return tx.DeleteBannedPassword("password1")
+	})
+	if err != ErrMdbBadUpdate {
+		t.Errorf("Delete banned twice: expected ErrMdbBadUpdate, got %v", err)
+	}
+}
@@ -0,0 +1,402 @@
+package maildb
+
+/*
+ * Copyright (C) 2020, Jim Lieb <lieb@sea-troll.net>
+ *
+ * This program is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 3 of the License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ *
+ * -------------
+ */
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// PostgreSQL lets a site run several MX hosts against one database.
+// The schema in files/postgres has the same tables, views, and columns
+// as the sqlite one so the postfix and dovecot queries work unchanged.
+
+// pgDriverName
+// The lib/pq driver wrapped so it takes '?' placeholders like sqlite does.
+const pgDriverName = "postdove-postgres"
+
+func init() {
+	sql.Register(pgDriverName, &pgDriver{})
+}
+
+// isPgDSN
+// A URL or a libpq style list of key=value pairs
+func isPgDSN(dbPath string) bool {
+	if strings.HasPrefix(dbPath, "postgres://") ||
+		strings.HasPrefix(dbPath, "postgresql://") {
+		return true
+	}
+	for _, kv := range strings.Fields(dbPath) {
+		switch strings.SplitN(kv, "=", 2)[0] {
+		case "host", "dbname", "user", "port", "service":
+			if strings.Contains(kv, "=") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pgDialect
+type pgDialect struct{}
+
+// name
+func (d *pgDialect) name() string {
+	return "postgresql"
+}
+
+// open
+// The server queues lock waits itself. Use lock_timeout
+// in the DSN if waiting forever is not wanted.
+func (d *pgDialect) open(dbPath string, busy time.Duration) (*sql.DB, error) {
+	return sql.Open(pgDriverName, dbPath)
+}
+
+// enableWAL
+// The server always has a write-ahead log
+func (d *pgDialect) enableWAL(db *sql.DB) error {
+	return nil
+}
+
+// isFile
+// There is no file here. Use pg_dump and friends.
+func (d *pgDialect) isFile() bool {
+	return false
+}
+
+// schemaFile
+func (d *pgDialect) schemaFile() string {
+	return "files/postgres/schema.sql"
+}
+
+// migrationDir
+func (d *pgDialect) migrationDir() string {
+	return "files/postgres/migrations"
+}
+
+// hasTable
+func (d *pgDialect) hasTable(db *sql.DB, name string) (bool, error) {
+	var cnt int
+
+	row := db.QueryRow(`
+SELECT count(*) FROM information_schema.tables
+  WHERE table_schema = current_schema() AND table_type = 'BASE TABLE'
+    AND lower(table_name) = lower(?)`, name)
+	if err := row.Scan(&cnt); err != nil {
+		return false, err
+	}
+	return cnt > 0, nil
+}
+
+// findDefaults
+// The information schema has what sqlite's pragma_table_info has but
+// it spells the types differently and casts the defaults.
+func (d *pgDialect) findDefaults(db *sql.DB, dflts map[string]TableInfo) error {
+	var (
+		info  TableInfo
+		table string
+	)
+
+	rows, err := db.Query(`
+SELECT table_name, ordinal_position, column_name, data_type, is_nullable, column_default
+  FROM information_schema.columns
+  WHERE table_schema = current_schema() AND column_default IS NOT NULL
+    AND column_default NOT LIKE 'nextval(%'`)
+	if err != nil {
+		return fmt.Errorf("column lookup broke: %s", err)
+	}
+	for rows.Next() {
+		var nullable string
+
+		if err = rows.Scan(&table, &info.cid, &info.name, &info.colType,
+			&nullable, &info.dflt); err != nil {
+			break
+		}
+		switch info.colType {
+		case "integer", "bigint", "smallint":
+			info.colType = "INTEGER"
+		case "text", "character varying":
+			info.colType = "TEXT"
+		}
+		if nullable == "NO" {
+			info.notNull = 1
+		} else {
+			info.notNull = 0
+		}
+		info.dflt.String = pgUncast(info.dflt.String)
+		dflts[strings.ToLower(table)+"."+info.name] = info
+	}
+	if e := rows.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err != nil {
+		return fmt.Errorf("column lookup scan broke: %s", err)
+	}
+	return nil
+}
+
+// pgUncast
+// A default of 'PLAIN'::text is just 'PLAIN' to us
+func pgUncast(dflt string) string {
+	if i := strings.LastIndex(dflt, "'::"); i > 0 && strings.HasPrefix(dflt, "'") {
+		return dflt[:i+1]
+	}
+	return dflt
+}
+
+// pgResult
+// There is no last insert id. We ask for it with RETURNING instead.
+type pgResult struct {
+	id int64
+}
+
+// LastInsertId
+func (r pgResult) LastInsertId() (int64, error) {
+	return r.id, nil
+}
+
+// RowsAffected
+func (r pgResult) RowsAffected() (int64, error) {
+	return 1, nil
+}
+
+// insert
+func (d *pgDialect) insert(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) (sql.Result, error) {
+	var id int64
+
+	if err := tx.QueryRowContext(ctx, query+" RETURNING id", args...).Scan(&id); err != nil {
+		return nil, err
+	}
+	return pgResult{id: id}, nil
+}
+
+// auditTable
+// The triggers get who and what from transaction local settings so
+// there is nothing to clean up and no row for concurrent
+// transactions to fight over.
+func (d *pgDialect) auditTable() string {
+	return "audit"
+}
+
+// setAuditContext
+func (d *pgDialect) setAuditContext(ctx context.Context, tx *sql.Tx, user string, command string) error {
+	_, err := tx.ExecContext(ctx, "SELECT set_config('postdove.user', ?, true), set_config('postdove.command', ?, true)",
+		user, command)
+	return err
+}
+
+// clearAuditContext
+// The settings go away with the transaction
+func (d *pgDialect) clearAuditContext(ctx context.Context, tx *sql.Tx) error {
+	return nil
+}
+
+// integrityQuery
+// The server looks after its own files
+func (d *pgDialect) integrityQuery() string {
+	return ""
+}
+
+// foreignKeyQuery
+// Foreign keys are always enforced
+func (d *pgDialect) foreignKeyQuery() string {
+	return ""
+}
+
+// constraint
+func (d *pgDialect) constraint(err error) (constraint, bool) {
+	var e *pq.Error
+
+	if !errors.As(err, &e) {
+		return notConstraint, false
+	}
+	switch e.Code.Name() {
+	case "foreign_key_violation":
+		return constraintForeignKey, true
+	case "unique_violation":
+		return constraintUnique, true
+	case "not_null_violation":
+		return constraintNotNull, true
+	}
+	return notConstraint, true
+}
+
+// message
+// pq puts "pq: " in front of what the trigger raised
+func (d *pgDialect) message(err error) (string, bool) {
+	var e *pq.Error
+
+	if !errors.As(err, &e) {
+		return "", false
+	}
+	return e.Message, true
+}
+
+// position
+func (d *pgDialect) position(err error) int {
+	var e *pq.Error
+
+	if !errors.As(err, &e) {
+		return 0
+	}
+	pos, _ := strconv.Atoi(e.Position)
+	return pos
+}
+
+// busy
+// Concurrent transactions that got in each other's way. The
+// server rolled one of them back and it can be tried again.
+func (d *pgDialect) busy(err error) bool {
+	var e *pq.Error
+
+	if !errors.As(err, &e) {
+		return false
+	}
+	switch e.Code.Name() {
+	case "serialization_failure", "deadlock_detected", "lock_not_available":
+		return true
+	}
+	return false
+}
+
+// rebind
+// Turn the '?' placeholders into $1, $2... Leave quoted strings,
+// quoted names, and comments alone.
+func rebind(query string) string {
+	var (
+		b strings.Builder
+		n int
+	)
+
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '\'' || c == '"':
+			j := strings.IndexByte(query[i+1:], c)
+			if j < 0 {
+				b.WriteString(query[i:])
+				return b.String()
+			}
+			b.WriteString(query[i : i+j+2])
+			i += j + 1
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			j := strings.IndexByte(query[i:], '\n')
+			if j < 0 {
+				b.WriteString(query[i:])
+				return b.String()
+			}
+			b.WriteString(query[i : i+j+1])
+			i += j
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			j := strings.Index(query[i+2:], "*/")
+			if j < 0 {
+				b.WriteString(query[i:])
+				return b.String()
+			}
+			b.WriteString(query[i : i+j+4])
+			i += j + 3
+		case c == '?':
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// pgDriver
+// lib/pq with rebind in front of it
+type pgDriver struct {
+	pq.Driver
+}
+
+// Open
+func (d *pgDriver) Open(name string) (driver.Conn, error) {
+	c, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &pgConn{Conn: c}, nil
+}
+
+// pgConn
+// Pass everything through to pq. A statement with no arguments is sent
+// as is so a whole script can be run at once.
+type pgConn struct {
+	driver.Conn
+}
+
+// Prepare
+func (c *pgConn) Prepare(query string) (driver.Stmt, error) {
+	return c.Conn.Prepare(rebind(query))
+}
+
+// PrepareContext
+func (c *pgConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	return c.Conn.(driver.ConnPrepareContext).PrepareContext(ctx, rebind(query))
+}
+
+// ExecContext
+func (c *pgConn) ExecContext(ctx context.Context, query string,
+	args []driver.NamedValue) (driver.Result, error) {
+	if len(args) > 0 {
+		query = rebind(query)
+	}
+	return c.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+}
+
+// QueryContext
+func (c *pgConn) QueryContext(ctx context.Context, query string,
+	args []driver.NamedValue) (driver.Rows, error) {
+	if len(args) > 0 {
+		query = rebind(query)
+	}
+	return c.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+}
+
+// BeginTx
+func (c *pgConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+// Ping
+func (c *pgConn) Ping(ctx context.Context) error {
+	return c.Conn.(driver.Pinger).Ping(ctx)
+}
+
+// ResetSession
+func (c *pgConn) ResetSession(ctx context.Context) error {
+	return c.Conn.(driver.SessionResetter).ResetSession(ctx)
+}
+
+// IsValid
+func (c *pgConn) IsValid() bool {
+	return c.Conn.(driver.Validator).IsValid()
+}
@@ -0,0 +1,490 @@
+package maildb
+
+/*
+ * Copyright (C) 2020, Jim Lieb <lieb@sea-troll.net>
+ *
+ * This program is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 3 of the License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ *
+ * -------------
+ */
+
+import (
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// TestDialect
+// The parts that don't need a server
+func TestDialect(t *testing.T) {
+	fmt.Printf("Dialect Test\n")
+
+	names := []struct {
+		path string
+		pg   bool
+	}{
+		{"/etc/postfix/private/postdove.sqlite", false},
+		{":memory:", false},
+		{"./test.db", false},
+		{"postgres://postdove@db.example.com/postdove", true},
+		{"postgresql://db.example.com/postdove?sslmode=disable", true},
+		{"host=db.example.com dbname=postdove", true},
+		{"dbname=postdove", true},
+		{"/tmp/dbname.db", false},
+	}
+	for _, n := range names {
+		_, isPg := dialectFor(n.path).(*pgDialect)
+		if isPg != n.pg {
+			t.Errorf("dialectFor %s: expected postgresql %v, got %v", n.path, n.pg, isPg)
+		}
+	}
+
+	queries := []struct {
+		in  string
+		out string
+	}{
+		{"SELECT id FROM address WHERE localpart = ? AND domain = ?",
+			"SELECT id FROM address WHERE localpart = $1 AND domain = $2"},
+		{"SELECT '?' FROM x WHERE a = ?", "SELECT '?' FROM x WHERE a = $1"},
+		{`SELECT "what?" FROM x WHERE a = ?`, `SELECT "what?" FROM x WHERE a = $1`},
+		{"SELECT 'it''s ?' WHERE a = ? -- b = ?\n AND c = ?",
+			"SELECT 'it''s ?' WHERE a = $1 -- b = ?\n AND c = $2"},
+		{"SELECT /* ? */ a FROM x WHERE b = ?", "SELECT /* ? */ a FROM x WHERE b = $1"},
+		{"SELECT 'unterminated ?", "SELECT 'unterminated ?"},
+		{"no placeholders", "no placeholders"},
+	}
+	for _, q := range queries {
+		if r := rebind(q.in); r != q.out {
+			t.Errorf("rebind %q: expected %q, got %q", q.in, q.out, r)
+		}
+	}
+
+	uncast := map[string]string{
+		"'PLAIN'::text":          "'PLAIN'",
+		"'*:bytes=300M'::text":   "'*:bytes=300M'",
+		"1":                      "1",
+		"'it''s'::text":          "'it''s'",
+		"now()":                  "now()",
+		"'x'::character varying": "'x'",
+	}
+	for in, out := range uncast {
+		if r := pgUncast(in); r != out {
+			t.Errorf("pgUncast %s: expected %s, got %s", in, out, r)
+		}
+	}
+
+	// rebind only renumbers so sqlite's "IS ?" would get to the server
+	isParam := regexp.MustCompile(`(?i)\bIS\s+(NOT\s+)?\?`)
+	srcs, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatalf("Glob sources: %s", err)
+	}
+	for _, src := range srcs {
+		if strings.HasSuffix(src, "_test.go") {
+			continue
+		}
+		b, err := ioutil.ReadFile(src)
+		if err != nil {
+			t.Errorf("Read %s: %s", src, err)
+			continue
+		}
+		if m := isParam.Find(b); m != nil {
+			t.Errorf("%s: %q does not work with postgresql, use =", src, m)
+		}
+	}
+}
+
+// pgCreated
+// The tables, views, and indexes a script creates, lower case
+// because that is what postgresql makes of the unquoted names
+func pgCreated(t *testing.T, name string) map[string]string {
+	create := regexp.MustCompile(`(?is)^CREATE\s+(?:OR\s+REPLACE\s+)?(?:UNIQUE\s+)?(TABLE|VIEW|INDEX)\s+"?(\w+)"?`)
+	b, err := DbContent.ReadFile(name)
+	if err != nil {
+		t.Fatalf("Read %s: %s", name, err)
+	}
+	stmts, err := splitScript(name, string(b))
+	if err != nil {
+		t.Fatalf("Split %s: %s", name, err)
+	}
+	objs := make(map[string]string)
+	for _, st := range stmts {
+		if m := create.FindStringSubmatch(st.text); m != nil {
+			objs[strings.ToLower(m[2])] = strings.ToLower(m[1])
+		}
+	}
+	return objs
+}
+
+// TestPgScripts
+// The postgresql schema and migrations without a server. They have to
+// split, create what the sqlite ones do, and stay clear of the sqlite
+// only SQL that a server would reject.
+func TestPgScripts(t *testing.T) {
+	fmt.Printf("PostgreSQL Scripts Test\n")
+
+	// Sqlite does with audit_context and the null check triggers what
+	// postgresql does with set_config and the address_local partial index.
+	// address_localpart is the UNIQUE in the address table.
+	sqliteOnly := map[string]bool{"audit_context": true, "address_localpart": true}
+	pgOnly := map[string]bool{"address_local": true}
+
+	lite := pgCreated(t, "files/schema.sql")
+	pg := pgCreated(t, "files/postgres/schema.sql")
+	for n, kind := range lite {
+		if k, ok := pg[n]; ok {
+			if k != kind {
+				t.Errorf("schema: %s is a %s in sqlite and a %s in postgresql", n, kind, k)
+			}
+		} else if !sqliteOnly[n] {
+			t.Errorf("schema: %s %s is missing from postgresql", kind, n)
+		}
+	}
+	for n, kind := range pg {
+		if _, ok := lite[n]; !ok && !pgOnly[n] {
+			t.Errorf("schema: %s %s is not in sqlite", kind, n)
+		}
+	}
+
+	// Every migration past the first postgresql schema has one for each
+	litePaths, err := fs.Glob(DbContent, "files/migrations/*.sql")
+	if err != nil {
+		t.Fatalf("Glob migrations: %s", err)
+	}
+	pgPaths, err := fs.Glob(DbContent, "files/postgres/migrations/*.sql")
+	if err != nil {
+		t.Fatalf("Glob postgresql migrations: %s", err)
+	}
+	pgMigrations := make(map[string]bool)
+	for _, p := range pgPaths {
+		pgMigrations[filepath.Base(p)] = true
+	}
+	first := filepath.Base(pgPaths[0])
+	for _, p := range litePaths {
+		base := filepath.Base(p)
+		if base < first {
+			continue
+		}
+		if !pgMigrations[base] {
+			t.Errorf("migration %s is missing from postgresql", base)
+			continue
+		}
+		liteObjs := pgCreated(t, p)
+		pgObjs := pgCreated(t, "files/postgres/migrations/"+base)
+		for n, kind := range liteObjs {
+			if _, ok := pgObjs[n]; !ok && !sqliteOnly[n] {
+				t.Errorf("migration %s: %s %s is missing from postgresql", base, kind, n)
+			}
+		}
+		delete(pgMigrations, base)
+	}
+	for base := range pgMigrations {
+		t.Errorf("postgresql migration %s is not in sqlite", base)
+	}
+
+	// The sqlite-isms
+	sqliteSQL := regexp.MustCompile(`(?i)\bAUTOINCREMENT\b|\bdatetime\s*\(|\bstrftime\s*\(|` +
+		`\bRAISE\s*\(|\bINSERT\s+OR\s|\bIS\s+(NOT\s+)?(NEW|OLD)\.|\bIS\s+(NOT\s+)?\?`)
+	for _, p := range append([]string{"files/postgres/schema.sql"}, pgPaths...) {
+		b, err := DbContent.ReadFile(p)
+		if err != nil {
+			t.Fatalf("Read %s: %s", p, err)
+		}
+		for i, l := range strings.Split(string(b), "\n") {
+			if c := strings.Index(l, "--"); c >= 0 {
+				l = l[:c]
+			}
+			if m := sqliteSQL.FindString(l); m != "" {
+				t.Errorf("%s:%d: %q is sqlite only", p, i+1, m)
+			}
+		}
+	}
+
+	// The audit triggers read what setAuditContext sets
+	src, err := ioutil.ReadFile("postgres.go")
+	if err != nil {
+		t.Fatalf("Read postgres.go: %s", err)
+	}
+	pgSchema, err := DbContent.ReadFile("files/postgres/schema.sql")
+	if err != nil {
+		t.Fatalf("Read postgresql schema: %s", err)
+	}
+	settings := regexp.MustCompile(`set_config\('([\w.]+)'`).FindAllSubmatch(src, -1)
+	if len(settings) == 0 {
+		t.Errorf("setAuditContext: no set_config found")
+	}
+	for _, s := range settings {
+		if !strings.Contains(string(pgSchema), "current_setting('"+string(s[1])+"'") {
+			t.Errorf("audit: the triggers do not read %s", s[1])
+		}
+	}
+}
+
+// TestAddressLocal
+// The postgresql address_local partial index does what the sqlite
+// null check triggers do. Sqlite has partial indexes too so put the
+// index from the postgresql schema in place of the triggers and
+// run the same changes past both.
+func TestAddressLocal(t *testing.T) {
+	fmt.Printf("Address local index Test\n")
+
+	var index string
+	b, err := DbContent.ReadFile("files/postgres/schema.sql")
+	if err != nil {
+		t.Fatalf("Read postgresql schema: %s", err)
+	}
+	stmts, err := splitScript("schema.sql", string(b))
+	if err != nil {
+		t.Fatalf("Split postgresql schema: %s", err)
+	}
+	for _, st := range stmts {
+		if strings.HasPrefix(st.text, "CREATE UNIQUE INDEX address_local ") {
+			index = st.text
+		}
+	}
+	if index == "" {
+		t.Fatalf("postgresql schema: no address_local index")
+	} else if !regexp.MustCompile(`(?i)\(localpart\)\s+WHERE\s+domain\s+IS\s+NULL$`).MatchString(index) {
+		t.Errorf("address_local: expected a localpart index where domain IS NULL, got %s", index)
+	}
+
+	dir, err := ioutil.TempDir("", "TestAddressLocal-*")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	trig, err := makeTestDB(filepath.Join(dir, "trigger.db"))
+	if err != nil {
+		t.Fatalf("Trigger DB: %s", err)
+	}
+	defer trig.Close()
+	idx, err := makeTestDB(filepath.Join(dir, "index.db"))
+	if err != nil {
+		t.Fatalf("Index DB: %s", err)
+	}
+	defer idx.Close()
+	for _, s := range []string{
+		"DROP TRIGGER addr_insert_null_check",
+		"DROP TRIGGER addr_update_null_check",
+		index,
+	} {
+		if _, err = idx.db.Exec(s); err != nil {
+			t.Fatalf("Index DB: %s, %s", s, err)
+		}
+	}
+
+	changes := []struct {
+		sql string
+		ok  bool
+	}{
+		{"INSERT INTO domain (id, name) VALUES (1, 'pobox.org')", true},
+		{"INSERT INTO address (localpart, domain) VALUES ('root', NULL)", true},
+		{"INSERT INTO address (localpart, domain) VALUES ('root', NULL)", false},
+		{"INSERT INTO address (localpart, domain) VALUES ('root', 1)", true},
+		{"INSERT INTO address (localpart, domain) VALUES ('postmaster', NULL)", true},
+		{"UPDATE address SET localpart = 'root' WHERE localpart = 'postmaster'", false},
+		{"UPDATE address SET domain = NULL WHERE localpart = 'root' AND domain = 1", false},
+		{"UPDATE address SET domain = 1 WHERE localpart = 'postmaster'", true},
+		{"INSERT INTO address (localpart, domain) VALUES ('postmaster', NULL)", true},
+	}
+	for _, c := range changes {
+		_, terr := trig.db.Exec(c.sql)
+		_, ierr := idx.db.Exec(c.sql)
+		if (terr == nil) != c.ok {
+			t.Errorf("Triggers: %s, expected ok %v, got %v", c.sql, c.ok, terr)
+		}
+		if (ierr == nil) != c.ok {
+			t.Errorf("address_local: %s, expected ok %v, got %v", c.sql, c.ok, ierr)
+		}
+	}
+}
+
+// TestPostgres
+// Run the basics against a real server. POSTDOVE_TEST_PG is the DSN of a
+// scratch database. The schema load drops and creates the postdove tables.
+func TestPostgres(t *testing.T) {
+	var (
+		tx  *Tx
+		err error
+		mdb *MailDB
+		d   *Domain
+		a   *Address
+		al  []*AuditEntry
+	)
+
+	pgDSN := os.Getenv("POSTDOVE_TEST_PG")
+	if pgDSN == "" {
+		t.Skip("POSTDOVE_TEST_PG not set")
+	}
+	fmt.Printf("PostgreSQL Test\n")
+
+	if mdb, err = OpenMailDB(pgDSN); err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	defer mdb.Close()
+	if err = mdb.LoadSchema(""); err != nil {
+		t.Fatalf("LoadSchema: %s", err)
+	}
+	if err = mdb.CheckSchema(); err != nil {
+		t.Errorf("CheckSchema: unexpected error, %s", err)
+	}
+	if v, err := mdb.SchemaVersion(); err != nil || v != DbSchemaVersion {
+		t.Errorf("SchemaVersion: expected %d, got %d, %v", DbSchemaVersion, v, err)
+	}
+
+	// The defaults come from the information schema
+	if s, err := mdb.DefaultString("vmailbox.pw_type"); err != nil || s != "PLAIN" {
+		t.Errorf("DefaultString: expected PLAIN, got %s, %v", s, err)
+	}
+	if s, err := mdb.DefaultString("vmailbox.quota"); err != nil || s != "*:bytes=300M" {
+		t.Errorf("DefaultString: expected *:bytes=300M, got %s, %v", s, err)
+	}
+	if i, err := mdb.DefaultInt("vmailbox.enable"); err != nil || i != 1 {
+		t.Errorf("DefaultInt: expected 1, got %d, %v", i, err)
+	}
+
+	// Inserts get their ids and the constraints are classified
+	mdb.SetAuditInfo("tester", "TestPostgres")
+	tx = beginTx(t, mdb)
+	if d, err = tx.InsertDomain("pobox.org"); err == nil {
+		if d.Id() == 0 {
+			err = fmt.Errorf("no id for pobox.org")
+		}
+	}
+	if err == nil {
+		_, err = tx.InsertDomain("pobox.org")
+		if err != ErrMdbDupDomain {
+			err = fmt.Errorf("expected duplicate domain, got %v", err)
+		} else {
+			err = nil
+		}
+	}
+	tx.End(&err)
+	if err == nil {
+		t.Errorf("Duplicate domain: should have rolled back")
+	}
+	tx = beginTx(t, mdb)
+	if a, err = tx.InsertAddress("bill@pobox.org"); err == nil {
+		if a.Id() == 0 {
+			err = fmt.Errorf("no id for bill@pobox.org")
+		}
+	}
+	tx.End(&err)
+	if err != nil {
+		t.Errorf("Insert bill@pobox.org: unexpected error, %s", err)
+	}
+	tx = beginTx(t, mdb)
+	_, err = tx.InsertAddress("root")
+	tx.End(&err)
+	if err != nil {
+		t.Errorf("Insert root: unexpected error, %s", err)
+	}
+	tx = beginTx(t, mdb)
+	_, err = tx.InsertAddress("root")
+	tx.End(&err)
+	if err != ErrMdbDupAddress {
+		t.Errorf("Insert root again: expected %s, got %v", ErrMdbDupAddress, err)
+	}
+
+	// The triggers recorded who did it
+	if al, err = mdb.FindAudit(&AuditFilter{Entity: "address"}); err != nil {
+		t.Errorf("FindAudit: unexpected error, %s", err)
+	} else if len(al) != 2 {
+		t.Errorf("FindAudit: expected 2 address entries, got %d", len(al))
+	} else {
+		if al[0].Key() != "bill@pobox.org" || al[0].User() != "tester" ||
+			al[0].Command() != "TestPostgres" || al[0].Op() != "INSERT" {
+			t.Errorf("FindAudit: unexpected entry %s %s %s %s",
+				al[0].Key(), al[0].User(), al[0].Command(), al[0].Op())
+		}
+		if !strings.Contains(al[0].After(), "pobox.org") {
+			t.Errorf("FindAudit: expected domain in after, got %s", al[0].After())
+		}
+	}
+
+	// Mailboxes and aliases are looked up by id
+	err = mdb.WithTx(func(tx *Tx) error {
+		d, err := tx.InsertDomain("mail.org")
+		if err == nil {
+			err = d.SetClass("vmailbox")
+		}
+		if err == nil {
+			_, err = tx.InsertVMailbox("ann@mail.org")
+		}
+		if err != nil {
+			return err
+		}
+		vm, err := tx.GetVMailbox("ann@mail.org")
+		if err == nil {
+			err = vm.ResetQuota()
+		}
+		if err != nil {
+			return err
+		}
+		a, err := tx.GetOrInsAddress("sales@mail.org")
+		if err == nil {
+			err = a.AttachAlias("ann@mail.org")
+		}
+		return err
+	})
+	if err != nil {
+		t.Errorf("Mailbox and alias: unexpected error, %s", err)
+	}
+	if _, err = mdb.LookupVMailbox("ann@mail.org"); err != nil {
+		t.Errorf("LookupVMailbox: unexpected error, %s", err)
+	}
+	if vl, err := mdb.FindVMailbox("*@mail.org"); err != nil || len(vl) != 1 {
+		t.Errorf("FindVMailbox: expected ann, got %v, %v", vl, err)
+	}
+	if al, err := mdb.LookupAlias("sales@mail.org"); err != nil || len(al) != 1 ||
+		al[0].Export() != "sales@mail.org ann@mail.org" {
+		t.Errorf("LookupAlias: expected sales@mail.org ann@mail.org, got %v, %v", al, err)
+	}
+	if a, err = mdb.LookupAddress("sales@mail.org"); err == nil {
+		var al *Alias
+		if al, err = a.Alias(); err == nil && len(al.Targets()) != 1 {
+			err = fmt.Errorf("expected 1 recipient, got %d", len(al.Targets()))
+		}
+	}
+	if err != nil {
+		t.Errorf("Alias: unexpected error, %s", err)
+	}
+
+	// and the cascade triggers clean up
+	if err = mdb.WithTx(func(tx *Tx) error { return tx.DeleteAddress("bill@pobox.org") }); err != nil {
+		t.Errorf("DeleteAddress: unexpected error, %s", err)
+	}
+	if _, err = tx.GetDomain("pobox.org"); err != ErrMdbDomainNotFound {
+		t.Errorf("GetDomain: expected pobox.org to be gone, got %v", err)
+	}
+
+	// Nothing for check to find
+	if fl, err := mdb.Check(); err != nil {
+		t.Errorf("Check: unexpected error, %s", err)
+	} else if len(fl) != 0 {
+		t.Errorf("Check: expected nothing, got %v", fl)
+	}
+
+	// and no file to back up
+	if _, err = mdb.Backup("/tmp/nowhere", false); err == nil ||
+		!strings.Contains(err.Error(), ErrMdbNotFile.Error()) {
+		t.Errorf("Backup: expected %s, got %v", ErrMdbNotFile, err)
+	}
+}
@@ -0,0 +1,371 @@
+package maildb
+
+/*
+ * Copyright (C) 2020, Jim Lieb <lieb@sea-troll.net>
+ *
+ * This program is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 3 of the License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ *
+ * -------------
+ */
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// QuotaUsage
+// What a mailbox is using, as dovecot's quota dict counted it, and
+// the limits of its quota rule. A limit of 0 is no limit, as it is
+// for dovecot.
+type QuotaUsage struct {
+	user     string
+	domain   string
+	rule     sql.NullString
+	bytes    int64
+	messages int64
+	maxBytes int64
+	maxMsgs  int64
+}
+
+// quotaCols
+// The user_quota columns, in scan() order
+const quotaCols = `username, domain, quota_rule, bytes, messages`
+
+// scan
+func (q *QuotaUsage) scan() []interface{} {
+	return []interface{}{&q.user, &q.domain, &q.rule, &q.bytes, &q.messages}
+}
+
+// LookupQuotaUsage
+// The usage of mailbox vm
+func (mdb *MailDB) LookupQuotaUsage(vm *VMailbox) (*QuotaUsage, error) {
+	return mdb.LookupQuotaUsageContext(context.Background(), vm)
+}
+
+// LookupQuotaUsageContext
+// LookupQuotaUsage that gives up when ctx is done
+func (mdb *MailDB) LookupQuotaUsageContext(ctx context.Context, vm *VMailbox) (*QuotaUsage, error) {
+	q := &QuotaUsage{}
+	row := mdb.db.QueryRowContext(ctx,
+		"SELECT "+quotaCols+" FROM user_quota WHERE id = ?", vm.a.id)
+	if err := row.Scan(q.scan()...); err != nil {
+		return nil, err
+	}
+	q.user = q.user + "@" + q.domain
+	q.maxBytes, q.maxMsgs = quotaLimits(q.rule.String)
+	return q, nil
+}
+
+// FindQuotaUsage
+// The usage of the mailboxes matching user, in FindVMailbox order
+func (mdb *MailDB) FindQuotaUsage(user string) ([]*QuotaUsage, error) {
+	return mdb.FindQuotaUsageContext(context.Background(), user)
+}
+
+// FindQuotaUsageContext
+// FindQuotaUsage that gives up when ctx is done
+func (mdb *MailDB) FindQuotaUsageContext(ctx context.Context, user string) ([]*QuotaUsage, error) {
+	var ql []*QuotaUsage
+
+	ml, err := mdb.FindVMailboxContext(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range ml {
+		q, err := mdb.LookupQuotaUsageContext(ctx, m)
+		if err != nil {
+			return nil, err
+		}
+		ql = append(ql, q)
+	}
+	return ql, nil
+}
+
+// User
+func (q *QuotaUsage) User() string {
+	return q.user
+}
+
+// Domain
+func (q *QuotaUsage) Domain() string {
+	return q.domain
+}
+
+// Rule
+// The dovecot quota rule the limits come from, "none" if
+// dovecot uses its own
+func (q *QuotaUsage) Rule() string {
+	if q.rule.Valid {
+		return q.rule.String
+	} else {
+		return "none"
+	}
+}
+
+// Bytes
+func (q *QuotaUsage) Bytes() int64 {
+	return q.bytes
+}
+
+// Messages
+func (q *QuotaUsage) Messages() int64 {
+	return q.messages
+}
+
+// BytesLimit
+func (q *QuotaUsage) BytesLimit() int64 {
+	return q.maxBytes
+}
+
+// MessagesLimit
+func (q *QuotaUsage) MessagesLimit() int64 {
+	return q.maxMsgs
+}
+
+// IsLimited
+// Does the rule limit either the storage or the message count?
+func (q *QuotaUsage) IsLimited() bool {
+	return q.maxBytes > 0 || q.maxMsgs > 0
+}
+
+// Percent
+// How full the mailbox is, the larger of the storage and message
+// count percentages. It is 0 if there is no limit.
+func (q *QuotaUsage) Percent() int64 {
+	var pct int64
+
+	if q.maxBytes > 0 {
+		pct = q.bytes * 100 / q.maxBytes
+	}
+	if q.maxMsgs > 0 {
+		if p := q.messages * 100 / q.maxMsgs; p > pct {
+			pct = p
+		}
+	}
+	return pct
+}
+
+// String
+// Usage for show, e.g. "1.5M of 300M, 42 messages (0%)"
+func (q *QuotaUsage) String() string {
+	var line strings.Builder
+
+	fmt.Fprintf(&line, "%s", FormatBytes(q.bytes))
+	if q.maxBytes > 0 {
+		fmt.Fprintf(&line, " of %s", FormatBytes(q.maxBytes))
+	}
+	fmt.Fprintf(&line, ", %d", q.messages)
+	if q.maxMsgs > 0 {
+		fmt.Fprintf(&line, " of %d", q.maxMsgs)
+	}
+	fmt.Fprintf(&line, " messages")
+	if q.IsLimited() {
+		fmt.Fprintf(&line, " (%d%%)", q.Percent())
+	}
+	return line.String()
+}
+
+// FormatBytes
+// n in the units of a dovecot quota rule, e.g. 512B, 1.5M, 300M
+func FormatBytes(n int64) string {
+	const units = "KMGT"
+
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	v := float64(n)
+	u := -1
+	for v >= 1024 && u < len(units)-1 {
+		v /= 1024
+		u++
+	}
+	s := strings.TrimSuffix(strconv.FormatFloat(v, 'f', 1, 64), ".0")
+	return s + units[u:u+1]
+}
+
+// QuotaRule
+// A dovecot quota rule, <mailbox>:<limit>=<value>[:<limit>=<value>] or
+// <mailbox>:ignore. Mailbox "*" is the root rule, the limits of the
+// whole mailbox. Any other is a folder, e.g. "Trash", whose limits are
+// usually relative to the root's. Storage and bytes are both kept in
+// Bytes.
+type QuotaRule struct {
+	Mailbox  string
+	Ignore   bool        // the folder doesn't count against the quota
+	Bytes    *QuotaLimit // nil if the rule doesn't limit it
+	Messages *QuotaLimit
+}
+
+// QuotaLimit
+// One limit of a rule. A Relative one is added to, or if negative
+// taken from, the root rule's limit. A Percent one is Value percent
+// of the root rule's. 0 is no limit.
+type QuotaLimit struct {
+	Value    int64
+	Relative bool
+	Percent  bool
+}
+
+// ParseQuotaRule
+// Parse and check a quota rule the way dovecot would
+func ParseQuotaRule(rule string) (*QuotaRule, error) {
+	i := strings.IndexByte(rule, ':')
+	if i < 1 || i == len(rule)-1 {
+		return nil, ErrMdbBadQuota
+	}
+	q := &QuotaRule{Mailbox: rule[:i]}
+	if strings.ContainsAny(q.Mailbox, "= \t") {
+		return nil, ErrMdbBadQuota
+	}
+	if strings.EqualFold(rule[i+1:], "ignore") {
+		q.Ignore = true
+		return q, nil
+	}
+	for _, f := range strings.Split(rule[i+1:], ":") {
+		var (
+			limit **QuotaLimit
+			unit  int64 = 1
+		)
+
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			return nil, ErrMdbBadQuota
+		}
+		switch strings.ToLower(kv[0]) {
+		case "bytes":
+			limit = &q.Bytes
+		case "storage":
+			limit, unit = &q.Bytes, 1024
+		case "messages":
+			limit, unit = &q.Messages, 0
+		default:
+			return nil, ErrMdbBadQuota
+		}
+		if *limit != nil { // only one of each
+			return nil, ErrMdbBadQuota
+		}
+		l, err := parseQuotaLimit(kv[1], unit)
+		if err != nil {
+			return nil, err
+		}
+		if q.Mailbox == "*" && (l.Relative || l.Percent) {
+			return nil, ErrMdbBadQuota // nothing to be relative to
+		}
+		*limit = l
+	}
+	return q, nil
+}
+
+// parseQuotaLimit
+// [+|-]<number>[<unit>|%]. unit is what a bare number is in, 0 if
+// units aren't allowed. The units are B, K, M, G, and T, in
+// either case.
+func parseQuotaLimit(val string, unit int64) (*QuotaLimit, error) {
+	l := &QuotaLimit{}
+	sign := int64(1)
+
+	switch {
+	case strings.HasPrefix(val, "+"):
+		l.Relative = true
+		val = val[1:]
+	case strings.HasPrefix(val, "-"):
+		l.Relative = true
+		sign = -1
+		val = val[1:]
+	}
+	if strings.HasSuffix(val, "%") {
+		l.Percent = true
+		val = val[:len(val)-1]
+	} else if val != "" {
+		if i := strings.IndexByte("bkmgt", val[len(val)-1]|0x20); i >= 0 {
+			if unit == 0 {
+				return nil, ErrMdbBadQuota
+			}
+			unit = 1 << (10 * i)
+			val = val[:len(val)-1]
+		}
+	}
+	if unit == 0 || l.Percent {
+		unit = 1
+	}
+	if val == "" || strings.IndexFunc(val, func(r rune) bool {
+		return r < '0' || r > '9'
+	}) >= 0 {
+		return nil, ErrMdbBadQuota
+	}
+	n, err := strconv.ParseInt(val, 10, 64)
+	if err != nil || n > math.MaxInt64/unit {
+		return nil, ErrMdbBadQuota
+	}
+	l.Value = sign * n * unit
+	return l, nil
+}
+
+// String
+// The rule in dovecot form with the sizes in bytes
+func (q *QuotaRule) String() string {
+	var line strings.Builder
+
+	fmt.Fprintf(&line, "%s:", q.Mailbox)
+	if q.Ignore {
+		fmt.Fprintf(&line, "ignore")
+		return line.String()
+	}
+	var limits []string
+	if q.Bytes != nil {
+		limits = append(limits, "bytes="+q.Bytes.String())
+	}
+	if q.Messages != nil {
+		limits = append(limits, "messages="+q.Messages.String())
+	}
+	fmt.Fprintf(&line, "%s", strings.Join(limits, ":"))
+	return line.String()
+}
+
+// String
+func (l *QuotaLimit) String() string {
+	var line strings.Builder
+
+	if l.Relative && l.Value >= 0 {
+		fmt.Fprintf(&line, "+")
+	}
+	fmt.Fprintf(&line, "%d", l.Value)
+	if l.Percent {
+		fmt.Fprintf(&line, "%%")
+	}
+	return line.String()
+}
+
+// quotaLimits
+// The storage and message limits of the root rule, 0 if there
+// isn't one. A NULL rule is dovecot's own default which we
+// don't know so it is no limit too.
+func quotaLimits(rule string) (maxBytes, maxMsgs int64) {
+	q, err := ParseQuotaRule(rule)
+	if err != nil || q.Mailbox != "*" || q.Ignore {
+		return 0, 0
+	}
+	if q.Bytes != nil {
+		maxBytes = q.Bytes.Value
+	}
+	if q.Messages != nil {
+		maxMsgs = q.Messages.Value
+	}
+	return maxBytes, maxMsgs
+}
@@ -0,0 +1,298 @@
+package maildb
+
+/*
+ * Copyright (C) 2020, Jim Lieb <lieb@sea-troll.net>
+ *
+ * This program is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 3 of the License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ *
+ * -------------
+ */
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestQuotaUsage
+func TestQuotaUsage(t *testing.T) {
+	var (
+		err error
+		mdb *MailDB
+		dir string
+	)
+
+	fmt.Printf("Quota Usage Test\n")
+
+	// The rule parsing and formatting
+	for _, r := range []struct {
+		rule, parsed string
+	}{
+		{"*:bytes=300M", "*:bytes=314572800"},
+		{"*:bytes=1024", "*:bytes=1024"},
+		{"*:storage=1000", "*:bytes=1024000"},
+		{"*:storage=2g:messages=500", "*:bytes=2147483648:messages=500"},
+		{"*:bytes=10b", "*:bytes=10"},
+		{"*:bytes=0", "*:bytes=0"},
+		{"Trash:storage=+100M", "Trash:bytes=+104857600"},
+		{"Trash:bytes=-10%", "Trash:bytes=-10%"},
+		{"INBOX/Sent:messages=+50", "INBOX/Sent:messages=+50"},
+		{"Trash:ignore", "Trash:ignore"},
+		{"*:bytes=300MB", ""},
+		{"*:byte=1G", ""},
+		{"*:bytes=+1G", ""},
+		{"*:bytes=10%", ""},
+		{"*:bytes=1.5G", ""},
+		{"*:bytes=10X", ""},
+		{"*:bytes=", ""},
+		{"*:bytes=-", ""},
+		{"*:messages=10k", ""},
+		{"*:bytes=1G:bytes=2G", ""},
+		{"*:bytes=99999999T", ""},
+		{"bytes=1G", ""},
+		{":bytes=1G", ""},
+		{"*:", ""},
+		{"", ""},
+	} {
+		q, err := ParseQuotaRule(r.rule)
+		if r.parsed == "" {
+			if err != ErrMdbBadQuota {
+				t.Errorf("ParseQuotaRule(%s): expected ErrMdbBadQuota, got %v", r.rule, err)
+			}
+		} else if err != nil {
+			t.Errorf("ParseQuotaRule(%s): unexpected error, %s", r.rule, err)
+		} else if q.String() != r.parsed {
+			t.Errorf("ParseQuotaRule(%s): expected %s, got %s", r.rule, r.parsed, q)
+		}
+	}
+	for _, r := range []struct {
+		rule           string
+		maxBytes, msgs int64
+	}{
+		{"*:bytes=300M", 300 << 20, 0},
+		{"*:storage=2g:messages=500", 2 << 30, 500},
+		{"Trash:storage=+100M", 0, 0},
+		{"*:bytes=300MB", 0, 0},
+		{"", 0, 0},
+	} {
+		if b, m := quotaLimits(r.rule); b != r.maxBytes || m != r.msgs {
+			t.Errorf("quotaLimits(%s): expected %d, %d, got %d, %d",
+				r.rule, r.maxBytes, r.msgs, b, m)
+		}
+	}
+	for n, s := range map[int64]string{
+		0: "0B", 1023: "1023B", 1024: "1K", 1536: "1.5K",
+		300 << 20: "300M", 40 << 30: "40G", 3 << 40: "3T", 5 << 50: "5120T",
+	} {
+		if f := FormatBytes(n); f != s {
+			t.Errorf("FormatBytes(%d): expected %s, got %s", n, s, f)
+		}
+	}
+
+	dir, err = ioutil.TempDir("", "TestQuotaUsage-*")
+	defer os.RemoveAll(dir)
+	mdb, err = makeTestDB(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Errorf("Database load failed, %s", err)
+		return
+	}
+	defer mdb.Close()
+
+	err = mdb.WithTx(func(tx *Tx) error {
+		d, err := tx.InsertDomain("skywalker")
+		if err == nil {
+			err = d.SetClass("vmailbox")
+		}
+		for _, u := range []string{"luke", "leia", "anakin"} {
+			if err != nil {
+				break
+			}
+			_, err = tx.InsertVMailbox(u + "@skywalker")
+		}
+		if err == nil {
+			var mb *VMailbox
+			if mb, err = tx.GetVMailbox("leia@skywalker"); err == nil {
+				err = mb.SetQuota("*:storage=1000:messages=10")
+			}
+		}
+		if err == nil {
+			var mb *VMailbox
+			if mb, err = tx.GetVMailbox("anakin@skywalker"); err == nil {
+				err = mb.ClearQuota()
+			}
+		}
+		return err
+	})
+	if err != nil {
+		t.Errorf("Insert of mailboxes failed, %s", err)
+		return
+	}
+
+	// Nothing counted yet
+	mb, err := mdb.LookupVMailbox("luke@skywalker")
+	if err != nil {
+		t.Errorf("Lookup luke, %s", err)
+		return
+	}
+	q, err := mdb.LookupQuotaUsage(mb)
+	if err != nil {
+		t.Errorf("Quota of luke, %s", err)
+	} else if q.User() != "luke@skywalker" || q.Bytes() != 0 || q.Messages() != 0 ||
+		q.BytesLimit() != 300<<20 || q.String() != "0B of 300M, 0 messages (0%)" {
+		t.Errorf("Quota of luke: unexpected %s, %s", q.User(), q)
+	}
+
+	// This is what dovecot's dict does
+	for _, u := range []struct {
+		user            string
+		bytes, messages int64
+	}{
+		{"luke@skywalker", 150 << 20, 42},
+		{"leia@skywalker", 100 << 10, 9},
+		{"anakin@skywalker", 5 << 30, 1000},
+		{"nobody@skywalker", 1, 1},
+	} {
+		if _, err = mdb.db.Exec("INSERT INTO quotausage (username, bytes, messages) VALUES (?, ?, ?)",
+			u.user, u.bytes, u.messages); err != nil {
+			t.Errorf("Insert usage of %s, %s", u.user, err)
+		}
+	}
+	ql, err := mdb.FindQuotaUsage("*@skywalker")
+	if err != nil || len(ql) != 3 {
+		t.Errorf("Find skywalker usage: expected 3, got %d, %v", len(ql), err)
+		return
+	}
+	for _, q := range ql {
+		var expected string
+		var pct int64
+
+		switch q.User() {
+		case "luke@skywalker":
+			expected, pct = "150M of 300M, 42 messages (50%)", 50
+		case "leia@skywalker":
+			expected, pct = "100K of 1000K, 9 of 10 messages (90%)", 90
+		case "anakin@skywalker":
+			expected, pct = "5G, 1000 messages", 0
+		default:
+			t.Errorf("Find skywalker usage: unexpected %s", q.User())
+			continue
+		}
+		if q.String() != expected || q.Percent() != pct || q.IsLimited() != (pct > 0) {
+			t.Errorf("Usage of %s: expected %s, got %s", q.User(), expected, q)
+		}
+	}
+
+	// Deleting the mailbox deletes its usage
+	err = mdb.WithTx(func(tx *Tx) error {
+		return tx.DeleteVMailbox("luke@skywalker")
+	})
+	if err != nil {
+		t.Errorf("Delete luke, %s", err)
+	}
+	var cnt int
+	row := mdb.db.QueryRow("SELECT count(*) FROM quotausage")
+	if err = row.Scan(&cnt); err != nil || cnt != 3 {
+		t.Errorf("Usage after delete: expected 3 rows, got %d, %v", cnt, err)
+	}
+	row = mdb.db.QueryRow("SELECT count(*) FROM quotausage WHERE username = 'luke@skywalker'")
+	if err = row.Scan(&cnt); err != nil || cnt != 0 {
+		t.Errorf("Usage after delete: luke is still there, %d, %v", cnt, err)
+	}
+
+	// A domain default is for the mailboxes without their own
+	err = mdb.WithTx(func(tx *Tx) error {
+		d, err := tx.GetDomain("skywalker")
+		if err != nil {
+			return err
+		}
+		if err = d.SetQuota("*:bytes=10GB"); err != ErrMdbBadQuota {
+			return fmt.Errorf("domain 10GB: expected ErrMdbBadQuota, got %v", err)
+		}
+		if err = d.SetQuota("*:storage=10G"); err != nil {
+			return err
+		}
+		mb, err := tx.GetVMailbox("leia@skywalker")
+		if err != nil {
+			return err
+		}
+		if err = mb.SetQuota("*:byte=1G"); err != ErrMdbBadQuota {
+			return fmt.Errorf("leia byte: expected ErrMdbBadQuota, got %v", err)
+		}
+		if err = mb.ResetQuota(); err != nil {
+			return err
+		}
+		_, err = tx.InsertVMailbox("han@skywalker")
+		return err
+	})
+	if err != nil {
+		t.Errorf("Domain quota, %s", err)
+	}
+	for _, u := range []struct {
+		user, rule, usage string
+	}{
+		{"leia@skywalker", "*:storage=10G", "100K of 10G, 9 messages (0%)"},
+		{"anakin@skywalker", "*:storage=10G", "5G of 10G, 1000 messages (50%)"},
+		{"han@skywalker", "*:storage=10G", "0B of 10G, 0 messages (0%)"},
+	} {
+		mb, err := mdb.LookupVMailbox(u.user)
+		if err != nil {
+			t.Errorf("Lookup %s, %s", u.user, err)
+			continue
+		}
+		if rule, inherited := mb.QuotaRule(); rule != u.rule || !inherited || mb.Quota() != "none" {
+			t.Errorf("Quota rule of %s: expected %s from the domain, got %s, %v, %s",
+				u.user, u.rule, rule, inherited, mb.Quota())
+		}
+		if q, err := mdb.LookupQuotaUsage(mb); err != nil || q.Rule() != u.rule || q.String() != u.usage {
+			t.Errorf("Usage of %s: expected %s, got %v, %v", u.user, u.usage, q, err)
+		}
+	}
+	d, err := mdb.LookupDomain("skywalker")
+	if err != nil || d.Quota() != "*:storage=10G" ||
+		!strings.HasSuffix(d.Export(), ", quota=*:storage=10G") {
+		t.Errorf("Lookup skywalker: unexpected quota %s, %v", d.Export(), err)
+	}
+
+	// and no limit if the domain has none either
+	err = mdb.WithTx(func(tx *Tx) error {
+		d, err := tx.GetDomain("skywalker")
+		if err == nil {
+			err = d.ClearQuota()
+		}
+		return err
+	})
+	if err != nil {
+		t.Errorf("Clear domain quota, %s", err)
+	}
+	mb, err = mdb.LookupVMailbox("anakin@skywalker")
+	if err != nil {
+		t.Errorf("Lookup anakin, %s", err)
+	} else if rule, inherited := mb.QuotaRule(); rule != "none" || inherited {
+		t.Errorf("Quota rule of anakin: expected none, got %s, %v", rule, inherited)
+	} else if q, err := mdb.LookupQuotaUsage(mb); err != nil || q.Rule() != "none" ||
+		q.String() != "5G, 1000 messages" {
+		t.Errorf("Usage of anakin: expected no limit, got %v, %v", q, err)
+	}
+	// which dovecot gets spelled out rather than as a NULL
+	var rule sql.NullString
+	row = mdb.db.QueryRow("SELECT quota_rule FROM user_mailbox WHERE username = 'anakin' AND domain = 'skywalker'")
+	if err = row.Scan(&rule); err != nil || rule.String != "*:storage=0" {
+		t.Errorf("user_mailbox anakin: expected *:storage=0, got %v, %v", rule, err)
+	}
+}
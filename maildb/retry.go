@@ -0,0 +1,158 @@
+package maildb
+
+/*
+ * Copyright (C) 2020, Jim Lieb <lieb@sea-troll.net>
+ *
+ * This program is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 3 of the License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ *
+ * -------------
+ */
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Postfix and dovecot read the database while we write it. With the
+// database in WAL mode they never wait for us. We can still have to wait
+// for another writer, another postdove or someone with the sqlite3 shell.
+// The engine waits for up to the busy timeout and after that we back
+// off and try again a few times before giving up.
+
+// DefaultBusyTimeout
+// How long the engine waits for a lock before it says it is busy.
+// This is the sqlite3 driver's own default.
+const DefaultBusyTimeout = 5 * time.Second
+
+// RetryPolicy
+// How many times to try a write that found the database busy and how
+// long to wait in between. The wait doubles each time, up to MaxDelay,
+// with some jitter so competing writers don't keep colliding.
+type RetryPolicy struct {
+	Attempts int // total tries, 1 is no retry
+	Delay    time.Duration
+	MaxDelay time.Duration
+}
+
+// DefaultRetryPolicy
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts: 5,
+	Delay:    50 * time.Millisecond,
+	MaxDelay: 2 * time.Second,
+}
+
+// wait
+// How long to wait before try number attempt+1
+func (p RetryPolicy) wait(attempt int) time.Duration {
+	d := p.Delay
+	for i := 1; i < attempt && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d > 0 {
+		d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	}
+	return d
+}
+
+// SetRetryPolicy
+// Set how Begin and WithTx retry when the database is busy
+func (mdb *MailDB) SetRetryPolicy(p RetryPolicy) error {
+	if p.Attempts < 1 || p.Delay < 0 || p.MaxDelay < 0 {
+		return fmt.Errorf("SetRetryPolicy: %d attempts, %s delay, %s max delay is not a policy",
+			p.Attempts, p.Delay, p.MaxDelay)
+	}
+	mdb.mu.Lock()
+	mdb.retry = p
+	mdb.mu.Unlock()
+	return nil
+}
+
+// retryPolicy
+func (mdb *MailDB) retryPolicy() RetryPolicy {
+	mdb.mu.Lock()
+	defer mdb.mu.Unlock()
+
+	return mdb.retry
+}
+
+// backoff
+// Wait before the next try unless ctx is done first
+func (mdb *MailDB) backoff(ctx context.Context, p RetryPolicy, attempt int) error {
+	t := time.NewTimer(p.wait(attempt))
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// IsErrBusy
+// The database was too busy to do it. Try again later.
+func IsErrBusy(err error) bool {
+	for _, d := range dialects {
+		if d.busy(err) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetBusyTimeout
+// Set how long the engine waits for another writer before it says
+// the database is busy. The connections are re-opened so this can't
+// be done with a transaction going.
+func (mdb *MailDB) SetBusyTimeout(busy time.Duration) error {
+	if busy < 0 {
+		return fmt.Errorf("SetBusyTimeout: %s is not a timeout", busy)
+	}
+	mdb.mu.Lock()
+	defer mdb.mu.Unlock()
+
+	if mdb.db == nil {
+		return ErrMdbNotOpen
+	}
+	if mdb.txCount > 0 {
+		return ErrMdbInTransaction
+	}
+	db, err := mdb.dialect.open(mdb.path, busy)
+	if err != nil {
+		return fmt.Errorf("SetBusyTimeout: %s", err)
+	}
+	mdb.db.Close()
+	mdb.db = db
+	mdb.busyTimeout = busy
+	return nil
+}
+
+// EnableWAL
+// Put the database in write-ahead log mode. This sticks to the database
+// so it only has to be done once, when it is created.
+func (mdb *MailDB) EnableWAL() error {
+	if mdb.db == nil {
+		return ErrMdbNotOpen
+	}
+	if err := mdb.dialect.enableWAL(mdb.db); err != nil {
+		return fmt.Errorf("EnableWAL: %s", err)
+	}
+	return nil
+}
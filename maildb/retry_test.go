@@ -0,0 +1,204 @@
+package maildb
+
+/*
+ * Copyright (C) 2020, Jim Lieb <lieb@sea-troll.net>
+ *
+ * This program is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 3 of the License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ *
+ * -------------
+ */
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// TestRetry
+// WAL mode, the busy timeout, and backing off when another writer
+// has the database
+func TestRetry(t *testing.T) {
+	var (
+		err    error
+		mdb    *MailDB
+		dir    string
+		dbfile string
+		tx     *Tx
+		mode   string
+	)
+
+	fmt.Printf("Retry test\n")
+
+	dir, err = ioutil.TempDir("", "TestRetry-*")
+	defer os.RemoveAll(dir)
+	dbfile = filepath.Join(dir, "test.db")
+	mdb, err = makeTestDB(dbfile)
+	if err != nil {
+		t.Fatalf("Database load failed, %s", err)
+	}
+	defer mdb.Close()
+
+	// What is busy and what isn't
+	busy := sqlite3.Error{Code: sqlite3.ErrBusy}
+	if !IsErrBusy(busy) {
+		t.Errorf("IsErrBusy: expected sqlite busy to be busy")
+	}
+	if !IsErrBusy(fmt.Errorf("Begin: %w", busy)) {
+		t.Errorf("IsErrBusy: expected wrapped sqlite busy to be busy")
+	}
+	if !IsErrBusy(&pq.Error{Code: "40001"}) {
+		t.Errorf("IsErrBusy: expected serialization failure to be busy")
+	}
+	if IsErrBusy(sqlite3.Error{Code: sqlite3.ErrConstraint}) {
+		t.Errorf("IsErrBusy: constraint error is not busy")
+	}
+	if IsErrBusy(ErrMdbBadName) {
+		t.Errorf("IsErrBusy: %s is not busy", ErrMdbBadName)
+	}
+
+	// The policy
+	if err = mdb.SetRetryPolicy(RetryPolicy{Attempts: 0}); err == nil {
+		t.Errorf("SetRetryPolicy: expected error for no attempts")
+	}
+	if err = mdb.SetRetryPolicy(RetryPolicy{Attempts: 1, Delay: -1}); err == nil {
+		t.Errorf("SetRetryPolicy: expected error for negative delay")
+	}
+	p := RetryPolicy{Attempts: 5, Delay: 10 * time.Millisecond, MaxDelay: 40 * time.Millisecond}
+	for attempt, max := range []time.Duration{10, 20, 40, 40, 40} {
+		max *= time.Millisecond
+		if w := p.wait(attempt + 1); w < max/2 || w > max {
+			t.Errorf("wait: attempt %d, expected %s to %s, got %s", attempt+1, max/2, max, w)
+		}
+	}
+
+	// WAL mode
+	if err = mdb.EnableWAL(); err != nil {
+		t.Errorf("EnableWAL: unexpected error, %s", err)
+	}
+	if err = mdb.db.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil {
+		t.Errorf("journal_mode: unexpected error, %s", err)
+	} else if mode != "wal" {
+		t.Errorf("journal_mode: expected wal, got %s", mode)
+	}
+
+	// The busy timeout
+	if err = mdb.SetBusyTimeout(-time.Second); err == nil {
+		t.Errorf("SetBusyTimeout: expected error for negative timeout")
+	}
+	tx = beginTx(t, mdb)
+	if err = mdb.SetBusyTimeout(time.Second); err != ErrMdbInTransaction {
+		t.Errorf("SetBusyTimeout: expected %s, got %v", ErrMdbInTransaction, err)
+	}
+	tx.End(&err)
+	if err = mdb.SetBusyTimeout(10 * time.Millisecond); err != nil {
+		t.Fatalf("SetBusyTimeout: unexpected error, %s", err)
+	}
+
+	// Someone else has the write lock
+	other, err := sql.Open("sqlite3", dsn(dbfile, 0))
+	if err != nil {
+		t.Fatalf("Open of other: unexpected error, %s", err)
+	}
+	defer other.Close()
+	otx, err := other.Begin()
+	if err != nil {
+		t.Fatalf("Begin of other: unexpected error, %s", err)
+	}
+	if err = mdb.SetRetryPolicy(RetryPolicy{Attempts: 3, Delay: time.Millisecond}); err != nil {
+		t.Errorf("SetRetryPolicy: unexpected error, %s", err)
+	}
+	if _, err = mdb.Begin(); err == nil || !IsErrBusy(err) {
+		t.Errorf("Begin: expected busy, got %v", err)
+	}
+	calls := 0
+	if err = mdb.WithTx(func(tx *Tx) error {
+		calls++
+		return nil
+	}); err == nil || !IsErrBusy(err) {
+		t.Errorf("WithTx: expected busy, got %v", err)
+	}
+	if calls != 0 {
+		t.Errorf("WithTx: expected no calls, got %d", calls)
+	}
+
+	// Waiting gives up when the context does
+	if err = mdb.SetRetryPolicy(RetryPolicy{Attempts: 100, Delay: time.Second}); err != nil {
+		t.Errorf("SetRetryPolicy: unexpected error, %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	_, err = mdb.BeginContext(ctx)
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Errorf("BeginContext: expected %s, got %v", context.DeadlineExceeded, err)
+	}
+
+	// and keeps trying until the other lets go
+	if err = mdb.SetRetryPolicy(RetryPolicy{
+		Attempts: 100,
+		Delay:    5 * time.Millisecond,
+		MaxDelay: 20 * time.Millisecond,
+	}); err != nil {
+		t.Errorf("SetRetryPolicy: unexpected error, %s", err)
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		otx.Rollback()
+	}()
+	if tx, err = mdb.Begin(); err != nil {
+		t.Errorf("Begin: expected to get in after other finished, got %s", err)
+	} else {
+		tx.End(&err)
+	}
+
+	// WithTx tries fn again if it was busy, but not for anything else
+	calls = 0
+	if err = mdb.WithTx(func(tx *Tx) error {
+		calls++
+		if calls == 1 {
+			return busy
+		}
+		_, err := tx.InsertDomain("retry.org")
+		return err
+	}); err != nil {
+		t.Errorf("WithTx: unexpected error, %s", err)
+	}
+	if calls != 2 {
+		t.Errorf("WithTx: expected 2 calls, got %d", calls)
+	}
+	if _, err = mdb.LookupDomain("retry.org"); err != nil {
+		t.Errorf("LookupDomain: retry.org, unexpected error, %s", err)
+	}
+	calls = 0
+	if err = mdb.WithTx(func(tx *Tx) error {
+		calls++
+		return ErrMdbBadUpdate
+	}); err != ErrMdbBadUpdate {
+		t.Errorf("WithTx: expected %s, got %v", ErrMdbBadUpdate, err)
+	}
+	if calls != 1 {
+		t.Errorf("WithTx: expected 1 call, got %d", calls)
+	}
+	if mdb.txCount != 0 {
+		t.Errorf("expected no transactions in progress, got %d", mdb.txCount)
+	}
+}
@@ -0,0 +1,321 @@
+package maildb
+
+/*
+ * Copyright (C) 2020, Jim Lieb <lieb@sea-troll.net>
+ *
+ * This program is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 3 of the License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ *
+ * -------------
+ */
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Schema and migration scripts are run one statement at a time so an
+// error can be tied to where it is in the file. Finding where a statement
+// ends is more than looking for ';'. There are semicolons in strings and
+// comments and a trigger body is a list of statements between BEGIN and
+// END. PostgreSQL functions have their bodies in $$ quotes.
+
+// execScript
+// Run a script of SQL statements, one at a time. name is the file it came
+// from for the error messages.
+func (mdb *MailDB) execScript(ctx context.Context, ex execer, name string, script string) error {
+	stmts, err := splitScript(name, script)
+	if err != nil {
+		return err
+	}
+	return mdb.execStatements(ctx, ex, name, stmts)
+}
+
+// execStatements
+// Run the statements of a script that has already been split
+func (mdb *MailDB) execStatements(ctx context.Context, ex execer, name string, stmts []statement) error {
+	for _, st := range stmts {
+		if _, err := ex.ExecContext(ctx, st.text); err != nil {
+			line := st.line
+			if pos := mdb.dialect.position(err); pos > 0 {
+				line += lineOf(st.text, pos) - 1
+			}
+			return scriptError(name, line, err)
+		}
+	}
+	return nil
+}
+
+// statement
+// One statement from a script and the line it starts on
+type statement struct {
+	text string
+	line int
+}
+
+// scriptError
+// Where in the file the problem is
+func scriptError(name string, line int, err interface{}) error {
+	return fmt.Errorf("%s:%d: %v", name, line, err)
+}
+
+// splitScript
+// Break a script into its statements. Comments and blank space
+// between statements are dropped. Inside a statement, they are left as is.
+func splitScript(name string, script string) ([]statement, error) {
+	var (
+		stmts []statement
+		start = -1 // offset of the current statement, -1 if between them
+		first int  // the line it starts on
+		line  = 1
+		words []string // the first few keywords to spot a CREATE TRIGGER
+		depth int      // BEGIN and CASE nesting
+	)
+
+	end := func(i int) {
+		if start >= 0 && start < i { // a lone ';' is nothing
+			stmts = append(stmts, statement{
+				text: strings.TrimSpace(script[start:i]),
+				line: first,
+			})
+		}
+		start, words, depth = -1, nil, 0
+	}
+	for i := 0; i < len(script); {
+		c := script[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+			continue
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f':
+			i++
+			continue
+		case c == '-' && strings.HasPrefix(script[i:], "--"):
+			for i < len(script) && script[i] != '\n' {
+				i++
+			}
+			continue
+		case c == '/' && strings.HasPrefix(script[i:], "/*"):
+			n := strings.Index(script[i+2:], "*/")
+			if n < 0 {
+				return nil, scriptError(name, line, "comment is not closed")
+			}
+			line += strings.Count(script[i:i+2+n+2], "\n")
+			i += 2 + n + 2
+			continue
+		}
+
+		// Something real, it is part of a statement
+		if start < 0 {
+			start, first = i, line
+		}
+		switch {
+		case c == ';':
+			if depth == 0 {
+				end(i)
+			}
+			i++
+		case c == '\'' || c == '"' || c == '`' || c == '[':
+			close := c
+			if c == '[' {
+				close = ']'
+			}
+			j := i + 1
+			for {
+				n := strings.IndexByte(script[j:], close)
+				if n < 0 {
+					return nil, scriptError(name, line, fmt.Sprintf("%c quote is not closed", c))
+				}
+				j += n + 1
+				// a doubled quote is a quote inside, except for []
+				if close != ']' && j < len(script) && script[j] == close {
+					j++
+					continue
+				}
+				break
+			}
+			line += strings.Count(script[i:j], "\n")
+			i = j
+		case c == '$':
+			j := i + 1
+			for j < len(script) && isWordByte(script[j]) {
+				j++
+			}
+			if j < len(script) && script[j] == '$' && (j == i+1 || !isDigit(script[i+1])) {
+				tag := script[i : j+1]
+				n := strings.Index(script[j+1:], tag)
+				if n < 0 {
+					return nil, scriptError(name, line, fmt.Sprintf("%s quote is not closed", tag))
+				}
+				j += 1 + n + len(tag)
+			}
+			line += strings.Count(script[i:j], "\n")
+			i = j
+		case isWordByte(c):
+			j := i
+			for j < len(script) && isWordByte(script[j]) {
+				j++
+			}
+			word := strings.ToUpper(script[i:j])
+			if len(words) < 4 {
+				words = append(words, word)
+			}
+			switch word {
+			case "BEGIN":
+				if isTrigger(words) {
+					depth++
+				}
+			case "CASE":
+				depth++
+			case "END":
+				if depth > 0 {
+					depth--
+				}
+			}
+			i = j
+		default:
+			i++
+		}
+	}
+	if depth > 0 {
+		return nil, scriptError(name, first, "BEGIN or CASE without an END")
+	}
+	end(len(script))
+	return stmts, nil
+}
+
+// isWordByte
+func isWordByte(c byte) bool {
+	return c == '_' || isDigit(c) || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// isDigit
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// isTrigger
+// The statement is a CREATE [TEMP] TRIGGER. Its BEGIN is the start of the
+// body, not a transaction.
+func isTrigger(words []string) bool {
+	if len(words) < 2 || words[0] != "CREATE" {
+		return false
+	}
+	for _, w := range words[1:] {
+		switch w {
+		case "TRIGGER":
+			return true
+		case "TEMP", "TEMPORARY":
+			continue
+		}
+		return false
+	}
+	return false
+}
+
+// lineOf
+// The line of the pos'th character (not byte), counting from 1.
+// This is how PostgreSQL says where an error is.
+func lineOf(script string, pos int) int {
+	line := 1
+	for _, r := range script {
+		if pos--; pos <= 0 {
+			break
+		}
+		if r == '\n' {
+			line++
+		}
+	}
+	return line
+}
+
+// requiredObjects
+// The tables and views this package uses. Anything else in
+// a schema is for postfix and dovecot or just decoration.
+var requiredObjects = map[string]string{
+	"schema_version": "TABLE",
+	"access":         "TABLE",
+	"transport":      "TABLE",
+	"domain":         "TABLE",
+	"address":        "TABLE",
+	"alias":          "TABLE",
+	"vmailbox":       "TABLE",
+	"address_name":   "VIEW",
+	"user_mailbox":   "VIEW",
+}
+
+// checkSchemaScript
+// Look through the statements for the tables and views we need.
+// This is before anything is done to the database so a bad schema
+// leaves it alone.
+func checkSchemaScript(name string, stmts []statement) error {
+	var missing []string
+
+	found := make(map[string]string)
+	for _, st := range stmts {
+		kind, obj := createdObject(st.text)
+		if kind != "" {
+			found[obj] = kind
+		}
+	}
+	for obj, kind := range requiredObjects {
+		if found[obj] != kind {
+			missing = append(missing, strings.ToLower(kind)+" "+obj)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("%s: %s, %s", name, ErrMdbSchemaIncomplete, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// createdObject
+// If the statement is a CREATE TABLE or VIEW, what and its name in lower case
+func createdObject(text string) (kind string, obj string) {
+	f := strings.Fields(text)
+	if len(f) < 3 || strings.ToUpper(f[0]) != "CREATE" {
+		return "", ""
+	}
+	f = f[1:]
+	if len(f) > 2 && strings.ToUpper(f[0]) == "OR" && strings.ToUpper(f[1]) == "REPLACE" {
+		f = f[2:]
+	}
+	if k := strings.ToUpper(f[0]); k == "TEMP" || k == "TEMPORARY" {
+		f = f[1:]
+	}
+	kind = strings.ToUpper(f[0])
+	if kind != "TABLE" && kind != "VIEW" {
+		return "", ""
+	}
+	f = f[1:]
+	if len(f) > 3 && strings.ToUpper(strings.Join(f[:3], " ")) == "IF NOT EXISTS" {
+		f = f[3:]
+	}
+	if len(f) == 0 {
+		return "", ""
+	}
+	obj = f[0]
+	if n := strings.IndexAny(obj, "(;"); n > 0 {
+		obj = obj[:n]
+	}
+	if n := strings.LastIndexByte(obj, '.'); n >= 0 { // schema.name
+		obj = obj[n+1:]
+	}
+	obj = strings.Trim(obj, "\"`[]")
+	return kind, strings.ToLower(obj)
+}
@@ -0,0 +1,214 @@
+package maildb
+
+/*
+ * Copyright (C) 2020, Jim Lieb <lieb@sea-troll.net>
+ *
+ * This program is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 3 of the License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ *
+ * -------------
+ */
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestScript
+// Splitting scripts into statements and saying where the errors are
+func TestScript(t *testing.T) {
+	var (
+		err   error
+		stmts []statement
+	)
+
+	fmt.Printf("Script test\n")
+
+	tests := []struct {
+		name   string
+		script string
+		lines  []int  // where each statement starts
+		last   string // the text of the last one
+		err    string // the error, if any
+	}{
+		{"simple", "SELECT 1;\nSELECT 2;\n", []int{1, 2}, "SELECT 2", ""},
+		{"no final semicolon", "SELECT 1;\n\nSELECT 2\n", []int{1, 3}, "SELECT 2", ""},
+		{"empty ones", ";;\n  ;\nSELECT 1;;\n", []int{3}, "SELECT 1", ""},
+		{"only comments", "-- nothing\n/* at\n all */\n", nil, "", ""},
+		{"semicolon in string", "INSERT INTO x VALUES ('a;b');\nSELECT 'it''s; here';\n",
+			[]int{1, 2}, "SELECT 'it''s; here'", ""},
+		{"semicolon in names", "SELECT \"a;b\", `c;d`, [e;f] FROM x;\n",
+			[]int{1}, "SELECT \"a;b\", `c;d`, [e;f] FROM x", ""},
+		{"semicolon in comments", "-- one; two\nSELECT 1 /* ; */ ;\n-- three;\nSELECT 2;\n",
+			[]int{2, 4}, "SELECT 2", ""},
+		{"multi line string", "SELECT 'a\nb\nc';\nSELECT 3;\n", []int{1, 4}, "SELECT 3", ""},
+		{"transaction", "BEGIN TRANSACTION;\nSELECT 1;\nCOMMIT;\n",
+			[]int{1, 2, 3}, "COMMIT", ""},
+		{"trigger", `CREATE TRIGGER t AFTER DELETE ON x
+ BEGIN
+   DELETE FROM y WHERE id = OLD.id;
+   SELECT CASE WHEN 1 THEN 2 ELSE 3 END;
+ END;
+SELECT 1;
+`, []int{1, 6}, "SELECT 1", ""},
+		{"trigger on one line", "CREATE TEMP TRIGGER t BEFORE INSERT ON x BEGIN SELECT RAISE(FAIL, 'no; way'); END;\nSELECT 1;\n",
+			[]int{1, 2}, "SELECT 1", ""},
+		{"case outside a trigger", "SELECT CASE x WHEN 1 THEN 'a;' END FROM y;\nSELECT 1;\n",
+			[]int{1, 2}, "SELECT 1", ""},
+		{"dollar quotes", `CREATE FUNCTION f() RETURNS trigger AS $$
+BEGIN
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+CREATE FUNCTION g() RETURNS int AS $body$ SELECT 1; $body$ LANGUAGE sql;
+SELECT $1;
+`, []int{1, 6, 7}, "SELECT $1", ""},
+		{"open string", "SELECT 1;\nSELECT 'oops;\n", nil, "", "test.sql:2: ' quote is not closed"},
+		{"open name", "SELECT \"oops;\n", nil, "", "test.sql:1: \" quote is not closed"},
+		{"open comment", "SELECT 1;\n\n/* oops\n", nil, "", "test.sql:3: comment is not closed"},
+		{"open dollar quote", "SELECT 1;\nSELECT $x$ oops;\n", nil, "", "test.sql:2: $x$ quote is not closed"},
+		{"open trigger", "SELECT 1;\nCREATE TRIGGER t AFTER DELETE ON x\n BEGIN\n DELETE FROM y;\n",
+			nil, "", "test.sql:2: BEGIN or CASE without an END"},
+	}
+	for _, test := range tests {
+		stmts, err = splitScript("test.sql", test.script)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error, %s", test.name, err)
+			continue
+		}
+		if len(stmts) != len(test.lines) {
+			t.Errorf("%s: expected %d statements, got %d, %v", test.name, len(test.lines), len(stmts), stmts)
+			continue
+		}
+		for i, st := range stmts {
+			if st.line != test.lines[i] {
+				t.Errorf("%s: statement %d, expected line %d, got %d", test.name, i, test.lines[i], st.line)
+			}
+		}
+		if len(stmts) > 0 && stmts[len(stmts)-1].text != test.last {
+			t.Errorf("%s: expected last statement %q, got %q", test.name, test.last, stmts[len(stmts)-1].text)
+		}
+	}
+
+	// Where in a statement PostgreSQL says the error is
+	if l := lineOf("SELECT\n  foo\n  FROM bar", 10); l != 2 {
+		t.Errorf("lineOf: expected line 2, got %d", l)
+	}
+	if l := lineOf("SELECT 1", 1); l != 1 {
+		t.Errorf("lineOf: expected line 1, got %d", l)
+	}
+
+	// Our own schemas and migrations all split and have what we need
+	for _, d := range dialects {
+		c, err := DbContent.ReadFile(d.schemaFile())
+		if err != nil {
+			t.Fatalf("%s: unexpected error, %s", d.schemaFile(), err)
+		}
+		if stmts, err = splitScript(d.schemaFile(), string(c)); err != nil {
+			t.Errorf("%s: unexpected error, %s", d.schemaFile(), err)
+		} else if err = checkSchemaScript(d.schemaFile(), stmts); err != nil {
+			t.Errorf("%s: unexpected error, %s", d.schemaFile(), err)
+		}
+		ml, err := migrations(d)
+		if err != nil {
+			t.Fatalf("%s migrations: unexpected error, %s", d.name(), err)
+		}
+		for _, m := range ml {
+			if c, err = DbContent.ReadFile(m.file); err != nil {
+				t.Errorf("%s: unexpected error, %s", m.file, err)
+			} else if _, err = splitScript(m.file, string(c)); err != nil {
+				t.Errorf("%s: unexpected error, %s", m.file, err)
+			}
+		}
+	}
+}
+
+// TestLoadSchema
+// A schema from a file is checked before it is loaded and its
+// errors say where they are
+func TestLoadSchema(t *testing.T) {
+	var (
+		err error
+		dir string
+		mdb *MailDB
+	)
+
+	fmt.Printf("Load schema test\n")
+
+	dir, err = ioutil.TempDir("", "TestLoadSchema-*")
+	defer os.RemoveAll(dir)
+
+	c, err := DbContent.ReadFile("files/schema.sql")
+	if err != nil {
+		t.Fatalf("Read of schema: unexpected error, %s", err)
+	}
+	schema := string(c)
+
+	// no vmailbox table or address_name view
+	incomplete := filepath.Join(dir, "incomplete.sql")
+	s := strings.Replace(schema, `CREATE TABLE "VMailbox"`, `CREATE TABLE "NotMailbox"`, 1)
+	s = strings.Replace(s, `CREATE VIEW "address_name"`, `CREATE TABLE "address_name"`, 1)
+	if err = os.WriteFile(incomplete, []byte(s), 0644); err != nil {
+		t.Fatalf("Write of %s: unexpected error, %s", incomplete, err)
+	}
+	// a typo well down the file
+	broken := filepath.Join(dir, "broken.sql")
+	s = strings.Replace(schema, `CREATE VIEW "user_deny" AS`, `CREATE VEIW "user_deny" AS`, 1)
+	if err = os.WriteFile(broken, []byte(s), 0644); err != nil {
+		t.Fatalf("Write of %s: unexpected error, %s", broken, err)
+	}
+	typoLine := strings.Count(s[:strings.Index(s, `CREATE VEIW`)], "\n") + 1
+
+	if mdb, err = NewMailDB(filepath.Join(dir, "test.db")); err != nil {
+		t.Fatalf("NewMailDB: unexpected error, %s", err)
+	}
+	defer mdb.Close()
+
+	err = mdb.LoadSchema(incomplete)
+	if err == nil {
+		t.Errorf("LoadSchema: expected %s", ErrMdbSchemaIncomplete)
+	} else {
+		for _, want := range []string{ErrMdbSchemaIncomplete.Error(), "table vmailbox", "view address_name"} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("LoadSchema: expected %q in %s", want, err)
+			}
+		}
+	}
+	if ok, err := mdb.hasTable("domain"); err != nil || ok {
+		t.Errorf("LoadSchema: expected nothing done to the database, %v, %v", ok, err)
+	}
+
+	err = mdb.LoadSchema(broken)
+	want := fmt.Sprintf("%s:%d:", broken, typoLine)
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("LoadSchema: expected error at %s, got %v", want, err)
+	}
+
+	if err = mdb.LoadSchema("notdotslash.sql"); err == nil {
+		t.Errorf("LoadSchema: expected error for a relative name")
+	}
+	if err = mdb.LoadSchema(""); err != nil {
+		t.Errorf("LoadSchema: builtin schema, unexpected error, %s", err)
+	}
+}
@@ -0,0 +1,325 @@
+package maildb
+
+/*
+ * Copyright (C) 2020, Jim Lieb <lieb@sea-troll.net>
+ *
+ * This program is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 3 of the License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ *
+ * -------------
+ */
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// SieveScript
+// A named Sieve filter of a mailbox. Only the active one is run at
+// delivery. The modified time is UTC in AuditStampFormat.
+type SieveScript struct {
+	mdb      *MailDB
+	tx       *Tx // nil unless from a transaction
+	id       int64
+	mailbox  int64
+	user     string
+	name     string
+	script   string
+	active   int64
+	version  int64
+	modified string
+}
+
+// sieveCols
+// The sievescript columns, in scan() order
+const sieveCols = `s.id, s.mailbox, s.name, s.script, s.active, s.version, s.modified`
+
+// scan
+func (s *SieveScript) scan() []interface{} {
+	return []interface{}{&s.id, &s.mailbox, &s.name, &s.script,
+		&s.active, &s.version, &s.modified}
+}
+
+// sieveQuery
+// All the scripts of a mailbox. Add to the WHERE.
+const sieveQuery = `SELECT ` + sieveCols + `
+ FROM sievescript AS s JOIN address AS a ON (a.id = s.mailbox)
+ JOIN domain AS d ON (a.domain = d.id)
+ WHERE a.localpart = ? AND d.name = ?`
+
+// checkSieveName
+// A script name is part of a dict key so it can't have a /, "active"
+// is how dovecot finds the active one, and "vacation" is made from the
+// mailbox's Vacation.
+func checkSieveName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || strings.ContainsAny(name, "/\n\r\t") ||
+		strings.EqualFold(name, "active") || strings.EqualFold(name, VacationScript) {
+		return "", ErrMdbSieveBadName
+	}
+	return name, nil
+}
+
+// FindSieveScripts
+// The scripts of the user's mailbox by name
+func (mdb *MailDB) FindSieveScripts(user string) ([]*SieveScript, error) {
+	return mdb.FindSieveScriptsContext(context.Background(), user)
+}
+
+// FindSieveScriptsContext
+// FindSieveScripts that gives up when ctx is done
+func (mdb *MailDB) FindSieveScriptsContext(ctx context.Context, user string) ([]*SieveScript, error) {
+	var (
+		ap   *AddressParts
+		rows *sql.Rows
+		sl   []*SieveScript
+		err  error
+	)
+
+	if ap, err = DecodeRFC822(user); err != nil {
+		return nil, err
+	}
+	if _, err = mdb.LookupVMailboxContext(ctx, user); err != nil {
+		return nil, err
+	}
+	rows, err = mdb.db.QueryContext(ctx, sieveQuery+" ORDER BY s.name", ap.lpart, ap.domain)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		s := &SieveScript{mdb: mdb, user: user}
+		if err = rows.Scan(s.scan()...); err != nil {
+			break
+		}
+		sl = append(sl, s)
+	}
+	if e := rows.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err == nil && len(sl) == 0 {
+		err = ErrMdbSieveNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sl, nil
+}
+
+// LookupSieveScript
+// outside transactions
+func (mdb *MailDB) LookupSieveScript(user string, name string) (*SieveScript, error) {
+	return mdb.LookupSieveScriptContext(context.Background(), user, name)
+}
+
+// LookupSieveScriptContext
+// LookupSieveScript that gives up when ctx is done
+func (mdb *MailDB) LookupSieveScriptContext(ctx context.Context, user string, name string) (*SieveScript, error) {
+	ap, err := DecodeRFC822(user)
+	if err != nil {
+		return nil, err
+	}
+	s := &SieveScript{mdb: mdb, user: user}
+	row := mdb.db.QueryRowContext(ctx, sieveQuery+" AND s.name = ?",
+		ap.lpart, ap.domain, strings.TrimSpace(name))
+	switch err := row.Scan(s.scan()...); err {
+	case sql.ErrNoRows:
+		return nil, ErrMdbSieveNotFound
+	case nil:
+		return s, nil
+	default:
+		return nil, err
+	}
+}
+
+// GetSieveScript
+// inside transactions
+func (tx *Tx) GetSieveScript(user string, name string) (*SieveScript, error) {
+	if !tx.active() {
+		return nil, ErrMdbTransaction
+	}
+	ap, err := DecodeRFC822(user)
+	if err != nil {
+		return nil, err
+	}
+	s := &SieveScript{mdb: tx.mdb, tx: tx, user: user}
+	row := tx.queryRow(sieveQuery+" AND s.name = ?", ap.lpart, ap.domain, strings.TrimSpace(name))
+	switch err := row.Scan(s.scan()...); err {
+	case sql.ErrNoRows:
+		return nil, ErrMdbSieveNotFound
+	case nil:
+		return s, nil
+	default:
+		return nil, err
+	}
+}
+
+// InsertSieveScript
+// Add the named script to the user's mailbox. It is checked with
+// CheckSieve first and is not active.
+func (tx *Tx) InsertSieveScript(user string, name string, script string) (*SieveScript, error) {
+	var err error
+
+	if !tx.active() {
+		return nil, ErrMdbTransaction
+	}
+	if name, err = checkSieveName(name); err != nil {
+		return nil, err
+	}
+	return tx.insertSieveScript(user, name, script)
+}
+
+// insertSieveScript
+// InsertSieveScript without the name check for the scripts postdove makes
+func (tx *Tx) insertSieveScript(user string, name string, script string) (*SieveScript, error) {
+	var (
+		mb  *VMailbox
+		err error
+	)
+
+	if err = CheckSieve(script); err != nil {
+		return nil, err
+	}
+	if mb, err = tx.GetVMailbox(user); err != nil {
+		return nil, err
+	}
+	_, err = tx.insert("INSERT INTO sievescript (mailbox, name, script) VALUES (?, ?, ?)",
+		mb.a.Id(), name, script)
+	if err != nil {
+		if IsErrConstraintUnique(err) {
+			err = ErrMdbDupSieve
+		}
+		return nil, err
+	}
+	return tx.GetSieveScript(user, name)
+}
+
+// DeleteSieveScript
+func (tx *Tx) DeleteSieveScript(user string, name string) error {
+	s, err := tx.GetSieveScript(user, name)
+	if err != nil {
+		return err
+	}
+	res, err := tx.exec("DELETE FROM sievescript WHERE id = ?", s.id)
+	if err == nil {
+		n, err := res.RowsAffected()
+		if err == nil && n == 0 {
+			return ErrMdbSieveNotFound
+		}
+	}
+	return err
+}
+
+// User
+func (s *SieveScript) User() string {
+	return s.user
+}
+
+// Name
+func (s *SieveScript) Name() string {
+	return s.name
+}
+
+// Script
+func (s *SieveScript) Script() string {
+	return s.script
+}
+
+// IsActive
+// Is this the script run at delivery?
+func (s *SieveScript) IsActive() bool {
+	return s.active != 0
+}
+
+// Version
+// How many times the script has been set, from 1
+func (s *SieveScript) Version() int64 {
+	return s.version
+}
+
+// Modified
+// When the script was last set, in UTC
+func (s *SieveScript) Modified() time.Time {
+	return parseStamp(s.modified)
+}
+
+// update
+// Set columns of this script. cols is "col = ?, ..." for vals
+func (s *SieveScript) update(cols string, vals ...interface{}) error {
+	if s.tx == nil || !s.tx.active() {
+		return ErrMdbTransaction
+	}
+	vals = append(vals, s.id)
+	res, err := s.tx.exec("UPDATE sievescript SET "+cols+" WHERE id = ?", vals...)
+	if err == nil {
+		n, err := res.RowsAffected()
+		if err == nil && n != 1 {
+			return ErrMdbBadUpdate
+		}
+	}
+	return err
+}
+
+// SetScript
+// Replace the script, checking it first. The new version makes
+// dovecot compile it again.
+func (s *SieveScript) SetScript(script string) error {
+	if err := CheckSieve(script); err != nil {
+		return err
+	}
+	now := time.Now().UTC().Format(AuditStampFormat)
+	if err := s.update("script = ?, version = version + 1, modified = ?", script, now); err != nil {
+		return err
+	}
+	s.script = script
+	s.version++
+	s.modified = now
+	return nil
+}
+
+// Activate
+// Make this the script run at delivery, in place of the mailbox's
+// active one if it has one.
+func (s *SieveScript) Activate() error {
+	if s.tx == nil || !s.tx.active() {
+		return ErrMdbTransaction
+	}
+	if s.IsActive() {
+		return nil
+	}
+	_, err := s.tx.exec("UPDATE sievescript SET active = 0 WHERE mailbox = ? AND active = 1",
+		s.mailbox)
+	if err != nil {
+		return err
+	}
+	if err = s.update("active = ?", 1); err != nil {
+		return err
+	}
+	s.active = 1
+	return nil
+}
+
+// Deactivate
+// Leave the mailbox with no script run at delivery if this was it
+func (s *SieveScript) Deactivate() error {
+	if !s.IsActive() {
+		return nil
+	}
+	if err := s.update("active = ?", 0); err != nil {
+		return err
+	}
+	s.active = 0
+	return nil
+}
@@ -0,0 +1,313 @@
+package maildb
+
+/*
+ * Copyright (C) 2020, Jim Lieb <lieb@sea-troll.net>
+ *
+ * This program is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 3 of the License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ *
+ * -------------
+ */
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestSieveCheck
+// Scripts that Pigeonhole takes and ones it doesn't. err is what the
+// error ends with, "" if it is good.
+func TestSieveCheck(t *testing.T) {
+	fmt.Printf("Sieve Check Test\n")
+
+	for _, s := range []struct {
+		script, err string
+	}{
+		{"", ""},
+		{"keep;", ""},
+		{"# nothing but a comment\n/* and\nanother */\n", ""},
+		{`require ["fileinto", "reject"];
+if header :contains "subject" "[SPAM]" {
+  fileinto "Junk";
+  stop;
+} elsif address :is :domain "from" ["example.com", "example.org"] {
+  keep;
+} elsif anyof (size :over 1M, not exists "date") {
+  reject "too big or no date";
+} else {
+  discard;
+}
+`, ""},
+		{`require "vacation";
+vacation :days 7 :subject "Away" :addresses ["me@example.com"] text:
+I am away.
+..and dot stuffed
+.
+;
+`, ""},
+		{"require \"vacation\";\nvacation text: # a comment\nhello\n.\n;\n", ""},
+		{`require ["variables", "imap4flags", "relational", "comparator-i;ascii-numeric"];
+if header :value "ge" :comparator "i;ascii-numeric" "x-spam-score" "5" {
+  set "flag" "\\Seen";
+  addflag "${flag}";
+  setflag "x" ["\\Flagged"];
+}
+`, ""},
+		{"require [\"envelope\", \"subaddress\"];\nif envelope :detail \"to\" \"lists\" { keep; }\n", ""},
+		{"require \"vnd.dovecot.pipe\";\npipe \"sa-learn\";\n", ""},
+		{"REQUIRE \"fileinto\"; FileInto \"INBOX\";", ""},
+		{"keep", "line 1, expected \";\" after keep, got end of script"},
+		{"keep;\nrequire \"fileinto\";\n", "line 2, require must come before other commands"},
+		{"fileinto \"Junk\";", "line 1, fileinto needs require \"fileinto\""},
+		{"require \"nosuch\";", "line 1, unknown extension \"nosuch\""},
+		{"frobnicate;", "line 1, unknown command \"frobnicate\""},
+		{"if frob { keep; }", "line 1, unknown test \"frob\""},
+		{"if true { keep;\n", "line 2, block is not closed"},
+		{"keep; }", "line 1, unexpected \"}\""},
+		{"else { keep; }", "line 1, else without if"},
+		{"if true keep;", "line 1, unknown test \"keep\""},
+		{"if true;", "line 1, if needs a block"},
+		{"keep { stop; }", "line 1, keep does not take a block"},
+		{"if (true) { keep; }", "line 1, if needs one test"},
+		{"if anyof true { keep; }", "line 1, anyof needs a test list"},
+		{"if true, false { keep; }", "line 1, expected \";\" after if, got \",\""},
+		{"if size 100 { keep; }", "line 1, size needs :over or :under"},
+		{"if size :over :under 100 { keep; }", "line 1, :over and :under cannot be used together"},
+		{"if size :over \"100\" { keep; }", "line 1, argument 1 of size must be a number"},
+		{"if size :over 10X { keep; }", "line 1, bad number \"10X\""},
+		{"if header :is :is \"a\" \"b\" { keep; }", "line 1, :is is used twice"},
+		{"if header :is :contains \"a\" \"b\" { keep; }", "line 1, :is and :contains cannot be used together"},
+		{"if header :regex \"a\" \"b\" { keep; }", "line 1, :regex needs require \"regex\""},
+		{"if header :over \"a\" \"b\" { keep; }", "line 1, header has no :over tag"},
+		{"if header \"a\" { keep; }", "line 1, header takes 2 arguments, not 1"},
+		{"if header :comparator { keep; }", "line 1, :comparator needs an argument"},
+		{"if header :comparator \"i;ascii-numeric\" \"a\" \"b\" { keep; }",
+			"line 1, comparator \"i;ascii-numeric\" needs require \"comparator-i;ascii-numeric\""},
+		{"redirect [\"a@b.c\", \"d@e.f\"];", "line 1, argument 1 of redirect must be a string"},
+		{"redirect \"a@b.c\";\nredirect [];", "line 2, expected a string in string list, got \"]\""},
+		{"redirect \"a@b.c;", "line 1, string is not closed"},
+		{"/* not closed\nkeep;", "line 1, comment is not closed"},
+		{"require \"vacation\";\nvacation text:\nno end\n", "line 2, text: is not ended by a line with only a \".\""},
+		{"require \"vacation\";\nvacation text: x\n.\n;", "line 2, text: must be followed by the end of the line"},
+		{"keep;\n\n@", "line 3, unexpected '@'"},
+		{"keep :\"x\";", "line 1, tag has no name"},
+		{"keep;\xff", "not UTF-8"},
+	} {
+		err := CheckSieve(s.script)
+		if s.err == "" {
+			if err != nil {
+				t.Errorf("CheckSieve(%q): unexpected error, %s", s.script, err)
+			}
+		} else if err == nil || !errors.Is(err, ErrMdbBadSieve) ||
+			!strings.HasSuffix(err.Error(), s.err) {
+			t.Errorf("CheckSieve(%q): expected %s, got %v", s.script, s.err, err)
+		}
+	}
+}
+
+// TestSieveScripts
+func TestSieveScripts(t *testing.T) {
+	var (
+		err error
+		mdb *MailDB
+		dir string
+	)
+
+	fmt.Printf("Sieve Scripts Test\n")
+
+	dir, err = ioutil.TempDir("", "TestSieveScripts-*")
+	defer os.RemoveAll(dir)
+	mdb, err = makeTestDB(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Errorf("Database load failed, %s", err)
+		return
+	}
+	defer mdb.Close()
+
+	spam := "require \"fileinto\";\nif header :contains \"subject\" \"SPAM\" { fileinto \"Junk\"; }\n"
+	err = mdb.WithTx(func(tx *Tx) error {
+		d, err := tx.InsertDomain("skywalker")
+		if err == nil {
+			err = d.SetClass("vmailbox")
+		}
+		for _, u := range []string{"luke", "leia"} {
+			if err != nil {
+				break
+			}
+			_, err = tx.InsertVMailbox(u + "@skywalker")
+		}
+		if err != nil {
+			return err
+		}
+		if _, err = tx.InsertSieveScript("luke@skywalker", "spam", spam); err != nil {
+			return err
+		}
+		s, err := tx.InsertSieveScript("luke@skywalker", " keep ", "keep;")
+		if err != nil {
+			return err
+		}
+		if err = s.Activate(); err != nil {
+			return err
+		}
+		_, err = tx.InsertSieveScript("leia@skywalker", "spam", spam)
+		return err
+	})
+	if err != nil {
+		t.Errorf("Insert of scripts failed, %s", err)
+		return
+	}
+
+	// Mistakes
+	err = mdb.WithTx(func(tx *Tx) error {
+		for _, n := range []string{"", " ", "active", "Active", "vacation", "a/b"} {
+			if _, err := tx.InsertSieveScript("luke@skywalker", n, "keep;"); err != ErrMdbSieveBadName {
+				return fmt.Errorf("name %q: expected ErrMdbSieveBadName, got %v", n, err)
+			}
+		}
+		if _, err := tx.InsertSieveScript("luke@skywalker", "spam", "keep;"); err != ErrMdbDupSieve {
+			return fmt.Errorf("dup spam: expected ErrMdbDupSieve, got %v", err)
+		}
+		if _, err := tx.InsertSieveScript("luke@skywalker", "bad", "fileinto \"x\";"); !errors.Is(err, ErrMdbBadSieve) {
+			return fmt.Errorf("bad script: expected ErrMdbBadSieve, got %v", err)
+		}
+		if _, err := tx.InsertSieveScript("han@skywalker", "spam", "keep;"); err != ErrMdbAddressNotFound {
+			return fmt.Errorf("han: expected ErrMdbAddressNotFound, got %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Bad inserts: %s", err)
+	}
+
+	sl, err := mdb.FindSieveScripts("luke@skywalker")
+	if err != nil || len(sl) != 2 {
+		t.Errorf("Find luke's scripts: expected 2, got %d, %v", len(sl), err)
+		return
+	}
+	if sl[0].Name() != "keep" || !sl[0].IsActive() || sl[0].Version() != 1 ||
+		sl[0].Modified().IsZero() || sl[1].Name() != "spam" || sl[1].IsActive() ||
+		sl[1].Script() != spam {
+		t.Errorf("Find luke's scripts: unexpected %s, %v, %s, %v",
+			sl[0].Name(), sl[0].IsActive(), sl[1].Name(), sl[1].IsActive())
+	}
+	if _, err = mdb.FindSieveScripts("han@skywalker"); err != ErrMdbAddressNotFound {
+		t.Errorf("Find han's scripts: expected ErrMdbAddressNotFound, got %v", err)
+	}
+	if _, err = mdb.LookupSieveScript("leia@skywalker", "keep"); err != ErrMdbSieveNotFound {
+		t.Errorf("Lookup leia's keep: expected ErrMdbSieveNotFound, got %v", err)
+	}
+
+	// The dict view, what dovecot sees
+	dict := func(user, name string) (string, string) {
+		var id, data string
+		row := mdb.db.QueryRow("SELECT id FROM user_sieve WHERE username = ? AND script_name = ?",
+			user, name)
+		if err := row.Scan(&id); err != nil {
+			return "", ""
+		}
+		row = mdb.db.QueryRow("SELECT script_data FROM user_sieve WHERE username = ? AND id = ?",
+			user, id)
+		if err := row.Scan(&data); err != nil {
+			return id, ""
+		}
+		return id, data
+	}
+	keepID, data := dict("luke@skywalker", "active")
+	if keepID == "" || data != "keep;" {
+		t.Errorf("Dict luke active: expected keep;, got %q, %q", keepID, data)
+	}
+	if id, _ := dict("luke@skywalker", "keep"); id != keepID {
+		t.Errorf("Dict luke keep: expected %s, got %s", keepID, id)
+	}
+	if id, data := dict("luke@skywalker", "spam"); id == "" || data != spam {
+		t.Errorf("Dict luke spam: unexpected %q, %q", id, data)
+	}
+	if id, _ := dict("leia@skywalker", "active"); id != "" {
+		t.Errorf("Dict leia active: expected none, got %s", id)
+	}
+
+	// Edit and switch the active one
+	err = mdb.WithTx(func(tx *Tx) error {
+		s, err := tx.GetSieveScript("luke@skywalker", "keep")
+		if err != nil {
+			return err
+		}
+		if err = s.SetScript("stop"); !errors.Is(err, ErrMdbBadSieve) {
+			return fmt.Errorf("set bad: expected ErrMdbBadSieve, got %v", err)
+		}
+		if err = s.SetScript("keep;\nstop;\n"); err != nil {
+			return err
+		}
+		if s.Version() != 2 {
+			return fmt.Errorf("set keep: expected version 2, got %d", s.Version())
+		}
+		s, err = tx.GetSieveScript("luke@skywalker", "spam")
+		if err != nil {
+			return err
+		}
+		return s.Activate()
+	})
+	if err != nil {
+		t.Errorf("Edit luke's scripts: %s", err)
+	}
+	id, data := dict("luke@skywalker", "active")
+	if data != spam {
+		t.Errorf("Dict luke active after edit: expected spam, got %q, %q", id, data)
+	}
+	if id, data := dict("luke@skywalker", "keep"); id == keepID || data != "keep;\nstop;\n" {
+		t.Errorf("Dict luke keep after edit: expected a new id and script, got %q, %q", id, data)
+	}
+	var cnt int
+	row := mdb.db.QueryRow("SELECT count(*) FROM sievescript WHERE active = 1")
+	if err = row.Scan(&cnt); err != nil || cnt != 1 {
+		t.Errorf("Active scripts: expected 1, got %d, %v", cnt, err)
+	}
+
+	// Deactivate, delete, and the mailbox takes its scripts with it
+	err = mdb.WithTx(func(tx *Tx) error {
+		s, err := tx.GetSieveScript("luke@skywalker", "spam")
+		if err != nil {
+			return err
+		}
+		if err = s.Deactivate(); err != nil {
+			return err
+		}
+		if err = tx.DeleteSieveScript("luke@skywalker", "keep"); err != nil {
+			return err
+		}
+		if err = tx.DeleteSieveScript("luke@skywalker", "keep"); err != ErrMdbSieveNotFound {
+			return fmt.Errorf("delete keep again: expected ErrMdbSieveNotFound, got %v", err)
+		}
+		return tx.DeleteVMailbox("leia@skywalker")
+	})
+	if err != nil {
+		t.Errorf("Delete scripts: %s", err)
+	}
+	if id, _ := dict("luke@skywalker", "active"); id != "" {
+		t.Errorf("Dict luke active after deactivate: expected none, got %s", id)
+	}
+	row = mdb.db.QueryRow("SELECT count(*) FROM sievescript")
+	if err = row.Scan(&cnt); err != nil || cnt != 1 {
+		t.Errorf("Scripts after delete: expected 1, got %d, %v", cnt, err)
+	}
+	row = mdb.db.QueryRow("SELECT count(*) FROM audit WHERE entity = 'sieve'")
+	if err = row.Scan(&cnt); err != nil || cnt != 10 {
+		t.Errorf("Sieve audit: expected 10 records, got %d, %v", cnt, err)
+	}
+}
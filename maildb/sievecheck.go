@@ -0,0 +1,757 @@
+package maildb
+
+/*
+ * Copyright (C) 2020, Jim Lieb <lieb@sea-troll.net>
+ *
+ * This program is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 3 of the License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ *
+ * -------------
+ */
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// A checker for Sieve scripts, RFC 5228, and the extensions Pigeonhole
+// ships with. It does what the Pigeonhole compiler does before it will
+// run a script: the grammar, that require comes first and names known
+// extensions, that commands and tests are known and have the right
+// arguments, and that what they use has been required. It does not run
+// anything so a script that passes can still fail at delivery, e.g. a
+// fileinto of a folder that isn't there.
+
+// sieveTokKind
+type sieveTokKind int
+
+const (
+	sieveEOF sieveTokKind = iota
+	sieveIdent
+	sieveTag
+	sieveNumber
+	sieveString
+	sieveSpecial // one of [ ] ( ) { } ; ,
+)
+
+// sieveToken
+type sieveToken struct {
+	kind sieveTokKind
+	text string // the identifier, tag, number, string, or special
+	line int
+}
+
+// sieveArg
+// An argument of a command or test. A string list has list set
+type sieveArg struct {
+	kind sieveTokKind // sieveTag, sieveNumber, or sieveString
+	text string
+	list []string
+	line int
+}
+
+// isList
+func (a *sieveArg) isList() bool {
+	return a.kind == sieveString && a.list != nil
+}
+
+// sieveNode
+// A parsed command or test
+type sieveNode struct {
+	name     string
+	line     int
+	args     []sieveArg
+	tests    []*sieveNode
+	testList bool // the tests were a ( ) list
+	block    bool // a command with a { } block
+}
+
+// sieveSyntax
+// What a command or test takes. The positional args are matched from
+// the end so optional ones come first.
+type sieveSyntax struct {
+	ext   string         // the extension(s) that must be required, "|" between, "" for the base
+	args  string         // s a string, l a string list, n a number
+	opt   int            // how many of the leading args can be left out
+	tags  map[string]int // the tags and how many arguments each takes
+	test  int            // 0 none, 1 a test, 2 a test list
+	block bool           // ends with a block rather than ;
+}
+
+// sieveTags
+// Make a tag set from the sets and tags in tl
+func sieveTags(tl ...interface{}) map[string]int {
+	tags := make(map[string]int)
+	for _, t := range tl {
+		switch v := t.(type) {
+		case map[string]int:
+			for k, n := range v {
+				tags[k] = n
+			}
+		case string:
+			tags[v] = 0
+		}
+	}
+	return tags
+}
+
+var (
+	sieveMatchTags = map[string]int{":is": 0, ":contains": 0, ":matches": 0,
+		":regex": 0, ":value": 1, ":count": 1, ":comparator": 1}
+	sieveAddrTags = map[string]int{":all": 0, ":localpart": 0, ":domain": 0,
+		":user": 0, ":detail": 0}
+	sieveIndexTags = map[string]int{":index": 1, ":last": 0}
+)
+
+// sieveExclusive
+// The tags of which only one can be used
+var sieveExclusive = [][]string{
+	{":is", ":contains", ":matches", ":regex", ":value", ":count"},
+	{":all", ":localpart", ":domain", ":user", ":detail"},
+	{":over", ":under"},
+	{":personal", ":global"},
+	{":zone", ":originalzone"},
+	{":raw", ":content", ":text"},
+	{":header", ":uniqueid"},
+}
+
+// sieveTagExt
+// Tags that come from an extension. A "command:tag" key is for where
+// the command's own extension has the tag, e.g. vacation's :mime.
+var sieveTagExt = map[string]string{
+	":regex": "regex", ":value": "relational", ":count": "relational",
+	":user": "subaddress", ":detail": "subaddress",
+	":copy": "copy", ":create": "mailbox", ":flags": "imap4flags",
+	":index": "index", ":last": "index",
+	":mime": "mime", ":anychild": "mime", ":type": "mime", ":subtype": "mime",
+	":contenttype": "mime", ":param": "mime",
+	":specialuse": "special-use", ":mailboxid": "mailboxid",
+	":quoteregex": "regex", ":encodeurl": "enotify",
+	"vacation:seconds": "vacation-seconds", "vacation:mime": "", "replace:mime": "",
+	"deleteheader:index": "", "deleteheader:last": "", "addheader:last": "",
+	"duplicate:last": "",
+}
+
+// sieveCommands
+var sieveCommands = map[string]*sieveSyntax{
+	"require":      {args: "l"},
+	"if":           {test: 1, block: true},
+	"elsif":        {test: 1, block: true},
+	"else":         {block: true},
+	"stop":         {},
+	"keep":         {tags: sieveTags(map[string]int{":flags": 1})},
+	"discard":      {},
+	"redirect":     {args: "s", tags: sieveTags(":copy")},
+	"fileinto":     {ext: "fileinto", args: "s", tags: sieveTags(":copy", ":create", map[string]int{":flags": 1, ":specialuse": 1, ":mailboxid": 1})},
+	"reject":       {ext: "reject", args: "s"},
+	"ereject":      {ext: "ereject", args: "s"},
+	"vacation":     {ext: "vacation", args: "s", tags: map[string]int{":days": 1, ":seconds": 1, ":subject": 1, ":from": 1, ":addresses": 1, ":mime": 0, ":handle": 1}},
+	"setflag":      {ext: "imap4flags", args: "sl", opt: 1},
+	"addflag":      {ext: "imap4flags", args: "sl", opt: 1},
+	"removeflag":   {ext: "imap4flags", args: "sl", opt: 1},
+	"set":          {ext: "variables", args: "ss", tags: sieveTags(":lower", ":upper", ":lowerfirst", ":upperfirst", ":quotewildcard", ":quoteregex", ":encodeurl", ":length")},
+	"include":      {ext: "include", args: "s", tags: sieveTags(":personal", ":global", ":once", ":optional")},
+	"return":       {ext: "include"},
+	"global":       {ext: "include", args: "l"},
+	"addheader":    {ext: "editheader", args: "ss", tags: sieveTags(":last")},
+	"deleteheader": {ext: "editheader", args: "sl", opt: 1, tags: sieveTags(sieveMatchTags, sieveIndexTags)},
+	"notify":       {ext: "enotify", args: "s", tags: map[string]int{":from": 1, ":importance": 1, ":options": 1, ":message": 1}},
+	"error":        {ext: "ihave", args: "s"},
+	"foreverypart": {ext: "foreverypart", tags: map[string]int{":name": 1}, block: true},
+	"break":        {ext: "foreverypart", tags: map[string]int{":name": 1}},
+	"replace":      {ext: "replace", args: "s", tags: map[string]int{":mime": 0, ":subject": 1, ":from": 1}},
+	"enclose":      {ext: "enclose", args: "s", tags: map[string]int{":subject": 1, ":headers": 1}},
+	"extracttext":  {ext: "extracttext", args: "s", tags: sieveTags(":lower", ":upper", ":lowerfirst", ":upperfirst", ":quotewildcard", ":length", map[string]int{":first": 1})},
+}
+
+// sieveTests
+var sieveTests = map[string]*sieveSyntax{
+	"address":                  {args: "ll", tags: sieveTags(sieveMatchTags, sieveAddrTags, sieveIndexTags, ":mime", map[string]int{":anychild": 0})},
+	"envelope":                 {ext: "envelope", args: "ll", tags: sieveTags(sieveMatchTags, sieveAddrTags)},
+	"header":                   {args: "ll", tags: sieveTags(sieveMatchTags, sieveIndexTags, ":mime", ":anychild", map[string]int{":type": 0, ":subtype": 0, ":contenttype": 0, ":param": 1})},
+	"exists":                   {args: "l", tags: sieveTags(":mime", ":anychild")},
+	"size":                     {args: "n", tags: sieveTags(":over", ":under")},
+	"not":                      {test: 1},
+	"allof":                    {test: 2},
+	"anyof":                    {test: 2},
+	"true":                     {},
+	"false":                    {},
+	"body":                     {ext: "body", args: "l", tags: sieveTags(sieveMatchTags, ":raw", ":text", map[string]int{":content": 1})},
+	"string":                   {ext: "variables", args: "ll", tags: sieveTags(sieveMatchTags)},
+	"hasflag":                  {ext: "imap4flags", args: "ll", opt: 1, tags: sieveTags(sieveMatchTags)},
+	"date":                     {ext: "date", args: "ssl", tags: sieveTags(sieveMatchTags, sieveIndexTags, ":originalzone", map[string]int{":zone": 1})},
+	"currentdate":              {ext: "date", args: "sl", tags: sieveTags(sieveMatchTags, map[string]int{":zone": 1})},
+	"mailboxexists":            {ext: "mailbox", args: "l"},
+	"duplicate":                {ext: "duplicate", tags: map[string]int{":handle": 1, ":header": 1, ":uniqueid": 1, ":seconds": 1, ":last": 0}},
+	"spamtest":                 {ext: "spamtest|spamtestplus", args: "s", tags: sieveTags(sieveMatchTags, ":percent")},
+	"virustest":                {ext: "virustest", args: "s", tags: sieveTags(sieveMatchTags)},
+	"environment":              {ext: "environment", args: "sl", tags: sieveTags(sieveMatchTags)},
+	"ihave":                    {ext: "ihave", args: "l"},
+	"valid_notify_method":      {ext: "enotify", args: "l"},
+	"notify_method_capability": {ext: "enotify", args: "sll", tags: sieveTags(sieveMatchTags)},
+	"valid_ext_list":           {ext: "extlists", args: "l"},
+	"specialuse_exists":        {ext: "special-use", args: "ll", opt: 1},
+	"metadata":                 {ext: "mboxmetadata", args: "ssl", tags: sieveTags(sieveMatchTags)},
+	"metadataexists":           {ext: "mboxmetadata", args: "sl"},
+	"servermetadata":           {ext: "servermetadata", args: "sl", tags: sieveTags(sieveMatchTags)},
+	"servermetadataexists":     {ext: "servermetadata", args: "l"},
+	"mailboxidexists":          {ext: "mailboxid", args: "l"},
+}
+
+// SieveExtensions
+// The extensions a script can require, the ones Pigeonhole knows.
+// Anything starting with "vnd." is let through too because those are
+// plugins whose commands we can't check.
+var SieveExtensions = []string{
+	"body", "comparator-i;ascii-numeric", "copy", "date", "duplicate",
+	"editheader", "enclose", "encoded-character", "enotify", "envelope",
+	"environment", "ereject", "extlists", "extracttext", "fileinto",
+	"foreverypart", "ihave", "imap4flags", "include", "index", "mailbox",
+	"mailboxid", "mboxmetadata", "mime", "regex", "reject", "relational",
+	"replace", "servermetadata", "spamtest", "spamtestplus", "special-use",
+	"subaddress", "vacation", "vacation-seconds", "variables", "virustest",
+}
+
+// sieveComparators
+// The comparators that don't have to be required
+var sieveComparators = []string{"i;octet", "i;ascii-casemap"}
+
+// CheckSieve
+// Check that script is a Sieve script Pigeonhole will compile. The
+// error is ErrMdbBadSieve, wrapped with the line and what is wrong.
+func CheckSieve(script string) error {
+	if !utf8.ValidString(script) {
+		return fmt.Errorf("%w: not UTF-8", ErrMdbBadSieve)
+	}
+	toks, err := sieveLex(script)
+	if err != nil {
+		return err
+	}
+	p := &sieveParser{toks: toks, required: make(map[string]bool)}
+	return p.commands(true)
+}
+
+// sieveErr
+func sieveErr(line int, format string, a ...interface{}) error {
+	return fmt.Errorf("%w: line %d, %s", ErrMdbBadSieve, line, fmt.Sprintf(format, a...))
+}
+
+// isSieveAlpha
+func isSieveAlpha(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_'
+}
+
+// isSieveDigit
+func isSieveDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// sieveLex
+// Break the script into tokens, dropping the comments
+func sieveLex(s string) ([]sieveToken, error) {
+	var toks []sieveToken
+
+	line := 1
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#':
+			for i < len(s) && s[i] != '\n' {
+				i++
+			}
+		case c == '/' && i+1 < len(s) && s[i+1] == '*':
+			start := line
+			end := strings.Index(s[i+2:], "*/")
+			if end < 0 {
+				return nil, sieveErr(start, "comment is not closed")
+			}
+			line += strings.Count(s[i:i+2+end], "\n")
+			i += end + 4
+		case strings.ContainsRune("[](){};,", rune(c)):
+			toks = append(toks, sieveToken{sieveSpecial, s[i : i+1], line})
+			i++
+		case c == '"':
+			var b strings.Builder
+
+			start := line
+			for i++; ; i++ {
+				if i >= len(s) {
+					return nil, sieveErr(start, "string is not closed")
+				}
+				if s[i] == '"' {
+					i++
+					break
+				}
+				if s[i] == '\\' {
+					i++
+					if i >= len(s) {
+						return nil, sieveErr(start, "string is not closed")
+					}
+				}
+				if s[i] == '\n' {
+					line++
+				}
+				b.WriteByte(s[i])
+			}
+			toks = append(toks, sieveToken{sieveString, b.String(), start})
+		case isSieveDigit(c):
+			j := i
+			for j < len(s) && isSieveDigit(s[j]) {
+				j++
+			}
+			if j < len(s) && strings.IndexByte("KMGkmg", s[j]) >= 0 {
+				j++
+			}
+			if j < len(s) && (isSieveAlpha(s[j]) || isSieveDigit(s[j])) {
+				return nil, sieveErr(line, "bad number %q", s[i:j+1])
+			}
+			toks = append(toks, sieveToken{sieveNumber, s[i:j], line})
+			i = j
+		case c == ':' || isSieveAlpha(c):
+			j := i + 1
+			if c == ':' && (j >= len(s) || !isSieveAlpha(s[j])) {
+				return nil, sieveErr(line, "tag has no name")
+			}
+			for j < len(s) && (isSieveAlpha(s[j]) || isSieveDigit(s[j])) {
+				j++
+			}
+			word := s[i:j]
+			i = j
+			if word == "text" && i < len(s) && s[i] == ':' {
+				text, n, err := sieveMultiLine(s[i+1:], line)
+				if err != nil {
+					return nil, err
+				}
+				toks = append(toks, sieveToken{sieveString, text, line})
+				line += strings.Count(s[i+1:i+1+n], "\n")
+				i += 1 + n
+			} else if c == ':' {
+				toks = append(toks, sieveToken{sieveTag, strings.ToLower(word), line})
+			} else {
+				toks = append(toks, sieveToken{sieveIdent, strings.ToLower(word), line})
+			}
+		default:
+			r, _ := utf8.DecodeRuneInString(s[i:])
+			return nil, sieveErr(line, "unexpected %q", r)
+		}
+	}
+	toks = append(toks, sieveToken{sieveEOF, "", line})
+	return toks, nil
+}
+
+// sieveMultiLine
+// The rest of a text: string. s starts after the ':'. Returns the text
+// with the dot stuffing removed and how much of s it took.
+func sieveMultiLine(s string, line int) (string, int, error) {
+	var b strings.Builder
+
+	i := 0
+	for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+		i++
+	}
+	if i < len(s) && s[i] == '#' {
+		for i < len(s) && s[i] != '\n' {
+			i++
+		}
+	} else if i < len(s) && s[i] == '\r' {
+		i++
+	}
+	if i >= len(s) || s[i] != '\n' {
+		return "", 0, sieveErr(line, "text: must be followed by the end of the line")
+	}
+	i++
+	for i < len(s) {
+		end := strings.IndexByte(s[i:], '\n')
+		if end < 0 {
+			break
+		}
+		l := strings.TrimSuffix(s[i:i+end], "\r")
+		i += end + 1
+		if l == "." {
+			return b.String(), i, nil
+		}
+		if strings.HasPrefix(l, ".") {
+			l = l[1:]
+		}
+		b.WriteString(l)
+		b.WriteString("\r\n")
+	}
+	return "", 0, sieveErr(line, "text: is not ended by a line with only a \".\"")
+}
+
+// sieveParser
+type sieveParser struct {
+	toks     []sieveToken
+	pos      int
+	required map[string]bool
+	vendor   bool // a vnd. extension was required
+	started  bool // a command other than require has been seen
+}
+
+// peek
+func (p *sieveParser) peek() *sieveToken {
+	return &p.toks[p.pos]
+}
+
+// next
+func (p *sieveParser) next() *sieveToken {
+	t := &p.toks[p.pos]
+	if t.kind != sieveEOF {
+		p.pos++
+	}
+	return t
+}
+
+// isSpecial
+func (t *sieveToken) isSpecial(c string) bool {
+	return t.kind == sieveSpecial && t.text == c
+}
+
+// describe
+// the token for an error message
+func (t *sieveToken) describe() string {
+	switch t.kind {
+	case sieveEOF:
+		return "end of script"
+	case sieveString:
+		return "string"
+	default:
+		return "\"" + t.text + "\""
+	}
+}
+
+// commands
+// commands = *command, to the end of the script or block
+func (p *sieveParser) commands(top bool) error {
+	prev := ""
+	for {
+		t := p.peek()
+		if t.kind == sieveEOF {
+			if !top {
+				return sieveErr(t.line, "block is not closed")
+			}
+			return nil
+		}
+		if t.isSpecial("}") {
+			if top {
+				return sieveErr(t.line, "unexpected \"}\"")
+			}
+			return nil
+		}
+		if t.kind != sieveIdent {
+			return sieveErr(t.line, "expected a command, got %s", t.describe())
+		}
+		n, err := p.command()
+		if err != nil {
+			return err
+		}
+		switch n.name {
+		case "require":
+			if !top || p.started {
+				return sieveErr(n.line, "require must come before other commands")
+			}
+		case "elsif", "else":
+			if prev != "if" && prev != "elsif" {
+				return sieveErr(n.line, "%s without if", n.name)
+			}
+			p.started = true
+		default:
+			p.started = true
+		}
+		prev = n.name
+	}
+}
+
+// command
+// command = identifier arguments (";" / block)
+func (p *sieveParser) command() (*sieveNode, error) {
+	t := p.next()
+	n := &sieveNode{name: t.text, line: t.line}
+	if err := p.arguments(n); err != nil {
+		return nil, err
+	}
+	t = p.next()
+	if t.isSpecial("{") {
+		n.block = true
+	} else if !t.isSpecial(";") {
+		return nil, sieveErr(t.line, "expected \";\" after %s, got %s", n.name, t.describe())
+	}
+	if err := p.check(n, sieveCommands, "command"); err != nil {
+		return nil, err
+	}
+	if n.block {
+		if err := p.commands(false); err != nil {
+			return nil, err
+		}
+		p.next() // the }
+	}
+	return n, nil
+}
+
+// test
+// test = identifier arguments
+func (p *sieveParser) test() (*sieveNode, error) {
+	t := p.next()
+	if t.kind != sieveIdent {
+		return nil, sieveErr(t.line, "expected a test, got %s", t.describe())
+	}
+	n := &sieveNode{name: t.text, line: t.line}
+	if err := p.arguments(n); err != nil {
+		return nil, err
+	}
+	if err := p.check(n, sieveTests, "test"); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// arguments
+// arguments = *argument [ test / test-list ]
+func (p *sieveParser) arguments(n *sieveNode) error {
+	for {
+		t := p.peek()
+		switch {
+		case t.kind == sieveTag || t.kind == sieveNumber || t.kind == sieveString:
+			p.next()
+			n.args = append(n.args, sieveArg{kind: t.kind, text: t.text, line: t.line})
+		case t.isSpecial("["):
+			a, err := p.stringList()
+			if err != nil {
+				return err
+			}
+			n.args = append(n.args, *a)
+		case t.kind == sieveIdent:
+			tst, err := p.test()
+			if err != nil {
+				return err
+			}
+			n.tests = append(n.tests, tst)
+			return nil
+		case t.isSpecial("("):
+			p.next()
+			n.testList = true
+			for {
+				tst, err := p.test()
+				if err != nil {
+					return err
+				}
+				n.tests = append(n.tests, tst)
+				t = p.next()
+				if t.isSpecial(")") {
+					return nil
+				}
+				if !t.isSpecial(",") {
+					return sieveErr(t.line, "expected \",\" or \")\" in test list, got %s",
+						t.describe())
+				}
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+// stringList
+// string-list = "[" string *("," string) "]"
+func (p *sieveParser) stringList() (*sieveArg, error) {
+	t := p.next()
+	a := &sieveArg{kind: sieveString, list: []string{}, line: t.line}
+	for {
+		t = p.next()
+		if t.kind != sieveString {
+			return nil, sieveErr(t.line, "expected a string in string list, got %s", t.describe())
+		}
+		a.list = append(a.list, t.text)
+		t = p.next()
+		if t.isSpecial("]") {
+			return a, nil
+		}
+		if !t.isSpecial(",") {
+			return nil, sieveErr(t.line, "expected \",\" or \"]\" in string list, got %s", t.describe())
+		}
+	}
+}
+
+// hasExt
+// Has one of the "|" separated extensions been required?
+func (p *sieveParser) hasExt(ext string) bool {
+	for _, e := range strings.Split(ext, "|") {
+		if p.required[e] {
+			return true
+		}
+	}
+	return false
+}
+
+// check
+// Check a command or test against its syntax in table
+func (p *sieveParser) check(n *sieveNode, table map[string]*sieveSyntax, what string) error {
+	s, ok := table[n.name]
+	if !ok {
+		if p.vendor {
+			return nil // could be a plugin's, we can't know
+		}
+		return sieveErr(n.line, "unknown %s %q", what, n.name)
+	}
+	if s.ext != "" && !p.hasExt(s.ext) {
+		return sieveErr(n.line, "%s needs require %q", n.name,
+			strings.Split(s.ext, "|")[0])
+	}
+
+	// The tags, which can be in any order, and what they take
+	var pos []sieveArg
+	used := make(map[string]bool)
+	for i := 0; i < len(n.args); i++ {
+		a := n.args[i]
+		if a.kind != sieveTag {
+			pos = append(pos, a)
+			continue
+		}
+		tag := a.text
+		cnt, ok := s.tags[tag]
+		if !ok {
+			return sieveErr(a.line, "%s has no %s tag", n.name, tag)
+		}
+		if used[tag] {
+			return sieveErr(a.line, "%s is used twice", tag)
+		}
+		used[tag] = true
+		ext, ok := sieveTagExt[n.name+tag]
+		if !ok {
+			ext = sieveTagExt[tag]
+		}
+		if ext != "" && !p.hasExt(ext) {
+			return sieveErr(a.line, "%s needs require %q", tag, strings.Split(ext, "|")[0])
+		}
+		for j := 0; j < cnt; j++ {
+			i++
+			if i >= len(n.args) || n.args[i].kind == sieveTag {
+				return sieveErr(a.line, "%s needs an argument", tag)
+			}
+		}
+		if tag == ":comparator" {
+			if err := p.checkComparator(&n.args[i]); err != nil {
+				return err
+			}
+		}
+	}
+	for _, ex := range sieveExclusive {
+		var found []string
+		for _, tag := range ex {
+			if used[tag] {
+				found = append(found, tag)
+			}
+		}
+		if len(found) > 1 {
+			return sieveErr(n.line, "%s cannot be used together",
+				strings.Join(found, " and "))
+		}
+	}
+	if n.name == "size" && !used[":over"] && !used[":under"] {
+		return sieveErr(n.line, "size needs :over or :under")
+	}
+
+	// and the positional args, matched from the end
+	if len(pos) > len(s.args) || len(pos) < len(s.args)-s.opt {
+		return sieveErr(n.line, "%s takes %d arguments, not %d", n.name,
+			len(s.args), len(pos))
+	}
+	types := s.args[len(s.args)-len(pos):]
+	for i, a := range pos {
+		switch types[i] {
+		case 'n':
+			if a.kind != sieveNumber {
+				return sieveErr(a.line, "argument %d of %s must be a number", i+1, n.name)
+			}
+		case 's':
+			if a.kind != sieveString || a.isList() {
+				return sieveErr(a.line, "argument %d of %s must be a string", i+1, n.name)
+			}
+		case 'l':
+			if a.kind != sieveString {
+				return sieveErr(a.line, "argument %d of %s must be a string list", i+1, n.name)
+			}
+		}
+	}
+	if n.name == "require" {
+		return p.require(&pos[0])
+	}
+
+	// then the tests and block
+	switch {
+	case s.test == 0 && len(n.tests) > 0:
+		return sieveErr(n.line, "%s does not take a test", n.name)
+	case s.test == 1 && (len(n.tests) != 1 || n.testList):
+		return sieveErr(n.line, "%s needs one test", n.name)
+	case s.test == 2 && !n.testList:
+		return sieveErr(n.line, "%s needs a test list", n.name)
+	}
+	if s.block && !n.block {
+		return sieveErr(n.line, "%s needs a block", n.name)
+	} else if !s.block && n.block {
+		return sieveErr(n.line, "%s does not take a block", n.name)
+	}
+	return nil
+}
+
+// checkComparator
+// The comparators other than the two in RFC 5228 must be required
+func (p *sieveParser) checkComparator(a *sieveArg) error {
+	if a.kind != sieveString || a.isList() {
+		return sieveErr(a.line, ":comparator must be a string")
+	}
+	for _, c := range sieveComparators {
+		if a.text == c {
+			return nil
+		}
+	}
+	if !p.required["comparator-"+a.text] {
+		return sieveErr(a.line, "comparator %q needs require %q", a.text, "comparator-"+a.text)
+	}
+	return nil
+}
+
+// require
+// Add the extensions to what the rest of the script can use
+func (p *sieveParser) require(a *sieveArg) error {
+	exts := a.list
+	if !a.isList() {
+		exts = []string{a.text}
+	}
+	for _, e := range exts {
+		if strings.HasPrefix(e, "vnd.") {
+			p.vendor = true
+		} else if !isSieveExtension(e) {
+			return sieveErr(a.line, "unknown extension %q", e)
+		}
+		p.required[e] = true
+	}
+	return nil
+}
+
+// isSieveExtension
+func isSieveExtension(e string) bool {
+	for _, x := range SieveExtensions {
+		if e == x {
+			return true
+		}
+	}
+	return false
+}
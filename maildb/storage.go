@@ -0,0 +1,347 @@
+package maildb
+
+/*
+ * Copyright (C) 2020, Jim Lieb <lieb@sea-troll.net>
+ *
+ * This program is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 3 of the License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ *
+ * -------------
+ */
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Mail storage under a vmail root. The layout is dovecot's
+// mail_home = <root>/%d/%n with mail_location = maildir:~/Maildir.
+// A mailbox's home overrides the <root>/%d/%n part and is either
+// relative to the root or an absolute path inside it.
+
+// DefaultStorageMode
+// Mail homes and their Maildirs are only for the mailbox's uid
+const DefaultStorageMode os.FileMode = 0700
+
+// DefaultTrashDays
+// How long the storage of deleted mailboxes is kept
+const DefaultTrashDays = 30
+
+// TrashDir
+// Where deleted storage goes, in the root. A domain cannot start with a dot.
+const TrashDir = ".trash"
+
+// MaildirName
+// The Maildir in a mail home
+const MaildirName = "Maildir"
+
+// trashStampFormat
+// Appended to the mailbox name in the trash, in UTC
+const trashStampFormat = "20060102T150405Z"
+
+// Storage
+type Storage struct {
+	root      string
+	mode      os.FileMode
+	retention time.Duration
+}
+
+// NewStorage
+// The storage under root, an existing directory. Directories are made
+// with mode and deleted storage is kept for retentionDays.
+func NewStorage(root string, mode os.FileMode, retentionDays int) (*Storage, error) {
+	if root == "" {
+		return nil, ErrMdbStorageRoot
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := os.Stat(root); err != nil || !fi.IsDir() {
+		return nil, ErrMdbStorageRoot
+	}
+	if retentionDays < 0 {
+		return nil, ErrMdbStorageRetention
+	}
+	mode &= os.ModePerm
+	if mode == 0 {
+		mode = DefaultStorageMode
+	}
+	return &Storage{
+		root:      root,
+		mode:      mode,
+		retention: time.Duration(retentionDays) * 24 * time.Hour,
+	}, nil
+}
+
+// Root
+func (s *Storage) Root() string {
+	return s.root
+}
+
+// Trash
+func (s *Storage) Trash() string {
+	return filepath.Join(s.root, TrashDir)
+}
+
+// MailHome
+// What a mailbox's storage is made from, as dovecot sees it
+type MailHome struct {
+	user   string
+	lpart  string
+	domain string
+	home   string // "" is the root's default
+	uid    sql.NullInt64
+	gid    sql.NullInt64
+}
+
+// GetMailHome
+// The user's home and the uid and gid after the domain and
+// installation defaults
+func (tx *Tx) GetMailHome(user string) (*MailHome, error) {
+	if !tx.active() {
+		return nil, ErrMdbTransaction
+	}
+	vm, err := tx.GetVMailbox(user)
+	if err != nil {
+		return nil, err
+	}
+	mh := &MailHome{
+		user:   vm.a.Address(),
+		lpart:  vm.a.localpart,
+		domain: vm.a.d.Name(),
+	}
+	row := tx.queryRow("SELECT uid, gid, home FROM user_mailbox WHERE id = ?", vm.a.Id())
+	if err = row.Scan(&mh.uid, &mh.gid, &mh.home); err != nil {
+		return nil, err
+	}
+	return mh, nil
+}
+
+// User
+func (mh *MailHome) User() string {
+	return mh.user
+}
+
+// Path
+// Where the mail home is. It must be in the root but not the root
+// itself or in the trash. It must also be at least as deep as the
+// <domain>/<name> default so that it cannot be a domain's directory
+// with the homes of other mailboxes in it.
+func (s *Storage) Path(mh *MailHome) (string, error) {
+	var p string
+
+	switch {
+	case mh.home == "":
+		for _, n := range []string{mh.domain, mh.lpart} {
+			if n == "" || n == "." || n == ".." || strings.ContainsRune(n, '/') {
+				return "", ErrMdbStorageOutside
+			}
+		}
+		p = filepath.Join(s.root, mh.domain, mh.lpart)
+	case filepath.IsAbs(mh.home):
+		p = filepath.Clean(mh.home)
+	default:
+		p = filepath.Join(s.root, mh.home)
+	}
+	rel, err := filepath.Rel(s.root, p)
+	if err != nil || rel == "." || rel == ".." ||
+		strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", ErrMdbStorageOutside
+	}
+	parts := strings.Split(rel, string(filepath.Separator))
+	if parts[0] == TrashDir {
+		return "", ErrMdbStorageOutside
+	}
+	if len(parts) < 2 {
+		return "", ErrMdbStorageShallow
+	}
+	return p, nil
+}
+
+// mkdir
+// Make the directory with our mode and give it to the mailbox.
+// One that is already there is left alone.
+func (s *Storage) mkdir(dir string, mh *MailHome) error {
+	if err := os.Mkdir(dir, s.mode); err != nil {
+		if os.IsExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := os.Chmod(dir, s.mode); err != nil { // past the umask
+		return err
+	}
+	if mh.uid.Valid || mh.gid.Valid {
+		uid, gid := -1, -1
+		if mh.uid.Valid {
+			uid = int(mh.uid.Int64)
+		}
+		if mh.gid.Valid {
+			gid = int(mh.gid.Int64)
+		}
+		return os.Lchown(dir, uid, gid)
+	}
+	return nil
+}
+
+// Provision
+// Make the mail home and its Maildir before the first delivery.
+// The directories above the home are made if needed and left to
+// whoever owns the root.
+func (s *Storage) Provision(mh *MailHome) (string, error) {
+	p, err := s.Path(mh)
+	if err != nil {
+		return "", err
+	}
+	if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return "", err
+	}
+	md := filepath.Join(p, MaildirName)
+	for _, d := range []string{p, md,
+		filepath.Join(md, "cur"), filepath.Join(md, "new"), filepath.Join(md, "tmp")} {
+		if err = s.mkdir(d, mh); err != nil {
+			return "", err
+		}
+	}
+	return p, nil
+}
+
+// Remove
+// Move the mail home of a deleted mailbox to the trash and return where
+// it went. There is nothing to do if it was never delivered to.
+func (s *Storage) Remove(mh *MailHome, now time.Time) (string, error) {
+	p, err := s.Path(mh)
+	if err != nil {
+		return "", err
+	}
+	if _, err = os.Lstat(p); os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	if err = os.MkdirAll(s.Trash(), 0700); err != nil {
+		return "", err
+	}
+	name := strings.ReplaceAll(mh.user, string(filepath.Separator), "_")
+	t := filepath.Join(s.Trash(), name+"."+now.UTC().Format(trashStampFormat))
+	if _, err = os.Lstat(t); err == nil {
+		return "", ErrMdbStorageExists
+	}
+	if err = os.Rename(p, t); err != nil {
+		return "", err
+	}
+	return t, nil
+}
+
+// Move
+// Rename the storage when the mail home changes. The new place
+// must not be there already.
+func (s *Storage) Move(from, to *MailHome) error {
+	fp, tp, err := s.movePaths(from, to)
+	if err != nil || fp == "" {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(tp), 0755); err != nil {
+		return err
+	}
+	return os.Rename(fp, tp)
+}
+
+// RemoveDomain
+// Remove the <root>/<domain> directory once a domain rename has moved
+// the homes out of it so that a later domain of that name does not get
+// it. One that still has something in it, or is not there, is left.
+func (s *Storage) RemoveDomain(domain string) error {
+	if domain == "" || domain == "." || domain == ".." || domain == TrashDir ||
+		strings.ContainsRune(domain, '/') {
+		return ErrMdbStorageOutside
+	}
+	dir := filepath.Join(s.root, domain)
+	fl, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if len(fl) > 0 {
+		return nil
+	}
+	return os.Remove(dir)
+}
+
+// CheckMove
+// The mistakes Move would find without moving anything, so that they
+// can stop the transaction that changes the mail home before it commits.
+func (s *Storage) CheckMove(from, to *MailHome) error {
+	_, _, err := s.movePaths(from, to)
+	return err
+}
+
+// movePaths
+// What Move renames, or "" if there is nothing to move
+func (s *Storage) movePaths(from, to *MailHome) (string, string, error) {
+	fp, err := s.Path(from)
+	if err != nil {
+		return "", "", err
+	}
+	tp, err := s.Path(to)
+	if err != nil {
+		return "", "", err
+	}
+	if fp == tp {
+		return "", "", nil
+	}
+	if _, err = os.Lstat(fp); os.IsNotExist(err) {
+		return "", "", nil
+	} else if err != nil {
+		return "", "", err
+	}
+	if _, err = os.Lstat(tp); err == nil {
+		return "", "", ErrMdbStorageExists
+	}
+	return fp, tp, nil
+}
+
+// Purge
+// Delete what has been in the trash longer than the retention period
+// and return what was deleted. Anything not put there by Remove stays.
+func (s *Storage) Purge(now time.Time) ([]string, error) {
+	var gone []string
+
+	dl, err := os.ReadDir(s.Trash())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, d := range dl {
+		dot := strings.LastIndex(d.Name(), ".")
+		if dot < 0 {
+			continue
+		}
+		t, err := time.Parse(trashStampFormat, d.Name()[dot+1:])
+		if err != nil || now.Sub(t) < s.retention {
+			continue
+		}
+		if err = os.RemoveAll(filepath.Join(s.Trash(), d.Name())); err != nil {
+			return gone, err
+		}
+		gone = append(gone, d.Name())
+	}
+	return gone, nil
+}
@@ -0,0 +1,190 @@
+package maildb
+
+/*
+ * Copyright (C) 2020, Jim Lieb <lieb@sea-troll.net>
+ *
+ * This program is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 3 of the License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ *
+ * -------------
+ */
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestStorage
+func TestStorage(t *testing.T) {
+	var (
+		err  error
+		mdb  *MailDB
+		dir  string
+		st   *Storage
+		luke *MailHome
+		leia *MailHome
+	)
+
+	fmt.Printf("Storage Test\n")
+
+	dir, err = ioutil.TempDir("", "TestStorage-*")
+	defer os.RemoveAll(dir)
+	mdb, err = makeTestDB(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Errorf("Database load failed, %s", err)
+		return
+	}
+	defer mdb.Close()
+	root := filepath.Join(dir, "vmail")
+
+	if _, err = NewStorage(root, 0, DefaultTrashDays); err != ErrMdbStorageRoot {
+		t.Errorf("No root: expected ErrMdbStorageRoot, got %v", err)
+	}
+	if err = os.Mkdir(root, 0755); err != nil {
+		t.Fatalf("Make root: %s", err)
+	}
+	if _, err = NewStorage(root, 0, -1); err != ErrMdbStorageRetention {
+		t.Errorf("Negative retention: expected ErrMdbStorageRetention, got %v", err)
+	}
+	if st, err = NewStorage(root, 0750, 7); err != nil {
+		t.Fatalf("New storage: %s", err)
+	}
+
+	// We can only give the storage to ourselves unless we are root
+	me, mygrp := int64(os.Getuid()), int64(os.Getgid())
+	err = mdb.WithTx(func(tx *Tx) error {
+		d, err := tx.InsertDomain("skywalker")
+		if err == nil {
+			err = d.SetClass("vmailbox")
+		}
+		if err == nil {
+			err = d.SetVGid(mygrp)
+		}
+		if err != nil {
+			return err
+		}
+		vm, err := tx.InsertVMailbox("luke@skywalker")
+		if err == nil {
+			err = vm.SetUid(me)
+		}
+		if err != nil {
+			return err
+		}
+		vm, err = tx.InsertVMailbox("leia@skywalker")
+		if err == nil {
+			err = vm.SetHome("rebels/leia")
+		}
+		if err != nil {
+			return err
+		}
+		if luke, err = tx.GetMailHome("luke@skywalker"); err != nil {
+			return err
+		}
+		leia, err = tx.GetMailHome("leia@skywalker")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Make mailboxes: %s", err)
+	}
+
+	p, err := st.Provision(luke)
+	if err != nil || p != filepath.Join(root, "skywalker", "luke") {
+		t.Errorf("Provision luke: got %q, %v", p, err)
+	}
+	for _, d := range []string{"", "Maildir", "Maildir/cur", "Maildir/new", "Maildir/tmp"} {
+		fi, err := os.Stat(filepath.Join(p, d))
+		if err != nil {
+			t.Errorf("Provision luke %q: %s", d, err)
+			continue
+		}
+		sys := fi.Sys().(*syscall.Stat_t)
+		if !fi.IsDir() || fi.Mode().Perm() != 0750 ||
+			int64(sys.Uid) != me || int64(sys.Gid) != mygrp {
+			t.Errorf("Provision luke %q: got %v %d:%d", d, fi.Mode(), sys.Uid, sys.Gid)
+		}
+	}
+	if _, err = st.Provision(luke); err != nil {
+		t.Errorf("Provision luke again: %s", err)
+	}
+	if p, err = st.Path(leia); err != nil || p != filepath.Join(root, "rebels", "leia") {
+		t.Errorf("Path leia: got %q, %v", p, err)
+	}
+
+	// Homes that are not ours
+	for _, h := range []string{"..", "../elsewhere", "/etc", root, TrashDir + "/leia"} {
+		if _, err = st.Path(&MailHome{user: "x@skywalker", home: h}); err != ErrMdbStorageOutside {
+			t.Errorf("Path %q: expected ErrMdbStorageOutside, got %v", h, err)
+		}
+	}
+	if _, err = st.Path(&MailHome{user: "x@skywalker", lpart: "..", domain: "skywalker"}); err != ErrMdbStorageOutside {
+		t.Errorf("Path ..@skywalker: expected ErrMdbStorageOutside, got %v", err)
+	}
+
+	// A home that is a domain's directory would take its other mailboxes
+	// along when it is removed or moved
+	for _, h := range []string{"skywalker", "rebels", "./skywalker", filepath.Join(root, "skywalker"), "rebels/../skywalker"} {
+		if _, err = st.Path(&MailHome{user: "x@skywalker", home: h}); err != ErrMdbStorageShallow {
+			t.Errorf("Path %q: expected ErrMdbStorageShallow, got %v", h, err)
+		}
+	}
+	if _, err = st.Remove(&MailHome{user: "x@skywalker", home: "skywalker"}, time.Now()); err != ErrMdbStorageShallow {
+		t.Errorf("Remove skywalker: expected ErrMdbStorageShallow, got %v", err)
+	}
+	if fi, err := os.Stat(filepath.Join(root, "skywalker", "luke")); err != nil || !fi.IsDir() {
+		t.Errorf("Remove skywalker: luke's home is gone, %v", err)
+	}
+
+	// Move luke to leia's home which is not there yet, then back
+	if err = st.Move(luke, leia); err != nil {
+		t.Errorf("Move luke: %s", err)
+	}
+	if _, err = os.Stat(filepath.Join(root, "rebels", "leia", "Maildir", "new")); err != nil {
+		t.Errorf("Move luke: %s", err)
+	}
+	if _, err = st.Provision(luke); err != nil {
+		t.Errorf("Provision luke after move: %s", err)
+	}
+	if err = st.Move(leia, luke); err != ErrMdbStorageExists {
+		t.Errorf("Move onto luke: expected ErrMdbStorageExists, got %v", err)
+	}
+
+	// Trash and purge
+	now := time.Now()
+	tp, err := st.Remove(leia, now.Add(-8*24*time.Hour))
+	if err != nil || filepath.Dir(tp) != st.Trash() {
+		t.Errorf("Remove leia: got %q, %v", tp, err)
+	}
+	if tp, err = st.Remove(leia, now); err != nil || tp != "" {
+		t.Errorf("Remove leia again: got %q, %v", tp, err)
+	}
+	if tp, err = st.Remove(luke, now); err != nil || tp == "" {
+		t.Errorf("Remove luke: got %q, %v", tp, err)
+	}
+	if err = os.Mkdir(filepath.Join(st.Trash(), "keepme"), 0700); err != nil {
+		t.Errorf("Make keepme: %s", err)
+	}
+	gone, err := st.Purge(now)
+	if err != nil || len(gone) != 1 || filepath.Join(st.Trash(), gone[0]) == tp {
+		t.Errorf("Purge: expected leia's storage, got %v, %v", gone, err)
+	}
+	dl, err := os.ReadDir(st.Trash())
+	if err != nil || len(dl) != 2 {
+		t.Errorf("Purge: expected luke and keepme left, got %v, %v", dl, err)
+	}
+}
@@ -4,9 +4,36 @@ go test -run=TestDecode
 go test -run=TestTarget
 go test -run=TestTransport
 go test -run=TestDBdefaults
+go test -run=TestTransaction
+go test -run=TestConcurrentTx
+go test -run=TestContext
+go test -run=TestRetry
+go test -run=TestScript
+go test -run=TestLoadSchema
 go test -run=TestAccess
 go test -run=Test_Transport
 go test -run=TestDomain
+go test -run=TestRename$
+go test -run=TestAliasDomain
 go test -run=TestAddress
 go test -run=TestAliasOps
 go test -run=TestMailbox
+go test -run=TestProtocols
+go test -run=TestRenameMailbox
+go test -run=TestCredential
+go test -run=TestPwPolicy
+go test -run=TestQuotaUsage
+go test -run=TestSieveCheck
+go test -run=TestSieveScripts
+go test -run=TestVacation
+go test -run=TestForward
+go test -run=TestStorage
+go test -run=TestPassword
+go test -run=TestVerifyPassword
+go test -run=TestMigrate
+go test -run=TestAudit
+go test -run=TestBackup
+go test -run=TestCheck
+go test -run=TestDialect
+go test -run=TestPgScripts
+go test -run=TestAddressLocal
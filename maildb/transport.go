@@ -21,6 +21,7 @@ package maildb
  */
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"strings"
@@ -31,6 +32,7 @@ import (
 // Transport DB table
 type Transport struct {
 	mdb       *MailDB
+	tx        *Tx // nil unless from a transaction
 	id        int64
 	name      string
 	transport sql.NullString
@@ -39,9 +41,9 @@ type Transport struct {
 
 // getTransportById
 // make a Transport without transaction
-func (mdb *MailDB) getTransportById(id int64) (*Transport, error) {
+func (mdb *MailDB) getTransportById(ctx context.Context, id int64) (*Transport, error) {
 	tr := &Transport{mdb: mdb, id: id}
-	row := mdb.db.QueryRow(
+	row := mdb.db.QueryRowContext(ctx,
 		"SELECT name, transport, nexthop FROM transport WHERE id = ?", id)
 	switch err := row.Scan(&tr.name, &tr.transport, &tr.nexthop); err {
 	case sql.ErrNoRows:
@@ -53,11 +55,11 @@ func (mdb *MailDB) getTransportById(id int64) (*Transport, error) {
 	}
 }
 
-// getTransportByIdTx
-// make a Transport witn a transaction
-func (mdb *MailDB) getTransportByIdTx(id int64) (*Transport, error) {
-	tr := &Transport{mdb: mdb, id: id}
-	row := mdb.tx.QueryRow(
+// getTransportById
+// make a Transport within a transaction
+func (tx *Tx) getTransportById(id int64) (*Transport, error) {
+	tr := &Transport{mdb: tx.mdb, tx: tx, id: id}
+	row := tx.queryRow(
 		"SELECT name, transport, nexthop FROM transport WHERE id = ?", id)
 	switch err := row.Scan(&tr.name, &tr.transport, &tr.nexthop); err {
 	case sql.ErrNoRows:
@@ -72,6 +74,12 @@ func (mdb *MailDB) getTransportByIdTx(id int64) (*Transport, error) {
 // LookupTransport
 // outside transactions
 func (mdb *MailDB) LookupTransport(name string) (*Transport, error) {
+	return mdb.LookupTransportContext(context.Background(), name)
+}
+
+// LookupTransportContext
+// LookupTransport that gives up when ctx is done
+func (mdb *MailDB) LookupTransportContext(ctx context.Context, name string) (*Transport, error) {
 	if name == "" {
 		return nil, ErrMdbBadName
 	}
@@ -79,7 +87,7 @@ func (mdb *MailDB) LookupTransport(name string) (*Transport, error) {
 		name: name,
 		mdb:  mdb,
 	}
-	row := mdb.db.QueryRow("SELECT id, transport, nexthop FROM transport WHERE name = ?", name)
+	row := mdb.db.QueryRowContext(ctx, "SELECT id, transport, nexthop FROM transport WHERE name = ?", name)
 	switch err := row.Scan(&tr.id, &tr.transport, &tr.nexthop); err {
 	case sql.ErrNoRows:
 		return nil, ErrMdbTransNotFound
@@ -94,6 +102,12 @@ func (mdb *MailDB) LookupTransport(name string) (*Transport, error) {
 // '*' find all transport rules
 // 'something*something' find matching names
 func (mdb *MailDB) FindTransport(name string) ([]*Transport, error) {
+	return mdb.FindTransportContext(context.Background(), name)
+}
+
+// FindTransportContext
+// FindTransport that gives up when ctx is done
+func (mdb *MailDB) FindTransportContext(ctx context.Context, name string) ([]*Transport, error) {
 	var (
 		err  error
 		rows *sql.Rows
@@ -103,11 +117,11 @@ func (mdb *MailDB) FindTransport(name string) ([]*Transport, error) {
 	)
 	if name == "*" {
 		q = `SELECT id, name, transport, nexthop FROM transport ORDER BY name`
-		rows, err = mdb.db.Query(q)
+		rows, err = mdb.db.QueryContext(ctx, q)
 	} else {
 		name = strings.ReplaceAll(name, "*", "%")
 		q = `SELECT id, name, transport, nexthop FROM transport WHERE name LIKE ? ORDER BY name`
-		rows, err = mdb.db.Query(q, name)
+		rows, err = mdb.db.QueryContext(ctx, q, name)
 	}
 	if err != nil {
 		return nil, err
@@ -139,18 +153,19 @@ func (mdb *MailDB) FindTransport(name string) ([]*Transport, error) {
 
 // GetTransport
 // inside transactions
-func (mdb *MailDB) GetTransport(name string) (*Transport, error) {
+func (tx *Tx) GetTransport(name string) (*Transport, error) {
 	if name == "" {
 		return nil, ErrMdbBadName
 	}
 	tr := &Transport{
 		name: name,
-		mdb:  mdb,
+		mdb:  tx.mdb,
+		tx:   tx,
 	}
-	if mdb.tx == nil {
+	if !tx.active() {
 		return nil, ErrMdbTransaction
 	}
-	row := mdb.tx.QueryRow("SELECT id, transport, nexthop FROM transport WHERE name = ?", name)
+	row := tx.queryRow("SELECT id, transport, nexthop FROM transport WHERE name = ?", name)
 	switch err := row.Scan(&tr.id, &tr.transport, &tr.nexthop); err {
 	case sql.ErrNoRows:
 		return nil, ErrMdbTransNotFound
@@ -162,7 +177,7 @@ func (mdb *MailDB) GetTransport(name string) (*Transport, error) {
 }
 
 // InsertTransport
-func (mdb *MailDB) InsertTransport(name string) (*Transport, error) {
+func (tx *Tx) InsertTransport(name string) (*Transport, error) {
 	var (
 		res sql.Result
 		err error
@@ -170,10 +185,10 @@ func (mdb *MailDB) InsertTransport(name string) (*Transport, error) {
 	if name == "" {
 		return nil, ErrMdbBadName
 	}
-	if mdb.tx == nil {
+	if !tx.active() {
 		return nil, ErrMdbTransaction
 	}
-	res, err = mdb.tx.Exec("INSERT INTO transport (name) VALUES (?)", name)
+	res, err = tx.insert("INSERT INTO transport (name) VALUES (?)", name)
 	if err != nil {
 		if IsErrConstraintUnique(err) {
 			err = ErrMdbDupTrans
@@ -181,7 +196,8 @@ func (mdb *MailDB) InsertTransport(name string) (*Transport, error) {
 	} else {
 		if trID, err := res.LastInsertId(); err == nil {
 			tr := &Transport{
-				mdb:  mdb,
+				mdb:  tx.mdb,
+				tx:   tx,
 				id:   trID,
 				name: name,
 			}
@@ -191,6 +207,27 @@ func (mdb *MailDB) InsertTransport(name string) (*Transport, error) {
 	return nil, err
 }
 
+// RenameTransport
+// Change the name in place so the domains and addresses that use
+// the transport keep it.
+func (tx *Tx) RenameTransport(old string, new string) (*Transport, error) {
+	if new == "" {
+		return nil, ErrMdbBadName
+	}
+	tr, err := tx.GetTransport(old)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = tx.exec("UPDATE transport SET name = ? WHERE id = ?", new, tr.id); err != nil {
+		if IsErrConstraintUnique(err) {
+			err = ErrMdbDupTrans
+		}
+		return nil, err
+	}
+	tr.name = new
+	return tr, nil
+}
+
 // Name
 func (tr *Transport) Name() string {
 	return tr.name
@@ -239,7 +276,7 @@ func (tr *Transport) SetTransport(trans string) error {
 		err       error
 	)
 
-	if tr.mdb.tx == nil {
+	if !tr.tx.active() {
 		return ErrMdbTransaction
 	}
 	if trans == "" {
@@ -247,7 +284,7 @@ func (tr *Transport) SetTransport(trans string) error {
 	} else {
 		transport = sql.NullString{Valid: true, String: trans}
 	}
-	res, err := tr.mdb.tx.Exec("UPDATE transport SET transport = ? WHERE id = ?", transport, tr.id)
+	res, err := tr.tx.exec("UPDATE transport SET transport = ? WHERE id = ?", transport, tr.id)
 	if err == nil {
 		c, err := res.RowsAffected()
 		if err == nil {
@@ -263,10 +300,10 @@ func (tr *Transport) SetTransport(trans string) error {
 
 // ClearTransport
 func (tr *Transport) ClearTransport() error {
-	if tr.mdb.tx == nil {
+	if !tr.tx.active() {
 		return ErrMdbTransaction
 	}
-	res, err := tr.mdb.tx.Exec("UPDATE transport SET transport = NULL WHERE id = ?", tr.id)
+	res, err := tr.tx.exec("UPDATE transport SET transport = NULL WHERE id = ?", tr.id)
 	if err == nil {
 		c, err := res.RowsAffected()
 		if err == nil {
@@ -287,7 +324,7 @@ func (tr *Transport) SetNexthop(hop string) error {
 		err     error
 	)
 
-	if tr.mdb.tx == nil {
+	if !tr.tx.active() {
 		return ErrMdbTransaction
 	}
 	if hop == "" {
@@ -295,7 +332,7 @@ func (tr *Transport) SetNexthop(hop string) error {
 	} else {
 		nexthop = sql.NullString{Valid: true, String: hop}
 	}
-	res, err := tr.mdb.tx.Exec("UPDATE transport SET nexthop = ? WHERE id = ?", nexthop, tr.id)
+	res, err := tr.tx.exec("UPDATE transport SET nexthop = ? WHERE id = ?", nexthop, tr.id)
 	if err == nil {
 		c, err := res.RowsAffected()
 		if err == nil {
@@ -311,10 +348,10 @@ func (tr *Transport) SetNexthop(hop string) error {
 
 // ClearNexthop
 func (tr *Transport) ClearNexthop() error {
-	if tr.mdb.tx == nil {
+	if !tr.tx.active() {
 		return ErrMdbTransaction
 	}
-	res, err := tr.mdb.tx.Exec("UPDATE transport SET nexthop = NULL WHERE id = ?", tr.id)
+	res, err := tr.tx.exec("UPDATE transport SET nexthop = NULL WHERE id = ?", tr.id)
 	if err == nil {
 		c, err := res.RowsAffected()
 		if err == nil {
@@ -329,8 +366,8 @@ func (tr *Transport) ClearNexthop() error {
 }
 
 // DeleteTransport
-func (mdb *MailDB) DeleteTransport(name string) error {
-	res, err := mdb.db.Exec("DELETE FROM transport WHERE name = ?", name)
+func (tx *Tx) DeleteTransport(name string) error {
+	res, err := tx.exec("DELETE FROM transport WHERE name = ?", name)
 	if err != nil {
 		if IsErrConstraintForeignKey(err) {
 			err = ErrMdbTransBusy
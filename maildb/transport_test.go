@@ -34,6 +34,7 @@ import (
 // Test_Transport
 func Test_Transport(t *testing.T) {
 	var (
+		tx  *Tx
 		err error
 		mdb *MailDB
 		dir string
@@ -60,7 +61,7 @@ func Test_Transport(t *testing.T) {
 	}
 
 	// Try to insert an transport without a transaction
-	tr, err = mdb.InsertTransport("dovecot")
+	tr, err = tx.InsertTransport("dovecot")
 	if err == nil {
 		t.Errorf("Insert with no transaction did not fail")
 		return
@@ -70,11 +71,11 @@ func Test_Transport(t *testing.T) {
 	}
 
 	// Insert a transport
-	mdb.Begin()
-	tr, err = mdb.InsertTransport("dovecot")
+	tx = beginTx(t, mdb)
+	tr, err = tx.InsertTransport("dovecot")
 	if err != nil {
 		t.Errorf("Insert transport dovecot: %s", err)
-		mdb.End(&err)
+		tx.End(&err)
 		return
 	} else {
 		if tr.Name() != "dovecot" {
@@ -93,7 +94,7 @@ func Test_Transport(t *testing.T) {
 		if err = tr.SetNexthop("localhost:24"); err != nil {
 		}
 	}
-	mdb.End(&err)
+	tx.End(&err)
 
 	// See if it has the right fields
 	trans := tr.Transport()
@@ -131,7 +132,7 @@ func Test_Transport(t *testing.T) {
 	}
 
 	// get it without a transaction
-	tr, err = mdb.GetTransport("dovecot")
+	tr, err = tx.GetTransport("dovecot")
 	if err == nil {
 		t.Errorf("Get of dovecot with no transaction did not fail")
 	} else if err != ErrMdbTransaction {
@@ -139,11 +140,11 @@ func Test_Transport(t *testing.T) {
 	}
 
 	// get it
-	mdb.Begin()
-	tr, err = mdb.GetTransport("dovecot")
+	tx = beginTx(t, mdb)
+	tr, err = tx.GetTransport("dovecot")
 	if err != nil {
 		t.Errorf("Get dovecot: %s", err)
-		mdb.End(&err)
+		tx.End(&err)
 		return
 	}
 	// set transport and nexthop
@@ -155,7 +156,7 @@ func Test_Transport(t *testing.T) {
 	if err != nil {
 		t.Errorf("Set nomad: %s", err)
 	}
-	mdb.End(&err)
+	tx.End(&err)
 
 	// Now check it
 	tr, err = mdb.LookupTransport("dovecot")
@@ -176,11 +177,11 @@ func Test_Transport(t *testing.T) {
 	}
 
 	// get it to test for null entry
-	mdb.Begin()
-	tr, err = mdb.GetTransport("dovecot")
+	tx = beginTx(t, mdb)
+	tr, err = tx.GetTransport("dovecot")
 	if err != nil {
 		t.Errorf("Get dovecot: %s", err)
-		mdb.End(&err)
+		tx.End(&err)
 		return
 	}
 	// clear transport and nexthop
@@ -192,7 +193,7 @@ func Test_Transport(t *testing.T) {
 	if err != nil {
 		t.Errorf("Clear nexthop failed: %s", err)
 	}
-	mdb.End(&err)
+	tx.End(&err)
 
 	// Now check it
 	tr, err = mdb.LookupTransport("dovecot")
@@ -210,28 +211,28 @@ func Test_Transport(t *testing.T) {
 	}
 
 	// load some more transports and then find them
-	mdb.Begin()
-	tr, err = mdb.InsertTransport("spam")
+	tx = beginTx(t, mdb)
+	tr, err = tx.InsertTransport("spam")
 	if err != nil {
 		t.Errorf("Insert spam: %s", err)
-		mdb.End(&err)
+		tx.End(&err)
 		return
 	} else {
 		if err = tr.SetNexthop("/dev/null"); err != nil {
 			t.Errorf("Insert spam: set nexthop failed, %s", err)
 		}
 	}
-	tr, err = mdb.InsertTransport("local")
+	tr, err = tx.InsertTransport("local")
 	if err != nil {
 		t.Errorf("Insert local: %s", err)
-		mdb.End(&err)
+		tx.End(&err)
 		return
 	} else {
 		if err = tr.SetTransport("mailbox"); err != nil {
 			t.Errorf("Insert local: set transport mailbox failed. %s", err)
 		}
 	}
-	mdb.End(&err)
+	tx.End(&err)
 	if tl, err = mdb.FindTransport("dovecot"); err != nil {
 		t.Errorf("FindTransport dovecot, unexpected error, %s", err)
 	} else if len(tl) != 1 {
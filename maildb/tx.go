@@ -0,0 +1,202 @@
+package maildb
+
+/*
+ * Copyright (C) 2020, Jim Lieb <lieb@sea-troll.net>
+ *
+ * This program is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 3 of the License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ *
+ * -------------
+ */
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// Tx
+// A transaction. Everything that changes the database, and the reads
+// that have to see those changes, are done through one of these.
+// A Tx is used by one goroutine at a time but a MailDB can have
+// any number of them going at once.
+//
+// The objects a Tx returns, Domain, Address etc., carry it with them
+// so their Set/Clear methods are part of the same transaction. Objects
+// from the Lookup/Find methods have no transaction and can't be changed.
+//
+// Everything done in a Tx uses the context it was started with. If that
+// is cancelled, the work in progress fails and the transaction is rolled back.
+type Tx struct {
+	mdb *MailDB
+	ctx context.Context
+	tx  *sql.Tx // nil once the transaction has ended
+}
+
+// Begin
+// Start a transaction. Every successful Begin must have an End.
+func (mdb *MailDB) Begin() (*Tx, error) {
+	return mdb.BeginContext(context.Background())
+}
+
+// BeginContext
+// Begin a transaction that lives no longer than ctx. If another
+// writer has the database, back off and try again per the retry policy.
+func (mdb *MailDB) BeginContext(ctx context.Context) (*Tx, error) {
+	if mdb.db == nil {
+		return nil, ErrMdbNotOpen
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	mdb.auditing() // look before the tx holds a connection
+	p := mdb.retryPolicy()
+	stx, err := mdb.db.BeginTx(ctx, nil)
+	for attempt := 1; err != nil && attempt < p.Attempts && mdb.dialect.busy(err); attempt++ {
+		if e := mdb.backoff(ctx, p, attempt); e != nil {
+			return nil, e
+		}
+		stx, err = mdb.db.BeginTx(ctx, nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Begin: %w", err)
+	}
+	if err = mdb.setAuditContext(ctx, stx); err != nil {
+		stx.Rollback()
+		return nil, fmt.Errorf("Begin: audit context, %s", err)
+	}
+	mdb.mu.Lock()
+	mdb.txCount++
+	mdb.mu.Unlock()
+	return &Tx{mdb: mdb, ctx: ctx, tx: stx}, nil
+}
+
+// End
+// This is deferred so pass a reference to the error var
+// Commit on no errors, rollback otherwise. If the commit
+// fails, that becomes the error.
+func (tx *Tx) End(err *error) {
+	if !tx.active() {
+		if *err == nil {
+			*err = ErrMdbTransaction
+		}
+		return
+	}
+	stx := tx.tx
+	tx.tx = nil
+	defer func() {
+		tx.mdb.mu.Lock()
+		tx.mdb.txCount--
+		tx.mdb.mu.Unlock()
+	}()
+	if *err != nil {
+		stx.Rollback()
+		return
+	}
+	if e := tx.mdb.clearAuditContext(tx.ctx, stx); e != nil {
+		stx.Rollback()
+		*err = fmt.Errorf("End: audit context, %s", e)
+	} else if e = stx.Commit(); e != nil {
+		*err = fmt.Errorf("End: commit, %w", e)
+	}
+}
+
+// WithTx
+// Run fn in a transaction. Commit if fn returns nil and roll back
+// if it returns an error or panics. If the database was busy, it is all
+// tried again per the retry policy so fn must not have side effects
+// outside the transaction.
+func (mdb *MailDB) WithTx(fn func(*Tx) error) (err error) {
+	return mdb.WithTxContext(context.Background(), fn)
+}
+
+// WithTxContext
+// WithTx in a transaction that lives no longer than ctx
+func (mdb *MailDB) WithTxContext(ctx context.Context, fn func(*Tx) error) error {
+	p := mdb.retryPolicy()
+	for attempt := 1; ; attempt++ {
+		tx, err := mdb.BeginContext(ctx) // does its own retries
+		if err != nil {
+			return err
+		}
+		err = tx.run(fn)
+		if err == nil || attempt >= p.Attempts || !mdb.dialect.busy(err) {
+			return err
+		}
+		if e := mdb.backoff(ctx, p, attempt); e != nil {
+			return e
+		}
+	}
+}
+
+// run
+// fn and then End the transaction
+func (tx *Tx) run(fn func(*Tx) error) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			abort := fmt.Errorf("WithTx: panic, %v", p)
+			tx.End(&abort)
+			panic(p)
+		}
+		tx.End(&err)
+	}()
+	return fn(tx)
+}
+
+// Context
+// The context this transaction was started with
+func (tx *Tx) Context() context.Context {
+	if tx == nil || tx.ctx == nil {
+		return context.Background()
+	}
+	return tx.ctx
+}
+
+// active
+// A nil Tx or one that has ended can't be used
+func (tx *Tx) active() bool {
+	return tx != nil && tx.tx != nil
+}
+
+// exec
+// Do a change in this transaction
+func (tx *Tx) exec(query string, args ...interface{}) (sql.Result, error) {
+	if !tx.active() {
+		return nil, ErrMdbTransaction
+	}
+	return tx.tx.ExecContext(tx.ctx, query, args...)
+}
+
+// insert
+// Do an INSERT in this transaction. The result's LastInsertId is
+// the id of the new row whatever the engine.
+func (tx *Tx) insert(query string, args ...interface{}) (sql.Result, error) {
+	if !tx.active() {
+		return nil, ErrMdbTransaction
+	}
+	return tx.mdb.dialect.insert(tx.ctx, tx.tx, query, args...)
+}
+
+// queryRow
+// Do a single row query in this transaction. The caller has
+// already checked that it is active.
+func (tx *Tx) queryRow(query string, args ...interface{}) *sql.Row {
+	return tx.tx.QueryRowContext(tx.ctx, query, args...)
+}
+
+// query
+// Do a query in this transaction. Same rules as queryRow.
+func (tx *Tx) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.tx.QueryContext(tx.ctx, query, args...)
+}
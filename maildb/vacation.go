@@ -0,0 +1,518 @@
+package maildb
+
+/*
+ * Copyright (C) 2020, Jim Lieb <lieb@sea-troll.net>
+ *
+ * This program is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 3 of the License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ *
+ * -------------
+ */
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// VacationScript
+// The name of the Sieve script made from a mailbox's Vacation
+const VacationScript = "vacation"
+
+// VacationDateFormat
+// How the start and end dates are stored and given to Sieve
+const VacationDateFormat = "2006-01-02"
+
+// Vacation
+// The out of office reply of a mailbox. It is sent by the Sieve
+// "vacation" script postdove makes from it. The dates are in the
+// server's time zone and either can be unset for no limit.
+type Vacation struct {
+	mdb          *MailDB
+	tx           *Tx // nil unless from a transaction
+	mailbox      int64
+	user         string
+	subject      sql.NullString
+	body         string
+	start        sql.NullString
+	end          sql.NullString
+	days         int64
+	addresses    sql.NullString
+	previous     sql.NullString
+	modified     string
+	scriptActive int64
+}
+
+// vacationQuery
+// The vacation of a mailbox and whether its script is the active one
+const vacationQuery = `SELECT v.mailbox, v.subject, v.body, v.start_date, v.end_date,
+ v.days, v.addresses, v.previous, v.modified,
+ COALESCE((SELECT s.active FROM sievescript AS s
+           WHERE s.mailbox = v.mailbox AND s.name = '` + VacationScript + `'), 0)
+ FROM vacation AS v WHERE v.mailbox = ?`
+
+// scan
+func (v *Vacation) scan() []interface{} {
+	return []interface{}{&v.mailbox, &v.subject, &v.body, &v.start, &v.end,
+		&v.days, &v.addresses, &v.previous, &v.modified, &v.scriptActive}
+}
+
+// LookupVacation
+// outside transactions
+func (mdb *MailDB) LookupVacation(user string) (*Vacation, error) {
+	return mdb.LookupVacationContext(context.Background(), user)
+}
+
+// LookupVacationContext
+// LookupVacation that gives up when ctx is done
+func (mdb *MailDB) LookupVacationContext(ctx context.Context, user string) (*Vacation, error) {
+	vm, err := mdb.LookupVMailboxContext(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	return mdb.lookupVacation(ctx, vm, user)
+}
+
+// lookupVacation
+func (mdb *MailDB) lookupVacation(ctx context.Context, vm *VMailbox, user string) (*Vacation, error) {
+	v := &Vacation{mdb: mdb, user: user}
+	row := mdb.db.QueryRowContext(ctx, vacationQuery, vm.a.Id())
+	switch err := row.Scan(v.scan()...); err {
+	case sql.ErrNoRows:
+		return nil, ErrMdbVacationNotFound
+	case nil:
+		return v, nil
+	default:
+		return nil, err
+	}
+}
+
+// FindVacations
+// The vacations of the mailboxes matching user, in FindVMailbox order.
+// Mailboxes without one are skipped.
+func (mdb *MailDB) FindVacations(user string) ([]*Vacation, error) {
+	return mdb.FindVacationsContext(context.Background(), user)
+}
+
+// FindVacationsContext
+// FindVacations that gives up when ctx is done
+func (mdb *MailDB) FindVacationsContext(ctx context.Context, user string) ([]*Vacation, error) {
+	var vl []*Vacation
+
+	ml, err := mdb.FindVMailboxContext(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range ml {
+		v, err := mdb.lookupVacation(ctx, m, m.a.Address())
+		if err == ErrMdbVacationNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		vl = append(vl, v)
+	}
+	if len(vl) == 0 {
+		return nil, ErrMdbVacationNotFound
+	}
+	return vl, nil
+}
+
+// GetVacation
+// inside transactions
+func (tx *Tx) GetVacation(user string) (*Vacation, error) {
+	if !tx.active() {
+		return nil, ErrMdbTransaction
+	}
+	vm, err := tx.GetVMailbox(user)
+	if err != nil {
+		return nil, err
+	}
+	v := &Vacation{mdb: tx.mdb, tx: tx, user: user}
+	row := tx.queryRow(vacationQuery, vm.a.Id())
+	switch err := row.Scan(v.scan()...); err {
+	case sql.ErrNoRows:
+		return nil, ErrMdbVacationNotFound
+	case nil:
+		return v, nil
+	default:
+		return nil, err
+	}
+}
+
+// InsertVacation
+// Give the user's mailbox a vacation. It has no message yet so
+// nothing is sent until it has one and is applied.
+func (tx *Tx) InsertVacation(user string) (*Vacation, error) {
+	if !tx.active() {
+		return nil, ErrMdbTransaction
+	}
+	vm, err := tx.GetVMailbox(user)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = tx.exec("INSERT INTO vacation (mailbox) VALUES (?)", vm.a.Id()); err != nil {
+		if IsErrConstraintUnique(err) {
+			err = ErrMdbDupVacation
+		}
+		return nil, err
+	}
+	return tx.GetVacation(user)
+}
+
+// DeleteVacation
+// Remove the user's vacation and its script. The script that was
+// active before it is made active again.
+func (tx *Tx) DeleteVacation(user string) error {
+	v, err := tx.GetVacation(user)
+	if err != nil {
+		return err
+	}
+	if s, err := tx.GetSieveScript(user, VacationScript); err == nil {
+		if err = tx.DeleteSieveScript(user, VacationScript); err != nil {
+			return err
+		}
+		if s.IsActive() && v.previous.Valid {
+			p, err := tx.GetSieveScript(user, v.previous.String)
+			if err == nil {
+				err = p.Activate()
+			}
+			if err != nil && err != ErrMdbSieveNotFound {
+				return err
+			}
+		}
+	} else if err != ErrMdbSieveNotFound {
+		return err
+	}
+	res, err := tx.exec("DELETE FROM vacation WHERE mailbox = ?", v.mailbox)
+	if err == nil {
+		n, err := res.RowsAffected()
+		if err == nil && n == 0 {
+			return ErrMdbVacationNotFound
+		}
+	}
+	return err
+}
+
+// User
+func (v *Vacation) User() string {
+	return v.user
+}
+
+// Subject
+// The subject of the reply. Sieve makes one from the message's if empty.
+func (v *Vacation) Subject() string {
+	return v.subject.String
+}
+
+// Body
+func (v *Vacation) Body() string {
+	return v.body
+}
+
+// Start
+// The first day of the vacation, the zero time if there is none
+func (v *Vacation) Start() time.Time {
+	return vacationDate(v.start)
+}
+
+// End
+// The last day of the vacation, the zero time if there is none
+func (v *Vacation) End() time.Time {
+	return vacationDate(v.end)
+}
+
+// vacationDate
+func vacationDate(d sql.NullString) time.Time {
+	if !d.Valid {
+		return time.Time{}
+	}
+	t, err := time.ParseInLocation(VacationDateFormat, d.String, time.Local)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// Days
+// How many days before the same sender is replied to again
+func (v *Vacation) Days() int64 {
+	return v.days
+}
+
+// Addresses
+// The other addresses of the mailbox that mail to it can be sent to
+func (v *Vacation) Addresses() []string {
+	if !v.addresses.Valid || v.addresses.String == "" {
+		return nil
+	}
+	return strings.Split(v.addresses.String, ",")
+}
+
+// Previous
+// The script that was active before the vacation's, "" if none
+func (v *Vacation) Previous() string {
+	return v.previous.String
+}
+
+// Modified
+// When the vacation was last changed, in UTC
+func (v *Vacation) Modified() time.Time {
+	return parseStamp(v.modified)
+}
+
+// IsActive
+// Is the vacation script the one run at delivery? It still only
+// replies between the dates.
+func (v *Vacation) IsActive() bool {
+	return v.scriptActive != 0
+}
+
+// Status
+// "inactive" if its script is not run, "scheduled" if now is before
+// the start, "expired" if after the end, and "active" otherwise.
+func (v *Vacation) Status(now time.Time) string {
+	today := now.Format(VacationDateFormat)
+	switch {
+	case !v.IsActive():
+		return "inactive"
+	case v.start.Valid && today < v.start.String:
+		return "scheduled"
+	case v.end.Valid && today > v.end.String:
+		return "expired"
+	default:
+		return "active"
+	}
+}
+
+// update
+// Set columns of this vacation. cols is "col = ?, ..." for vals
+func (v *Vacation) update(cols string, vals ...interface{}) error {
+	if v.tx == nil || !v.tx.active() {
+		return ErrMdbTransaction
+	}
+	now := time.Now().UTC().Format(AuditStampFormat)
+	vals = append(vals, now, v.mailbox)
+	res, err := v.tx.exec("UPDATE vacation SET "+cols+", modified = ? WHERE mailbox = ?", vals...)
+	if err == nil {
+		n, err := res.RowsAffected()
+		if err == nil && n != 1 {
+			return ErrMdbBadUpdate
+		}
+	}
+	if err == nil {
+		v.modified = now
+	}
+	return err
+}
+
+// nullString
+// An empty s is NULL
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// SetSubject
+func (v *Vacation) SetSubject(subject string) error {
+	subject = strings.TrimSpace(subject)
+	if err := v.update("subject = ?", nullString(subject)); err != nil {
+		return err
+	}
+	v.subject = nullString(subject)
+	return nil
+}
+
+// SetBody
+// The reply message. It cannot be empty.
+func (v *Vacation) SetBody(body string) error {
+	if strings.TrimSpace(body) == "" {
+		return ErrMdbVacationNoBody
+	}
+	if err := v.update("body = ?", body); err != nil {
+		return err
+	}
+	v.body = body
+	return nil
+}
+
+// SetDates
+// The first and last days of the vacation. A zero time is no limit.
+func (v *Vacation) SetDates(start time.Time, end time.Time) error {
+	var s, e sql.NullString
+
+	if !start.IsZero() {
+		s = nullString(start.Format(VacationDateFormat))
+	}
+	if !end.IsZero() {
+		e = nullString(end.Format(VacationDateFormat))
+	}
+	if s.Valid && e.Valid && e.String < s.String {
+		return ErrMdbVacationDates
+	}
+	if err := v.update("start_date = ?, end_date = ?", s, e); err != nil {
+		return err
+	}
+	v.start, v.end = s, e
+	return nil
+}
+
+// SetDays
+// How many days before the same sender is replied to again
+func (v *Vacation) SetDays(days int64) error {
+	if days < 1 {
+		return ErrMdbVacationDays
+	}
+	if err := v.update("days = ?", days); err != nil {
+		return err
+	}
+	v.days = days
+	return nil
+}
+
+// SetAddresses
+// Replace the other addresses of the mailbox. Each must be a good
+// RFC822 address.
+func (v *Vacation) SetAddresses(addrs []string) error {
+	var al []string
+
+	for _, a := range addrs {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+		if _, err := DecodeRFC822(a); err != nil {
+			return err
+		}
+		al = append(al, a)
+	}
+	addresses := nullString(strings.Join(al, ","))
+	if err := v.update("addresses = ?", addresses); err != nil {
+		return err
+	}
+	v.addresses = addresses
+	return nil
+}
+
+// sieveQuote
+// s as a Sieve quoted string
+func sieveQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
+
+// Script
+// The Sieve script of the vacation. The dates are tested at delivery
+// so the replies start and stop on their own. The script that was
+// active before is included after it so its filtering still happens.
+func (v *Vacation) Script() string {
+	var (
+		b      strings.Builder
+		tests  []string
+		indent string
+	)
+
+	req := []string{`"vacation"`}
+	if v.start.Valid {
+		tests = append(tests, `currentdate :value "ge" "date" `+sieveQuote(v.start.String))
+	}
+	if v.end.Valid {
+		tests = append(tests, `currentdate :value "le" "date" `+sieveQuote(v.end.String))
+	}
+	if len(tests) > 0 {
+		req = append(req, `"date"`, `"relational"`)
+	}
+	if v.previous.Valid {
+		req = append(req, `"include"`)
+	}
+	fmt.Fprintf(&b, "# Made by postdove from the vacation of %s. Changes here are lost.\n", v.user)
+	fmt.Fprintf(&b, "require [%s];\n", strings.Join(req, ", "))
+	if len(tests) > 0 {
+		fmt.Fprintf(&b, "if allof (%s) {\n", strings.Join(tests, ",\n          "))
+		indent = "  "
+	}
+	fmt.Fprintf(&b, "%svacation :days %d", indent, v.days)
+	if v.subject.Valid {
+		fmt.Fprintf(&b, " :subject %s", sieveQuote(v.subject.String))
+	}
+	if al := v.Addresses(); len(al) > 0 {
+		ql := make([]string, len(al))
+		for i, a := range al {
+			ql[i] = sieveQuote(a)
+		}
+		fmt.Fprintf(&b, " :addresses [%s]", strings.Join(ql, ", "))
+	}
+	b.WriteString(" text:\n")
+	body := strings.ReplaceAll(strings.ReplaceAll(v.body, "\r\n", "\n"), "\r", "\n")
+	for _, l := range strings.Split(strings.TrimSuffix(body, "\n"), "\n") {
+		if strings.HasPrefix(l, ".") {
+			l = "." + l // dot-stuffing
+		}
+		b.WriteString(l + "\n")
+	}
+	b.WriteString(".\n;\n")
+	if len(tests) > 0 {
+		b.WriteString("}\n")
+	}
+	if v.previous.Valid {
+		fmt.Fprintf(&b, "include :personal :optional %s;\n", sieveQuote(v.previous.String))
+	}
+	return b.String()
+}
+
+// Apply
+// Make or replace the vacation script and make it the active one.
+// The script active before it is kept to be included and to be made
+// active again when the vacation is deleted.
+func (v *Vacation) Apply() error {
+	var (
+		s    *SieveScript
+		name string
+		err  error
+	)
+
+	if v.tx == nil || !v.tx.active() {
+		return ErrMdbTransaction
+	}
+	if strings.TrimSpace(v.body) == "" {
+		return ErrMdbVacationNoBody
+	}
+	row := v.tx.queryRow("SELECT name FROM sievescript WHERE mailbox = ? AND active = 1", v.mailbox)
+	switch err = row.Scan(&name); err {
+	case sql.ErrNoRows:
+	case nil:
+		if name != VacationScript && name != v.previous.String {
+			if err = v.update("previous = ?", name); err != nil {
+				return err
+			}
+			v.previous = nullString(name)
+		}
+	default:
+		return err
+	}
+	if s, err = v.tx.GetSieveScript(v.user, VacationScript); err == ErrMdbSieveNotFound {
+		s, err = v.tx.insertSieveScript(v.user, VacationScript, v.Script())
+	} else if err == nil && s.Script() != v.Script() {
+		err = s.SetScript(v.Script())
+	}
+	if err != nil {
+		return err
+	}
+	if err = s.Activate(); err != nil {
+		return err
+	}
+	v.scriptActive = 1
+	return nil
+}
@@ -0,0 +1,234 @@
+package maildb
+
+/*
+ * Copyright (C) 2020, Jim Lieb <lieb@sea-troll.net>
+ *
+ * This program is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 3 of the License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA
+ *
+ * -------------
+ */
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestVacation
+func TestVacation(t *testing.T) {
+	var (
+		err error
+		mdb *MailDB
+		dir string
+		v   *Vacation
+		cnt int
+	)
+
+	fmt.Printf("Vacation Test\n")
+
+	dir, err = ioutil.TempDir("", "TestVacation-*")
+	defer os.RemoveAll(dir)
+	mdb, err = makeTestDB(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Errorf("Database load failed, %s", err)
+		return
+	}
+	defer mdb.Close()
+
+	start := time.Date(2026, 7, 1, 0, 0, 0, 0, time.Local)
+	end := time.Date(2026, 7, 14, 0, 0, 0, 0, time.Local)
+	spam := "require \"fileinto\";\nif header :contains \"subject\" \"SPAM\" { fileinto \"Junk\"; }\n"
+	err = mdb.WithTx(func(tx *Tx) error {
+		d, err := tx.InsertDomain("skywalker")
+		if err == nil {
+			err = d.SetClass("vmailbox")
+		}
+		for _, u := range []string{"luke", "leia"} {
+			if err != nil {
+				break
+			}
+			_, err = tx.InsertVMailbox(u + "@skywalker")
+		}
+		if err != nil {
+			return err
+		}
+		s, err := tx.InsertSieveScript("luke@skywalker", "spam", spam)
+		if err == nil {
+			err = s.Activate()
+		}
+		if err != nil {
+			return err
+		}
+		if v, err = tx.InsertVacation("luke@skywalker"); err != nil {
+			return err
+		}
+		if err = v.Apply(); err != ErrMdbVacationNoBody {
+			return fmt.Errorf("apply without body: expected ErrMdbVacationNoBody, got %v", err)
+		}
+		if err = v.SetSubject("On \"Dagobah\""); err != nil {
+			return err
+		}
+		if err = v.SetBody("Training.\n.Back soon\n"); err != nil {
+			return err
+		}
+		if err = v.SetDates(start, end); err != nil {
+			return err
+		}
+		if err = v.SetAddresses([]string{"luke@rebels", " red5@rebels "}); err != nil {
+			return err
+		}
+		if err = v.Apply(); err != nil {
+			return err
+		}
+		v, err = tx.InsertVacation("leia@skywalker")
+		if err == nil {
+			err = v.SetBody("Busy")
+		}
+		if err == nil {
+			err = v.Apply()
+		}
+		return err
+	})
+	if err != nil {
+		t.Errorf("Insert of vacations failed, %s", err)
+		return
+	}
+
+	// Mistakes
+	err = mdb.WithTx(func(tx *Tx) error {
+		if _, err := tx.InsertVacation("luke@skywalker"); err != ErrMdbDupVacation {
+			return fmt.Errorf("dup luke: expected ErrMdbDupVacation, got %v", err)
+		}
+		if _, err := tx.InsertVacation("han@skywalker"); err != ErrMdbAddressNotFound {
+			return fmt.Errorf("han: expected ErrMdbAddressNotFound, got %v", err)
+		}
+		v, err := tx.GetVacation("luke@skywalker")
+		if err != nil {
+			return err
+		}
+		if err = v.SetDates(end, start); err != ErrMdbVacationDates {
+			return fmt.Errorf("backward dates: expected ErrMdbVacationDates, got %v", err)
+		}
+		if err = v.SetDays(0); err != ErrMdbVacationDays {
+			return fmt.Errorf("days 0: expected ErrMdbVacationDays, got %v", err)
+		}
+		if err = v.SetBody(" \n"); err != ErrMdbVacationNoBody {
+			return fmt.Errorf("empty body: expected ErrMdbVacationNoBody, got %v", err)
+		}
+		if err = v.SetAddresses([]string{"luke@rebels", "red{5}@rebels"}); err != ErrMdbAddrIllegalChars {
+			return fmt.Errorf("bad address: expected ErrMdbAddrIllegalChars, got %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Vacation mistakes: %s", err)
+	}
+
+	// The script is made, checked and active in place of spam
+	if v, err = mdb.LookupVacation("luke@skywalker"); err != nil {
+		t.Fatalf("Lookup luke: %s", err)
+	}
+	if v.Previous() != "spam" || !v.IsActive() || !v.Start().Equal(start) ||
+		!v.End().Equal(end) || len(v.Addresses()) != 2 || v.Days() != 7 {
+		t.Errorf("Lookup luke: got previous %q, active %v, %s to %s, %v, %d days",
+			v.Previous(), v.IsActive(), v.Start(), v.End(), v.Addresses(), v.Days())
+	}
+	s, err := mdb.LookupSieveScript("luke@skywalker", VacationScript)
+	if err != nil || !s.IsActive() || s.Script() != v.Script() {
+		t.Fatalf("Lookup luke script: expected the active vacation, got %v", err)
+	}
+	for _, want := range []string{
+		`require ["vacation", "date", "relational", "include"];`,
+		`currentdate :value "ge" "date" "2026-07-01"`,
+		`currentdate :value "le" "date" "2026-07-14"`,
+		`:subject "On \"Dagobah\"" :addresses ["luke@rebels", "red5@rebels"] text:`,
+		"\n..Back soon\n.\n;\n}\n",
+		`include :personal :optional "spam";`,
+	} {
+		if !strings.Contains(s.Script(), want) {
+			t.Errorf("Luke script: expected %q in %q", want, s.Script())
+		}
+	}
+	if err = CheckSieve(s.Script()); err != nil {
+		t.Errorf("Luke script: %s", err)
+	}
+	for now, want := range map[string]string{
+		"2026-06-30": "scheduled", "2026-07-01": "active",
+		"2026-07-14": "active", "2026-07-15": "expired",
+	} {
+		day, _ := time.ParseInLocation(VacationDateFormat, now, time.Local)
+		if st := v.Status(day.Add(12 * time.Hour)); st != want {
+			t.Errorf("Luke status on %s: expected %s, got %s", now, want, st)
+		}
+	}
+	if vl, err := mdb.FindVacations("*@skywalker"); err != nil || len(vl) != 2 {
+		t.Errorf("Find vacations: expected 2, got %d, %v", len(vl), err)
+	} else {
+		for _, fv := range vl {
+			if fv.User() == "leia@skywalker" &&
+				(fv.Status(start) != "active" || strings.Contains(fv.Script(), "if ")) {
+				t.Errorf("Find vacations: leia's has no dates, got %s, %q", fv.Status(start), fv.Script())
+			}
+		}
+	}
+
+	// Changes make a new version, delete puts spam back
+	err = mdb.WithTx(func(tx *Tx) error {
+		v, err := tx.GetVacation("luke@skywalker")
+		if err == nil {
+			err = v.SetDates(start, time.Time{})
+		}
+		if err == nil {
+			err = v.Apply()
+		}
+		return err
+	})
+	if err != nil {
+		t.Errorf("Change luke: %s", err)
+	}
+	if s, err = mdb.LookupSieveScript("luke@skywalker", VacationScript); err != nil ||
+		s.Version() != 2 || strings.Contains(s.Script(), `"le"`) {
+		t.Errorf("Luke script after change: expected version 2 without an end, got %v", err)
+	}
+	err = mdb.WithTx(func(tx *Tx) error {
+		if err := tx.DeleteVacation("luke@skywalker"); err != nil {
+			return err
+		}
+		if err := tx.DeleteVacation("luke@skywalker"); err != ErrMdbVacationNotFound {
+			return fmt.Errorf("delete luke again: expected ErrMdbVacationNotFound, got %v", err)
+		}
+		return tx.DeleteVMailbox("leia@skywalker")
+	})
+	if err != nil {
+		t.Errorf("Delete vacations: %s", err)
+	}
+	if s, err = mdb.LookupSieveScript("luke@skywalker", "spam"); err != nil || !s.IsActive() {
+		t.Errorf("Luke spam after delete: expected active, got %v", err)
+	}
+	if _, err = mdb.LookupSieveScript("luke@skywalker", VacationScript); err != ErrMdbSieveNotFound {
+		t.Errorf("Luke vacation script after delete: expected ErrMdbSieveNotFound, got %v", err)
+	}
+	if _, err = mdb.FindVacations("*@*"); err != ErrMdbVacationNotFound {
+		t.Errorf("Find after delete: expected ErrMdbVacationNotFound, got %v", err)
+	}
+	row := mdb.db.QueryRow("SELECT count(*) FROM audit WHERE entity = 'vacation'")
+	if err = row.Scan(&cnt); err != nil || cnt != 10 {
+		t.Errorf("Vacation audit: expected 10 records, got %d, %v", cnt, err)
+	}
+}